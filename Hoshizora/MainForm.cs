@@ -2,6 +2,7 @@ using System;
 using System.Drawing;
 using System.IO;
 using System.Linq;
+using System.Text;
 using System.Text.Json;
 using System.Threading.Tasks;
 using System.Windows.Forms;
@@ -464,8 +465,8 @@ namespace Hoshizora
                 if (!_nodeInitialized)
                 {
                     Log("Initializing node (DLL)...");
-                    int result = P2PNode.P2P_Init(
-                        HoshizoraConfig.EnvPassphrase,
+                    int result = P2PNode.InitSecure(
+                        Encoding.UTF8.GetBytes(HoshizoraConfig.EnvPassphrase ?? ""),
                         HoshizoraConfig.ApiPort,
                         HoshizoraConfig.ControlPort,
                         HoshizoraConfig.MulticastGroup,
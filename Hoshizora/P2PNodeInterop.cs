@@ -26,12 +26,52 @@ namespace Hoshizora
             string keySaverUrl,
             int forceNewEnv);
 
+        /// <summary>
+        /// Writes the passphrase into buf (at most cap bytes) and returns its length.
+        /// </summary>
+        [UnmanagedFunctionPointer(CallingConvention.Cdecl)]
+        public delegate int PassphraseCallback(IntPtr ctx, IntPtr buf, int cap);
+
+        /// <summary>
+        /// Called once the DLL has copied the passphrase; the host wipes its copy.
+        /// </summary>
+        [UnmanagedFunctionPointer(CallingConvention.Cdecl)]
+        public delegate void WipeCallback(IntPtr ctx);
+
+        /// <summary>
+        /// Initialize the P2P node, fetching the passphrase through a one-shot callback.
+        /// </summary>
+        [DllImport(DllName, CallingConvention = CallingConvention.Cdecl, CharSet = CharSet.Ansi)]
+        public static extern int P2P_InitSecure(
+            PassphraseCallback getPass,
+            WipeCallback wipe,
+            IntPtr ctx,
+            int apiPort,
+            int controlPort,
+            string mcGroup,
+            int mcPort,
+            string keySaverUrl,
+            int forceNewEnv);
+
         /// <summary>
         /// Start the P2P node services (discovery, HTTP servers).
         /// </summary>
         [DllImport(DllName, CallingConvention = CallingConvention.Cdecl)]
         public static extern int P2P_Start();
 
+        /// <summary>
+        /// Receives each node event as UTF-8 JSON; the pointer is only valid during the call.
+        /// </summary>
+        [UnmanagedFunctionPointer(CallingConvention.Cdecl)]
+        public delegate void EventCallback(IntPtr ctx, IntPtr json);
+
+        /// <summary>
+        /// Register (or, with null, unregister) the node event callback.
+        /// The delegate must be kept alive while registered.
+        /// </summary>
+        [DllImport(DllName, CallingConvention = CallingConvention.Cdecl)]
+        public static extern int P2P_SetEventCallback(EventCallback fn, IntPtr ctx);
+
         /// <summary>
         /// Stop all P2P services gracefully.
         /// </summary>
@@ -146,6 +186,49 @@ namespace Hoshizora
             }
         }
 
+        /// <summary>
+        /// Initialize via P2P_InitSecure. pass is handed to the DLL and zeroed
+        /// when the DLL asks for the host copy to be wiped (or on return).
+        /// </summary>
+        public static int InitSecure(byte[] pass, int apiPort, int controlPort, string mcGroup, int mcPort, string keySaverUrl, int forceNewEnv)
+        {
+            PassphraseCallback get = (ctx, buf, cap) =>
+            {
+                if (pass.Length > cap) return pass.Length;
+                Marshal.Copy(pass, 0, buf, pass.Length);
+                return pass.Length;
+            };
+            WipeCallback wipe = ctx => Array.Clear(pass, 0, pass.Length);
+            try
+            {
+                return P2P_InitSecure(get, wipe, IntPtr.Zero, apiPort, controlPort, mcGroup, mcPort, keySaverUrl, forceNewEnv);
+            }
+            finally
+            {
+                Array.Clear(pass, 0, pass.Length);
+                GC.KeepAlive(get);
+                GC.KeepAlive(wipe);
+            }
+        }
+
+        // Held so the GC doesn't collect the delegate the DLL calls.
+        private static EventCallback eventCallback;
+
+        /// <summary>
+        /// Receive node events (JSON) through handler, on a DLL thread; null stops them.
+        /// </summary>
+        public static int SetEventHandler(Action<string> handler)
+        {
+            EventCallback cb = null;
+            if (handler != null)
+            {
+                cb = (ctx, json) => handler(PtrToStringUtf8(json) ?? "");
+            }
+            int rc = P2P_SetEventCallback(cb, IntPtr.Zero);
+            eventCallback = cb;
+            return rc;
+        }
+
         /// <summary>
         /// Check if node is running.
         /// </summary>
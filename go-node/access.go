@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Access log. With --access-log on, every decryption this node does for
+// /chunks/decrypt or a recovery appends an "access" block to its chain:
+// the block accessed, the time, how (decrypt or recover), the caller's
+// ?user= hint and the outcome, signed with the receipt key (see escrow.go).
+// Access blocks carry no chunk and replicate like receipts, so a node that
+// is later compromised can't quietly drop what it decrypted. With
+// --access-log salted the block names only HMAC-SHA256(access.salt, hash);
+// whoever holds the node's salt can still test a suspected file. The mode
+// is flag-only and always reported as access_log on /status.
+
+const (
+	blockAccess    = "access"
+	accessSaltFile = "access.salt"
+
+	accessOff    = "off"
+	accessOn     = "on"
+	accessSalted = "salted"
+
+	accessViaDecrypt = "decrypt"
+	accessViaRecover = "recover"
+
+	accessOK         = "ok"
+	accessFailed     = "failed"
+	accessUserMaxLen = 64
+)
+
+func validateAccessLog(m string) error {
+	switch m {
+	case accessOff, accessOn, accessSalted:
+		return nil
+	}
+	return fmt.Errorf("--access-log must be off, on or salted, got %q", m)
+}
+
+// accessRecord is the payload of an access block.
+type accessRecord struct {
+	Block   string `json:"block"`            // data block, or its salted hash
+	Salted  bool   `json:"salted,omitempty"` // Block is HMAC-SHA256(salt, hash)
+	At      int64  `json:"at_unix"`
+	Via     string `json:"via"`            // decrypt or recover
+	User    string `json:"user,omitempty"` // caller's hint, unverified
+	Outcome string `json:"outcome"`        // ok or failed
+	Signer  string `json:"signer"`         // Ed25519 public key, base64
+	Sig     string `json:"sig"`
+}
+
+func (ac *accessRecord) body(origin string) []byte {
+	return fmt.Appendf(nil, "%s|%s|%s|%t|%d|%s|%s|%s|%s", blockAccess, origin, ac.Block, ac.Salted, ac.At, ac.Via, ac.User, ac.Outcome, ac.Signer)
+}
+
+// digest is the access block's hash; it covers the signature too.
+func (ac *accessRecord) digest(origin string) string {
+	return sha256Hex(append(ac.body(origin), ac.Sig...))
+}
+
+func (b Block) isAccess() bool { return b.Kind == blockAccess }
+
+// verifyAccess checks an access block's signature and hash.
+func verifyAccess(b Block) error {
+	ac := b.Access
+	if ac == nil || !b.isAccess() {
+		return errors.New("not an access record")
+	}
+	if err := verifySig(ac.Signer, ac.Sig, ac.body(b.OriginID)); err != nil {
+		return err
+	}
+	if b.Hash != ac.digest(b.OriginID) {
+		return errors.New("block hash is not the access digest")
+	}
+	return nil
+}
+
+// accessSalt loads the node's salt for salted access records, creating it
+// on first use. Keep it with the node's backups: without it a salted
+// record can't be matched to a file.
+func accessSalt(paths *EnvPaths) ([]byte, error) {
+	fp := filepath.Join(paths.BaseDir, accessSaltFile)
+	if b, err := os.ReadFile(fp); err == nil {
+		salt, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+		if err != nil || len(salt) != 32 {
+			return nil, fmt.Errorf("%s: bad salt", fp)
+		}
+		return salt, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(fp, []byte(base64.StdEncoding.EncodeToString(salt))); err != nil {
+		return nil, err
+	}
+	log.Printf("[access] created access log salt %s", fp)
+	return salt, nil
+}
+
+// saltedHash is what a salted access record names instead of hash.
+func saltedHash(salt []byte, hash string) string {
+	m := hmac.New(sha256.New, salt)
+	m.Write([]byte(hash))
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// accessUser is the ?user= hint, trimmed to something fit for a block.
+func accessUser(r *http.Request) string {
+	u := strings.Map(func(c rune) rune {
+		if c < 0x20 || c == 0x7f || c == '|' {
+			return -1
+		}
+		return c
+	}, strings.TrimSpace(r.URL.Query().Get("user")))
+	if len(u) > accessUserMaxLen {
+		u = u[:accessUserMaxLen]
+	}
+	return u
+}
+
+// logAccess records one decryption of block hash when the access log is
+// on, and fans the record out in the background. Failing to record doesn't
+// fail the decryption; it is logged.
+func (s *Server) logAccess(hash, via, user, outcome string) {
+	if s.cfg.AccessLog == "" || s.cfg.AccessLog == accessOff {
+		return
+	}
+	blk, env, err := s.appendAccess(hash, via, user, outcome)
+	if err != nil {
+		log.Printf("[access] %s %s: not recorded: %v", via, hash, err)
+		return
+	}
+	envBytes, _ := json.Marshal(env)
+	go func() {
+		defer recoverOnce("access fanout")
+		t := s.transfers.start(transferSend, env.MsgID, blockAccess, blk.Hash)
+		s.fanoutWithQuorum(t, s.rankPeers(s.peers.List()), envBytes, nil, s.cfg.ReplicateQuorum)
+	}()
+}
+
+// appendAccess signs an access record, appends it to the chain and returns
+// the block and its envelope.
+func (s *Server) appendAccess(hash, via, user, outcome string) (Block, ReplicateEnvelope, error) {
+	priv, err := receiptKey(s.paths)
+	if err != nil {
+		return Block{}, ReplicateEnvelope{}, err
+	}
+	ac := &accessRecord{
+		Block:   hash,
+		At:      time.Now().Unix(),
+		Via:     via,
+		User:    user,
+		Outcome: outcome,
+		Signer:  base64.StdEncoding.EncodeToString(priv.Public().(ed25519.PublicKey)),
+	}
+	if s.cfg.AccessLog == accessSalted {
+		salt, err := accessSalt(s.paths)
+		if err != nil {
+			return Block{}, ReplicateEnvelope{}, err
+		}
+		ac.Block, ac.Salted = saltedHash(salt, hash), true
+	}
+	ac.Sig = base64.StdEncoding.EncodeToString(ed25519.Sign(priv, ac.body(s.id.NodeID)))
+	msgidBytes, err := secureRandom(16)
+	if err != nil {
+		return Block{}, ReplicateEnvelope{}, err
+	}
+	env := ReplicateEnvelope{
+		MsgID:    base64.RawURLEncoding.EncodeToString(msgidBytes),
+		OriginID: s.id.NodeID,
+		HashHex:  ac.digest(s.id.NodeID),
+		PrevHash: s.getChainTip(),
+		OrgID:    s.org.ID,
+		Created:  ac.At,
+		Logical:  s.lamport.tick(),
+		Kind:     blockAccess,
+		Access:   ac,
+	}
+	blk := Block{
+		Hash:     env.HashHex,
+		PrevHash: env.PrevHash,
+		Created:  env.Created,
+		OriginID: env.OriginID,
+		Logical:  env.Logical,
+		Kind:     env.Kind,
+		Access:   ac,
+	}
+	if err := s.appendBlock(blk); err != nil {
+		return Block{}, ReplicateEnvelope{}, err
+	}
+	s.seenMu.Lock()
+	s.seen[env.MsgID] = struct{}{}
+	s.seenMu.Unlock()
+	return blk, env, nil
+}
+
+// replicateAccess takes a peer's access block after checking it.
+func (s *Server) replicateAccess(w http.ResponseWriter, env ReplicateEnvelope, localTip string) {
+	blk := Block{
+		Hash:     env.HashHex,
+		PrevHash: env.PrevHash,
+		Created:  env.Created,
+		OriginID: env.OriginID,
+		Logical:  env.Logical,
+		Kind:     env.Kind,
+		Access:   env.Access,
+	}
+	if err := verifyAccess(blk); err != nil {
+		http.Error(w, "bad access record: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.replicateRecord(w, env, blk, localTip)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// Public (peer-facing) API versions. Each version N is served under /vN/...;
+// the unprefixed paths are v1 aliases kept for one release so older nodes
+// keep working, and answer with a Deprecation header.
+const (
+	apiVersion       = 1
+	apiVersionHeader = "X-API-Version"
+)
+
+var supportedAPIVersions = []int{1}
+
+func apiPrefix(v int) string {
+	return "/v" + strconv.Itoa(v)
+}
+
+// handleVersioned registers h under every supported version prefix plus the
+// deprecated unprefixed alias, which answers 426 once the unversioned-API
+// shim is off.
+func (s *Server) handleVersioned(mux *http.ServeMux, path string, h http.HandlerFunc) {
+	for _, v := range supportedAPIVersions {
+		mux.HandleFunc(apiPrefix(v)+path, h)
+	}
+	successor := apiPrefix(apiVersion) + path
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		if s.refuseLegacy(w, legacyUnversioned) {
+			return
+		}
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", "<"+successor+">; rel=\"successor-version\"")
+		h(w, r)
+	})
+}
+
+// negotiateAPI picks the newest version both sides speak. A peer that never
+// advertised one (pre-versioning node) gets 0, meaning unprefixed paths.
+func negotiateAPI(peerVersion int) int {
+	best := 0
+	for _, v := range supportedAPIVersions {
+		if v <= peerVersion && v > best {
+			best = v
+		}
+	}
+	return best
+}
+
+// peerPath maps an unversioned path to the one p should be called on.
+func peerPath(p PeerInfo, path string) string {
+	if v := negotiateAPI(p.APIVersion); v > 0 {
+		return apiPrefix(v) + path
+	}
+	return path
+}
+
+// GET /versions (public)
+func (s *Server) handleVersions(w http.ResponseWriter, r *http.Request) {
+	versions := make([]string, 0, len(supportedAPIVersions))
+	for _, v := range supportedAPIVersions {
+		versions = append(versions, apiPrefix(v)[1:])
+	}
+	writeJSON(w, map[string]any{
+		"current":               apiPrefix(apiVersion)[1:],
+		"supported":             versions,
+		"unprefixed_deprecated": true,
+	})
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// oldNode serves s's public API the way a node from before versioning did:
+// unprefixed paths only. It records the paths it was called on.
+type oldNode struct {
+	mu    sync.Mutex
+	paths []string
+}
+
+func (o *oldNode) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		o.mu.Lock()
+		o.paths = append(o.paths, r.URL.Path)
+		o.mu.Unlock()
+		if strings.HasPrefix(r.URL.Path, "/v1/") || r.URL.Path == "/versions" {
+			http.NotFound(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (o *oldNode) called(path string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, p := range o.paths {
+		if p == path {
+			return true
+		}
+	}
+	return false
+}
+
+// downgrade puts s behind an oldNode listener.
+func downgrade(t *testing.T, s *Server) *oldNode {
+	o := &oldNode{}
+	ts := httptest.NewServer(o.wrap(s.PublicHandler()))
+	t.Cleanup(ts.Close)
+	s.selfAddr = strings.TrimPrefix(ts.URL, "http://")
+	return o
+}
+
+// setAPI sets the API version a has on record for b.
+func setAPI(a, b *Server, v int) {
+	a.peers.mu.Lock()
+	p := a.peers.peers[b.id.NodeID]
+	p.APIVersion = v
+	a.peers.peers[b.id.NodeID] = p
+	a.peers.mu.Unlock()
+}
+
+func TestVersionedRoutes(t *testing.T) {
+	s := newTestServer(t, "v", nil)
+	h := s.PublicHandler()
+	for _, path := range []string{"/v1/peer-info", "/peer-info"} {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: HTTP %d", path, rr.Code)
+		}
+		if dep := rr.Header().Get("Deprecation"); (dep != "") != (path == "/peer-info") {
+			t.Fatalf("%s: Deprecation %q", path, dep)
+		}
+	}
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/versions", nil))
+	if !strings.Contains(rr.Body.String(), `"supported":["v1"]`) {
+		t.Fatalf("/versions: %s", rr.Body)
+	}
+	if negotiateAPI(0) != 0 || negotiateAPI(1) != 1 || negotiateAPI(7) != 1 {
+		t.Fatal("negotiateAPI")
+	}
+}
+
+func replicateOnce(t *testing.T, a, b *Server) string {
+	t.Helper()
+	sf, err := a.sealAndStore("f.txt", []byte("replicated"), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := a.peers.Get(b.id.NodeID)
+	if _, ok := a.replicateTo(p, sf.Hash, sf.Env, nil); !ok {
+		t.Fatal("replicate not acked")
+	}
+	if _, ok := b.haveChunk(sf.Hash); !ok {
+		t.Fatal("receiver has no chunk")
+	}
+	return sf.Hash
+}
+
+func TestReplicateNewClientOldServer(t *testing.T) {
+	for _, v := range []int{0, 1} { // 0: never advertised one; 1: downgraded since
+		a, b := newTestServer(t, "a", nil), newTestServer(t, "b", nil)
+		old := downgrade(t, b)
+		mesh(t, a, b)
+		setAPI(a, b, v)
+		replicateOnce(t, a, b)
+		if !old.called("/replicate") {
+			t.Fatalf("api %d: old node never got /replicate: %v", v, old.paths)
+		}
+		if v == 0 && old.called("/v1/replicate") {
+			t.Fatal("api 0: tried /v1 on a node that never advertised it")
+		}
+	}
+}
+
+func TestReplicateOldClientNewServer(t *testing.T) {
+	a, b := newTestServer(t, "a", nil), newTestServer(t, "b", nil)
+	sf, err := a.sealAndStore("f.txt", []byte("old client"), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// an old node posts to the unprefixed path
+	resp, err := http.Post("http://"+b.selfAddr+"/replicate", "application/json", bytes.NewReader(sf.Env))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("HTTP %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Deprecation") != "true" || !strings.Contains(resp.Header.Get("Link"), "/v1/replicate") {
+		t.Fatalf("no deprecation headers: %v", resp.Header)
+	}
+	if _, ok := b.haveChunk(sf.Hash); !ok {
+		t.Fatal("chunk not stored")
+	}
+}
+
+func TestRelayNewClientOldServer(t *testing.T) {
+	for _, v := range []int{0, 1} {
+		a, relay, c := newTestServer(t, "a", nil), newTestServer(t, "relay", nil), newTestServer(t, "c", nil)
+		old := downgrade(t, relay)
+		mesh(t, a, relay, c)
+		setAPI(a, relay, v)
+		res := sendText(t, a, c, "hops=2&class=bulk", "via an old relay")
+		if got := inboxText(t, c, res.MsgID); got != "via an old relay" {
+			t.Fatalf("api %d: got %q", v, got)
+		}
+		if !old.called("/mix/relay") {
+			t.Fatalf("api %d: old relay never got /mix/relay: %v", v, old.paths)
+		}
+	}
+}
+
+func TestRelayOldClientNewServer(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Quarantine = false // deliver the file straight to the inbox
+	a, c := newTestServer(t, "a", nil), newTestServer(t, "c", cfg)
+	mesh(t, a, c)
+	p, _ := a.peers.Get(c.id.NodeID)
+	hops := []hopInfo{{NodeID: c.id.NodeID, Addr: c.selfAddr, PubKey: p.PubKey, V: onionVersionFor(p)}}
+	env := FinalEnvelope{Type: "file", Name: "f", SenderID: a.id.NodeID, ReceiverID: c.id.NodeID, MsgID: "old-client", DataB64: "aGk"}
+	payload, _ := json.Marshal(env)
+	onion, err := buildOnion(hops, payload, mixTTL, env.MsgID, "", "bulk", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post("http://"+c.selfAddr+"/mix/relay", "application/json", bytes.NewReader(onion))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Deprecation") != "true" {
+		t.Fatalf("HTTP %d, Deprecation %q", resp.StatusCode, resp.Header.Get("Deprecation"))
+	}
+	if got := inboxText(t, c, "old-client"); got != "hi" {
+		t.Fatalf("got %q", got)
+	}
+}
@@ -0,0 +1,520 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Batch sends. POST /mix/send-batch takes a folder version as one multipart
+// upload: a manifest naming every file, then the files. Nothing is sealed
+// until the whole upload arrived and matches the manifest; then each file
+// gets its own key, chunk and block as in send-file, and every block carries
+// the BatchID. The members are appended back to back, so a peer has to take
+// them in chain order: the fanout goes peer by peer, member by member, and
+// stops on a peer at its first refusal. The batch is sealed once every
+// member reached the replicate quorum. The record (batches/<id>.json) keeps
+// per-member state, so a batch cut short by failures, a cancel or a restart
+// is left incomplete and POST /batches/<id>/resume delivers it again from
+// the local chunks.
+
+const (
+	batchesDir    = "batches"
+	batchMaxBytes = 512 << 20 // whole upload, buffered before sealing
+	batchMaxFiles = 10000
+
+	batchSending    = "sending"
+	batchSealed     = "sealed"
+	batchIncomplete = "incomplete"
+
+	memberStored  = "stored"  // sealed and in the chain, not yet at quorum
+	memberDurable = "durable" // acked by the quorum
+	memberShort   = "short"   // delivery ended below the quorum
+	memberFailed  = "failed"  // never stored, or its chunk is gone
+)
+
+// batchManifest is the first part of a send-batch upload.
+type batchManifest struct {
+	Label string   `json:"label,omitempty"` // e.g. the folder and its version
+	Files []string `json:"files"`           // relative paths, one part each
+}
+
+type batchMember struct {
+	Name  string `json:"name"`
+	Hash  string `json:"hash,omitempty"`
+	MsgID string `json:"msgid,omitempty"`
+	Size  int    `json:"size"`
+	State string `json:"state"`
+	Acked int    `json:"acked"`
+	Error string `json:"error,omitempty"`
+}
+
+type batchRecord struct {
+	ID      string        `json:"id"`
+	Label   string        `json:"label,omitempty"`
+	State   string        `json:"state"`
+	Created time.Time     `json:"created"`
+	Updated time.Time     `json:"updated"`
+	Quorum  int           `json:"quorum"` // acks per member, capped at the peers tried
+	Peers   int           `json:"peers"`
+	Resumed int           `json:"resumed,omitempty"`
+	Members []batchMember `json:"members"`
+}
+
+// counts returns how many members are durable and how many exist.
+func (b *batchRecord) counts() (durable, total int) {
+	for _, m := range b.Members {
+		if m.State == memberDurable {
+			durable++
+		}
+	}
+	return durable, len(b.Members)
+}
+
+type batchStore struct {
+	dir string
+
+	mu sync.Mutex
+	m  map[string]*batchRecord
+}
+
+// newBatchStore loads batches/. A batch still sending when the node stopped
+// is incomplete now.
+func newBatchStore(paths *EnvPaths) *batchStore {
+	bs := &batchStore{dir: filepath.Join(paths.BaseDir, batchesDir), m: make(map[string]*batchRecord)}
+	entries, err := os.ReadDir(bs.dir)
+	if err != nil {
+		return bs
+	}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(bs.dir, e.Name()))
+		if err != nil {
+			continue
+		}
+		var rec batchRecord
+		if err := json.Unmarshal(b, &rec); err != nil || rec.ID == "" {
+			log.Printf("[batch] ignoring bad %s", e.Name())
+			continue
+		}
+		if rec.State == batchSending {
+			rec.State = batchIncomplete
+			log.Printf("[batch] %s was interrupted; POST /batches/%s/resume to deliver it", rec.ID, rec.ID)
+		}
+		bs.m[rec.ID] = &rec
+	}
+	return bs
+}
+
+func (bs *batchStore) saveLocked(b *batchRecord) {
+	b.Updated = time.Now().UTC()
+	out, _ := json.MarshalIndent(b, "", "  ")
+	err := os.MkdirAll(bs.dir, 0700)
+	if err == nil {
+		err = writeFileAtomic(filepath.Join(bs.dir, b.ID+".json"), out)
+	}
+	if err != nil {
+		log.Printf("[batch] persist %s: %v", b.ID, err)
+	}
+}
+
+func (bs *batchStore) put(b *batchRecord) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	bs.m[b.ID] = b
+	bs.saveLocked(b)
+}
+
+func (bs *batchStore) get(id string) (batchRecord, bool) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	b, ok := bs.m[id]
+	if !ok {
+		return batchRecord{}, false
+	}
+	cp := *b
+	cp.Members = append([]batchMember(nil), b.Members...)
+	return cp, true
+}
+
+// list returns the batches newest first, without their members.
+func (bs *batchStore) list() []batchRecord {
+	bs.mu.Lock()
+	out := make([]batchRecord, 0, len(bs.m))
+	for _, b := range bs.m {
+		cp := *b
+		cp.Members = nil
+		out = append(out, cp)
+	}
+	bs.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Created.After(out[j].Created) })
+	return out
+}
+
+// update runs fn on batch id under the lock and persists it.
+func (bs *batchStore) update(id string, fn func(*batchRecord)) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if b, ok := bs.m[id]; ok {
+		fn(b)
+		bs.saveLocked(b)
+	}
+}
+
+// ack counts one peer ack for member i; true when it sealed the batch.
+func (bs *batchStore) ack(id string, i int) bool {
+	sealed := false
+	bs.update(id, func(b *batchRecord) {
+		m := &b.Members[i]
+		m.Acked++
+		if m.State == memberStored && m.Acked >= b.Quorum {
+			m.State = memberDurable
+			if d, n := b.counts(); d == n && b.State == batchSending {
+				b.State = batchSealed
+				sealed = true
+			}
+		}
+	})
+	return sealed
+}
+
+// settle ends a delivery run: members short of the quorum are marked, and
+// a batch that isn't sealed is incomplete.
+func (bs *batchStore) settle(id string) batchRecord {
+	bs.update(id, func(b *batchRecord) {
+		for i := range b.Members {
+			if b.Members[i].State == memberStored {
+				b.Members[i].State = memberShort
+			}
+		}
+		if b.State == batchSending {
+			b.State = batchIncomplete
+		}
+	})
+	rec, _ := bs.get(id)
+	return rec
+}
+
+func newBatchID() string {
+	b, err := secureRandom(9)
+	if err != nil {
+		return fmt.Sprintf("bat-%d", time.Now().UnixNano())
+	}
+	return "bat-" + base64.RawURLEncoding.EncodeToString(b)
+}
+
+// batchName checks a manifest path with cleanRelPath: relative,
+// slash-separated, no ".." and no drive letters.
+func batchName(name string) (string, bool) {
+	clean, err := cleanRelPath(name)
+	return clean, err == nil
+}
+
+// batchTarget is where recovery writes member name under outDir, keeping
+// its folders.
+func batchTarget(outDir, name string) (string, error) {
+	if clean, ok := batchName(name); ok {
+		return filepath.Join(outDir, filepath.FromSlash(clean)), nil
+	}
+	return safeJoin(outDir, sanitize(name))
+}
+
+// readBatchUpload reads the manifest part and then one file part per
+// manifest entry, keyed by the part's filename (folders kept, unlike
+// multipart.Part.FileName).
+func readBatchUpload(r *http.Request) (batchManifest, map[string][]byte, error) {
+	var man batchManifest
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return man, nil, fmt.Errorf("want multipart/form-data: %w", err)
+	}
+	p, err := mr.NextPart()
+	if err != nil || p.FormName() != "manifest" {
+		return man, nil, errors.New("the first part must be \"manifest\"")
+	}
+	if err := json.NewDecoder(io.LimitReader(p, 4<<20)).Decode(&man); err != nil {
+		return man, nil, fmt.Errorf("manifest: %w", err)
+	}
+	if len(man.Files) == 0 || len(man.Files) > batchMaxFiles {
+		return man, nil, fmt.Errorf("manifest: want 1 to %d files", batchMaxFiles)
+	}
+	want := make(map[string]bool, len(man.Files))
+	for i, f := range man.Files {
+		clean, ok := batchName(f)
+		if !ok {
+			return man, nil, fmt.Errorf("manifest: bad path %q", f)
+		}
+		if want[clean] {
+			return man, nil, fmt.Errorf("manifest: %q listed twice", clean)
+		}
+		want[clean] = true
+		man.Files[i] = clean
+	}
+	files := make(map[string][]byte, len(man.Files))
+	left := int64(batchMaxBytes)
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return man, nil, err
+		}
+		_, params, _ := mime.ParseMediaType(p.Header.Get("Content-Disposition"))
+		name, ok := batchName(params["filename"])
+		if !ok || !want[name] {
+			return man, nil, fmt.Errorf("part %q is not in the manifest", params["filename"])
+		}
+		if _, dup := files[name]; dup {
+			return man, nil, fmt.Errorf("%q sent twice", name)
+		}
+		data, err := io.ReadAll(io.LimitReader(p, left+1))
+		if err != nil {
+			return man, nil, err
+		}
+		if left -= int64(len(data)); left < 0 {
+			return man, nil, fmt.Errorf("batch larger than %d MiB", batchMaxBytes>>20)
+		}
+		files[name] = data
+	}
+	var missing []string
+	for _, f := range man.Files {
+		if _, ok := files[f]; !ok {
+			missing = append(missing, f)
+		}
+	}
+	if len(missing) > 0 {
+		return man, nil, fmt.Errorf("missing from the upload: %s", strings.Join(missing, ", "))
+	}
+	return man, files, nil
+}
+
+// POST /mix/send-batch (multipart: "manifest" JSON, then one part per file
+// with the manifest path as filename). Answers once the batch is sealed,
+// every peer was tried, or quorumWait elapsed; delivery goes on in the
+// background and GET /batches/<id> follows it.
+func (s *Server) handleSendBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	man, files, err := readBatchUpload(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var total int64
+	for _, data := range files {
+		total += int64(len(data))
+	}
+	id := newBatchID()
+	if err := s.checkDiskFor(total); err != nil {
+		s.writeDiskFull(w, id, err)
+		return
+	}
+
+	rec := &batchRecord{ID: id, Label: man.Label, State: batchSending, Created: time.Now().UTC()}
+	var failed error
+	for _, name := range man.Files {
+		m := batchMember{Name: name, Size: len(files[name]), State: memberFailed}
+		if failed == nil {
+			sf, err := s.sealAndStore(name, files[name], id, nil)
+			if err != nil {
+				failed = fmt.Errorf("%s: %w", name, err)
+				m.Error = err.Error()
+			} else {
+				m.Hash, m.MsgID, m.State = sf.Hash, sf.MsgID, memberStored
+			}
+		} else {
+			m.Error = "not stored: an earlier member failed"
+		}
+		rec.Members = append(rec.Members, m)
+		delete(files, name)
+	}
+	if failed != nil {
+		rec.State = batchIncomplete
+		s.batches.put(rec)
+		log.Printf("[batch] %s: %v", id, failed)
+		http.Error(w, fmt.Sprintf("batch %s incomplete: %v", id, failed), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("[batch] %s: %d files stored (%s)", id, len(rec.Members), man.Label)
+
+	hdr := http.Header{}
+	if r.URL.Query().Get("trace") == "1" {
+		hdr.Set(traceHeader, "1")
+	}
+	writeJSON(w, s.deliverBatch(rec, hdr))
+}
+
+// deliverBatch starts the fanout of rec (stored members only) and waits
+// like send-file for the outcome, up to quorumWait.
+func (s *Server) deliverBatch(rec *batchRecord, hdr http.Header) batchRecord {
+	peers := s.rankPeers(s.peers.List())
+	envs := make([][]byte, len(rec.Members))
+	for i, m := range rec.Members {
+		if m.State == memberStored {
+			envs[i] = s.batchEnvelope(m)
+		}
+	}
+	rec.State = batchSending
+	rec.Peers = len(peers)
+	rec.Quorum = min(s.cfg.ReplicateQuorum, len(peers))
+	s.batches.put(rec)
+
+	// the transfer ID is the BatchID: POST /transfers/<id>/cancel stops it
+	t := s.transfers.start(transferBatch, rec.ID, rec.Label, "")
+	s.transfers.update(t, func(t *transfer) { t.Peers = len(peers) })
+	sealed := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer recoverOnce("batch")
+		defer close(done)
+		defer s.transfers.finish(t)
+		s.fanoutBatch(t, rec.ID, peers, envs, hdr, sealed)
+	}()
+	select {
+	case <-sealed:
+	case <-done:
+	case <-t.ctx.Done():
+	case <-time.After(quorumWait):
+	}
+	out, _ := s.batches.get(rec.ID)
+	return out
+}
+
+// fanoutBatch offers the members to each peer in chain order. A refusal
+// ends that peer's run: it would refuse the members linked after it too.
+func (s *Server) fanoutBatch(t *transfer, id string, peers []PeerInfo, envs [][]byte, hdr http.Header, sealed chan struct{}) {
+	rec, _ := s.batches.get(id)
+	for _, p := range peers {
+		for i, env := range envs {
+			if t.ctx.Err() != nil {
+				log.Printf("[batch] %s cancelled before %.8s", id, p.NodeID)
+				s.settleBatch(id)
+				return
+			}
+			if env == nil {
+				continue
+			}
+			if !s.deliverTo(t, p, rec.Members[i].Hash, env, hdr) {
+				break
+			}
+			if s.batches.ack(id, i) {
+				log.Printf("[batch] %s sealed: every member at quorum %d", id, rec.Quorum)
+				close(sealed)
+			}
+		}
+	}
+	s.settleBatch(id)
+}
+
+func (s *Server) settleBatch(id string) {
+	rec := s.batches.settle(id)
+	if rec.State == batchIncomplete {
+		d, n := rec.counts()
+		log.Printf("[batch] %s incomplete: %d of %d members durable", id, d, n)
+	}
+}
+
+// batchEnvelope is member m's envelope: the cached one, else rebuilt from
+// the chunk on disk with its msgid. nil if the chunk is gone.
+func (s *Server) batchEnvelope(m batchMember) []byte {
+	key := "blob-" + m.Hash + "-" + m.Name
+	s.mu.RLock()
+	b, ok := s.kv[key]
+	s.mu.RUnlock()
+	if ok {
+		return b
+	}
+	b, ok = s.blobFromDisk(key)
+	if !ok {
+		return nil
+	}
+	var env ReplicateEnvelope
+	if json.Unmarshal(b, &env) != nil {
+		return nil
+	}
+	env.MsgID = m.MsgID
+	b, _ = json.Marshal(env)
+	return b
+}
+
+// ---- control API ----
+
+// GET /batches (control): batches newest first, without members.
+func (s *Server) handleBatches(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.batches.list())
+}
+
+// GET /batches/{id} (control): one batch with its member states.
+func (s *Server) handleBatchGet(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	rec, ok := s.batches.get(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "no such batch", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, rec)
+}
+
+// POST /batches/{id}/resume (control): deliver an incomplete batch again.
+// Members whose chunk is gone are marked failed; ones never stored stay
+// failed and have to be sent again.
+func (s *Server) handleBatchResume(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.PathValue("id")
+	var rec *batchRecord
+	var err error
+	s.batches.update(id, func(b *batchRecord) {
+		if b.State != batchIncomplete {
+			err = fmt.Errorf("batch is %s", b.State)
+			return
+		}
+		b.Resumed++
+		for i := range b.Members {
+			m := &b.Members[i]
+			if m.Hash == "" {
+				continue
+			}
+			// every peer is offered every member again; peers that hold
+			// the chunk ack without a transfer
+			m.Acked, m.State, m.Error = 0, memberStored, ""
+			if !fileExists(filepath.Join(s.paths.ChunksDir, m.Hash+".bin")) {
+				m.State, m.Error = memberFailed, "chunk missing"
+			}
+		}
+		cp := *b
+		cp.Members = append([]batchMember(nil), b.Members...)
+		rec = &cp
+	})
+	switch {
+	case rec == nil && err == nil:
+		http.Error(w, "no such batch", http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	log.Printf("[batch] %s resumed (%d)", id, rec.Resumed)
+	writeJSON(w, s.deliverBatch(rec, http.Header{}))
+}
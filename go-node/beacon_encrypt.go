@@ -13,6 +13,7 @@ import (
 var beaconMagic = []byte("MIXB1")
 
 func encryptBeaconWithKey(v any, key []byte) ([]byte, error) {
+	defer hBeaconSeal.time()()
 	aead, err := chacha20poly1305.NewX(key)
 	if err != nil {
 		return nil, err
@@ -32,6 +33,7 @@ func encryptBeaconWithKey(v any, key []byte) ([]byte, error) {
 }
 
 func decryptBeaconWithKey(pkt []byte, key []byte, out any) error {
+	defer hBeaconOpen.time()()
 	if len(pkt) <= len(beaconMagic)+chacha20poly1305.NonceSizeX {
 		return errors.New("packet too short")
 	}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Split advertisement. The beacon goes out every BroadcastIntv and must
+// stay within one unfragmented UDP datagram on small-MTU links, so it only
+// carries identity, port, chain tip and a profile generation. Everything
+// else (hostname, pubkey, caps, mode) is the profile, served on /peer-info
+// and fetched through the capability cache when a peer's generation
+// changes. Every beaconFullEvery-th beacon is a full one so nodes from
+// before the split still learn pubkeys.
+
+const (
+	beaconMaxBytes  = 1200 // safe UDP payload for the sealed beacon
+	beaconFullEvery = 20   // one full beacon per this many ticks
+)
+
+var errBeaconTooLarge = errors.New("beacon exceeds safe UDP payload")
+
+// beaconProfile numbers the versions of what minimal beacons leave out. Gen
+// starts at the process start time, so it also moves across restarts (which
+// bring a new mix keypair).
+type beaconProfile struct {
+	mu  sync.Mutex
+	key string
+	gen uint64
+}
+
+// beaconSource is what the broadcaster reads from the running node each
+// tick.
+type beaconSource interface {
+	beaconCaps() []string
+	profileGen() uint64
+	getChainTip() string
+	beaconPaused() bool
+	beaconPairings() *pairingStore
+	beaconIfaces() *ifaceWatch
+	mixKeyProof() mixKeyProof
+}
+
+// profileGen returns the current profile generation, bumping it if the
+// profile changed since the last call.
+func (s *Server) profileGen() uint64 {
+	key := strings.Join([]string{
+		s.id.Hostname,
+		base64.RawURLEncoding.EncodeToString(s.nodeKeys.Pub[:]),
+		s.cfg.Mode,
+		strings.Join(s.beaconCaps(), ","),
+	}, "|")
+	pr := &s.profile
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	switch {
+	case pr.gen == 0:
+		pr.gen = uint64(time.Now().Unix())
+	case key != pr.key:
+		pr.gen++
+	}
+	pr.key = key
+	return pr.gen
+}
+
+// beaconPaused is true once the identity was regenerated: the old NodeID
+// must not be announced any more.
+func (s *Server) beaconPaused() bool {
+	return s.retired.Load()
+}
+
+// sealBeacons seals b for the audiences mode calls for: the group key, each
+// pairing (pairings.go), or both. It returns errBeaconTooLarge, with the
+// packets, if any of them doesn't fit beaconMaxBytes; size is the largest.
+func sealBeacons(b Beacon, mode string, key []byte, pw *pairingStore) (pkts [][]byte, size int, err error) {
+	if mode != beaconModePairwise {
+		pkt, err := encryptBeaconWithKey(b, key)
+		if err != nil {
+			return nil, 0, err
+		}
+		pkts = append(pkts, pkt)
+	}
+	if mode != beaconModeGroup {
+		blobs, err := pw.seal(b)
+		if err != nil {
+			return nil, 0, err
+		}
+		pkts = append(pkts, blobs...)
+	}
+	for _, p := range pkts {
+		size = max(size, len(p))
+	}
+	if size > beaconMaxBytes {
+		return pkts, size, errBeaconTooLarge
+	}
+	return pkts, size, nil
+}
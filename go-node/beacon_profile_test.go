@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// worstBeacon is the largest beacon the broadcaster assembles today: every
+// field at its longest, full when full is set.
+func worstBeacon(full bool) Beacon {
+	var key [32]byte
+	b := Beacon{
+		Type:    "beacon",
+		NodeID:  strings.Repeat("f", 64),
+		APIPort: 65535,
+		TS:      1 << 40,
+		Org:     deriveOrgID(key),
+		API:     apiVersion,
+		Gen:     ^uint64(0),
+		Tip:     strings.Repeat("e", 64),
+		Posture: "legacy",
+	}
+	if full {
+		cfg := defaultConfig()
+		cfg.Mode = modeVault
+		b.Hostname = strings.Repeat("h", 63) // longest DNS label
+		b.PubKey = base64.RawURLEncoding.EncodeToString(key[:])
+		b.Caps = append(nodeCaps(cfg), capLowDisk, capMaintenance)
+		b.SignKey = base64.RawURLEncoding.EncodeToString(key[:])
+		b.KeySig = base64.RawURLEncoding.EncodeToString(make([]byte, 64))
+		b.KeyIssued = 1 << 40
+	}
+	return b
+}
+
+func TestBeaconMaxSize(t *testing.T) {
+	key := make([]byte, 32)
+	for _, full := range []bool{false, true} {
+		pkts, size, err := sealBeacons(worstBeacon(full), beaconModeGroup, key, nil)
+		if err != nil {
+			t.Fatalf("full=%v: %d bytes: %v", full, size, err)
+		}
+		t.Logf("full=%v: %d bytes sealed", full, size)
+		if len(pkts) != 1 || size > beaconMaxBytes {
+			t.Fatalf("full=%v: %d packets, %d bytes", full, len(pkts), size)
+		}
+	}
+	// the minimal beacon is what must always fit; keep it well clear
+	if _, size, _ := sealBeacons(worstBeacon(false), beaconModeGroup, key, nil); size > beaconMaxBytes/2 {
+		t.Fatalf("minimal beacon grew to %d bytes", size)
+	}
+
+	big := worstBeacon(true)
+	for range 100 {
+		big.Caps = append(big.Caps, "some-future-capability")
+	}
+	if _, size, err := sealBeacons(big, beaconModeGroup, key, nil); !errors.Is(err, errBeaconTooLarge) || size <= beaconMaxBytes {
+		t.Fatalf("oversized beacon: %d bytes, %v", size, err)
+	}
+}
+
+// Listeners take both the full beacons of nodes from before the split and
+// minimal ones, and fetch the profile only when a minimal beacon brings a
+// generation they don't have.
+func TestBeaconFullAndMinimal(t *testing.T) {
+	s, peer := newTestServer(t, "s", nil), newTestServer(t, "peer", nil)
+	var fetched []string
+	changed := func(id string) { fetched = append(fetched, id) }
+	pub := base64.RawURLEncoding.EncodeToString(peer.nodeKeys.Pub[:])
+
+	// a node from before the split: full beacon, no generation
+	old := Beacon{NodeID: peer.id.NodeID, APIPort: 1, Hostname: "old", PubKey: pub, API: apiVersion}
+	if out := hearBeacon(s, "10.0.0.2", old, changed); out != beaconAccepted {
+		t.Fatal(out)
+	}
+	if p, _ := s.peers.Get(peer.id.NodeID); p.Hostname != "old" || len(p.PubKey) != 32 || len(fetched) != 0 {
+		t.Fatalf("full beacon: %+v, fetched %v", p, fetched)
+	}
+
+	mb := Beacon{NodeID: peer.id.NodeID, APIPort: 1, API: apiVersion, Gen: 7, Tip: "tip"}
+	for range 2 {
+		if out := hearBeacon(s, "10.0.0.2", mb, changed); out != beaconAccepted {
+			t.Fatal(out)
+		}
+	}
+	p, _ := s.peers.Get(peer.id.NodeID)
+	if len(p.PubKey) != 32 || p.Tip != "tip" || p.ProfileGen != 7 {
+		t.Fatalf("minimal beacon lost the profile: %+v", p)
+	}
+	if len(fetched) != 1 {
+		t.Fatalf("profile fetched %d times for one new generation", len(fetched))
+	}
+	mb.Gen = 8
+	hearBeacon(s, "10.0.0.2", mb, changed)
+	if len(fetched) != 2 {
+		t.Fatal("no fetch on a new generation")
+	}
+}
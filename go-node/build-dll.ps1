@@ -53,9 +53,17 @@ if (-not $gcc) {
 
 Write-Host "Using GCC: $($gcc.Path)" -ForegroundColor Green
 
+# Stamp version, commit and commit date (not the clock) so rebuilding a
+# commit gives the same DLL; P2P_GetStatus reports them under "build"
+$version = git describe --tags --always --dirty 2>$null
+if (-not $version) { $version = "dev" }
+$commit = git rev-parse HEAD 2>$null
+$date = git log -1 --format=%cI 2>$null
+$ldflags = "-buildid= -X main.version=$version -X main.commit=$commit -X main.buildDate=$date -X main.buildTags=dll"
+
 # Build the DLL with dll tag
-Write-Host "Compiling with -tags=dll -buildmode=c-shared..." -ForegroundColor Gray
-go build -tags=dll -buildmode=c-shared -o p2pnode.dll .
+Write-Host "Compiling $version with -tags=dll -buildmode=c-shared..." -ForegroundColor Gray
+go build -trimpath -tags=dll -buildmode=c-shared -ldflags "$ldflags" -o p2pnode.dll .
 
 if ($LASTEXITCODE -eq 0) {
     Write-Host "[SUCCESS] Built p2pnode.dll" -ForegroundColor Green
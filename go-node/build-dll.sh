@@ -2,11 +2,20 @@
 # Build p2pnode as shared library for Linux (.so)
 # Usage: ./build-dll.sh
 
-echo "Building p2pnode.so..."
+cd "$(dirname "$0")"
+
+VERSION=$(git describe --tags --always --dirty 2>/dev/null || echo dev)
+COMMIT=$(git rev-parse HEAD 2>/dev/null)
+DATE=$(git log -1 --format=%cI 2>/dev/null)
+TAGS=dll
+
+echo "Building p2pnode.so $VERSION..."
 
 export CGO_ENABLED=1
 
-go build -buildmode=c-shared -o p2pnode.so .
+go build -trimpath -tags "$TAGS" -buildmode=c-shared \
+    -ldflags "-buildid= -X main.version=$VERSION -X main.commit=$COMMIT -X main.buildDate=$DATE -X main.buildTags=$TAGS" \
+    -o p2pnode.so .
 
 if [ $? -eq 0 ]; then
     echo "[SUCCESS] Built p2pnode.so"
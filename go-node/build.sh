@@ -0,0 +1,25 @@
+#!/bin/bash
+# Build the standalone p2pnode binary, stamped with version, commit and
+# commit date (not the clock), so rebuilding a commit gives the same binary.
+# Usage: ./build.sh [extra go build args]
+
+cd "$(dirname "$0")"
+
+VERSION=$(git describe --tags --always --dirty 2>/dev/null || echo dev)
+COMMIT=$(git rev-parse HEAD 2>/dev/null)
+DATE=$(git log -1 --format=%cI 2>/dev/null)
+TAGS=""
+
+echo "Building p2pnode $VERSION..."
+
+go build -trimpath -tags "$TAGS" \
+    -ldflags "-s -w -buildid= -X main.version=$VERSION -X main.commit=$COMMIT -X main.buildDate=$DATE -X main.buildTags=$TAGS" \
+    -o p2pnode "$@" .
+
+if [ $? -eq 0 ]; then
+    echo "[SUCCESS] Built p2pnode"
+    ./p2pnode --version
+else
+    echo "[ERROR] Build failed"
+    exit 1
+fi
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+)
+
+// Build stamp and compiled-in features, so support can tell what a given
+// binary is. The build scripts stamp the variables below with
+//   -ldflags "-X main.version=... -X main.commit=... -X main.buildDate=... -X main.buildTags=..."
+// and build with -trimpath, taking buildDate from the commit rather than
+// the clock, so two builds of one commit are identical. An unstamped build
+// falls back to what the Go toolchain recorded (vcs.revision, vcs.time,
+// -tags). The same BuildInfo is on /status, P2P_GetStatus and --version.
+
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+	buildTags = ""
+)
+
+// Features each optional subsystem registers from init in the file that
+// implements it, so a feature is listed exactly when its file is compiled.
+const (
+	featureLibp2p       = "libp2p"        // node.go
+	featureDLL          = "dll-exports"   // exports.go (dll && cgo)
+	featureCtl          = "ctl"           // ctl.go (!dll)
+	featureWANTLS       = "wan-tls"       // outbound.go: keysaver/webhook client
+	featureKeysaver     = "keysaver"      // escrow.go
+	featureWebhooks     = "webhooks"      // webhooks.go
+	featureEvents       = "events"        // events.go
+	featureDashboard    = "dashboard"     // ui.go
+	featureStrictCrypto = "strict-crypto" // crypto_posture.go
+	featureVault        = "vault-mode"    // vault.go
+	featureLoadgen      = "loadgen"       // loadgen.go
+	featureKVReconcile  = "kv-reconcile"  // kvsync.go
+)
+
+var compiledFeatures = map[string]bool{}
+
+// registerFeature is for init functions only; the registry is read-only
+// once main runs.
+func registerFeature(name string) {
+	if compiledFeatures[name] {
+		panic("feature registered twice: " + name)
+	}
+	compiledFeatures[name] = true
+}
+
+// featureList returns the compiled-in features, sorted.
+func featureList() []string {
+	out := make([]string, 0, len(compiledFeatures))
+	for f := range compiledFeatures {
+		out = append(out, f)
+	}
+	sort.Strings(out)
+	return out
+}
+
+type BuildInfo struct {
+	Version   string   `json:"version"`
+	Commit    string   `json:"commit,omitempty"`
+	BuildDate string   `json:"build_date,omitempty"`
+	BuildTags string   `json:"build_tags,omitempty"`
+	GoVersion string   `json:"go_version"`
+	Platform  string   `json:"platform"` // GOOS/GOARCH
+	CGO       bool     `json:"cgo"`
+	Dirty     bool     `json:"dirty,omitempty"` // unstamped build from a modified tree
+	Features  []string `json:"features"`
+}
+
+func buildInfo() BuildInfo {
+	b := BuildInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		BuildTags: buildTags,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+		Features:  featureList(),
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "CGO_ENABLED":
+				b.CGO = s.Value == "1"
+			case "-tags":
+				if b.BuildTags == "" {
+					b.BuildTags = s.Value
+				}
+			case "vcs.revision":
+				if b.Commit == "" {
+					b.Commit = s.Value
+				}
+			case "vcs.time":
+				if b.BuildDate == "" {
+					b.BuildDate = s.Value
+				}
+			case "vcs.modified":
+				b.Dirty = commit == "" && s.Value == "true"
+			}
+		}
+	}
+	return b
+}
+
+// String is the --version text.
+func (b BuildInfo) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "p2pnode %s", b.Version)
+	if c := b.Commit; c != "" {
+		if len(c) > 12 {
+			c = c[:12]
+		}
+		fmt.Fprintf(&sb, " (%s", c)
+		if b.Dirty {
+			sb.WriteString("+dirty")
+		}
+		if b.BuildDate != "" {
+			fmt.Fprintf(&sb, ", %s", b.BuildDate)
+		}
+		sb.WriteString(")")
+	}
+	fmt.Fprintf(&sb, "\n%s %s cgo=%t", b.GoVersion, b.Platform, b.CGO)
+	if b.BuildTags != "" {
+		fmt.Fprintf(&sb, " tags=%s", b.BuildTags)
+	}
+	sb.WriteString("\n")
+	fmt.Fprintf(&sb, "features: %s\n", strings.Join(b.Features, ","))
+	return sb.String()
+}
@@ -0,0 +1,58 @@
+//go:build !dll
+// +build !dll
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// The registry lists exactly the features of the default build: a
+// subsystem added without registering, or registering from a file that
+// isn't compiled by default, shows up here. /status and --version carry
+// the same list and the ldflags stamp.
+func TestFeatureRegistry(t *testing.T) {
+	want := []string{
+		featureCtl,
+		featureDashboard,
+		featureEvents,
+		featureKeysaver,
+		featureKVReconcile,
+		featureLibp2p,
+		featureLoadgen,
+		featureStrictCrypto,
+		featureVault,
+		featureWANTLS,
+		featureWebhooks,
+	}
+	slices.Sort(want)
+	if got := featureList(); !slices.Equal(got, want) {
+		t.Fatalf("features %v, want %v", got, want)
+	}
+
+	saved := version
+	version = "1.2.3-test"
+	t.Cleanup(func() { version = saved })
+
+	s := newTestServer(t, "a", nil)
+	rr := callControl(s, http.MethodGet, "/status", s.ctlToken, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("/status: %d %s", rr.Code, rr.Body)
+	}
+	var st struct {
+		Build BuildInfo `json:"build"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Build.Version != "1.2.3-test" || !slices.Equal(st.Build.Features, want) {
+		t.Fatalf("/status build %+v", st.Build)
+	}
+	if out := buildInfo().String(); !strings.HasPrefix(out, "p2pnode 1.2.3-test") || !strings.Contains(out, "features: "+strings.Join(want, ",")+"\n") {
+		t.Fatalf("--version:\n%s", out)
+	}
+}
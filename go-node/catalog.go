@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// File catalog. One row per file the network holds, fed by data blocks as
+// they reach the chain (sent here, replicated in, bootstrapped) and by
+// libp2p file manifests. A row is keyed by the file's plaintext SHA-256 when
+// its source carries one, so the same file sent twice, or over both
+// transports, is one row listing every block and manifest. Blocks from nodes
+// older than this release carry no plaintext hash and get a row of their
+// own. Rows live in catalog.json; the chain part is re-indexed at startup,
+// so only manifests and peer confirmations depend on the file.
+
+const (
+	catalogFile      = "catalog.json"
+	catalogSaveEvery = 10 * time.Second
+	catalogPageDef   = 100
+	catalogPageMax   = 1000
+)
+
+type catalogEntry struct {
+	ID        string   `json:"id"`
+	Name      string   `json:"name"`
+	Size      int64    `json:"size"` // plaintext bytes for compressed blocks and manifests, else sealed
+	Origin    string   `json:"origin"`
+	Created   int64    `json:"created_unix"`
+	PlainHash string   `json:"plain_sha256,omitempty"`
+	Blocks    []string `json:"blocks,omitempty"`          // live chain blocks (chunk hashes)
+	Manifests []string `json:"manifests,omitempty"`       // libp2p manifest IDs
+	Confirmed []string `json:"confirmed_by,omitempty"`    // peers that acked or originated a copy
+	Assembled bool     `json:"manifest_stored,omitempty"` // a manifest's file was assembled here
+
+	Local bool `json:"local"` // set per query: a chunk or assembled file is on disk
+}
+
+type catalogStore struct {
+	mu      sync.Mutex
+	path    string
+	chunks  string
+	self    string
+	rows    map[string]*catalogEntry
+	byBlock map[string]string // block hash -> row ID
+	byMan   map[string]string // manifest ID -> row ID
+	dirty   bool
+}
+
+func newCatalogStore(paths *EnvPaths, selfID string) *catalogStore {
+	cs := &catalogStore{
+		path:    filepath.Join(paths.BaseDir, catalogFile),
+		chunks:  paths.ChunksDir,
+		self:    selfID,
+		rows:    make(map[string]*catalogEntry),
+		byBlock: make(map[string]string),
+		byMan:   make(map[string]string),
+	}
+	b, err := os.ReadFile(cs.path)
+	if err != nil {
+		return cs
+	}
+	var rows []*catalogEntry
+	if err := json.Unmarshal(b, &rows); err != nil {
+		log.Printf("[catalog] ignoring unreadable %s: %v", cs.path, err)
+		return cs
+	}
+	for _, e := range rows {
+		if e.ID == "" {
+			continue
+		}
+		cs.rows[e.ID] = e
+		for _, h := range e.Blocks {
+			cs.byBlock[h] = e.ID
+		}
+		for _, m := range e.Manifests {
+			cs.byMan[m] = e.ID
+		}
+	}
+	return cs
+}
+
+// catalogID is the row ID for a file: the plaintext hash when known,
+// otherwise the first block's hash, shortened.
+func catalogID(plain, block string) string {
+	if plain != "" {
+		return short24(plain)
+	}
+	return short24(block)
+}
+
+func short24(h string) string {
+	if len(h) > 24 {
+		return h[:24]
+	}
+	return h
+}
+
+// rowLocked returns the row for id, creating it; callers hold cs.mu.
+func (cs *catalogStore) rowLocked(id string) *catalogEntry {
+	e := cs.rows[id]
+	if e == nil {
+		e = &catalogEntry{ID: id}
+		cs.rows[id] = e
+	}
+	return e
+}
+
+// fill sets the descriptive fields of e from a source seen before the
+// others: the earliest copy names the file.
+func (e *catalogEntry) fill(name string, size int64, origin string, created int64, plain string) {
+	if e.Created == 0 || (created != 0 && created < e.Created) {
+		e.Name, e.Size, e.Origin, e.Created = name, size, origin, created
+	}
+	if plain != "" {
+		e.PlainHash = plain
+	}
+}
+
+// observe indexes one block: a data block joins its file's row, a
+// tombstone takes its target out of it.
+func (cs *catalogStore) observe(b Block) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.observeLocked(b)
+}
+
+func (cs *catalogStore) observeLocked(b Block) {
+	switch {
+	case b.isTombstone() && b.Tombstone != nil:
+		cs.dropBlockLocked(b.Tombstone.Block)
+	case b.isData():
+		if _, ok := cs.byBlock[b.Hash]; ok {
+			return
+		}
+		size := int64(b.Size)
+		if b.RawSize > 0 {
+			size = int64(b.RawSize)
+		}
+		e := cs.rowLocked(catalogID(b.PlainHash, b.Hash))
+		e.fill(b.Name, size, b.OriginID, b.Created, b.PlainHash)
+		e.Blocks = append(e.Blocks, b.Hash)
+		cs.byBlock[b.Hash] = e.ID
+		if b.OriginID != cs.self {
+			e.confirm(b.OriginID)
+		}
+		cs.dirty = true
+	}
+}
+
+func (cs *catalogStore) dropBlockLocked(hash string) {
+	id, ok := cs.byBlock[hash]
+	if !ok {
+		return
+	}
+	delete(cs.byBlock, hash)
+	e := cs.rows[id]
+	e.Blocks = slices.DeleteFunc(e.Blocks, func(h string) bool { return h == hash })
+	if len(e.Blocks) == 0 && len(e.Manifests) == 0 {
+		delete(cs.rows, id)
+	}
+	cs.dirty = true
+}
+
+// index re-reads a whole chain: blocks the catalog hasn't seen are added,
+// deleted ones removed. Used at startup and after a bootstrap rewrote the
+// chain file.
+func (cs *catalogStore) index(blocks []Block) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	for _, b := range blocks {
+		cs.observeLocked(b)
+	}
+	log.Printf("[catalog] %d files indexed", len(cs.rows))
+}
+
+func (e *catalogEntry) confirm(nodeID string) bool {
+	if nodeID == "" || slices.Contains(e.Confirmed, nodeID) {
+		return false
+	}
+	e.Confirmed = append(e.Confirmed, nodeID)
+	return true
+}
+
+// confirm records that nodeID acknowledged or already held block hash.
+func (cs *catalogStore) confirm(hash, nodeID string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	id, ok := cs.byBlock[hash]
+	if ok && cs.rows[id].confirm(nodeID) {
+		cs.dirty = true
+	}
+}
+
+// observeManifest indexes a libp2p file manifest; assembled is true once
+// its file is on disk here. A nil store (a Node without a Server) ignores it.
+func (cs *catalogStore) observeManifest(m FileManifest, assembled bool) {
+	if cs == nil || m.ID == "" {
+		return
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	id, ok := cs.byMan[m.ID]
+	if !ok {
+		id = catalogID(m.PlainSHA256, m.ID)
+		e := cs.rowLocked(id)
+		e.fill(m.FileName, m.Size, m.PeerID, m.Timestamp, m.PlainSHA256)
+		e.Manifests = append(e.Manifests, m.ID)
+		cs.byMan[m.ID] = id
+		cs.dirty = true
+	}
+	if e := cs.rows[id]; assembled && !e.Assembled {
+		e.Assembled = true
+		cs.dirty = true
+	}
+}
+
+// local reports whether any of e's chunks is on disk; callers hold cs.mu.
+func (cs *catalogStore) localLocked(e *catalogEntry) bool {
+	if e.Assembled {
+		return true
+	}
+	for _, h := range e.Blocks {
+		if _, err := os.Stat(filepath.Join(cs.chunks, h+".bin")); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve returns the block to restore catalog row id from: one whose
+// chunk is here, else its first. ok is false for an unknown row or one
+// with no chain block (a manifest-only file).
+func (cs *catalogStore) resolve(id string) (hash string, ok bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	e := cs.rows[id]
+	if e == nil || len(e.Blocks) == 0 {
+		return "", false
+	}
+	for _, h := range e.Blocks {
+		if _, err := os.Stat(filepath.Join(cs.chunks, h+".bin")); err == nil {
+			return h, true
+		}
+	}
+	return e.Blocks[0], true
+}
+
+// save writes the catalog if it changed since the last save.
+func (cs *catalogStore) save() {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if !cs.dirty {
+		return
+	}
+	rows := make([]*catalogEntry, 0, len(cs.rows))
+	for _, e := range cs.rows {
+		rows = append(rows, e)
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].ID < rows[j].ID })
+	b, _ := json.Marshal(rows)
+	if err := writeFileAtomic(cs.path, b); err != nil {
+		log.Printf("[catalog] save: %v", err)
+		return
+	}
+	cs.dirty = false
+}
+
+func (s *Server) startCatalogLoop(ctx context.Context) {
+	ticker := time.NewTicker(catalogSaveEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			s.catalog.save()
+			return
+		case <-ticker.C:
+			s.catalog.save()
+		}
+	}
+}
+
+// GET /catalog?name_contains=&origin=&since=&available=&from=&limit=
+// (control): catalog rows, newest first. origin matches a NodeID prefix,
+// since is a unix time, available=true keeps files with a local copy or a
+// confirming peer (false the rest).
+func (s *Server) handleCatalog(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	name := strings.ToLower(q.Get("name_contains"))
+	origin := q.Get("origin")
+	var since int64
+	if v := q.Get("since"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "bad ?since=", http.StatusBadRequest)
+			return
+		}
+		since = n
+	}
+	avail := q.Get("available")
+	if avail != "" && avail != "true" && avail != "false" {
+		http.Error(w, "bad ?available=", http.StatusBadRequest)
+		return
+	}
+	from, _ := strconv.Atoi(q.Get("from"))
+	if from < 0 {
+		http.Error(w, "bad ?from=", http.StatusBadRequest)
+		return
+	}
+	limit, _ := strconv.Atoi(q.Get("limit"))
+	if limit <= 0 {
+		limit = catalogPageDef
+	}
+	limit = min(limit, catalogPageMax)
+
+	cs := s.catalog
+	cs.mu.Lock()
+	out := []catalogEntry{}
+	for _, e := range cs.rows {
+		if name != "" && !strings.Contains(strings.ToLower(e.Name), name) {
+			continue
+		}
+		if origin != "" && !strings.HasPrefix(e.Origin, origin) {
+			continue
+		}
+		if e.Created < since {
+			continue
+		}
+		cp := *e
+		cp.Blocks, cp.Manifests, cp.Confirmed = slices.Clone(e.Blocks), slices.Clone(e.Manifests), slices.Clone(e.Confirmed)
+		cp.Local = cs.localLocked(e)
+		if avail != "" && (cp.Local || len(cp.Confirmed) > 0) != (avail == "true") {
+			continue
+		}
+		out = append(out, cp)
+	}
+	cs.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Created != out[j].Created {
+			return out[i].Created > out[j].Created
+		}
+		return out[i].ID < out[j].ID
+	})
+	total := len(out)
+	page := out[min(from, total):min(from+limit, total)]
+	resp := map[string]any{"total": total, "from": from, "limit": limit, "files": page}
+	if from+limit < total {
+		resp["next"] = from + limit
+	}
+	writeJSON(w, resp)
+}
+
+// catalogHash resolves ?catalog=<id> to a block hash for endpoints that
+// take ?hash=, writing the error itself. An empty id returns hash as is.
+func (s *Server) catalogHash(w http.ResponseWriter, id, hash string) (string, bool) {
+	if id == "" {
+		return hash, true
+	}
+	if hash != "" {
+		http.Error(w, "give ?hash= or ?catalog=, not both", http.StatusBadRequest)
+		return "", false
+	}
+	h, ok := s.catalog.resolve(id)
+	if !ok {
+		http.Error(w, "no chain block for catalog entry "+id, http.StatusNotFound)
+		return "", false
+	}
+	return h, true
+}
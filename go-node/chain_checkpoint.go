@@ -0,0 +1,624 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Chain checkpoints. Every ChainCheckpointEvery blocks appendBlock writes
+// checkpoint-<height>.json next to chain.jsonl: the tip, the height (blocks
+// up to and including the tip), where the prefix ends in chain.jsonl, and a
+// prefix hash chained over every block's identity. Startup verifies the
+// chain from the newest checkpoint whose offset still ends on its tip
+// instead of from the first line; /chain/verify?full=true walks it all and
+// checks each checkpoint on the way.
+//
+// A brand-new node can bootstrap from a peer's latest checkpoint and the
+// blocks after it (/chain/snapshot). The history below the checkpoint is
+// pulled in the background (/chain/blocks) and spliced in once its prefix
+// hash matches; until then blocks below the base aren't local.
+
+const (
+	defaultChainCheckpointEvery = 1000
+
+	checkpointsKept   = 3
+	chainBaseFile     = "base.json" // checkpoint a bootstrapped chain starts at
+	chainHistoryPart  = "history.part"
+	chainPageMax      = 1000
+	chainPeerTimeout  = 30 * time.Second
+	chainSnapshotBody = 64 << 20
+)
+
+type chainCheckpoint struct {
+	Height     int    `json:"height"` // blocks up to and including Tip
+	Tip        string `json:"tip"`
+	PrefixHash string `json:"prefix_hash"`
+	Bytes      int64  `json:"bytes,omitempty"` // end of the prefix in the local chain.jsonl
+	Created    int64  `json:"created_unix"`
+}
+
+// chainState is the verified position of the local chain; guarded by
+// Server.chainMu.
+type chainState struct {
+	height int
+	acc    string // prefix hash at height
+	bytes  int64  // size of chain.jsonl
+	base   *chainCheckpoint
+	verify chainVerifyResult
+	filler bool // history fill running
+}
+
+type chainVerifyResult struct {
+	Full        bool   `json:"full"`
+	FromHeight  int    `json:"from_height"`
+	Height      int    `json:"height"`
+	Tip         string `json:"tip"`
+	Checked     int    `json:"checked"`
+	Unlinked    int    `json:"unlinked"` // prev_hash "" after genesis: older nodes lost their tip on restart
+	BrokenAt    int    `json:"broken_at,omitempty"`
+	Error       string `json:"error,omitempty"`
+	Checkpoints int    `json:"checkpoints_checked,omitempty"`
+	Base        int    `json:"base_height,omitempty"` // bootstrapped: history below is not local yet
+	TookMS      int64  `json:"took_ms"`
+	Time        int64  `json:"time"`
+}
+
+// chainDigest extends the prefix hash acc by block b. It covers the
+// fields that make a block's identity, not the JSON line, so nodes on
+// different releases agree.
+func chainDigest(acc string, b Block) string {
+	h := sha256.New()
+	h.Write([]byte(acc))
+	fmt.Fprintf(h, "|%s|%s|%s|%s|%d", b.Hash, b.PrevHash, b.OriginID, b.Name, b.Created)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// chainWalk verifies links and extends the prefix hash over blocks read
+// from r, starting after (height, acc, tip). marks are checkpoint prefix
+// hashes by height, checked on the way.
+type chainWalk struct {
+	height int
+	acc    string
+	tip    string
+	bytes  int64
+	res    chainVerifyResult
+	marks  map[int]string
+}
+
+func (cw *chainWalk) block(b Block, n int64) {
+	cw.bytes += n
+	switch {
+	case b.PrevHash == cw.tip:
+	case b.PrevHash == "" && cw.height > 0:
+		cw.res.Unlinked++
+	default:
+		if cw.res.BrokenAt == 0 {
+			cw.res.BrokenAt = cw.height + 1
+			cw.res.Error = fmt.Sprintf("block %s at height %d links to %.12s, previous is %.12s", b.Hash, cw.height+1, b.PrevHash, cw.tip)
+		}
+	}
+	cw.height++
+	cw.acc = chainDigest(cw.acc, b)
+	cw.tip = b.Hash
+	cw.res.Checked++
+	if want, ok := cw.marks[cw.height]; ok {
+		cw.res.Checkpoints++
+		if want != cw.acc && cw.res.Error == "" {
+			cw.res.BrokenAt = cw.height
+			cw.res.Error = fmt.Sprintf("prefix hash at checkpoint %d differs", cw.height)
+		}
+	}
+}
+
+func (cw *chainWalk) read(r io.Reader) error {
+	br := bufio.NewReaderSize(r, 1<<20)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			var b Block
+			if len(bytes.TrimSpace(line)) == 0 || json.Unmarshal(line, &b) != nil {
+				cw.bytes += int64(len(line)) // readChain skips these too
+			} else {
+				cw.block(b, int64(len(line)))
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Server) checkpointPath(height int) string {
+	return filepath.Join(s.chainDir(), fmt.Sprintf("checkpoint-%d.json", height))
+}
+
+// listCheckpoints returns the local checkpoints, newest first.
+func (s *Server) listCheckpoints() []chainCheckpoint {
+	entries, _ := os.ReadDir(s.chainDir())
+	var out []chainCheckpoint
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, "checkpoint-") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(s.chainDir(), name))
+		var cp chainCheckpoint
+		if err != nil || json.Unmarshal(b, &cp) != nil || cp.Height <= 0 {
+			log.Printf("[chain] ignoring unreadable %s", name)
+			continue
+		}
+		out = append(out, cp)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Height > out[j].Height })
+	return out
+}
+
+// checkpointAt reports whether cp still describes chain.jsonl: the line
+// ending at cp.Bytes is cp.Tip. Costs one small read.
+func (s *Server) checkpointAt(cp chainCheckpoint) bool {
+	f, err := os.Open(s.chainPath())
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil || cp.Bytes <= 0 || st.Size() < cp.Bytes {
+		return false
+	}
+	start := cp.Bytes - 64<<10
+	if start < 0 {
+		start = 0
+	}
+	buf := make([]byte, cp.Bytes-start)
+	if _, err := f.ReadAt(buf, start); err != nil {
+		return false
+	}
+	buf = bytes.TrimRight(buf, "\n")
+	if i := bytes.LastIndexByte(buf, '\n'); i >= 0 {
+		buf = buf[i+1:]
+	}
+	var b Block
+	return json.Unmarshal(buf, &b) == nil && b.Hash == cp.Tip
+}
+
+func (s *Server) loadChainBase() *chainCheckpoint {
+	b, err := os.ReadFile(filepath.Join(s.chainDir(), chainBaseFile))
+	if err != nil {
+		return nil
+	}
+	var cp chainCheckpoint
+	if err := json.Unmarshal(b, &cp); err != nil {
+		log.Printf("[chain] ignoring bad %s: %v", chainBaseFile, err)
+		return nil
+	}
+	return &cp
+}
+
+// verifyChain walks chain.jsonl from the newest usable checkpoint (or from
+// the start with full), returning the walk and where it started.
+func (s *Server) verifyChain(full bool) (*chainWalk, chainCheckpoint) {
+	start := time.Now()
+	cw := &chainWalk{marks: make(map[int]string)}
+	var from chainCheckpoint
+	cps := s.listCheckpoints()
+	base := s.loadChainBase()
+	if base != nil {
+		cw.height, cw.acc, cw.tip = base.Height, base.PrefixHash, base.Tip
+		cw.res.Base = base.Height
+		from = *base
+		from.Bytes = 0
+	}
+	if full {
+		for _, cp := range cps {
+			cw.marks[cp.Height] = cp.PrefixHash
+		}
+	} else {
+		for _, cp := range cps {
+			if s.checkpointAt(cp) {
+				from = cp
+				cw.height, cw.acc, cw.tip, cw.bytes = cp.Height, cp.PrefixHash, cp.Tip, cp.Bytes
+				break
+			}
+		}
+	}
+	cw.res.Full, cw.res.FromHeight = full, cw.height
+	f, err := os.Open(s.chainPath())
+	if err == nil {
+		if _, err = f.Seek(cw.bytes, io.SeekStart); err == nil {
+			err = cw.read(f)
+		}
+		f.Close()
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) && cw.res.Error == "" {
+		cw.res.Error = err.Error()
+	}
+	cw.res.Height, cw.res.Tip = cw.height, cw.tip
+	cw.res.TookMS = time.Since(start).Milliseconds()
+	cw.res.Time = time.Now().Unix()
+	return cw, from
+}
+
+// loadChain restores the chain tip at startup, verifying only what was
+// appended since the newest checkpoint.
+func (s *Server) loadChain() {
+	cw, from := s.verifyChain(false)
+	s.chainMu.Lock()
+	defer s.chainMu.Unlock()
+	s.setChainTip(cw.tip)
+	s.chain = chainState{height: cw.height, acc: cw.acc, bytes: cw.bytes, base: s.loadChainBase(), verify: cw.res}
+	if cw.res.Error != "" {
+		log.Printf("[chain] verify: %s", cw.res.Error)
+		s.health.markDegraded("chain", cw.res.Error)
+	}
+	log.Printf("[chain] height %d tip %.12s (checked %d blocks from %d in %dms)", cw.height, cw.tip, cw.res.Checked, from.Height, cw.res.TookMS)
+	if s.cfg.ChainCheckpointEvery > 0 && cw.res.Checked >= s.cfg.ChainCheckpointEvery {
+		s.writeCheckpointLocked() // so the next start skips what we just read
+	}
+}
+
+// chainAppended updates the chain state after appendBlock wrote line.
+func (s *Server) chainAppended(b Block, n int) {
+	c := &s.chain
+	c.height++
+	c.acc = chainDigest(c.acc, b)
+	c.bytes += int64(n)
+	if every := s.cfg.ChainCheckpointEvery; every > 0 && c.height%every == 0 {
+		s.writeCheckpointLocked()
+	}
+}
+
+// writeCheckpointLocked writes a checkpoint at the current tip and keeps
+// the newest checkpointsKept. Caller holds chainMu.
+func (s *Server) writeCheckpointLocked() {
+	c := &s.chain
+	if c.height == 0 {
+		return
+	}
+	cp := chainCheckpoint{Height: c.height, Tip: s.getChainTip(), PrefixHash: c.acc, Bytes: c.bytes, Created: time.Now().Unix()}
+	b, _ := json.Marshal(cp)
+	if err := writeFileAtomic(s.checkpointPath(cp.Height), b); err != nil {
+		log.Printf("[chain] checkpoint %d: %v", cp.Height, err)
+		return
+	}
+	for i, old := range s.listCheckpoints() {
+		if i >= checkpointsKept {
+			_ = os.Remove(s.checkpointPath(old.Height))
+		}
+	}
+}
+
+func (s *Server) latestCheckpoint() *chainCheckpoint {
+	s.chainMu.Lock()
+	defer s.chainMu.Unlock()
+	for _, cp := range s.listCheckpoints() {
+		if cp.Height <= s.chain.height {
+			return &cp
+		}
+	}
+	return nil
+}
+
+// GET /chain/verify[?full=true] (control): verify from the newest
+// checkpoint, or walk the whole local chain and check every checkpoint.
+func (s *Server) handleChainVerify(w http.ResponseWriter, r *http.Request) {
+	// read-only: appends go on meanwhile, the walk stops at what it saw
+	cw, _ := s.verifyChain(r.URL.Query().Get("full") == "true")
+	s.chainMu.Lock()
+	s.chain.verify = cw.res
+	s.chainMu.Unlock()
+	if cw.res.Error != "" {
+		s.health.markDegraded("chain", cw.res.Error)
+	}
+	writeJSON(w, cw.res)
+}
+
+// ---- peers: snapshot, history pages, bootstrap ----
+
+// chainSnapshot is what /chain/snapshot serves: the latest checkpoint and
+// every block after it. Checkpoint is nil when there is none yet; Blocks is
+// then the whole chain.
+type chainSnapshot struct {
+	Checkpoint *chainCheckpoint `json:"checkpoint"`
+	Blocks     []Block          `json:"blocks"`
+	Height     int              `json:"height"`
+	Tip        string           `json:"tip"`
+}
+
+// localHeightBase is the height of the first line of chain.jsonl minus one
+// (non-zero on a bootstrapped chain whose history isn't spliced in yet).
+func (s *Server) localHeightBase() int {
+	s.chainMu.Lock()
+	defer s.chainMu.Unlock()
+	if s.chain.base != nil {
+		return s.chain.base.Height
+	}
+	return 0
+}
+
+// GET /chain/snapshot?org=<id> (public)
+func (s *Server) handleChainSnapshot(w http.ResponseWriter, r *http.Request) {
+	org := r.URL.Query().Get("org")
+	if org == "" && s.refuseLegacy(w, legacyUntaggedOrg) {
+		return
+	}
+	if !s.org.accept(org, &s.org.foreignReplicates) {
+		http.Error(w, "foreign org", http.StatusForbidden)
+		return
+	}
+	cp := s.latestCheckpoint()
+	baseH := s.localHeightBase()
+	if cp == nil && baseH > 0 {
+		cp = s.loadChainBase()
+	}
+	blocks := s.readChain()
+	snap := chainSnapshot{Checkpoint: cp, Tip: s.getChainTip(), Height: baseH + len(blocks)}
+	from := 0
+	if cp != nil {
+		cp := *cp
+		cp.Bytes = 0 // meaningless off this node
+		snap.Checkpoint = &cp
+		from = cp.Height - baseH
+	}
+	if from >= 0 && from <= len(blocks) {
+		snap.Blocks = blocks[from:]
+	}
+	writeJSON(w, snap)
+}
+
+// GET /chain/blocks?from=<height>&limit=<n>&org=<id> (public): blocks at
+// heights from+1 .. from+limit, for lazily fetched history.
+func (s *Server) handleChainBlocks(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("org") == "" && s.refuseLegacy(w, legacyUntaggedOrg) {
+		return
+	}
+	if !s.org.accept(q.Get("org"), &s.org.foreignReplicates) {
+		http.Error(w, "foreign org", http.StatusForbidden)
+		return
+	}
+	from, err := strconv.Atoi(q.Get("from"))
+	if err != nil || from < 0 {
+		http.Error(w, "bad ?from=", http.StatusBadRequest)
+		return
+	}
+	limit, _ := strconv.Atoi(q.Get("limit"))
+	if limit <= 0 || limit > chainPageMax {
+		limit = chainPageMax
+	}
+	baseH := s.localHeightBase()
+	if from < baseH {
+		http.Error(w, "history below "+strconv.Itoa(baseH)+" not local", http.StatusNotFound)
+		return
+	}
+	blocks := s.readChain()
+	i := min(from-baseH, len(blocks))
+	writeJSON(w, blocks[i:min(i+limit, len(blocks))])
+}
+
+// POST /chain/bootstrap[?peer=<node_id>] (control): start an empty chain
+// from a peer's latest checkpoint and fetch the history behind it in the
+// background. On a bootstrapped chain whose history is still missing (the
+// fill failed, or the node restarted) it restarts the fill.
+func (s *Server) handleChainBootstrap(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	var peers []PeerInfo
+	id, ok := s.nodeIDParam(w, "peer", r.URL.Query().Get("peer"))
+	if !ok {
+		return
+	}
+	if id != "" {
+		p, ok := s.peers.Get(id)
+		if !ok {
+			http.Error(w, "unknown peer", http.StatusNotFound)
+			return
+		}
+		peers = []PeerInfo{p}
+	} else {
+		peers = s.rankPeers(s.peers.List())
+	}
+	s.chainMu.Lock()
+	resume := s.chain.base != nil && !s.chain.filler && len(peers) > 0
+	if resume {
+		s.chain.filler = true
+	}
+	s.chainMu.Unlock()
+	if resume {
+		go func() {
+			defer recoverOnce("chain-history")
+			s.fillChainHistory(peers[0])
+		}()
+		w.WriteHeader(http.StatusAccepted)
+		writeJSON(w, map[string]any{"status": "history", "peer": peers[0].NodeID})
+		return
+	}
+
+	var errs []string
+	for _, p := range peers {
+		snap, err := s.bootstrapChainFrom(p)
+		if errors.Is(err, errChainNotEmpty) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%.8s: %v", p.NodeID, err))
+			continue
+		}
+		writeJSON(w, map[string]any{"status": "ok", "peer": p.NodeID, "height": snap.Height, "tip": snap.Tip, "base_height": baseHeight(snap), "blocks": len(snap.Blocks)})
+		return
+	}
+	if len(errs) == 0 {
+		errs = append(errs, "no peers")
+	}
+	http.Error(w, "bootstrap failed: "+strings.Join(errs, "; "), http.StatusBadGateway)
+}
+
+var errChainNotEmpty = errors.New("local chain is not empty")
+
+func baseHeight(snap *chainSnapshot) int {
+	if snap.Checkpoint == nil {
+		return 0
+	}
+	return snap.Checkpoint.Height
+}
+
+func (s *Server) chainFromPeer(p PeerInfo, path string, q url.Values, out any) error {
+	q.Set("org", s.org.ID)
+	resp, _, err := s.getFromPeer(p, http.MethodGet, peerPath(p, path)+"?"+q.Encode(), chainPeerTimeout)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return fmt.Errorf("%s: HTTP %d", path, resp.StatusCode)
+	}
+	b, err := readPeerBody(resp, chainSnapshotBody)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, out)
+}
+
+func (s *Server) bootstrapChainFrom(p PeerInfo) (*chainSnapshot, error) {
+	var snap chainSnapshot
+	if err := s.chainFromPeer(p, "/chain/snapshot", url.Values{}, &snap); err != nil {
+		return nil, err
+	}
+	cw := &chainWalk{}
+	if cp := snap.Checkpoint; cp != nil {
+		cw.height, cw.acc, cw.tip = cp.Height, cp.PrefixHash, cp.Tip
+	}
+	var buf bytes.Buffer
+	for _, b := range snap.Blocks {
+		line, _ := json.Marshal(b)
+		buf.Write(append(line, '\n'))
+		cw.block(b, int64(len(line)+1))
+	}
+	if cw.res.Error != "" {
+		return nil, errors.New(cw.res.Error)
+	}
+	if cw.tip != snap.Tip {
+		return nil, fmt.Errorf("snapshot ends at %.12s, peer tip is %.12s", cw.tip, snap.Tip)
+	}
+
+	s.chainMu.Lock()
+	defer s.chainMu.Unlock()
+	if s.chain.height > 0 || s.getChainTip() != "" {
+		return nil, errChainNotEmpty
+	}
+	if err := os.MkdirAll(s.chainDir(), 0700); err != nil {
+		return nil, err
+	}
+	if cp := snap.Checkpoint; cp != nil {
+		b, _ := json.Marshal(cp)
+		if err := writeFileAtomic(filepath.Join(s.chainDir(), chainBaseFile), b); err != nil {
+			return nil, err
+		}
+		s.chain.base = cp
+	}
+	if err := writeFileAtomic(s.chainPath(), buf.Bytes()); err != nil {
+		return nil, err
+	}
+	s.setChainTip(cw.tip)
+	s.chain.height, s.chain.acc, s.chain.bytes = cw.height, cw.acc, cw.bytes
+	log.Printf("[chain] bootstrapped from %.8s at height %d (%d blocks after checkpoint %d)", p.NodeID, cw.height, len(snap.Blocks), baseHeight(&snap))
+	s.catalog.index(snap.Blocks)
+	if s.chain.base != nil {
+		s.chain.filler = true
+		go func() {
+			defer recoverOnce("chain-history")
+			s.fillChainHistory(p)
+		}()
+	}
+	return &snap, nil
+}
+
+// fillChainHistory pulls the blocks below the bootstrap base from p page by
+// page into history.part, and splices them in front of chain.jsonl once
+// their prefix hash matches the base.
+func (s *Server) fillChainHistory(p PeerInfo) {
+	defer func() {
+		s.chainMu.Lock()
+		s.chain.filler = false
+		s.chainMu.Unlock()
+	}()
+	s.chainMu.Lock()
+	base := *s.chain.base
+	s.chainMu.Unlock()
+
+	part := filepath.Join(s.chainDir(), chainHistoryPart)
+	f, err := os.OpenFile(part, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("[chain] history: %v", err)
+		return
+	}
+	defer os.Remove(part)
+	cw := &chainWalk{}
+	w := bufio.NewWriter(f)
+	for cw.height < base.Height {
+		var page []Block
+		q := url.Values{"from": {strconv.Itoa(cw.height)}, "limit": {strconv.Itoa(min(chainPageMax, base.Height-cw.height))}}
+		if err := s.chainFromPeer(p, "/chain/blocks", q, &page); err != nil || len(page) == 0 {
+			log.Printf("[chain] history from %.8s at %d: %v (retry with POST /chain/bootstrap later)", p.NodeID, cw.height, err)
+			f.Close()
+			return
+		}
+		for _, b := range page[:min(len(page), base.Height-cw.height)] {
+			line, _ := json.Marshal(b)
+			w.Write(append(line, '\n'))
+			cw.block(b, int64(len(line)+1))
+		}
+	}
+	if err := w.Flush(); err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if cw.acc != base.PrefixHash || cw.tip != base.Tip || cw.res.BrokenAt != 0 {
+		log.Printf("[chain] history from %.8s doesn't match checkpoint %d; discarded", p.NodeID, base.Height)
+		return
+	}
+
+	s.chainMu.Lock()
+	defer s.chainMu.Unlock()
+	hist, err := os.ReadFile(part)
+	var cur []byte
+	if err == nil {
+		cur, err = os.ReadFile(s.chainPath())
+	}
+	if err == nil {
+		err = writeFileAtomic(s.chainPath(), append(hist, cur...))
+	}
+	if err != nil {
+		log.Printf("[chain] history splice: %v", err)
+		return
+	}
+	_ = os.Remove(filepath.Join(s.chainDir(), chainBaseFile))
+	for _, cp := range s.listCheckpoints() {
+		_ = os.Remove(s.checkpointPath(cp.Height)) // offsets moved
+	}
+	s.chain.base = nil
+	s.chain.bytes = int64(len(hist) + len(cur))
+	s.writeCheckpointLocked()
+	log.Printf("[chain] history below %d spliced in from %.8s", base.Height, p.NodeID)
+	s.catalog.index(s.readChain())
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// chainBurst is how many replicates arrive at once in each benchmark round.
+const (
+	chainBurst        = 1000
+	chainBurstReadGap = 50 * time.Microsecond
+)
+
+// chainBurstStats gathers append and tip-read latencies over the rounds.
+type chainBurstStats struct {
+	appends, reads []float64
+	writes         int
+}
+
+// burst releases chainBurst appenders at once, each reading the tip and
+// appending a block after it, while a reader polls the tip. Latency counts
+// from the release, not from when each appender got scheduled: a
+// replicate's sender waits from the moment it arrives.
+func (st *chainBurstStats) burst(round int, readTip func() string, appendFn func(Block, []byte) error) {
+	lat := make([]float64, chainBurst)
+	var reads []float64
+	stop, readerDone := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(readerDone)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			t := time.Now()
+			readTip()
+			reads = append(reads, float64(time.Since(t).Nanoseconds())/1e6)
+			time.Sleep(chainBurstReadGap)
+		}
+	}()
+	var start time.Time
+	var wg, ready sync.WaitGroup
+	gate := make(chan struct{})
+	for i := range chainBurst {
+		wg.Add(1)
+		ready.Add(1)
+		go func() {
+			defer wg.Done()
+			ready.Done()
+			<-gate
+			b := Block{Hash: sha256Hex([]byte(strconv.Itoa(round*chainBurst + i))), PrevHash: readTip(), Name: "bench", Created: start.Unix()}
+			line := fmt.Appendf(nil, `{"hash":%q,"prev_hash":%q,"name":"bench"}`+"\n", b.Hash, b.PrevHash)
+			_ = appendFn(b, line)
+			lat[i] = msSince(start)
+		}()
+	}
+	ready.Wait()
+	start = time.Now()
+	close(gate)
+	wg.Wait()
+	close(stop)
+	<-readerDone
+	st.appends = append(st.appends, lat...)
+	st.reads = append(st.reads, reads...)
+}
+
+func (st *chainBurstStats) report(b *testing.B) {
+	pct := func(ms []float64, p float64) float64 {
+		if len(ms) == 0 {
+			return 0
+		}
+		sort.Float64s(ms)
+		return ms[int(p*float64(len(ms)-1))]
+	}
+	b.ReportMetric(pct(st.appends, 0.50), "append-p50-ms")
+	b.ReportMetric(pct(st.appends, 0.99), "append-p99-ms")
+	b.ReportMetric(pct(st.reads, 0.99)*1000, "tip-p99-us")
+	if st.writes > 0 {
+		b.ReportMetric(float64(st.writes)/float64(b.N), "writes/op")
+	}
+}
+
+// benchLockedChain appends the way appendBlock did before the journal: one
+// mutex across each write, shared with every tip read.
+func benchLockedChain(b *testing.B, durable bool) {
+	var mu sync.Mutex
+	var tip string
+	var st chainBurstStats
+	path := filepath.Join(b.TempDir(), "chain.jsonl")
+	for i := 0; b.Loop(); i++ {
+		st.burst(i,
+			func() string { mu.Lock(); defer mu.Unlock(); return tip },
+			func(blk Block, line []byte) error {
+				mu.Lock()
+				defer mu.Unlock()
+				var err error
+				if durable {
+					err = appendFileSync(path, line)
+				} else {
+					err = appendFileNoSync(path, line)
+				}
+				tip = blk.Hash
+				st.writes++
+				return err
+			})
+	}
+	st.report(b)
+}
+
+func BenchmarkChainAppendLocked(b *testing.B)     { benchLockedChain(b, false) }
+func BenchmarkChainAppendLockedSync(b *testing.B) { benchLockedChain(b, true) }
+
+// BenchmarkChainAppendJournal batches the same bursts through a journal
+// writing a scratch file, with a lock-free tip.
+func BenchmarkChainAppendJournal(b *testing.B) {
+	var tip atomic.Value
+	tip.Store("")
+	var st chainBurstStats
+	path := filepath.Join(b.TempDir(), "chain.jsonl")
+	j := newChainJournal(func(batch []*journalReq) {
+		var buf []byte
+		for _, r := range batch {
+			buf = append(buf, r.line...)
+		}
+		err := appendFileSync(path, buf)
+		st.writes++
+		for _, r := range batch {
+			r.err = err
+		}
+		tip.Store(batch[len(batch)-1].b.Hash)
+	})
+	defer j.close()
+	for i := 0; b.Loop(); i++ {
+		st.burst(i, func() string { return tip.Load().(string) },
+			func(blk Block, line []byte) error { return j.submit(&journalReq{b: blk, line: line}) })
+	}
+	st.report(b)
+}
+
+// BenchmarkChainAppendServer is the journal as a node runs it: appendBlock
+// into the live chain, which also updates the chain state and catalog.
+func BenchmarkChainAppendServer(b *testing.B) {
+	s := newTestServer(b, "bench", nil)
+	var st chainBurstStats
+	for i := 0; b.Loop(); i++ {
+		st.burst(i, s.getChainTip, func(blk Block, _ []byte) error { return s.appendBlock(blk) })
+	}
+	st.report(b)
+}
+
+// A panic while a batch is written under chainMu is recovered by the
+// journal (flush), and must not leave chainMu held: the next append still
+// goes through.
+func TestChainBatchPanicReleasesLock(t *testing.T) {
+	s := newTestServer(t, "a", nil)
+	func() {
+		defer recoverOnce("chain-journal")
+		s.writeChainBatch([]*journalReq{nil})
+	}()
+
+	done := make(chan error, 1)
+	go func() { done <- s.appendBlock(Block{Hash: "after", PrevHash: s.getChainTip()}) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("append stuck: chainMu still held after the panic")
+	}
+	if tip := s.getChainTip(); tip != "after" {
+		t.Fatalf("tip %q", tip)
+	}
+}
+
+// appendFileNoSync appends data to path without an fsync.
+func appendFileNoSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
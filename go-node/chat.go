@@ -41,7 +41,7 @@ func (n *Node) publishChat(text string) error {
 	data, _ := json.Marshal(msg)
 	for _, pid := range n.h.Network().Peers() {
 		// FIX: host.Host has no Context(); use context.Background()
-		s, err := n.h.NewStream(context.Background(), pid, protoChat)
+		s, err := n.openStream(context.Background(), pid, protoChat)
 		if err != nil {
 			continue
 		}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Chunk pre-validation: before pushing an envelope (up to MaxDataBytes of
+// base64) the sender asks HEAD /chunk?hash= and skips peers that already
+// hold a verified copy and its block. /replicate itself also answers
+// "already_have" without rewriting the chunk. Older peers 404 the HEAD,
+// which reads as "don't have it", so they get the full envelope as before.
+
+const (
+	chunkSizeHeader     = "X-Chunk-Size"
+	chunkVerifiedHeader = "X-Chunk-Verified-At"
+	chunkInChainHeader  = "X-Chunk-In-Chain" // "1" if a chain block references it
+
+	chunkProbeTimeout = 5 * time.Second
+)
+
+var (
+	chunkHashRe = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+	chunkDedup = metricDef{"chunk_dedup_total", "transfers avoided because the peer already held the chunk", "side"}
+)
+
+type chunkVerified struct {
+	size int64
+	mod  time.Time
+	at   time.Time
+}
+
+// chunkVerifier remembers which chunk files were hashed and found intact,
+// so repeated probes don't re-read 100 MB files. A changed size or mtime
+// forces a re-hash.
+type chunkVerifier struct {
+	mu   sync.Mutex
+	seen map[string]chunkVerified
+}
+
+func newChunkVerifier() *chunkVerifier {
+	return &chunkVerifier{seen: make(map[string]chunkVerified)}
+}
+
+// haveChunk reports whether hash's chunk file exists and matches its hash.
+func (s *Server) haveChunk(hash string) (chunkVerified, bool) {
+	if !chunkHashRe.MatchString(hash) {
+		return chunkVerified{}, false
+	}
+	path := filepath.Join(s.paths.ChunksDir, hash+".bin")
+	st, err := os.Stat(path)
+	if err != nil || !st.Mode().IsRegular() {
+		return chunkVerified{}, false
+	}
+	v := s.chunkCheck
+	v.mu.Lock()
+	c, ok := v.seen[hash]
+	v.mu.Unlock()
+	if ok && c.size == st.Size() && c.mod.Equal(st.ModTime()) {
+		return c, true
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return chunkVerified{}, false
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil || hex.EncodeToString(h.Sum(nil)) != hash {
+		v.mu.Lock()
+		delete(v.seen, hash)
+		v.mu.Unlock()
+		return chunkVerified{}, false
+	}
+	c = chunkVerified{size: st.Size(), mod: st.ModTime(), at: time.Now()}
+	v.mu.Lock()
+	v.seen[hash] = c
+	v.mu.Unlock()
+	return c, true
+}
+
+// HEAD|GET /chunk?hash= (public): 200 with size and verification time if
+// the chunk is here and intact, 404 otherwise. X-Chunk-In-Chain tells
+// whether the block is here too; a chunk without its block still needs the
+// envelope.
+func (s *Server) handleChunkProbe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodHead && r.Method != http.MethodGet {
+		http.Error(w, "use HEAD", http.StatusMethodNotAllowed)
+		return
+	}
+	hash := r.URL.Query().Get("hash")
+	c, ok := s.haveChunk(hash)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set(chunkSizeHeader, strconv.FormatInt(c.size, 10))
+	w.Header().Set(chunkVerifiedHeader, c.at.UTC().Format(time.RFC3339))
+	_, err := s.blockFor(hash)
+	inChain := err == nil
+	if inChain {
+		w.Header().Set(chunkInChainHeader, "1")
+	} else {
+		w.Header().Set(chunkInChainHeader, "0")
+	}
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	writeJSON(w, map[string]any{"hash": hash, "size": c.size, "verified_at": c.at.UTC(), "in_chain": inChain})
+}
+
+// peerHasChunk asks p whether it already holds hash and its block. Any
+// error or non-200 (including old peers without /chunk) means no. Returns
+// the address that answered.
+func (s *Server) peerHasChunk(p PeerInfo, hash string) (string, bool) {
+	path := peerPath(p, "/chunk") + "?hash=" + url.QueryEscape(hash)
+	resp, addr, err := s.getFromPeer(p, http.MethodHead, path, chunkProbeTimeout)
+	if err != nil {
+		return "", false
+	}
+	resp.Body.Close()
+	return addr, resp.StatusCode == http.StatusOK && resp.Header.Get(chunkInChainHeader) == "1"
+}
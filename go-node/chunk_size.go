@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math/bits"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Chunk size per libp2p transfer. A fixed 256 KiB chunk left gigabit LANs
+// dominated by per-chunk overhead and was too big for lossy WebRTC or
+// relayed links. The sender now picks a size per peer: a chunk should take
+// about chunkTarget on the measured throughput of recent transfers to that
+// peer; until there is one, the ping RTT decides (LAN: the largest, slow
+// links: the smallest), and WebRTC and relayed paths never get more than
+// lossyChunk. Sizes are powers of two within --file-chunk-min and
+// --file-chunk-max, so a file is staged at a few sizes at most.
+//
+// Each size gets its own manifest, hashes and signature. Nonces come from
+// (file key, chunk size, index), so the same key never seals two different
+// plaintexts under one nonce. A receiver checks the declared size against
+// minChunkSize..maxChunkSize and the chunk count against the file size
+// before it decodes a chunk.
+
+const (
+	minChunkSize     = 16 << 10  // smallest size a receiver accepts
+	maxChunkSize     = 16 << 20  // largest; bounds what a manifest can make us allocate
+	defaultChunkSize = 256 << 10 // nothing measured yet (the old fixed size)
+
+	defaultFileChunkMin = 64 << 10
+	defaultFileChunkMax = 4 << 20
+
+	lossyChunk  = 64 << 10
+	chunkTarget = 250 * time.Millisecond
+	lanRTT      = 5 * time.Millisecond
+	slowRTT     = 150 * time.Millisecond
+
+	rateMinSample = 1 << 20 // smaller transfers fit the stream window and say nothing
+	rateWeight    = 0.3     // of a new sample in the smoothed rate
+)
+
+// chunkBounds clamps the configured bounds to what receivers accept.
+func chunkBounds(lo, hi int) (int, int) {
+	lo = floorPow2(min(max(lo, minChunkSize), maxChunkSize))
+	hi = floorPow2(min(max(hi, lo), maxChunkSize))
+	return lo, hi
+}
+
+func floorPow2(v int) int {
+	if v <= 0 {
+		return 0
+	}
+	return 1 << (bits.Len(uint(v)) - 1)
+}
+
+// chunkSizeFor picks the chunk size for a transfer to p.
+func (n *Node) chunkSizeFor(p peer.ID) int {
+	n.latMu.Lock()
+	rtt, rate := n.rtts[p], n.rates[p]
+	n.latMu.Unlock()
+	size := defaultChunkSize
+	switch {
+	case rate > 0:
+		size = int(rate * chunkTarget.Seconds())
+	case rtt > 0 && rtt < lanRTT:
+		size = n.chunkMax
+	case rtt > slowRTT:
+		size = n.chunkMin
+	}
+	if p != "" && n.lossyPath(p) {
+		size = min(size, lossyChunk)
+	}
+	return floorPow2(min(max(size, n.chunkMin), n.chunkMax))
+}
+
+// lossyPath reports whether every connection to p is relayed or WebRTC.
+func (n *Node) lossyPath(p peer.ID) bool {
+	conns := n.h.Network().ConnsToPeer(p)
+	for _, c := range conns {
+		if !c.Stat().Limited && !strings.Contains(c.ConnState().Transport, "webrtc") {
+			return false
+		}
+	}
+	return len(conns) > 0
+}
+
+// observeRate folds a transfer of wire bytes to p that spent busy writing
+// into p's smoothed throughput.
+func (n *Node) observeRate(p peer.ID, wire int, busy time.Duration) {
+	if wire < rateMinSample || busy <= 0 {
+		return
+	}
+	r := float64(wire) / busy.Seconds()
+	n.latMu.Lock()
+	if old, ok := n.rates[p]; ok {
+		r = old + rateWeight*(r-old)
+	}
+	n.rates[p] = r
+	n.latMu.Unlock()
+}
+
+// chunkNonce derives the nonce of chunk i of a file sealed at size.
+func chunkNonce(kFile []byte, size, i int) []byte {
+	return hkdfBytes(kFile, fmt.Sprintf("chunk-%d-%d", size, i), 12)
+}
+
+// checkChunking rejects a manifest whose chunk size or count doesn't fit
+// its file size.
+func checkChunking(man FileManifest) error {
+	if man.ChunkSize < minChunkSize || man.ChunkSize > maxChunkSize {
+		return fmt.Errorf("chunk size %d outside %d..%d", man.ChunkSize, minChunkSize, maxChunkSize)
+	}
+	if man.Size < 0 || int64(man.Chunks) != (man.Size+int64(man.ChunkSize)-1)/int64(man.ChunkSize) {
+		return fmt.Errorf("%d chunks don't hold %d bytes at %d", man.Chunks, man.Size, man.ChunkSize)
+	}
+	return nil
+}
+
+// chunkPlainLen is the plaintext length of chunk i of man.
+func chunkPlainLen(man FileManifest, i int) int {
+	if i == man.Chunks-1 {
+		return int(man.Size - int64(i)*int64(man.ChunkSize))
+	}
+	return man.ChunkSize
+}
+
+// chunkWireMax is the longest DataB64 a chunk of man may carry.
+func chunkWireMax(man FileManifest) int {
+	return base64.StdEncoding.EncodedLen(man.ChunkSize + 16) // GCM tag
+}
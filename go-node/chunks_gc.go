@@ -0,0 +1,93 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type gcCandidate struct {
+	Hash  string `json:"hash"`
+	Path  string `json:"path"`
+	Bytes int64  `json:"bytes"`
+}
+
+type gcPlan struct {
+	DryRun           bool          `json:"dry_run"`
+	Candidates       []gcCandidate `json:"candidates"`
+	ReclaimableBytes int64         `json:"reclaimable_bytes"`
+	Deleted          int           `json:"deleted"`
+	Errors           []string      `json:"errors,omitempty"`
+}
+
+// planChunkGC selects chunk files no block in the local chain references.
+// With execute=false it only reports; the selection is identical either way.
+func (s *Server) planChunkGC(execute bool) (gcPlan, error) {
+	plan := gcPlan{DryRun: !execute}
+	referenced := make(map[string]struct{})
+	for _, b := range s.readChain() {
+		referenced[b.Hash] = struct{}{}
+	}
+	entries, err := os.ReadDir(s.paths.ChunksDir)
+	if err != nil {
+		return plan, err
+	}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".bin") {
+			continue
+		}
+		hash := strings.TrimSuffix(e.Name(), ".bin")
+		if _, ok := referenced[hash]; ok {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		c := gcCandidate{Hash: hash, Path: filepath.Join(s.paths.ChunksDir, e.Name()), Bytes: info.Size()}
+		plan.Candidates = append(plan.Candidates, c)
+		plan.ReclaimableBytes += c.Bytes
+		if !execute {
+			continue
+		}
+		if err := os.Remove(c.Path); err != nil {
+			plan.Errors = append(plan.Errors, err.Error())
+			continue
+		}
+		plan.Deleted++
+	}
+	if execute {
+		log.Printf("[gc] removed %d orphan chunks (%d bytes)", plan.Deleted, plan.ReclaimableBytes)
+	}
+	return plan, nil
+}
+
+// POST /chunks/gc[?dry_run=true]
+func (s *Server) handleChunkGC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	execute := !isDryRun(r)
+	if execute {
+		if !s.maint.hold() {
+			s.writeMaintenance(w)
+			return
+		}
+		defer s.maint.release()
+	}
+	plan, err := s.planChunkGC(execute)
+	if err != nil {
+		http.Error(w, "gc fail: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, plan)
+}
+
+// isDryRun reads the ?dry_run= flag shared by destructive endpoints.
+func isDryRun(r *http.Request) bool {
+	v := r.URL.Query().Get("dry_run")
+	return v == "1" || v == "true"
+}
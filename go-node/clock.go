@@ -0,0 +1,130 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock sanity from beacons. Every beacon carries the sender's wall clock
+// (TS); the median of local-minus-TS across peers is our own offset from
+// the LAN. One peer with a bad clock doesn't move the median, a bad local
+// clock moves all of them. No NTP here: we measure, warn, and widen our own
+// acceptance windows so a skewed node keeps its peers.
+
+const (
+	defaultClockSkewWarn = time.Minute
+	clockSampleTTL       = 10 * time.Minute // forget peers we stopped hearing
+)
+
+type clockSample struct {
+	off time.Duration // local - peer
+	at  time.Time
+}
+
+type clockSkew struct {
+	selfID string
+	warn   time.Duration
+	adjust bool
+
+	mu     sync.Mutex
+	peers  map[string]clockSample
+	skewed bool
+}
+
+// clockState is what /ready and /sync/status report.
+type clockState struct {
+	SkewSeconds float64 `json:"clock_skew_seconds"` // >0: local clock ahead of peers
+	Peers       int     `json:"peers"`
+	Skewed      bool    `json:"skewed"`
+}
+
+func newClockSkew(selfID string, cfg *Config) *clockSkew {
+	return &clockSkew{selfID: selfID, warn: cfg.ClockSkewWarn, adjust: cfg.ClockSkewAdjust, peers: make(map[string]clockSample)}
+}
+
+// observe records the TS of a beacon from nodeID.
+func (c *clockSkew) observe(nodeID string, ts int64) {
+	if ts <= 0 || nodeID == c.selfID {
+		return
+	}
+	now := time.Now()
+	c.mu.Lock()
+	c.peers[nodeID] = clockSample{off: now.Sub(time.Unix(ts, 0)), at: now}
+	skew, n := c.medianLocked(now)
+	was := c.skewed
+	c.skewed = c.warn > 0 && n > 0 && absDur(skew) > c.warn
+	is := c.skewed
+	c.mu.Unlock()
+
+	if is && !was {
+		dir := "ahead of"
+		if skew < 0 {
+			dir = "behind"
+		}
+		log.Printf("[clock] WARNING: local clock is %s %s the median of %d peer(s); beacon freshness, command timestamps and expiries will misbehave; check NTP",
+			absDur(skew).Round(time.Second), dir, n)
+	} else if was && !is {
+		log.Printf("[clock] local clock back within %s of peers", c.warn)
+	}
+}
+
+// medianLocked drops stale samples and returns the median offset.
+func (c *clockSkew) medianLocked(now time.Time) (time.Duration, int) {
+	offs := make([]time.Duration, 0, len(c.peers))
+	for id, s := range c.peers {
+		if now.Sub(s.at) > clockSampleTTL {
+			delete(c.peers, id)
+			continue
+		}
+		offs = append(offs, s.off)
+	}
+	if len(offs) == 0 {
+		return 0, 0
+	}
+	sort.Slice(offs, func(i, j int) bool { return offs[i] < offs[j] })
+	m := len(offs) / 2
+	if len(offs)%2 == 0 {
+		return (offs[m-1] + offs[m]) / 2, len(offs)
+	}
+	return offs[m], len(offs)
+}
+
+func (c *clockSkew) state() clockState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	skew, n := c.medianLocked(time.Now())
+	return clockState{SkewSeconds: skew.Round(time.Second).Seconds(), Peers: n, Skewed: c.skewed}
+}
+
+// window widens a timestamp acceptance window by our measured skew while
+// the local clock is off, instead of dropping every peer.
+func (c *clockSkew) window(base time.Duration) time.Duration {
+	if !c.adjust {
+		return base
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.skewed {
+		return base
+	}
+	skew, _ := c.medianLocked(time.Now())
+	return base + absDur(skew)
+}
+
+// fresh reports whether a peer timestamp is within maxAge of local time
+// (0 = no check).
+func (c *clockSkew) fresh(ts int64, maxAge time.Duration) bool {
+	if maxAge <= 0 {
+		return true
+	}
+	return absDur(time.Since(time.Unix(ts, 0))) <= c.window(maxAge)
+}
+
+func absDur(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
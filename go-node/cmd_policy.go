@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultCmdDenyRoots keeps remote commands away from the OS even when no
+// allow list is configured.
+var defaultCmdDenyRoots = func() []string {
+	if runtime.GOOS == "windows" {
+		return []string{`C:\Windows`, `C:\Program Files`, `C:\Program Files (x86)`, `C:\ProgramData`}
+	}
+	return []string{"/bin", "/boot", "/dev", "/etc", "/lib", "/proc", "/sbin", "/sys", "/usr", "/var"}
+}()
+
+// cmdPolicy decides which folders incoming SyncCommands may touch. An empty
+// allow list permits anything not denied; deny always wins.
+type cmdPolicy struct {
+	mu       sync.RWMutex
+	allow    []string // canonical
+	deny     []string // canonical
+	rejected atomic.Int64
+}
+
+func newCmdPolicy(allow, deny []string) *cmdPolicy {
+	p := &cmdPolicy{}
+	p.set(allow, deny)
+	return p
+}
+
+func (p *cmdPolicy) set(allow, deny []string) {
+	a, d := canonicalRoots(allow), canonicalRoots(deny)
+	p.mu.Lock()
+	p.allow, p.deny = a, d
+	p.mu.Unlock()
+}
+
+func (p *cmdPolicy) roots() (allow, deny []string) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return append([]string(nil), p.allow...), append([]string(nil), p.deny...)
+}
+
+// check canonicalizes path and returns an error if the policy refuses it.
+func (p *cmdPolicy) check(path string) error {
+	if strings.TrimSpace(path) == "" {
+		return fmt.Errorf("empty folder path")
+	}
+	c := canonicalPath(path)
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, d := range p.deny {
+		if withinRoot(d, c) {
+			return fmt.Errorf("%s is under denied root %s", c, d)
+		}
+	}
+	if len(p.allow) == 0 {
+		return nil
+	}
+	for _, a := range p.allow {
+		if withinRoot(a, c) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is outside the allowed roots", c)
+}
+
+// canonicalPath makes path absolute, cleans it, resolves symlinks where it
+// exists and lower-cases it on Windows, so "..", links and case tricks can't
+// escape a root.
+func canonicalPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	path = filepath.Clean(path)
+	if real, err := filepath.EvalSymlinks(path); err == nil {
+		path = real
+	} else if os.IsNotExist(err) {
+		// resolve the deepest existing parent so a link above a missing dir still counts
+		dir, rest := filepath.Dir(path), filepath.Base(path)
+		for dir != filepath.Dir(dir) {
+			if real, err := filepath.EvalSymlinks(dir); err == nil {
+				path = filepath.Join(real, rest)
+				break
+			}
+			dir, rest = filepath.Dir(dir), filepath.Join(filepath.Base(dir), rest)
+		}
+	}
+	if runtime.GOOS == "windows" {
+		path = strings.ToLower(path)
+	}
+	return path
+}
+
+func canonicalRoots(roots []string) []string {
+	out := make([]string, 0, len(roots))
+	for _, r := range roots {
+		if r = strings.TrimSpace(r); r != "" {
+			out = append(out, canonicalPath(r))
+		}
+	}
+	return out
+}
+
+// withinRoot reports whether p is root or below it (both canonical).
+func withinRoot(root, p string) bool {
+	rel, err := filepath.Rel(root, p)
+	if err != nil {
+		return false
+	}
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))
+}
+
+// splitList parses a comma-separated flag value.
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// configView is the runtime configuration shown by GET|PATCH /config.
+type configView struct {
+	Mode          string   `json:"mode"`
+	APIPort       int      `json:"api_port"`
+	ControlPort   int      `json:"control_port"`
+	MCGroup       string   `json:"mc_group"`
+	MCPort        int      `json:"mc_port"`
+	TraceKeep     string   `json:"trace_retention"`
+	InboxMaxMsgs  int      `json:"inbox_max_msgs"`
+	InboxMaxBytes int64    `json:"inbox_max_bytes"`
+	InboxTTL      string   `json:"inbox_ttl"`     // "0s" = kept
+	InboxMaxTTL   string   `json:"inbox_max_ttl"` // "0s" = no cap
+	Quorum        int      `json:"replicate_quorum"`
+	CmdAllowRoots []string `json:"cmd_allow_roots"`
+	CmdDenyRoots  []string `json:"cmd_deny_roots"`
+	CmdRejected   int64    `json:"cmd_rejected"`
+}
+
+// configPatch lists the fields PATCH /config may change at runtime.
+type configPatch struct {
+	CmdAllowRoots *[]string `json:"cmd_allow_roots"`
+	CmdDenyRoots  *[]string `json:"cmd_deny_roots"`
+	InboxTTL      *string   `json:"inbox_ttl"`     // e.g. "7d", "36h", "0"
+	InboxMaxTTL   *string   `json:"inbox_max_ttl"` // e.g. "30d", "0"
+}
+
+// GET|PATCH /config (control)
+func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPatch:
+		var patch configPatch
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&patch); err != nil {
+			http.Error(w, "bad patch: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		ttl, maxTTL := s.inbox.ttls()
+		for _, f := range []struct {
+			v   *string
+			dst *time.Duration
+		}{{patch.InboxTTL, &ttl}, {patch.InboxMaxTTL, &maxTTL}} {
+			if f.v == nil {
+				continue
+			}
+			d, err := parseInboxTTL(*f.v)
+			if err != nil {
+				http.Error(w, "bad patch: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			*f.dst = d
+		}
+		s.inbox.setTTLs(ttl, maxTTL)
+		allow, deny := s.cmdPolicy.roots()
+		if patch.CmdAllowRoots != nil {
+			allow = *patch.CmdAllowRoots
+		}
+		if patch.CmdDenyRoots != nil {
+			deny = *patch.CmdDenyRoots
+		}
+		s.cmdPolicy.set(allow, deny)
+	default:
+		http.Error(w, "use GET or PATCH", http.StatusMethodNotAllowed)
+		return
+	}
+	allow, deny := s.cmdPolicy.roots()
+	ttl, maxTTL := s.inbox.ttls()
+	writeJSON(w, configView{
+		Mode:          s.cfg.Mode,
+		APIPort:       s.cfg.APIPort,
+		ControlPort:   s.cfg.ControlPort,
+		MCGroup:       s.cfg.MCGroup,
+		MCPort:        s.cfg.MCPort,
+		TraceKeep:     s.cfg.TraceKeep.String(),
+		InboxMaxMsgs:  s.cfg.InboxMaxMsgs,
+		InboxMaxBytes: s.cfg.InboxMaxBytes,
+		InboxTTL:      ttl.String(),
+		InboxMaxTTL:   maxTTL.String(),
+		Quorum:        s.cfg.ReplicateQuorum,
+		CmdAllowRoots: allow,
+		CmdDenyRoots:  deny,
+		CmdRejected:   s.cmdPolicy.rejected.Load(),
+	})
+}
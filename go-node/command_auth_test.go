@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Folder commands work between strict nodes: the origin signs the command,
+// the receiver signs its plan, and both are taken. A command or plan
+// changed on the way is refused, whatever the posture.
+func TestSignedCommandsUnderStrict(t *testing.T) {
+	cfgA, err := strictConfig(t, "--strict-crypto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfgB, _ := strictConfig(t, "--strict-crypto")
+	a, b := newTestServer(t, "a", cfgA), newTestServer(t, "b", cfgB)
+	mesh(t, a, b)
+
+	rr := callControl(a, http.MethodPost, "/command/broadcast?dry_run=true", a.ctlToken,
+		strings.NewReader(`{"type":"encrypt","folder_path":"`+t.TempDir()+`"}`))
+	var res struct {
+		MsgID string `json:"msgid"`
+		Sent  int    `json:"sent"`
+	}
+	if rr.Code != http.StatusOK || json.Unmarshal(rr.Body.Bytes(), &res) != nil || res.Sent != 1 {
+		t.Fatalf("broadcast: HTTP %d %s", rr.Code, rr.Body)
+	}
+	var plans []CommandPlan
+	eventually(t, "b's plan back at a", func() bool {
+		a.cmdResultsMu.Lock()
+		defer a.cmdResultsMu.Unlock()
+		plans = a.cmdResults[res.MsgID]
+		return len(plans) == 1
+	})
+	if plans[0].NodeID != b.id.NodeID || !plans[0].DryRun {
+		t.Fatalf("plan %+v", plans[0])
+	}
+	if n := b.legacy.counts()[legacyPlainCommands]; n != 0 {
+		t.Fatalf("b refused %d commands", n)
+	}
+
+	post := func(s *Server, path string, v any) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(v)
+		rr := httptest.NewRecorder()
+		s.PublicHandler().ServeHTTP(rr, httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body)))
+		return rr
+	}
+	open := newTestServer(t, "open", nil)
+	cmd := SyncCommand{Type: "encrypt", FolderPath: t.TempDir(), OriginNode: a.id.NodeID, MsgID: "forged", OrgID: "test", DryRun: true}
+	a.signCommand(&cmd)
+	cmd.FolderPath = "/"
+	for _, s := range []*Server{b, open} {
+		if rr := post(s, "/v1/p2p/command", cmd); rr.Code != http.StatusForbidden {
+			t.Errorf("%s took a changed command: HTTP %d %s", s.id.Hostname, rr.Code, rr.Body)
+		}
+	}
+
+	plan := CommandPlan{MsgID: res.MsgID, NodeID: b.id.NodeID, Type: "encrypt"}
+	plan.MAC = planMAC(commandKey(b.secrets.BeaconKey), plan)
+	plan.Files = []string{"/etc/passwd"}
+	if rr := post(a, "/v1/p2p/command/result", plan); rr.Code != http.StatusForbidden {
+		t.Errorf("a took a changed plan: HTTP %d %s", rr.Code, rr.Body)
+	}
+}
@@ -1,15 +1,15 @@
 package main
 
 import (
-	"bytes"
-	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
 	"io"
+	"io/fs"
 	"log"
 	"net/http"
 	"os"
-	"sync"
+	"path/filepath"
+	"strings"
 	"time"
 )
 
@@ -21,23 +21,55 @@ type SyncCommand struct {
 	OriginNode string `json:"origin_node"`
 	MsgID      string `json:"msgid"`
 	Timestamp  int64  `json:"timestamp"`
+	OrgID      string `json:"org_id,omitempty"`
+	DryRun     bool   `json:"dry_run,omitempty"` // receivers report what they'd touch instead of executing
+	MAC        string `json:"mac,omitempty"`     // origin's org MAC (command_auth.go)
 }
 
+// CommandPlan is what a receiver would (or did) act on for a command.
+// Dry-run plans travel back to the origin via /p2p/command/result.
+type CommandPlan struct {
+	MsgID      string   `json:"msgid"`
+	NodeID     string   `json:"node_id"`
+	Type       string   `json:"type"`
+	FolderPath string   `json:"folder_path"`
+	DryRun     bool     `json:"dry_run"`
+	Files      []string `json:"files"`
+	Bytes      int64    `json:"bytes"`
+	Truncated  bool     `json:"truncated,omitempty"`
+	Rejected   bool     `json:"rejected,omitempty"` // refused by the receiver's folder policy
+	Error      string   `json:"error,omitempty"`
+	MAC        string   `json:"mac,omitempty"` // receiver's org MAC (command_auth.go)
+}
+
+const maxPlanFiles = 10000
+
 // CommandCallback is called when receiving a command from peer
 type CommandCallback func(cmd SyncCommand)
 
-var (
-	commandCallbacks   []CommandCallback
-	commandCallbacksMu sync.RWMutex
-	seenCommands       = make(map[string]struct{})
-	seenCommandsMu     sync.Mutex
-)
-
 // RegisterCommandCallback registers a callback for incoming commands
-func RegisterCommandCallback(cb CommandCallback) {
-	commandCallbacksMu.Lock()
-	defer commandCallbacksMu.Unlock()
-	commandCallbacks = append(commandCallbacks, cb)
+func (s *Server) RegisterCommandCallback(cb CommandCallback) {
+	s.cmdCbMu.Lock()
+	defer s.cmdCbMu.Unlock()
+	s.cmdCallbacks = append(s.cmdCallbacks, cb)
+}
+
+// markCommandSeen records msgid; false if it was already seen.
+func (s *Server) markCommandSeen(msgid string) bool {
+	s.cmdSeenMu.Lock()
+	defer s.cmdSeenMu.Unlock()
+	if _, ok := s.cmdSeen[msgid]; ok {
+		return false
+	}
+	s.cmdSeen[msgid] = struct{}{}
+	return true
+}
+
+// forgetCommand unmarks msgid, for a command refused before it was acted on.
+func (s *Server) forgetCommand(msgid string) {
+	s.cmdSeenMu.Lock()
+	delete(s.cmdSeen, msgid)
+	s.cmdSeenMu.Unlock()
 }
 
 // handleP2PCommand receives command from peer and executes locally
@@ -46,7 +78,6 @@ func (s *Server) handleP2PCommand(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "use POST", http.StatusMethodNotAllowed)
 		return
 	}
-
 	var cmd SyncCommand
 	if err := json.NewDecoder(r.Body).Decode(&cmd); err != nil {
 		http.Error(w, "bad json: "+err.Error(), http.StatusBadRequest)
@@ -54,27 +85,41 @@ func (s *Server) handleP2PCommand(w http.ResponseWriter, r *http.Request) {
 	}
 	defer r.Body.Close()
 
+	if !s.commandAuthed(w, cmd.MAC, commandMAC(commandKey(s.secrets.BeaconKey), cmd)) {
+		return
+	}
+	if cmd.OrgID == "" && s.refuseLegacy(w, legacyUntaggedOrg) {
+		return
+	}
+	if !s.org.accept(cmd.OrgID, &s.org.foreignCommands) {
+		http.Error(w, "foreign org", http.StatusForbidden)
+		return
+	}
+
 	// Loop prevention
-	seenCommandsMu.Lock()
-	if _, ok := seenCommands[cmd.MsgID]; ok {
-		seenCommandsMu.Unlock()
+	if !s.markCommandSeen(cmd.MsgID) {
 		writeJSON(w, map[string]any{"status": "seen"})
 		return
 	}
-	seenCommands[cmd.MsgID] = struct{}{}
-	seenCommandsMu.Unlock()
 
-	log.Printf("[p2p-cmd] received %s from %s for folder: %s", cmd.Type, cmd.OriginNode, cmd.FolderPath)
-
-	// Execute callbacks (for DLL mode / in-process handling)
-	commandCallbacksMu.RLock()
-	for _, cb := range commandCallbacks {
-		go cb(cmd) // async so we don't block
+	// Forward to other peers; with no room to, refuse the command unseen
+	// so the sender can retry it
+	if !s.fwdPool.submit(func() { s.forwardCommand(cmd) }) {
+		s.forgetCommand(cmd.MsgID)
+		log.Printf("[p2p-cmd] %s from %s refused: forward pool full", cmd.MsgID, cmd.OriginNode)
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "busy: forward queue full", http.StatusServiceUnavailable)
+		return
 	}
-	commandCallbacksMu.RUnlock()
 
-	// Forward to other peers
-	go s.forwardCommand(cmd)
+	log.Printf("[p2p-cmd] received %s from %s for folder: %s (dry_run=%v)", cmd.Type, cmd.OriginNode, cmd.FolderPath, cmd.DryRun)
+
+	plan := s.runCommand(cmd, !cmd.DryRun)
+	if cmd.DryRun || plan.Rejected {
+		if !s.fwdPool.submit(func() { s.reportCommandResult(cmd.OriginNode, plan) }) {
+			log.Printf("[p2p-cmd] result for %s dropped: forward pool full", cmd.MsgID)
+		}
+	}
 
 	writeJSON(w, map[string]any{
 		"status": "received",
@@ -99,15 +144,27 @@ func (s *Server) handleBroadcastCommand(w http.ResponseWriter, r *http.Request)
 
 	// Fill in origin and timestamp
 	cmd.OriginNode = s.id.NodeID
+	cmd.OrgID = s.org.ID
 	cmd.Timestamp = time.Now().Unix()
 	if cmd.MsgID == "" {
-		cmd.MsgID = randomMsgID()
+		id, err := randomMsgID()
+		if err != nil {
+			http.Error(w, "msgid: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		cmd.MsgID = id
 	}
 
+	cmd.DryRun = isDryRun(r) || cmd.DryRun
+	s.signCommand(&cmd)
+
 	// Mark as seen locally
-	seenCommandsMu.Lock()
-	seenCommands[cmd.MsgID] = struct{}{}
-	seenCommandsMu.Unlock()
+	s.markCommandSeen(cmd.MsgID)
+
+	// Collect per-peer results for this msgid (dry-run plans)
+	s.cmdResultsMu.Lock()
+	s.cmdResults[cmd.MsgID] = []CommandPlan{}
+	s.cmdResultsMu.Unlock()
 
 	// Broadcast to all peers
 	sent := s.broadcastToPeers(cmd)
@@ -115,13 +172,170 @@ func (s *Server) handleBroadcastCommand(w http.ResponseWriter, r *http.Request)
 	log.Printf("[broadcast] sent %s command to %d peers", cmd.Type, sent)
 
 	writeJSON(w, map[string]any{
-		"status": "broadcast",
-		"type":   cmd.Type,
+		"status":  "broadcast",
+		"type":    cmd.Type,
+		"msgid":   cmd.MsgID,
+		"sent":    sent,
+		"dry_run": cmd.DryRun,
+	})
+}
+
+// planCommandFiles applies the Hoshizora client's selection rules: encrypt
+// touches everything not already encrypted, decrypt only encrypted files.
+func planCommandFiles(cmd SyncCommand) ([]string, int64, bool, error) {
+	var (
+		files     []string
+		total     int64
+		truncated bool
+	)
+	root := filepath.Clean(cmd.FolderPath)
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if p != root && !cmd.Recursive {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		enc := strings.HasSuffix(strings.ToLower(p), strings.ToLower(encryptedFileExt))
+		if (cmd.Type == "encrypt" && enc) || (cmd.Type == "decrypt" && !enc) {
+			return nil
+		}
+		if len(files) >= maxPlanFiles {
+			truncated = true
+			return filepath.SkipAll
+		}
+		if info, err := d.Info(); err == nil {
+			total += info.Size()
+		}
+		files = append(files, p)
+		return nil
+	})
+	return files, total, truncated, err
+}
+
+// runCommand checks a received command against the folder policy, plans it
+// and, when execute is set, dispatches it to callbacks (DLL mode) and the
+// pending slot (subprocess polling). Dry runs and real runs share the exact
+// same selection.
+func (s *Server) runCommand(cmd SyncCommand, execute bool) CommandPlan {
+	plan := CommandPlan{
+		MsgID:      cmd.MsgID,
+		NodeID:     s.id.NodeID,
+		Type:       cmd.Type,
+		FolderPath: cmd.FolderPath,
+		DryRun:     !execute,
+	}
+	if s.isVault() {
+		log.Printf("[p2p-cmd] %s from %s acknowledged but not run (vault node)", cmd.MsgID, cmd.OriginNode)
+		plan.Rejected = true
+		plan.Error = "vault node: sync commands are never executed"
+		s.emitCommand(eventCommandRejected, cmd, plan)
+		return plan
+	}
+	if err := s.cmdPolicy.check(cmd.FolderPath); err != nil {
+		s.cmdPolicy.rejected.Add(1)
+		log.Printf("[p2p-cmd] %s from %s rejected by folder policy: %v", cmd.MsgID, cmd.OriginNode, err)
+		plan.Rejected = true
+		plan.Error = "folder policy: " + err.Error()
+		s.emitCommand(eventCommandRejected, cmd, plan)
+		return plan
+	}
+	files, total, truncated, err := planCommandFiles(cmd)
+	plan.Files, plan.Bytes, plan.Truncated = files, total, truncated
+	if err != nil {
+		plan.Error = err.Error()
+	}
+	if !execute {
+		return plan
+	}
+
+	// Execute callbacks (for DLL mode / in-process handling), async so we
+	// don't block
+	s.dispatchCallbacks(cmd)
+	s.storePendingCommand(cmd)
+	s.emitCommand(eventCommandExecuted, cmd, plan)
+	return plan
+}
+
+func (s *Server) emitCommand(typ string, cmd SyncCommand, plan CommandPlan) {
+	s.emit(typ, map[string]any{
 		"msgid":  cmd.MsgID,
-		"sent":   sent,
+		"origin": cmd.OriginNode,
+		"type":   cmd.Type,
+		"folder": cmd.FolderPath,
+		"files":  len(plan.Files),
+		"bytes":  plan.Bytes,
+		"error":  plan.Error,
 	})
 }
 
+// reportCommandResult sends a plan back to the command's origin.
+func (s *Server) reportCommandResult(originID string, plan CommandPlan) {
+	defer recoverOnce("command")
+	origin, ok := s.peers.Get(originID)
+	if !ok || origin.Addr == "" {
+		log.Printf("[p2p-cmd] result for %s: origin %s address unknown", plan.MsgID, originID)
+		return
+	}
+	plan.MAC = planMAC(commandKey(s.secrets.BeaconKey), plan)
+	b, _ := json.Marshal(plan)
+	resp, _, err := s.postToPeer(origin, "/p2p/command/result", b, nil)
+	if err != nil {
+		log.Printf("[p2p-cmd] result to %s failed: %v", originID, err)
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+// handleCommandResult (public) accepts plans for commands this node originated.
+func (s *Server) handleCommandResult(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	var plan CommandPlan
+	if err := json.NewDecoder(io.LimitReader(r.Body, 8<<20)).Decode(&plan); err != nil {
+		http.Error(w, "bad json: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !s.commandAuthed(w, plan.MAC, planMAC(commandKey(s.secrets.BeaconKey), plan)) {
+		return
+	}
+	s.cmdResultsMu.Lock()
+	list, ok := s.cmdResults[plan.MsgID]
+	if ok {
+		s.cmdResults[plan.MsgID] = append(list, plan)
+	}
+	s.cmdResultsMu.Unlock()
+	if !ok {
+		http.Error(w, "unknown msgid", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, map[string]any{"status": "ok"})
+}
+
+// GET /command/results?msgid= (control)
+func (s *Server) handleCommandResults(w http.ResponseWriter, r *http.Request) {
+	msgid := r.URL.Query().Get("msgid")
+	if msgid == "" {
+		http.Error(w, "missing ?msgid=", http.StatusBadRequest)
+		return
+	}
+	s.cmdResultsMu.Lock()
+	list, ok := s.cmdResults[msgid]
+	out := append([]CommandPlan(nil), list...)
+	s.cmdResultsMu.Unlock()
+	if !ok {
+		http.Error(w, "unknown msgid", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, map[string]any{"msgid": msgid, "results": out})
+}
+
 // handleExportEnv exports env.enc for copying to other machines
 func (s *Server) handleExportEnv(w http.ResponseWriter, r *http.Request) {
 	envPath := s.paths.EnvFile
@@ -167,10 +381,9 @@ func (s *Server) broadcastToPeers(cmd SyncCommand) int {
 		if p.NodeID == s.id.NodeID || p.Addr == "" {
 			continue
 		}
-		url := "http://" + p.Addr + "/p2p/command"
-		resp, err := http.Post(url, "application/json", bytes.NewReader(cmdBytes))
+		resp, _, err := s.postToPeer(p, "/p2p/command", cmdBytes, nil)
 		if err != nil {
-			log.Printf("[broadcast] to %s failed: %v", p.Addr, err)
+			log.Printf("[broadcast] to %s failed: %v", p.NodeID[:8], err)
 			continue
 		}
 		io.Copy(io.Discard, resp.Body)
@@ -181,13 +394,16 @@ func (s *Server) broadcastToPeers(cmd SyncCommand) int {
 }
 
 func (s *Server) forwardCommand(cmd SyncCommand) {
+	defer recoverOnce("command")
 	s.broadcastToPeers(cmd)
 }
 
-func randomMsgID() string {
-	b := make([]byte, 16)
-	rand.Read(b)
-	return base64.RawURLEncoding.EncodeToString(b)
+func randomMsgID() (string, error) {
+	b, err := secureRandom(16)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
 }
 
 // storePendingCommand stores command for subprocess mode polling
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+	"strings"
+)
+
+// Files are compressed at the origin before sealing (ciphertext doesn't
+// compress). The envelope and Block record the codec and the original size;
+// hashes stay on the ciphertext, so replication checks don't change.
+
+const (
+	compGzip = "gzip"
+
+	compMinBytes   = 4 << 10 // not worth it below this
+	compSampleSize = 64 << 10
+	compMaxEntropy = 7.5  // bits/byte of the sample; above it, likely compressed already
+	compMinSaving  = 0.10 // keep the raw bytes unless we save at least 10%
+)
+
+// already-compressed formats, by extension
+var compSkipExt = map[string]bool{
+	".zip": true, ".gz": true, ".tgz": true, ".bz2": true, ".xz": true, ".zst": true, ".7z": true, ".rar": true,
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true, ".heic": true,
+	".mp3": true, ".mp4": true, ".mkv": true, ".mov": true, ".avi": true, ".ogg": true, ".flac": true,
+	".docx": true, ".xlsx": true, ".pptx": true, ".odt": true, ".ods": true, ".pdf": true, ".jar": true, ".apk": true,
+}
+
+// maybeCompress returns the gzipped data and compGzip, or data unchanged and
+// "" when it looks incompressible or compressing didn't pay off.
+func maybeCompress(name string, data []byte) ([]byte, string) {
+	if len(data) < compMinBytes || compSkipExt[strings.ToLower(filepath.Ext(name))] {
+		return data, ""
+	}
+	if sampleEntropy(data[:min(len(data), compSampleSize)]) > compMaxEntropy {
+		return data, ""
+	}
+	var buf bytes.Buffer
+	zw, _ := gzip.NewWriterLevel(&buf, gzip.DefaultCompression)
+	if _, err := zw.Write(data); err != nil {
+		return data, ""
+	}
+	if err := zw.Close(); err != nil {
+		return data, ""
+	}
+	if float64(buf.Len()) > float64(len(data))*(1-compMinSaving) {
+		return data, ""
+	}
+	return buf.Bytes(), compGzip
+}
+
+// sampleEntropy is the Shannon entropy of b in bits per byte (0..8).
+func sampleEntropy(b []byte) float64 {
+	var freq [256]int
+	for _, c := range b {
+		freq[c]++
+	}
+	var h float64
+	n := float64(len(b))
+	for _, f := range freq {
+		if f == 0 {
+			continue
+		}
+		p := float64(f) / n
+		h -= p * math.Log2(p)
+	}
+	return h
+}
+
+// decompressPayload undoes maybeCompress. rawSize bounds the output so a
+// hostile chunk can't inflate without limit.
+func decompressPayload(comp string, b []byte, rawSize int) ([]byte, error) {
+	switch comp {
+	case "":
+		return b, nil
+	case compGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		out, err := io.ReadAll(io.LimitReader(zr, int64(rawSize)+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(out) != rawSize {
+			return nil, fmt.Errorf("decompressed %d bytes, block says %d", len(out), rawSize)
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("unknown compression %q", comp)
+	}
+}
+
+// blockFor finds the chain block for a ciphertext hash.
+func (s *Server) blockFor(hash string) (Block, error) {
+	for _, b := range s.readChain() {
+		if b.Hash == hash {
+			return b, nil
+		}
+	}
+	return Block{}, errors.New("no block for hash " + hash)
+}
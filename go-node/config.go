@@ -3,6 +3,7 @@ package main
 import (
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,23 +19,258 @@ type Server struct {
 	mu           sync.RWMutex
 	kv           map[string][]byte
 	chainMu      sync.Mutex
-	chainTip     string
+	chainTip     atomic.Value  // string; set under chainMu, read without it
+	chain        chainState    // guarded by chainMu
+	journal      *chainJournal // the one writer of chain.jsonl (chain_journal.go)
 	seenMu       sync.Mutex
 	seen         map[string]struct{}
 	pendingCmdMu sync.Mutex
 	pendingCmd   *SyncCommand
+	cmdSeenMu    sync.Mutex
+	cmdSeen      map[string]struct{} // command msgids already handled (loop prevention)
+	health       *health             // subsystems that failed
+	cmdCbMu      sync.RWMutex
+	cmdCallbacks []CommandCallback
+	cmdResultsMu sync.Mutex
+	cmdResults   map[string][]CommandPlan // msgid -> plans reported by peers
+	traces       *traceStore
+	cmdPolicy    *cmdPolicy
+	inbox        *inboxQuota
+	fanout       *fanoutStats
+	ctlToken     string             // guards sensitive control endpoints
+	ctlTokens    *controlTokenStore // named, scoped control tokens
+	lowDisk      atomic.Bool
+	org          *orgGuard
+	clock        *clockSkew
+	lamport      *lamportClock
+	chunkCheck   *chunkVerifier
+	scrub        *scrubber
+	transports   *transportSelector
+	requests     atomic.Uint64 // public + control, for scrub yielding
+	webhooks     *webhookStore
+	peerCaps     *capsCache
+	profile      beaconProfile
+	transfers    *transferStore
+	abandoned    *abandonedSet
+	retention    *retentionStore
+	batches      *batchStore
+	rtt          *rttProber
+	dups         *dupDetector
+	wan          *wanOutbound // keysaver, webhooks: proxy-aware
+	egress       *egressPolicy
+	keysavers    *keysaverPool
+	retired      atomic.Bool // identity regenerated: stop beaconing this NodeID
+	maint        *maintenance
+	convs        *conversationStore
+	groups       *groupStore
+	reach        reachCache
+	lg           *loadgen
+	kvs          *kvSync
+	legacy       *legacyGuard
+	spill        *relaySpill
+	relayReplay  *relayReplayCache
+	deliveries   *deliveryTracker
+	selfAddr     string // ip:port peers reach our public API at; "" if unknown
+	pairings     *pairingStore
+	keys         *keyBackfill
+	disco        *discoveryGuard
+	catalog      *catalogStore
+	outbox       *outboxStore
+	replicateQ   *workQueue  // fanout retries (replicate_retry.go)
+	escrowQ      *workQueue  // queued key escrows (escrow_queue.go)
+	keyProof     mixKeyProof // signature over our mix key (key_continuity.go)
+	peerLog      *peerEvents // lifecycle history and events (peer_lifecycle.go)
+	announces    *dhtAnnouncer
+	fleet        *fleetStore
+	cbPool       *workPool // command callbacks (workpool.go)
+	fwdPool      *workPool // command forwards, results, trace reports
+	snapshots    *snapshotter
+	quarantine   *quarantineStore
+	events       *eventHub
+	logs         *logRing         // nil unless main tees the logger into it
+	p2p          *Node            // libp2p node with --p2p (node.go)
+	metrics      *metricsRegistry // this node's counters; the process's are in processMetrics
 }
 
 type Config struct {
+	Mode          string // modeNormal | modeVault (restart to change)
 	APIPort       int
 	MCGroup       string
 	MCPort        int
 	BroadcastIntv time.Duration
 	MaxDataBytes  int64
 	ControlPort   int
+	DataDir       string // storage root; "" = MIXNETS_DATA_DIR or ~/.mixnets
 	BindIP        string // HTTP bind IP (defaults to detected iface IP)
 	MCSubnet      string // e.g., "192.168.3.0/24"
 	MCIface       string // optional interface name to force
+	TraceKeep     time.Duration
+
+	// Final-hop mix inbox quotas (0 = unlimited)
+	InboxMaxMsgs        int
+	InboxMaxBytes       int64
+	InboxSenderMaxMsgs  int
+	InboxSenderMaxBytes int64
+
+	// Final-hop messages expire after InboxTTL unless the sender set an
+	// expiry, which is capped at InboxMaxTTL (0 = none; inbox_expiry.go)
+	InboxTTL    time.Duration
+	InboxMaxTTL time.Duration
+
+	// Folder roots incoming SyncCommands may (allow) or may not (deny) name;
+	// an empty allow list permits anything not denied
+	CmdAllowRoots []string
+	CmdDenyRoots  []string
+
+	// Replicate acks after which send-file reports the block durable
+	ReplicateQuorum int
+
+	// libp2p host: AutoNAT, relay v2 client and hole punching (off by default)
+	P2PNAT bool
+	Relays []string // static relay multiaddrs ending in /p2p/<id>
+	// Start the libp2p node next to the server (node.go)
+	P2P bool
+	// libp2p node's local HTTP API; give each node on a host its own
+	P2PHTTPAddr string
+	// Bounds of the per-peer libp2p file chunk size (chunk_size.go)
+	FileChunkMin int
+	FileChunkMax int
+
+	// Free space kept on the chunks filesystem; replicates that would dip
+	// below it get 507
+	DiskReserveBytes int64
+	DiskMinInodes    int64
+
+	Metrics bool // latency histograms (counts are always kept)
+
+	// Beacon-measured clock skew: warn threshold, whether to widen timestamp
+	// windows by it, and the beacon freshness window (0 = off)
+	ClockSkewWarn   time.Duration
+	ClockSkewAdjust bool
+	BeaconMaxAge    time.Duration
+
+	Compress bool // gzip compressible files before sealing
+
+	// Replicate metadata minimization (metapad.go): pad chunks to 64 KiB
+	// buckets, seal names with the file key
+	PadChunks bool
+	SealNames bool
+
+	// Mixnet message classes (interactive, bulk, background)
+	MixClasses map[string]mixClass
+
+	// Integrity scrub: time to re-hash every chunk once (0 = off)
+	ScrubPeriod time.Duration
+
+	// Key saver base URL, probed by the doctor and told of keys revoked by
+	// retention policies ("" = none)
+	KeySaverURL string
+
+	// Proxy for WAN-facing calls ("" = HTTPS_PROXY/HTTP_PROXY); peer calls
+	// never use one
+	ProxyURL string
+
+	// Where outbound connections may go: open, lan-only or allowlist, plus
+	// the hosts, IPs and CIDRs always allowed (egress.go)
+	EgressMode  string
+	EgressAllow []string
+
+	// How long a peer's /peer-info answer is trusted
+	PeerCapsTTL time.Duration
+
+	// Webhook deliveries are dead-lettered after this many attempts
+	WebhookMaxAttempts int
+
+	// A chain checkpoint is written every this many blocks (0 = off)
+	ChainCheckpointEvery int
+
+	// Latency probes sent per minute (0 = off)
+	RTTProbesPerMin int
+
+	// Mix path diversity (see path_diversity.go): hops differ in their
+	// IPv4 /PathSubnetBits (0 = off) and in the first PathHostPrefix
+	// hostname chars (0 = first label, -1 = off); PathRequireVault puts
+	// a vault on every path
+	PathSubnetBits   int
+	PathHostPrefix   int
+	PathRequireVault bool
+
+	// kv anti-entropy with one random peer per interval (0 = off)
+	KVReconcileInterval time.Duration
+
+	// Onion packets above RelaySpillBytes are relayed through encrypted
+	// temp files (0 = always in memory); RelayMaxBytes caps any packet
+	// (0 = no cap). See relay_spill.go.
+	RelaySpillBytes int64
+	RelayMaxBytes   int64
+
+	// Peeled layers remembered against replay (relay_replay.go); a zero
+	// window turns the check off.
+	RelayReplayWindow time.Duration
+	RelayReplayMax    int
+
+	// Legacy shims by code (see crypto_posture.go); --strict-crypto turns
+	// them all off
+	StrictCrypto bool
+	LegacyAccept map[string]bool
+
+	// Who beacons are sealed for: the BeaconKey group, each pairing, or
+	// both (see pairings.go)
+	BeaconMode string
+
+	// Received files wait in the quarantine for an accept (quarantine.go)
+	Quarantine bool
+
+	// Sends queued with ?queue=true are dropped after this (outbox.go)
+	OutboxMaxAge time.Duration
+
+	// Failed replicates are retried until this old (replicate_retry.go)
+	ReplicateRetryMaxAge time.Duration
+
+	// An unsigned mix key change for a known peer waits this long (0 = taken
+	// at once); see key_continuity.go
+	KeyChangeQuarantine time.Duration
+
+	// Peers not heard for PeerStaleAfter are stale, and dropped after
+	// PeerPruneAfter (0 = kept); see peer_lifecycle.go
+	PeerStaleAfter time.Duration
+	PeerPruneAfter time.Duration
+
+	// Provider records republished after DHTRepublish (0 = not announced);
+	// the first pass after startup spread over DHTWarmup (dht_announce.go)
+	DHTRepublish time.Duration
+	DHTWarmup    time.Duration
+
+	// Collect every peer's /fleet/report each AggregateInterval (fleet.go)
+	AggregateMetrics  bool
+	AggregateInterval time.Duration
+
+	// Workers and queue slots for command callbacks and for forwarding,
+	// and the goroutine count past which both refuse work (workpool.go)
+	CallbackWorkers int
+	CallbackQueue   int
+	ForwardWorkers  int
+	ForwardQueue    int
+	GoroutineBudget int
+
+	// Exports written to SnapshotDir ("" = off) on SnapshotSchedule,
+	// newest SnapshotKeep kept (snapshots.go)
+	SnapshotDir      string
+	SnapshotSchedule string
+	SnapshotKeep     int
+
+	// Decryptions recorded as access blocks: off, on or salted (access.go)
+	AccessLog string
+
+	// Apply pending data dir migrations at startup (migrate.go)
+	AutoMigrate bool
+
+	// Control requests without a token: local (allowed where they always
+	// were) or token (refused) (control_scopes.go)
+	ControlAuth string
+
+	// Synthetic load generator endpoints (/loadgen/*, see loadgen.go)
+	LoadGen bool
 }
 
 type ifacePick struct {
@@ -56,6 +292,8 @@ type EnvPaths struct {
 	KeyPath   string // legacy (still used by X25519 node keys if you kept that)
 	EnvEnc    string // NEW: env.enc (JSON with BeaconKey/FileKey)
 	EnvFile   string // Full path to env.enc file
+	StoreDir  string // libp2p file transfer: chunk parts and assembled files
+	TmpDir    string // uploads being received
 }
 
 type NodeIdentity struct {
@@ -67,38 +305,101 @@ type NodeIdentity struct {
 type PeerStore struct {
 	mu    sync.RWMutex
 	peers map[string]PeerInfo
+
+	// persistence (see peers_autosave.go): gen bumps when a peer appears or
+	// its identity/address changes, touched when only seen/probe state moves
+	gen, touched           uint64
+	savedGen, savedTouched uint64
+	lastSave               time.Time
+	changed                chan struct{}   // poked on gen bumps
+	watchers               []chan struct{} // see watch
+
+	keyQuarantine time.Duration   // see key_continuity.go
+	onKeyChange   func(keyChange) // called without the lock held
+
+	// lifecycle (see peer_lifecycle.go): active, stale or banned per peer
+	life         map[string]string
+	staleAfter   time.Duration
+	onTransition func([]peerTransition) // called without the lock held
 }
 
-// Beacon is the structure each node advertises (encrypted on wire)
+// Beacon is the structure each node advertises (encrypted on wire). Most
+// beacons are minimal: identity, port, tip and profile generation. Hostname,
+// pubkey and caps ride only in the occasional full beacon (for nodes that
+// predate the split) and on /peer-info, fetched when Gen changes.
 type Beacon struct {
-	Type     string `json:"type"`
-	NodeID   string `json:"node_id"`
-	APIPort  int    `json:"api_port"`
-	Hostname string `json:"hostname"`
-	TS       int64  `json:"ts"`
-	PubKey   string `json:"pubkey"` // Mixnet public key (base64)
+	Type     string   `json:"type"`
+	NodeID   string   `json:"node_id"`
+	APIPort  int      `json:"api_port"`
+	Hostname string   `json:"hostname,omitempty"`
+	TS       int64    `json:"ts"`
+	PubKey   string   `json:"pubkey,omitempty"` // Mixnet public key (base64)
+	Org      string   `json:"org,omitempty"`
+	API      int      `json:"api,omitempty"`     // newest public API version (0 = pre-versioning node)
+	Caps     []string `json:"caps,omitempty"`    // e.g. "vault"
+	Gen      uint64   `json:"gen,omitempty"`     // profile generation (0 = pre-split node)
+	Tip      string   `json:"tip,omitempty"`     // chain tip hash
+	Posture  string   `json:"posture,omitempty"` // crypto posture: strict, mixed or legacy
+
+	SignKey   string `json:"sign_key,omitempty"`   // Ed25519 key that signs the mix key (full beacons)
+	KeySig    string `json:"key_sig,omitempty"`    // see key_continuity.go
+	KeyIssued int64  `json:"key_issued,omitempty"` // when the mix key was minted
 }
 
 // PeerInfo is each peer record discovered
 type PeerInfo struct {
-	NodeID   string    `json:"node_id"`
-	Addr     string    `json:"addr"` // "ip:apiport"
-	APIPort  int       `json:"api_port"`
-	Hostname string    `json:"hostname"`
-	LastSeen time.Time `json:"last_seen"`
-	PubKey   []byte    `json:"-"`
+	NodeID     string     `json:"node_id"`
+	Addr       string     `json:"addr"` // "ip:apiport"
+	APIPort    int        `json:"api_port"`
+	Hostname   string     `json:"hostname"`
+	LastSeen   time.Time  `json:"last_seen"`
+	PubKey     []byte     `json:"-"`               // "pubkey" (base64url), see wire.go
+	Addrs      []PeerAddr `json:"addrs,omitempty"` // recent addresses, freshest first
+	APIVersion int        `json:"api_version,omitempty"`
+	Caps       []string   `json:"caps,omitempty"`           // e.g. "vault"
+	FreeBytes  int64      `json:"free_bytes,omitempty"`     // advertised via /peer-info
+	ProfileGen uint64     `json:"profile_gen,omitempty"`    // from beacons; 0 = pre-split node
+	Tip        string     `json:"tip,omitempty"`            // chain tip from the last beacon
+	Posture    string     `json:"crypto_posture,omitempty"` // from beacons; "" = predates postures
+	RTTms      float64    `json:"rtt_ms,omitempty"`         // smoothed round trip, see latency.go
+	RTTAt      time.Time  `json:"rtt_at,omitempty"`         // when RTTms last took a sample
+	KeyState   string     `json:"key_state,omitempty"`      // "pending-key" while /peer-info is fetched for a missing pubkey
+	MixFails   int        `json:"mix_fails,omitempty"`      // failed relays/injections in a row, see mix_failover.go
+	MixFailAt  time.Time  `json:"mix_fail_at,omitzero"`     // the last of them
+
+	// mix key continuity, see key_continuity.go; the keys are base64url on
+	// the wire like PubKey (wire.go)
+	SignKey        []byte    `json:"-"` // "sign_key": pinned key that signs its mix keys
+	KeyIssued      int64     `json:"key_issued,omitempty"`
+	PendingKey     []byte    `json:"-"` // "pending_key": new mix key awaiting confirmation
+	PendingSignKey []byte    `json:"-"` // "pending_sign_key"
+	PendingIssued  int64     `json:"pending_issued,omitempty"`
+	KeyChangedAt   time.Time `json:"key_changed_at,omitzero"`
+	KeyConflict    bool      `json:"key_conflict,omitempty"` // the old key was beaconed again
+	RejectedKey    []byte    `json:"-"`                      // "rejected_key"
 }
 type onionLayerPlain struct {
-	Next    string `json:"next"`    // next hop address (host:port) or empty if final
-	Payload string `json:"payload"` // base64(inner ciphertext)
+	Next    string `json:"next,omitempty"` // next hop address (host:port) or empty if final
+	Payload string `json:"payload"`        // base64(inner ciphertext)
 	Meta    struct {
 		Final bool   `json:"final"`
 		MsgID string `json:"msgid"`
 		TTL   int    `json:"ttl"`
+		Trace string `json:"trace,omitempty"` // origin NodeID to report hop events to (opt-in, de-anonymizes)
+		Class string `json:"class,omitempty"` // message class: picks the relay's delay bounds
+		Bin   bool   `json:"bin,omitempty"`   // the next hop's packet is binary (onion_binary.go)
 	} `json:"meta"`
+	Pad string `json:"pad,omitempty"` // JSON layers off a cell path: filler up to the class's bucket
+	Len int64  `json:"len,omitempty"` // binary layers and cells: payload bytes after the header
 }
 
+// onionPadBuckets are the sizes cells (onion_cell.go) and padded layers
+// round up to; past the last, a multiple of it. The smallest holds a text of a few KiB with the overhead
+// of a full mixTTL path.
+var onionPadBuckets = [...]int{8 << 10, 32 << 10, 128 << 10}
+
 type onionPacket struct {
+	V            int    `json:"v,omitempty"`   // layer key derivation (mixnet.go); absent: v1
 	EphemeralPub string `json:"ephemeral_pub"` // base64 32
 	Ciphertext   string `json:"ciphertext"`    // base64 nonce+ciphertext
 }
@@ -113,40 +414,76 @@ type PeerSnapshot struct {
 }
 
 type PeerBrief struct {
-	NodeID    string    `json:"node_id"`
-	Addr      string    `json:"addr"`
-	Hostname  string    `json:"hostname"`
-	LastSeen  time.Time `json:"last_seen"`
-	PubKeyB64 string    `json:"pubkey_b64"`
+	NodeID     string     `json:"node_id"`
+	Addr       string     `json:"addr"`
+	Hostname   string     `json:"hostname,omitempty"`
+	LastSeen   time.Time  `json:"last_seen"`
+	PubKeyB64  string     `json:"pubkey,omitempty"` // was pubkey_b64
+	Addrs      []PeerAddr `json:"addrs,omitempty"`
+	APIVersion int        `json:"api_version,omitempty"`
+	Caps       []string   `json:"caps,omitempty"`
 }
 
 type Block struct {
-	Hash     string `json:"hash"`
-	PrevHash string `json:"prev_hash"`
-	Name     string `json:"name"`
-	Size     int    `json:"size"`
-	Created  int64  `json:"created_unix"`
-	OriginID string `json:"origin_id"`
+	Hash      string `json:"hash"`
+	PrevHash  string `json:"prev_hash"`
+	Name      string `json:"name"`
+	Size      int    `json:"size"`
+	Created   int64  `json:"created_unix"`
+	OriginID  string `json:"origin_id"`
+	Comp      string `json:"comp,omitempty"`         // plaintext codec before sealing ("" or "gzip")
+	RawSize   int    `json:"raw_size,omitempty"`     // original file size when compressed
+	Logical   uint64 `json:"logical,omitempty"`      // origin's Lamport stamp (see lamport.go)
+	Batch     string `json:"batch,omitempty"`        // BatchID of a grouped send (see batch.go)
+	Kind      string `json:"kind,omitempty"`         // "" for data, blockEscrowReceipt, blockTombstone, blockAccess
+	PlainHash string `json:"plain_sha256,omitempty"` // plaintext SHA-256, for the catalog (catalog.go)
+
+	// metadata minimization (metapad.go): RawSize moves into the padded
+	// payload, and Name is base64url sealed with the file key
+	Pad        int  `json:"pad,omitempty"` // padding bucket of the sealed payload
+	NameSealed bool `json:"name_sealed,omitempty"`
+
+	Receipt   *escrowReceipt `json:"receipt,omitempty"`   // escrow receipts only
+	Tombstone *tombstone     `json:"tombstone,omitempty"` // tombstones only (see tombstone.go)
+	Access    *accessRecord  `json:"access,omitempty"`    // access records only (see access.go)
 }
 
+// EnvSecrets is the content of env.enc; the keys are stored there as
+// base64url(32B) (see envPlain). BeaconKey and FileKey are adjacent so
+// lockSecrets can lock them together.
 type EnvSecrets struct {
-	BeaconKeyB64 string   `json:"beacon_key_b64"` // base64url(32B)
-	FileKeyB64   string   `json:"file_key_b64"`   // base64url(32B)
-	BeaconKey    [32]byte `json:"-"`
-	FileKey      [32]byte `json:"-"`
+	OrgID     string   `json:"org_id,omitempty"`
+	ProxyUser string   `json:"proxy_user,omitempty"` // WAN proxy basic auth
+	ProxyPass string   `json:"proxy_pass,omitempty"`
+	BeaconKey [32]byte `json:"-"`
+	FileKey   [32]byte `json:"-"`
 }
 
+// FinalEnvelope is what the LAST hop receives as plaintext.
+// For Type "text", Data is the text boxed to the receiver (text_seal.go; hard-coded key
+// without text_eph); for "file", Data is raw file bytes.
 type FinalEnvelope struct {
 	Type       string `json:"type"` // "text" | "file"
 	SenderID   string `json:"sender_id"`
 	ReceiverID string `json:"receiver_id"`
 	Name       string `json:"name,omitempty"` // optional file name
 	MsgID      string `json:"msgid"`
-	DataB64    string `json:"data_b64"` // Base64URL-encoded payload (ciphertext for text; raw for file)
+	DataB64    string `json:"data_b64"`           // Base64URL-encoded payload (ciphertext for text; raw for file)
+	TextEph    string `json:"text_eph,omitempty"` // text boxed to the receiver: ephemeral X25519 pub (text_seal.go)
+	Logical    uint64 `json:"logical,omitempty"`  // sender's Lamport stamp
+	SentUnix   int64  `json:"sent_unix,omitempty"`
+	Expires    int64  `json:"expires_unix,omitempty"` // sender's wish; the receiver caps it
+	Ack        bool   `json:"ack,omitempty"`          // sender wants a delivery ack (delivery_ack.go)
+
+	// group messages and keys (groups.go)
+	Group      string `json:"group,omitempty"`
+	GroupOwner string `json:"group_owner,omitempty"`
+	GroupGen   uint64 `json:"group_gen,omitempty"`
 }
 
 func defaultConfig() *Config {
 	return &Config{
+		Mode:          modeNormal,
 		APIPort:       8080,
 		MCGroup:       "239.255.255.250",
 		MCPort:        35888,
@@ -154,5 +491,82 @@ func defaultConfig() *Config {
 		MaxDataBytes:  1 << 30,
 		MCSubnet:      "192.168.1.0/24",
 		ControlPort:   8081,
+		TraceKeep:     defaultTraceKeep,
+
+		InboxMaxMsgs:        defaultInboxMaxMsgs,
+		InboxMaxBytes:       defaultInboxMaxBytes,
+		InboxSenderMaxMsgs:  defaultInboxSenderMaxMsgs,
+		InboxSenderMaxBytes: defaultInboxSenderMaxBytes,
+		InboxTTL:            defaultInboxTTL,
+		InboxMaxTTL:         defaultInboxMaxTTL,
+
+		CmdDenyRoots: defaultCmdDenyRoots,
+
+		ReplicateQuorum: defaultReplicateQuorum,
+
+		DiskReserveBytes: defaultDiskReserve,
+		DiskMinInodes:    defaultDiskMinInodes,
+
+		Metrics: true,
+
+		ClockSkewWarn:   defaultClockSkewWarn,
+		ClockSkewAdjust: true,
+
+		Compress: true,
+
+		MixClasses: defaultMixClasses(),
+
+		ScrubPeriod: defaultScrubPeriod,
+
+		PeerCapsTTL:        defaultPeerCapsTTL,
+		WebhookMaxAttempts: defaultWebhookMaxAttempts,
+
+		ChainCheckpointEvery: defaultChainCheckpointEvery,
+		RTTProbesPerMin:      defaultRTTProbesPerMin,
+
+		PathSubnetBits: defaultPathSubnetBits,
+
+		EgressMode: egressOpen,
+
+		KVReconcileInterval: defaultKVReconcileInterval,
+
+		RelaySpillBytes:   defaultRelaySpillBytes,
+		RelayReplayWindow: defaultRelayReplayWindow,
+		RelayReplayMax:    defaultRelayReplayMax,
+
+		BeaconMode: beaconModeGroup,
+		Quarantine: true,
+
+		OutboxMaxAge: defaultOutboxMaxAge,
+
+		ReplicateRetryMaxAge: defaultReplicateRetryMaxAge,
+
+		KeyChangeQuarantine: defaultKeyChangeQuarantine,
+
+		PeerStaleAfter: defaultPeerStaleAfter,
+
+		DHTRepublish: defaultDHTRepublish,
+		DHTWarmup:    defaultDHTWarmup,
+
+		AggregateInterval: defaultAggregateInterval,
+
+		CallbackWorkers: defaultCallbackWorkers,
+		CallbackQueue:   defaultCallbackQueue,
+		ForwardWorkers:  defaultForwardWorkers,
+		ForwardQueue:    defaultForwardQueue,
+		GoroutineBudget: defaultGoroutineBudget,
+
+		SnapshotSchedule: defaultSnapshotSchedule,
+		SnapshotKeep:     defaultSnapshotKeep,
+
+		AccessLog: accessOff,
+
+		ControlAuth: controlAuthLocal,
+
+		P2PHTTPAddr:  defaultP2PHTTPAddr,
+		FileChunkMin: defaultFileChunkMin,
+		FileChunkMax: defaultFileChunkMax,
+
+		LegacyAccept: allLegacyAccepted(),
 	}
 }
@@ -1,10 +1,10 @@
 package main
 
 const (
-	httpAddr  = "127.0.0.1:7777"
-	mdnsTag   = "mixnets-sicftp-mdns"
-	protoChat = "/mixnets/chat/1.0.0"
-	protoFile = "/mixnets/file/1.0.0"
-	storeDir  = "storage"
-	maxChunk  = 256 * 1024 // 256KB per chunk (demo)
+	defaultP2PHTTPAddr = "127.0.0.1:7777" // libp2p node's local HTTP API
+	mdnsTag            = "mixnets-sicftp-mdns"
+	protoChat          = "/mixnets/chat/1.0.0"
+	protoFile          = "/mixnets/file/1.0.0"
+
+	encryptedFileExt = ".HSZR" // extension the Hoshizora client gives encrypted files
 )
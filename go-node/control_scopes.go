@@ -0,0 +1,394 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Control token scopes. Besides control.token (every scope; the DLL host,
+// the UI and `go-node ctl` use it), the control API accepts named tokens
+// limited to some of:
+//
+//	read-status        GETs of state, /metrics, /ready, /events
+//	send               sending and cancelling messages, files, batches
+//	recover            decrypting and recovering data, peer snapshots
+//	admin-destructive  keys, identity, config, retention, quarantine, tokens
+//
+// Named tokens live in control-tokens.json as SHA-256 hashes; the token
+// itself is shown once, by POST /control/tokens. Every control request
+// that carries a token is held to the scope of its route (controlScopes),
+// and one with a token that doesn't match is refused. With
+// --control-auth=local (the default) a request without a token still
+// reaches the read-status and send routes, which local processes always
+// used without one; recover and admin-destructive routes need a token
+// whatever the mode. --control-auth=token requires a token on every route
+// but /ui.
+
+const (
+	controlTokensFile = "control-tokens.json"
+
+	scopeRead    = "read-status"
+	scopeSend    = "send"
+	scopeRecover = "recover"
+	scopeAdmin   = "admin-destructive"
+
+	controlAuthLocal = "local"
+	controlAuthToken = "token"
+
+	controlTokenMaxName = 64
+)
+
+var allScopes = []string{scopeRead, scopeSend, scopeRecover, scopeAdmin}
+
+func validateControlAuth(m string) error {
+	switch m {
+	case controlAuthLocal, controlAuthToken:
+		return nil
+	}
+	return fmt.Errorf("--control-auth must be local or token, got %q", m)
+}
+
+// routeScope is what a route needs: read for GET and HEAD, write for the
+// other methods. An empty scope is open.
+type routeScope struct{ read, write string }
+
+func scopeRW(read, write string) routeScope { return routeScope{read, write} }
+func scopeAny(scope string) routeScope      { return routeScope{scope, scope} }
+
+// controlScopes maps each ControlHandler pattern to its scope. A pattern
+// missing here needs admin-destructive.
+var controlScopes = map[string]routeScope{
+	"/status":                        scopeAny(scopeRead),
+	"/ready":                         scopeAny(scopeRead),
+	"/metrics":                       scopeAny(scopeRead),
+	"/doctor":                        scopeAny(scopeRead),
+	"/events":                        scopeAny(scopeRead),
+	"/logs/tail":                     scopeAny(scopeRead),
+	"/org":                           scopeAny(scopeRead),
+	"/trace":                         scopeAny(scopeRead),
+	"/maintenance":                   scopeAny(scopeRead),
+	"/discovery/stats":               scopeAny(scopeRead),
+	"/sync/status":                   scopeAny(scopeRead),
+	"/chunks/scrub-status":           scopeAny(scopeRead),
+	"/kv/reconcile-status":           scopeAny(scopeRead),
+	"/peers":                         scopeRW(scopeRead, scopeAdmin),
+	"/peers/history":                 scopeAny(scopeRead),
+	"/peers/scores":                  scopeAny(scopeRead),
+	"/fleet/status":                  scopeAny(scopeRead),
+	"/fleet/metrics":                 scopeAny(scopeRead),
+	"/peers/transports":              scopeAny(scopeRead),
+	"/peers/reachability":            scopeAny(scopeRead),
+	"/peers/capabilities":            scopeAny(scopeRead),
+	"/chain/list":                    scopeAny(scopeRead),
+	"/chain/verify":                  scopeAny(scopeRead),
+	"/chain/tombstones":              scopeAny(scopeRead),
+	"/catalog":                       scopeAny(scopeRead),
+	"/dht/announcements":             scopeAny(scopeRead),
+	"/debug/goroutines":              scopeAny(scopeRead),
+	"/command/pending":               scopeAny(scopeRead),
+	"/command/results":               scopeAny(scopeRead),
+	"/escrow/audit":                  scopeAny(scopeRead),
+	"/escrow/status":                 scopeAny(scopeRead),
+	"/filekeys/list":                 scopeAny(scopeRead),
+	"/filekeys/unverified":           scopeAny(scopeRead),
+	"/queues":                        scopeAny(scopeRead),
+	"/retention/blocks":              scopeAny(scopeRead),
+	"/inbox/quota":                   scopeAny(scopeRead),
+	"/loadgen":                       scopeAny(scopeRead),
+	"/quarantine":                    scopeAny(scopeRead),
+	"/quarantine/{id}":               scopeAny(scopeRead),
+	"/ui":                            {},
+	"/mix/send-text":                 scopeAny(scopeSend),
+	"/mix/send-group":                scopeAny(scopeSend),
+	"/mix/send-file":                 scopeAny(scopeSend),
+	"/mix/send-batch":                scopeAny(scopeSend),
+	"/command/broadcast":             scopeAny(scopeSend),
+	"/batches":                       scopeAny(scopeRead),
+	"/batches/{id}":                  scopeAny(scopeRead),
+	"/batches/{id}/resume":           scopeAny(scopeSend),
+	"/transfers":                     scopeAny(scopeRead),
+	"/transfers/{id}":                scopeAny(scopeRead),
+	"/transfers/{id}/cancel":         scopeAny(scopeSend),
+	"/outbox":                        scopeRW(scopeRead, scopeSend),
+	"/outbox/{id}":                   scopeAny(scopeSend),
+	"/inbox":                         scopeRW(scopeRead, scopeSend),
+	"/mix/inbox":                     scopeRW(scopeRead, scopeSend),
+	"/mix/inbox/read":                scopeAny(scopeRead),
+	"/mix/status":                    scopeAny(scopeRead),
+	"/mix/conversations":             scopeAny(scopeRead),
+	"/groups":                        scopeRW(scopeRead, scopeAdmin),
+	"/mix/conversations/{peer}":      scopeAny(scopeRead),
+	"/mix/conversations/{peer}/read": scopeAny(scopeSend),
+	"/chunks/decrypt":                scopeAny(scopeRecover),
+	"/recover":                       scopeAny(scopeRecover),
+	"/recover/{id}":                  scopeRW(scopeRead, scopeRecover),
+	"/recover/{id}/cancel":           scopeAny(scopeRecover),
+	"/backup/get":                    scopeAny(scopeRecover),
+	"/chain/bootstrap":               scopeAny(scopeRecover),
+	"/kv/reconcile":                  scopeAny(scopeRecover),
+	"/peers/save":                    scopeAny(scopeRecover),
+	"/peers/load":                    scopeAny(scopeRecover),
+	"/peers/publish":                 scopeAny(scopeRecover),
+	"/peers/fetch":                   scopeAny(scopeRecover),
+	"/snapshots":                     scopeRW(scopeRead, scopeAdmin),
+	"/snapshots/run":                 scopeAny(scopeAdmin),
+	"/config":                        scopeRW(scopeRead, scopeAdmin),
+	"/retention/policies":            scopeRW(scopeRead, scopeAdmin),
+	"/quarantine/rules":              scopeRW(scopeRead, scopeAdmin),
+	// everything else, /identity/regenerate, /env/*, /filekeys/export,
+	// /chain/tombstone, /webhooks, /pairings, /control/tokens and the
+	// benchmarks among them, needs admin-destructive
+}
+
+func (rs routeScope) need(method string) string {
+	if method == http.MethodGet || method == http.MethodHead {
+		return rs.read
+	}
+	return rs.write
+}
+
+func scopeFor(pattern, method string) string {
+	rs, ok := controlScopes[pattern]
+	if !ok {
+		return scopeAdmin
+	}
+	return rs.need(method)
+}
+
+type namedToken struct {
+	Name    string    `json:"name"`
+	Hash    string    `json:"sha256"`
+	Scopes  []string  `json:"scopes"`
+	Created time.Time `json:"created"`
+}
+
+type controlTokenStore struct {
+	path string
+	mu   sync.Mutex
+	toks []namedToken
+}
+
+func newControlTokenStore(paths *EnvPaths) *controlTokenStore {
+	ts := &controlTokenStore{path: filepath.Join(paths.BaseDir, controlTokensFile)}
+	b, err := os.ReadFile(ts.path)
+	if err != nil {
+		return ts
+	}
+	if err := json.Unmarshal(b, &ts.toks); err != nil {
+		log.Printf("[control] ignoring unreadable %s: %v", ts.path, err)
+		ts.toks = nil
+	}
+	return ts
+}
+
+// saveLocked writes the tokens; callers hold ts.mu.
+func (ts *controlTokenStore) saveLocked() error {
+	b, _ := json.MarshalIndent(ts.toks, "", "  ")
+	return writeFileAtomic(ts.path, append(b, '\n'))
+}
+
+// lookup returns the named token tok is, if any.
+func (ts *controlTokenStore) lookup(tok string) (namedToken, bool) {
+	sum := sha256.Sum256([]byte(tok))
+	h := []byte(hex.EncodeToString(sum[:]))
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	for _, t := range ts.toks {
+		if subtle.ConstantTimeCompare(h, []byte(t.Hash)) == 1 {
+			return t, true
+		}
+	}
+	return namedToken{}, false
+}
+
+// controlCaller is who a control request's token says it is.
+type controlCaller struct {
+	name   string
+	scopes []string
+}
+
+// controlCaller resolves r's bearer token: ok is false for one that
+// matches nothing, and the caller is nil for a request without a token.
+func (s *Server) controlCaller(r *http.Request) (c *controlCaller, ok bool) {
+	h := r.Header.Get("Authorization")
+	if h == "" {
+		return nil, true
+	}
+	got := strings.TrimPrefix(h, "Bearer ")
+	if got == "" {
+		return nil, false
+	}
+	if s.ctlToken != "" && subtle.ConstantTimeCompare([]byte(got), []byte(s.ctlToken)) == 1 {
+		return &controlCaller{name: controlTokenFile, scopes: allScopes}, true
+	}
+	if t, found := s.ctlTokens.lookup(got); found {
+		return &controlCaller{name: t.Name, scopes: t.Scopes}, true
+	}
+	return nil, false
+}
+
+// authorizeControl enforces the scope of the route mux would send r to,
+// and reports whether to go on.
+func (s *Server) authorizeControl(w http.ResponseWriter, r *http.Request, mux *http.ServeMux) bool {
+	_, pattern := mux.Handler(r)
+	caller, ok := s.controlCaller(r)
+	if !ok {
+		log.Printf("[audit] %s %s denied: bad control token", r.Method, r.URL.Path)
+		http.Error(w, "bad control token", http.StatusUnauthorized)
+		return false
+	}
+	if pattern == "" {
+		return true // the mux's 404 or 405
+	}
+	need := scopeFor(pattern, r.Method)
+	if need == "" {
+		return true
+	}
+	if caller == nil {
+		if s.cfg.ControlAuth == controlAuthToken {
+			log.Printf("[audit] %s %s denied: no control token (--control-auth=token)", r.Method, r.URL.Path)
+			http.Error(w, "control token required", http.StatusUnauthorized)
+			return false
+		}
+		if !localTrusted(need) {
+			log.Printf("[audit] %s %s denied: no control token (scope %s)", r.Method, r.URL.Path, need)
+			http.Error(w, "control token with scope "+need+" required", http.StatusUnauthorized)
+			return false
+		}
+		return true // local trust
+	}
+	if !slices.Contains(caller.scopes, need) {
+		log.Printf("[audit] %s %s denied: token %q lacks scope %s", r.Method, r.URL.Path, caller.name, need)
+		http.Error(w, "control token lacks scope "+need, http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// localTrusted reports whether --control-auth=local lets a request
+// without a token through to a route that needs scope.
+func localTrusted(scope string) bool {
+	return scope == scopeRead || scope == scopeSend
+}
+
+type controlTokenCreate struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+type controlTokenView struct {
+	Name     string    `json:"name"`
+	Scopes   []string  `json:"scopes"`
+	Created  time.Time `json:"created,omitzero"`
+	Implicit bool      `json:"implicit,omitempty"` // control.token
+	Token    string    `json:"token,omitempty"`    // only in the POST answer
+}
+
+// GET/POST/DELETE /control/tokens (admin-destructive): list, create
+// ({"name","scopes"}; the answer carries the token, which isn't stored)
+// and delete (?name=) named control tokens.
+func (s *Server) handleControlTokens(w http.ResponseWriter, r *http.Request) {
+	ts := s.ctlTokens
+	switch r.Method {
+	case http.MethodGet:
+		out := []controlTokenView{{Name: controlTokenFile, Scopes: allScopes, Implicit: true}}
+		ts.mu.Lock()
+		for _, t := range ts.toks {
+			out = append(out, controlTokenView{Name: t.Name, Scopes: t.Scopes, Created: t.Created})
+		}
+		ts.mu.Unlock()
+		writeJSON(w, map[string]any{"tokens": out, "scopes": allScopes})
+	case http.MethodPost:
+		var req controlTokenCreate
+		if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil {
+			http.Error(w, "bad json", http.StatusBadRequest)
+			return
+		}
+		req.Name = strings.TrimSpace(req.Name)
+		if req.Name == "" || len(req.Name) > controlTokenMaxName || req.Name == controlTokenFile {
+			http.Error(w, fmt.Sprintf("name must be 1..%d characters and not %s", controlTokenMaxName, controlTokenFile), http.StatusBadRequest)
+			return
+		}
+		if len(req.Scopes) == 0 {
+			http.Error(w, "scopes required: "+strings.Join(allScopes, ", "), http.StatusBadRequest)
+			return
+		}
+		for _, sc := range req.Scopes {
+			if !slices.Contains(allScopes, sc) {
+				http.Error(w, "unknown scope "+sc, http.StatusBadRequest)
+				return
+			}
+		}
+		scopes := slices.Clone(req.Scopes)
+		sort.Strings(scopes)
+		scopes = slices.Compact(scopes)
+		raw := make([]byte, 32)
+		if _, err := rand.Read(raw); err != nil {
+			http.Error(w, "token gen: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		tok := base64.RawURLEncoding.EncodeToString(raw)
+		sum := sha256.Sum256([]byte(tok))
+		t := namedToken{Name: req.Name, Hash: hex.EncodeToString(sum[:]), Scopes: scopes, Created: time.Now().UTC()}
+		ts.mu.Lock()
+		for _, old := range ts.toks {
+			if old.Name == t.Name {
+				ts.mu.Unlock()
+				http.Error(w, "a token named "+t.Name+" exists", http.StatusConflict)
+				return
+			}
+		}
+		ts.toks = append(ts.toks, t)
+		err := ts.saveLocked()
+		if err != nil {
+			ts.toks = ts.toks[:len(ts.toks)-1]
+		}
+		ts.mu.Unlock()
+		if err != nil {
+			http.Error(w, "save: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("[audit] control token %q created (scopes %v)", t.Name, t.Scopes)
+		writeJSON(w, controlTokenView{Name: t.Name, Scopes: t.Scopes, Created: t.Created, Token: tok})
+	case http.MethodDelete:
+		name := r.URL.Query().Get("name")
+		ts.mu.Lock()
+		i := slices.IndexFunc(ts.toks, func(t namedToken) bool { return t.Name == name })
+		var err error
+		if i >= 0 {
+			old := ts.toks
+			ts.toks = slices.Delete(slices.Clone(old), i, i+1)
+			if err = ts.saveLocked(); err != nil {
+				ts.toks = old
+			}
+		}
+		ts.mu.Unlock()
+		if i < 0 {
+			http.Error(w, "no token named "+name, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "save: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("[audit] control token %q deleted", name)
+		writeJSON(w, map[string]any{"status": "ok", "deleted": name})
+	default:
+		http.Error(w, "use GET, POST or DELETE", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// newScopedToken creates a named control token with scopes on s.
+func newScopedToken(t *testing.T, s *Server, name string, scopes ...string) string {
+	t.Helper()
+	body, _ := json.Marshal(controlTokenCreate{Name: name, Scopes: scopes})
+	rr := callControl(s, http.MethodPost, "/control/tokens", s.ctlToken, strings.NewReader(string(body)))
+	var v controlTokenView
+	if rr.Code != http.StatusOK || json.Unmarshal(rr.Body.Bytes(), &v) != nil || v.Token == "" {
+		t.Fatalf("create %s: %d %s", name, rr.Code, rr.Body)
+	}
+	return v.Token
+}
+
+// A send-scoped token sends but can't reach the destructive routes: env.enc
+// export, identity regeneration, decryption or the token list itself.
+func TestControlScopeSendToken(t *testing.T) {
+	s := newTestServer(t, "s", nil)
+	send := newScopedToken(t, s, "sender", scopeSend)
+	for _, c := range []struct {
+		method, path string
+		want         int
+	}{
+		{http.MethodGet, "/env/export", http.StatusForbidden},
+		{http.MethodPost, "/identity/regenerate", http.StatusForbidden},
+		{http.MethodPost, "/filekeys/export", http.StatusForbidden},
+		{http.MethodPost, "/chunks/decrypt", http.StatusForbidden},
+		{http.MethodPost, "/recover", http.StatusForbidden},
+		{http.MethodPost, "/control/tokens", http.StatusForbidden},
+		{http.MethodGet, "/status", http.StatusForbidden},
+		{http.MethodPost, "/mix/send-text", http.StatusBadRequest},
+		{http.MethodGet, "/env/export", 0},
+	} {
+		tok := send
+		if c.want == 0 {
+			tok = s.ctlToken
+		}
+		rr := callControl(s, c.method, c.path, tok, strings.NewReader("{"))
+		switch {
+		case c.want == 0 && (rr.Code == http.StatusUnauthorized || rr.Code == http.StatusForbidden):
+			t.Errorf("control.token %s %s: %d %s", c.method, c.path, rr.Code, rr.Body)
+		case c.want != 0 && rr.Code != c.want:
+			t.Errorf("send token %s %s: %d, want %d (%s)", c.method, c.path, rr.Code, c.want, rr.Body)
+		}
+	}
+}
+
+// Under --control-auth=local a request without a token still reads and
+// sends, but recover and admin-destructive routes want a token.
+func TestControlAuthLocalRefusesPrivileged(t *testing.T) {
+	s := newTestServer(t, "s", nil)
+	if s.cfg.ControlAuth != controlAuthLocal {
+		t.Fatalf("default --control-auth is %q", s.cfg.ControlAuth)
+	}
+	for _, c := range []struct {
+		method, path string
+		open         bool
+	}{
+		{http.MethodGet, "/status", true},
+		{http.MethodGet, "/peers", true},
+		{http.MethodPost, "/mix/send-text", true},
+		{http.MethodGet, "/env/export", false},
+		{http.MethodPost, "/identity/regenerate", false},
+		{http.MethodPost, "/peers", false},
+		{http.MethodPost, "/config", false},
+		{http.MethodPost, "/chunks/decrypt", false},
+		{http.MethodPost, "/recover", false},
+		{http.MethodGet, "/backup/get", false},
+		{http.MethodPost, "/peers/load", false},
+		{http.MethodGet, "/ui", true},
+	} {
+		rr := callControl(s, c.method, c.path, "", strings.NewReader("{"))
+		if refused := rr.Code == http.StatusUnauthorized; refused == c.open {
+			t.Errorf("no token %s %s: %d %s", c.method, c.path, rr.Code, rr.Body)
+		}
+	}
+	if scopeFor("/env/export", http.MethodGet) != scopeAdmin || localTrusted(scopeAdmin) || localTrusted(scopeRecover) {
+		t.Fatal("admin-destructive and recover must never be locally trusted")
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The control token guards sensitive control endpoints (key export/import).
+// It is generated on first start into <BaseDir>/control.token, readable only
+// by the node's user; `go-node ctl` picks it up from there. It holds every
+// scope; narrower named tokens are in control_scopes.go.
+const controlTokenFile = "control.token"
+
+func controlTokenPath(baseDir string) string {
+	return filepath.Join(baseDir, controlTokenFile)
+}
+
+func loadOrCreateControlToken(paths *EnvPaths) string {
+	fp := controlTokenPath(paths.BaseDir)
+	if b, err := os.ReadFile(fp); err == nil {
+		if tok := strings.TrimSpace(string(b)); tok != "" {
+			return tok
+		}
+	}
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		log.Printf("[control] token gen: %v", err)
+		return ""
+	}
+	tok := base64.RawURLEncoding.EncodeToString(raw)
+	if err := os.WriteFile(fp, []byte(tok+"\n"), 0o600); err != nil {
+		log.Printf("[control] token write: %v", err)
+	}
+	return tok
+}
+
+// requireToken rejects requests without "Authorization: Bearer <token>",
+// the control token or a named one; the route's scope was checked by
+// authorizeControl.
+func (s *Server) requireToken(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if c, ok := s.controlCaller(r); !ok || c == nil {
+			log.Printf("[audit] %s %s denied: bad or missing control token", r.Method, r.URL.Path)
+			http.Error(w, "control token required", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
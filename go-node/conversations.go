@@ -0,0 +1,337 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Conversations. Text messages that reach this node as the final hop, and
+// the ones it sends, are threaded per (local NodeID, remote NodeID) in
+// conversations.enc, sealed with the env.enc FileKey like webhooks.enc.
+// Each message gets a per-conversation sequence number; ?since=<seq> pages
+// new messages and the read mark is a sequence number too. Threads are
+// ordered by Lamport stamp, the order both sides agree on. An outgoing
+// message is "sent" once the first hop took it, and "delivered" once the
+// receiver acked it (delivery_ack.go).
+
+const (
+	conversationsFile = "conversations.enc"
+	convKeep          = 1000 // messages kept per conversation, oldest dropped
+	convPreviewRunes  = 80
+
+	convIn  = "in"
+	convOut = "out"
+)
+
+type convMessage struct {
+	Seq     uint64 `json:"seq"`
+	MsgID   string `json:"msgid"`
+	Dir     string `json:"dir"`            // convIn | convOut
+	From    string `json:"from,omitempty"` // group threads: the sender
+	Text    string `json:"text"`
+	Logical uint64 `json:"logical"`
+	At      int64  `json:"at_unix"`                // received, or sent
+	State   string `json:"state"`                  // "received" | "sent" | "delivered"
+	Expires int64  `json:"expires_unix,omitempty"` // received only (inbox_expiry.go)
+}
+
+type conversation struct {
+	Local    string        `json:"local"`
+	Peer     string        `json:"peer"`
+	NextSeq  uint64        `json:"next_seq"`
+	ReadSeq  uint64        `json:"read_seq"` // messages up to here were read
+	Messages []convMessage `json:"messages"` // in Lamport order
+}
+
+// conversationView is one line of GET /mix/conversations.
+type conversationView struct {
+	Peer     string       `json:"peer"`
+	Messages int          `json:"messages"`
+	Unread   int          `json:"unread"`
+	Last     *convMessage `json:"last,omitempty"` // Text cut to a preview
+}
+
+type conversationStore struct {
+	path string
+	key  []byte
+
+	mu sync.Mutex
+	m  map[string]*conversation // convID(local, peer)
+}
+
+func convID(local, peer string) string { return local + "|" + peer }
+
+func newConversationStore(paths *EnvPaths, key []byte) *conversationStore {
+	cs := &conversationStore{path: filepath.Join(paths.BaseDir, conversationsFile), key: key, m: make(map[string]*conversation)}
+	blob, err := os.ReadFile(cs.path)
+	if err != nil {
+		return cs
+	}
+	var list []*conversation
+	plain, err := aeadOpenWithKey(key, blob)
+	if err == nil {
+		err = json.Unmarshal(plain, &list)
+	}
+	wipeBytes(plain)
+	if err != nil {
+		log.Printf("[conv] ignoring unreadable %s: %v", cs.path, err)
+		return cs
+	}
+	for _, c := range list {
+		cs.m[convID(c.Local, c.Peer)] = c
+	}
+	return cs
+}
+
+// saveLocked seals and writes all conversations; callers hold cs.mu.
+func (cs *conversationStore) saveLocked() {
+	list := make([]*conversation, 0, len(cs.m))
+	for _, c := range cs.m {
+		list = append(list, c)
+	}
+	b, _ := json.Marshal(list)
+	blob, err := aeadSealWithKey(cs.key, b)
+	wipeBytes(b)
+	if err == nil {
+		err = writeFileAtomic(cs.path, blob)
+	}
+	if err != nil {
+		log.Printf("[conv] save: %v", err)
+	}
+}
+
+// add threads one message; a msgid already in the conversation is ignored
+// (re-delivery).
+func (cs *conversationStore) add(local, peer string, msg convMessage) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	id := convID(local, peer)
+	c := cs.m[id]
+	if c == nil {
+		c = &conversation{Local: local, Peer: peer}
+		cs.m[id] = c
+	}
+	for _, m := range c.Messages {
+		if m.MsgID == msg.MsgID && m.Dir == msg.Dir {
+			return
+		}
+	}
+	c.NextSeq++
+	msg.Seq = c.NextSeq
+	c.Messages = append(c.Messages, msg)
+	sort.SliceStable(c.Messages, func(i, j int) bool {
+		a, b := c.Messages[i], c.Messages[j]
+		if a.Logical != b.Logical {
+			return a.Logical < b.Logical
+		}
+		return a.At < b.At
+	})
+	if len(c.Messages) > convKeep {
+		c.Messages = c.Messages[len(c.Messages)-convKeep:]
+	}
+	cs.saveLocked()
+}
+
+func (s *Server) convReceived(peer, msgid string, logical uint64, text []byte, expires int64) {
+	if peer == "" {
+		return
+	}
+	s.convs.add(s.id.NodeID, peer, convMessage{MsgID: msgid, Dir: convIn, Text: string(text), Logical: logical, At: time.Now().Unix(), State: "received", Expires: expires})
+}
+
+func (s *Server) convSent(peer, msgid string, logical uint64, text []byte) {
+	s.convs.add(s.id.NodeID, peer, convMessage{MsgID: msgid, Dir: convOut, Text: string(text), Logical: logical, At: time.Now().Unix(), State: "sent"})
+}
+
+// setState updates one outgoing message's state.
+func (cs *conversationStore) setState(local, peer, msgid, state string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	c := cs.m[convID(local, peer)]
+	if c == nil {
+		return
+	}
+	for i := range c.Messages {
+		if m := &c.Messages[i]; m.MsgID == msgid && m.Dir == convOut {
+			if m.State != state {
+				m.State = state
+				cs.saveLocked()
+			}
+			return
+		}
+	}
+}
+
+func (c *conversation) unread() int {
+	n := 0
+	for _, m := range c.Messages {
+		if m.Dir == convIn && m.Seq > c.ReadSeq {
+			n++
+		}
+	}
+	return n
+}
+
+func convPreview(text string) string {
+	if utf8.RuneCountInString(text) <= convPreviewRunes {
+		return text
+	}
+	r := []rune(text)
+	return string(r[:convPreviewRunes]) + "…"
+}
+
+// list returns local's conversations, most recent activity first.
+func (cs *conversationStore) list(local string) []conversationView {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	out := []conversationView{}
+	for _, c := range cs.m {
+		if c.Local != local {
+			continue
+		}
+		v := conversationView{Peer: c.Peer, Messages: len(c.Messages), Unread: c.unread()}
+		if n := len(c.Messages); n > 0 {
+			last := c.Messages[n-1]
+			last.Text = convPreview(last.Text)
+			v.Last = &last
+		}
+		out = append(out, v)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		var ai, aj int64
+		if out[i].Last != nil {
+			ai = out[i].Last.At
+		}
+		if out[j].Last != nil {
+			aj = out[j].Last.At
+		}
+		if ai != aj {
+			return ai > aj
+		}
+		return out[i].Peer < out[j].Peer
+	})
+	return out
+}
+
+// messages returns the thread with peer after sequence number since.
+func (cs *conversationStore) messages(local, peer string, since uint64) (conversation, bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	c := cs.m[convID(local, peer)]
+	if c == nil {
+		return conversation{}, false
+	}
+	out := *c
+	out.Messages = []convMessage{}
+	for _, m := range c.Messages {
+		if m.Seq > since {
+			out.Messages = append(out.Messages, m)
+		}
+	}
+	return out, true
+}
+
+// markRead moves the read mark to through (everything if 0). The mark
+// never moves back.
+func (cs *conversationStore) markRead(local, peer string, through uint64) (uint64, bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	c := cs.m[convID(local, peer)]
+	if c == nil {
+		return 0, false
+	}
+	if through == 0 || through > c.NextSeq {
+		through = c.NextSeq
+	}
+	if through > c.ReadSeq {
+		c.ReadSeq = through
+		cs.saveLocked()
+	}
+	return c.ReadSeq, true
+}
+
+// ---- control API ----
+
+// threadParam resolves the {peer} of a conversation route: a NodeID (or
+// prefix), or a group thread (groups.go) as is.
+func (s *Server) threadParam(w http.ResponseWriter, value string) (string, bool) {
+	if strings.HasPrefix(value, groupThreadPrefix) {
+		return value, true
+	}
+	return s.nodeIDParam(w, "peer", value)
+}
+
+// GET /mix/conversations (control): threads with a preview of the last
+// message and the unread count.
+func (s *Server) handleConversations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, s.convs.list(s.id.NodeID))
+}
+
+// GET /mix/conversations/{peer}[?since=<seq>] (control): the thread in
+// Lamport order, only messages with a higher seq if since is given.
+func (s *Server) handleConversation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	var since uint64
+	if v := r.URL.Query().Get("since"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, "bad since", http.StatusBadRequest)
+			return
+		}
+		since = n
+	}
+	peer, ok := s.threadParam(w, r.PathValue("peer"))
+	if !ok {
+		return
+	}
+	c, ok := s.convs.messages(s.id.NodeID, peer, since)
+	if !ok {
+		http.Error(w, "no conversation with that peer", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, c)
+}
+
+// POST /mix/conversations/{peer}/read[?through=<seq>] (control): mark the
+// thread read, up to seq or entirely.
+func (s *Server) handleConversationRead(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	var through uint64
+	if v := r.URL.Query().Get("through"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, "bad through", http.StatusBadRequest)
+			return
+		}
+		through = n
+	}
+	peer, ok := s.threadParam(w, r.PathValue("peer"))
+	if !ok {
+		return
+	}
+	read, ok := s.convs.markRead(s.id.NodeID, peer, through)
+	if !ok {
+		http.Error(w, "no conversation with that peer", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, map[string]any{"peer": peer, "read_seq": read})
+}
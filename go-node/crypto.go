@@ -3,7 +3,7 @@ package main
 import (
 	"crypto/aes"
 	"crypto/cipher"
-	"crypto/rand" // <- use this
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
@@ -14,6 +14,16 @@ import (
 	"golang.org/x/crypto/hkdf"
 )
 
+// secureRandom returns n bytes from the OS CSPRNG. All nonces, keys and IDs
+// must come from here (never math/rand).
+func secureRandom(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
 func hkdfBytes(key []byte, info string, n int) []byte {
 	h := hkdf.New(sha256.New, key, nil, []byte(info))
 	out := make([]byte, n)
@@ -45,8 +55,10 @@ func wrapKeyWithGroup(kFile []byte) (wrapped, nonce []byte, err error) {
 		return nil, nil, err
 	}
 	a := gcm(gk)
-	nonce = make([]byte, 12)
-	_, _ = rand.Read(nonce) // <- changed
+	nonce, err = secureRandom(12)
+	if err != nil {
+		return nil, nil, err
+	}
 	wrapped = a.Seal(nil, nonce, kFile, nil)
 	return wrapped, nonce, nil
 }
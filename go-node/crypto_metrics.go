@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// Crypto timings. Each helper does `defer hX.time()()`.
+var (
+	hKDF          = newHistogram("crypto_kdf_seconds", "Argon2id passphrase derivations")
+	hSeal         = newHistogram("crypto_file_seal_seconds", "XChaCha20-Poly1305 file/chunk sealing")
+	hOpen         = newHistogram("crypto_file_open_seconds", "XChaCha20-Poly1305 file/chunk opening")
+	hOnionLayer   = newHistogram("crypto_onion_layer_seconds", "building one onion layer (X25519 + seal)")
+	hRelayPeel    = newHistogram("crypto_relay_peel_seconds", "peeling one onion layer at a relay (X25519 + open)")
+	hBeaconSeal   = newHistogram("crypto_beacon_seal_seconds", "beacon encryption")
+	hBeaconOpen   = newHistogram("crypto_beacon_open_seconds", "beacon decryption (including failures)")
+	benchX25519Op = 100
+)
+
+type cryptoBench struct {
+	Seal1MiBMs   float64 `json:"seal_1mib_ms"`
+	Open1MiBMs   float64 `json:"open_1mib_ms"`
+	Argon2Ms     float64 `json:"argon2_ms"` // one kdf() call (64 MiB, t=2)
+	X25519x100Ms float64 `json:"x25519_x100_ms"`
+	MetricsOn    bool    `json:"metrics_enabled"`
+}
+
+func msSince(t time.Time) float64 {
+	return float64(time.Since(t).Microseconds()) / 1000
+}
+
+// GET /debug/crypto-bench (control): a short self-benchmark so support can
+// compare machines. Takes well under a second on anything but tiny VMs.
+func handleCryptoBench(w http.ResponseWriter, r *http.Request) {
+	var res cryptoBench
+	res.MetricsOn = metricsEnabled.Load()
+
+	key, err := secureRandom(32)
+	if err != nil {
+		http.Error(w, "random: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data, err := secureRandom(1 << 20)
+	if err != nil {
+		http.Error(w, "random: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	t := time.Now()
+	ct, err := aeadSealWithKey(key, data)
+	res.Seal1MiBMs = msSince(t)
+	if err != nil {
+		http.Error(w, "seal: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	t = time.Now()
+	if _, err := aeadOpenWithKey(key, ct); err != nil {
+		http.Error(w, "open: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res.Open1MiBMs = msSince(t)
+
+	t = time.Now()
+	kdf([]byte("crypto-bench"), key[:16])
+	res.Argon2Ms = msSince(t)
+
+	t = time.Now()
+	for i := 0; i < benchX25519Op; i++ {
+		if _, err := curve25519.X25519(key, curve25519.Basepoint); err != nil {
+			http.Error(w, "x25519: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	res.X25519x100Ms = msSince(t)
+	writeJSON(w, res)
+}
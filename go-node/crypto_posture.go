@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+)
+
+func init() { registerFeature(featureStrictCrypto) }
+
+// Strict crypto mode. A node still accepts a few formats older releases
+// send; each is a legacy shim with its own --accept-* flag, on by default.
+// --strict-crypto turns them all off, refuses to start if one is turned
+// back on, and checks the minimum crypto parameters at startup. A request
+// that needs a shim that is off gets 426 with the shim's code (beacons are
+// just dropped) and is counted. The effective posture is on /status and in
+// every beacon, so /peers shows which nodes still run with shims:
+//   strict  --strict-crypto
+//   mixed   some shims off
+//   legacy  every shim on (the default)
+
+const (
+	postureStrict = "strict"
+	postureMixed  = "mixed"
+	postureLegacy = "legacy"
+
+	legacyUntaggedOrg   = "legacy_untagged_org"      // beacons, replicates, commands and chain/kv reads without an OrgID
+	legacyUnversioned   = "legacy_unversioned_api"   // unprefixed public paths; beacons from pre-versioning nodes
+	legacyRawMix        = "legacy_raw_mix"           // final-hop payloads that aren't a FinalEnvelope, stored raw
+	legacySnapshotV1    = "legacy_snapshot_v1"       // peer snapshots sealed with math/rand nonces
+	legacyPlainCommands = "legacy_plaintext_command" // /p2p/command and results without a mac (command_auth.go)
+	legacyHardcodedText = "legacy_hardcoded_text"    // mix texts sealed with the shared hardcoded key
+	legacyOnionV1       = "legacy_onion_v1"          // onion layers keyed with SHA-256(shared), for relays without onion-hkdf
+
+	// Floors checked by --strict-crypto
+	strictKDFMemoryKiB = 64 * 1024
+	strictKDFTime      = 2
+	strictKeyLen       = 32
+	strictTLSMin       = tls.VersionTLS12
+)
+
+type legacyShim struct {
+	Code  string
+	Flag  string
+	Usage string
+}
+
+var legacyShims = []legacyShim{
+	{legacyUntaggedOrg, "accept-untagged-org", "accept peer traffic that carries no OrgID (pre-org nodes)"},
+	{legacyUnversioned, "accept-unversioned-api", "serve the unprefixed public paths and accept beacons from pre-versioning nodes"},
+	{legacyRawMix, "accept-raw-mix", "store final-hop mix payloads that aren't an envelope"},
+	{legacySnapshotV1, "accept-weak-snapshots", "import v1 peer snapshots (sealed with math/rand nonces)"},
+	{legacyPlainCommands, "accept-plaintext-commands", "accept folder commands and results without an org MAC (pre-MAC nodes)"},
+	{legacyHardcodedText, "accept-hardcoded-text", "open and send (?legacy=1) mix texts sealed with the shared hardcoded key"},
+	{legacyOnionV1, "accept-onion-v1", "peel v1 onion layers and build them for hops without onion-hkdf"},
+}
+
+// allLegacyAccepted is the default: every shim on.
+func allLegacyAccepted() map[string]bool {
+	m := make(map[string]bool, len(legacyShims))
+	for _, sh := range legacyShims {
+		m[sh.Code] = true
+	}
+	return m
+}
+
+// legacyFlags registers an --accept-* flag per shim plus --strict-crypto
+// on fs. After fs.Parse, apply fills cfg.LegacyAccept; under
+// --strict-crypto it fails if any --accept-* flag was set to true.
+func legacyFlags(fs *flag.FlagSet, cfg *Config) (apply func() error) {
+	accept := make(map[string]*bool, len(legacyShims))
+	for _, sh := range legacyShims {
+		accept[sh.Code] = fs.Bool(sh.Flag, true, sh.Usage+" (off under --strict-crypto)")
+	}
+	fs.BoolVar(&cfg.StrictCrypto, "strict-crypto", cfg.StrictCrypto, "refuse every legacy wire format and check crypto minimums at startup")
+	return func() error {
+		set := make(map[string]bool)
+		fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+		cfg.LegacyAccept = make(map[string]bool, len(legacyShims))
+		var bad []string
+		for _, sh := range legacyShims {
+			on := *accept[sh.Code]
+			if cfg.StrictCrypto {
+				if set[sh.Flag] && on {
+					bad = append(bad, "--"+sh.Flag)
+				}
+				on = false
+			}
+			cfg.LegacyAccept[sh.Code] = on
+		}
+		if len(bad) > 0 {
+			return fmt.Errorf("--strict-crypto refuses %s", strings.Join(bad, ", "))
+		}
+		return nil
+	}
+}
+
+// cryptoPosture summarizes cfg's legacy shims.
+func (cfg *Config) cryptoPosture() string {
+	if cfg.StrictCrypto {
+		return postureStrict
+	}
+	for _, sh := range legacyShims {
+		if !cfg.LegacyAccept[sh.Code] {
+			return postureMixed
+		}
+	}
+	return postureLegacy
+}
+
+// checkStrictCrypto asserts the minimum parameters --strict-crypto
+// promises. It runs once env.enc and the node keys are loaded.
+func checkStrictCrypto(cfg *Config, sec *EnvSecrets, nk *NodeKeypair) error {
+	var errs []error
+	if kdfMemoryKiB < strictKDFMemoryKiB || kdfTime < strictKDFTime {
+		errs = append(errs, fmt.Errorf("argon2id m=%dKiB t=%d below m=%dKiB t=%d", kdfMemoryKiB, kdfTime, strictKDFMemoryKiB, strictKDFTime))
+	}
+	if kdfKeyLen < strictKeyLen {
+		errs = append(errs, fmt.Errorf("kdf key %d bytes, want %d", kdfKeyLen, strictKeyLen))
+	}
+	var zero [32]byte
+	if sec.BeaconKey == zero {
+		errs = append(errs, errors.New("BeaconKey is all zero"))
+	}
+	if sec.FileKey == zero {
+		errs = append(errs, errors.New("FileKey is all zero"))
+	}
+	if nk == nil || nk.Pub == zero || nk.Priv == zero {
+		errs = append(errs, errors.New("node keypair missing"))
+	}
+	for _, u := range cfg.keysaverURLs() {
+		if p, err := url.Parse(u); err != nil || (p.Scheme != "https" && !isLoopbackHost(p.Hostname())) {
+			errs = append(errs, fmt.Errorf("keysaver %s is not https", u))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// legacyGuard answers whether a shim is on and counts what it refused.
+type legacyGuard struct {
+	accept   map[string]bool
+	rejected map[string]*atomic.Int64 // fixed keys; safe without a lock
+}
+
+func newLegacyGuard(cfg *Config) *legacyGuard {
+	g := &legacyGuard{accept: cfg.LegacyAccept, rejected: make(map[string]*atomic.Int64, len(legacyShims))}
+	if g.accept == nil {
+		g.accept = allLegacyAccepted()
+	}
+	for _, sh := range legacyShims {
+		g.rejected[sh.Code] = new(atomic.Int64)
+	}
+	return g
+}
+
+// allow reports whether shim code is on, counting a refusal if not. A nil
+// guard allows everything.
+func (g *legacyGuard) allow(code string) bool {
+	if g.on(code) {
+		return true
+	}
+	g.refused(code)
+	return false
+}
+
+// on is allow without counting, for checks that aren't a refusal yet.
+func (g *legacyGuard) on(code string) bool { return g == nil || g.accept[code] }
+
+func (g *legacyGuard) refused(code string) { g.rejected[code].Add(1) }
+
+func (g *legacyGuard) counts() map[string]int64 {
+	out := make(map[string]int64)
+	for code, n := range g.rejected {
+		if v := n.Load(); v > 0 {
+			out[code] = v
+		}
+	}
+	return out
+}
+
+// LegacyRejected is the 426 body for a request that needs a shim that is off.
+type LegacyRejected struct {
+	Status string `json:"status"` // "legacy_rejected"
+	Code   string `json:"code"`
+	NodeID string `json:"node_id"`
+}
+
+// refuseLegacy writes a 426 and returns true if shim code is off.
+func (s *Server) refuseLegacy(w http.ResponseWriter, code string) bool {
+	if s.legacy.allow(code) {
+		return false
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUpgradeRequired)
+	_ = json.NewEncoder(w).Encode(LegacyRejected{Status: "legacy_rejected", Code: code, NodeID: s.id.NodeID})
+	return true
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// strictConfig parses args the way main does and returns the config.
+func strictConfig(t *testing.T, args ...string) (*Config, error) {
+	t.Helper()
+	cfg := defaultConfig()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	apply := legacyFlags(fs, cfg)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return cfg, apply()
+}
+
+func TestStrictCryptoFlags(t *testing.T) {
+	cfg, err := strictConfig(t, "--strict-crypto")
+	if err != nil || cfg.cryptoPosture() != postureStrict {
+		t.Fatalf("%v %s", err, cfg.cryptoPosture())
+	}
+	for _, sh := range legacyShims {
+		if cfg.LegacyAccept[sh.Code] {
+			t.Errorf("%s still on under --strict-crypto", sh.Code)
+		}
+	}
+	if _, err := strictConfig(t, "--strict-crypto", "--accept-raw-mix=true"); err == nil || !strings.Contains(err.Error(), "--accept-raw-mix") {
+		t.Fatalf("a shim turned back on must refuse to start: %v", err)
+	}
+	if _, err := strictConfig(t, "--strict-crypto", "--accept-raw-mix=false"); err != nil {
+		t.Fatalf("turning a shim off is fine: %v", err)
+	}
+	if cfg, _ := strictConfig(t, "--accept-raw-mix=false"); cfg.cryptoPosture() != postureMixed {
+		t.Fatalf("one shim off: %s", cfg.cryptoPosture())
+	}
+	if cfg, _ := strictConfig(t); cfg.cryptoPosture() != postureLegacy {
+		t.Fatalf("default: %s", cfg.cryptoPosture())
+	}
+}
+
+func TestCheckStrictCrypto(t *testing.T) {
+	nk, err := newNodeKeypair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sec := &EnvSecrets{}
+	sec.BeaconKey[0], sec.FileKey[0] = 1, 1
+	cfg := defaultConfig()
+	if err := checkStrictCrypto(cfg, sec, nk); err != nil {
+		t.Fatal(err)
+	}
+	cfg.KeySaverURL = "http://keys.example:9000"
+	if err := checkStrictCrypto(cfg, &EnvSecrets{}, nil); err == nil ||
+		!strings.Contains(err.Error(), "BeaconKey") || !strings.Contains(err.Error(), "keypair") || !strings.Contains(err.Error(), "not https") {
+		t.Fatalf("%v", err)
+	}
+}
+
+// Every legacy path answers 426 with its shim's code on a strict node, and
+// something else on a default one, so the test can't pass on a dead route.
+func TestStrictCryptoRefusesLegacyPaths(t *testing.T) {
+	cfg, err := strictConfig(t, "--strict-crypto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	strict, open := newTestServer(t, "strict", cfg), newTestServer(t, "open", nil)
+	covered := map[string]bool{}
+
+	dir := t.TempDir()
+	pem := filepath.Join(dir, "k.pem")
+	os.WriteFile(pem, []byte("pem"), 0o600)
+	v1 := filepath.Join(dir, "v1.enc")
+	key, _ := deriveSymKeyFromPEM(pem)
+	aead, _ := chacha20poly1305.NewX(key)
+	plain, _ := json.Marshal(PeerSnapshot{Version: 1, NodeID: "old"})
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	os.WriteFile(v1, aead.Seal(nonce, nonce, plain, nil), 0o600)
+
+	type call struct {
+		code, method, path, body string
+		control                  bool
+		onion                    []byte // POSTed to /v1/mix/relay
+	}
+	rawMix := func(s *Server) []byte { return mixTo(t, s, onionV2, []byte("not an envelope")) }
+	hardText := func(s *Server) []byte {
+		env, _ := json.Marshal(FinalEnvelope{Type: "text", MsgID: "m", DataB64: "aGk"})
+		return mixTo(t, s, onionV2, env)
+	}
+	v1Layer := func(s *Server) []byte {
+		env, _ := json.Marshal(FinalEnvelope{Type: loadgenMixType, MsgID: "m"})
+		return mixTo(t, s, onionV1, env)
+	}
+	calls := []call{
+		{code: legacyUntaggedOrg, method: "POST", path: "/v1/replicate", body: `{"msgid":"m","hash_hex":"h"}`},
+		{code: legacyUntaggedOrg, method: "POST", path: "/v1/replicate/abandon", body: `{"hash":"h"}`},
+		{code: legacyUntaggedOrg, method: "GET", path: "/v1/kv/summary"},
+		{code: legacyUntaggedOrg, method: "GET", path: "/v1/kv/keys"},
+		{code: legacyUntaggedOrg, method: "GET", path: "/v1/chain/snapshot"},
+		{code: legacyUntaggedOrg, method: "GET", path: "/v1/chain/blocks"},
+		{code: legacyUnversioned, method: "GET", path: "/peer-info"},
+		{code: legacyPlainCommands, method: "POST", path: "/v1/p2p/command", body: `{"type":"encrypt","msgid":"m","org_id":"test"}`},
+		{code: legacyPlainCommands, method: "POST", path: "/v1/p2p/command/result", body: `{}`},
+		{code: legacyHardcodedText, method: "POST", path: "/mix/send-text?to=" + strings.Repeat("0", 64) + "&legacy=1", body: "hi", control: true},
+		{code: legacySnapshotV1, method: "POST", path: "/peers/load?pem=" + pem + "&in=" + v1, control: true},
+		{code: legacyRawMix},
+		{code: legacyHardcodedText},
+		{code: legacyOnionV1},
+	}
+	do := func(s *Server, c call) *httptest.ResponseRecorder {
+		var body []byte
+		switch {
+		case c.path != "":
+			body = []byte(c.body)
+		case c.code == legacyRawMix:
+			body = rawMix(s)
+		case c.code == legacyOnionV1:
+			body = v1Layer(s)
+		default:
+			body = hardText(s)
+		}
+		if c.control {
+			return callControl(s, c.method, c.path, s.ctlToken, bytes.NewReader(body))
+		}
+		if c.path == "" {
+			c.method, c.path = "POST", "/v1/mix/relay"
+		}
+		r := httptest.NewRequest(c.method, c.path, bytes.NewReader(body))
+		rr := httptest.NewRecorder()
+		s.PublicHandler().ServeHTTP(rr, r)
+		return rr
+	}
+	for i, c := range calls {
+		rr := do(strict, c)
+		var lr LegacyRejected
+		if rr.Code != http.StatusUpgradeRequired || json.Unmarshal(rr.Body.Bytes(), &lr) != nil || lr.Code != c.code || lr.Status != "legacy_rejected" {
+			t.Errorf("%d %s %s: strict answered %d %s, want 426 %s", i, c.method, c.path, rr.Code, rr.Body, c.code)
+			continue
+		}
+		covered[c.code] = true
+		if rr := do(open, c); rr.Code == http.StatusUpgradeRequired {
+			t.Errorf("%d %s %s: a default node refused it too", i, c.method, c.path)
+		}
+	}
+
+	// beacons are dropped, not answered
+	untagged, _ := encryptBeaconWithKey(Beacon{Type: "beacon", NodeID: "peer", API: 1, TS: time.Now().Unix()}, strict.secrets.BeaconKey[:])
+	if _, out := acceptBeacon(strict.cfg, strict.peers, &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 5000}, untagged,
+		strict.secrets.BeaconKey[:], strict.pairings, strict.org, strict.clock, strict.dups, nil); out != beaconRejected {
+		t.Errorf("untagged beacon: %s", out)
+	}
+	if out := hearBeacon(strict, "10.0.0.3", Beacon{NodeID: "peer2", APIPort: 1}, nil); out != beaconRejected {
+		t.Errorf("unversioned beacon: %s", out)
+	}
+	if out := hearBeacon(open, "10.0.0.3", Beacon{NodeID: "peer2", APIPort: 1}, nil); out != beaconAccepted {
+		t.Errorf("unversioned beacon on a default node: %s", out)
+	}
+
+	// a send to a peer that only peels v1 layers finds no path
+	v1Peer := PeerInfo{NodeID: hexA, Addr: "127.0.0.1:1", PubKey: open.nodeKeys.Pub[:], Caps: []string{capOnionBin}}
+	for _, s := range []*Server{strict, open} {
+		s.peers.Upsert(v1Peer)
+		hops, _, err := s.mixPath(pathFurthest, hexA, 1)
+		if s == strict && !errors.Is(err, errOnionV1Dest) {
+			t.Errorf("strict path to a v1 peer: %v %v", hops, err)
+		}
+		if s == open && (err != nil || hops[0].V != onionV1) {
+			t.Errorf("default path to a v1 peer: %v %v", hops, err)
+		}
+	}
+	if rr := callControl(strict, http.MethodPost, "/mix/send-text?to="+hexA, strict.ctlToken, strings.NewReader("hi")); rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "legacy_onion_v1") {
+		t.Errorf("strict send to a v1 peer: %d %s", rr.Code, rr.Body)
+	}
+
+	for _, sh := range legacyShims {
+		if !covered[sh.Code] {
+			t.Errorf("no test reaches %s", sh.Code)
+		}
+	}
+	if n := strict.legacy.counts(); n[legacyUntaggedOrg] < 7 || n[legacyUnversioned] < 2 || n[legacyOnionV1] < 3 {
+		t.Errorf("refusals not counted: %v", n)
+	}
+	rr := callControl(strict, http.MethodGet, "/status", strict.ctlToken, nil)
+	var st StatusResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &st); err != nil || st.CryptoPosture != postureStrict || len(st.LegacyRejected) != len(legacyShims) {
+		t.Fatalf("/status: %v %s", err, rr.Body)
+	}
+}
+
+// mixTo wraps payload in a one-hop onion for s, sealed at layer version v.
+func mixTo(t *testing.T, s *Server, v int, payload []byte) []byte {
+	t.Helper()
+	hops := []hopInfo{{NodeID: s.id.NodeID, Addr: s.selfAddr, PubKey: s.nodeKeys.Pub[:], V: v}}
+	onion, err := buildOnion(hops, payload, mixTTL, "", "", classBulk, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return onion
+}
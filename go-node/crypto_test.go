@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSnapshotCiphertextsDiffer(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	snap := PeerSnapshot{NodeID: "self", Created: time.Unix(1700000000, 0).UTC(), Peers: []PeerBrief{{NodeID: "a", Addr: "10.0.0.1:8080"}}}
+	a, err := encryptSnapshot(key, snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := encryptSnapshot(key, snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(a, b) {
+		t.Fatal("two snapshots of the same content sealed to the same bytes")
+	}
+	if bytes.Equal(a[:24], b[:24]) {
+		t.Fatal("nonce repeated")
+	}
+	for _, blob := range [][]byte{a, b} {
+		got, err := decryptSnapshot(key, blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Version != peerSnapshotVersion || got.NodeID != "self" || len(got.Peers) != 1 {
+			t.Fatalf("round trip: %+v", got)
+		}
+	}
+}
+
+func TestRandomMsgIDUnique(t *testing.T) {
+	seen := map[string]bool{}
+	for range 1000 {
+		id, err := randomMsgID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[id] {
+			t.Fatalf("msgid %s repeated", id)
+		}
+		seen[id] = true
+	}
+}
+
+// mathRandAllowed lists the files that may import a math/rand package and
+// which one. loadgen.go only picks synthetic destinations and sizes with it.
+var mathRandAllowed = map[string]string{
+	"loadgen.go": "math/rand/v2",
+}
+
+// walkSources parses every non-test Go file of the package tree with mode
+// and hands it to fn.
+func walkSources(t *testing.T, mode parser.Mode, fn func(path string, f *ast.File)) {
+	t.Helper()
+	fset := token.NewFileSet()
+	err := filepath.WalkDir(".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && path != "." && strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if d.IsDir() || !strings.HasSuffix(path, ".go") || strings.HasSuffix(path, "_test.go") {
+			return nil
+		}
+		f, err := parser.ParseFile(fset, path, nil, mode)
+		if err != nil {
+			return err
+		}
+		fn(filepath.ToSlash(path), f)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestNoMathRand keeps nonces, keys and IDs on secureRandom: no non-test
+// file may import math/rand outside mathRandAllowed.
+func TestNoMathRand(t *testing.T) {
+	walkSources(t, parser.ImportsOnly, func(path string, f *ast.File) {
+		for _, imp := range f.Imports {
+			p, _ := strconv.Unquote(imp.Path.Value)
+			if p != "math/rand" && !strings.HasPrefix(p, "math/rand/") {
+				continue
+			}
+			if mathRandAllowed[path] != p {
+				t.Errorf("%s imports %s; use secureRandom", path, p)
+			}
+		}
+	})
+}
+
+// TestRandErrorsChecked: a rand.Read whose error is dropped leaves a zero
+// nonce, key or ID behind if the CSPRNG ever fails. Use secureRandom, or
+// check the error.
+func TestRandErrorsChecked(t *testing.T) {
+	walkSources(t, 0, func(path string, f *ast.File) {
+		isRead := func(e ast.Expr) bool {
+			call, ok := e.(*ast.CallExpr)
+			if !ok {
+				return false
+			}
+			sel, ok := call.Fun.(*ast.SelectorExpr)
+			if !ok || sel.Sel.Name != "Read" {
+				return false
+			}
+			pkg, ok := sel.X.(*ast.Ident)
+			return ok && pkg.Name == "rand"
+		}
+		ast.Inspect(f, func(n ast.Node) bool {
+			var dropped bool
+			switch n := n.(type) {
+			case *ast.ExprStmt:
+				dropped = isRead(n.X)
+			case *ast.AssignStmt:
+				if len(n.Rhs) == 1 && len(n.Lhs) == 2 && isRead(n.Rhs[0]) {
+					id, ok := n.Lhs[1].(*ast.Ident)
+					dropped = ok && id.Name == "_"
+				}
+			}
+			if dropped {
+				t.Errorf("%s: rand.Read error dropped; use secureRandom", path)
+			}
+			return true
+		})
+	})
+}
@@ -0,0 +1,1427 @@
+//go:build !dll
+// +build !dll
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// `go-node ctl ...` talks to the local control API so nobody has to quote
+// JSON for curl. Exit codes: 0 ok, 1 API or network error, 2 usage error.
+
+type ctlClient struct {
+	base   string
+	token  string
+	output string // "table" or "json"
+	http   *http.Client
+}
+
+type ctlCmd struct {
+	name  string // "chain list"
+	usage string
+	run   func(c *ctlClient, args []string) error
+}
+
+var errUsage = errors.New("usage")
+
+var ctlCmds []ctlCmd
+
+// set in init: completion walks ctlCmds, which would otherwise be a cycle
+func init() {
+	registerFeature(featureCtl)
+	ctlCmds = []ctlCmd{
+		{"status", "", ctlStatus},
+		{"peers", "", ctlPeers},
+		{"peers reachability", "[--refresh]", ctlPeersReachability},
+		{"send-text", "--to <node_id> [--class interactive|bulk|background] [--path furthest|lowlatency] [--trace] [--expires-in 24h] <text|->", ctlSendText},
+		{"send-status", "[<msgid>]", ctlSendStatus},
+		{"send-file", "[--name <name>] [--trace] <path>", ctlSendFile},
+		{"send-batch", "[--label <label>] [--trace] <dir>", ctlSendBatch},
+		{"batches", "", ctlBatches},
+		{"batches show", "<id>", ctlBatchesShow},
+		{"batches resume", "<id>", ctlBatchesResume},
+		{"chain list", "[--logical]", ctlChainList},
+		{"chain delete", "[--reason <text>] [--revoke-escrow] <hash> | --batch <id>", ctlChainDelete},
+		{"chain tombstones", "[--pending] [--no-probe]", ctlChainTombstones},
+		{"inbox", "", ctlInbox},
+		{"conversations", "", ctlConversations},
+		{"conversations show", "[--since <seq>] [--read] <peer>", ctlConversationsShow},
+		{"chunks decrypt", "--hash <sha256> [--key <b64>] --out <file>", ctlChunksDecrypt},
+		{"recover", "[--out <dir>] [--hash <sha256> | --batch <id>] [--overwrite] [--dry-run]", ctlRecover},
+		{"transfers", "", ctlTransfers},
+		{"transfers cancel", "[--abandon] <id>", ctlTransfersCancel},
+		{"identity regenerate", "", ctlIdentityRegenerate},
+		{"retention policies", "", ctlRetentionPolicies},
+		{"retention add", "[--id <id>] [--origin <node_id>] [--name <glob>] [--hashes <a,b>] --action retain-forever|expire-after|replicate-minimum [--after 30d] [--min <n>]", ctlRetentionAdd},
+		{"retention rm", "<id>", ctlRetentionRm},
+		{"retention blocks", "[--hash <sha256>]", ctlRetentionBlocks},
+		{"retention apply", "[--dry-run]", ctlRetentionApply},
+		{"maintenance", "", ctlMaintenance},
+		{"maintenance enter", "[--for 30m]", ctlMaintenanceEnter},
+		{"maintenance exit", "", ctlMaintenanceExit},
+		{"loadgen", "", ctlLoadgen},
+		{"loadgen start", "--for 10m [--files <n/min>] [--file-size <bytes>] [--msgs <n/min>] [--msg-size <bytes>] [--class <name>] [--commands-every 1m]", ctlLoadgenStart},
+		{"loadgen stop", "", ctlLoadgenStop},
+		{"config get", "", ctlConfigGet},
+		{"config set", "cmd_allow_roots=<a,b> | cmd_deny_roots=<a,b> | inbox_ttl=7d | inbox_max_ttl=30d ...", ctlConfigSet},
+		{"filekeys list", "", ctlFileKeysList},
+		{"filekeys export", "--out <file> (passphrase: MIXNETS_KEYS_PASS)", ctlFileKeysExport},
+		{"filekeys import", "<file> (passphrase: MIXNETS_KEYS_PASS)", ctlFileKeysImport},
+		{"filekeys escrow", "<hash>", ctlFileKeysEscrow},
+		{"escrow audit", "[--node <node_id>]", ctlEscrowAudit},
+		{"events", "", ctlEvents},
+		{"completion", "bash|zsh|powershell", ctlCompletion},
+	}
+}
+
+func runCtl(args []string) int {
+	fs := flag.NewFlagSet("ctl", flag.ContinueOnError)
+	c := &ctlClient{http: &http.Client{Timeout: 5 * time.Minute}}
+	addr := envOr("MIXNETS_CTL_ADDR", "127.0.0.1:8081")
+	fs.StringVar(&addr, "addr", addr, "control API host:port (or MIXNETS_CTL_ADDR)")
+	fs.StringVar(&c.token, "token", envOr("MIXNETS_CTL_TOKEN", ""), "control token (or MIXNETS_CTL_TOKEN; default: read from the data dir)")
+	dataDir := fs.String("data-dir", "", "node data dir to read the token from (default: MIXNETS_DATA_DIR or ~/.mixnets)")
+	fs.StringVar(&c.output, "o", "table", "output: table or json")
+	fs.Usage = func() { ctlUsage(fs) }
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if c.output != "table" && c.output != "json" {
+		fmt.Fprintln(os.Stderr, "ctl: -o must be table or json")
+		return 2
+	}
+	c.base = "http://" + addr
+	if c.token == "" {
+		c.token = localControlToken(*dataDir)
+	}
+
+	cmd, rest := findCtlCmd(fs.Args())
+	if cmd == nil {
+		ctlUsage(fs)
+		return 2
+	}
+	if err := cmd.run(c, rest); err != nil {
+		if errors.Is(err, errUsage) {
+			fmt.Fprintf(os.Stderr, "usage: go-node ctl %s %s\n", cmd.name, cmd.usage)
+			return 2
+		}
+		fmt.Fprintln(os.Stderr, "ctl:", err)
+		return 1
+	}
+	return 0
+}
+
+// findCtlCmd matches the longest command name ("config get" before "config").
+func findCtlCmd(args []string) (*ctlCmd, []string) {
+	for n := 2; n >= 1; n-- {
+		if len(args) < n {
+			continue
+		}
+		name := strings.Join(args[:n], " ")
+		for i := range ctlCmds {
+			if ctlCmds[i].name == name {
+				return &ctlCmds[i], args[n:]
+			}
+		}
+	}
+	return nil, nil
+}
+
+func ctlUsage(fs *flag.FlagSet) {
+	fmt.Fprintln(os.Stderr, "usage: go-node ctl [--addr host:port] [--token T] [-o table|json] <command>")
+	fmt.Fprintln(os.Stderr, "\ncommands:")
+	for _, c := range ctlCmds {
+		fmt.Fprintf(os.Stderr, "  %-15s %s\n", c.name, c.usage)
+	}
+	fmt.Fprintln(os.Stderr, "\nflags:")
+	fs.PrintDefaults()
+}
+
+// localControlToken reads the token the node using dir ("" = default)
+// generated.
+func localControlToken(dir string) string {
+	if dir == "" {
+		var err error
+		if dir, err = defaultDataDir(); err != nil {
+			return ""
+		}
+	}
+	b, err := os.ReadFile(controlTokenPath(dir))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+func envOr(key, def string) string {
+	if v := strings.TrimSpace(os.Getenv(key)); v != "" {
+		return v
+	}
+	return def
+}
+
+// ---- HTTP ----
+
+type ctlAPIError struct {
+	Status int
+	Body   string
+}
+
+func (e *ctlAPIError) Error() string {
+	return fmt.Sprintf("HTTP %d: %s", e.Status, strings.TrimSpace(e.Body))
+}
+
+func (c *ctlClient) do(method, path string, q url.Values, body io.Reader, contentType string) (*http.Response, error) {
+	u := c.base + path
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return c.send(req)
+}
+
+// send adds the token and turns non-2xx answers into *ctlAPIError.
+func (c *ctlClient) send(req *http.Request) (*http.Response, error) {
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		return nil, &ctlAPIError{Status: resp.StatusCode, Body: string(b)}
+	}
+	return resp, nil
+}
+
+// call decodes a JSON response into out.
+func (c *ctlClient) call(method, path string, q url.Values, body io.Reader, contentType string, out any) error {
+	resp, err := c.do(method, path, q, body, contentType)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decode %s: %w", path, err)
+	}
+	return nil
+}
+
+// ---- output ----
+
+func (c *ctlClient) printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// show prints v as JSON with -o json, else the table rows.
+func (c *ctlClient) show(v any, header []string, rows [][]string) error {
+	if c.output == "json" {
+		return c.printJSON(v)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	if header != nil {
+		fmt.Fprintln(tw, strings.Join(header, "\t"))
+	}
+	for _, r := range rows {
+		fmt.Fprintln(tw, strings.Join(r, "\t"))
+	}
+	return tw.Flush()
+}
+
+// showKV prints a single object as key/value lines.
+func (c *ctlClient) showKV(v any, kv ...string) error {
+	rows := make([][]string, 0, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		rows = append(rows, []string{kv[i] + ":", kv[i+1]})
+	}
+	return c.show(v, nil, rows)
+}
+
+func short(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+func ago(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return time.Since(t).Round(time.Second).String()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// ---- commands ----
+
+func ctlStatus(c *ctlClient, args []string) error {
+	var st StatusResponse
+	if err := c.call("GET", "/status", nil, nil, "", &st); err != nil {
+		return err
+	}
+	maint := "-"
+	if st.Maintenance != nil {
+		maint = "until " + st.Maintenance.Until.Format(time.RFC3339)
+	}
+	egress := "-"
+	if e := st.Egress; e != nil {
+		var n uint64
+		for _, v := range e.Blocked {
+			n += v
+		}
+		egress = fmt.Sprintf("%s (%d blocked)", e.Mode, n)
+	}
+	return c.showKV(st,
+		"node_id", st.NodeID,
+		"hostname", st.Hostname,
+		"mode", st.Mode,
+		"api_port", fmt.Sprint(st.APIPort),
+		"time", st.Time.Format(time.RFC3339),
+		"clock_skew", fmt.Sprintf("%gs", st.ClockSkew),
+		"maintenance", maint,
+		"crypto", orDash(st.CryptoPosture),
+		"access_log", orDash(st.AccessLog),
+		"egress", egress,
+		"version", st.Build.Version+" "+orDash(short(st.Build.Commit)),
+		"features", strings.Join(st.Build.Features, ","),
+		"alerts", strings.Join(st.Alerts, ","))
+}
+
+func ctlPeers(c *ctlClient, args []string) error {
+	var peers []PeerInfo
+	if err := c.call("GET", "/peers", nil, nil, "", &peers); err != nil {
+		return err
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Hostname < peers[j].Hostname })
+	rows := make([][]string, 0, len(peers))
+	now := time.Now()
+	for _, p := range peers {
+		rtt := "-"
+		if d, ok := p.rtt(now); ok {
+			rtt = d.Round(100 * time.Microsecond).String()
+		}
+		rows = append(rows, []string{short(p.NodeID), p.Hostname, p.Addr, strings.Join(p.Caps, ","), fmt.Sprint(p.APIVersion), orDash(p.Posture), rtt, ago(p.LastSeen)})
+	}
+	return c.show(peers, []string{"NODE", "HOST", "ADDR", "CAPS", "API", "CRYPTO", "RTT", "SEEN"}, rows)
+}
+
+func ctlPeersReachability(c *ctlClient, args []string) error {
+	fs := flag.NewFlagSet("peers reachability", flag.ContinueOnError)
+	refresh := fs.Bool("refresh", false, "probe again instead of using a recent report")
+	if fs.Parse(args) != nil {
+		return errUsage
+	}
+	var q url.Values
+	if *refresh {
+		q = url.Values{"refresh": {"true"}}
+	}
+	var rep reachReport
+	if err := c.call("GET", "/peers/reachability", q, nil, "", &rep); err != nil {
+		return err
+	}
+	var rows [][]string
+	for _, p := range rep.Peers {
+		for _, pb := range p.Probes {
+			res := fmt.Sprintf("%.1fms", pb.LatencyMs)
+			if !pb.OK {
+				res = pb.Error
+			}
+			rows = append(rows, []string{short(p.NodeID), p.Hostname, pb.Transport, pb.Addr, fmt.Sprintf("%gs", p.BeaconAgeS), orDash(p.Excluded), res})
+		}
+		if len(p.Probes) == 0 {
+			rows = append(rows, []string{short(p.NodeID), p.Hostname, "-", "-", fmt.Sprintf("%gs", p.BeaconAgeS), orDash(p.Excluded), "no transport"})
+		}
+	}
+	return c.show(rep, []string{"NODE", "HOST", "TRANSPORT", "ADDR", "BEACON AGE", "EXCLUDED", "RESULT"}, rows)
+}
+
+func ctlSendText(c *ctlClient, args []string) error {
+	fs := flag.NewFlagSet("send-text", flag.ContinueOnError)
+	to := fs.String("to", "", "destination node id")
+	trace := fs.Bool("trace", false, "ask hops to report trace events")
+	class := fs.String("class", "", "message class (default interactive)")
+	path := fs.String("path", "", "path strategy: furthest, lowlatency, random or nearest (default: the class's)")
+	hops := fs.Int("hops", 0, "hops including the destination; fails if the network can't make a path that long (default: the class's)")
+	expires := fs.String("expires-in", "", "ask the receiver to drop it this long after sending, e.g. 24h or 7d")
+	if fs.Parse(args) != nil || *to == "" || fs.NArg() != 1 {
+		return errUsage
+	}
+	var body io.Reader = strings.NewReader(fs.Arg(0))
+	if fs.Arg(0) == "-" {
+		body = os.Stdin
+	}
+	q := url.Values{"to": {*to}}
+	if *trace {
+		q.Set("trace", "1")
+	}
+	if *class != "" {
+		q.Set("class", *class)
+	}
+	if *path != "" {
+		q.Set("path", *path)
+	}
+	if *hops != 0 {
+		q.Set("hops", fmt.Sprint(*hops))
+	}
+	if *expires != "" {
+		q.Set("expires_in", *expires)
+	}
+	var res SendTextResponse
+	if err := c.call("POST", "/mix/send-text", q, body, "text/plain", &res); err != nil {
+		return err
+	}
+	return c.showKV(res, "msgid", res.MsgID, "first_hop", res.FirstHop, "hops", fmt.Sprint(res.Hops), "class", res.Class,
+		"strategy", res.Strategy, "diversity", orDash(strings.Join(res.Diversity.Enforced, ",")), "relaxed", orDash(strings.Join(res.Diversity.Relaxed, ",")),
+		"ack", fmt.Sprint(res.Ack))
+}
+
+func ctlSendStatus(c *ctlClient, args []string) error {
+	if len(args) > 1 {
+		return errUsage
+	}
+	var list []DeliveryStatus
+	if len(args) == 1 {
+		var st DeliveryStatus
+		if err := c.call("GET", "/mix/status", url.Values{"msgid": {args[0]}}, nil, "", &st); err != nil {
+			return err
+		}
+		list = append(list, st)
+	} else if err := c.call("GET", "/mix/status", nil, nil, "", &list); err != nil {
+		return err
+	}
+	unix := func(t int64) string {
+		if t == 0 {
+			return "-"
+		}
+		return time.Unix(t, 0).Format(time.RFC3339)
+	}
+	rows := make([][]string, 0, len(list))
+	for _, st := range list {
+		rows = append(rows, []string{st.MsgID, short(st.To), st.State, unix(st.Sent), unix(st.Delivered), orDash(st.Via), orDash(st.Error)})
+	}
+	return c.show(list, []string{"MSGID", "TO", "STATE", "SENT", "DELIVERED", "VIA", "ERROR"}, rows)
+}
+
+func ctlSendFile(c *ctlClient, args []string) error {
+	fs := flag.NewFlagSet("send-file", flag.ContinueOnError)
+	name := fs.String("name", "", "name recorded in the chain (default: file's base name)")
+	trace := fs.Bool("trace", false, "ask hops to report trace events")
+	if fs.Parse(args) != nil || fs.NArg() != 1 {
+		return errUsage
+	}
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if *name == "" {
+		*name = filepath.Base(fs.Arg(0))
+	}
+	q := url.Values{"name": {*name}}
+	if *trace {
+		q.Set("trace", "1")
+	}
+	var res SendFileResponse
+	if err := c.call("POST", "/mix/send-file", q, f, "application/octet-stream", &res); err != nil {
+		return err
+	}
+	return c.showKV(res,
+		"msgid", res.MsgID,
+		"hash", res.Hash,
+		"key_file", res.KeyFile,
+		"fanout", fmt.Sprintf("%d/%d peers", res.Fanout, res.PeersSeen),
+		"durable", fmt.Sprintf("%v (quorum %d, pending %v)", res.Durable, res.Quorum, res.Pending),
+		"compression", fmt.Sprintf("%s (ratio %.2f)", orDash(res.Compression), res.Ratio))
+}
+
+// ctlSendBatch uploads every regular file under dir as one batch, streaming
+// the multipart body.
+func ctlSendBatch(c *ctlClient, args []string) error {
+	fs := flag.NewFlagSet("send-batch", flag.ContinueOnError)
+	label := fs.String("label", "", "batch label (default: the directory name)")
+	trace := fs.Bool("trace", false, "ask hops to report trace events")
+	if fs.Parse(args) != nil || fs.NArg() != 1 {
+		return errUsage
+	}
+	dir := fs.Arg(0)
+	var names []string
+	err := filepath.WalkDir(dir, func(p string, d os.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		names = append(names, filepath.ToSlash(rel))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("no files under %s", dir)
+	}
+	if *label == "" {
+		abs, _ := filepath.Abs(dir)
+		*label = filepath.Base(abs)
+	}
+	man, _ := json.Marshal(batchManifest{Label: *label, Files: names})
+
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		pw.CloseWithError(writeBatchParts(mw, dir, man, names))
+	}()
+	q := url.Values{}
+	if *trace {
+		q.Set("trace", "1")
+	}
+	var rec batchRecord
+	if err := c.call("POST", "/mix/send-batch", q, pr, mw.FormDataContentType(), &rec); err != nil {
+		return err
+	}
+	return showBatch(c, rec)
+}
+
+func writeBatchParts(mw *multipart.Writer, dir string, man []byte, names []string) error {
+	w, err := mw.CreateFormField("manifest")
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(man); err != nil {
+		return err
+	}
+	for _, n := range names {
+		h := textproto.MIMEHeader{}
+		h.Set("Content-Disposition", mime.FormatMediaType("form-data", map[string]string{"name": "file", "filename": n}))
+		h.Set("Content-Type", "application/octet-stream")
+		w, err := mw.CreatePart(h)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(filepath.Join(dir, filepath.FromSlash(n)))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
+
+func showBatch(c *ctlClient, rec batchRecord) error {
+	rows := make([][]string, 0, len(rec.Members))
+	for _, m := range rec.Members {
+		rows = append(rows, []string{m.Name, short(m.Hash), m.State, fmt.Sprintf("%d/%d", m.Acked, rec.Quorum), m.Error})
+	}
+	if err := c.show(rec, []string{"NAME", "HASH", "STATE", "ACKED", "ERROR"}, rows); err != nil {
+		return err
+	}
+	if c.output == "table" {
+		d, n := rec.counts()
+		fmt.Printf("\nbatch %s: %s, %d of %d members durable\n", rec.ID, rec.State, d, n)
+	}
+	return nil
+}
+
+func ctlBatches(c *ctlClient, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	var list []batchRecord
+	if err := c.call("GET", "/batches", nil, nil, "", &list); err != nil {
+		return err
+	}
+	rows := make([][]string, 0, len(list))
+	for _, b := range list {
+		rows = append(rows, []string{b.ID, b.State, orDash(b.Label), b.Created.Local().Format(time.RFC3339)})
+	}
+	return c.show(list, []string{"ID", "STATE", "LABEL", "CREATED"}, rows)
+}
+
+func ctlBatchesShow(c *ctlClient, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	var rec batchRecord
+	if err := c.call("GET", "/batches/"+url.PathEscape(args[0]), nil, nil, "", &rec); err != nil {
+		return err
+	}
+	return showBatch(c, rec)
+}
+
+func ctlBatchesResume(c *ctlClient, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	var rec batchRecord
+	if err := c.call("POST", "/batches/"+url.PathEscape(args[0])+"/resume", nil, nil, "", &rec); err != nil {
+		return err
+	}
+	return showBatch(c, rec)
+}
+
+func ctlChainList(c *ctlClient, args []string) error {
+	fs := flag.NewFlagSet("chain list", flag.ContinueOnError)
+	logical := fs.Bool("logical", false, "sort by Lamport stamp instead of chain order")
+	kind := fs.String("kind", "", "only blocks of this kind: data, escrow-receipt, tombstone or access")
+	origin := fs.String("origin", "", "only blocks from this NodeID")
+	if fs.Parse(args) != nil {
+		return errUsage
+	}
+	q := url.Values{}
+	if *logical {
+		q.Set("order", "logical")
+	}
+	if *kind != "" {
+		q.Set("kind", *kind)
+	}
+	if *origin != "" {
+		q.Set("origin", *origin)
+	}
+	var blocks []chainEntry
+	if err := c.call("GET", "/chain/list", q, nil, "", &blocks); err != nil {
+		return err
+	}
+	rows := make([][]string, 0, len(blocks))
+	for _, b := range blocks {
+		expired := "-"
+		if b.Expired != nil {
+			expired = b.Expired.At.Format(time.RFC3339)
+		}
+		name := b.Name
+		switch {
+		case b.isReceipt() && b.Receipt != nil:
+			name = "(escrow receipt for " + short(b.Receipt.Block) + ")"
+		case b.isTombstone() && b.Tombstone != nil:
+			name = "(tombstone for " + short(b.Tombstone.Block) + ")"
+		case b.isAccess() && b.Access != nil:
+			name = fmt.Sprintf("(%s of %s by %s: %s)", b.Access.Via, short(b.Access.Block), orDash(b.Access.User), b.Access.Outcome)
+		case b.DeletedBy != "":
+			name += " (deleted)"
+		}
+		rows = append(rows, []string{short(b.Hash), name, fmt.Sprint(b.Size), short(b.OriginID), fmt.Sprint(b.Logical), time.Unix(b.Created, 0).Format(time.RFC3339), expired})
+	}
+	return c.show(blocks, []string{"HASH", "NAME", "SIZE", "ORIGIN", "LOGICAL", "CREATED", "EXPIRED"}, rows)
+}
+
+func ctlChainDelete(c *ctlClient, args []string) error {
+	fs := flag.NewFlagSet("chain delete", flag.ContinueOnError)
+	reason := fs.String("reason", "", "why, recorded in the tombstone")
+	revoke := fs.Bool("revoke-escrow", false, "also revoke the key on the keysaver")
+	batch := fs.String("batch", "", "delete all of this node's blocks in a batch instead")
+	if fs.Parse(args) != nil || (fs.NArg() == 1) == (*batch != "") {
+		return errUsage
+	}
+	q := url.Values{"hash": {fs.Arg(0)}}
+	if *batch != "" {
+		q = url.Values{"batch": {*batch}}
+	}
+	if *reason != "" {
+		q.Set("reason", *reason)
+	}
+	if *revoke {
+		q.Set("revoke_escrow", "true")
+	}
+	if *batch != "" {
+		var res struct {
+			Deleted []tombstoneResult `json:"deleted"`
+			Errors  []string          `json:"errors"`
+		}
+		if err := c.call("POST", "/chain/tombstone", q, nil, "", &res); err != nil {
+			return err
+		}
+		rows := make([][]string, 0, len(res.Deleted))
+		for _, d := range res.Deleted {
+			rows = append(rows, []string{short(d.Hash), short(d.Tombstone), fmt.Sprint(d.Local.ChunkDeleted), fmt.Sprint(d.Fanout.Acked)})
+		}
+		if err := c.show(res, []string{"HASH", "TOMBSTONE", "CHUNK DELETED", "ACKED"}, rows); err != nil {
+			return err
+		}
+		if c.output == "table" {
+			for _, e := range res.Errors {
+				fmt.Println("error: " + e)
+			}
+		}
+		return nil
+	}
+	var res tombstoneResult
+	if err := c.call("POST", "/chain/tombstone", q, nil, "", &res); err != nil {
+		return err
+	}
+	return c.showKV(res, "hash", res.Hash, "tombstone", res.Tombstone, "chunk deleted", fmt.Sprint(res.Local.ChunkDeleted),
+		"keysaver", orDash(res.Local.Keysaver), "acked", fmt.Sprint(res.Fanout.Acked))
+}
+
+func ctlChainTombstones(c *ctlClient, args []string) error {
+	fs := flag.NewFlagSet("chain tombstones", flag.ContinueOnError)
+	pending := fs.Bool("pending", false, "only tombstones whose chunk still exists somewhere")
+	noProbe := fs.Bool("no-probe", false, "don't ask peers")
+	if fs.Parse(args) != nil {
+		return errUsage
+	}
+	q := url.Values{}
+	if *pending {
+		q.Set("pending", "true")
+	}
+	if *noProbe {
+		q.Set("probe", "false")
+	}
+	var rep []tombstoneView
+	if err := c.call("GET", "/chain/tombstones", q, nil, "", &rep); err != nil {
+		return err
+	}
+	rows := make([][]string, 0, len(rep))
+	for _, v := range rep {
+		held := make([]string, 0, len(v.HeldBy))
+		for _, id := range v.HeldBy {
+			held = append(held, short(id))
+		}
+		rows = append(rows, []string{short(v.Block), orDash(v.Name), short(v.Origin), time.Unix(v.At, 0).Format(time.RFC3339),
+			fmt.Sprint(v.LocalChunk), orDash(strings.Join(held, ",")), orDash(v.Reason)})
+	}
+	return c.show(rep, []string{"BLOCK", "NAME", "ORIGIN", "DELETED", "LOCAL", "HELD BY", "REASON"}, rows)
+}
+
+func ctlLoadgen(c *ctlClient, args []string) error {
+	var rep loadgenReport
+	if err := c.call("GET", "/loadgen", nil, nil, "", &rep); err != nil {
+		return err
+	}
+	return showLoadgen(c, rep)
+}
+
+func ctlLoadgenStart(c *ctlClient, args []string) error {
+	fs := flag.NewFlagSet("loadgen start", flag.ContinueOnError)
+	var spec loadgenSpec
+	fs.StringVar(&spec.Duration, "for", "", "how long to run, e.g. 10m")
+	fs.IntVar(&spec.FilesPerMin, "files", 0, "random files sent per minute")
+	fs.IntVar(&spec.FileSize, "file-size", 64<<10, "bytes per file")
+	fs.IntVar(&spec.MsgsPerMin, "msgs", 0, "mix messages per minute to random peers")
+	fs.IntVar(&spec.MsgSize, "msg-size", 256, "bytes per mix message")
+	fs.StringVar(&spec.Class, "class", "", "mix class (default interactive)")
+	fs.StringVar(&spec.CommandsEvery, "commands-every", "", "dry-run command broadcast period")
+	if fs.Parse(args) != nil || spec.Duration == "" {
+		return errUsage
+	}
+	body, _ := json.Marshal(spec)
+	var rep loadgenReport
+	if err := c.call("POST", "/loadgen/start", nil, bytes.NewReader(body), "application/json", &rep); err != nil {
+		return err
+	}
+	return c.showKV(rep, "run", rep.Run, "batch", rep.Batch, "peers", fmt.Sprint(rep.Peers), "cleanup", "go-node ctl chain delete --batch "+rep.Batch)
+}
+
+func ctlLoadgenStop(c *ctlClient, args []string) error {
+	var rep loadgenReport
+	if err := c.call("POST", "/loadgen/stop", nil, nil, "", &rep); err != nil {
+		return err
+	}
+	return showLoadgen(c, rep)
+}
+
+func showLoadgen(c *ctlClient, rep loadgenReport) error {
+	ms := func(v float64) string { return fmt.Sprintf("%.1f", v) }
+	rows := [][]string{}
+	for _, k := range []struct {
+		name string
+		st   opStats
+	}{{"files", rep.Files}, {"mix", rep.Mix}, {"commands", rep.Commands}} {
+		rows = append(rows, []string{k.name, fmt.Sprint(k.st.Attempts), fmt.Sprint(k.st.Failed), fmt.Sprint(k.st.Skipped),
+			ms(k.st.P50ms), ms(k.st.P90ms), ms(k.st.P99ms), ms(k.st.MaxMs)})
+	}
+	if err := c.show(rep, []string{"KIND", "SENT", "FAILED", "SKIPPED", "P50 MS", "P90 MS", "P99 MS", "MAX MS"}, rows); err != nil {
+		return err
+	}
+	if c.output == "table" {
+		state := "running"
+		if !rep.Running {
+			state = "ended " + rep.Ended.Format(time.RFC3339)
+		}
+		fmt.Printf("run %s (%s), batch %s, %d command replies\n", rep.Run, state, rep.Batch, rep.Replies)
+		if n := len(rep.Runtime); n > 0 {
+			last := rep.Runtime[n-1]
+			fmt.Printf("goroutines %d, heap %d MiB\n", last.Goroutines, last.HeapAlloc>>20)
+		}
+	}
+	return nil
+}
+
+func ctlInbox(c *ctlClient, args []string) error {
+	var res InboxList
+	if err := c.call("GET", "/inbox", nil, nil, "", &res); err != nil {
+		return err
+	}
+	rows := make([][]string, 0, len(res.Messages))
+	for _, m := range res.Messages {
+		rows = append(rows, []string{fmt.Sprint(m.Logical), short(m.Sender), m.MsgID, cmp.Or(m.Type, "-"), m.Key, fmt.Sprint(m.Size), time.Unix(m.Received, 0).Format(time.RFC3339)})
+	}
+	return c.show(res, []string{"LOGICAL", "SENDER", "MSGID", "TYPE", "KEY", "SIZE", "RECEIVED"}, rows)
+}
+
+func ctlConversations(c *ctlClient, args []string) error {
+	var convs []conversationView
+	if err := c.call("GET", "/mix/conversations", nil, nil, "", &convs); err != nil {
+		return err
+	}
+	rows := make([][]string, 0, len(convs))
+	for _, v := range convs {
+		last, at := "-", "-"
+		if v.Last != nil {
+			last = strings.ReplaceAll(v.Last.Text, "\n", " ")
+			at = time.Unix(v.Last.At, 0).Format(time.RFC3339)
+		}
+		rows = append(rows, []string{short(v.Peer), fmt.Sprint(v.Messages), fmt.Sprint(v.Unread), at, last})
+	}
+	return c.show(convs, []string{"PEER", "MESSAGES", "UNREAD", "LAST", "PREVIEW"}, rows)
+}
+
+func ctlConversationsShow(c *ctlClient, args []string) error {
+	fs := flag.NewFlagSet("conversations show", flag.ContinueOnError)
+	since := fs.Uint64("since", 0, "only messages after this seq")
+	read := fs.Bool("read", false, "mark the thread read afterwards")
+	if fs.Parse(args) != nil || fs.NArg() != 1 {
+		return errUsage
+	}
+	peer := url.PathEscape(fs.Arg(0))
+	var q url.Values
+	if *since > 0 {
+		q = url.Values{"since": {fmt.Sprint(*since)}}
+	}
+	var conv conversation
+	if err := c.call("GET", "/mix/conversations/"+peer, q, nil, "", &conv); err != nil {
+		return err
+	}
+	rows := make([][]string, 0, len(conv.Messages))
+	for _, m := range conv.Messages {
+		rows = append(rows, []string{fmt.Sprint(m.Seq), m.Dir, fmt.Sprint(m.Logical), time.Unix(m.At, 0).Format(time.RFC3339), m.State, m.Text})
+	}
+	if err := c.show(conv, []string{"SEQ", "DIR", "LOGICAL", "AT", "STATE", "TEXT"}, rows); err != nil {
+		return err
+	}
+	if *read {
+		var res map[string]any
+		return c.call("POST", "/mix/conversations/"+peer+"/read", nil, nil, "", &res)
+	}
+	return nil
+}
+
+// ctlUser is the local login, sent as the access log's ?user= hint.
+func ctlUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return ""
+}
+
+func ctlChunksDecrypt(c *ctlClient, args []string) error {
+	fs := flag.NewFlagSet("chunks decrypt", flag.ContinueOnError)
+	hash := fs.String("hash", "", "chunk sha256")
+	name := fs.String("name", "", "original file name (only needed for legacy key files)")
+	key := fs.String("key", "", "base64url file key (default: local key file)")
+	out := fs.String("out", "", "file name to write under the chunks dir")
+	if fs.Parse(args) != nil || *hash == "" || *out == "" {
+		return errUsage
+	}
+	q := url.Values{"hash": {*hash}, "out": {*out}, "user": {ctlUser()}}
+	if *name != "" {
+		q.Set("name", *name)
+	}
+	if *key != "" {
+		q.Set("keyB64", *key)
+	}
+	var res DecryptSavedResponse
+	if err := c.call("GET", "/chunks/decrypt", q, nil, "", &res); err != nil {
+		return err
+	}
+	return c.showKV(res, "path", res.Path, "bytes", fmt.Sprint(res.Bytes))
+}
+
+func ctlRecover(c *ctlClient, args []string) error {
+	fs := flag.NewFlagSet("recover", flag.ContinueOnError)
+	out := fs.String("out", "", "output directory (default: <base>/recovered)")
+	hash := fs.String("hash", "", "only this block")
+	batch := fs.String("batch", "", "only this batch's members")
+	overwrite := fs.Bool("overwrite", false, "overwrite existing files")
+	dry := fs.Bool("dry-run", false, "show the plan without writing")
+	if fs.Parse(args) != nil || fs.NArg() != 0 {
+		return errUsage
+	}
+	q := url.Values{"user": {ctlUser()}}
+	if *out != "" {
+		q.Set("out", *out)
+	}
+	if *hash != "" {
+		q.Set("hash", *hash)
+	}
+	if *batch != "" {
+		q.Set("batch", *batch)
+	}
+	if *overwrite {
+		q.Set("overwrite", "true")
+	}
+	if *dry {
+		q.Set("dry_run", "true")
+	}
+	var plan recoverPlan
+	if err := c.call("POST", "/recover", q, nil, "", &plan); err != nil {
+		return err
+	}
+	rows := make([][]string, 0, len(plan.Items))
+	for _, it := range plan.Items {
+		rows = append(rows, []string{short(it.Hash), it.Action, it.Target, it.Error})
+	}
+	if err := c.show(plan, []string{"HASH", "ACTION", "TARGET", "ERROR"}, rows); err != nil {
+		return err
+	}
+	if c.output == "table" {
+		fmt.Printf("\n%d written to %s (dry run: %v)\n", plan.Written, plan.OutDir, plan.DryRun)
+		if plan.Batch != "" && plan.Incomplete {
+			fmt.Printf("batch %s incomplete; missing: %s\n", plan.Batch, orDash(strings.Join(plan.Missing, ", ")))
+		}
+	}
+	return nil
+}
+
+func ctlTransfers(c *ctlClient, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	var list []transfer
+	if err := c.call("GET", "/transfers", nil, nil, "", &list); err != nil {
+		return err
+	}
+	rows := make([][]string, 0, len(list))
+	for _, t := range list {
+		rows = append(rows, []string{t.ID, t.Kind, t.State, t.Name, fmt.Sprintf("%d/%d", t.Acked, t.Peers), t.Started.Local().Format(time.RFC3339)})
+	}
+	return c.show(list, []string{"ID", "KIND", "STATE", "NAME", "ACKED", "STARTED"}, rows)
+}
+
+func ctlTransfersCancel(c *ctlClient, args []string) error {
+	fs := flag.NewFlagSet("transfers cancel", flag.ContinueOnError)
+	abandon := fs.Bool("abandon", false, "tell peers that already stored the block to stop spreading it")
+	if fs.Parse(args) != nil || fs.NArg() != 1 {
+		return errUsage
+	}
+	var q url.Values
+	if *abandon {
+		q = url.Values{"abandon": {"true"}}
+	}
+	var t transfer
+	if err := c.call("POST", "/transfers/"+url.PathEscape(fs.Arg(0))+"/cancel", q, nil, "", &t); err != nil {
+		return err
+	}
+	return c.showKV(t, "id", t.ID, "kind", t.Kind, "state", t.State, "acked", fmt.Sprint(t.Acked), "notified", fmt.Sprint(t.Notified))
+}
+
+func ctlIdentityRegenerate(c *ctlClient, args []string) error {
+	var res struct {
+		NodeID   string `json:"node_id"`
+		Previous string `json:"previous"`
+	}
+	if err := c.call("POST", "/identity/regenerate", nil, nil, "", &res); err != nil {
+		return err
+	}
+	return c.showKV(res, "node_id", res.NodeID, "previous", res.Previous, "next", "restart the node to announce the new NodeID")
+}
+
+func ctlRetentionPolicies(c *ctlClient, args []string) error {
+	var ps []retentionPolicy
+	if err := c.call("GET", "/retention/policies", nil, nil, "", &ps); err != nil {
+		return err
+	}
+	rows := make([][]string, 0, len(ps))
+	for _, p := range ps {
+		arg := orDash(p.After)
+		if p.Action == retainReplicate {
+			arg = fmt.Sprint(p.Min)
+		}
+		rows = append(rows, []string{p.ID, p.Action, arg, orDash(short(p.Match.Origin)), orDash(p.Match.Name), fmt.Sprint(len(p.Match.Hashes))})
+	}
+	return c.show(ps, []string{"ID", "ACTION", "AFTER/MIN", "ORIGIN", "NAME", "HASHES"}, rows)
+}
+
+func ctlRetentionAdd(c *ctlClient, args []string) error {
+	fs := flag.NewFlagSet("retention add", flag.ContinueOnError)
+	var p retentionPolicy
+	fs.StringVar(&p.ID, "id", "", "policy ID (default: random; an existing ID is replaced)")
+	fs.StringVar(&p.Match.Origin, "origin", "", "match blocks from this origin NodeID")
+	fs.StringVar(&p.Match.Name, "name", "", "match file names against this glob")
+	hashes := fs.String("hashes", "", "match these block hashes (comma-separated)")
+	fs.StringVar(&p.Action, "action", "", "retain-forever, expire-after or replicate-minimum")
+	fs.StringVar(&p.After, "after", "", "expire-after: age such as 30d, 7y or 36h")
+	fs.IntVar(&p.Min, "min", 0, "replicate-minimum: copies to keep")
+	if fs.Parse(args) != nil || fs.NArg() != 0 || p.Action == "" {
+		return errUsage
+	}
+	if *hashes != "" {
+		p.Match.Hashes = strings.Split(*hashes, ",")
+	}
+	body, _ := json.Marshal(p)
+	var out retentionPolicy
+	if err := c.call("POST", "/retention/policies", nil, bytes.NewReader(body), "application/json", &out); err != nil {
+		return err
+	}
+	return c.showKV(out, "id", out.ID, "action", out.Action)
+}
+
+func ctlRetentionRm(c *ctlClient, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	var res map[string]any
+	if err := c.call("DELETE", "/retention/policies/"+url.PathEscape(args[0]), nil, nil, "", &res); err != nil {
+		return err
+	}
+	return c.showKV(res, "removed", args[0])
+}
+
+func retentionRow(v retentionVerdict) []string {
+	until := "-"
+	switch {
+	case v.Expired != nil:
+		until = "expired " + v.Expired.At.Format(time.RFC3339)
+	case v.ExpiresAt != nil:
+		until = v.ExpiresAt.Format(time.RFC3339)
+	}
+	return []string{short(v.Hash), v.Name, v.Action, orDash(v.Policy), until, fmt.Sprint(v.MinCopies)}
+}
+
+var retentionHeader = []string{"HASH", "NAME", "ACTION", "POLICY", "EXPIRES", "MIN COPIES"}
+
+func ctlRetentionBlocks(c *ctlClient, args []string) error {
+	fs := flag.NewFlagSet("retention blocks", flag.ContinueOnError)
+	hash := fs.String("hash", "", "only this block")
+	if fs.Parse(args) != nil || fs.NArg() != 0 {
+		return errUsage
+	}
+	if *hash != "" {
+		var v retentionVerdict
+		if err := c.call("GET", "/retention/blocks", url.Values{"hash": {*hash}}, nil, "", &v); err != nil {
+			return err
+		}
+		return c.show(v, retentionHeader, [][]string{retentionRow(v)})
+	}
+	var vs []retentionVerdict
+	if err := c.call("GET", "/retention/blocks", nil, nil, "", &vs); err != nil {
+		return err
+	}
+	rows := make([][]string, 0, len(vs))
+	for _, v := range vs {
+		rows = append(rows, retentionRow(v))
+	}
+	return c.show(vs, retentionHeader, rows)
+}
+
+func ctlRetentionApply(c *ctlClient, args []string) error {
+	fs := flag.NewFlagSet("retention apply", flag.ContinueOnError)
+	dry := fs.Bool("dry-run", false, "only list the blocks that would expire")
+	if fs.Parse(args) != nil || fs.NArg() != 0 {
+		return errUsage
+	}
+	var q url.Values
+	if *dry {
+		q = url.Values{"dry_run": {"true"}}
+	}
+	var rep retentionReport
+	if err := c.call("POST", "/retention/apply", q, nil, "", &rep); err != nil {
+		return err
+	}
+	rows := make([][]string, 0, len(rep.Expired))
+	for _, v := range rep.Expired {
+		rows = append(rows, retentionRow(v))
+	}
+	if err := c.show(rep, retentionHeader, rows); err != nil {
+		return err
+	}
+	if c.output != "json" {
+		fmt.Printf("\n%d blocks evaluated, %d expired (dry run: %v), %d copies added, %d short of their minimum\n", rep.Evaluated, len(rep.Expired), rep.DryRun, rep.Copies, len(rep.Short))
+	}
+	return nil
+}
+
+func (c *ctlClient) showConfig(cfg configView) error {
+	return c.showKV(cfg,
+		"mode", cfg.Mode,
+		"api_port", fmt.Sprint(cfg.APIPort),
+		"control_port", fmt.Sprint(cfg.ControlPort),
+		"replicate_quorum", fmt.Sprint(cfg.Quorum),
+		"inbox_max_msgs", fmt.Sprint(cfg.InboxMaxMsgs),
+		"inbox_max_bytes", fmt.Sprint(cfg.InboxMaxBytes),
+		"inbox_ttl", cfg.InboxTTL,
+		"inbox_max_ttl", cfg.InboxMaxTTL,
+		"cmd_allow_roots", strings.Join(cfg.CmdAllowRoots, ","),
+		"cmd_deny_roots", strings.Join(cfg.CmdDenyRoots, ","),
+		"cmd_rejected", fmt.Sprint(cfg.CmdRejected))
+}
+
+func ctlConfigGet(c *ctlClient, args []string) error {
+	var cfg configView
+	if err := c.call("GET", "/config", nil, nil, "", &cfg); err != nil {
+		return err
+	}
+	return c.showConfig(cfg)
+}
+
+// config set key=value ...; list values are comma-separated ("" clears).
+func ctlConfigSet(c *ctlClient, args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	var patch configPatch
+	for _, a := range args {
+		k, v, ok := strings.Cut(a, "=")
+		if !ok {
+			return errUsage
+		}
+		list := splitList(v)
+		if list == nil {
+			list = []string{}
+		}
+		switch k {
+		case "cmd_allow_roots":
+			patch.CmdAllowRoots = &list
+		case "cmd_deny_roots":
+			patch.CmdDenyRoots = &list
+		case "inbox_ttl":
+			patch.InboxTTL = &v
+		case "inbox_max_ttl":
+			patch.InboxMaxTTL = &v
+		default:
+			return fmt.Errorf("config key %q is not settable at runtime", k)
+		}
+	}
+	body, _ := json.Marshal(patch)
+	var cfg configView
+	if err := c.call("PATCH", "/config", nil, bytes.NewReader(body), "application/json", &cfg); err != nil {
+		return err
+	}
+	return c.showConfig(cfg)
+}
+
+func showMaintenance(c *ctlClient, v maintenanceView) error {
+	if !v.Active {
+		return c.showKV(v, "active", "false")
+	}
+	return c.showKV(v, "active", "true", "since", v.Since.Format(time.RFC3339), "until", v.Until.Format(time.RFC3339))
+}
+
+func ctlMaintenance(c *ctlClient, args []string) error {
+	var v maintenanceView
+	if err := c.call("GET", "/maintenance", nil, nil, "", &v); err != nil {
+		return err
+	}
+	return showMaintenance(c, v)
+}
+
+func ctlMaintenanceEnter(c *ctlClient, args []string) error {
+	fs := flag.NewFlagSet("maintenance enter", flag.ContinueOnError)
+	d := fs.Duration("for", defaultMaintenance, "how long before the node leaves maintenance by itself")
+	if fs.Parse(args) != nil {
+		return errUsage
+	}
+	var v maintenanceView
+	if err := c.call("POST", "/maintenance/enter", url.Values{"duration": {d.String()}}, nil, "", &v); err != nil {
+		return err
+	}
+	return showMaintenance(c, v)
+}
+
+func ctlMaintenanceExit(c *ctlClient, args []string) error {
+	var v maintenanceView
+	if err := c.call("POST", "/maintenance/exit", nil, nil, "", &v); err != nil {
+		return err
+	}
+	return showMaintenance(c, v)
+}
+
+func ctlFileKeysList(c *ctlClient, args []string) error {
+	var res struct {
+		Count int            `json:"count"`
+		Keys  []fileKeyEntry `json:"keys"`
+	}
+	if err := c.call("GET", "/filekeys/list", nil, nil, "", &res); err != nil {
+		return err
+	}
+	rows := make([][]string, 0, len(res.Keys))
+	for _, k := range res.Keys {
+		created := "-"
+		if k.Created > 0 {
+			created = time.Unix(k.Created, 0).Format(time.RFC3339)
+		}
+		rows = append(rows, []string{short(k.Hash), k.Name, created, fmt.Sprint(k.Escrowed), fmt.Sprint(k.ChunkLocal), fmt.Sprint(k.Legacy)})
+	}
+	return c.show(res, []string{"HASH", "NAME", "CREATED", "ESCROWED", "CHUNK", "LEGACY"}, rows)
+}
+
+func keysPass() (string, error) {
+	p := os.Getenv("MIXNETS_KEYS_PASS")
+	if p == "" {
+		return "", errors.New("set MIXNETS_KEYS_PASS to the archive passphrase")
+	}
+	return p, nil
+}
+
+func ctlFileKeysExport(c *ctlClient, args []string) error {
+	fs := flag.NewFlagSet("filekeys export", flag.ContinueOnError)
+	out := fs.String("out", "", "archive file to write")
+	if fs.Parse(args) != nil || *out == "" {
+		return errUsage
+	}
+	pass, err := keysPass()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("GET", c.base+"/filekeys/export", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(passphraseHeader, pass)
+	resp, err := c.send(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	f, err := os.OpenFile(*out, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, resp.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "wrote %d bytes to %s\n", n, *out)
+	return nil
+}
+
+func ctlFileKeysImport(c *ctlClient, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	pass, err := keysPass()
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	req, err := http.NewRequest("POST", c.base+"/filekeys/import", f)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(passphraseHeader, pass)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := c.send(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var res keyImportResult
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return err
+	}
+	if err := c.showKV(res, "imported", fmt.Sprint(res.Imported), "skipped", fmt.Sprint(res.Skipped), "failed", fmt.Sprint(len(res.Failed))); err != nil {
+		return err
+	}
+	if c.output == "table" {
+		for _, f := range res.Failed {
+			fmt.Println("  " + f)
+		}
+	}
+	return nil
+}
+
+func ctlFileKeysEscrow(c *ctlClient, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	var res struct {
+		Hash    string       `json:"hash"`
+		Receipt string       `json:"receipt"`
+		Fanout  fanoutResult `json:"fanout"`
+	}
+	if err := c.call("POST", "/filekeys/escrow", url.Values{"hash": {args[0]}}, nil, "", &res); err != nil {
+		return err
+	}
+	return c.showKV(res, "hash", res.Hash, "receipt", res.Receipt, "acked", fmt.Sprint(res.Fanout.Acked))
+}
+
+func ctlEscrowAudit(c *ctlClient, args []string) error {
+	fs := flag.NewFlagSet("escrow audit", flag.ContinueOnError)
+	node := fs.String("node", "", "node whose receipts to audit (default: this node)")
+	if fs.Parse(args) != nil {
+		return errUsage
+	}
+	var q url.Values
+	if *node != "" {
+		q = url.Values{"node_id": {*node}}
+	}
+	var rep escrowAudit
+	if err := c.call("GET", "/escrow/audit", q, nil, "", &rep); err != nil {
+		return err
+	}
+	rows := make([][]string, 0, len(rep.Items))
+	for _, it := range rep.Items {
+		at := "-"
+		if it.At > 0 {
+			at = time.Unix(it.At, 0).Format(time.RFC3339)
+		}
+		rows = append(rows, []string{short(it.Block), orDash(short(it.Receipt)), at, it.Status, orDash(it.Note)})
+	}
+	if err := c.show(rep, []string{"BLOCK", "RECEIPT", "AT", "STATUS", "NOTE"}, rows); err != nil {
+		return err
+	}
+	if c.output == "table" {
+		fmt.Printf("%d receipts, %d discrepancies\n", rep.Receipts, rep.Discrepancies)
+		if rep.Error != "" {
+			fmt.Println("keysaver: " + rep.Error)
+		}
+	}
+	return nil
+}
+
+// events streams the control API's server-sent events until interrupted.
+func ctlEvents(c *ctlClient, args []string) error {
+	c.http.Timeout = 0
+	resp, err := c.do("GET", "/events", nil, nil, "")
+	var apiErr *ctlAPIError
+	if errors.As(err, &apiErr) && apiErr.Status == http.StatusNotFound {
+		return errors.New("this node's control API has no /events stream")
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	sc := bufio.NewScanner(resp.Body)
+	sc.Buffer(make([]byte, 64<<10), 1<<20)
+	event := "message"
+	var data []string
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case line == "":
+			if len(data) > 0 {
+				c.printEvent(event, strings.Join(data, "\n"))
+			}
+			event, data = "message", nil
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(line[len("event:"):])
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(line[len("data:"):], " "))
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	return errors.New("event stream closed")
+}
+
+func (c *ctlClient) printEvent(event, data string) {
+	if c.output == "json" {
+		fmt.Println(data)
+		return
+	}
+	fmt.Printf("%s  %-12s %s\n", time.Now().Format("15:04:05"), event, data)
+}
+
+// ---- completion ----
+
+func ctlCompletion(c *ctlClient, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	top := map[string][]string{}
+	var order []string
+	for _, cmd := range ctlCmds {
+		first, sub, _ := strings.Cut(cmd.name, " ")
+		if _, ok := top[first]; !ok {
+			order = append(order, first)
+			top[first] = nil
+		}
+		if sub != "" {
+			top[first] = append(top[first], sub)
+		}
+	}
+	switch args[0] {
+	case "bash", "zsh":
+		var b strings.Builder
+		if args[0] == "zsh" {
+			b.WriteString("autoload -U +X bashcompinit && bashcompinit\n")
+		}
+		b.WriteString("_go_node_ctl() {\n  local cur=${COMP_WORDS[COMP_CWORD]}\n")
+		b.WriteString("  if [ \"${COMP_WORDS[1]}\" != ctl ]; then COMPREPLY=($(compgen -W \"ctl\" -- \"$cur\")); return; fi\n")
+		b.WriteString("  case $COMP_CWORD in\n")
+		fmt.Fprintf(&b, "    2) COMPREPLY=($(compgen -W %q -- \"$cur\")) ;;\n", strings.Join(order, " "))
+		b.WriteString("    3) case ${COMP_WORDS[2]} in\n")
+		for _, t := range order {
+			if len(top[t]) > 0 {
+				fmt.Fprintf(&b, "         %s) COMPREPLY=($(compgen -W %q -- \"$cur\")) ;;\n", t, strings.Join(top[t], " "))
+			}
+		}
+		b.WriteString("         completion) COMPREPLY=($(compgen -W \"bash zsh powershell\" -- \"$cur\")) ;;\n")
+		b.WriteString("       esac ;;\n  esac\n}\ncomplete -F _go_node_ctl go-node\n")
+		fmt.Print(b.String())
+	case "powershell":
+		var b strings.Builder
+		b.WriteString("Register-ArgumentCompleter -Native -CommandName go-node,go-node.exe -ScriptBlock {\n")
+		b.WriteString("  param($word, $ast, $cursor)\n  $w = @($ast.CommandElements | ForEach-Object { $_.ToString() })\n  $subs = @{\n")
+		for _, t := range order {
+			if len(top[t]) > 0 {
+				fmt.Fprintf(&b, "    '%s' = @('%s')\n", t, strings.Join(top[t], "','"))
+			}
+		}
+		b.WriteString("    'completion' = @('bash','zsh','powershell')\n  }\n")
+		b.WriteString("  if ($w.Count -le 1 -or ($w.Count -eq 2 -and $word)) { $c = @('ctl') }\n")
+		fmt.Fprintf(&b, "  elseif ($w.Count -eq 2 -or ($w.Count -eq 3 -and $word)) { $c = @('%s') }\n", strings.Join(order, "','"))
+		b.WriteString("  elseif ($subs.ContainsKey($w[2])) { $c = $subs[$w[2]] } else { $c = @() }\n")
+		b.WriteString("  $c | Where-Object { $_ -like \"$word*\" } | ForEach-Object { [System.Management.Automation.CompletionResult]::new($_) }\n}\n")
+		fmt.Print(b.String())
+	default:
+		return errUsage
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import "time"
+
+// Control API responses shared by the handlers and the `ctl` client so the
+// two can't drift apart. Peers, chain blocks, recovery plans and config use
+// PeerInfo, Block, recoverPlan and configView directly.
+
+// GET /status
+type StatusResponse struct {
+	NodeID   string            `json:"node_id"`
+	Hostname string            `json:"hostname"`
+	Attrs    map[string]string `json:"attrs"`
+	APIPort  int               `json:"api_port"`
+	Mode     string            `json:"mode"`
+	Control  bool              `json:"control"`
+	Time     time.Time         `json:"time"`
+
+	ClockSkew float64 `json:"clock_skew_seconds"` // vs. peers' beacons, >0 = we're ahead
+
+	Alerts     []string      `json:"alerts,omitempty"`             // e.g. "duplicate_identity"
+	Duplicates []dupConflict `json:"duplicate_identity,omitempty"` // NodeIDs beaconed by several machines
+
+	Maintenance *maintenanceView `json:"maintenance,omitempty"` // only while in maintenance mode
+
+	CryptoPosture  string           `json:"crypto_posture"`            // strict, mixed or legacy
+	AccessLog      string           `json:"access_log"`                // decryptions recorded in the chain: off, on or salted
+	LegacyRejected map[string]int64 `json:"legacy_rejected,omitempty"` // refusals per legacy code
+
+	Build BuildInfo `json:"build"` // version stamp and compiled-in features
+
+	Egress *EgressStatus `json:"egress"` // outbound connection policy (egress.go)
+}
+
+// POST /mix/send-text
+type SendTextResponse struct {
+	Status   string `json:"status"`
+	Type     string `json:"type"`
+	MsgID    string `json:"msgid"`
+	FirstHop string `json:"first_hop"`
+	Hops     int    `json:"hops"`
+	Class    string `json:"class"`
+	Strategy string `json:"strategy"` // path strategy the relays were picked by
+	Attempt  int    `json:"attempt"`  // which try got through (1 = the first path)
+	Ack      bool   `json:"ack"`      // the receiver will ack delivery (GET /mix/status)
+
+	Diversity PathDiversity `json:"diversity"` // path diversity rules kept and relaxed
+}
+
+// GET /mix/status
+type DeliveryStatus struct {
+	MsgID     string `json:"msgid"`
+	To        string `json:"to"`
+	State     string `json:"state"` // "pending" | "delivered" | "failed" | "sent" (no ack coming)
+	Sent      int64  `json:"sent_unix"`
+	Delivered int64  `json:"delivered_unix,omitempty"`
+	Failed    int64  `json:"failed_unix,omitempty"`
+	Via       string `json:"via,omitempty"` // how the ack came back: "mix" or "direct"
+	Error     string `json:"error,omitempty"`
+}
+
+// POST /mix/send-file
+type SendFileResponse struct {
+	Status    string `json:"status"`
+	MsgID     string `json:"msgid"`
+	Name      string `json:"name"`
+	Hash      string `json:"hash"`
+	StoreKey  string `json:"store_key"`
+	Fanout    int    `json:"fanout"`
+	PeersSeen int    `json:"peers_seen"`
+	Quorum    int    `json:"quorum"`
+	Durable   bool   `json:"durable"`
+	Pending   bool   `json:"pending"`
+	Cancelled bool   `json:"cancelled,omitempty"`
+	KeyFile   string `json:"key_file"`
+
+	Compression string  `json:"compression,omitempty"` // "gzip", or empty when sent as is
+	RawSize     int     `json:"raw_size"`
+	Ratio       float64 `json:"ratio"` // sealed payload / original size
+}
+
+// GET /chunks/decrypt?out=... (without out the plaintext itself is returned)
+type DecryptSavedResponse struct {
+	Status string `json:"status"`
+	Path   string `json:"path"`
+	Bytes  int    `json:"bytes"`
+}
+
+// GET /inbox: held final-hop messages in Lamport order
+type InboxList struct {
+	LogicalClock uint64         `json:"logical_clock"`
+	Messages     []InboxMessage `json:"messages"`
+	Next         string         `json:"next,omitempty"` // ?after= for the next /mix/inbox page
+}
+
+type InboxMessage struct {
+	Key      string `json:"key"`
+	Sender   string `json:"sender"`
+	MsgID    string `json:"msgid,omitempty"`
+	Type     string `json:"type,omitempty"` // "text", "file", "group", "raw", ...
+	Name     string `json:"name,omitempty"` // file name or group label
+	Logical  uint64 `json:"logical"`        // sender's stamp; 0 from older nodes
+	Size     int64  `json:"size"`
+	Received int64  `json:"received_unix"`
+	Expires  int64  `json:"expires_unix,omitempty"` // 0 = kept until deleted
+}
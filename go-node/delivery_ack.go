@@ -0,0 +1,318 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Delivery acks for mix texts. send-text used to answer "sent" once the
+// first hop took the onion, and the sender never learned whether the text
+// arrived. Now a sender whose destination advertises capTextAck sets Ack in
+// the envelope; the final hop, once it stored the text, signs a
+// deliveryAck with its receipt key and sends it back as a text-ack mix
+// message, a reverse onion like a group key ack. When it can't route to the
+// sender (no mix key or address for it), it POSTs the ack straight to the
+// sender's /mix/ack instead, at the addresses the sender publishes in the
+// DHT under "ack:"+NodeID. That shortcut links the two nodes for anyone
+// watching, so it is only the fallback.
+//
+// The sender checks the signature against the receiver's pinned signing
+// key and marks the msgid delivered: in GET /mix/status?msgid= and as the
+// conversation state. A text still unacked after deliveryAckWait reads as
+// failed, though a late ack still turns it delivered. Texts to nodes
+// without the capability stay "sent". The tracker is memory-only and keeps
+// the last deliveryKeep sends.
+
+const (
+	mixTextAck   = "text-ack" // FinalEnvelope.Type: a delivery ack
+	capTextAck   = "text-ack" // beacon capability: acks texts that ask
+	ackDHTPrefix = "ack:"     // DHT key prefix: where a sender takes direct acks
+
+	deliveryAckWait  = 30 * time.Minute
+	deliveryKeep     = 10000
+	ackLookupTimeout = 5 * time.Second
+
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryFailed    = "failed"
+	deliverySent      = "sent"
+)
+
+var mixAcks = metricDef{"mix_acks_total", "delivery acks accepted by how they came back", "via"}
+
+// deliveryAck is the data of a text-ack mix message and the body of POST
+// /mix/ack.
+type deliveryAck struct {
+	MsgID    string `json:"msgid"`
+	Sender   string `json:"sender"`   // who sent the text
+	Receiver string `json:"receiver"` // who stored it
+	At       int64  `json:"at_unix"`
+	Sig      string `json:"sig"` // receiver's Ed25519 signature over the fields above
+}
+
+func (a deliveryAck) signed() []byte {
+	return []byte(strings.Join([]string{"hz-textack", a.MsgID, a.Sender, a.Receiver, strconv.FormatInt(a.At, 10)}, "|"))
+}
+
+type deliveryTracker struct {
+	mu    sync.Mutex
+	m     map[string]*DeliveryStatus
+	order []string // msgids, oldest first
+}
+
+func newDeliveryTracker() *deliveryTracker {
+	return &deliveryTracker{m: make(map[string]*DeliveryStatus)}
+}
+
+func (t *deliveryTracker) putLocked(st *DeliveryStatus) {
+	if _, ok := t.m[st.MsgID]; !ok {
+		t.order = append(t.order, st.MsgID)
+	}
+	t.m[st.MsgID] = st
+	for len(t.order) > deliveryKeep {
+		delete(t.m, t.order[0])
+		t.order = t.order[1:]
+	}
+}
+
+// sent records a text the first hop took; acked says whether an ack will
+// come.
+func (t *deliveryTracker) sent(msgid, to string, acked bool, now time.Time) {
+	state := deliverySent
+	if acked {
+		state = deliveryPending
+	}
+	t.mu.Lock()
+	t.putLocked(&DeliveryStatus{MsgID: msgid, To: to, State: state, Sent: now.Unix()})
+	t.mu.Unlock()
+}
+
+// failed records a text that never got onto a path.
+func (t *deliveryTracker) failed(msgid, to, reason string, now time.Time) {
+	t.mu.Lock()
+	t.putLocked(&DeliveryStatus{MsgID: msgid, To: to, State: deliveryFailed, Sent: now.Unix(), Failed: now.Unix(), Error: reason})
+	t.mu.Unlock()
+}
+
+// delivered marks msgid acked by receiver. False if we didn't send msgid
+// to receiver.
+func (t *deliveryTracker) delivered(msgid, receiver, via string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	st := t.m[msgid]
+	if st == nil || st.To != receiver {
+		return false
+	}
+	if st.State != deliveryDelivered {
+		st.State, st.Delivered, st.Via = deliveryDelivered, now.Unix(), via
+		st.Failed, st.Error = 0, ""
+	}
+	return true
+}
+
+// view is st as of now: pending past deliveryAckWait reads as failed.
+func (st DeliveryStatus) view(now time.Time) DeliveryStatus {
+	if st.State == deliveryPending && now.Unix()-st.Sent > int64(deliveryAckWait/time.Second) {
+		st.State = deliveryFailed
+		st.Failed = st.Sent + int64(deliveryAckWait/time.Second)
+		st.Error = "no ack within " + deliveryAckWait.String()
+	}
+	return st
+}
+
+func (t *deliveryTracker) get(msgid string, now time.Time) (DeliveryStatus, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	st := t.m[msgid]
+	if st == nil {
+		return DeliveryStatus{}, false
+	}
+	return st.view(now), true
+}
+
+// list returns every tracked send, newest first.
+func (t *deliveryTracker) list(now time.Time) []DeliveryStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make([]DeliveryStatus, 0, len(t.order))
+	for _, id := range slices.Backward(t.order) {
+		out = append(out, t.m[id].view(now))
+	}
+	return out
+}
+
+// wantsAck reports whether destID acks texts.
+func (s *Server) wantsAck(destID string) bool {
+	p, ok := s.peers.Get(destID)
+	return ok && p.hasCap(capTextAck)
+}
+
+func ackDHTKey(nodeID string) string { return ackDHTPrefix + nodeID }
+
+// ackDelivery acks a stored text whose sender asked for it.
+func (s *Server) ackDelivery(env *FinalEnvelope) {
+	if !env.Ack || env.SenderID == "" || env.SenderID == s.id.NodeID {
+		return
+	}
+	a := deliveryAck{MsgID: env.MsgID, Sender: env.SenderID, Receiver: s.id.NodeID, At: time.Now().Unix()}
+	s.fwdPool.submit(func() { s.sendDeliveryAck(a) })
+}
+
+// sendDeliveryAck signs a and sends it back over the mix, or straight to
+// the sender when no path to it can be built.
+func (s *Server) sendDeliveryAck(a deliveryAck) {
+	priv, err := receiptKey(s.paths)
+	if err != nil {
+		log.Printf("[ack] %s: %v", a.MsgID, err)
+		return
+	}
+	a.Sig = base64.RawURLEncoding.EncodeToString(ed25519.Sign(priv, a.signed()))
+	data, _ := json.Marshal(a)
+	if p, ok := s.peers.Get(a.Sender); ok && len(p.PubKey) == 32 {
+		msgid, err := randomMsgID()
+		if err == nil {
+			class, _ := s.cfg.mixClassFor(defaultMixClass)
+			_, err = s.sendMix(FinalEnvelope{
+				Type:       mixTextAck,
+				SenderID:   s.id.NodeID,
+				ReceiverID: a.Sender,
+				MsgID:      msgid,
+				DataB64:    base64.RawURLEncoding.EncodeToString(data),
+				Logical:    s.lamport.tick(),
+				SentUnix:   time.Now().Unix(),
+			}, defaultMixClass, class)
+		}
+		if err == nil {
+			return
+		}
+		log.Printf("[ack] %s to %.8s over the mix: %v; trying direct", a.MsgID, a.Sender, err)
+	}
+	hdr := http.Header{"Content-Type": {"application/json"}}
+	for _, addr := range s.ackAddrs(a.Sender) {
+		resp, _, err := s.postToAddr(addr, "/mix/ack", data, hdr)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 == 2 {
+			return
+		}
+		log.Printf("[ack] %s direct to %s: HTTP %d", a.MsgID, addr, resp.StatusCode)
+	}
+	log.Printf("[ack] %s: no way back to %.8s", a.MsgID, a.Sender)
+}
+
+// ackAddrs returns where sender takes direct acks: its known address, then
+// its "ack:" DHT record, asked of the peers closest to the key when the
+// local DHT doesn't hold it.
+func (s *Server) ackAddrs(sender string) []string {
+	var out []string
+	if p, ok := s.peers.Get(sender); ok && p.Addr != "" {
+		out = append(out, p.Addr)
+	}
+	key := ackDHTKey(sender)
+	found := s.dht.Get(key)
+	if len(found) == 0 {
+		for _, p := range s.dhtTargets(key) {
+			resp, _, err := s.getFromPeer(p, http.MethodGet, peerPath(p, "/dht/get")+"?key="+url.QueryEscape(key), ackLookupTimeout)
+			if err != nil {
+				continue
+			}
+			var res struct {
+				Providers []string `json:"providers"`
+			}
+			b, err := readPeerBody(resp, 16<<10)
+			if err == nil && resp.StatusCode == http.StatusOK && json.Unmarshal(b, &res) == nil {
+				found = append(found, res.Providers...)
+			}
+		}
+	}
+	for _, addr := range found {
+		if _, _, err := net.SplitHostPort(addr); err == nil && !slices.Contains(out, addr) {
+			out = append(out, addr)
+		}
+	}
+	return out
+}
+
+// acceptDeliveryAck checks an ack of one of our texts and records it.
+func (s *Server) acceptDeliveryAck(a deliveryAck, via string) (int, error) {
+	if a.Sender != s.id.NodeID || a.MsgID == "" {
+		return http.StatusBadRequest, errors.New("not an ack of our text")
+	}
+	p, ok := s.peers.Get(a.Receiver)
+	if !ok || len(p.SignKey) != ed25519.PublicKeySize {
+		return http.StatusForbidden, errors.New("receiver's signing key not pinned yet")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(a.Sig)
+	if err != nil || !ed25519.Verify(p.SignKey, a.signed(), sig) {
+		return http.StatusForbidden, errors.New("bad receiver signature")
+	}
+	if !s.deliveries.delivered(a.MsgID, a.Receiver, via, time.Now()) {
+		return http.StatusNotFound, fmt.Errorf("no text %s to %.8s", a.MsgID, a.Receiver)
+	}
+	s.convs.setState(s.id.NodeID, a.Receiver, a.MsgID, deliveryDelivered)
+	s.metrics.counter(mixAcks).inc(via)
+	log.Printf("[ack] %s delivered to %.8s (%s)", a.MsgID, a.Receiver, via)
+	return http.StatusOK, nil
+}
+
+// acceptMixAck handles a text-ack that came back over the mix.
+func (s *Server) acceptMixAck(env *FinalEnvelope, data []byte) (int, error) {
+	var a deliveryAck
+	if err := json.Unmarshal(data, &a); err != nil || a.Receiver != env.SenderID {
+		return http.StatusBadRequest, errors.New("bad delivery ack")
+	}
+	return s.acceptDeliveryAck(a, "mix")
+}
+
+// POST /mix/ack (public): a deliveryAck sent straight to us.
+func (s *Server) handleMixAck(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	var a deliveryAck
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4<<10)).Decode(&a); err != nil {
+		http.Error(w, "bad ack", http.StatusBadRequest)
+		return
+	}
+	if code, err := s.acceptDeliveryAck(a, "direct"); err != nil {
+		http.Error(w, err.Error(), code)
+		return
+	}
+	writeJSON(w, map[string]string{"status": "ok"})
+}
+
+// GET /mix/status?msgid= (control): delivery state of one sent text.
+// Without msgid, every tracked send, newest first.
+func (s *Server) handleMixStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	msgid := strings.TrimSpace(r.URL.Query().Get("msgid"))
+	if msgid == "" {
+		writeJSON(w, s.deliveries.list(time.Now()))
+		return
+	}
+	st, ok := s.deliveries.get(msgid, time.Now())
+	if !ok {
+		http.Error(w, "unknown msgid", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, st)
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// A first hop that refuses the onion (4xx) fails the send: send-text
+// answers with that status, not "sent", and /mix/status says failed.
+func TestSendTextRefusedByFirstHop(t *testing.T) {
+	small := defaultConfig()
+	small.RelayMaxBytes = 64
+	a, b, c := newTestServer(t, "a", nil), newTestServer(t, "b", small), newTestServer(t, "c", nil)
+	mesh(t, a, b, c)
+
+	rr := httptest.NewRecorder()
+	a.handleSendText(rr, httptest.NewRequest(http.MethodPost, "/mix/send-text?to="+c.id.NodeID+"&hops=2", strings.NewReader("too big for b")))
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "inject fail: status 400: bad packet") {
+		t.Fatalf("send-text: HTTP %d %s", rr.Code, rr.Body)
+	}
+
+	rr = httptest.NewRecorder()
+	a.handleMixStatus(rr, httptest.NewRequest(http.MethodGet, "/mix/status", nil))
+	var list []DeliveryStatus
+	if err := json.Unmarshal(rr.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].State != deliveryFailed || !strings.Contains(list[0].Error, "status 400") {
+		t.Fatalf("status %+v", list)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/hex"
 	"math/big"
 	"sync"
+	"time"
 )
 
 type DHT interface {
@@ -15,11 +16,12 @@ type DHT interface {
 type simpleDHT struct {
 	selfID string
 	mu     sync.RWMutex
-	table  map[string]map[string]struct{} // key -> set(nodeID)
+	table  map[string]map[string]time.Time // key -> nodeID -> last put
+	dirty  bool                            // changed since the last save (dht_store.go)
 }
 
 func newSimpleDHT(selfID string) *simpleDHT {
-	return &simpleDHT{selfID: selfID, table: make(map[string]map[string]struct{})}
+	return &simpleDHT{selfID: selfID, table: make(map[string]map[string]time.Time)}
 }
 
 func (d *simpleDHT) Put(key string, providers []string) {
@@ -27,12 +29,14 @@ func (d *simpleDHT) Put(key string, providers []string) {
 	defer d.mu.Unlock()
 	set := d.table[key]
 	if set == nil {
-		set = make(map[string]struct{})
+		set = make(map[string]time.Time)
 		d.table[key] = set
 	}
+	now := time.Now()
 	for _, p := range providers {
-		set[p] = struct{}{}
+		set[p] = now
 	}
+	d.dirty = true
 }
 
 func (d *simpleDHT) Get(key string) []string {
@@ -46,6 +50,29 @@ func (d *simpleDHT) Get(key string) []string {
 	return out
 }
 
+// expire drops the providers not put again since before, and keys left
+// with none, and returns how many providers went.
+func (d *simpleDHT) expire(before time.Time) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := 0
+	for key, set := range d.table {
+		for p, at := range set {
+			if at.Before(before) {
+				delete(set, p)
+				n++
+			}
+		}
+		if len(set) == 0 {
+			delete(d.table, key)
+		}
+	}
+	if n > 0 {
+		d.dirty = true
+	}
+	return n
+}
+
 func (d *simpleDHT) SelfID() string { return d.selfID }
 
 // XOR helpers (for future Kademlia)
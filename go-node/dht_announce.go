@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DHT announcements. Provider records used to die with the process that
+// held them and nothing put them back. The DHT is now saved in dht.enc
+// (dht_store.go), and this node announces what it can serve itself: every
+// chunk on disk that a live data block references (as its
+// blob-<hash>-<name> key, which /fetch rebuilds from disk), the peer
+// snapshots it published (kept in dht.enc across restarts), and its ack
+// record. Catalog rows are served through their blocks' chunks; libp2p
+// manifests aren't fetchable over /fetch and aren't announced. Each
+// record goes into the local DHT and, through /dht/put, to the dhtReplicas
+// peers closest to the key by XOR distance. After a restart the records
+// are announced once, spaced out over --dht-warmup so a node with many
+// chunks doesn't hit its peers all at once. After that the loop
+// republishes each record once it is --dht-republish old, and rescans the
+// stores every dhtRescanEvery for new and removed ones. A record no peer
+// took is tried again after dhtAnnounceRetry. Peers drop a provider that
+// missed two republishes, so a record counts as lapsed then:
+// GET /dht/announcements lists every record with when it was last put,
+// where, and when it lapses.
+
+const (
+	defaultDHTRepublish = time.Hour
+	defaultDHTWarmup    = 10 * time.Minute
+
+	dhtReplicas        = 3
+	dhtAnnounceCheck   = time.Minute
+	dhtAnnounceRetry   = 5 * time.Minute
+	dhtRescanEvery     = 10 * time.Minute
+	dhtAnnouncePerTick = 256
+
+	announceChunk = "chunk"
+	announcePeers = "peers"
+	announceAck   = "ack" // our ackDHTKey, naming our address (delivery_ack.go)
+)
+
+type dhtAnnouncement struct {
+	Key       string    `json:"key"`
+	Source    string    `json:"source"` // chunk, peers or ack
+	Announced time.Time `json:"announced,omitempty"`
+	Expires   time.Time `json:"expires,omitempty"`
+	Peers     []string  `json:"peers,omitempty"` // took the last put
+	LastError string    `json:"last_error,omitempty"`
+	State     string    `json:"state"` // pending, fresh, due, lapsed
+
+	tried time.Time
+}
+
+type dhtAnnouncer struct {
+	mu       sync.Mutex
+	m        map[string]*dhtAnnouncement
+	scanned  time.Time
+	warmedUp bool
+}
+
+func newDHTAnnouncer() *dhtAnnouncer {
+	return &dhtAnnouncer{m: make(map[string]*dhtAnnouncement)}
+}
+
+// track adds the records not tracked yet and drops those no longer held.
+func (a *dhtAnnouncer) track(held map[string]string, now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for key, src := range held {
+		if a.m[key] == nil {
+			a.m[key] = &dhtAnnouncement{Key: key, Source: src}
+		}
+	}
+	for key := range a.m {
+		if _, ok := held[key]; !ok {
+			delete(a.m, key)
+		}
+	}
+	a.scanned = now
+}
+
+// due returns the keys to announce now, never-announced first, then the
+// oldest, at most limit (0 = all).
+func (a *dhtAnnouncer) due(now time.Time, republish time.Duration, limit int) []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var out []*dhtAnnouncement
+	for _, r := range a.m {
+		switch {
+		case r.Announced.IsZero():
+			if now.Sub(r.tried) < dhtAnnounceRetry {
+				continue
+			}
+		case republish <= 0 || now.Sub(r.Announced) < republish:
+			continue
+		}
+		out = append(out, r)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].Announced.Equal(out[j].Announced) {
+			return out[i].Announced.Before(out[j].Announced)
+		}
+		return out[i].Key < out[j].Key
+	})
+	if limit > 0 && len(out) > limit {
+		out = out[:limit]
+	}
+	keys := make([]string, len(out))
+	for i, r := range out {
+		keys[i] = r.Key
+	}
+	return keys
+}
+
+// done records one announcement of key; took lists the peers that
+// accepted it.
+func (a *dhtAnnouncer) done(key string, took []string, errMsg string, now time.Time, republish time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	r := a.m[key]
+	if r == nil {
+		return
+	}
+	r.tried = now
+	r.LastError = errMsg
+	if len(took) == 0 {
+		return
+	}
+	r.Announced = now
+	r.Expires = now.Add(2 * republish)
+	r.Peers = took
+}
+
+// list returns every record with its state, by key.
+func (a *dhtAnnouncer) list(now time.Time, republish time.Duration) []dhtAnnouncement {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	out := make([]dhtAnnouncement, 0, len(a.m))
+	for _, r := range a.m {
+		cp := *r
+		switch {
+		case cp.Announced.IsZero():
+			cp.State = "pending"
+		case !now.Before(cp.Expires):
+			cp.State = "lapsed"
+		case now.Sub(cp.Announced) >= republish:
+			cp.State = "due"
+		default:
+			cp.State = "fresh"
+		}
+		out = append(out, cp)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out
+}
+
+// dhtHeld walks the local stores for the records this node can serve, and
+// adds our ack record.
+func (s *Server) dhtHeld() map[string]string {
+	out := make(map[string]string)
+	onDisk := make(map[string]bool)
+	if entries, err := os.ReadDir(s.paths.ChunksDir); err == nil {
+		for _, e := range entries {
+			if name, ok := strings.CutSuffix(e.Name(), ".bin"); ok && !e.IsDir() {
+				onDisk[name] = true
+			}
+		}
+	}
+	blocks := s.readChain()
+	deleted := tombstonesIn(blocks)
+	for _, b := range blocks {
+		if _, gone := deleted[b.Hash]; gone || !b.isData() || !onDisk[b.Hash] {
+			continue
+		}
+		out["blob-"+b.Hash+"-"+b.Name] = announceChunk
+	}
+	prefix := s.orgDHTKey("peers:")
+	s.mu.RLock()
+	for key := range s.kv {
+		if strings.HasPrefix(key, prefix) {
+			out[key] = announcePeers
+		}
+	}
+	s.mu.RUnlock()
+	if s.selfAddr != "" {
+		out[ackDHTKey(s.id.NodeID)] = announceAck
+	}
+	return out
+}
+
+// dhtTargets returns the peers closest to key by XOR distance.
+func (s *Server) dhtTargets(key string) []PeerInfo {
+	peers := s.rankPeers(s.peers.List())
+	kh := sha256Hex([]byte(key))
+	sort.SliceStable(peers, func(i, j int) bool {
+		return xorDistance(kh, peers[i].NodeID).Cmp(xorDistance(kh, peers[j].NodeID)) < 0
+	})
+	if len(peers) > dhtReplicas {
+		peers = peers[:dhtReplicas]
+	}
+	return peers
+}
+
+// announceKey puts us as a provider of key, locally and on its closest
+// peers. Our ack record names our address instead of our NodeID.
+func (s *Server) announceKey(key string) {
+	providers := []string{s.id.NodeID}
+	if key == ackDHTKey(s.id.NodeID) {
+		providers = []string{s.selfAddr}
+	}
+	s.dht.Put(key, providers)
+	body, _ := json.Marshal(map[string]any{"key": key, "providers": providers})
+	var took []string
+	errMsg := "no peers with an address"
+	for _, p := range s.dhtTargets(key) {
+		resp, _, err := s.postToPeer(p, "/dht/put", body, nil)
+		if err != nil {
+			errMsg = fmt.Sprintf("%.8s: %v", p.NodeID, err)
+			continue
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			errMsg = fmt.Sprintf("%.8s: HTTP %d", p.NodeID, resp.StatusCode)
+			continue
+		}
+		took = append(took, p.NodeID)
+	}
+	if len(took) > 0 {
+		errMsg = ""
+	}
+	s.announces.done(key, took, errMsg, time.Now(), s.cfg.DHTRepublish)
+}
+
+// republishDue rescans the stores when due and announces the records
+// that are.
+func (s *Server) republishDue(now time.Time) {
+	s.announces.mu.Lock()
+	rescan := now.Sub(s.announces.scanned) >= dhtRescanEvery
+	s.announces.mu.Unlock()
+	if rescan {
+		s.announces.track(s.dhtHeld(), now)
+	}
+	keys := s.announces.due(now, s.cfg.DHTRepublish, dhtAnnouncePerTick)
+	for _, key := range keys {
+		s.announceKey(key)
+	}
+	if len(keys) > 0 {
+		log.Printf("[dht] announced %d records", len(keys))
+	}
+}
+
+func (s *Server) startDHTAnnounceLoop(ctx context.Context) {
+	if s.cfg.DHTRepublish <= 0 {
+		return
+	}
+	s.announces.track(s.dhtHeld(), time.Now())
+	keys := s.announces.due(time.Now(), s.cfg.DHTRepublish, 0)
+	if len(keys) > 0 {
+		gap := s.cfg.DHTWarmup / time.Duration(len(keys))
+		log.Printf("[dht] announcing %d records over %v", len(keys), s.cfg.DHTWarmup)
+		for _, key := range keys {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(gap):
+			}
+			s.announceKey(key)
+		}
+	}
+	s.announces.mu.Lock()
+	s.announces.warmedUp = true
+	s.announces.mu.Unlock()
+
+	t := time.NewTicker(dhtAnnounceCheck)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			func() {
+				defer recoverOnce("dht-announce")
+				s.republishDue(now)
+			}()
+		}
+	}
+}
+
+// GET /dht/announcements (control): the provider records this node
+// advertises.
+func (s *Server) handleDHTAnnouncements(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	recs := s.announces.list(time.Now(), s.cfg.DHTRepublish)
+	states := make(map[string]int)
+	for _, rec := range recs {
+		states[rec.State]++
+	}
+	s.announces.mu.Lock()
+	warm := s.announces.warmedUp
+	s.announces.mu.Unlock()
+	writeJSON(w, map[string]any{
+		"republish":  s.cfg.DHTRepublish.String(),
+		"warmup":     s.cfg.DHTWarmup.String(),
+		"warming_up": s.cfg.DHTRepublish > 0 && !warm,
+		"replicas":   dhtReplicas,
+		"states":     states,
+		"records":    recs,
+	})
+}
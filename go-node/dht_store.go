@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DHT persistence. The provider table and the peer snapshots published
+// from this node (served out of kv by /fetch) are kept in dht.enc, sealed
+// with the env.enc FileKey since blob keys carry file names. It is saved
+// every dhtSaveEvery when the table changed, and at shutdown, and loaded
+// by newServer, so records put by peers survive a restart and a published
+// snapshot is still held, and re-announced, afterwards. Providers re-put
+// their records every --dht-republish; one that missed two is dropped, on
+// load and before each save.
+
+const (
+	dhtStoreFile = "dht.enc"
+	dhtSaveEvery = time.Minute
+)
+
+type dhtStoreRecord struct {
+	Key       string               `json:"key"`
+	Providers map[string]time.Time `json:"providers"` // nodeID -> last put
+}
+
+type dhtStoreState struct {
+	Records []dhtStoreRecord  `json:"records"`
+	Held    map[string][]byte `json:"held,omitempty"` // published peer snapshots, by kv key
+}
+
+// dhtTTL is how long a provider record lives without a republish; 0 when
+// records aren't republished and so never lapse.
+func (s *Server) dhtTTL() time.Duration {
+	if s.cfg.DHTRepublish <= 0 {
+		return 0
+	}
+	return 2 * s.cfg.DHTRepublish
+}
+
+func (s *Server) dhtStorePath() string { return filepath.Join(s.paths.BaseDir, dhtStoreFile) }
+
+// loadDHTStore restores dht.enc into the DHT and kv.
+func (s *Server) loadDHTStore() {
+	d, ok := s.dht.(*simpleDHT)
+	if !ok {
+		return
+	}
+	blob, err := os.ReadFile(s.dhtStorePath())
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	var st dhtStoreState
+	if err == nil {
+		var plain []byte
+		if plain, err = aeadOpenWithKey(s.secrets.FileKey[:], blob); err == nil {
+			err = json.Unmarshal(plain, &st)
+		}
+	}
+	if err != nil {
+		log.Printf("[dht] ignoring unreadable %s: %v", s.dhtStorePath(), err)
+		return
+	}
+	d.mu.Lock()
+	for _, r := range st.Records {
+		if len(r.Providers) > 0 {
+			d.table[r.Key] = r.Providers
+		}
+	}
+	d.mu.Unlock()
+	dropped := 0
+	if ttl := s.dhtTTL(); ttl > 0 {
+		dropped = d.expire(time.Now().Add(-ttl))
+	}
+	prefix := s.orgDHTKey("peers:")
+	s.mu.Lock()
+	for key, b := range st.Held {
+		if strings.HasPrefix(key, prefix) {
+			s.kv[key] = b
+		}
+	}
+	s.mu.Unlock()
+	d.mu.Lock()
+	d.dirty = dropped > 0
+	n := len(d.table)
+	d.mu.Unlock()
+	log.Printf("[dht] restored %d keys and %d held snapshots (%d lapsed providers dropped)", n, len(st.Held), dropped)
+}
+
+// saveDHTStore writes dht.enc if the table changed since the last save.
+func (s *Server) saveDHTStore() {
+	d, ok := s.dht.(*simpleDHT)
+	if !ok {
+		return
+	}
+	if ttl := s.dhtTTL(); ttl > 0 {
+		d.expire(time.Now().Add(-ttl))
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.dirty {
+		return
+	}
+	st := dhtStoreState{Records: make([]dhtStoreRecord, 0, len(d.table)), Held: make(map[string][]byte)}
+	for key, set := range d.table {
+		st.Records = append(st.Records, dhtStoreRecord{Key: key, Providers: set})
+	}
+	sort.Slice(st.Records, func(i, j int) bool { return st.Records[i].Key < st.Records[j].Key })
+	prefix := s.orgDHTKey("peers:")
+	s.mu.RLock()
+	for key, b := range s.kv {
+		if strings.HasPrefix(key, prefix) {
+			st.Held[key] = b
+		}
+	}
+	s.mu.RUnlock()
+	plain, _ := json.Marshal(st)
+	blob, err := aeadSealWithKey(s.secrets.FileKey[:], plain)
+	wipeBytes(plain)
+	if err == nil {
+		err = writeFileAtomic(s.dhtStorePath(), blob)
+	}
+	if err != nil {
+		log.Printf("[dht] save: %v", err)
+		return
+	}
+	d.dirty = false
+}
+
+func (s *Server) startDHTSaveLoop(ctx context.Context) {
+	ticker := time.NewTicker(dhtSaveEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			s.saveDHTStore()
+			return
+		case <-ticker.C:
+			s.saveDHTStore()
+		}
+	}
+}
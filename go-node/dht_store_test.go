@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// restart builds a fresh server on s's data dir and identity, as a node
+// coming back up would, and stops using s.
+func restart(t *testing.T, s *Server) *Server {
+	t.Helper()
+	nk, err := newNodeKeypair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2 := newServer(s.cfg, s.id, newPeerStore(), newSimpleDHT(s.id.NodeID), nk, s.paths, s.secrets)
+	ts := httptest.NewServer(s2.PublicHandler())
+	t.Cleanup(ts.Close)
+	s2.selfAddr = strings.TrimPrefix(ts.URL, "http://")
+	return s2
+}
+
+// announceAll announces every record s holds now.
+func announceAll(s *Server) map[string]string {
+	held := s.dhtHeld()
+	s.announces.track(held, time.Now())
+	for _, key := range s.announces.due(time.Now(), s.cfg.DHTRepublish, 0) {
+		s.announceKey(key)
+	}
+	return held
+}
+
+// A node holding a chunk, a published peer snapshot and its ack record
+// announces all three again after a restart, and the provider records it
+// learned from peers are still there.
+func TestDHTRecordsSurviveRestart(t *testing.T) {
+	a, b := newTestServer(t, "a", nil), newTestServer(t, "b", nil)
+	meet(t, a, b)
+	if rr := callControl(a, http.MethodPost, "/mix/send-file?name=doc.txt", a.ctlToken, strings.NewReader("hello dht")); rr.Code != http.StatusOK {
+		t.Fatalf("send: %d %s", rr.Code, rr.Body)
+	}
+	pem := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(pem, []byte("pem"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if rr := callControl(a, http.MethodPost, "/peers/publish?pem="+pem, a.ctlToken, nil); rr.Code != http.StatusOK {
+		t.Fatalf("publish: %d %s", rr.Code, rr.Body)
+	}
+	a.dht.Put("learned", []string{"provider-x"})
+
+	kinds := func(held map[string]string) []string {
+		var out []string
+		for _, src := range held {
+			if !slices.Contains(out, src) {
+				out = append(out, src)
+			}
+		}
+		slices.Sort(out)
+		return out
+	}
+	if got := kinds(announceAll(a)); !slices.Equal(got, []string{announceAck, announceChunk, announcePeers}) {
+		t.Fatalf("held before the restart: %v", got)
+	}
+	a.saveDHTStore()
+	if blob, _ := os.ReadFile(a.dhtStorePath()); len(blob) == 0 || bytes.Contains(blob, []byte("doc.txt")) || bytes.Contains(blob, []byte("learned")) {
+		t.Fatal("dht.enc missing or not sealed")
+	}
+
+	a2 := restart(t, a)
+	if got := a2.dht.Get("learned"); !slices.Equal(got, []string{"provider-x"}) {
+		t.Fatalf("learned record after the restart: %v", got)
+	}
+	c := newTestServer(t, "c", nil)
+	meet(t, a2, c)
+	held := announceAll(a2)
+	if got := kinds(held); !slices.Equal(got, []string{announceAck, announceChunk, announcePeers}) {
+		t.Fatalf("held after the restart: %v", got)
+	}
+	for key, src := range held {
+		want := a2.id.NodeID
+		if src == announceAck {
+			want = a2.selfAddr
+		}
+		if got := c.dht.Get(key); !slices.Contains(got, want) {
+			t.Errorf("%s record %q not re-announced to c: %v", src, key, got)
+		}
+	}
+	// the snapshot is still served
+	for key, src := range held {
+		if src != announcePeers {
+			continue
+		}
+		if got, _, err := c.fetchFromPeer(PeerInfo{NodeID: a2.id.NodeID, Addr: a2.selfAddr}, key); err != nil || len(got) == 0 {
+			t.Fatalf("fetch published snapshot: %v", err)
+		}
+	}
+}
+
+// A provider that missed two republishes is dropped on load and before a
+// save; with republishing off nothing lapses.
+func TestDHTStoreExpiry(t *testing.T) {
+	s := newTestServer(t, "s", nil)
+	d := s.dht.(*simpleDHT)
+	d.Put("k", []string{"old", "new"})
+	d.mu.Lock()
+	d.table["k"]["old"] = time.Now().Add(-3 * s.cfg.DHTRepublish)
+	d.table["gone"] = map[string]time.Time{"old": time.Now().Add(-3 * s.cfg.DHTRepublish)}
+	d.mu.Unlock()
+
+	cfg := *s.cfg
+	cfg.DHTRepublish = 0
+	s.cfg = &cfg
+	s.saveDHTStore()
+	kept := restart(t, s)
+	if got := kept.dht.Get("gone"); len(got) != 1 {
+		t.Fatalf("lapsed with republishing off: %v", got)
+	}
+
+	cfg.DHTRepublish = defaultDHTRepublish
+	s2 := restart(t, s)
+	if got := s2.dht.Get("k"); !slices.Equal(got, []string{"new"}) {
+		t.Fatalf("k after load: %v", got)
+	}
+	if got := s2.dht.Get("gone"); len(got) != 0 {
+		t.Fatalf("lapsed key kept: %v", got)
+	}
+	s2.saveDHTStore()
+	if got := restart(t, s2).dht.Get("gone"); len(got) != 0 {
+		t.Fatalf("lapsed key saved again: %v", got)
+	}
+}
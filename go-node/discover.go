@@ -1,19 +1,25 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"strconv"
 	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
 )
 
 // ---------------------- Discovery ----------------------
 
-// startBroadcaster sends encrypted beacons at intervals using BeaconKey (from env.enc).
-func startBroadcaster(ctx context.Context, cfg *Config, id NodeIdentity, pick *ifacePick, nodeKeys *NodeKeypair, beaconKey []byte) error {
+// startBroadcaster sends encrypted beacons at intervals: minimal ones, and a
+// full one every beaconFullEvery ticks. cfg.BeaconMode picks whether they
+// are sealed with BeaconKey (from env.enc), to each pairing, or both.
+func startBroadcaster(ctx context.Context, cfg *Config, id NodeIdentity, pick *ifacePick, nodeKeys *NodeKeypair, beaconKey []byte, orgID string, src beaconSource, hl *health) error {
 	addr := fmt.Sprintf("%s:%d", cfg.MCGroup, cfg.MCPort)
 	udpAddr, err := net.ResolveUDPAddr("udp", addr)
 	if err != nil {
@@ -29,39 +35,91 @@ func startBroadcaster(ctx context.Context, cfg *Config, id NodeIdentity, pick *i
 	pubB64 := base64.RawURLEncoding.EncodeToString(nodeKeys.Pub[:])
 	ticker := time.NewTicker(cfg.BroadcastIntv)
 
-	go func() {
+	hl.goSafe("broadcaster", func() {
 		defer conn.Close()
+		tick := 0
+		warned := 0 // last oversize length logged
+		unpaired := false
 		for {
 			select {
 			case <-ctx.Done():
 				return
 			case <-ticker.C:
+				if src.beaconPaused() {
+					continue
+				}
+				sendCanary(conn, src.beaconIfaces(), pick.Iface.Name, cfg.MCPort)
 				b := Beacon{
-					Type:     "beacon",
-					NodeID:   id.NodeID,
-					APIPort:  cfg.APIPort,
-					Hostname: id.Hostname,
-					TS:       time.Now().Unix(),
-					PubKey:   pubB64,
+					Type:    "beacon",
+					NodeID:  id.NodeID,
+					APIPort: cfg.APIPort,
+					TS:      time.Now().Unix(),
+					Org:     orgID,
+					API:     apiVersion,
+					Gen:     src.profileGen(),
+					Tip:     src.getChainTip(),
+					Posture: cfg.cryptoPosture(),
+				}
+				full := tick%beaconFullEvery == 0
+				tick++
+				if full {
+					b.Hostname, b.PubKey, b.Caps = id.Hostname, pubB64, src.beaconCaps()
+					kp := src.mixKeyProof()
+					b.SignKey, b.KeySig, b.KeyIssued = kp.SignKey, kp.Sig, kp.Issued
+				}
+				pkts, size, err := sealBeacons(b, cfg.BeaconMode, beaconKey, src.beaconPairings())
+				if errors.Is(err, errBeaconTooLarge) && full {
+					if size != warned {
+						log.Printf("[beacon] WARNING: full beacon is %d bytes (> %d), sending minimal ones only", size, beaconMaxBytes)
+						warned = size
+					}
+					b.Hostname, b.PubKey, b.Caps = "", "", nil
+					b.SignKey, b.KeySig, b.KeyIssued = "", "", 0
+					pkts, size, err = sealBeacons(b, cfg.BeaconMode, beaconKey, src.beaconPairings())
+				}
+				if errors.Is(err, errBeaconTooLarge) {
+					if size != warned {
+						log.Printf("[beacon] WARNING: beacon is %d bytes (> %d), may fragment on small-MTU links", size, beaconMaxBytes)
+						warned = size
+					}
+					err = nil
 				}
-				pkt, err := encryptBeaconWithKey(b, beaconKey)
 				if err != nil {
 					log.Printf("[beacon] encryption failed, skipping beacon: %v", err)
 					continue
 				}
-				if _, err := conn.Write(pkt); err != nil {
-					log.Printf("[beacon] write fail: %v", err)
+				if len(pkts) == 0 {
+					if !unpaired {
+						log.Printf("[beacon] WARNING: --beacon-mode=%s with no pairings, not announcing (see /pairings)", cfg.BeaconMode)
+						unpaired = true
+					}
+					continue
+				}
+				unpaired = false
+				sent := 0
+				for _, pkt := range pkts {
+					if _, err := conn.Write(pkt); err != nil {
+						log.Printf("[beacon] write fail: %v", err)
+						continue
+					}
+					sent++
+				}
+				src.beaconIfaces().sent(pick.Iface.Name, sent, len(pkts)-sent)
+				if sent == 0 {
 					continue
 				}
 				log.Printf("[beacon] sent node=%s api=%d", id.NodeID[:8], cfg.APIPort)
 			}
 		}
-	}()
+	})
 	return nil
 }
 
-// startListener decrypts incoming beacons using BeaconKey and updates peer store.
-func startListener(ctx context.Context, cfg *Config, ps *PeerStore, pick *ifacePick, beaconKey []byte) error {
+// startListener decrypts incoming beacons using BeaconKey or a pairing and
+// updates peer store. profileChanged is called for a minimal beacon whose profile
+// generation we don't have yet. guard rate-limits and counts packets per
+// source (discovery_guard.go).
+func startListener(ctx context.Context, cfg *Config, ps *PeerStore, pick *ifacePick, beaconKey []byte, pw *pairingStore, guard *discoveryGuard, org *orgGuard, clock *clockSkew, dups *dupDetector, profileChanged func(nodeID string), hl *health) error {
 	groupIP := net.ParseIP(cfg.MCGroup)
 	if groupIP == nil {
 		return fmt.Errorf("invalid multicast group %s", cfg.MCGroup)
@@ -77,7 +135,7 @@ func startListener(ctx context.Context, cfg *Config, ps *PeerStore, pick *ifaceP
 	}
 	log.Printf("[listen] joined %s:%d on iface=%s ip=%s", cfg.MCGroup, cfg.MCPort, pick.Iface.Name, pick.IPStr)
 
-	go func() {
+	hl.goSafe("listener", func() {
 		defer conn.Close()
 		buf := make([]byte, 65535)
 		for {
@@ -87,6 +145,8 @@ func startListener(ctx context.Context, cfg *Config, ps *PeerStore, pick *ifaceP
 			default:
 				_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
 				n, src, err := conn.ReadFromUDP(buf)
+				now := time.Now()
+				guard.summarize(now)
 				if err != nil {
 					if ne, ok := err.(net.Error); ok && ne.Timeout() {
 						continue
@@ -95,31 +155,102 @@ func startListener(ctx context.Context, cfg *Config, ps *PeerStore, pick *ifaceP
 					continue
 				}
 
-				var b Beacon
-				if err := decryptBeaconWithKey(buf[:n], beaconKey, &b); err != nil || b.Type != "beacon" {
+				if guard.ifaces.canaryBack(pick.Iface.Name, buf[:n], now) {
 					continue
 				}
-
-				addr := net.JoinHostPort(src.IP.String(), strconv.Itoa(b.APIPort))
-				var pk []byte
-				if b.PubKey != "" {
-					if dec, err := base64.RawURLEncoding.DecodeString(b.PubKey); err == nil && len(dec) == 32 {
-						pk = dec
-					}
+				ip := src.IP.String()
+				if !guard.admit(ip, now) {
+					continue
 				}
-
-				pi := PeerInfo{
-					NodeID:   b.NodeID,
-					Addr:     addr,
-					APIPort:  b.APIPort,
-					Hostname: b.Hostname,
-					LastSeen: time.Now(),
-					PubKey:   pk,
+				nodeID, outcome := acceptBeacon(cfg, ps, src, buf[:n], beaconKey, pw, org, clock, dups, profileChanged)
+				guard.record(ip, outcome, now)
+				if outcome == beaconAccepted {
+					guard.ifaces.received(pick.Iface.Name, nodeID, now)
 				}
-				ps.Upsert(pi)
-				log.Printf("[listen] seen node=%s addr=%s api=%d pk=%v", b.NodeID[:8], addr, b.APIPort, len(pk) == 32)
 			}
 		}
-	}()
+	})
 	return nil
 }
+
+// acceptBeacon handles one received packet, full (pre-split nodes and every
+// beaconFullEvery-th) or minimal, sealed with the group key or to us by a
+// pairing, and returns the sender and the outcome (beaconAccepted or why it
+// was dropped). Group beacons are ignored in pairwise mode. A panic here
+// (malformed input) costs that beacon only, not the listener.
+func acceptBeacon(cfg *Config, ps *PeerStore, src *net.UDPAddr, pkt []byte, beaconKey []byte, pw *pairingStore, org *orgGuard, clock *clockSkew, dups *dupDetector, profileChanged func(nodeID string)) (nodeID, outcome string) {
+	outcome = beaconMalformed // what a panic below counts as
+	defer recoverOnce("listener")
+	var b Beacon
+	switch {
+	case isPairwiseBeacon(pkt):
+		from, err := pw.open(pkt, &b)
+		if errors.Is(err, errNotForUs) {
+			return "", beaconNotForUs
+		}
+		if err != nil {
+			return "", beaconMalformed
+		}
+		if b.NodeID != from {
+			log.Printf("[listen] pairwise beacon from pairing %s claims node=%.8s, dropped", from[:8], b.NodeID)
+			return "", beaconRejected
+		}
+	case len(pkt) <= len(beaconMagic)+chacha20poly1305.NonceSizeX || !bytes.HasPrefix(pkt, beaconMagic):
+		return "", beaconMalformed
+	case cfg.BeaconMode == beaconModePairwise:
+		return "", beaconRejected
+	default:
+		if err := decryptBeaconWithKey(pkt, beaconKey, &b); err != nil {
+			return "", beaconDecryptFail
+		}
+	}
+	if b.Type != "beacon" || b.NodeID == "" {
+		return "", beaconMalformed
+	}
+	if !org.accept(b.Org, &org.foreignBeacons) {
+		return "", beaconRejected
+	}
+	if b.API == 0 && !org.legacy.allow(legacyUnversioned) {
+		return "", beaconRejected // we couldn't call it anyway: it only speaks unprefixed paths
+	}
+	clock.observe(b.NodeID, b.TS)
+	if !clock.fresh(b.TS, cfg.BeaconMaxAge) {
+		log.Printf("[listen] stale beacon node=%.8s ts=%d, dropped", b.NodeID, b.TS)
+		return "", beaconStale
+	}
+
+	dups.observe(b.NodeID, src.IP.String(), b.PubKey, time.Now())
+
+	addr := net.JoinHostPort(src.IP.String(), strconv.Itoa(b.APIPort))
+	var pk []byte
+	if b.PubKey != "" {
+		if dec, err := base64.RawURLEncoding.DecodeString(b.PubKey); err == nil && len(dec) == 32 {
+			pk = dec
+		}
+	}
+
+	pi := PeerInfo{
+		NodeID:     b.NodeID,
+		Addr:       addr,
+		APIPort:    b.APIPort,
+		Hostname:   b.Hostname,
+		LastSeen:   time.Now(),
+		PubKey:     pk,
+		APIVersion: b.API,
+		Caps:       b.Caps,
+		ProfileGen: b.Gen,
+		Tip:        b.Tip,
+		Posture:    b.Posture,
+	}
+	old, known := ps.Get(b.NodeID)
+	if known && old.Addr != "" && old.Addr != addr {
+		log.Printf("[listen] node=%.8s moved %s -> %s (old address demoted)", b.NodeID, old.Addr, addr)
+	}
+	ps.upsertProved(pi, mixKeyProof{SignKey: b.SignKey, Sig: b.KeySig, Issued: b.KeyIssued})
+	minimal := b.Gen != 0 && b.PubKey == ""
+	if minimal && profileChanged != nil && (!known || old.ProfileGen != b.Gen || len(old.PubKey) == 0) {
+		profileChanged(b.NodeID)
+	}
+	log.Printf("[listen] seen node=%.8s addr=%s api=%d pk=%v", b.NodeID, addr, b.APIPort, len(pk) == 32)
+	return b.NodeID, beaconAccepted
+}
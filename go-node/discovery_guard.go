@@ -0,0 +1,210 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Listener hardening. Every packet on the beacon port is charged to its
+// source IP's token bucket before any AEAD work, so a device spraying the
+// port costs us a map lookup per packet past its burst. Outcomes are
+// counted per source (GET /discovery/stats) and in total (/metrics). A
+// source whose packets keep failing to parse or decrypt is ignored for a
+// while; the read loop logs nothing per packet for it, only a summary line
+// at most once a minute. Pairwise blobs for other nodes are normal traffic
+// and don't count as failures.
+
+const (
+	discoveryRate        = 50  // packets per second per source, refilled
+	discoveryBurst       = 200 // bucket size: several nodes per host, pairwise blobs
+	discoveryFailWindow  = time.Minute
+	discoveryIgnoreFails = 60 // failures per window that get a source ignored
+	discoveryIgnoreFor   = 10 * time.Minute
+	discoverySummaryIntv = time.Minute
+	discoverySourcesMax  = 1024 // least recently seen source is forgotten beyond this
+)
+
+// Packet outcomes, the "outcome" label of discovery_packets_total.
+const (
+	beaconAccepted    = "accepted"
+	beaconMalformed   = "malformed"      // bad magic, short, or unparsable
+	beaconDecryptFail = "decrypt_failed" // group key didn't open it
+	beaconNotForUs    = "not_addressed"  // pairwise blob for another node
+	beaconStale       = "stale"
+	beaconRejected    = "rejected" // foreign org, legacy shim off, mode, identity mismatch
+	beaconRateLimited = "rate_limited"
+	beaconIgnored     = "ignored"
+)
+
+var discoveryPackets = metricDef{"discovery_packets_total", "multicast packets on the beacon port by outcome", "outcome"}
+
+type discoverySource struct {
+	IP           string            `json:"ip"`
+	Counts       map[string]uint64 `json:"counts"`
+	LastSeen     time.Time         `json:"last_seen"`
+	IgnoredUntil time.Time         `json:"ignored_until,omitempty"`
+
+	tokens    float64
+	refilled  time.Time
+	fails     int
+	failsFrom time.Time
+}
+
+type discoveryGuard struct {
+	mu      sync.Mutex
+	src     map[string]*discoverySource
+	totals  map[string]uint64
+	dropped uint64 // packets from ignored sources since the last summary
+	summary time.Time
+	evicted uint64
+	ifaces  *ifaceWatch // per-interface counters and canary (discovery_iface.go)
+	packets *counterVec
+}
+
+func newDiscoveryGuard(self string, m *metricsRegistry) *discoveryGuard {
+	return &discoveryGuard{src: make(map[string]*discoverySource), totals: make(map[string]uint64), ifaces: newIfaceWatch(self, m),
+		packets: m.counter(discoveryPackets)}
+}
+
+// sourceLocked returns ip's record, creating it; callers hold g.mu.
+func (g *discoveryGuard) sourceLocked(ip string, now time.Time) *discoverySource {
+	s := g.src[ip]
+	if s != nil {
+		return s
+	}
+	if len(g.src) >= discoverySourcesMax {
+		var oldest *discoverySource
+		for _, o := range g.src {
+			if oldest == nil || o.LastSeen.Before(oldest.LastSeen) {
+				oldest = o
+			}
+		}
+		delete(g.src, oldest.IP)
+		g.evicted++
+	}
+	s = &discoverySource{IP: ip, Counts: make(map[string]uint64), tokens: discoveryBurst, refilled: now}
+	g.src[ip] = s
+	return s
+}
+
+func (g *discoveryGuard) countLocked(s *discoverySource, outcome string) {
+	s.Counts[outcome]++
+	g.totals[outcome]++
+	g.packets.inc(outcome)
+}
+
+// admit charges one packet to ip and reports whether it may be processed.
+// Ignored and rate-limited packets are counted here.
+func (g *discoveryGuard) admit(ip string, now time.Time) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	s := g.sourceLocked(ip, now)
+	s.LastSeen = now
+	if now.Before(s.IgnoredUntil) {
+		g.countLocked(s, beaconIgnored)
+		g.dropped++
+		return false
+	}
+	s.tokens = min(discoveryBurst, s.tokens+now.Sub(s.refilled).Seconds()*discoveryRate)
+	s.refilled = now
+	if s.tokens < 1 {
+		g.countLocked(s, beaconRateLimited)
+		return false
+	}
+	s.tokens--
+	return true
+}
+
+// record counts an admitted packet's outcome, ignoring the source once
+// its failures in the window reach discoveryIgnoreFails.
+func (g *discoveryGuard) record(ip, outcome string, now time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	s := g.sourceLocked(ip, now)
+	g.countLocked(s, outcome)
+	if outcome != beaconMalformed && outcome != beaconDecryptFail {
+		return
+	}
+	if now.Sub(s.failsFrom) > discoveryFailWindow {
+		s.fails, s.failsFrom = 0, now
+	}
+	if s.fails++; s.fails >= discoveryIgnoreFails {
+		s.IgnoredUntil = now.Add(discoveryIgnoreFor)
+		s.fails = 0
+		log.Printf("[listen] ignoring %s for %s: %d malformed or undecryptable packets within %s", ip, discoveryIgnoreFor, discoveryIgnoreFails, discoveryFailWindow)
+	}
+}
+
+// summarize logs, at most once per discoverySummaryIntv, how many packets
+// ignored sources sent since the last line.
+func (g *discoveryGuard) summarize(now time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if now.Sub(g.summary) < discoverySummaryIntv {
+		return
+	}
+	g.summary = now
+	if g.dropped == 0 {
+		return
+	}
+	n := 0
+	for _, s := range g.src {
+		if now.Before(s.IgnoredUntil) {
+			n++
+		}
+	}
+	log.Printf("[listen] dropped %d packets from %d ignored sources in the last %s", g.dropped, n, discoverySummaryIntv)
+	g.dropped = 0
+}
+
+// GET /discovery/stats (control): per-interface counters, and packet
+// outcomes in total and per source, sources with failures or currently
+// ignored first.
+func (s *Server) handleDiscoveryStats(w http.ResponseWriter, r *http.Request) {
+	g := s.disco
+	now := time.Now()
+	g.mu.Lock()
+	totals := make(map[string]uint64, len(g.totals))
+	for k, v := range g.totals {
+		totals[k] = v
+	}
+	out := make([]discoverySource, 0, len(g.src))
+	ignored := 0
+	for _, src := range g.src {
+		cp := *src
+		cp.Counts = make(map[string]uint64, len(src.Counts))
+		for k, v := range src.Counts {
+			cp.Counts[k] = v
+		}
+		if now.Before(cp.IgnoredUntil) {
+			ignored++
+		} else {
+			cp.IgnoredUntil = time.Time{}
+		}
+		out = append(out, cp)
+	}
+	evicted := g.evicted
+	g.mu.Unlock()
+	bad := func(d discoverySource) uint64 {
+		return d.Counts[beaconMalformed] + d.Counts[beaconDecryptFail] + d.Counts[beaconRateLimited] + d.Counts[beaconIgnored]
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if bi, bj := bad(out[i]), bad(out[j]); bi != bj {
+			return bi > bj
+		}
+		return out[i].IP < out[j].IP
+	})
+	writeJSON(w, map[string]any{
+		"interfaces":       g.ifaces.snapshot(now),
+		"totals":           totals,
+		"ignored_sources":  ignored,
+		"evicted_sources":  evicted,
+		"rate_per_second":  discoveryRate,
+		"burst":            discoveryBurst,
+		"ignore_threshold": discoveryIgnoreFails,
+		"sources":          out,
+	})
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+// Per-interface discovery counters. Discovery that "sort of works" is
+// usually asymmetric multicast: our beacons leave but nothing comes in, or
+// the reverse. For each interface the broadcaster counts beacons sent and
+// send errors, and the listener counts beacons accepted from other nodes
+// and remembers who it heard within discoveryHeardWindow. Every tick the
+// broadcaster also sends a canary to the group that only this process
+// recognises; the listener should see it come back. After canaryMissLimit
+// ticks in a row without it, the node logs a warning naming the interface
+// and /ready reports discovery_canary_lost until a canary returns.
+//
+// The canary is shaped like a pairwise blob (pairwiseMagic, our token in
+// the ephemeral key's place, the sequence number in the nonce's), so other
+// nodes, old releases included, count it as not_addressed, not malformed.
+
+const (
+	discoveryHeardWindow = 5 * time.Minute
+	canaryMissLimit      = 3
+)
+
+var (
+	discoveryBeaconsSent  = metricDef{"discovery_beacons_sent_total", "beacon packets sent by interface", "iface"}
+	discoverySendErrors   = metricDef{"discovery_beacon_send_errors_total", "beacon and canary packets that failed to send by interface", "iface"}
+	discoveryBeaconsRecv  = metricDef{"discovery_beacons_received_total", "beacons accepted from other nodes by interface", "iface"}
+	discoveryCanariesSent = metricDef{"discovery_canaries_sent_total", "self-addressed canaries sent by interface", "iface"}
+	discoveryCanariesRecv = metricDef{"discovery_canaries_received_total", "own canaries that came back by interface", "iface"}
+	discoveryPeersHeard   = metricDef{"discovery_peers_heard", "distinct nodes heard in the last 5 minutes by interface", "iface"}
+	discoveryCanaryLost   = metricDef{"discovery_canary_lost", "1 while an interface's canaries don't come back", "iface"}
+)
+
+type ifaceStats struct {
+	Iface           string    `json:"iface"`
+	BeaconsSent     uint64    `json:"beacons_sent"`
+	SendErrors      uint64    `json:"send_errors"`
+	BeaconsReceived uint64    `json:"beacons_received"` // accepted, from other nodes
+	CanariesSent    uint64    `json:"canaries_sent"`
+	CanariesBack    uint64    `json:"canaries_received"`
+	CanaryMissed    int       `json:"canary_missed"` // ticks in a row
+	CanaryLost      bool      `json:"canary_lost"`
+	LastCanary      time.Time `json:"last_canary,omitempty"`
+	PeersHeard      int       `json:"peers_heard_5m"`
+
+	heard   map[string]time.Time
+	sentSeq uint64
+	backSeq uint64
+	peers   *gaugeVec // discovery_peers_heard
+}
+
+type ifaceWatch struct {
+	self  string
+	token []byte // canary token, fresh per process
+	mu    sync.Mutex
+	m     map[string]*ifaceStats
+
+	beaconsSent, sendErrors, beaconsRecv, canariesSent, canariesRecv *counterVec
+	peersHeard, canaryLost                                           *gaugeVec
+}
+
+func newIfaceWatch(self string, m *metricsRegistry) *ifaceWatch {
+	tok, err := secureRandom(curve25519.PointSize)
+	if err != nil {
+		log.Printf("[discovery] no canary token, canaries off: %v", err)
+	}
+	return &ifaceWatch{self: self, token: tok, m: make(map[string]*ifaceStats),
+		beaconsSent: m.counter(discoveryBeaconsSent), sendErrors: m.counter(discoverySendErrors),
+		beaconsRecv: m.counter(discoveryBeaconsRecv), canariesSent: m.counter(discoveryCanariesSent),
+		canariesRecv: m.counter(discoveryCanariesRecv), peersHeard: m.gauge(discoveryPeersHeard),
+		canaryLost: m.gauge(discoveryCanaryLost)}
+}
+
+// statsLocked returns iface's record, creating it; callers hold w.mu.
+func (w *ifaceWatch) statsLocked(iface string) *ifaceStats {
+	st := w.m[iface]
+	if st == nil {
+		st = &ifaceStats{Iface: iface, heard: make(map[string]time.Time), peers: w.peersHeard}
+		w.m[iface] = st
+	}
+	return st
+}
+
+// heardLocked drops nodes not heard within the window and returns how many
+// are left; callers hold w.mu.
+func (st *ifaceStats) heardLocked(now time.Time) int {
+	for id, at := range st.heard {
+		if now.Sub(at) > discoveryHeardWindow {
+			delete(st.heard, id)
+		}
+	}
+	st.peers.set(st.Iface, float64(len(st.heard)))
+	return len(st.heard)
+}
+
+// sent counts one tick's beacon packets on iface.
+func (w *ifaceWatch) sent(iface string, ok, failed int) {
+	w.mu.Lock()
+	st := w.statsLocked(iface)
+	st.BeaconsSent += uint64(ok)
+	st.SendErrors += uint64(failed)
+	w.mu.Unlock()
+	for i := 0; i < ok; i++ {
+		w.beaconsSent.inc(iface)
+	}
+	for i := 0; i < failed; i++ {
+		w.sendErrors.inc(iface)
+	}
+}
+
+// received counts a beacon the listener accepted on iface; our own,
+// looped back by the kernel, doesn't count.
+func (w *ifaceWatch) received(iface, nodeID string, now time.Time) {
+	if nodeID == "" || nodeID == w.self {
+		return
+	}
+	w.mu.Lock()
+	st := w.statsLocked(iface)
+	st.BeaconsReceived++
+	st.heard[nodeID] = now
+	st.heardLocked(now)
+	w.mu.Unlock()
+	w.beaconsRecv.inc(iface)
+}
+
+// nextCanary settles the previous canary on iface (back or missed) and
+// returns the packet for the next one. port is only for the warning.
+func (w *ifaceWatch) nextCanary(iface string, port int, now time.Time) []byte {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	st := w.statsLocked(iface)
+	st.heardLocked(now)
+	if st.sentSeq > 0 && st.backSeq < st.sentSeq {
+		st.CanaryMissed++
+		if st.CanaryMissed == canaryMissLimit {
+			st.CanaryLost = true
+			w.canaryLost.set(iface, 1)
+			log.Printf("[discovery] WARNING: iface=%s: the last %d canaries sent to the beacon group did not come back, "+
+				"so multicast isn't making the round trip here (sent=%d received=%d peers heard=%d). "+
+				"Usual culprits: IGMP snooping with no querier on the segment, AP client isolation, "+
+				"a host firewall dropping UDP %d, or the multicast route pointing at another interface",
+				iface, canaryMissLimit, st.BeaconsSent, st.BeaconsReceived, len(st.heard), port)
+		}
+	}
+	pkt := append(append(pairwiseMagic[:0:0], pairwiseMagic...), w.token...)
+	var nonce [chacha20poly1305.NonceSizeX]byte
+	binary.BigEndian.PutUint64(nonce[:], st.sentSeq+1)
+	pkt = append(pkt, nonce[:]...)
+	return append(pkt, make([]byte, chacha20poly1305.Overhead)...)
+}
+
+// canarySent records whether the packet from nextCanary went out; one
+// that didn't is a send error and isn't waited for.
+func (w *ifaceWatch) canarySent(iface string, ok bool) {
+	w.mu.Lock()
+	st := w.statsLocked(iface)
+	if ok {
+		st.sentSeq++
+		st.CanariesSent++
+	} else {
+		st.SendErrors++
+	}
+	w.mu.Unlock()
+	if ok {
+		w.canariesSent.inc(iface)
+	} else {
+		w.sendErrors.inc(iface)
+	}
+}
+
+// sendCanary sends the next canary for iface on the broadcaster's socket.
+func sendCanary(conn *net.UDPConn, w *ifaceWatch, iface string, port int) {
+	if w.token == nil {
+		return
+	}
+	_, err := conn.Write(w.nextCanary(iface, port, time.Now()))
+	w.canarySent(iface, err == nil)
+}
+
+// canaryBack reports whether pkt is one of our canaries, and if so counts
+// it on iface.
+func (w *ifaceWatch) canaryBack(iface string, pkt []byte, now time.Time) bool {
+	hdr := len(pairwiseMagic) + len(w.token)
+	if w.token == nil || len(pkt) < hdr+chacha20poly1305.NonceSizeX || !isPairwiseBeacon(pkt) || !bytes.Equal(pkt[len(pairwiseMagic):hdr], w.token) {
+		return false
+	}
+	seq := binary.BigEndian.Uint64(pkt[hdr:])
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	st := w.statsLocked(iface)
+	st.CanariesBack++
+	st.LastCanary = now
+	if seq > st.backSeq {
+		st.backSeq = seq
+	}
+	st.CanaryMissed = 0
+	if st.CanaryLost {
+		st.CanaryLost = false
+		w.canaryLost.set(iface, 0)
+		log.Printf("[discovery] iface=%s: canaries are coming back again", iface)
+	}
+	w.canariesRecv.inc(iface)
+	return true
+}
+
+// lost returns the interfaces whose canaries stopped coming back.
+func (w *ifaceWatch) lost() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var out []string
+	for name, st := range w.m {
+		if st.CanaryLost {
+			out = append(out, name)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// snapshot returns every interface's counters, sorted by name.
+func (w *ifaceWatch) snapshot(now time.Time) []ifaceStats {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	out := make([]ifaceStats, 0, len(w.m))
+	for _, st := range w.m {
+		st.PeersHeard = st.heardLocked(now)
+		cp := *st
+		cp.heard = nil
+		out = append(out, cp)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Iface < out[j].Iface })
+	return out
+}
+
+// beaconIfaces lets the broadcaster count what it sends.
+func (s *Server) beaconIfaces() *ifaceWatch { return s.disco.ifaces }
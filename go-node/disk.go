@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	defaultDiskReserve   = 512 << 20 // bytes kept free on the chunks filesystem
+	defaultDiskMinInodes = 1000
+	diskCheckIntv        = 30 * time.Second
+
+	capLowDisk = "lowdisk" // beacon capability: deprioritize me for fanout
+)
+
+var errDiskFull = errors.New("disk full")
+
+type diskState struct {
+	Free   uint64 `json:"free_bytes"`
+	Inodes int64  `json:"free_inodes"` // -1 where the filesystem has no limit
+	Low    bool   `json:"low"`
+	Err    string `json:"error,omitempty"`
+}
+
+// diskStatus measures the chunks filesystem and updates s.lowDisk.
+func (s *Server) diskStatus() diskState {
+	free, inodes, err := diskSpace(s.paths.ChunksDir)
+	if err != nil {
+		// can't tell: don't block writes, the write itself will fail
+		return diskState{Inodes: -1, Err: err.Error()}
+	}
+	st := diskState{Free: free, Inodes: inodes}
+	st.Low = free < uint64(s.cfg.DiskReserveBytes) || (inodes >= 0 && inodes < s.cfg.DiskMinInodes)
+	if s.lowDisk.Swap(st.Low) != st.Low {
+		if st.Low {
+			log.Printf("[disk] low: %d bytes / %d inodes free on %s", free, inodes, s.paths.ChunksDir)
+		} else {
+			log.Printf("[disk] back above reserve")
+		}
+	}
+	return st
+}
+
+// checkDiskFor returns an error if writing n more bytes would eat into the
+// reserve (or there are too few inodes for a new chunk).
+func (s *Server) checkDiskFor(n int64) error {
+	st := s.diskStatus()
+	if st.Err != "" {
+		return nil
+	}
+	if st.Inodes >= 0 && st.Inodes < s.cfg.DiskMinInodes {
+		return fmt.Errorf("%w: only %d inodes free", errDiskFull, st.Inodes)
+	}
+	if st.Free < uint64(n)+uint64(s.cfg.DiskReserveBytes) {
+		return fmt.Errorf("%w: %d bytes needed, %d free (reserve %d)", errDiskFull, n, st.Free, s.cfg.DiskReserveBytes)
+	}
+	return nil
+}
+
+// writeDiskFull answers 507 with the same body the mix inbox uses.
+func (s *Server) writeDiskFull(w http.ResponseWriter, msgid string, err error) {
+	log.Printf("[disk] refusing %s: %v", msgid, err)
+	writeStorageFull(w, StorageFull{Status: "storage_full", NodeID: s.id.NodeID, Scope: "disk", MsgID: msgid})
+}
+
+// writeChunk stores a chunk durably. The chain must only reference a chunk
+// once this returned nil.
+func writeChunk(path string, data []byte) error {
+	return writeFileAtomic(path, data)
+}
+
+// writeFileAtomic writes data to path via temp file, fsync, rename, so a
+// crash leaves either the old file or the new one, never half of it.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op after the rename
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// beaconCaps is nodeCaps plus the dynamic ones (low disk, maintenance).
+func (s *Server) beaconCaps() []string {
+	caps := nodeCaps(s.cfg)
+	if s.lowDisk.Load() {
+		caps = append(caps, capLowDisk)
+	}
+	if s.maint.active() {
+		caps = append(caps, capMaintenance)
+	}
+	return caps
+}
+
+// startDiskWatchLoop keeps s.lowDisk fresh for beacons and /ready.
+func (s *Server) startDiskWatchLoop(ctx context.Context) {
+	s.diskStatus()
+	ticker := time.NewTicker(diskCheckIntv)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.diskStatus()
+		}
+	}
+}
+
+// GET /ready (control): "ok", or "degraded" with the reasons.
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	disk := s.diskStatus()
+	clock := s.clock.state()
+	reasons := []string{}
+	if disk.Low {
+		reasons = append(reasons, "low_disk")
+	}
+	if clock.Skewed {
+		reasons = append(reasons, "clock_skew")
+	}
+	if s.dups.duplicated(s.id.NodeID) {
+		reasons = append(reasons, alertDupID)
+	}
+	if s.snapshots.failing() {
+		reasons = append(reasons, "snapshot_failed")
+	}
+	if len(s.disco.ifaces.lost()) > 0 {
+		reasons = append(reasons, "discovery_canary_lost")
+	}
+	down, why := s.health.degradedSubsystems()
+	for _, n := range down {
+		reasons = append(reasons, "subsystem:"+n)
+	}
+	status := "ok"
+	if len(reasons) > 0 {
+		status = "degraded"
+	}
+	writeJSON(w, map[string]any{"status": status, "reasons": reasons, "disk": disk, "clock": clock, "subsystems": why})
+}
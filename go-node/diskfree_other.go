@@ -0,0 +1,15 @@
+//go:build !windows
+
+package main
+
+import "syscall"
+
+// diskSpace returns the bytes available to us and the free inodes on the
+// filesystem holding path.
+func diskSpace(path string) (free uint64, inodes int64, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), int64(st.Ffree), nil
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"keysaver-server/keysaverclient"
+)
+
+// Environment self-check behind `go-node doctor` and GET /doctor. Most
+// support cases are the machine, not the code: multicast blocked, the wrong
+// subnet, a bound port, a full disk, env.enc from another passphrase. Each
+// check is a doctorCheck; subsystems add theirs to doctorChecks.
+
+const (
+	doctorPass = "pass"
+	doctorWarn = "warn"
+	doctorFail = "fail"
+	doctorSkip = "skip"
+
+	doctorMcastWait  = 2 * time.Second
+	doctorHTTPWait   = 5 * time.Second
+	doctorPeerSample = 5
+)
+
+// DoctorResult is one check's outcome.
+type DoctorResult struct {
+	Name   string `json:"name"`
+	Status string `json:"status"` // pass | warn | fail | skip
+	Detail string `json:"detail"`
+	Hint   string `json:"hint,omitempty"` // what to do about a warn or fail
+	TookMS int64  `json:"took_ms"`
+}
+
+// DoctorReport is the body of GET /doctor and `doctor --json`.
+type DoctorReport struct {
+	Status  string         `json:"status"` // worst of the results
+	Time    time.Time      `json:"time"`
+	Results []DoctorResult `json:"results"`
+}
+
+// doctorEnv is what checks can look at. srv is nil when the doctor runs
+// offline (CLI, node not started in this process); pass may be empty.
+type doctorEnv struct {
+	cfg   *Config
+	paths *EnvPaths
+	pass  []byte
+	srv   *Server
+}
+
+// wan is the node's WAN transport, or one built from the flags and
+// env.enc (if the passphrase opens it) when running offline.
+func (env *doctorEnv) wan() *wanOutbound {
+	if env.srv != nil {
+		return env.srv.wan
+	}
+	var sec *EnvSecrets
+	if len(env.pass) > 0 {
+		sec, _ = loadEnvSecrets(env.paths, env.pass)
+	}
+	return newWANOutbound(env.cfg, sec)
+}
+
+type doctorCheck interface {
+	Name() string
+	Run(env *doctorEnv) DoctorResult
+}
+
+// checkFunc adapts a function to doctorCheck.
+type checkFunc struct {
+	name string
+	fn   func(env *doctorEnv) DoctorResult
+}
+
+func (c checkFunc) Name() string                    { return c.name }
+func (c checkFunc) Run(env *doctorEnv) DoctorResult { return c.fn(env) }
+
+var doctorChecks = []doctorCheck{
+	checkFunc{"interface", doctorInterface},
+	checkFunc{"multicast", doctorMulticast},
+	checkFunc{"ports", doctorPorts},
+	checkFunc{"storage", doctorStorage},
+	checkFunc{"env.enc", doctorEnvEnc},
+	checkFunc{"clock", doctorClock},
+	checkFunc{"keysaver", doctorKeySaver},
+	checkFunc{"peers", doctorPeers},
+}
+
+func runDoctorChecks(env *doctorEnv) DoctorReport {
+	rep := DoctorReport{Status: doctorPass, Time: time.Now().UTC()}
+	rank := map[string]int{doctorSkip: 0, doctorPass: 0, doctorWarn: 1, doctorFail: 2}
+	for _, c := range doctorChecks {
+		start := time.Now()
+		res := func() (res DoctorResult) {
+			defer func() {
+				if v := recover(); v != nil {
+					res = DoctorResult{Status: doctorFail, Detail: fmt.Sprintf("check panicked: %v", v)}
+				}
+			}()
+			return c.Run(env)
+		}()
+		res.Name = c.Name()
+		res.TookMS = time.Since(start).Milliseconds()
+		if rank[res.Status] > rank[rep.Status] {
+			rep.Status = res.Status
+		}
+		rep.Results = append(rep.Results, res)
+	}
+	return rep
+}
+
+func pass(format string, a ...any) DoctorResult {
+	return DoctorResult{Status: doctorPass, Detail: fmt.Sprintf(format, a...)}
+}
+
+func skip(format string, a ...any) DoctorResult {
+	return DoctorResult{Status: doctorSkip, Detail: fmt.Sprintf(format, a...)}
+}
+
+func warnHint(hint, format string, a ...any) DoctorResult {
+	return DoctorResult{Status: doctorWarn, Detail: fmt.Sprintf(format, a...), Hint: hint}
+}
+
+func failHint(hint, format string, a ...any) DoctorResult {
+	return DoctorResult{Status: doctorFail, Detail: fmt.Sprintf(format, a...), Hint: hint}
+}
+
+func doctorInterface(env *doctorEnv) DoctorResult {
+	pick, err := pickInterface(env.cfg)
+	if err != nil {
+		return failHint("list interfaces with `ip -4 addr` / `ipconfig` and pass --mc-iface <name> or --mc-subnet <cidr>", "no usable interface: %v", err)
+	}
+	if env.cfg.MCIface == "" && env.cfg.MCSubnet != "" && !pick.ByCIDR {
+		return warnHint("set --mc-subnet to the LAN this machine is on (peers must share it), or force --mc-iface",
+			"no interface in --mc-subnet %s; fell back to %s %s (%s)", env.cfg.MCSubnet, pick.Iface.Name, pick.IPStr, pick.NetStr)
+	}
+	return pass("%s %s (%s)", pick.Iface.Name, pick.IPStr, pick.NetStr)
+}
+
+// doctorMulticast joins the beacon group and sends itself a probe. A
+// running node's listener sees the probe too and drops it as undecryptable.
+func doctorMulticast(env *doctorEnv) DoctorResult {
+	const hint = "allow UDP on the beacon port in the firewall, check IGMP snooping on the switch, disable VPN adapters or pick the LAN with --mc-iface"
+	pick, err := pickInterface(env.cfg)
+	if err != nil {
+		return skip("no interface")
+	}
+	group := net.ParseIP(env.cfg.MCGroup)
+	if group == nil || !group.IsMulticast() {
+		return failHint("use an IPv4 multicast group, e.g. 239.255.255.250", "--mc-group %q is not a multicast address", env.cfg.MCGroup)
+	}
+	dst := &net.UDPAddr{IP: group, Port: env.cfg.MCPort}
+	in, err := net.ListenMulticastUDP("udp4", pick.Iface, dst)
+	if err != nil {
+		return failHint(hint, "join %s on %s: %v", dst, pick.Iface.Name, err)
+	}
+	defer in.Close()
+	out, err := net.DialUDP("udp4", &net.UDPAddr{IP: pick.IP}, dst)
+	if err != nil {
+		return failHint(hint, "send socket: %v", err)
+	}
+	defer out.Close()
+
+	nonce, err := secureRandom(8)
+	if err != nil {
+		return failHint(hint, "probe nonce: %v", err)
+	}
+	probe := []byte("mixnets-doctor-" + hex.EncodeToString(nonce))
+	if _, err := out.Write(probe); err != nil {
+		return failHint(hint, "send to %s: %v", dst, err)
+	}
+	deadline := time.Now().Add(doctorMcastWait)
+	buf := make([]byte, 2048)
+	for time.Now().Before(deadline) {
+		_ = in.SetReadDeadline(deadline)
+		n, _, err := in.ReadFromUDP(buf)
+		if err != nil {
+			break
+		}
+		if string(buf[:n]) == string(probe) {
+			return pass("loopback probe received on %s via %s", dst, pick.Iface.Name)
+		}
+	}
+	return failHint(hint, "probe sent to %s via %s was not received within %s", dst, pick.Iface.Name, doctorMcastWait)
+}
+
+func doctorPorts(env *doctorEnv) DoctorResult {
+	if env.srv != nil {
+		down, why := env.srv.health.degradedSubsystems()
+		for _, n := range down {
+			if strings.HasSuffix(n, " http") {
+				return failHint("stop the other process using the port or pick another with --api-port / --control-port", "%s: %s", n, why[n])
+			}
+		}
+		return pass("public :%d and control :%d listening", env.cfg.APIPort, env.cfg.ControlPort)
+	}
+	bindIP := env.cfg.BindIP
+	if bindIP == "" {
+		if pick, err := pickInterface(env.cfg); err == nil {
+			bindIP = pick.IPStr
+		}
+	}
+	var busy []string
+	for _, addr := range []string{fmt.Sprintf("%s:%d", bindIP, env.cfg.APIPort), fmt.Sprintf("127.0.0.1:%d", env.cfg.ControlPort)} {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			busy = append(busy, addr)
+			continue
+		}
+		ln.Close()
+	}
+	if len(busy) == 0 {
+		return pass("public :%d and control :%d are free", env.cfg.APIPort, env.cfg.ControlPort)
+	}
+	// a node already running here is fine
+	resp, err := (&http.Client{Timeout: doctorHTTPWait}).Get(fmt.Sprintf("http://127.0.0.1:%d/versions", env.cfg.ControlPort))
+	if err == nil {
+		resp.Body.Close()
+		return warnHint("run `go-node ctl status`, or curl the running node's /doctor for its own view", "%s in use, apparently by a running node", strings.Join(busy, ", "))
+	}
+	return failHint("stop the other process using the port or pick another with --api-port / --control-port", "cannot bind %s", strings.Join(busy, ", "))
+}
+
+func doctorStorage(env *doctorEnv) DoctorResult {
+	if env.paths == nil {
+		return failHint("check that the home directory exists and is writable", "no storage paths")
+	}
+	f, err := os.CreateTemp(env.paths.BaseDir, ".doctor-*")
+	if err != nil {
+		return failHint("fix ownership/permissions of "+env.paths.BaseDir, "base dir not writable: %v", err)
+	}
+	name := f.Name()
+	f.Close()
+	os.Remove(name)
+
+	free, inodes, err := diskSpace(env.paths.ChunksDir)
+	if err != nil {
+		return warnHint("", "%s writable; free space unknown: %v", env.paths.BaseDir, err)
+	}
+	if free < uint64(env.cfg.DiskReserveBytes) || (inodes >= 0 && inodes < env.cfg.DiskMinInodes) {
+		return failHint("free space on that filesystem, run `POST /chunks/gc`, or lower --disk-reserve",
+			"%s: %d bytes / %d inodes free, below the reserve (%d bytes); replicates will get 507", env.paths.ChunksDir, free, inodes, env.cfg.DiskReserveBytes)
+	}
+	return pass("%s writable, %d MiB free", env.paths.BaseDir, free>>20)
+}
+
+func doctorEnvEnc(env *doctorEnv) DoctorResult {
+	if env.srv != nil {
+		return pass("loaded (org %s)", env.srv.org.ID)
+	}
+	if _, err := os.Stat(env.paths.EnvEnc); err != nil {
+		return failHint("create one with --new-net --env-pass, or copy the network's env.enc into "+filepath.Dir(env.paths.EnvEnc), "%s missing", env.paths.EnvEnc)
+	}
+	if len(env.pass) == 0 {
+		return warnHint("pass --env-pass or set MIXNETS_ENV_PASS to test decryption", "%s present, not tested (no passphrase)", env.paths.EnvEnc)
+	}
+	sec, err := loadEnvSecrets(env.paths, env.pass)
+	if err != nil {
+		return failHint("this env.enc was sealed with a different passphrase or belongs to another network; get the right passphrase or env.enc from whoever created the network",
+			"cannot decrypt %s: %v", env.paths.EnvEnc, err)
+	}
+	return pass("decrypts (org %s)", sec.OrgID)
+}
+
+func doctorClock(env *doctorEnv) DoctorResult {
+	if env.srv == nil {
+		return skip("needs a running node (GET /doctor)")
+	}
+	st := env.srv.clock.state()
+	if st.Peers == 0 {
+		return skip("no peer beacons yet")
+	}
+	if st.Skewed {
+		return warnHint("enable time sync (NTP / w32time) on this machine or on the peers",
+			"local clock is %.1fs off the median of %d peers", st.SkewSeconds, st.Peers)
+	}
+	return pass("%.1fs from the median of %d peers", st.SkewSeconds, st.Peers)
+}
+
+// doctorKeySaver checks every configured keysaver: all healthy passes, some
+// down warns (failover covers it), none up fails.
+func doctorKeySaver(env *doctorEnv) DoctorResult {
+	urls := env.cfg.keysaverURLs()
+	if len(urls) == 0 {
+		return skip("no keysaver configured (--keysaver-url)")
+	}
+	var ok, bad []string
+	var first DoctorResult
+	for _, base := range urls {
+		res := doctorKeySaverOne(env, base)
+		if res.Status == doctorPass {
+			ok = append(ok, res.Detail)
+			continue
+		}
+		if len(bad) == 0 {
+			first = res
+		}
+		bad = append(bad, res.Detail)
+	}
+	switch {
+	case len(bad) == 0:
+		return pass("%s", strings.Join(ok, "; "))
+	case len(ok) == 0:
+		first.Detail = strings.Join(bad, "; ")
+		return first
+	}
+	return warnHint(first.Hint, "%s; failing over to: %s", strings.Join(bad, "; "), strings.Join(ok, "; "))
+}
+
+func doctorKeySaverOne(env *doctorEnv, base string) DoctorResult {
+	const hint = "check the URL, DNS and firewall, and that keysaver-server is running (`systemctl status keysaver`)"
+	wan := env.wan()
+	proxy := wan.viaProxy(base + "/health")
+	c := keysaverclient.New(base, "")
+	c.HTTP = wan.client(doctorHTTPWait)
+	h, err := c.DeepHealth(context.Background())
+	switch st := keysaverStatus(err); {
+	case st == http.StatusProxyAuthRequired:
+		return failHint("set the proxy credentials with PUT /env/proxy-auth (stored in env.enc)", "proxy %s rejected the request: HTTP 407", proxy)
+	case st == 0 && err != nil:
+		detail, h := wanFailure("keysaver "+base, proxy, err)
+		if h == "" {
+			h = hint
+		}
+		return failHint(h, "%s", detail)
+	case err != nil:
+		return failHint(hint, "%s/health: %v", base, err)
+	}
+	if bad := keysaverFailing(h); bad != "" {
+		return failHint("the keysaver runs but can't store or open keys; see its log (a wrong --master-key stops it at startup)", "%s unhealthy: %s", base, bad)
+	}
+	if proxy != "" {
+		return pass("%s healthy (via proxy %s)", base, proxy)
+	}
+	return pass("%s healthy", base)
+}
+
+func doctorPeers(env *doctorEnv) DoctorResult {
+	if env.srv == nil {
+		return skip("needs a running node (GET /doctor)")
+	}
+	peers := env.srv.rankPeers(env.srv.peers.List())
+	if len(peers) == 0 {
+		return warnHint("no beacons heard: see the multicast check, and make sure peers share the network's env.enc", "no peers known")
+	}
+	if len(peers) > doctorPeerSample {
+		peers = peers[:doctorPeerSample]
+	}
+	ok := 0
+	var bad []string
+	for _, p := range peers {
+		resp, _, err := env.srv.getFromPeer(p, http.MethodHead, peerPath(p, "/peer-info"), doctorHTTPWait)
+		if err == nil {
+			resp.Body.Close()
+			ok++
+			continue
+		}
+		bad = append(bad, p.NodeID[:min(8, len(p.NodeID))])
+	}
+	switch {
+	case ok == len(peers):
+		return pass("%d/%d sampled peers reachable", ok, len(peers))
+	case ok == 0:
+		return failHint("beacons arrive but TCP doesn't: open the API port (--api-port) in the peers' firewalls, or check --bind",
+			"none of %d sampled peers reachable", len(peers))
+	default:
+		return warnHint("unreachable peers may be asleep or firewalled; see /peers/transports",
+			"%d/%d sampled peers reachable (down: %s)", ok, len(peers), strings.Join(bad, ", "))
+	}
+}
+
+// GET /doctor (control): the checks from inside the running node.
+func (s *Server) handleDoctor(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, runDoctorChecks(&doctorEnv{cfg: s.cfg, paths: s.paths, srv: s}))
+}
@@ -0,0 +1,63 @@
+//go:build !dll
+// +build !dll
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// `go-node doctor [--json] [node flags]` runs the self-check without
+// starting the node. Exit 1 if any check fails.
+func runDoctor(args []string) int {
+	cfg := defaultConfig()
+	fs := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	envPass := fs.String("env-pass", "", "passphrase to test env.enc with (or set MIXNETS_ENV_PASS)")
+	fs.IntVar(&cfg.APIPort, "api-port", cfg.APIPort, "HTTP API port")
+	fs.IntVar(&cfg.ControlPort, "control-port", cfg.ControlPort, "localhost control port")
+	fs.StringVar(&cfg.DataDir, "data-dir", cfg.DataDir, "storage directory (default: MIXNETS_DATA_DIR or ~/.mixnets)")
+	fs.StringVar(&cfg.MCGroup, "mc-group", cfg.MCGroup, "multicast group (IPv4)")
+	fs.IntVar(&cfg.MCPort, "mc-port", cfg.MCPort, "multicast UDP port")
+	fs.StringVar(&cfg.BindIP, "bind", cfg.BindIP, "HTTP bind IP (default: chosen iface IP)")
+	fs.StringVar(&cfg.MCSubnet, "mc-subnet", cfg.MCSubnet, "CIDR to choose NIC")
+	fs.StringVar(&cfg.MCIface, "mc-iface", cfg.MCIface, "Interface name to force")
+	fs.Int64Var(&cfg.DiskReserveBytes, "disk-reserve", cfg.DiskReserveBytes, "bytes that must stay free on the chunks filesystem")
+	fs.StringVar(&cfg.KeySaverURL, "keysaver-url", cfg.KeySaverURL, "key saver base URL(s), comma-separated")
+	fs.StringVar(&cfg.ProxyURL, "proxy-url", cfg.ProxyURL, "HTTP proxy for the keysaver check (default HTTPS_PROXY/HTTP_PROXY)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	paths, err := initStorageEnv(cfg.DataDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "doctor: storage: %v\n", err)
+		return 1
+	}
+	pass := *envPass
+	if pass == "" {
+		pass = os.Getenv("MIXNETS_ENV_PASS")
+	}
+	rep := runDoctorChecks(&doctorEnv{cfg: cfg, paths: paths, pass: []byte(pass)})
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(rep)
+	} else {
+		for _, r := range rep.Results {
+			fmt.Printf("[%s] %-9s %s\n", strings.ToUpper(r.Status), r.Name, r.Detail)
+			if r.Hint != "" && (r.Status == doctorWarn || r.Status == doctorFail) {
+				fmt.Printf("       %-9s -> %s\n", "", r.Hint)
+			}
+		}
+		fmt.Printf("overall: %s\n", rep.Status)
+	}
+	if rep.Status == doctorFail {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// withChecks swaps doctorChecks for the length of the test.
+func withChecks(t *testing.T, checks ...doctorCheck) {
+	old := doctorChecks
+	doctorChecks = checks
+	t.Cleanup(func() { doctorChecks = old })
+}
+
+func TestDoctorReportWorstStatus(t *testing.T) {
+	withChecks(t,
+		checkFunc{"ok", func(*doctorEnv) DoctorResult { return pass("fine") }},
+		checkFunc{"skipped", func(*doctorEnv) DoctorResult { return skip("n/a") }},
+		checkFunc{"meh", func(*doctorEnv) DoctorResult { return warnHint("h", "so-so") }},
+	)
+	if rep := runDoctorChecks(&doctorEnv{}); rep.Status != doctorWarn || len(rep.Results) != 3 || rep.Results[2].Name != "meh" {
+		t.Fatalf("%+v", rep)
+	}
+	withChecks(t,
+		checkFunc{"boom", func(*doctorEnv) DoctorResult { panic("nil map") }},
+		checkFunc{"ok", func(*doctorEnv) DoctorResult { return pass("fine") }},
+	)
+	rep := runDoctorChecks(&doctorEnv{})
+	if rep.Status != doctorFail || rep.Results[0].Name != "boom" || !strings.Contains(rep.Results[0].Detail, "nil map") || rep.Results[1].Status != doctorPass {
+		t.Fatalf("a panicking check must fail alone: %+v", rep)
+	}
+}
+
+func TestDoctorStorage(t *testing.T) {
+	s := newTestServer(t, "d", nil)
+	env := &doctorEnv{cfg: defaultConfig(), paths: s.paths}
+	env.cfg.DiskReserveBytes = 0
+	env.cfg.DiskMinInodes = 0
+	if res := doctorStorage(env); res.Status != doctorPass {
+		t.Fatalf("%+v", res)
+	}
+	env.cfg.DiskReserveBytes = 1 << 62
+	if res := doctorStorage(env); res.Status != doctorFail || res.Hint == "" {
+		t.Fatalf("below the reserve: %+v", res)
+	}
+}
+
+func TestDoctorEnvEnc(t *testing.T) {
+	paths, err := initStorageEnv(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := &doctorEnv{cfg: defaultConfig(), paths: paths, pass: []byte("right")}
+	if res := doctorEnvEnc(env); res.Status != doctorFail || !strings.Contains(res.Detail, "missing") {
+		t.Fatalf("no env.enc: %+v", res)
+	}
+	if _, err := createEnvSecrets(paths, env.pass, "org-1"); err != nil {
+		t.Fatal(err)
+	}
+	if res := doctorEnvEnc(env); res.Status != doctorPass || !strings.Contains(res.Detail, "org-1") {
+		t.Fatalf("right passphrase: %+v", res)
+	}
+	env.pass = []byte("wrong")
+	if res := doctorEnvEnc(env); res.Status != doctorFail || !strings.Contains(res.Hint, "passphrase") {
+		t.Fatalf("wrong passphrase: %+v", res)
+	}
+	env.pass = nil
+	if res := doctorEnvEnc(env); res.Status != doctorWarn {
+		t.Fatalf("no passphrase: %+v", res)
+	}
+}
+
+func TestDoctorPortsBusy(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	cfg := defaultConfig()
+	cfg.BindIP = "127.0.0.1"
+	cfg.APIPort = ln.Addr().(*net.TCPAddr).Port
+	cfg.ControlPort = freePort(t)
+	if res := doctorPorts(&doctorEnv{cfg: cfg}); res.Status != doctorFail || !strings.Contains(res.Detail, ln.Addr().String()) {
+		t.Fatalf("bound port: %+v", res)
+	}
+	ln.Close()
+	if res := doctorPorts(&doctorEnv{cfg: cfg}); res.Status != doctorPass {
+		t.Fatalf("free ports: %+v", res)
+	}
+}
+
+func freePort(t *testing.T) int {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestDoctorKeySaver(t *testing.T) {
+	up, ts1 := newFakeKeysaver(t)
+	down, ts2 := newFakeKeysaver(t)
+	down.down = true
+	check := func(urls ...string) DoctorResult {
+		s := keysaverNode(t, urls...)
+		return doctorKeySaver(&doctorEnv{cfg: s.cfg, paths: s.paths, srv: s})
+	}
+	if res := check(); res.Status != doctorSkip {
+		t.Fatalf("none configured: %+v", res)
+	}
+	if res := check(ts1.URL); res.Status != doctorPass {
+		t.Fatalf("up: %+v", res)
+	}
+	if res := check(ts2.URL, ts1.URL); res.Status != doctorWarn || !strings.Contains(res.Detail, "failing over to") {
+		t.Fatalf("one down: %+v", res)
+	}
+	up.mu.Lock()
+	up.down = true
+	up.mu.Unlock()
+	if res := check(ts1.URL, ts2.URL); res.Status != doctorFail || res.Hint == "" {
+		t.Fatalf("all down: %+v", res)
+	}
+}
+
+func TestDoctorPeers(t *testing.T) {
+	a, b := newTestServer(t, "a", nil), newTestServer(t, "b", nil)
+	env := &doctorEnv{cfg: a.cfg, paths: a.paths, srv: a}
+	if res := doctorPeers(env); res.Status != doctorWarn {
+		t.Fatalf("no peers: %+v", res)
+	}
+	meet(t, a, b)
+	if res := doctorPeers(env); res.Status != doctorPass {
+		t.Fatalf("reachable: %+v", res)
+	}
+	a.peers.Upsert(PeerInfo{NodeID: strings.Repeat("d", 64), Addr: fmt.Sprintf("127.0.0.1:%d", freePort(t)), APIVersion: 1})
+	if res := doctorPeers(env); res.Status != doctorWarn || !strings.Contains(res.Detail, "dddddddd") {
+		t.Fatalf("one dead: %+v", res)
+	}
+}
+
+func TestHandleDoctorJSON(t *testing.T) {
+	withChecks(t, checkFunc{"ok", func(env *doctorEnv) DoctorResult {
+		if env.srv == nil {
+			return failHint("", "offline")
+		}
+		return pass("from the node")
+	}})
+	s := newTestServer(t, "d", nil)
+	rr := httptest.NewRecorder()
+	s.handleDoctor(rr, httptest.NewRequest(http.MethodGet, "/doctor", nil))
+	var rep DoctorReport
+	if err := json.Unmarshal(rr.Body.Bytes(), &rep); err != nil {
+		t.Fatal(err)
+	}
+	if rep.Status != doctorPass || rep.Results[0].Detail != "from the node" {
+		t.Fatalf("%s", rr.Body)
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/control"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// Egress policy. Air-gapped and regulated sites need proof that a node only
+// ever talks to its own LAN. Every outbound HTTP client (peer calls, probes,
+// keysaver, webhooks) and the libp2p dialer pass their destination through
+// one policy: open lets everything out; lan-only allows the subnets of this
+// machine's interfaces plus --egress-allow; allowlist allows only
+// --egress-allow (hosts, domain suffixes, IPs or CIDRs, as in NO_PROXY).
+// Loopback and the keysavers' hosts are always allowed. A refused connection
+// fails with errEgressBlocked, is counted per subsystem and logged with its
+// destination; /status shows the policy and the latest refusals.
+
+const (
+	egressOpen      = "open"
+	egressLANOnly   = "lan-only"
+	egressAllowlist = "allowlist"
+
+	egressRecentMax = 32               // refusals kept for /status
+	egressNetsTTL   = 30 * time.Second // interface subnets are re-read this often
+	egressResolveTO = 2 * time.Second  // lookup of a hostname destination
+	egressLogEvery  = time.Minute      // one log line per subsystem+destination
+)
+
+var errEgressBlocked = errors.New("blocked by egress policy")
+
+var egressBlocked = metricDef{"egress_blocked_total",
+	"outbound connections refused by the egress policy, by subsystem", "subsystem"}
+
+func validateEgressMode(m string) error {
+	switch m {
+	case egressOpen, egressLANOnly, egressAllowlist:
+		return nil
+	}
+	return fmt.Errorf("--egress must be open, lan-only or allowlist, got %q", m)
+}
+
+// egressViolation is one refused connection.
+type egressViolation struct {
+	Time      time.Time `json:"time"`
+	Subsystem string    `json:"subsystem"`
+	Dest      string    `json:"dest"`
+	Path      string    `json:"path,omitempty"`
+	Reason    string    `json:"reason"`
+}
+
+// EgressStatus is the policy as /status reports it.
+type EgressStatus struct {
+	Mode    string            `json:"mode"`
+	Allow   []string          `json:"allow,omitempty"`
+	Subnets []string          `json:"subnets,omitempty"` // lan-only: local networks allowed
+	Blocked map[string]uint64 `json:"blocked,omitempty"` // refusals per subsystem
+	Recent  []egressViolation `json:"recent,omitempty"`  // newest last
+}
+
+type egressPolicy struct {
+	mode  string
+	allow []string
+	list  string // allow joined for noProxy
+
+	mu      sync.Mutex
+	nets    []*net.IPNet
+	netsAt  time.Time
+	blocked map[string]uint64
+	recent  []egressViolation
+	logged  map[string]time.Time
+	counted *counterVec // egress_blocked_total
+}
+
+func newEgressPolicy(cfg *Config, m *metricsRegistry) *egressPolicy {
+	e := &egressPolicy{
+		counted: m.counter(egressBlocked),
+		mode:    cfg.EgressMode,
+		allow:   slices.Clone(cfg.EgressAllow),
+		blocked: make(map[string]uint64),
+		logged:  make(map[string]time.Time),
+	}
+	if e.mode == "" {
+		e.mode = egressOpen
+	}
+	list := slices.Clone(e.allow)
+	for _, ks := range cfg.keysaverURLs() {
+		if u, err := url.Parse(ks); err == nil && u.Hostname() != "" {
+			list = append(list, u.Hostname())
+		}
+	}
+	e.list = strings.Join(list, ",")
+	return e
+}
+
+// localNets are the networks of this machine's interfaces, cached briefly
+// so DHCP renumbering is picked up.
+func (e *egressPolicy) localNets() []*net.IPNet {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.nets != nil && time.Since(e.netsAt) < egressNetsTTL {
+		return e.nets
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		log.Printf("[egress] interface addresses: %v", err)
+	}
+	nets := []*net.IPNet{}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok {
+			nets = append(nets, &net.IPNet{IP: n.IP.Mask(n.Mask), Mask: n.Mask})
+		}
+	}
+	e.nets, e.netsAt = nets, time.Now()
+	return nets
+}
+
+func (e *egressPolicy) onLAN(ip net.IP) bool {
+	if ip.IsLoopback() {
+		return true
+	}
+	for _, n := range e.localNets() {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// reason is why host may not be reached, "" if it may.
+func (e *egressPolicy) reason(host string) string {
+	host = strings.Trim(host, "[]")
+	if e == nil || e.mode == egressOpen || host == "" {
+		return ""
+	}
+	ip := net.ParseIP(host)
+	if (ip != nil && ip.IsLoopback()) || strings.EqualFold(host, "localhost") {
+		return ""
+	}
+	if e.list != "" && noProxy(host, e.list) {
+		return ""
+	}
+	if e.mode == egressAllowlist {
+		return "not on --egress-allow"
+	}
+	ips := []net.IP{ip}
+	if ip == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), egressResolveTO)
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		cancel()
+		if err != nil || len(addrs) == 0 {
+			return "unresolvable"
+		}
+		ips = ips[:0]
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
+	}
+	for _, ip := range ips {
+		if !e.onLAN(ip) && !(e.list != "" && noProxy(ip.String(), e.list)) {
+			return "outside the local subnets"
+		}
+	}
+	return ""
+}
+
+// check returns errEgressBlocked if sub may not connect to dest ("host" or
+// "host:port"); path is only for the log.
+func (e *egressPolicy) check(sub, dest, path string) error {
+	host := dest
+	if h, _, err := net.SplitHostPort(dest); err == nil {
+		host = h
+	}
+	why := e.reason(host)
+	if why == "" {
+		return nil
+	}
+	e.counted.inc(sub)
+	now := time.Now()
+	e.mu.Lock()
+	e.blocked[sub]++
+	e.recent = append(e.recent, egressViolation{Time: now, Subsystem: sub, Dest: dest, Path: path, Reason: why})
+	if len(e.recent) > egressRecentMax {
+		e.recent = slices.Delete(e.recent, 0, len(e.recent)-egressRecentMax)
+	}
+	key := sub + " " + dest
+	quiet := now.Sub(e.logged[key]) < egressLogEvery
+	if !quiet {
+		e.logged[key] = now
+	}
+	e.mu.Unlock()
+	if !quiet {
+		log.Printf("[egress] %s -> %s%s refused (%s, mode %s)", sub, dest, path, why, e.mode)
+	}
+	return fmt.Errorf("%w: %s %s (%s)", errEgressBlocked, sub, dest, why)
+}
+
+func (e *egressPolicy) status() *EgressStatus {
+	st := &EgressStatus{Mode: e.mode, Allow: e.allow}
+	if e.mode == egressLANOnly {
+		for _, n := range e.localNets() {
+			st.Subnets = append(st.Subnets, n.String())
+		}
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.blocked) > 0 {
+		st.Blocked = make(map[string]uint64, len(e.blocked))
+		for k, v := range e.blocked {
+			st.Blocked[k] = v
+		}
+	}
+	st.Recent = slices.Clone(e.recent)
+	return st
+}
+
+// wrap checks every request next would send on behalf of sub.
+func (e *egressPolicy) wrap(sub string, next http.RoundTripper) http.RoundTripper {
+	if e == nil || e.mode == egressOpen {
+		return next
+	}
+	return &egressTransport{e: e, sub: sub, next: next}
+}
+
+type egressTransport struct {
+	e    *egressPolicy
+	sub  string
+	next http.RoundTripper
+}
+
+func (t *egressTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.e.check(t.sub, req.URL.Host, req.URL.Path); err != nil {
+		return nil, err
+	}
+	return t.next.RoundTrip(req)
+}
+
+// wanClient is s.wan.client behind the egress policy.
+func (s *Server) wanClient(sub string, timeout time.Duration) *http.Client {
+	c := s.wan.client(timeout)
+	c.Transport = s.egress.wrap(sub, c.Transport)
+	return c
+}
+
+// gater applies the policy to libp2p dials; inbound connections are the
+// firewall's business.
+func (e *egressPolicy) gater() *egressGater { return &egressGater{e: e} }
+
+type egressGater struct{ e *egressPolicy }
+
+func (g *egressGater) InterceptPeerDial(peer.ID) bool { return true }
+
+func (g *egressGater) InterceptAddrDial(_ peer.ID, a ma.Multiaddr) bool {
+	host := ""
+	if ip, err := manet.ToIP(a); err == nil {
+		host = ip.String()
+	} else {
+		for _, p := range []int{ma.P_DNS, ma.P_DNS4, ma.P_DNS6} {
+			if v, err := a.ValueForProtocol(p); err == nil {
+				host = v
+				break
+			}
+		}
+	}
+	return g.e.check("libp2p", host, "") == nil
+}
+
+func (g *egressGater) InterceptAccept(network.ConnMultiaddrs) bool { return true }
+
+func (g *egressGater) InterceptSecured(network.Direction, peer.ID, network.ConnMultiaddrs) bool {
+	return true
+}
+
+func (g *egressGater) InterceptUpgraded(network.Conn) (bool, control.DisconnectReason) {
+	return true, 0
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeNets pins the policy's view of the local subnets.
+func fakeNets(e *egressPolicy, cidrs ...string) {
+	var nets []*net.IPNet
+	for _, c := range cidrs {
+		_, n, _ := net.ParseCIDR(c)
+		nets = append(nets, n)
+	}
+	e.mu.Lock()
+	e.nets, e.netsAt = nets, time.Now().Add(time.Hour)
+	e.mu.Unlock()
+}
+
+func TestEgressReason(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.EgressMode = egressLANOnly
+	cfg.EgressAllow = []string{"203.0.113.0/24", ".corp.example"}
+	cfg.KeySaverURL = "https://198.51.100.7:8443"
+	lan := newEgressPolicy(cfg, nil)
+	fakeNets(lan, "10.1.0.0/16")
+	cfg.EgressMode = egressAllowlist
+	allow := newEgressPolicy(cfg, nil)
+	fakeNets(allow, "10.1.0.0/16")
+	open := newEgressPolicy(defaultConfig(), nil)
+	for _, c := range []struct {
+		host             string
+		lan, allow, open bool
+	}{
+		{"10.1.2.3", true, false, true},
+		{"10.2.0.1", false, false, true},
+		{"8.8.8.8", false, false, true},
+		{"203.0.113.9", true, true, true},       // --egress-allow CIDR
+		{"198.51.100.7", true, true, true},      // the keysaver
+		{"keys.corp.example", true, true, true}, // domain suffix, never resolved
+		{"127.0.0.1", true, true, true},
+		{"[::1]", true, true, true},
+		{"localhost", true, true, true},
+	} {
+		for _, p := range []struct {
+			e    *egressPolicy
+			want bool
+		}{{lan, c.lan}, {allow, c.allow}, {open, c.open}} {
+			if got := p.e.reason(c.host) == ""; got != p.want {
+				t.Errorf("%s %s: allowed=%v, want %v (%s)", p.e.mode, c.host, got, p.want, p.e.reason(c.host))
+			}
+		}
+	}
+}
+
+// lanIPs returns two non-loopback addresses of this host, so connections
+// to them go through the policy's subnet check rather than the loopback
+// exemption, and allowing one (the keysaver) doesn't allow the other.
+func lanIPs(t *testing.T) (string, string) {
+	var out []string
+	addrs, _ := net.InterfaceAddrs()
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && !n.IP.IsLoopback() && !n.IP.IsLinkLocalUnicast() {
+			out = append(out, n.IP.String())
+		}
+	}
+	if len(out) < 2 {
+		t.Skipf("need two non-loopback addresses, have %v", out)
+	}
+	return out[0], out[1]
+}
+
+// serveOn serves h on ip and counts the requests it gets.
+func serveOn(t *testing.T, ip string, h http.Handler) (string, *atomic.Int64) {
+	ln, err := net.Listen("tcp", net.JoinHostPort(ip, "0"))
+	if err != nil {
+		t.Skipf("listen on %s: %v", ip, err)
+	}
+	var hits atomic.Int64
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		h.ServeHTTP(w, r)
+	}))
+	ts.Listener.Close()
+	ts.Listener = ln
+	ts.Start()
+	t.Cleanup(ts.Close)
+	return ln.Addr().String(), &hits
+}
+
+// In lan-only mode a replicate to a peer outside the local subnets never
+// leaves the node, while the keysaver on the same address is reached.
+func TestEgressLANOnlyReplicateAndKeysaver(t *testing.T) {
+	ksIP, peerIP := lanIPs(t)
+	f := &fakeKeysaver{keys: map[string]string{}}
+	ksAddr, ksHits := serveOn(t, ksIP, http.HandlerFunc(f.serve))
+
+	run := func(mode string) (*Server, string, *atomic.Int64) {
+		cfg := defaultConfig()
+		cfg.EgressMode = mode
+		cfg.KeySaverURL = "http://" + ksAddr
+		a := newTestServer(t, "a-"+mode, cfg)
+		fakeNets(a.egress, "198.18.0.0/15") // both addresses are off every subnet the node sees
+		b := newTestServer(t, "b-"+mode, nil)
+		peerAddr, peerHits := serveOn(t, peerIP, b.PublicHandler())
+		p := PeerInfo{NodeID: b.id.NodeID, Addr: peerAddr, APIVersion: 1}
+		a.peers.Upsert(p)
+		a.replicateTo(p, sha256Hex([]byte("chunk")), []byte(`{"msgid":"m"}`), nil)
+		return a, peerAddr, peerHits
+	}
+
+	a, peerAddr, peerHits := run(egressLANOnly)
+	if n := peerHits.Load(); n != 0 {
+		t.Fatalf("lan-only: the peer got %d requests", n)
+	}
+	st := a.egress.status()
+	if st.Blocked["peer"] == 0 || len(st.Recent) == 0 || st.Recent[0].Dest != peerAddr || st.Recent[0].Reason != "outside the local subnets" {
+		t.Fatalf("refusal not recorded: %+v", st)
+	}
+	var status StatusResponse
+	if err := json.Unmarshal(callControl(a, http.MethodGet, "/status", a.ctlToken, nil).Body.Bytes(), &status); err != nil ||
+		status.Egress == nil || status.Egress.Mode != egressLANOnly || status.Egress.Blocked["peer"] != st.Blocked["peer"] {
+		t.Fatalf("/status egress: %v %+v", err, status.Egress)
+	}
+	if _, err := a.keysaverClient(a.keysavers.order()[0]).Health(t.Context()); err != nil {
+		t.Fatalf("keysaver on the allowlist: %v", err)
+	}
+	if ksHits.Load() == 0 {
+		t.Fatal("keysaver never reached")
+	}
+	if m := scrape(t, a); !strings.Contains(m, `egress_blocked_total{subsystem="peer"}`) {
+		t.Fatalf("/metrics: %s", m)
+	}
+
+	if _, _, peerHits := run(egressOpen); peerHits.Load() == 0 {
+		t.Fatal("open: the replicate never reached the peer")
+	}
+}
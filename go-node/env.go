@@ -4,7 +4,6 @@ package main
 
 import (
 	"crypto/rand"
-	"encoding/base64"
 	"fmt"
 	"log"
 	"os"
@@ -14,15 +13,19 @@ import (
 
 // Secrets stored inside env.enc
 
-func initStorageEnv() (*EnvPaths, error) {
-	home, err := os.UserHomeDir()
-	if err != nil {
-		return nil, fmt.Errorf("cannot find home dir: %v", err)
+// initStorageEnv prepares base ("" = defaultDataDir) for storage.
+func initStorageEnv(base string) (*EnvPaths, error) {
+	if base == "" {
+		var err error
+		if base, err = defaultDataDir(); err != nil {
+			return nil, err
+		}
 	}
-	base := filepath.Join(home, ".mixnets")
-	chunks := filepath.Join(base, "chunks")
-	if err := os.MkdirAll(chunks, 0o700); err != nil {
-		return nil, fmt.Errorf("cannot create mixnets dirs: %v", err)
+	chunks, tmp := filepath.Join(base, "chunks"), filepath.Join(base, "tmp")
+	for _, d := range []string{chunks, tmp} {
+		if err := os.MkdirAll(d, 0o700); err != nil {
+			return nil, fmt.Errorf("cannot create mixnets dirs: %v", err)
+		}
 	}
 	p := &EnvPaths{
 		BaseDir:   base,
@@ -31,12 +34,16 @@ func initStorageEnv() (*EnvPaths, error) {
 		ChunksDir: chunks,
 		KeyPath:   filepath.Join(base, "key.pem"),
 		EnvEnc:    filepath.Join(base, "env.enc"),
+		StoreDir:  filepath.Join(base, "storage"),
+		TmpDir:    tmp,
 	}
 	log.Printf("[env] using %s for mixnets storage (%s)", base, runtime.GOOS)
 	return p, nil
 }
 
-func createEnvSecrets(paths *EnvPaths, pass []byte) (*EnvSecrets, error) {
+// createEnvSecrets generates fresh keys; orgID may be empty, in which case
+// the OrgID is derived from the BeaconKey (and not stored).
+func createEnvSecrets(paths *EnvPaths, pass []byte, orgID string) (*EnvSecrets, error) {
 	var s EnvSecrets
 	if _, err := rand.Read(s.BeaconKey[:]); err != nil {
 		return nil, err
@@ -44,11 +51,13 @@ func createEnvSecrets(paths *EnvPaths, pass []byte) (*EnvSecrets, error) {
 	if _, err := rand.Read(s.FileKey[:]); err != nil {
 		return nil, err
 	}
-	s.BeaconKeyB64 = base64.RawURLEncoding.EncodeToString(s.BeaconKey[:])
-	s.FileKeyB64 = base64.RawURLEncoding.EncodeToString(s.FileKey[:])
+	s.OrgID = orgID
 	if err := sealEnvSecrets(paths.EnvEnc, pass, &s); err != nil {
 		return nil, err
 	}
+	if s.OrgID == "" {
+		s.OrgID = deriveOrgID(s.BeaconKey)
+	}
 	return &s, nil
 }
 
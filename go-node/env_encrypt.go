@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/binary"
@@ -13,32 +14,50 @@ import (
 	"golang.org/x/crypto/chacha20poly1305"
 )
 
-var envMagic = []byte("MENV1") // file header for env.enc
+// env.enc versions. v1 files don't record the Argon2id parameters, so
+// they are always the constants below; v2 files carry them in the header,
+// which is authenticated with the ciphertext.
+var (
+	envMagic   = []byte("MENV1")
+	envMagicV2 = []byte("MENV2")
+)
+
+// Argon2id parameters for new env.enc files; v1 files are always opened
+// with them
+const (
+	kdfTime      = 2
+	kdfMemoryKiB = 64 * 1024
+	kdfThreads   = 1
+	kdfKeyLen    = 32
+
+	envHeaderV2 = 5 + 4 + 4 + 1 + 16 + chacha20poly1305.NonceSizeX + 4
+)
 
 // kdf derives a 32B key from passphrase and salt using Argon2id.
-// m=64 MiB, t=2, p=1 (tune if needed).
 func kdf(pass []byte, salt []byte) []byte {
-	return argon2.IDKey(pass, salt, 2, 64*1024, 1, 32)
+	return kdfWith(pass, salt, kdfTime, kdfMemoryKiB, kdfThreads)
+}
+
+func kdfWith(pass, salt []byte, time, memKiB uint32, threads uint8) []byte {
+	defer hKDF.time()()
+	return argon2.IDKey(pass, salt, time, memKiB, threads, kdfKeyLen)
 }
 
-// sealEnvSecrets encrypts EnvSecrets JSON into env.enc: MAGIC|salt|nonce|ct.
+// sealEnvSecrets encrypts EnvSecrets JSON into a v2 env.enc:
+// MAGIC|t|m|p|salt|nonce|len|ct, the header being the AEAD's extra data.
 func sealEnvSecrets(path string, pass []byte, sec *EnvSecrets) error {
-	plain, err := json.Marshal(struct {
-		BeaconKeyB64 string `json:"beacon_key_b64"`
-		FileKeyB64   string `json:"file_key_b64"`
-	}{
-		BeaconKeyB64: sec.BeaconKeyB64,
-		FileKeyB64:   sec.FileKeyB64,
-	})
+	plain, err := envPlain(sec)
 	if err != nil {
 		return err
 	}
+	defer wipeBytes(plain)
 	salt := make([]byte, 16)
 	if _, err := rand.Read(salt); err != nil {
 		return err
 	}
 	key := kdf(pass, salt)
 	aead, err := chacha20poly1305.NewX(key)
+	wipeBytes(key)
 	if err != nil {
 		return err
 	}
@@ -46,73 +65,129 @@ func sealEnvSecrets(path string, pass []byte, sec *EnvSecrets) error {
 	if _, err := rand.Read(nonce); err != nil {
 		return err
 	}
-	ct := aead.Seal(nil, nonce, plain, nil)
-
-	out := make([]byte, 0, len(envMagic)+16+len(nonce)+len(ct)+4)
-	out = append(out, envMagic...)
+	out := make([]byte, 0, envHeaderV2+len(plain)+aead.Overhead())
+	out = append(out, envMagicV2...)
+	out = binary.BigEndian.AppendUint32(out, kdfTime)
+	out = binary.BigEndian.AppendUint32(out, kdfMemoryKiB)
+	out = append(out, kdfThreads)
 	out = append(out, salt...)
 	out = append(out, nonce...)
-	// optional plaintext length prefix for future; not required, but harmless
-	var lbuf [4]byte
-	binary.BigEndian.PutUint32(lbuf[:], uint32(len(plain)))
-	out = append(out, lbuf[:]...)
-	out = append(out, ct...)
+	out = binary.BigEndian.AppendUint32(out, uint32(len(plain)))
+	out = aead.Seal(out, nonce, plain, out)
+	return writeFileAtomic(path, out)
+}
 
-	return os.WriteFile(path, out, 0600)
+// envFileVersion reports whether env.enc at path is v1 or v2.
+func envFileVersion(path string) (int, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case bytes.HasPrefix(b, envMagic):
+		return 1, nil
+	case bytes.HasPrefix(b, envMagicV2):
+		return 2, nil
+	}
+	return 0, errors.New("bad env.enc magic")
 }
 
-// openEnvSecrets decrypts env.enc using passphrase and fills sec.
+// openEnvSecrets decrypts env.enc (v1 or v2) using passphrase and fills sec.
 func openEnvSecrets(path string, pass []byte) (*EnvSecrets, error) {
 	b, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
-	min := len(envMagic) + 16 + chacha20poly1305.NonceSizeX + 4
-	if len(b) < min {
-		return nil, errors.New("env.enc too short")
-	}
-	if string(b[:len(envMagic)]) != string(envMagic) {
+	var (
+		salt, nonce, ct, ad []byte
+		key                 []byte
+	)
+	switch {
+	case bytes.HasPrefix(b, envMagicV2):
+		if len(b) < envHeaderV2 {
+			return nil, errors.New("env.enc too short")
+		}
+		off := len(envMagicV2)
+		t := binary.BigEndian.Uint32(b[off:])
+		m := binary.BigEndian.Uint32(b[off+4:])
+		p := b[off+8]
+		if t < 1 || t > 64 || m < 8*1024 || m > 4*1024*1024 || p < 1 {
+			return nil, fmt.Errorf("env.enc: implausible argon2id parameters t=%d m=%dKiB p=%d", t, m, p)
+		}
+		off += 9
+		salt, nonce = b[off:off+16], b[off+16:off+16+chacha20poly1305.NonceSizeX]
+		ad, ct = b[:envHeaderV2], b[envHeaderV2:]
+		key = kdfWith(pass, salt, t, m, p)
+	case bytes.HasPrefix(b, envMagic):
+		min := len(envMagic) + 16 + chacha20poly1305.NonceSizeX + 4
+		if len(b) < min {
+			return nil, errors.New("env.enc too short")
+		}
+		offset := len(envMagic)
+		salt = b[offset : offset+16]
+		offset += 16
+		nonce = b[offset : offset+chacha20poly1305.NonceSizeX]
+		offset += chacha20poly1305.NonceSizeX
+		// skip len (4 bytes)
+		offset += 4
+		ct = b[offset:]
+		key = kdf(pass, salt)
+	default:
 		return nil, errors.New("bad env.enc magic")
 	}
-	offset := len(envMagic)
-	salt := b[offset : offset+16]
-	offset += 16
-	nonce := b[offset : offset+chacha20poly1305.NonceSizeX]
-	offset += chacha20poly1305.NonceSizeX
-	// skip len (4 bytes)
-	offset += 4
-	ct := b[offset:]
-
-	key := kdf(pass, salt)
 	aead, err := chacha20poly1305.NewX(key)
+	wipeBytes(key)
 	if err != nil {
 		return nil, err
 	}
-	plain, err := aead.Open(nil, nonce, ct, nil)
+	plain, err := aead.Open(nil, nonce, ct, ad)
 	if err != nil {
 		return nil, errors.New("env.enc decrypt failed (wrong pass?)")
 	}
+	defer wipeBytes(plain)
 	var tmp struct {
-		BeaconKeyB64 string `json:"beacon_key_b64"`
-		FileKeyB64   string `json:"file_key_b64"`
+		BeaconKey *envKey `json:"beacon_key_b64"`
+		FileKey   *envKey `json:"file_key_b64"`
+		OrgID     string  `json:"org_id,omitempty"`
+		ProxyUser string  `json:"proxy_user,omitempty"`
+		ProxyPass string  `json:"proxy_pass,omitempty"`
 	}
+	sec := &EnvSecrets{}
+	tmp.BeaconKey, tmp.FileKey = (*envKey)(&sec.BeaconKey), (*envKey)(&sec.FileKey)
 	if err := json.Unmarshal(plain, &tmp); err != nil {
-		return nil, err
-	}
-	sec := &EnvSecrets{
-		BeaconKeyB64: tmp.BeaconKeyB64,
-		FileKeyB64:   tmp.FileKeyB64,
+		return nil, fmt.Errorf("invalid env.enc: %v", err)
 	}
-	// decode into fixed arrays
-	if dec, err := base64.RawURLEncoding.DecodeString(sec.BeaconKeyB64); err == nil && len(dec) == 32 {
-		copy(sec.BeaconKey[:], dec)
-	} else {
-		return nil, fmt.Errorf("invalid beacon key in env.enc")
+	if sec.BeaconKey == ([32]byte{}) || sec.FileKey == ([32]byte{}) {
+		return nil, errors.New("env.enc is missing a key")
 	}
-	if dec, err := base64.RawURLEncoding.DecodeString(sec.FileKeyB64); err == nil && len(dec) == 32 {
-		copy(sec.FileKey[:], dec)
-	} else {
-		return nil, fmt.Errorf("invalid file key in env.enc")
+	sec.OrgID, sec.ProxyUser, sec.ProxyPass = tmp.OrgID, tmp.ProxyUser, tmp.ProxyPass
+	if sec.OrgID == "" {
+		sec.OrgID = deriveOrgID(sec.BeaconKey)
 	}
 	return sec, nil
 }
+
+// envPlain renders sec as the env.enc JSON. The keys are encoded straight
+// into the returned buffer, which the caller wipes, rather than through
+// strings that would outlive it.
+func envPlain(sec *EnvSecrets) ([]byte, error) {
+	rest, err := json.Marshal(struct {
+		OrgID     string `json:"org_id,omitempty"`
+		ProxyUser string `json:"proxy_user,omitempty"`
+		ProxyPass string `json:"proxy_pass,omitempty"`
+	}{sec.OrgID, sec.ProxyUser, sec.ProxyPass})
+	if err != nil {
+		return nil, err
+	}
+	enc := base64.RawURLEncoding
+	out := make([]byte, 0, 64+2*enc.EncodedLen(32)+len(rest))
+	out = append(out, `{"beacon_key_b64":"`...)
+	out = enc.AppendEncode(out, sec.BeaconKey[:])
+	out = append(out, `","file_key_b64":"`...)
+	out = enc.AppendEncode(out, sec.FileKey[:])
+	out = append(out, '"')
+	if len(rest) > 2 {
+		out = append(out, ',')
+	}
+	return append(out, rest[1:]...), nil
+}
@@ -0,0 +1,510 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"keysaver-server/keysaverclient"
+)
+
+func init() { registerFeature(featureKeysaver) }
+
+// Escrow receipts. POST /filekeys/escrow?hash=H saves the local key of
+// block H to the keysaver. Once the keysaver took it, the node appends an
+// escrow receipt to its chain: a block of kind "escrow-receipt" naming H,
+// the hash of the keysaver URL, the time and the keysaver's confirmation,
+// signed with the node's receipt key (receipt.key, Ed25519). The block hash
+// is the digest of the signed receipt. Receipts carry no key material and
+// have no chunk; they replicate like data blocks, and a peer checks the
+// signature and the digest before it appends one. GET /escrow/audit
+// matches a node's receipts against what the keysaver lists for it.
+
+const (
+	blockEscrowReceipt = "escrow-receipt"
+	receiptKeyFile     = "receipt.key"
+	keysaverTokenEnv   = "MIXNETS_KEYSAVER_TOKEN"
+
+	// audit outcomes per receipt (or keysaver record)
+	auditOK           = "ok"
+	auditBadSignature = "bad_signature"
+	auditOtherSaver   = "other_keysaver" // receipt names a keysaver we don't talk to
+	auditMissing      = "missing"        // keysaver has no key for the block
+	auditRevoked      = "revoked"
+	auditMismatch     = "confirmation_mismatch" // key replaced since the receipt
+	auditNoReceipt    = "no_receipt"            // keysaver holds a key no receipt covers
+	auditKeyMismatch  = "key_mismatch"          // our local key doesn't open the chunk
+)
+
+// escrowReceipt is the payload of a receipt block.
+type escrowReceipt struct {
+	Block        string `json:"block"`    // data block whose key was escrowed
+	Keysaver     string `json:"keysaver"` // sha256 of the keysaver base URL
+	At           int64  `json:"at_unix"`
+	Confirmation string `json:"confirmation"` // from the keysaver's /keys/save
+	Signer       string `json:"signer"`       // Ed25519 public key, base64
+	Sig          string `json:"sig"`
+}
+
+func (rc *escrowReceipt) body(origin string) []byte {
+	return fmt.Appendf(nil, "%s|%s|%s|%s|%d|%s|%s", blockEscrowReceipt, origin, rc.Block, rc.Keysaver, rc.At, rc.Confirmation, rc.Signer)
+}
+
+// digest is the receipt block's hash; it covers the signature too.
+func (rc *escrowReceipt) digest(origin string) string {
+	return sha256Hex(append(rc.body(origin), rc.Sig...))
+}
+
+func (b Block) isReceipt() bool { return b.Kind == blockEscrowReceipt }
+
+// verifyReceipt checks a receipt block: signature by its signer over its
+// origin and payload, and the block hash.
+func verifyReceipt(b Block) error {
+	rc := b.Receipt
+	if rc == nil || !b.isReceipt() {
+		return errors.New("not an escrow receipt")
+	}
+	if err := verifySig(rc.Signer, rc.Sig, rc.body(b.OriginID)); err != nil {
+		return err
+	}
+	if b.Hash != rc.digest(b.OriginID) {
+		return errors.New("block hash is not the receipt digest")
+	}
+	return nil
+}
+
+// receiptKey loads the node's receipt signing key, creating it on first
+// use. It stays the same across NodeID changes so auditors can pin it.
+func receiptKey(paths *EnvPaths) (ed25519.PrivateKey, error) {
+	fp := filepath.Join(paths.BaseDir, receiptKeyFile)
+	if b, err := os.ReadFile(fp); err == nil {
+		seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("%s: bad key", fp)
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(fp, []byte(base64.StdEncoding.EncodeToString(priv.Seed()))); err != nil {
+		return nil, err
+	}
+	log.Printf("[escrow] created receipt signing key %s", fp)
+	return priv, nil
+}
+
+// escrowKey saves the key of data block b to the keysaver and returns the
+// keysaver's confirmation and the endpoint that gave it. A key that doesn't
+// open the local chunk is never sent (errKeyMismatch).
+func (s *Server) escrowKey(b Block) (string, *keysaverEndpoint, error) {
+	k, err := findFileKey(s.paths, b.Hash, b.Name)
+	if err != nil {
+		return "", nil, fmt.Errorf("no local key: %w", err)
+	}
+	defer wipeBytes(k[:])
+	verified := true
+	switch err := s.verifyFileKey(b.Hash, b.Name, k); {
+	case errors.Is(err, errNoChunk):
+		verified = false
+	case errors.Is(err, errKeyMismatch):
+		return "", nil, fmt.Errorf("%w; re-send the file", err)
+	case err != nil:
+		return "", nil, fmt.Errorf("verify key: %w", err)
+	}
+	req := keysaverclient.SaveKeyRequest{
+		FileHash: b.Hash,
+		KeyB64:   base64.StdEncoding.EncodeToString(k[:]),
+		NodeID:   s.id.NodeID,
+		FileName: b.Name,
+		OrgID:    s.org.ID,
+		Verified: verified,
+	}
+	out, ep, err := keysaverRequest(s, "save", b.Hash, func(c *keysaverclient.Client) (*keysaverclient.SaveKeyResponse, error) {
+		return c.SaveKey(context.Background(), req)
+	})
+	switch {
+	case ep == nil:
+		return "", nil, err
+	case err != nil:
+		return "", nil, fmt.Errorf("keysaver %s: %w", ep.URL, err)
+	case out.Status != "ok":
+		return "", nil, fmt.Errorf("keysaver %s: %s %s", ep.URL, out.Status, out.Message)
+	}
+	if out.Confirmation == "" {
+		return "", nil, fmt.Errorf("keysaver %s gave no confirmation (too old for receipts?)", ep.URL)
+	}
+	dir := filepath.Join(s.paths.BaseDir, "keys")
+	if meta, ok := readFileKeyMeta(dir, b.Hash); ok && !meta.Escrowed {
+		meta.Escrowed = true
+		mb, _ := json.Marshal(meta)
+		if err := writeFileAtomic(filepath.Join(dir, fileKeyMetaName(b.Hash)), mb); err != nil {
+			log.Printf("[escrow] %s: mark escrowed: %v", b.Hash, err)
+		}
+	}
+	return out.Confirmation, ep, nil
+}
+
+// appendReceipt signs a receipt for data block hash, confirmed by the
+// keysaver with ID saver, appends it to the chain and returns the block and
+// its envelope.
+func (s *Server) appendReceipt(hash, saver, confirmation string) (Block, ReplicateEnvelope, error) {
+	priv, err := receiptKey(s.paths)
+	if err != nil {
+		return Block{}, ReplicateEnvelope{}, err
+	}
+	rc := &escrowReceipt{
+		Block:        hash,
+		Keysaver:     saver,
+		At:           time.Now().Unix(),
+		Confirmation: confirmation,
+		Signer:       base64.StdEncoding.EncodeToString(priv.Public().(ed25519.PublicKey)),
+	}
+	rc.Sig = base64.StdEncoding.EncodeToString(ed25519.Sign(priv, rc.body(s.id.NodeID)))
+	msgidBytes, err := secureRandom(16)
+	if err != nil {
+		return Block{}, ReplicateEnvelope{}, err
+	}
+	env := ReplicateEnvelope{
+		MsgID:    base64.RawURLEncoding.EncodeToString(msgidBytes),
+		OriginID: s.id.NodeID,
+		HashHex:  rc.digest(s.id.NodeID),
+		PrevHash: s.getChainTip(),
+		OrgID:    s.org.ID,
+		Created:  rc.At,
+		Logical:  s.lamport.tick(),
+		Kind:     blockEscrowReceipt,
+		Receipt:  rc,
+	}
+	blk := Block{
+		Hash:     env.HashHex,
+		PrevHash: env.PrevHash,
+		Created:  env.Created,
+		OriginID: env.OriginID,
+		Logical:  env.Logical,
+		Kind:     env.Kind,
+		Receipt:  rc,
+	}
+	if err := s.appendBlock(blk); err != nil {
+		return Block{}, ReplicateEnvelope{}, err
+	}
+	s.seenMu.Lock()
+	s.seen[env.MsgID] = struct{}{}
+	s.seenMu.Unlock()
+	return blk, env, nil
+}
+
+// POST /filekeys/escrow?hash=<sha256>[&queue=true] (control, token): save
+// the block's key to the keysaver and record an escrow receipt in the chain.
+// With queue=true a keysaver failure queues the escrow (escrow_queue.go)
+// and answers 202.
+func (s *Server) handleFileKeyEscrow(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	b, err := s.blockFor(r.URL.Query().Get("hash"))
+	if err != nil || !b.isData() {
+		http.Error(w, "no data block with that hash", http.StatusNotFound)
+		return
+	}
+	conf, ep, err := s.escrowKey(b)
+	if err != nil {
+		log.Printf("[escrow] %s: %v", b.Hash, err)
+		if r.URL.Query().Get("queue") == "true" && escrowRetryable(err) {
+			off, _, qerr := s.escrowQ.add(escrowJob{Hash: b.Hash, Queued: time.Now().Unix()})
+			if qerr == nil {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusAccepted)
+				json.NewEncoder(w).Encode(map[string]any{"status": "queued", "hash": b.Hash, "offset": off, "reason": err.Error()})
+				return
+			}
+			log.Printf("[escrow] %s: can't queue: %v", b.Hash, qerr)
+		}
+		msg, status := "escrow: "+err.Error(), http.StatusBadGateway
+		switch {
+		case errors.Is(err, errKeyMismatch):
+			status = http.StatusConflict
+		case !errors.Is(err, errNoKeysaver):
+			if diag := s.diagnoseKeysavers(); diag != "" {
+				log.Printf("[escrow] keysaver health: %s", diag)
+				msg += "; keysaver health: " + diag
+			}
+		}
+		http.Error(w, msg, status)
+		return
+	}
+	out, err := s.recordEscrow(b, conf, ep)
+	if err != nil {
+		http.Error(w, "key escrowed, receipt not recorded: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, out)
+}
+
+// recordEscrow appends the receipt for an escrow of block b that ep
+// confirmed with conf, fans it out and returns the escrow's summary. A
+// repeated escrow to the same keysaver, key unchanged, has its receipt.
+func (s *Server) recordEscrow(b Block, conf string, ep *keysaverEndpoint) (map[string]any, error) {
+	if rb, ok := s.findReceipt(b.Hash, ep.ID, conf); ok {
+		return map[string]any{"status": "escrowed", "hash": b.Hash, "receipt": rb.Hash, "keysaver": ep.URL, "existing": true}, nil
+	}
+	rb, env, err := s.appendReceipt(b.Hash, ep.ID, conf)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("[audit] key for %s escrowed to %s; receipt %s", b.Hash, ep.URL, rb.Hash)
+	peers := s.rankPeers(s.peers.List())
+	envBytes, _ := json.Marshal(env)
+	t := s.transfers.start(transferSend, env.MsgID, blockEscrowReceipt, rb.Hash)
+	res := s.fanoutWithQuorum(t, peers, envBytes, nil, s.cfg.ReplicateQuorum)
+	return map[string]any{
+		"status":   "escrowed",
+		"hash":     b.Hash,
+		"receipt":  rb.Hash,
+		"keysaver": ep.URL,
+		"fanout":   res,
+	}, nil
+}
+
+// findReceipt returns our receipt for block hash from keysaver saver with
+// confirmation conf, if the chain has one.
+func (s *Server) findReceipt(hash, saver, conf string) (Block, bool) {
+	for _, b := range s.readChain() {
+		if rc := b.Receipt; b.isReceipt() && b.OriginID == s.id.NodeID && rc != nil &&
+			rc.Block == hash && rc.Keysaver == saver && rc.Confirmation == conf {
+			return b, true
+		}
+	}
+	return Block{}, false
+}
+
+// ---- audit ----
+
+type escrowAuditItem struct {
+	Block     string     `json:"block"`
+	Receipt   string     `json:"receipt,omitempty"` // receipt block hash
+	At        int64      `json:"at_unix,omitempty"`
+	Signer    string     `json:"signer,omitempty"`
+	Status    string     `json:"status"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	Note      string     `json:"note,omitempty"`
+}
+
+type escrowAudit struct {
+	NodeID        string            `json:"node_id"`
+	Keysaver      string            `json:"keysaver"`  // primary: sha256 of the URL, as in receipts
+	Keysavers     []string          `json:"keysavers"` // every configured endpoint, in order
+	Receipts      int               `json:"receipts"`
+	Discrepancies int               `json:"discrepancies"`
+	Signers       []string          `json:"signers"` // more than one: the receipt key changed
+	Items         []escrowAuditItem `json:"items"`
+	Error         string            `json:"error,omitempty"` // keysaver unreachable: receipts checked locally only
+}
+
+// keysaverList is what endpoint ep holds for nodeID.
+func (s *Server) keysaverList(ep *keysaverEndpoint, nodeID string) (map[string]keysaverclient.FileKeyRecord, error) {
+	out, err := s.keysaverClient(ep).ListKeys(context.Background(), nodeID)
+	if err != nil {
+		err = fmt.Errorf("keysaver %s/keys/list: %w", ep.URL, err)
+	}
+	s.keysavers.mark(ep, err)
+	if err != nil {
+		s.keysavers.record(keysaverOp{Op: "list", Error: err.Error()})
+		return nil, err
+	}
+	s.keysavers.record(keysaverOp{Op: "list", Endpoint: ep.URL, Status: http.StatusOK})
+	m := make(map[string]keysaverclient.FileKeyRecord, len(out.Keys))
+	for _, k := range out.Keys {
+		m[k.FileHash] = k
+	}
+	return m, nil
+}
+
+// auditEscrow checks nodeID's receipts in the chain against the keysaver
+// each one names.
+func (s *Server) auditEscrow(nodeID string) escrowAudit {
+	rep := escrowAudit{NodeID: nodeID, Keysavers: s.keysavers.ids(), Signers: []string{}, Items: []escrowAuditItem{}}
+	if len(rep.Keysavers) > 0 {
+		rep.Keysaver = rep.Keysavers[0]
+	}
+	held := make(map[string]map[string]keysaverclient.FileKeyRecord) // endpoint ID -> hash -> record; absent if unreachable
+	var errs []error
+	if len(rep.Keysavers) == 0 {
+		errs = append(errs, errNoKeysaver)
+	}
+	for _, ep := range s.keysavers.order() {
+		m, err := s.keysaverList(ep, nodeID)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		held[ep.ID] = m
+	}
+	if err := errors.Join(errs...); err != nil {
+		rep.Error = err.Error()
+	}
+	data := make(map[string]bool)
+	names := make(map[string]string)
+	covered := make(map[string]bool)
+	// our own keys are checked against the chunk once per block
+	mismatch := make(map[string]bool)
+	own := nodeID == s.id.NodeID
+	localKeyBad := func(hash string) bool {
+		bad, done := mismatch[hash]
+		if !done {
+			bad = errors.Is(s.checkFileKey(hash, names[hash]), errKeyMismatch)
+			mismatch[hash] = bad
+		}
+		return bad
+	}
+	for _, b := range s.readChain() {
+		if b.OriginID != nodeID {
+			continue
+		}
+		if !b.isReceipt() {
+			data[b.Hash] = b.isData()
+			names[b.Hash] = b.Name
+			continue
+		}
+		rep.Receipts++
+		rc := b.Receipt
+		it := escrowAuditItem{Block: rc.Block, Receipt: b.Hash, At: rc.At, Signer: rc.Signer}
+		covered[rc.Block] = true
+		if !slices.Contains(rep.Signers, rc.Signer) {
+			rep.Signers = append(rep.Signers, rc.Signer)
+		}
+		list, reached := held[rc.Keysaver]
+		rec, ok := list[rc.Block]
+		switch {
+		case verifyReceipt(b) != nil:
+			it.Status = auditBadSignature
+		case own && localKeyBad(rc.Block):
+			it.Status, it.Note = auditKeyMismatch, "re-send the file"
+		case !slices.Contains(rep.Keysavers, rc.Keysaver):
+			it.Status = auditOtherSaver
+		case !reached:
+			continue // keysaver unreachable; nothing to compare
+		case !ok:
+			it.Status = auditMissing
+		case rec.RevokedAt != nil:
+			it.Status, it.RevokedAt = auditRevoked, rec.RevokedAt
+			if _, expired := s.retention.expired(rc.Block); expired {
+				it.Note = "expired by retention policy"
+			}
+		case rec.Confirmation != rc.Confirmation:
+			it.Status = auditMismatch
+		default:
+			it.Status = auditOK
+		}
+		rep.Items = append(rep.Items, it)
+	}
+	for _, id := range rep.Keysavers {
+		for hash, rec := range held[id] {
+			if data[hash] && !covered[hash] {
+				covered[hash] = true
+				rep.Items = append(rep.Items, escrowAuditItem{Block: hash, Status: auditNoReceipt, RevokedAt: rec.RevokedAt})
+			}
+		}
+	}
+	for _, it := range rep.Items {
+		if it.Status != auditOK && !(it.Status == auditRevoked && it.Note != "") {
+			rep.Discrepancies++
+		}
+	}
+	return rep
+}
+
+// GET /escrow/audit[?node_id=<id>] (control): the node's escrow receipts
+// (ours by default) checked against the keysaver.
+func (s *Server) handleEscrowAudit(w http.ResponseWriter, r *http.Request) {
+	nodeID, ok := s.nodeIDParam(w, "node_id", r.URL.Query().Get("node_id"))
+	if !ok {
+		return
+	}
+	if nodeID == "" {
+		nodeID = s.id.NodeID
+	}
+	writeJSON(w, s.auditEscrow(nodeID))
+}
+
+// replicateReceipt is /replicate for receipt envelopes: verify, append and
+// pass on. There is nothing to store besides the block.
+func (s *Server) replicateReceipt(w http.ResponseWriter, env ReplicateEnvelope, localTip string) {
+	blk := Block{
+		Hash:     env.HashHex,
+		PrevHash: env.PrevHash,
+		Created:  env.Created,
+		OriginID: env.OriginID,
+		Logical:  env.Logical,
+		Kind:     env.Kind,
+		Receipt:  env.Receipt,
+	}
+	if err := verifyReceipt(blk); err != nil {
+		http.Error(w, "bad receipt: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.replicateRecord(w, env, blk, localTip)
+}
+
+// replicateRecord appends a verified chunkless block (receipt, tombstone)
+// and passes its envelope on. It reports whether blk was new here.
+func (s *Server) replicateRecord(w http.ResponseWriter, env ReplicateEnvelope, blk Block, localTip string) bool {
+	if _, err := s.blockFor(env.HashHex); err == nil {
+		s.lamport.observe(env.Logical)
+		s.seenMu.Lock()
+		s.seen[env.MsgID] = struct{}{}
+		s.seenMu.Unlock()
+		writeJSON(w, map[string]any{"status": "already_have", "hash": env.HashHex, "tip": localTip})
+		return false
+	}
+	if env.PrevHash != localTip {
+		s.emit(eventReplicateChain, map[string]any{"msgid": env.MsgID, "origin": env.OriginID, "hash": env.HashHex, "prev": env.PrevHash, "tip": localTip})
+		http.Error(w, "chain mismatch: local tip "+localTip+" != prev "+env.PrevHash, http.StatusConflict)
+		return false
+	}
+	s.seenMu.Lock()
+	if _, ok := s.seen[env.MsgID]; ok {
+		s.seenMu.Unlock()
+		writeJSON(w, map[string]any{"status": "seen"})
+		return false
+	}
+	s.seen[env.MsgID] = struct{}{}
+	s.seenMu.Unlock()
+	s.lamport.observe(env.Logical)
+	if err := s.appendLinkedBlock(blk); err != nil {
+		s.seenMu.Lock()
+		delete(s.seen, env.MsgID)
+		s.seenMu.Unlock()
+		if errors.Is(err, errChainMoved) {
+			http.Error(w, "chain mismatch: "+err.Error(), http.StatusConflict)
+			return false
+		}
+		http.Error(w, "append block fail: "+err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	env.Hops++
+	envBytes, _ := json.Marshal(env)
+	sent := 0
+	for _, p := range s.rankPeers(s.peers.List()) {
+		if _, ok := s.replicateTo(p, env.HashHex, envBytes, nil); ok {
+			sent++
+		}
+	}
+	writeJSON(w, map[string]any{"status": "stored", "sent": sent, "hops": env.Hops, "tip": s.getChainTip()})
+	return true
+}
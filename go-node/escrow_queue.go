@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+
+	"p2pnode-R3/journal"
+)
+
+// Escrow queue. POST /filekeys/escrow?queue=true doesn't fail when the
+// keysaver can't take the key: the escrow is journaled (queues.go) and
+// retried until a keysaver confirms it, and then its receipt is appended and
+// fanned out as usual. A key that doesn't open its chunk, a key no longer
+// held locally and a block deleted meanwhile end the item without an escrow.
+
+type escrowJob struct {
+	Hash   string `json:"hash"`
+	Queued int64  `json:"queued_unix"`
+}
+
+func escrowJobKey(b []byte) string {
+	var it escrowJob
+	_ = json.Unmarshal(b, &it)
+	return it.Hash
+}
+
+// escrowRetryable says whether a later try of an escrow that failed with
+// err can succeed.
+func escrowRetryable(err error) bool {
+	return !errors.Is(err, errKeyMismatch) && !errors.Is(err, os.ErrNotExist)
+}
+
+// retryEscrow is the escrow queue's work function.
+func (s *Server) retryEscrow(r journal.Record) (bool, error) {
+	var it escrowJob
+	if err := json.Unmarshal(r.Data, &it); err != nil {
+		return true, nil
+	}
+	b, err := s.blockFor(it.Hash)
+	if _, gone := s.tombstoneFor(it.Hash); err != nil || gone {
+		log.Printf("[escrow] dropping queued escrow of %s: block gone", it.Hash)
+		return true, nil
+	}
+	conf, ep, err := s.escrowKey(b)
+	if err != nil {
+		if !escrowRetryable(err) {
+			log.Printf("[escrow] dropping queued escrow of %s: %v", it.Hash, err)
+			return true, nil
+		}
+		return false, err
+	}
+	if _, err := s.recordEscrow(b, conf, ep); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *Server) startEscrowQueueLoop(ctx context.Context) {
+	s.runQueue(ctx, s.escrowQ, s.retryEscrow)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+func init() { registerFeature(featureEvents) }
+
+// Live event stream. Everything emit() raises (the same events webhooks
+// get) is fanned out to GET /events subscribers as server-sent events, so
+// ctl events and the dashboard see changes without polling. A slow
+// subscriber misses events rather than holding up the node.
+
+const (
+	eventSubBuffer = 64
+	eventPingEvery = 15 * time.Second
+	eventMaxSubs   = 16
+)
+
+type eventHub struct {
+	mu   sync.Mutex
+	subs map[chan WebhookEvent]struct{}
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subs: make(map[chan WebhookEvent]struct{})}
+}
+
+// subscribe returns a channel of events and a func to drop it; ok is false
+// when the hub is full.
+func (h *eventHub) subscribe() (ch chan WebhookEvent, cancel func(), ok bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.subs) >= eventMaxSubs {
+		return nil, nil, false
+	}
+	ch = make(chan WebhookEvent, eventSubBuffer)
+	h.subs[ch] = struct{}{}
+	return ch, func() {
+		h.mu.Lock()
+		delete(h.subs, ch)
+		h.mu.Unlock()
+	}, true
+}
+
+// publish never blocks: a subscriber whose buffer is full misses ev.
+func (h *eventHub) publish(ev WebhookEvent) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// handleEvents streams events as text/event-stream until the client goes.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "GET only", http.StatusMethodNotAllowed)
+		return
+	}
+	fl, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	ch, cancel, ok := s.events.subscribe()
+	if !ok {
+		http.Error(w, "too many event subscribers", http.StatusServiceUnavailable)
+		return
+	}
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no")
+	fmt.Fprintf(w, ": %s\n\n", s.id.NodeID)
+	fl.Flush()
+
+	ping := time.NewTicker(eventPingEvery)
+	defer ping.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ping.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case ev := <-ch:
+			b, err := json.Marshal(ev)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, b)
+		}
+		fl.Flush()
+	}
+}
@@ -20,13 +20,34 @@ typedef struct {
 	int api_port;
 	int control_port;
 } P2PStatus;
+
+// P2PPassphraseFn writes the passphrase into buf (at most cap bytes, no
+// terminator needed) and returns its length, or <= 0 to refuse.
+typedef int (*P2PPassphraseFn)(void* ctx, char* buf, int cap);
+// P2PWipeFn tells the host to wipe its own copy of the passphrase.
+typedef void (*P2PWipeFn)(void* ctx);
+
+static inline int p2p_get_pass(P2PPassphraseFn fn, void* ctx, char* buf, int cap) {
+	return fn(ctx, buf, cap);
+}
+static inline void p2p_host_wipe(P2PWipeFn fn, void* ctx) {
+	if (fn) fn(ctx);
+}
+
+// P2PEventFn receives each node event as JSON, the body webhooks and
+// /events get; json is only valid during the call.
+typedef void (*P2PEventFn)(void* ctx, const char* json);
+
+static inline void p2p_event(P2PEventFn fn, void* ctx, const char* json) {
+	fn(ctx, json);
+}
 */
 import "C"
 import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
-	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
@@ -35,6 +56,8 @@ import (
 	"unsafe"
 )
 
+func init() { registerFeature(featureDLL) }
+
 // Global state for DLL mode
 var (
 	dllMu       sync.Mutex
@@ -50,10 +73,17 @@ var (
 	dllCfg      *Config
 	dllRunning  bool
 	dllPick     *ifacePick
+	dllLocked   bool     // keys locked in memory (see lockSecrets)
+	dllLogs     *logRing // tee of the standard logger, set up on first start
 
 	// HTTP servers
 	dllPublicSrv  *http.Server
 	dllControlSrv *http.Server
+
+	// Event callback (P2P_SetEventCallback)
+	dllEventFn   C.P2PEventFn
+	dllEventCtx  unsafe.Pointer
+	dllEventStop func()
 )
 
 // cString creates a C string from Go string (caller must free)
@@ -72,23 +102,68 @@ func goString(s *C.char) string {
 // P2P_Init initializes the p2p node with the given parameters.
 // Returns 0 on success, non-zero on error.
 // forceNewEnv: if 1, recreate env.enc even if it exists (like --new-net)
+// apiPort 0 picks an ephemeral port at P2P_Start; P2P_GetStatus reports it.
+// The data dir is MIXNETS_DATA_DIR, else ~/.mixnets.
+// The Go-side copy of envPass is wiped before returning; envPass itself is
+// the caller's to wipe. Prefer P2P_InitSecure.
 //
 //export P2P_Init
 func P2P_Init(envPass *C.char, apiPort C.int, controlPort C.int, mcGroup *C.char, mcPort C.int, keySaverUrl *C.char, forceNewEnv C.int) C.int {
 	dllMu.Lock()
 	defer dllMu.Unlock()
 
+	var pass []byte
+	if envPass != nil {
+		pass = C.GoBytes(unsafe.Pointer(envPass), C.int(C.strlen(envPass)))
+	}
+	defer wipeBytes(pass)
+	return dllInit(pass, apiPort, controlPort, mcGroup, mcPort, keySaverUrl, forceNewEnv)
+}
+
+// dllPassMax bounds the passphrase P2P_InitSecure accepts.
+const dllPassMax = 1024
+
+// P2P_InitSecure is P2P_Init with the passphrase supplied by a one-shot
+// callback: getPass fills a buffer owned by the DLL, the DLL copies it,
+// wipes and frees the buffer, then calls wipe(ctx) so the host can clear
+// its own copy (wipe may be NULL). The Go-side copy is locked in memory
+// and wiped once env.enc is open. Returns -2 if getPass refuses or
+// overflows the buffer; other codes as P2P_Init.
+//
+//export P2P_InitSecure
+func P2P_InitSecure(getPass C.P2PPassphraseFn, wipe C.P2PWipeFn, ctx unsafe.Pointer, apiPort C.int, controlPort C.int, mcGroup *C.char, mcPort C.int, keySaverUrl *C.char, forceNewEnv C.int) C.int {
+	dllMu.Lock()
+	defer dllMu.Unlock()
+
+	if getPass == nil {
+		log.Println("[dll] error: no passphrase callback")
+		return -2
+	}
+	buf := C.malloc(dllPassMax)
+	n := int(C.p2p_get_pass(getPass, ctx, (*C.char)(buf), dllPassMax))
+	pass, ok := takePassphrase(unsafe.Slice((*byte)(buf), dllPassMax), n)
+	C.free(buf)
+	C.p2p_host_wipe(wipe, ctx)
+	defer wipeBytes(pass)
+	if !ok {
+		log.Printf("[dll] error: passphrase over %d bytes", dllPassMax)
+		return -2
+	}
+	return dllInit(pass, apiPort, controlPort, mcGroup, mcPort, keySaverUrl, forceNewEnv)
+}
+
+// dllInit is the body of P2P_Init; dllMu is held. pass is wiped by the
+// caller.
+func dllInit(pass []byte, apiPort C.int, controlPort C.int, mcGroup *C.char, mcPort C.int, keySaverUrl *C.char, forceNewEnv C.int) C.int {
 	if dllRunning {
 		log.Println("[dll] already initialized")
 		return -1
 	}
 
-	passphrase := goString(envPass)
-	if passphrase == "" {
+	if len(pass) == 0 {
 		log.Println("[dll] error: empty passphrase")
 		return -2
 	}
-
 	// Build config
 	dllCfg = defaultConfig()
 	dllCfg.APIPort = int(apiPort)
@@ -99,14 +174,21 @@ func P2P_Init(envPass *C.char, apiPort C.int, controlPort C.int, mcGroup *C.char
 	if mcPort > 0 {
 		dllCfg.MCPort = int(mcPort)
 	}
+	if keySaverUrl != nil {
+		dllCfg.KeySaverURL = goString(keySaverUrl)
+	}
 
 	// Initialize storage environment
 	var err error
-	dllPaths, err = initStorageEnv()
+	dllPaths, err = initStorageEnv("")
 	if err != nil {
 		log.Printf("[dll] env init fail: %v", err)
 		return -3
 	}
+	if err := lockDataDir(dllPaths); err != nil {
+		log.Printf("[dll] %v", err)
+		return -7
+	}
 
 	// Handle env.enc: load existing or create new
 	envExists := false
@@ -116,9 +198,9 @@ func P2P_Init(envPass *C.char, apiPort C.int, controlPort C.int, mcGroup *C.char
 
 	if envExists && forceNewEnv == 0 {
 		// Try to load existing env.enc
-		dllSecrets, err = loadEnvSecrets(dllPaths, []byte(passphrase))
+		dllSecrets, err = loadEnvSecrets(dllPaths, pass)
 		if err != nil {
-			log.Printf("[dll] env.enc load failed (wrong passphrase?): %v", err)
+			log.Printf("[dll] env.enc load failed: %v", err)
 			log.Printf("[dll] TIP: Set forceNewEnv=1 to recreate with new passphrase")
 
 			// Auto-backup and recreate if load fails
@@ -126,12 +208,12 @@ func P2P_Init(envPass *C.char, apiPort C.int, controlPort C.int, mcGroup *C.char
 			if errRename := os.Rename(dllPaths.EnvEnc, backupPath); errRename == nil {
 				log.Printf("[dll] backed up old env.enc to %s", backupPath)
 				// Create new with provided passphrase
-				dllSecrets, err = createEnvSecrets(dllPaths, []byte(passphrase))
+				dllSecrets, err = createEnvSecrets(dllPaths, pass, "")
 				if err != nil {
 					log.Printf("[dll] env.enc create fail: %v", err)
 					return -5
 				}
-				log.Printf("[dll] created new env.enc with provided passphrase")
+				log.Printf("[dll] created new env.enc")
 			} else {
 				log.Printf("[dll] failed to backup env.enc: %v", errRename)
 				return -4
@@ -145,7 +227,7 @@ func P2P_Init(envPass *C.char, apiPort C.int, controlPort C.int, mcGroup *C.char
 			_ = os.Rename(dllPaths.EnvEnc, backupPath)
 			log.Printf("[dll] backed up existing env.enc to %s", backupPath)
 		}
-		dllSecrets, err = createEnvSecrets(dllPaths, []byte(passphrase))
+		dllSecrets, err = createEnvSecrets(dllPaths, pass, "")
 		if err != nil {
 			log.Printf("[dll] env.enc create fail: %v", err)
 			return -5
@@ -153,8 +235,12 @@ func P2P_Init(envPass *C.char, apiPort C.int, controlPort C.int, mcGroup *C.char
 		log.Printf("[dll] created new env.enc")
 	}
 
+	if dllLocked = lockSecrets(dllSecrets); !dllLocked {
+		log.Printf("[dll] could not lock keys in memory; they may reach swap")
+	}
+
 	// Build identity and keypair
-	dllID = buildNodeIdentity()
+	dllID = loadNodeIdentity(dllPaths)
 	dllNodeKeys, err = newNodeKeypair()
 	if err != nil {
 		log.Printf("[dll] keypair fail: %v", err)
@@ -190,65 +276,155 @@ func P2P_Start() C.int {
 		return -3
 	}
 
+	// Bind first: an ephemeral API port must be known before beacons go out
+	bindIP := dllCfg.BindIP
+	if bindIP == "" {
+		bindIP = dllPick.IPStr
+	}
+	lns, err := bindListeners(dllCfg, bindIP)
+	if err != nil {
+		log.Printf("[dll] listen fail: %v", err)
+		return -6
+	}
+	writeNodeLock(dllPaths, dllCfg, dllID.NodeID)
+
 	// Peer store and DHT
 	dllPeers = newPeerStore()
 	dllDHT = newSimpleDHT(dllID.NodeID)
 
 	// Load saved peers
 	loadPeersOnStart(dllPeers, dllPaths.PeersEnc, dllSecrets.FileKey[:])
-	go startAutoSavePeersLoop(dllCtx, dllPeers, dllPaths.PeersEnc, dllSecrets.FileKey[:])
+
+	// Create server
+	dllServer = newServer(dllCfg, dllID, dllPeers, dllDHT, dllNodeKeys, dllPaths, dllSecrets)
+	if dllLogs == nil {
+		dllLogs = newLogRing(logRingLines)
+		log.SetOutput(io.MultiWriter(log.Writer(), dllLogs))
+	}
+	dllServer.logs = dllLogs
+	dllServer.selfAddr = advertisedAddr(bindIP, dllPick.IPStr, dllCfg.APIPort)
+	dllServer.health.goSafe("peers-autosave", func() {
+		startAutoSavePeersLoop(dllCtx, dllPeers, dllPaths.PeersEnc, dllSecrets.FileKey[:], dllServer.maint)
+	})
+	dllServer.health.goSafe("addr-probe", func() { dllServer.startAddrProbeLoop(dllCtx) })
+	dllServer.health.goSafe("disk-watch", func() { dllServer.startDiskWatchLoop(dllCtx) })
+	dllServer.health.goSafe("scrub", func() { dllServer.startScrubLoop(dllCtx) })
+	dllServer.health.goSafe("webhooks", func() { dllServer.startWebhookLoop(dllCtx) })
+	dllServer.health.goSafe("peer-caps", func() { dllServer.startCapsRefreshLoop(dllCtx) })
+	dllServer.health.goSafe("key-backfill", func() { dllServer.startKeyBackfillLoop(dllCtx) })
+	dllServer.health.goSafe("rtt-probe", func() { dllServer.startRTTProbeLoop(dllCtx) })
+	dllServer.health.goSafe("kv-reconcile", func() { dllServer.startKVReconcileLoop(dllCtx) })
+	dllServer.health.goSafe("relay-spill", func() { dllServer.startRelaySpillSweepLoop(dllCtx) })
+	dllServer.health.goSafe("catalog", func() { dllServer.startCatalogLoop(dllCtx) })
+	dllServer.health.goSafe("outbox", func() { dllServer.startOutboxLoop(dllCtx) })
+	dllServer.health.goSafe("replicate-retry", func() { dllServer.startReplicateRetryLoop(dllCtx) })
+	dllServer.health.goSafe("escrow-queue", func() { dllServer.startEscrowQueueLoop(dllCtx) })
+	dllServer.health.goSafe("peer-lifecycle", func() { dllServer.startPeerLifecycleLoop(dllCtx) })
+	dllServer.health.goSafe("group-keys", func() { dllServer.startGroupKeyLoop(dllCtx) })
+	dllServer.health.goSafe("inbox-expiry", func() { dllServer.startInboxExpiryLoop(dllCtx) })
+	dllServer.health.goSafe("snapshot", func() { dllServer.startSnapshotLoop(dllCtx) })
+	dllServer.health.goSafe("keysaver-probe", func() { dllServer.startKeysaverProbeLoop(dllCtx) })
+	dllServer.health.goSafe("dht-announce", func() { dllServer.startDHTAnnounceLoop(dllCtx) })
+	dllServer.health.goSafe("dht-save", func() { dllServer.startDHTSaveLoop(dllCtx) })
+	dllServer.health.goSafe("fleet", func() { dllServer.startFleetLoop(dllCtx) })
 
 	// Start beacon broadcaster/listener
-	if err := startBroadcaster(dllCtx, dllCfg, dllID, dllPick, dllNodeKeys, dllSecrets.BeaconKey[:]); err != nil {
+	if err := startBroadcaster(dllCtx, dllCfg, dllID, dllPick, dllNodeKeys, dllSecrets.BeaconKey[:], dllServer.org.ID, dllServer, dllServer.health); err != nil {
 		log.Printf("[dll] broadcaster fail: %v", err)
+		lns.Close()
 		return -4
 	}
-	if err := startListener(dllCtx, dllCfg, dllPeers, dllPick, dllSecrets.BeaconKey[:]); err != nil {
+	if err := startListener(dllCtx, dllCfg, dllPeers, dllPick, dllSecrets.BeaconKey[:], dllServer.pairings, dllServer.disco, dllServer.org, dllServer.clock, dllServer.dups, dllServer.fetchProfile, dllServer.health); err != nil {
 		log.Printf("[dll] listener fail: %v", err)
+		lns.Close()
 		return -5
 	}
-
-	// Create server
-	dllServer = newServer(dllCfg, dllID, dllPeers, dllDHT, dllNodeKeys, dllPaths, dllSecrets)
-
-	// HTTP servers
-	bindIP := dllCfg.BindIP
-	if bindIP == "" {
-		bindIP = dllPick.IPStr
+	if dllCfg.P2P {
+		if err := dllServer.startP2PNode(dllCtx); err != nil {
+			dllServer.health.markDegraded("p2p", err.Error())
+		}
 	}
-	publicAddr := fmt.Sprintf("%s:%d", bindIP, dllCfg.APIPort)
-	controlAddr := fmt.Sprintf("127.0.0.1:%d", dllCfg.ControlPort)
 
+	// HTTP servers
 	dllPublicSrv = &http.Server{
-		Addr:              publicAddr,
 		Handler:           dllServer.PublicHandler(),
 		ReadHeaderTimeout: 5 * time.Second,
 	}
 	dllControlSrv = &http.Server{
-		Addr:              controlAddr,
 		Handler:           dllServer.ControlHandler(),
 		ReadHeaderTimeout: 5 * time.Second,
 	}
 
 	go func() {
-		log.Printf("[dll] public HTTP on %s", publicAddr)
-		if err := dllPublicSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Printf("[dll] public HTTP error: %v", err)
-		}
+		log.Printf("[dll] public HTTP on %s", lns.public.Addr())
+		dllServer.health.serveOrDegrade("public http", dllPublicSrv, lns.public)
 	}()
 
 	go func() {
-		log.Printf("[dll] control HTTP on %s", controlAddr)
-		if err := dllControlSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Printf("[dll] control HTTP error: %v", err)
-		}
+		log.Printf("[dll] control HTTP on %s", lns.control.Addr())
+		dllServer.health.serveOrDegrade("control http", dllControlSrv, lns.control)
 	}()
 
 	dllRunning = true
+	dllStartEvents()
 	log.Printf("[dll] started successfully")
 	return 0
 }
 
+// P2P_SetEventCallback registers fn to receive every node event (peer
+// lifecycle, inbox, commands, ... the same as GET /events) as JSON, on a
+// goroutine of the DLL, one event at a time. A callback slower than the
+// events misses some rather than holding up the node. NULL unregisters.
+// It may be called before or after P2P_Start and survives P2P_Stop.
+//
+//export P2P_SetEventCallback
+func P2P_SetEventCallback(fn C.P2PEventFn, ctx unsafe.Pointer) C.int {
+	dllMu.Lock()
+	defer dllMu.Unlock()
+	dllEventFn, dllEventCtx = fn, ctx
+	if dllRunning {
+		dllStartEvents()
+	}
+	return 0
+}
+
+// dllStartEvents (re)subscribes the event callback; dllMu is held.
+func dllStartEvents() {
+	if dllEventStop != nil {
+		dllEventStop()
+		dllEventStop = nil
+	}
+	if dllEventFn == nil || dllServer == nil {
+		return
+	}
+	ch, cancel, ok := dllServer.events.subscribe()
+	if !ok {
+		log.Printf("[dll] event callback not registered: too many event subscribers")
+		return
+	}
+	fn, ctx, done := dllEventFn, dllEventCtx, make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case ev := <-ch:
+				b, err := json.Marshal(ev)
+				if err != nil {
+					continue
+				}
+				cs := C.CString(string(b))
+				C.p2p_event(fn, ctx, cs)
+				C.free(unsafe.Pointer(cs))
+			}
+		}
+	}()
+	dllEventStop = func() {
+		cancel()
+		close(done)
+	}
+}
+
 // P2P_Stop gracefully stops all p2p services.
 //
 //export P2P_Stop
@@ -263,6 +439,17 @@ func P2P_Stop() {
 	if dllCancel != nil {
 		dllCancel()
 	}
+	if dllEventStop != nil {
+		dllEventStop()
+		dllEventStop = nil
+	}
+	if dllPeers != nil && dllPaths != nil && dllSecrets != nil {
+		savePeersIfDirty(dllPeers, dllPaths.PeersEnc, dllSecrets.FileKey[:])
+	}
+	if dllServer != nil {
+		dllServer.catalog.save()
+		dllServer.saveDHTStore()
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -273,6 +460,9 @@ func P2P_Stop() {
 	if dllControlSrv != nil {
 		_ = dllControlSrv.Shutdown(ctx)
 	}
+	if dllPaths != nil {
+		removeNodeLock(dllPaths)
+	}
 
 	dllRunning = false
 	log.Printf("[dll] stopped")
@@ -299,11 +489,16 @@ func P2P_GetStatus() *C.char {
 		status["hostname"] = dllID.Hostname
 		status["api_port"] = dllCfg.APIPort
 		status["control_port"] = dllCfg.ControlPort
+		status["data_dir"] = dllPaths.BaseDir
+		status["mode"] = dllCfg.Mode
+		status["secrets_locked"] = dllLocked
 		if dllPeers != nil {
 			status["peers_count"] = len(dllPeers.List())
 		}
 	}
 
+	status["build"] = buildInfo() // also before P2P_Start: what this DLL can do
+
 	b, _ := json.Marshal(status)
 	return cString(string(b))
 }
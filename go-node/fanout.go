@@ -0,0 +1,296 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultReplicateQuorum = 2
+	quorumWait             = 30 * time.Second // how long send-file waits for the quorum
+	freeBytesHeader        = "X-Free-Bytes"
+
+	scoreVault     = 10.0
+	scoreLowDisk   = -20.0 // peer says its disk is nearly full
+	scoreMaint     = -20.0 // peer is being backed up (see maintenance.go)
+	scoreSuccess   = 5.0   // times the peer's replicate success rate
+	scoreFreeMax   = 5.0   // one point per free GiB, capped
+	scoreRTTMax    = 4.0   // minus one point per 100ms of RTT, capped
+	scoreBadStrike = 10.0  // minus per bad-content strike (see fetch.go)
+	badStrikesMax  = 3     // strikes past this don't lower the score further
+	unknownSuccess = 0.5   // success rate assumed for peers never tried
+)
+
+// fanoutStats tracks per-peer replicate outcomes for scoring.
+type fanoutStats struct {
+	mu    sync.Mutex
+	peers map[string]*peerFanout
+}
+
+type peerFanout struct {
+	OK   int64 `json:"ok"`
+	Fail int64 `json:"fail"`
+	Bad  int64 `json:"bad_content"` // fetches that didn't match their key
+}
+
+func newFanoutStats() *fanoutStats {
+	return &fanoutStats{peers: make(map[string]*peerFanout)}
+}
+
+func (f *fanoutStats) record(nodeID string, ok bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	st := f.peers[nodeID]
+	if st == nil {
+		st = &peerFanout{}
+		f.peers[nodeID] = st
+	}
+	if ok {
+		st.OK++
+	} else {
+		st.Fail++
+	}
+}
+
+// strike counts bad content served by nodeID and returns its strikes.
+func (f *fanoutStats) strike(nodeID string) int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	st := f.peers[nodeID]
+	if st == nil {
+		st = &peerFanout{}
+		f.peers[nodeID] = st
+	}
+	st.Bad++
+	return st.Bad
+}
+
+func (f *fanoutStats) get(nodeID string) peerFanout {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if st := f.peers[nodeID]; st != nil {
+		return *st
+	}
+	return peerFanout{}
+}
+
+func (st peerFanout) successRate() float64 {
+	if st.OK+st.Fail == 0 {
+		return unknownSuccess
+	}
+	return float64(st.OK) / float64(st.OK+st.Fail)
+}
+
+// peerScore weighs vault capability, low disk and maintenance flags,
+// replicate success rate, bad content served, advertised free storage and
+// measured RTT; higher goes first in fanout.
+func (s *Server) peerScore(p PeerInfo) float64 {
+	st := s.fanout.get(p.NodeID)
+	score := scoreSuccess * st.successRate()
+	score -= scoreBadStrike * float64(min(st.Bad, badStrikesMax))
+	if p.hasCap(capVault) {
+		score += scoreVault
+	}
+	if p.hasCap(capLowDisk) {
+		score += scoreLowDisk
+	}
+	if p.hasCap(capMaintenance) {
+		score += scoreMaint
+	}
+	score += min(float64(p.FreeBytes)/(1<<30), scoreFreeMax)
+	score -= min(float64(p.rttOrUnknown(time.Now()))/float64(100*time.Millisecond), scoreRTTMax)
+	return score
+}
+
+// rankPeers returns the replication targets (everyone but us, with an
+// address and a NodeID only one machine holds) best score first.
+func (s *Server) rankPeers(peers []PeerInfo) []PeerInfo {
+	out := make([]PeerInfo, 0, len(peers))
+	scores := make(map[string]float64, len(peers))
+	for _, p := range peers {
+		if p.NodeID == s.id.NodeID || p.Addr == "" || s.dups.duplicated(p.NodeID) {
+			continue
+		}
+		out = append(out, p)
+	}
+	s.withCaps(out)
+	for _, p := range out {
+		scores[p.NodeID] = s.peerScore(p)
+	}
+	sort.SliceStable(out, func(i, j int) bool { return scores[out[i].NodeID] > scores[out[j].NodeID] })
+	return out
+}
+
+// replicateTo POSTs env to p and records the outcome. Only a 2xx counts as
+// an acknowledgement. A peer that already holds chunk hash is acked without
+// sending the envelope.
+func (s *Server) replicateTo(p PeerInfo, hash string, envBytes []byte, hdr http.Header) (string, bool) {
+	if addr, ok := s.peerHasChunk(p, hash); ok {
+		s.metrics.counter(chunkDedup).inc("skipped_send")
+		s.fanout.record(p.NodeID, true)
+		s.catalog.confirm(hash, p.NodeID)
+		return addr, true
+	}
+	resp, addr, err := s.postToPeer(p, "/replicate", envBytes, hdr)
+	if err != nil {
+		log.Printf("[replicate] to %s fail: %v", p.NodeID[:8], err)
+		s.fanout.record(p.NodeID, false)
+		return "", false
+	}
+	_ = resp.Body.Close()
+	ok := resp.StatusCode/100 == 2
+	if !ok {
+		log.Printf("[replicate] to %s: HTTP %d", p.NodeID[:8], resp.StatusCode)
+	}
+	s.fanout.record(p.NodeID, ok)
+	if ok {
+		s.catalog.confirm(hash, p.NodeID)
+	}
+	return addr, ok
+}
+
+// fanoutResult is what send-file reports once the quorum is met (or can't be).
+type fanoutResult struct {
+	Acked     int  `json:"acked"`
+	Tried     int  `json:"tried"`
+	Durable   bool `json:"durable"`
+	Pending   bool `json:"pending"` // deliveries still running in the background
+	Cancelled bool `json:"cancelled,omitempty"`
+}
+
+// fanoutWithQuorum replicates to peers best-first in the background and
+// returns as soon as quorum peers acknowledged, every peer was tried, or
+// quorumWait elapsed. Remaining deliveries continue after it returns, until
+// the transfer t is cancelled (see transfers.go).
+func (s *Server) fanoutWithQuorum(t *transfer, peers []PeerInfo, envBytes []byte, hdr http.Header, quorum int) fanoutResult {
+	s.transfers.update(t, func(t *transfer) { t.Peers = len(peers) })
+	acks := make(chan bool, len(peers))
+	go func() {
+		defer recoverOnce("fanout")
+		defer s.transfers.finish(t)
+		for _, p := range peers {
+			if t.ctx.Err() != nil {
+				log.Printf("[fanout] %s cancelled before %.8s", t.ID, p.NodeID)
+				return
+			}
+			acks <- s.deliverTo(t, p, t.Hash, envBytes, hdr)
+		}
+	}()
+
+	res := fanoutResult{}
+	if quorum > len(peers) {
+		quorum = len(peers)
+	}
+	timeout := time.After(quorumWait)
+	for res.Tried < len(peers) && res.Acked < quorum {
+		select {
+		case ok := <-acks:
+			res.Tried++
+			if ok {
+				res.Acked++
+			}
+		case <-timeout:
+			res.Pending = true
+			return res
+		case <-t.ctx.Done():
+			res.Cancelled = true
+			return res
+		}
+	}
+	res.Durable = quorum > 0 && res.Acked >= quorum
+	res.Pending = res.Tried < len(peers)
+	return res
+}
+
+// deliverTo replicates one envelope of transfer t to p, counting the try
+// and the ack on t.
+func (s *Server) deliverTo(t *transfer, p PeerInfo, hash string, envBytes []byte, hdr http.Header) bool {
+	addr, ok := s.replicateTo(p, hash, envBytes, hdr)
+	s.transfers.update(t, func(t *transfer) { t.Tried++ })
+	if !ok && t.ctx.Err() == nil {
+		s.queueReplicateRetry(p, hash, envBytes)
+	}
+	if ok {
+		s.trace(t.ID, traceFanout, addr)
+		if s.transfers.ackedBy(t, p) {
+			s.notifyAbandon(t, []PeerInfo{p})
+		}
+	}
+	var prog *sendProgress
+	var tried, acked, of int
+	s.transfers.update(t, func(t *transfer) { prog, tried, acked, of = t.progress, t.Tried, t.Acked, t.Peers })
+	prog.emit("fanout", map[string]any{"peer": p.NodeID, "ok": ok, "tried": tried, "acked": acked, "of": of})
+	return ok
+}
+
+// freeBytes is how much more chunk data this node will hold (MaxDataBytes
+// minus what is on disk).
+func (s *Server) freeBytes() int64 {
+	var used int64
+	if entries, err := os.ReadDir(s.paths.ChunksDir); err == nil {
+		for _, e := range entries {
+			if e.IsDir() || !strings.HasSuffix(e.Name(), ".bin") {
+				continue
+			}
+			if info, err := e.Info(); err == nil {
+				used += info.Size()
+			}
+		}
+	}
+	if used >= s.cfg.MaxDataBytes {
+		return 0
+	}
+	return s.cfg.MaxDataBytes - used
+}
+
+func parseFreeBytes(h http.Header) int64 {
+	n, _ := strconv.ParseInt(h.Get(freeBytesHeader), 10, 64)
+	return n
+}
+
+type peerScoreView struct {
+	NodeID      string  `json:"node_id"`
+	Hostname    string  `json:"hostname"`
+	Score       float64 `json:"score"`
+	Vault       bool    `json:"vault"`
+	FreeBytes   int64   `json:"free_bytes"`
+	OK          int64   `json:"ok"`
+	Fail        int64   `json:"fail"`
+	BadContent  int64   `json:"bad_content,omitempty"`
+	SuccessRate float64 `json:"success_rate"`
+	RTTms       float64 `json:"rtt_ms,omitempty"` // omitted while unmeasured
+	Maintenance bool    `json:"maintenance,omitempty"`
+}
+
+// GET /peers/scores (control): fanout order and its inputs.
+func (s *Server) handlePeerScores(w http.ResponseWriter, r *http.Request) {
+	ranked := s.rankPeers(s.peers.List())
+	out := make([]peerScoreView, 0, len(ranked))
+	for _, p := range ranked {
+		st := s.fanout.get(p.NodeID)
+		var rttMs float64
+		if d, ok := p.rtt(time.Now()); ok {
+			rttMs = float64(d) / float64(time.Millisecond)
+		}
+		out = append(out, peerScoreView{
+			NodeID:      p.NodeID,
+			Hostname:    p.Hostname,
+			Score:       s.peerScore(p),
+			Vault:       p.hasCap(capVault),
+			FreeBytes:   p.FreeBytes,
+			OK:          st.OK,
+			Fail:        st.Fail,
+			BadContent:  st.Bad,
+			SuccessRate: st.successRate(),
+			RTTms:       rttMs,
+			Maintenance: p.hasCap(capMaintenance),
+		})
+	}
+	writeJSON(w, map[string]any{"quorum": s.cfg.ReplicateQuorum, "peers": out})
+}
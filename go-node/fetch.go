@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// Read-through blob lookup for /fetch (public) and /backup/get (control):
+// memory kv, then the chunk store on disk, then (control only, so a public
+// miss can't fan out across the network) a DHT provider.
+//
+// Both send X-Content-SHA256, the hash of the body as written. A node
+// pulling from a peer hashes the body while reading it and drops it if the
+// header doesn't match (transport corruption) or if a blob-<hash> envelope
+// doesn't hold that ciphertext. The latter counts as a bad-content strike
+// against the peer, which lowers its fanout score (see fanout.go).
+
+const (
+	blobSourceHeader = "X-Blob-Source"
+	blobFromMemory   = "memory"
+	blobFromDisk     = "disk"
+	blobFromRemote   = "remote"
+	contentSHAHeader = "X-Content-SHA256"
+
+	remoteFetchTimeout = 30 * time.Second
+)
+
+// blob-<sha256 of ciphertext>-<name>
+var blobKeyRe = regexp.MustCompile(`^blob-([0-9a-f]{64})-(.+)$`)
+
+var (
+	errBadContent = errors.New("content hash does not match key")
+
+	fetchRejected = metricDef{"fetch_rejected_total",
+		"fetched bodies dropped by verification, by reason (transport, content)", "reason"}
+)
+
+// lookupBlob checks memory, then disk. It never goes to the network.
+func (s *Server) lookupBlob(key string) ([]byte, string, bool) {
+	s.mu.RLock()
+	val, ok := s.kv[key]
+	s.mu.RUnlock()
+	if ok {
+		return val, blobFromMemory, true
+	}
+	if val, ok := s.blobFromDisk(key); ok {
+		return val, blobFromDisk, true
+	}
+	return nil, "", false
+}
+
+// blobFromDisk rebuilds a replicate envelope from the chunk and its chain
+// block. The msgid isn't kept on disk, so it comes back empty. Not cached:
+// the chunk is already on disk and public reads shouldn't grow memory.
+func (s *Server) blobFromDisk(key string) ([]byte, bool) {
+	m := blobKeyRe.FindStringSubmatch(key)
+	if m == nil {
+		return nil, false
+	}
+	hash, name := m[1], m[2]
+	ct, err := os.ReadFile(filepath.Join(s.paths.ChunksDir, hash+".bin"))
+	if err != nil || sha256Hex(ct) != hash {
+		return nil, false
+	}
+	var blk *Block
+	for _, b := range s.readChain() {
+		if b.Hash == hash && b.Name == name {
+			blk = &b
+			break
+		}
+	}
+	if blk == nil {
+		return nil, false
+	}
+	env := ReplicateEnvelope{
+		OriginID:  blk.OriginID,
+		Name:      blk.Name,
+		HashHex:   blk.Hash,
+		PrevHash:  blk.PrevHash,
+		OrgID:     s.org.ID,
+		CipherB64: base64.RawURLEncoding.EncodeToString(ct),
+		Created:   blk.Created,
+		Comp:      blk.Comp,
+		RawSize:   blk.RawSize,
+		Logical:   blk.Logical,
+		Batch:     blk.Batch,
+	}
+	env.Pad, env.NameSealed = blk.Pad, blk.NameSealed
+	b, _ := json.Marshal(env)
+	return b, true
+}
+
+// verifyBlob checks a blob pulled from a peer against the hash in its key.
+// Keys without a hash (e.g. peer snapshots) can't be checked here.
+func verifyBlob(key string, b []byte) error {
+	m := blobKeyRe.FindStringSubmatch(key)
+	if m == nil {
+		return nil
+	}
+	var env ReplicateEnvelope
+	if err := json.Unmarshal(b, &env); err != nil {
+		return fmt.Errorf("not an envelope: %w", err)
+	}
+	ct, err := base64.RawURLEncoding.DecodeString(env.CipherB64)
+	if err != nil {
+		return fmt.Errorf("bad cipher_b64: %w", err)
+	}
+	if env.HashHex != m[1] || sha256Hex(ct) != m[1] {
+		return errBadContent
+	}
+	return nil
+}
+
+// pullBlob asks the DHT providers of key for it, verifies and caches the
+// first good answer. Returns the provider's node ID.
+func (s *Server) pullBlob(key string) ([]byte, string, error) {
+	providers := s.dht.Get(key)
+	if len(providers) == 0 {
+		return nil, "", errors.New("no providers")
+	}
+	lastErr := errors.New("no reachable provider")
+	for _, id := range providers {
+		if id == s.id.NodeID {
+			continue
+		}
+		p, ok := s.peers.Get(id)
+		if !ok {
+			continue
+		}
+		b, _, err := s.fetchFromPeer(p, key)
+		if err != nil {
+			log.Printf("[fetch] %s from %.8s: %v", key, id, err)
+			lastErr = err
+			continue
+		}
+		s.mu.Lock()
+		s.kv[key] = b
+		s.mu.Unlock()
+		return b, id, nil
+	}
+	return nil, "", lastErr
+}
+
+// fetchFromPeer GETs /fetch?key= from p over its best transport, hashing
+// the body as it streams in. The body is checked against the peer's
+// X-Content-SHA256 (older peers don't send it) and, for blob keys, against
+// the hash in the key; a blob that fails the latter is a strike against p.
+// Returns the address that answered.
+func (s *Server) fetchFromPeer(p PeerInfo, key string) ([]byte, string, error) {
+	path := peerPath(p, "/fetch") + "?key=" + url.QueryEscape(key)
+	resp, addr, err := s.getFromPeer(p, http.MethodGet, path, remoteFetchTimeout)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("status %d", resp.StatusCode)
+	}
+	h := sha256.New()
+	b, err := io.ReadAll(io.TeeReader(io.LimitReader(resp.Body, 2*s.cfg.MaxDataBytes), h))
+	if err != nil {
+		return nil, "", err
+	}
+	if want := resp.Header.Get(contentSHAHeader); want != "" && want != hex.EncodeToString(h.Sum(nil)) {
+		s.metrics.counter(fetchRejected).inc("transport")
+		return nil, "", fmt.Errorf("body does not match %s", contentSHAHeader)
+	}
+	if err := verifyBlob(key, b); err != nil {
+		s.badContent(p, key, err)
+		return nil, "", err
+	}
+	return b, addr, nil
+}
+
+// badContent records that p served something other than what key names.
+func (s *Server) badContent(p PeerInfo, key string, err error) {
+	s.metrics.counter(fetchRejected).inc("content")
+	n := s.fanout.strike(p.NodeID)
+	log.Printf("[fetch] %.8s served bad content for %s (%v); strike %d", p.NodeID, key, err, n)
+}
+
+func writeBlob(w http.ResponseWriter, b []byte, source string) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set(blobSourceHeader, source)
+	w.Header().Set(contentSHAHeader, sha256Hex(b))
+	w.Write(b)
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"context"
 	"crypto/ed25519"
-	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
@@ -47,7 +46,14 @@ func (n *Node) verifyManifest(man FileManifest) bool {
 	if !ed25519.Verify(ed25519.PublicKey(pubRaw), man.body(), sigRaw) {
 		return false
 	}
-	return man.computeID() == man.ID
+	return man.computeID() == man.ID && n.fromOrg(man)
+}
+
+// fileStaging is a file sealed at one chunk size, ready for the wire.
+type fileStaging struct {
+	man   FileManifest
+	lines [][]byte // NDJSON: manifest first, then chunks
+	wire  int
 }
 
 func (n *Node) broadcastFile(filePath string) (FileManifest, error) {
@@ -59,18 +65,14 @@ func (n *Node) broadcastFile(filePath string) (FileManifest, error) {
 	defer f.Close()
 
 	// Per-file symmetric key (32 bytes)
-	kFile := make([]byte, 32)
-	_, _ = rand.Read(kFile)
-
-	plainHash := sha256.New()
-	ciphHash := sha256.New()
+	kFile, err := secureRandom(32)
+	if err != nil {
+		return FileManifest{}, err
+	}
 
-	chunks := int((st.Size() + int64(maxChunk) - 1) / int64(maxChunk))
-	man := FileManifest{
+	base := FileManifest{
 		FileName:  filepath.Base(filePath),
 		Size:      st.Size(),
-		ChunkSize: maxChunk,
-		Chunks:    chunks,
 		PeerID:    n.peerID.String(),
 		PubB64:    base64.StdEncoding.EncodeToString(n.pub),
 		Timestamp: time.Now().Unix(),
@@ -81,61 +83,124 @@ func (n *Node) broadcastFile(filePath string) (FileManifest, error) {
 	if err != nil {
 		return FileManifest{}, err
 	}
-	man.WrappedKeyB64 = base64.StdEncoding.EncodeToString(wrapped)
-	man.WrapNonceB64 = base64.StdEncoding.EncodeToString(wnonce)
+	base.WrappedKeyB64 = base64.StdEncoding.EncodeToString(wrapped)
+	base.WrapNonceB64 = base64.StdEncoding.EncodeToString(wnonce)
 
-	// Stage encrypted chunks in memory (simpler demo)
-	type staged struct{ nonce, ct []byte }
-	stagedChunks := make([]staged, 0, chunks)
+	// Stage each chunk size once, when a peer first needs it
+	staged := map[int]*fileStaging{}
+	stage := func(size int) (*fileStaging, error) {
+		if fs, ok := staged[size]; ok {
+			return fs, nil
+		}
+		fs, err := n.stageFile(f, base, kFile, size)
+		if err != nil {
+			return nil, err
+		}
+		staged[size] = fs
+		n.catalog.observeManifest(fs.man, false)
+		return fs, nil
+	}
 
-	buf := make([]byte, maxChunk)
-	for i := 0; i < chunks; i++ {
-		nr, _ := io.ReadFull(f, buf)
+	// Send to each peer over a /file stream
+	var first *fileStaging
+	for _, pid := range n.peersByRTT() {
+		fs, err := stage(n.chunkSizeFor(pid))
+		if err != nil {
+			return FileManifest{}, err
+		}
+		if first == nil {
+			first = fs
+		}
+		if fs.wire > relayByteBudget && n.isRelayed(pid) && !n.waitDirect(context.Background(), pid) {
+			log.Printf("[file] %s: %d bytes exceeds the relay limit and hole punching failed; skipped", pid, fs.wire)
+			continue
+		}
+		s, err := n.openStream(context.Background(), pid, protoFile)
+		if err != nil {
+			continue
+		}
+		_ = s.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		var busy time.Duration
+		ok := true
+		for i, b := range fs.lines {
+			t0 := time.Now()
+			if _, err := s.Write(b); err != nil {
+				ok = false
+				break
+			}
+			busy += time.Since(t0)
+			if i > 0 {
+				time.Sleep(8 * time.Millisecond)
+			}
+		}
+		if ok {
+			n.observeRate(pid, fs.wire, busy)
+		}
+		s.CloseWrite()
+		s.Close()
+	}
+	if first == nil {
+		if first, err = stage(n.chunkSizeFor("")); err != nil {
+			return FileManifest{}, err
+		}
+	}
+	return first.man, nil
+}
+
+// stageFile seals f at chunk size size under kFile and signs its manifest.
+func (n *Node) stageFile(f *os.File, base FileManifest, kFile []byte, size int) (*fileStaging, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	man := base
+	man.ChunkSize = size
+	man.Chunks = int((man.Size + int64(size) - 1) / int64(size))
+
+	plainHash := sha256.New()
+	ciphHash := sha256.New()
+
+	// Encrypted chunks are staged in memory (simpler demo)
+	type sealed struct{ nonce, ct []byte }
+	chunks := make([]sealed, 0, man.Chunks)
+
+	buf := make([]byte, size)
+	for i := 0; i < man.Chunks; i++ {
+		nr, err := io.ReadFull(f, buf)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
 		plain := buf[:nr]
 		plainHash.Write(plain)
 
-		nonce := hkdfBytes(kFile, fmt.Sprintf("chunk-%d", i), 12)
+		nonce := chunkNonce(kFile, size, i)
 		ct := gcm(kFile).Seal(nil, nonce, plain, nil)
 		ciphHash.Write(ct)
 
-		stagedChunks = append(stagedChunks, staged{nonce, ct})
+		chunks = append(chunks, sealed{nonce, ct})
 	}
 
 	man.PlainSHA256 = hex.EncodeToString(plainHash.Sum(nil))
 	man.CipherSHA256 = hex.EncodeToString(ciphHash.Sum(nil))
 	man.SigB64 = base64.StdEncoding.EncodeToString(ed25519.Sign(n.priv, man.body()))
 	man.ID = man.computeID()
+	man.OrgMAC = manifestOrgMAC(n.orgKey, man.ID)
 
-	// Send to each peer over a /file stream: manifest first, then NDJSON chunks
-	for _, pid := range n.peersByRTT() {
-		s, err := n.h.NewStream(context.Background(), pid, protoFile)
-		if err != nil {
-			continue
-		}
-		enc := json.NewEncoder(s)
-		_ = s.SetWriteDeadline(time.Now().Add(10 * time.Second))
-		// manifest
-		_ = enc.Encode(man)
-		// chunks
-		for i, st := range stagedChunks {
-			ch := FileChunk{
-				ManifestID: man.ID,
-				Index:      i,
-				NonceB64:   base64.StdEncoding.EncodeToString(st.nonce),
-				DataB64:    base64.StdEncoding.EncodeToString(st.ct),
-				PeerID:     n.peerID.String(),
-			}
-			// newline-delimited JSON
-			b, _ := json.Marshal(ch)
-			_, _ = s.Write(b)
-			_, _ = s.Write([]byte("\n"))
-			time.Sleep(8 * time.Millisecond)
+	manLine, _ := json.Marshal(man)
+	fs := &fileStaging{man: man, lines: [][]byte{append(manLine, '\n')}}
+	fs.wire = len(fs.lines[0])
+	for i, c := range chunks {
+		ch := FileChunk{
+			ManifestID: man.ID,
+			Index:      i,
+			NonceB64:   base64.StdEncoding.EncodeToString(c.nonce),
+			DataB64:    base64.StdEncoding.EncodeToString(c.ct),
+			PeerID:     n.peerID.String(),
 		}
-		s.CloseWrite()
-		s.Close()
+		b, _ := json.Marshal(ch)
+		fs.lines = append(fs.lines, append(b, '\n'))
+		fs.wire += len(b) + 1
 	}
-
-	return man, nil
+	return fs, nil
 }
 
 func (n *Node) storeChunk(ch FileChunk) {
@@ -146,6 +211,9 @@ func (n *Node) storeChunk(ch FileChunk) {
 		return
 	}
 
+	if ch.Index < 0 || ch.Index >= man.Chunks || len(ch.DataB64) > chunkWireMax(man) {
+		return
+	}
 	nonce := mustDecodeB64(ch.NonceB64)
 	ct := mustDecodeB64(ch.DataB64)
 
@@ -154,12 +222,16 @@ func (n *Node) storeChunk(ch FileChunk) {
 		return
 	}
 	pt, err := gcm(kFile).Open(nil, nonce, ct, nil)
-	if err != nil {
+	if err != nil || len(pt) != chunkPlainLen(man, ch.Index) {
 		return
 	}
 
-	os.MkdirAll(filepath.Join(storeDir, ch.ManifestID), 0o755)
-	fn := filepath.Join(storeDir, ch.ManifestID, fmt.Sprintf("%06d.part", ch.Index))
+	partDir, err := partsDir(n.storeDir, ch.ManifestID)
+	if err != nil {
+		return
+	}
+	os.MkdirAll(partDir, 0o755)
+	fn := filepath.Join(partDir, fmt.Sprintf("%06d.part", ch.Index))
 	_ = os.WriteFile(fn, pt, 0o644)
 
 	n.fileMu.Lock()
@@ -175,13 +247,35 @@ func (n *Node) storeChunk(ch FileChunk) {
 	}
 }
 
+// partsDir and assembledPath are where a received file's parts and the
+// file itself go under storeDir; the ID and name are the sender's.
+func partsDir(storeDir, manifestID string) (string, error) {
+	return safeJoin(storeDir, sanitize(manifestID))
+}
+
+func assembledPath(storeDir string, man FileManifest) (string, error) {
+	return safeJoin(storeDir, sanitize(man.ID)+"__"+sanitize(man.FileName))
+}
+
 // tryAssemble assembles plaintext parts, verifies SHA-256, and writes final file.
 func (n *Node) tryAssemble(mid string) {
 	n.fileMu.Lock()
 	man := n.manifests[mid]
 	n.fileMu.Unlock()
 
-	out := filepath.Join(storeDir, man.ID+"__"+sanitize(man.FileName))
+	partDir, err := partsDir(n.storeDir, man.ID)
+	if err != nil {
+		return
+	}
+	if n.quarantine != nil && !n.quarantine.autoAccept(man.PeerID, man.Size) {
+		n.quarantineAssembled(man, partDir)
+		return
+	}
+	out, err := assembledPath(n.storeDir, man)
+	if err != nil {
+		log.Printf("[file] %s: %v", man.FileName, err)
+		return
+	}
 	if _, err := os.Stat(out); err == nil {
 		return
 	}
@@ -193,7 +287,7 @@ func (n *Node) tryAssemble(mid string) {
 
 	h := sha256.New()
 	for i := 0; i < man.Chunks; i++ {
-		part := filepath.Join(storeDir, man.ID, fmt.Sprintf("%06d.part", i))
+		part := filepath.Join(partDir, fmt.Sprintf("%06d.part", i))
 		b, err := os.ReadFile(part)
 		if err != nil {
 			return
@@ -207,5 +301,44 @@ func (n *Node) tryAssemble(mid string) {
 		log.Printf("[file] integrity FAILED for %s", man.FileName)
 		return
 	}
+	n.catalog.observeManifest(man, true)
 	log.Printf("[file] OK: %s", out)
 }
+
+// quarantineAssembled writes the parts of man into the quarantine instead
+// of the store; accept moves the file there (see quarantine.go).
+func (n *Node) quarantineAssembled(man FileManifest, partDir string) {
+	if n.quarantine.held(man.ID) {
+		return
+	}
+	it, err := n.quarantine.hold(QuarantineItem{
+		ID:            man.ID,
+		Source:        quarantineLibp2p,
+		Sender:        man.PeerID,
+		ClaimedName:   man.FileName,
+		Size:          man.Size,
+		ClaimedSHA256: man.PlainSHA256,
+		Created:       man.Timestamp,
+	}, func(w io.Writer) error {
+		for i := 0; i < man.Chunks; i++ {
+			b, err := os.ReadFile(filepath.Join(partDir, fmt.Sprintf("%06d.part", i)))
+			if err != nil {
+				return err
+			}
+			if _, err := w.Write(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("[file] quarantine %s: %v", man.FileName, err)
+		return
+	}
+	if it.SHA256 != man.PlainSHA256 {
+		n.quarantine.drop(it.ID)
+		log.Printf("[file] integrity FAILED for %s", man.FileName)
+		return
+	}
+	log.Printf("[file] quarantined %s as %s", man.FileName, it.ID)
+}
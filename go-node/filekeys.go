@@ -0,0 +1,284 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+var (
+	keyArchiveMagic = []byte("MFKX1") // file header for key export archives
+	fullKeyRe       = regexp.MustCompile(`^([0-9a-f]{64})\.fkey$`)
+)
+
+const passphraseHeader = "X-Passphrase"
+
+type fileKeyEntry struct {
+	Hash         string `json:"hash"` // full hash, or the 16-char prefix for legacy files
+	File         string `json:"file"`
+	Name         string `json:"name,omitempty"`
+	Created      int64  `json:"created_unix,omitempty"`
+	Size         int    `json:"size,omitempty"`
+	Escrowed     bool   `json:"escrowed"`
+	Legacy       bool   `json:"legacy,omitempty"`
+	ChunkLocal   bool   `json:"chunk_local"`
+	VerifiedAt   int64  `json:"verified_at,omitempty"` // last check against the chunk passed
+	VerifyFailed int64  `json:"verify_failed_at,omitempty"`
+	VerifyError  string `json:"verify_error,omitempty"`
+}
+
+// keyArchiveRecord is one key inside an export archive.
+type keyArchiveRecord struct {
+	File   string       `json:"file"`
+	KeyB64 string       `json:"key_b64"`
+	Meta   *fileKeyMeta `json:"meta,omitempty"`
+}
+
+type keyArchive struct {
+	Version int                `json:"version"`
+	NodeID  string             `json:"node_id"`
+	Created int64              `json:"created_unix"`
+	Keys    []keyArchiveRecord `json:"keys"`
+}
+
+// listFileKeys reads the keys dir; sidecars fill in name/created/size.
+func (s *Server) listFileKeys() []fileKeyEntry {
+	dir := filepath.Join(s.paths.BaseDir, "keys")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var out []fileKeyEntry
+	for _, e := range entries {
+		it := fileKeyEntry{File: e.Name()}
+		if m := fullKeyRe.FindStringSubmatch(e.Name()); m != nil {
+			it.Hash = m[1]
+			if meta, ok := readFileKeyMeta(dir, m[1]); ok {
+				it.Name, it.Created, it.Size, it.Escrowed = meta.Name, meta.Created, meta.Size, meta.Escrowed
+				it.VerifiedAt, it.VerifyFailed, it.VerifyError = meta.VerifiedAt, meta.VerifyFailed, meta.VerifyError
+			}
+			it.ChunkLocal = fileExists(filepath.Join(s.paths.ChunksDir, m[1]+".bin"))
+		} else if m := legacyKeyRe.FindStringSubmatch(e.Name()); m != nil {
+			it.Hash, it.Legacy = m[1], true
+		} else {
+			continue
+		}
+		out = append(out, it)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].File < out[j].File })
+	return out
+}
+
+func readFileKeyMeta(dir, hashHex string) (fileKeyMeta, bool) {
+	var meta fileKeyMeta
+	b, err := os.ReadFile(filepath.Join(dir, fileKeyMetaName(hashHex)))
+	if err != nil || json.Unmarshal(b, &meta) != nil {
+		return meta, false
+	}
+	return meta, true
+}
+
+// GET /filekeys/list (control)
+func (s *Server) handleFileKeysList(w http.ResponseWriter, r *http.Request) {
+	keys := s.listFileKeys()
+	if keys == nil {
+		keys = []fileKeyEntry{}
+	}
+	writeJSON(w, map[string]any{"count": len(keys), "keys": keys})
+}
+
+// GET /filekeys/export (control, token) with the archive passphrase in
+// X-Passphrase. Returns MAGIC|salt|nonce|ct, the same layout as env.enc.
+func (s *Server) handleFileKeysExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	pass := r.Header.Get(passphraseHeader)
+	if len(pass) < 8 {
+		http.Error(w, "missing or short "+passphraseHeader+" (min 8 chars)", http.StatusBadRequest)
+		return
+	}
+	dir := filepath.Join(s.paths.BaseDir, "keys")
+	arch := keyArchive{Version: 1, NodeID: s.id.NodeID, Created: time.Now().Unix()}
+	for _, it := range s.listFileKeys() {
+		k, err := loadFileKey(s.paths, it.File)
+		if err != nil {
+			log.Printf("[filekeys] export skip %s: %v", it.File, err)
+			continue
+		}
+		rec := keyArchiveRecord{File: it.File, KeyB64: base64.RawURLEncoding.EncodeToString(k[:])}
+		if !it.Legacy {
+			if meta, ok := readFileKeyMeta(dir, it.Hash); ok {
+				rec.Meta = &meta
+			}
+		}
+		arch.Keys = append(arch.Keys, rec)
+	}
+	plain, _ := json.Marshal(arch)
+	blob, err := sealKeyArchive([]byte(pass), plain)
+	if err != nil {
+		http.Error(w, "seal fail: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("[audit] filekeys export: %d keys to %s", len(arch.Keys), r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="filekeys-`+s.id.NodeID[:8]+`.mfkx"`)
+	w.Write(blob)
+}
+
+type keyImportResult struct {
+	Imported int      `json:"imported"`
+	Skipped  int      `json:"skipped"`  // already present
+	Failed   []string `json:"failed"`   // bad record, or key doesn't open the local chunk
+	Verified int      `json:"verified"` // imported keys checked against a local chunk
+}
+
+// POST /filekeys/import (control, token). Body: archive from /filekeys/export,
+// passphrase in X-Passphrase. Existing keys are never overwritten.
+func (s *Server) handleFileKeysImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	blob, err := io.ReadAll(io.LimitReader(r.Body, 64<<20))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	plain, err := openKeyArchive([]byte(r.Header.Get(passphraseHeader)), blob)
+	if err != nil {
+		log.Printf("[audit] filekeys import from %s rejected: %v", r.RemoteAddr, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var arch keyArchive
+	if err := json.Unmarshal(plain, &arch); err != nil {
+		http.Error(w, "bad archive: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	dir, err := ensureKeysDir(s.paths)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res := keyImportResult{Failed: []string{}}
+	for _, rec := range arch.Keys {
+		verified, err := s.importFileKey(dir, rec)
+		if err != nil {
+			if errors.Is(err, os.ErrExist) {
+				res.Skipped++
+				continue
+			}
+			res.Failed = append(res.Failed, rec.File+": "+err.Error())
+			continue
+		}
+		res.Imported++
+		if verified {
+			res.Verified++
+		}
+	}
+	log.Printf("[audit] filekeys import from %s (archive of node %.8s): %d imported, %d skipped, %d failed",
+		r.RemoteAddr, arch.NodeID, res.Imported, res.Skipped, len(res.Failed))
+	writeJSON(w, res)
+}
+
+// importFileKey stores one archived key; verified reports that it was
+// checked against a local chunk.
+func (s *Server) importFileKey(dir string, rec keyArchiveRecord) (verified bool, err error) {
+	full := fullKeyRe.FindStringSubmatch(rec.File)
+	if full == nil && !legacyKeyRe.MatchString(rec.File) {
+		return false, errors.New("not a key file name")
+	}
+	kb, err := base64.RawURLEncoding.DecodeString(rec.KeyB64)
+	if err != nil || len(kb) != 32 {
+		return false, errors.New("bad key")
+	}
+	fp, err := safeJoin(dir, rec.File)
+	if err != nil {
+		return false, err
+	}
+	if fileExists(fp) {
+		return false, os.ErrExist
+	}
+	var k [32]byte
+	copy(k[:], kb)
+	defer wipeBytes(k[:])
+	proof := errNoChunk
+	if full != nil {
+		// a key that doesn't open the local chunk is refused, not flagged
+		if proof = proveFileKey(s.paths, k, full[1]); proof != nil && !errors.Is(proof, errNoChunk) {
+			return false, proof
+		}
+		if fileExists(filepath.Join(dir, fileKeyName(full[1]))) {
+			return false, os.ErrExist
+		}
+	}
+	if err := os.WriteFile(fp, k[:], 0o600); err != nil {
+		return false, err
+	}
+	if full == nil || (rec.Meta == nil && proof != nil) {
+		return false, nil
+	}
+	// the archive's verification is the exporting node's; only ours counts
+	var meta fileKeyMeta
+	if rec.Meta != nil {
+		meta = *rec.Meta
+	}
+	meta.VerifiedAt, meta.VerifyFailed, meta.VerifyError = 0, 0, ""
+	if proof == nil {
+		meta.VerifiedAt = time.Now().Unix()
+	}
+	mb, _ := json.Marshal(meta)
+	_ = os.WriteFile(filepath.Join(dir, fileKeyMetaName(full[1])), mb, 0o600)
+	return proof == nil, nil
+}
+
+// sealKeyArchive encrypts plain with a passphrase: MAGIC|salt|nonce|ct.
+func sealKeyArchive(pass, plain []byte) ([]byte, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.NewX(kdf(pass, salt))
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := append(append([]byte{}, keyArchiveMagic...), salt...)
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, plain, keyArchiveMagic), nil
+}
+
+func openKeyArchive(pass, blob []byte) ([]byte, error) {
+	hdr := len(keyArchiveMagic) + 16 + chacha20poly1305.NonceSizeX
+	if len(blob) < hdr || !strings.HasPrefix(string(blob), string(keyArchiveMagic)) {
+		return nil, errors.New("not a key archive")
+	}
+	salt := blob[len(keyArchiveMagic) : len(keyArchiveMagic)+16]
+	nonce := blob[len(keyArchiveMagic)+16 : hdr]
+	aead, err := chacha20poly1305.NewX(kdf(pass, salt))
+	if err != nil {
+		return nil, err
+	}
+	plain, err := aead.Open(nil, nonce, blob[hdr:], keyArchiveMagic)
+	if err != nil {
+		return nil, errors.New("archive decrypt failed (wrong passphrase?)")
+	}
+	return plain, nil
+}
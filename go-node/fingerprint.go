@@ -23,26 +23,13 @@ type fpInput struct {
 	Host string   `json:"host"`
 }
 
-func trySerial() string {
+// trySerial and primaryDisplay take MIXNETS_DEVICE_SN and MIXNETS_DISP over
+// what the collectors found (fingerprint_hw.go).
+func trySerial(hw fpHardware) string {
 	if s := os.Getenv("MIXNETS_DEVICE_SN"); s != "" {
 		return s
 	}
-	if runtime.GOOS == "linux" {
-		paths := []string{
-			"/sys/class/dmi/id/product_uuid",
-			"/sys/class/dmi/id/board_serial",
-			"/sys/devices/virtual/dmi/id/product_uuid",
-		}
-		for _, p := range paths {
-			if b, err := os.ReadFile(p); err == nil {
-				s := strings.TrimSpace(string(b))
-				if s != "" && s != "None" {
-					return s
-				}
-			}
-		}
-	}
-	return ""
+	return hw.SN
 }
 
 func allMACs() []string {
@@ -62,19 +49,19 @@ func allMACs() []string {
 	return macs
 }
 
-func primaryDisplay() string {
+func primaryDisplay(hw fpHardware) string {
 	if s := os.Getenv("MIXNETS_DISP"); s != "" {
 		return s
 	}
-	return ""
+	return hw.Disp
 }
 
-func deriveNodeKeyPair(orgSalt []byte) (ed25519.PrivateKey, ed25519.PublicKey, string) {
+func deriveNodeKeyPair(orgSalt []byte, hw fpHardware) (ed25519.PrivateKey, ed25519.PublicKey, string) {
 	host, _ := os.Hostname()
 	fp := fpInput{
-		SN:   trySerial(),
+		SN:   trySerial(hw),
 		MACs: allMACs(),
-		Disp: primaryDisplay(),
+		Disp: primaryDisplay(hw),
 		OS:   runtime.GOOS,
 		Host: host,
 	}
@@ -0,0 +1,27 @@
+package main
+
+func collectSerial() string {
+	out, err := fpExec("ioreg", "-rd1", "-c", "IOPlatformExpertDevice")
+	if err != nil {
+		return ""
+	}
+	if s := parseIoregString(out, "IOPlatformSerialNumber"); !junkSerial(s) {
+		return s
+	}
+	return ""
+}
+
+// collectDisplay asks ioreg for the display: DisplayVendorID on Intel Macs,
+// DisplayAttributes on Apple silicon.
+func collectDisplay() string {
+	for _, key := range []string{"DisplayVendorID", "DisplayAttributes"} {
+		out, err := fpExec("ioreg", "-lw0", "-r", "-k", key)
+		if err != nil {
+			continue
+		}
+		if d := parseIoregDisplay(out); d != "" {
+			return d
+		}
+	}
+	return ""
+}
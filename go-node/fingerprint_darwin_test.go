@@ -0,0 +1,42 @@
+package main
+
+import "testing"
+
+const (
+	ioregPlatform = "ioreg -rd1 -c IOPlatformExpertDevice"
+	ioregIntel    = "ioreg -lw0 -r -k DisplayVendorID"
+	ioregSilicon  = "ioreg -lw0 -r -k DisplayAttributes"
+)
+
+func TestCollectDarwin(t *testing.T) {
+	withExec(t, map[string]string{
+		ioregPlatform: `+-o MacBookPro18,3  <class IOPlatformExpertDevice, id 0x100000210, registered, matched, active, busy 0 (35 ms), retain 37>
+    {
+      "IOPlatformSerialNumber" = "C02XK0ABJG5H"
+    }`,
+		ioregSilicon: `"DisplayAttributes" = {"ProductAttributes"={"ManufacturerID"="APP","ProductID"=41003}}`,
+	})
+	if got := collectSerial(); got != "C02XK0ABJG5H" {
+		t.Fatalf("serial %q", got)
+	}
+	// no DisplayVendorID: Apple silicon's DisplayAttributes is used
+	if got := collectDisplay(); got != "APP-a02b" {
+		t.Fatalf("display %q", got)
+	}
+
+	withExec(t, map[string]string{
+		ioregPlatform: `"IOPlatformSerialNumber" = "0"`,
+		ioregIntel:    `"DisplayVendorID" = 1552` + "\n" + `"DisplayProductID" = 40994`,
+	})
+	if got := collectSerial(); got != "" {
+		t.Fatalf("junk serial %q", got)
+	}
+	if got := collectDisplay(); got != "APP-a022" {
+		t.Fatalf("intel display %q", got)
+	}
+
+	withExec(t, nil)
+	if collectSerial() != "" || collectDisplay() != "" {
+		t.Fatal("inputs without ioreg")
+	}
+}
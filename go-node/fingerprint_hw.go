@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Hardware fingerprint inputs. Hostname and MACs are the attributes most
+// likely to change, so fpInput also takes a board serial and the primary
+// display's EDID identity, gathered per OS:
+//
+//	linux    DMI serials in /sys/class/dmi/id, EDID of the first connected
+//	         /sys/class/drm connector
+//	windows  Win32_BIOS SerialNumber (wmic, then PowerShell), EDIDs under
+//	         HKLM\SYSTEM\CurrentControlSet\Enum\DISPLAY
+//	darwin   ioreg IOPlatformSerialNumber, the display's vendor and product
+//
+// Every collector is best-effort: commands go through fpExec (killed after
+// execTimeout) and the lot is given fpCollectTimeout, after which whatever
+// is done is used. The result is cached in identity.json, so the collectors
+// run once per data dir and a monitor swapped later doesn't move the
+// fingerprint. MIXNETS_DEVICE_SN and MIXNETS_DISP still override both.
+
+const fpCollectTimeout = 8 * time.Second
+
+// fpExec runs the windows and darwin collectors' commands; tests swap it
+// for canned output.
+var fpExec = runExec
+
+// fpHardware is what the collectors found.
+type fpHardware struct {
+	SN        string `json:"sn,omitempty"`
+	Disp      string `json:"disp,omitempty"`
+	Collected string `json:"collected"`
+}
+
+// fingerprintHardware returns the cached inputs from identity.json,
+// collecting and caching them the first time.
+func fingerprintHardware(paths *EnvPaths) fpHardware {
+	fp := filepath.Join(paths.BaseDir, identityFile)
+	pi, err := readPersistedIdentity(fp)
+	if err == nil && pi.Fingerprint != nil {
+		return *pi.Fingerprint
+	}
+	hw := collectHardware(fpCollectTimeout)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("[identity] not caching fingerprint inputs in unreadable %s: %v", fp, err)
+		return hw
+	}
+	pi.Fingerprint = &hw
+	if err := writePersistedIdentity(fp, pi); err != nil {
+		log.Printf("[identity] caching fingerprint inputs: %v", err)
+	}
+	return hw
+}
+
+// collectHardware runs the OS collectors, giving up on any still running
+// after timeout.
+func collectHardware(timeout time.Duration) fpHardware {
+	var mu sync.Mutex
+	hw := fpHardware{Collected: time.Now().UTC().Format(time.RFC3339)}
+	done := make(chan struct{}, 2)
+	run := func(f func() string, dst *string) {
+		defer func() { done <- struct{}{} }()
+		defer recoverOnce("fingerprint")
+		v := f()
+		mu.Lock()
+		*dst = v
+		mu.Unlock()
+	}
+	go run(collectSerial, &hw.SN)
+	go run(collectDisplay, &hw.Disp)
+	deadline := time.After(timeout)
+wait:
+	for n := 0; n < 2; n++ {
+		select {
+		case <-done:
+		case <-deadline:
+			log.Printf("[identity] fingerprint collectors still running after %v; going on without them", timeout)
+			break wait
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	return fpHardware{SN: hw.SN, Disp: hw.Disp, Collected: hw.Collected}
+}
+
+// junkSerial reports placeholder serials firmware ships with.
+func junkSerial(s string) bool {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "none", "0", "default string", "to be filled by o.e.m.", "system serial number",
+		"not applicable", "not specified", "n/a", "0123456789", "123456789":
+		return true
+	}
+	return false
+}
+
+// ---- parsers, kept OS-neutral so each collector's output format can be
+// checked anywhere ----
+
+// edidIdentity names a display by its EDID: PNP manufacturer, product code
+// and serial. ok is false for a blob without the EDID header.
+func edidIdentity(b []byte) (string, bool) {
+	header := []byte{0x00, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x00}
+	if len(b) < 128 || !bytes.Equal(b[:8], header) {
+		return "", false
+	}
+	mfg := pnpID(binary.BigEndian.Uint16(b[8:10]))
+	product := binary.LittleEndian.Uint16(b[10:12])
+	serial := binary.LittleEndian.Uint32(b[12:16])
+	return fmt.Sprintf("%s-%04x-%08x", mfg, product, serial), true
+}
+
+// pnpID decodes a packed three-letter PNP manufacturer ID.
+func pnpID(v uint16) string {
+	var out [3]byte
+	for i := 0; i < 3; i++ {
+		c := byte(v>>(10-5*i)) & 0x1f
+		if c < 1 || c > 26 {
+			return fmt.Sprintf("%04x", v)
+		}
+		out[i] = 'A' + c - 1
+	}
+	return string(out[:])
+}
+
+// firstDisplay returns the smallest identity among the EDIDs, so the pick
+// doesn't depend on enumeration order.
+func firstDisplay(edids [][]byte) string {
+	var ids []string
+	for _, b := range edids {
+		if id, ok := edidIdentity(b); ok {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return ""
+	}
+	sort.Strings(ids)
+	return ids[0]
+}
+
+// parseWMIValue reads `wmic ... get <key> /value` output ("Key=Value").
+func parseWMIValue(out, key string) string {
+	for _, ln := range strings.Split(out, "\n") {
+		k, v, ok := strings.Cut(strings.TrimSpace(ln), "=")
+		if ok && strings.EqualFold(k, key) {
+			return strings.TrimSpace(v)
+		}
+	}
+	return ""
+}
+
+// parseRegEDIDs reads the EDID values from `reg query ... /s /v EDID`.
+func parseRegEDIDs(out string) [][]byte {
+	var edids [][]byte
+	for _, ln := range strings.Split(out, "\n") {
+		f := strings.Fields(ln)
+		if len(f) != 3 || f[0] != "EDID" || f[1] != "REG_BINARY" {
+			continue
+		}
+		if b, err := hex.DecodeString(f[2]); err == nil {
+			edids = append(edids, b)
+		}
+	}
+	return edids
+}
+
+var (
+	ioregStringRe   = regexp.MustCompile(`"([A-Za-z]+)" = "([^"]*)"`)
+	ioregVendorRe   = regexp.MustCompile(`"DisplayVendorID" = (\d+)`)
+	ioregProductRe  = regexp.MustCompile(`"DisplayProductID" = (\d+)`)
+	ioregAttrMfgRe  = regexp.MustCompile(`"ManufacturerID"="([A-Z]{3})"`)
+	ioregAttrProdRe = regexp.MustCompile(`"ProductID"=(\d+)`)
+)
+
+// parseIoregString reads a string property ("Key" = "value") from ioreg
+// output.
+func parseIoregString(out, key string) string {
+	for _, m := range ioregStringRe.FindAllStringSubmatch(out, -1) {
+		if m[1] == key {
+			return m[2]
+		}
+	}
+	return ""
+}
+
+// parseIoregDisplay names the first display in ioreg output: Intel Macs
+// list DisplayVendorID/DisplayProductID, Apple silicon a DisplayAttributes
+// dictionary with ManufacturerID and ProductID.
+func parseIoregDisplay(out string) string {
+	if v, p := ioregVendorRe.FindStringSubmatch(out), ioregProductRe.FindStringSubmatch(out); v != nil && p != nil {
+		vendor, err1 := strconv.ParseUint(v[1], 10, 16)
+		product, err2 := strconv.ParseUint(p[1], 10, 16)
+		if err1 == nil && err2 == nil {
+			return fmt.Sprintf("%s-%04x", pnpID(uint16(vendor)), product)
+		}
+	}
+	if m, p := ioregAttrMfgRe.FindStringSubmatch(out), ioregAttrProdRe.FindStringSubmatch(out); m != nil && p != nil {
+		if product, err := strconv.ParseUint(p[1], 10, 16); err == nil {
+			return fmt.Sprintf("%s-%04x", m[1], product)
+		}
+	}
+	return ""
+}
+
+// ---- identity.json ----
+
+func readPersistedIdentity(fp string) (persistedIdentity, error) {
+	var pi persistedIdentity
+	b, err := os.ReadFile(fp)
+	if err != nil {
+		return pi, err
+	}
+	err = json.Unmarshal(b, &pi)
+	return pi, err
+}
+
+func writePersistedIdentity(fp string, pi persistedIdentity) error {
+	out, _ := json.MarshalIndent(pi, "", "  ")
+	return writeFileAtomic(fp, out)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testEDID is a 128-byte EDID block naming mfg's product with serial.
+func testEDID(mfg string, product uint16, serial uint32) []byte {
+	b := make([]byte, 128)
+	copy(b, []byte{0x00, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x00})
+	var id uint16
+	for _, c := range mfg {
+		id = id<<5 | uint16(c-'A'+1)
+	}
+	binary.BigEndian.PutUint16(b[8:], id)
+	binary.LittleEndian.PutUint16(b[10:], product)
+	binary.LittleEndian.PutUint32(b[12:], serial)
+	return b
+}
+
+// withExec swaps fpExec for canned command output keyed by the command
+// line; a command missing from out fails.
+func withExec(t *testing.T, out map[string]string) {
+	old := fpExec
+	fpExec = func(name string, args ...string) (string, error) {
+		line := strings.Join(append([]string{name}, args...), " ")
+		if o, ok := out[line]; ok {
+			return o, nil
+		}
+		return "", fmt.Errorf("%s: not found", name)
+	}
+	t.Cleanup(func() { fpExec = old })
+}
+
+// seedFingerprint caches hw in paths' identity.json, so nothing is
+// collected from the host.
+func seedFingerprint(t *testing.T, paths *EnvPaths, hw fpHardware) {
+	t.Helper()
+	if err := writePersistedIdentity(filepath.Join(paths.BaseDir, identityFile), persistedIdentity{Fingerprint: &hw}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEdidIdentity(t *testing.T) {
+	if id, ok := edidIdentity(testEDID("DEL", 0xa0f4, 0x4c32)); !ok || id != "DEL-a0f4-00004c32" {
+		t.Fatalf("%q %v", id, ok)
+	}
+	if _, ok := edidIdentity(make([]byte, 128)); ok {
+		t.Fatal("no EDID header")
+	}
+	if _, ok := edidIdentity(testEDID("DEL", 1, 1)[:64]); ok {
+		t.Fatal("short EDID")
+	}
+	// enumeration order doesn't pick the display
+	a, b := testEDID("SAM", 2, 1), testEDID("APP", 9, 1)
+	if firstDisplay([][]byte{a, b}) != "APP-0009-00000001" || firstDisplay([][]byte{b, a}) != "APP-0009-00000001" {
+		t.Fatal("first display depends on order")
+	}
+	if firstDisplay([][]byte{[]byte("junk")}) != "" {
+		t.Fatal("junk EDID named a display")
+	}
+}
+
+func TestJunkSerial(t *testing.T) {
+	for _, s := range []string{"", " None ", "To Be Filled By O.E.M.", "System Serial Number", "0"} {
+		if !junkSerial(s) {
+			t.Errorf("%q taken as a serial", s)
+		}
+	}
+	if junkSerial("PF2ABCDE") {
+		t.Fatal("real serial dropped")
+	}
+}
+
+// Collector output from each OS, parsed here so every platform's format is
+// checked on any host.
+func TestParseCollectorOutput(t *testing.T) {
+	if got := parseWMIValue("\r\n\r\nSerialNumber=PF2ABCDE\r\n\r\n", "serialnumber"); got != "PF2ABCDE" {
+		t.Fatalf("wmic: %q", got)
+	}
+	reg := `
+HKEY_LOCAL_MACHINE\SYSTEM\CurrentControlSet\Enum\DISPLAY\DELA0F4\5&1a2b&0&UID4352\Device Parameters
+    EDID    REG_BINARY    ` + strings.ToUpper(hex.EncodeToString(testEDID("DEL", 0xa0f4, 7))) + `
+
+HKEY_LOCAL_MACHINE\SYSTEM\CurrentControlSet\Enum\DISPLAY\Default_Monitor\1&8713bca&0&UID0\Device Parameters
+    EDID    REG_BINARY    00FF
+
+End of search: 2 match(es) found.
+`
+	if edids := parseRegEDIDs(reg); len(edids) != 2 || firstDisplay(edids) != "DEL-a0f4-00000007" {
+		t.Fatalf("reg: %d EDIDs, %q", len(edids), firstDisplay(edids))
+	}
+	platform := `+-o J314sAP  <class IOPlatformExpertDevice, id 0x100000210, registered, matched, active, busy 0 (35 ms), retain 37>
+    {
+      "IOPlatformUUID" = "8A1C5B52-0000-0000-0000-000000000000"
+      "IOPlatformSerialNumber" = "C02XK0ABJG5H"
+    }`
+	if got := parseIoregString(platform, "IOPlatformSerialNumber"); got != "C02XK0ABJG5H" {
+		t.Fatalf("ioreg serial: %q", got)
+	}
+	intel := `    | |   "DisplayVendorID" = 1552
+    | |   "DisplayProductID" = 40994`
+	if got := parseIoregDisplay(intel); got != "APP-a022" {
+		t.Fatalf("intel display: %q", got)
+	}
+	silicon := `"DisplayAttributes" = {"ProductAttributes"={"ManufacturerID"="APP","YearOfManufacture"=2021,"ProductID"=41003}}`
+	if got := parseIoregDisplay(silicon); got != "APP-a02b" {
+		t.Fatalf("apple silicon display: %q", got)
+	}
+	if parseIoregDisplay("nothing here") != "" {
+		t.Fatal("display from no output")
+	}
+}
+
+// The serial and display move the NodeID, their absence doesn't, and the
+// inputs come from the identity.json cache rather than the host.
+func TestNodeIdentityHardware(t *testing.T) {
+	t.Setenv("MIXNETS_DEVICE_SN", "")
+	t.Setenv("MIXNETS_DISP", "")
+	base := buildNodeIdentity("inst", "", "")
+	if _, ok := base.Attrs["sn"]; ok {
+		t.Fatal("empty serial recorded")
+	}
+	withSN := buildNodeIdentity("inst", "PF2ABCDE", "")
+	withDisp := buildNodeIdentity("inst", "PF2ABCDE", "DEL-a0f4-00000007")
+	if withSN.NodeID == base.NodeID || withDisp.NodeID == withSN.NodeID || withDisp.Attrs["disp"] != "DEL-a0f4-00000007" {
+		t.Fatal("hardware inputs don't reach the NodeID")
+	}
+	if buildNodeIdentity("inst", "PF2ABCDE", "").NodeID != withSN.NodeID {
+		t.Fatal("NodeID not deterministic")
+	}
+
+	paths, err := initStorageEnv(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	seedFingerprint(t, paths, fpHardware{SN: "PF2ABCDE", Collected: "2026-01-01T00:00:00Z"})
+	if got := fingerprintHardware(paths); got.SN != "PF2ABCDE" {
+		t.Fatalf("cache not used: %+v", got)
+	}
+	if id := loadNodeIdentity(paths); id.NodeID != buildNodeIdentity(instanceName(paths), "PF2ABCDE", "").NodeID {
+		t.Fatal("loadNodeIdentity ignores the cached serial")
+	}
+	t.Setenv("MIXNETS_DEVICE_SN", "override")
+	if id := loadNodeIdentity(paths); id.Attrs["sn"] != "override" {
+		t.Fatalf("MIXNETS_DEVICE_SN not taken: %v", id.Attrs)
+	}
+}
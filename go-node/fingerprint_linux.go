@@ -0,0 +1,46 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// sysfsRoot is where the collectors find sysfs; tests point it at a
+// fixture tree.
+var sysfsRoot = "/sys"
+
+func collectSerial() string {
+	for _, p := range []string{
+		"class/dmi/id/product_uuid",
+		"class/dmi/id/board_serial",
+		"devices/virtual/dmi/id/product_uuid",
+		"class/dmi/id/product_serial",
+	} {
+		if b, err := os.ReadFile(filepath.Join(sysfsRoot, p)); err == nil {
+			if s := strings.TrimSpace(string(b)); !junkSerial(s) {
+				return s
+			}
+		}
+	}
+	return ""
+}
+
+// collectDisplay reads the EDIDs of the connected DRM connectors
+// (/sys/class/drm/card0-HDMI-A-1/edid and the like).
+func collectDisplay() string {
+	conns, _ := filepath.Glob(filepath.Join(sysfsRoot, "class/drm/card*-*"))
+	sort.Strings(conns)
+	var edids [][]byte
+	for _, c := range conns {
+		st, err := os.ReadFile(filepath.Join(c, "status"))
+		if err != nil || strings.TrimSpace(string(st)) != "connected" {
+			continue
+		}
+		if b, err := os.ReadFile(filepath.Join(c, "edid")); err == nil {
+			edids = append(edids, b)
+		}
+	}
+	return firstDisplay(edids)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// withSysfs points the collectors at a fixture sysfs holding files.
+func withSysfs(t *testing.T, files map[string][]byte) {
+	root := t.TempDir()
+	for name, b := range files {
+		writeFixture(t, filepath.Join(root, name), b)
+	}
+	old := sysfsRoot
+	sysfsRoot = root
+	t.Cleanup(func() { sysfsRoot = old })
+}
+
+func TestCollectLinux(t *testing.T) {
+	withSysfs(t, map[string][]byte{
+		"class/dmi/id/product_uuid":        []byte("Not Specified\n"),
+		"class/dmi/id/board_serial":        []byte("  BSN-4471  \n"),
+		"class/dmi/id/product_serial":      []byte("PSN-1\n"),
+		"class/drm/card0-HDMI-A-1/status":  []byte("disconnected\n"),
+		"class/drm/card0-HDMI-A-1/edid":    testEDID("AAA", 1, 1),
+		"class/drm/card0-eDP-1/status":     []byte("connected\n"),
+		"class/drm/card0-eDP-1/edid":       testEDID("BOE", 0x0a8e, 0),
+		"class/drm/card1-DP-2/status":      []byte("connected\n"),
+		"class/drm/card1-DP-2/edid":        []byte{},
+		"class/drm/card1-DP-3/status":      []byte("connected\n"),
+		"class/drm/card1-DP-3/edid":        testEDID("DEL", 0xa0f4, 9),
+		"class/drm/card1-Writeback-1/edid": testEDID("AAA", 2, 2),
+	})
+	if got := collectSerial(); got != "BSN-4471" {
+		t.Fatalf("serial %q: a junk product_uuid must fall through to board_serial", got)
+	}
+	if got := collectDisplay(); got != "BOE-0a8e-00000000" {
+		t.Fatalf("display %q", got)
+	}
+	hw := collectHardware(fpCollectTimeout)
+	if hw.SN != "BSN-4471" || hw.Disp != "BOE-0a8e-00000000" || hw.Collected == "" {
+		t.Fatalf("%+v", hw)
+	}
+
+	withSysfs(t, nil)
+	if collectSerial() != "" || collectDisplay() != "" {
+		t.Fatal("inputs from an empty sysfs")
+	}
+}
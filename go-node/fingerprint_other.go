@@ -0,0 +1,6 @@
+//go:build !linux && !windows && !darwin
+
+package main
+
+func collectSerial() string  { return "" }
+func collectDisplay() string { return "" }
@@ -0,0 +1,33 @@
+//go:build windows
+
+package main
+
+import "strings"
+
+// collectSerial asks WMI for the BIOS serial: wmic where it still ships,
+// PowerShell's CIM cmdlets otherwise.
+func collectSerial() string {
+	if out, err := fpExec("wmic", "bios", "get", "serialnumber", "/value"); err == nil {
+		if s := parseWMIValue(out, "SerialNumber"); !junkSerial(s) {
+			return s
+		}
+	}
+	out, err := fpExec("powershell", "-NoProfile", "-NonInteractive", "-Command", "(Get-CimInstance -ClassName Win32_BIOS).SerialNumber")
+	if err != nil {
+		return ""
+	}
+	if s := strings.TrimSpace(out); !junkSerial(s) {
+		return s
+	}
+	return ""
+}
+
+// collectDisplay reads the EDIDs Windows keeps for every monitor it has
+// seen, not only the attached ones.
+func collectDisplay() string {
+	out, err := fpExec("reg", "query", `HKLM\SYSTEM\CurrentControlSet\Enum\DISPLAY`, "/s", "/v", "EDID")
+	if err != nil {
+		return ""
+	}
+	return firstDisplay(parseRegEDIDs(out))
+}
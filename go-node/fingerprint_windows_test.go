@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+const (
+	wmicBIOS = "wmic bios get serialnumber /value"
+	psBIOS   = "powershell -NoProfile -NonInteractive -Command (Get-CimInstance -ClassName Win32_BIOS).SerialNumber"
+	regEDID  = `reg query HKLM\SYSTEM\CurrentControlSet\Enum\DISPLAY /s /v EDID`
+)
+
+func TestCollectWindows(t *testing.T) {
+	withExec(t, map[string]string{
+		wmicBIOS: "\r\n\r\nSerialNumber=PF2ABCDE\r\n\r\n",
+		regEDID:  "\r\nHKEY_LOCAL_MACHINE\\SYSTEM\\CurrentControlSet\\Enum\\DISPLAY\\DELA0F4\\1\\Device Parameters\r\n    EDID    REG_BINARY    " + hex.EncodeToString(testEDID("DEL", 0xa0f4, 7)) + "\r\n",
+	})
+	if got := collectSerial(); got != "PF2ABCDE" {
+		t.Fatalf("serial %q", got)
+	}
+	if got := collectDisplay(); got != "DEL-a0f4-00000007" {
+		t.Fatalf("display %q", got)
+	}
+
+	// no wmic (Windows 11 24H2): PowerShell's CIM answer is used
+	withExec(t, map[string]string{psBIOS: "5CD1234XYZ\r\n"})
+	if got := collectSerial(); got != "5CD1234XYZ" {
+		t.Fatalf("powershell serial %q", got)
+	}
+	if collectDisplay() != "" {
+		t.Fatal("display without reg output")
+	}
+
+	// placeholder serials from both are dropped
+	withExec(t, map[string]string{wmicBIOS: "SerialNumber=To be filled by O.E.M.\r\n", psBIOS: "Default string\r\n"})
+	if got := collectSerial(); got != "" {
+		t.Fatalf("junk serial %q", got)
+	}
+}
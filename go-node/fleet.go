@@ -0,0 +1,513 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fleet aggregation. A node started with --aggregate-metrics collects,
+// every --aggregate-interval, the status and the /metrics of every known
+// peer from its public GET /fleet/report, at most fleetParallel at a time,
+// and serves the lot on its control plane: GET /fleet/status as a JSON
+// table and GET /fleet/metrics in Prometheus text format with a node_id
+// label, so one reachable node is the only scrape target. A peer that
+// doesn't answer keeps its last report, marked stale with the time it was
+// last seen. Peers on releases without /fleet/report (404) are listed as
+// unsupported, and fields a peer doesn't send, its metrics included, are
+// simply missing from its row and its series.
+//
+// /fleet/report only answers nodes of the same org: the request carries
+// X-Fleet-Auth: <unix>.<hex HMAC-SHA256> over "fleet-report|<unix>|<target
+// NodeID>", keyed with a key derived from the BeaconKey, and is refused
+// outside fleetAuthSkew. The report is cached for fleetReportCache, so
+// several aggregators cost a peer one chain read.
+
+const (
+	defaultAggregateInterval = time.Minute
+	minAggregateInterval     = 15 * time.Second
+
+	fleetParallel    = 8
+	fleetPeerTimeout = 10 * time.Second
+	fleetReportBody  = 1 << 20
+	fleetReportCache = 10 * time.Second
+	fleetAuthSkew    = 5 * time.Minute
+	fleetAuthHeader  = "X-Fleet-Auth"
+)
+
+// fleetReport is what /fleet/report returns.
+type fleetReport struct {
+	NodeID   string         `json:"node_id"`
+	Hostname string         `json:"hostname,omitempty"`
+	Version  string         `json:"version,omitempty"`
+	Status   map[string]any `json:"status"`
+	Metrics  string         `json:"metrics,omitempty"` // /metrics, Prometheus text
+}
+
+type fleetNode struct {
+	NodeID    string         `json:"node_id"`
+	Hostname  string         `json:"hostname,omitempty"`
+	Version   string         `json:"version,omitempty"`
+	State     string         `json:"state"` // ok, stale, unsupported, never
+	LastSeen  time.Time      `json:"last_seen,omitempty"`
+	LastTry   time.Time      `json:"last_try"`
+	LastError string         `json:"last_error,omitempty"`
+	Status    map[string]any `json:"status,omitempty"`
+	Metrics   []promSample   `json:"-"`
+}
+
+// promSample is one sample line of a peer's /metrics, with its family.
+type promSample struct {
+	Family, Type string
+	Name         string
+	Labels       string // inside the braces, as sent
+	Value        string
+}
+
+type fleetStore struct {
+	mu     sync.Mutex
+	nodes  map[string]*fleetNode
+	rounds int64
+	last   time.Time
+
+	cacheMu sync.Mutex
+	cached  []byte // our own report, for fleetReportCache
+	cacheAt time.Time
+}
+
+func newFleetStore() *fleetStore {
+	return &fleetStore{nodes: make(map[string]*fleetNode)}
+}
+
+// fleetKey is the /fleet/report auth key; every node holding the BeaconKey
+// derives the same one.
+func (s *Server) fleetKey() []byte {
+	h := sha256.Sum256(append([]byte("mixnets-fleet-v1"), s.secrets.BeaconKey[:]...))
+	return h[:]
+}
+
+func fleetMAC(key []byte, ts, target string) string {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte("fleet-report|" + ts + "|" + target))
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// fleetAuth is the X-Fleet-Auth value for a request to target.
+func (s *Server) fleetAuth(target string, now time.Time) string {
+	ts := strconv.FormatInt(now.Unix(), 10)
+	return ts + "." + fleetMAC(s.fleetKey(), ts, target)
+}
+
+func (s *Server) checkFleetAuth(v string, now time.Time) error {
+	ts, mac, ok := strings.Cut(v, ".")
+	if !ok {
+		return errors.New("missing " + fleetAuthHeader)
+	}
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return errors.New("bad " + fleetAuthHeader)
+	}
+	if d := now.Sub(time.Unix(sec, 0)); d > fleetAuthSkew || d < -fleetAuthSkew {
+		return errors.New(fleetAuthHeader + " outside the clock window")
+	}
+	if !hmac.Equal([]byte(mac), []byte(fleetMAC(s.fleetKey(), ts, s.id.NodeID))) {
+		return errors.New("bad " + fleetAuthHeader)
+	}
+	return nil
+}
+
+// report builds our own report, as JSON.
+func (s *Server) fleetReport() []byte {
+	f := s.fleet
+	f.cacheMu.Lock()
+	defer f.cacheMu.Unlock()
+	if f.cached != nil && time.Since(f.cacheAt) < fleetReportCache {
+		return f.cached
+	}
+	var metrics strings.Builder
+	writeMetrics(&metrics, processMetrics, s.metrics)
+	rep := fleetReport{NodeID: s.id.NodeID, Hostname: s.id.Attrs["hostname"], Version: buildInfo().Version, Status: s.syncStatus(), Metrics: metrics.String()}
+	b, _ := json.Marshal(rep)
+	f.cached, f.cacheAt = b, time.Now()
+	return b
+}
+
+// GET /fleet/report?org=<id> (public, X-Fleet-Auth): this node's status
+// for an aggregator.
+func (s *Server) handleFleetReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.org.accept(r.URL.Query().Get("org"), &s.org.foreignReplicates) {
+		http.Error(w, "foreign org", http.StatusForbidden)
+		return
+	}
+	if err := s.checkFleetAuth(r.Header.Get(fleetAuthHeader), time.Now()); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(s.fleetReport())
+}
+
+// collectFleetFrom asks one peer for its report.
+func (s *Server) collectFleetFrom(p PeerInfo) (fleetReport, int, error) {
+	var rep fleetReport
+	path := peerPath(p, "/fleet/report") + "?org=" + s.org.ID
+	resp, _, err := s.peerDo(p, fleetPeerTimeout, func(base string) (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodGet, base+path, nil)
+		if err == nil {
+			req.Header.Set(fleetAuthHeader, s.fleetAuth(p.NodeID, time.Now()))
+		}
+		return req, err
+	})
+	if err != nil {
+		return rep, 0, err
+	}
+	body, err := readPeerBody(resp, fleetReportBody)
+	if err != nil {
+		return rep, resp.StatusCode, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return rep, resp.StatusCode, fmt.Errorf("HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	if err := json.Unmarshal(body, &rep); err != nil {
+		return rep, resp.StatusCode, err
+	}
+	return rep, resp.StatusCode, nil
+}
+
+// record stores one collection result.
+func (f *fleetStore) record(p PeerInfo, rep fleetReport, code int, err error, now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := f.nodes[p.NodeID]
+	if n == nil {
+		n = &fleetNode{NodeID: p.NodeID, State: "never"}
+		f.nodes[p.NodeID] = n
+	}
+	n.LastTry = now
+	if n.Hostname == "" {
+		n.Hostname = p.Hostname
+	}
+	if err != nil {
+		n.LastError = err.Error()
+		switch {
+		case code == http.StatusNotFound:
+			n.State = "unsupported"
+		case !n.LastSeen.IsZero():
+			n.State = "stale"
+		}
+		return
+	}
+	n.State, n.LastSeen, n.LastError = "ok", now, ""
+	n.Status = rep.Status
+	n.Metrics = parsePromText(rep.Metrics)
+	if rep.Hostname != "" {
+		n.Hostname = rep.Hostname
+	}
+	n.Version = rep.Version
+}
+
+// collectFleet runs one round: ourselves, then every known peer, at most
+// fleetParallel at a time.
+func (s *Server) collectFleet(ctx context.Context) {
+	now := time.Now()
+	var self fleetReport
+	_ = json.Unmarshal(s.fleetReport(), &self)
+	s.fleet.record(PeerInfo{NodeID: s.id.NodeID}, self, http.StatusOK, nil, now)
+
+	sem := make(chan struct{}, fleetParallel)
+	var wg sync.WaitGroup
+	for _, p := range s.rankPeers(s.peers.List()) {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return
+		case sem <- struct{}{}:
+		}
+		wg.Add(1)
+		go func(p PeerInfo) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			defer recoverOnce("fleet-collect")
+			rep, code, err := s.collectFleetFrom(p)
+			s.fleet.record(p, rep, code, err, time.Now())
+		}(p)
+	}
+	wg.Wait()
+	s.fleet.mu.Lock()
+	s.fleet.rounds++
+	s.fleet.last = now
+	s.fleet.mu.Unlock()
+}
+
+func (s *Server) startFleetLoop(ctx context.Context) {
+	if !s.cfg.AggregateMetrics {
+		return
+	}
+	every := s.cfg.AggregateInterval
+	if every < minAggregateInterval {
+		every = minAggregateInterval
+	}
+	log.Printf("[fleet] aggregating peer status every %v", every)
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		func() {
+			defer recoverOnce("fleet")
+			s.collectFleet(ctx)
+		}()
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// list returns the nodes, ourselves included, by NodeID.
+func (f *fleetStore) list() []fleetNode {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := make([]fleetNode, 0, len(f.nodes))
+	for _, n := range f.nodes {
+		out = append(out, *n)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].NodeID < out[j].NodeID })
+	return out
+}
+
+func (s *Server) fleetEnabled(w http.ResponseWriter) bool {
+	if !s.cfg.AggregateMetrics {
+		http.Error(w, "not an aggregator; start with --aggregate-metrics", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+// GET /fleet/status (control): every node's last report.
+func (s *Server) handleFleetStatus(w http.ResponseWriter, r *http.Request) {
+	if !s.fleetEnabled(w) {
+		return
+	}
+	s.fleet.mu.Lock()
+	rounds, last := s.fleet.rounds, s.fleet.last
+	s.fleet.mu.Unlock()
+	writeJSON(w, map[string]any{
+		"interval":   s.cfg.AggregateInterval.String(),
+		"rounds":     rounds,
+		"last_round": last,
+		"nodes":      s.fleet.list(),
+	})
+}
+
+var promNameRe = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// flattenMetrics adds the numbers and booleans in v to out, nested keys
+// joined with "_".
+func flattenMetrics(prefix string, v any, out map[string]float64) {
+	switch x := v.(type) {
+	case map[string]any:
+		for k, e := range x {
+			flattenMetrics(prefix+"_"+promNameRe.ReplaceAllString(k, "_"), e, out)
+		}
+	case float64:
+		out[prefix] = x
+	case bool:
+		if x {
+			out[prefix] = 1
+		} else {
+			out[prefix] = 0
+		}
+	}
+}
+
+var (
+	promMetricRe = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	promLabelRe  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*="(?:[^"\\]|\\.)*"$`)
+)
+
+// parsePromText reads the samples of a Prometheus text exposition such as
+// our /metrics. HELP lines and timestamps are dropped, and so is any line
+// that doesn't parse, so a peer can't break the aggregator's output.
+func parsePromText(text string) []promSample {
+	var out []promSample
+	family, typ := "", ""
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if rest, ok := strings.CutPrefix(line, "# TYPE "); ok {
+			if f := strings.Fields(rest); len(f) == 2 && promMetricRe.MatchString(f[0]) {
+				family, typ = f[0], f[1]
+			}
+			continue
+		}
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		var sm promSample
+		rest := line
+		if i := strings.IndexByte(line, '{'); i >= 0 {
+			j := strings.LastIndexByte(line, '}')
+			if j < i {
+				continue
+			}
+			sm.Name, sm.Labels, rest = line[:i], line[i+1:j], line[j+1:]
+			if !validPromLabels(sm.Labels) {
+				continue
+			}
+		} else {
+			sm.Name, rest, _ = strings.Cut(line, " ")
+		}
+		f := strings.Fields(rest)
+		if len(f) == 0 || !promMetricRe.MatchString(sm.Name) {
+			continue
+		}
+		if _, err := strconv.ParseFloat(f[0], 64); err != nil {
+			continue
+		}
+		sm.Value = f[0]
+		sm.Family, sm.Type = sm.Name, "untyped"
+		if family != "" && (sm.Name == family || strings.HasPrefix(sm.Name, family+"_")) {
+			sm.Family, sm.Type = family, typ
+		}
+		out = append(out, sm)
+	}
+	return out
+}
+
+// validPromLabels checks a label list such as `le="0.5",path="memory"`.
+func validPromLabels(s string) bool {
+	for s != "" {
+		// a label value may hold a comma: cut after the closing quote
+		i := strings.Index(s, `="`)
+		if i < 0 {
+			return false
+		}
+		j := i + 2
+		for j < len(s) && s[j] != '"' {
+			if s[j] == '\\' {
+				j++
+			}
+			j++
+		}
+		if j >= len(s) || !promLabelRe.MatchString(s[:j+1]) {
+			return false
+		}
+		s = strings.TrimPrefix(s[j+1:], ",")
+	}
+	return true
+}
+
+// withNodeID puts node_id first in a sample's labels; a node_id the peer
+// sent itself becomes exported_node_id, as Prometheus federation does.
+func withNodeID(node, labels string) string {
+	if strings.HasPrefix(labels, "node_id=") {
+		labels = "exported_" + labels
+	}
+	labels = strings.ReplaceAll(labels, `",node_id="`, `",exported_node_id="`)
+	out := fmt.Sprintf("node_id=%q", node)
+	if labels != "" {
+		out += "," + labels
+	}
+	return out
+}
+
+// GET /fleet/metrics (control): every node's report in Prometheus text
+// format, plus fleet_up and fleet_last_seen_seconds, then every node's own
+// /metrics with a node_id label added.
+func (s *Server) handleFleetMetrics(w http.ResponseWriter, r *http.Request) {
+	if !s.fleetEnabled(w) {
+		return
+	}
+	series := make(map[string]map[string]float64) // metric -> node -> value
+	add := func(name, node string, v float64) {
+		if series[name] == nil {
+			series[name] = make(map[string]float64)
+		}
+		series[name][node] = v
+	}
+	nodes := s.fleet.list()
+	for _, n := range nodes {
+		up := 0.0
+		if n.State == "ok" {
+			up = 1
+		}
+		add("fleet_up", n.NodeID, up)
+		if !n.LastSeen.IsZero() {
+			add("fleet_last_seen_seconds", n.NodeID, float64(n.LastSeen.Unix()))
+		}
+		vals := make(map[string]float64)
+		// round trip so structs in our own report flatten like peers' JSON
+		b, _ := json.Marshal(n.Status)
+		var m map[string]any
+		_ = json.Unmarshal(b, &m)
+		flattenMetrics("fleet", m, vals)
+		for k, v := range vals {
+			add(k, n.NodeID, v)
+		}
+	}
+	names := make([]string, 0, len(series))
+	for k := range series {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, name := range names {
+		fmt.Fprintf(w, "# TYPE %s gauge\n", name)
+		nodes := make([]string, 0, len(series[name]))
+		for id := range series[name] {
+			nodes = append(nodes, id)
+		}
+		sort.Strings(nodes)
+		for _, id := range nodes {
+			fmt.Fprintf(w, "%s{node_id=%q} %g\n", name, id, series[name][id])
+		}
+	}
+
+	// the peers' own metrics, one family at a time; the first node to send
+	// a family sets its type
+	type family struct {
+		typ   string
+		lines []string
+	}
+	families := make(map[string]*family)
+	for _, n := range nodes {
+		for _, sm := range n.Metrics {
+			if strings.HasPrefix(sm.Family, "fleet_") {
+				continue
+			}
+			f := families[sm.Family]
+			if f == nil {
+				f = &family{typ: sm.Type}
+				families[sm.Family] = f
+			}
+			f.lines = append(f.lines, fmt.Sprintf("%s{%s} %s\n", sm.Name, withNodeID(n.NodeID, sm.Labels), sm.Value))
+		}
+	}
+	names = names[:0]
+	for k := range families {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, families[name].typ)
+		for _, l := range families[name].lines {
+			_, _ = io.WriteString(w, l)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func aggregator(t *testing.T) *Server {
+	cfg := defaultConfig()
+	cfg.AggregateMetrics = true
+	return newTestServer(t, "agg", cfg)
+}
+
+// The aggregator serves each peer's own /metrics under its node_id, next to
+// the fleet_ gauges built from the status report.
+func TestFleetMetricsScrapesPeers(t *testing.T) {
+	a, b := aggregator(t), newTestServer(t, "b", nil)
+	meet(t, a, b)
+	b.disco.record("10.0.0.9", beaconMalformed, time.Now())
+	a.collectFleet(context.Background())
+
+	rr := callControl(a, http.MethodGet, "/fleet/metrics", a.ctlToken, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("/fleet/metrics: %d %s", rr.Code, rr.Body)
+	}
+	out := rr.Body.String()
+	for _, want := range []string{
+		`fleet_up{node_id="` + b.id.NodeID + `"} 1`,
+		`discovery_packets_total{node_id="` + b.id.NodeID + `",outcome="malformed"} 1`,
+		`crypto_kdf_seconds_bucket{node_id="` + a.id.NodeID + `",le="+Inf"}`,
+		`crypto_kdf_seconds_count{node_id="` + b.id.NodeID + `"}`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %s", want)
+		}
+	}
+	if strings.Contains(out, `discovery_packets_total{node_id="`+a.id.NodeID+`",outcome="malformed"}`) {
+		t.Error("b's counter shows on the aggregator")
+	}
+	// one TYPE line per family, whatever the number of nodes
+	for _, fam := range []string{"discovery_packets_total counter", "crypto_kdf_seconds histogram"} {
+		if n := strings.Count(out, "# TYPE "+fam+"\n"); n != 1 {
+			t.Errorf("%d TYPE lines for %s", n, fam)
+		}
+	}
+	if strings.Contains(out, "# HELP") {
+		t.Error("HELP lines passed through")
+	}
+
+	// b stops answering: its last metrics stay, with fleet_up 0
+	b.secrets.BeaconKey[0] ^= 1
+	a.collectFleet(context.Background())
+	out = callControl(a, http.MethodGet, "/fleet/metrics", a.ctlToken, nil).Body.String()
+	if !strings.Contains(out, `fleet_up{node_id="`+b.id.NodeID+`"} 0`) || !strings.Contains(out, `discovery_packets_total{node_id="`+b.id.NodeID+`",outcome="malformed"} 1`) {
+		t.Fatalf("stale peer:\n%s", out)
+	}
+}
+
+// A peer on a release whose report has no metrics only gets the fleet_
+// gauges.
+func TestFleetMetricsOlderPeer(t *testing.T) {
+	a := aggregator(t)
+	now := time.Now()
+	a.fleet.record(PeerInfo{NodeID: "old"}, fleetReport{NodeID: "old", Status: map[string]any{"chain_len": 3.0}}, http.StatusOK, nil, now)
+	out := callControl(a, http.MethodGet, "/fleet/metrics", a.ctlToken, nil).Body.String()
+	if !strings.Contains(out, `fleet_chain_len{node_id="old"} 3`) || strings.Contains(out, `_total{node_id="old"`) {
+		t.Fatalf("older peer:\n%s", out)
+	}
+}
+
+func TestParsePromText(t *testing.T) {
+	got := parsePromText(`# HELP x_total things
+# TYPE x_total counter
+x_total{path="a,b"} 2
+x_total{node_id="n1",path="c"} 3
+# TYPE lat_seconds histogram
+lat_seconds_bucket{le="0.5"} 1
+lat_seconds_sum 0.25 1700000000000
+lat_seconds_count 1
+loose 4
+bad name 1
+bad_value{a="b"} x
+bad_labels{a=b} 1
+bad_brace} 1
+injected{a="b"} 1
+`)
+	var lines []string
+	for _, sm := range got {
+		lines = append(lines, sm.Family+"/"+sm.Type+" "+sm.Name+"{"+withNodeID("n", sm.Labels)+"} "+sm.Value)
+	}
+	want := []string{
+		`x_total/counter x_total{node_id="n",path="a,b"} 2`,
+		`x_total/counter x_total{node_id="n",exported_node_id="n1",path="c"} 3`,
+		`lat_seconds/histogram lat_seconds_bucket{node_id="n",le="0.5"} 1`,
+		`lat_seconds/histogram lat_seconds_sum{node_id="n"} 0.25`,
+		`lat_seconds/histogram lat_seconds_count{node_id="n"} 1`,
+		`loose/untyped loose{node_id="n"} 4`,
+		`injected/untyped injected{node_id="n",a="b"} 1`,
+	}
+	if !slices.Equal(lines, want) {
+		t.Fatalf("got\n%s\nwant\n%s", strings.Join(lines, "\n"), strings.Join(want, "\n"))
+	}
+}
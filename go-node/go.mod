@@ -4,9 +4,13 @@ go 1.24.0
 
 require (
 	github.com/libp2p/go-libp2p v0.37.0
+	github.com/multiformats/go-multiaddr v0.13.0
 	golang.org/x/crypto v0.43.0
+	keysaver-server/keysaverclient v0.0.0
 )
 
+replace keysaver-server/keysaverclient => ../keysaver-server/keysaverclient
+
 require (
 	github.com/benbjohnson/clock v1.3.5 // indirect
 	github.com/beorn7/perks v1.0.1 // indirect
@@ -53,7 +57,6 @@ require (
 	github.com/mr-tron/base58 v1.2.0 // indirect
 	github.com/multiformats/go-base32 v0.1.0 // indirect
 	github.com/multiformats/go-base36 v0.2.0 // indirect
-	github.com/multiformats/go-multiaddr v0.13.0 // indirect
 	github.com/multiformats/go-multiaddr-dns v0.4.0 // indirect
 	github.com/multiformats/go-multiaddr-fmt v0.1.0 // indirect
 	github.com/multiformats/go-multibase v0.2.0 // indirect
@@ -0,0 +1,761 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+// Groups. A group is a named set of nodes sharing a symmetric key, so a
+// note reaches all of them end to end without a replicate fanout. The node
+// that defines a group (POST /groups) owns it: for every generation it
+// mints a key, wraps it to each member's X25519 mix key and sends it to
+// that member in its own mix message (type group-key), signed with the
+// owner's Ed25519 key. A member checks the signature against the key it
+// pinned for the owner (key_continuity.go), keeps the newest groupKeepGens
+// keys and answers with a group-key-ack signed by its own key; mix sends
+// have no end-to-end ack otherwise. The owner resends every groupRetry until
+// each member acknowledged the current generation. A membership change
+// mints a new generation that only the remaining members get, so a removed
+// member can't read what follows.
+//
+// POST /mix/send-group?group=<group> seals the text with the current key
+// (the additional data binds group, generation, sender and msgid) and sends
+// one onion per member. A member that opens it keeps it in the inbox and
+// threads it under group:<group> in /mix/conversations. Our own groups are
+// named by their name, other owners' as name@<owner prefix>. Groups live in
+// groups.enc, sealed with the env FileKey.
+
+const (
+	groupsFile        = "groups.enc"
+	groupKeepGens     = 3
+	groupRetry        = time.Minute
+	groupThreadPrefix = "group:"
+
+	mixGroup       = "group"         // FinalEnvelope.Type: a group message
+	mixGroupKey    = "group-key"     // FinalEnvelope.Type: a wrapped group key
+	mixGroupKeyAck = "group-key-ack" // FinalEnvelope.Type: a member took a key
+)
+
+var (
+	groupNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+	errGroupUnknown = errors.New("unknown group")
+)
+
+type groupState struct {
+	Owner   string            `json:"owner"`
+	Name    string            `json:"name"`
+	Members []string          `json:"members"` // sorted, owner included
+	Gen     uint64            `json:"gen"`
+	Keys    map[uint64][]byte `json:"keys"`            // generation -> key, the newest groupKeepGens
+	Taken   map[string]uint64 `json:"taken,omitempty"` // owner only: newest generation each member acknowledged
+	Updated time.Time         `json:"updated"`
+}
+
+// groupView is a group as GET /groups shows it; keys stay out.
+type groupView struct {
+	Group   string    `json:"group"` // what ?group= takes
+	Owner   string    `json:"owner"`
+	Name    string    `json:"name"`
+	Owned   bool      `json:"owned"`
+	Members []string  `json:"members"`
+	Gen     uint64    `json:"gen"`
+	Pending []string  `json:"pending,omitempty"` // owned: members without the current generation yet
+	Updated time.Time `json:"updated"`
+}
+
+func groupID(owner, name string) string { return owner + "/" + name }
+
+// groupLabel names g for the API and its thread.
+func groupLabel(self string, g *groupState) string {
+	if g.Owner == self {
+		return g.Name
+	}
+	return g.Name + "@" + g.Owner[:min(8, len(g.Owner))]
+}
+
+type groupStore struct {
+	path string
+	key  []byte
+	self string
+	kick chan struct{}
+
+	mu sync.Mutex
+	m  map[string]*groupState // groupID
+}
+
+func newGroupStore(paths *EnvPaths, key []byte, self string) *groupStore {
+	gs := &groupStore{path: filepath.Join(paths.BaseDir, groupsFile), key: key, self: self, kick: make(chan struct{}, 1), m: make(map[string]*groupState)}
+	blob, err := os.ReadFile(gs.path)
+	if err != nil {
+		return gs
+	}
+	var list []*groupState
+	plain, err := aeadOpenWithKey(key, blob)
+	if err == nil {
+		err = json.Unmarshal(plain, &list)
+	}
+	wipeBytes(plain)
+	if err != nil {
+		log.Printf("[group] ignoring unreadable %s: %v", gs.path, err)
+		return gs
+	}
+	for _, g := range list {
+		gs.m[groupID(g.Owner, g.Name)] = g
+	}
+	return gs
+}
+
+// saveLocked seals and writes all groups; callers hold gs.mu.
+func (gs *groupStore) saveLocked() {
+	list := make([]*groupState, 0, len(gs.m))
+	for _, g := range gs.m {
+		list = append(list, g)
+	}
+	b, _ := json.Marshal(list)
+	blob, err := aeadSealWithKey(gs.key, b)
+	wipeBytes(b)
+	if err == nil {
+		err = writeFileAtomic(gs.path, blob)
+	}
+	if err != nil {
+		log.Printf("[group] save: %v", err)
+	}
+}
+
+func (gs *groupStore) poke() {
+	select {
+	case gs.kick <- struct{}{}:
+	default:
+	}
+}
+
+// copyGroup returns a copy of g whose maps and members the caller may keep.
+func copyGroup(g *groupState) groupState {
+	out := *g
+	out.Members = slices.Clone(g.Members)
+	out.Keys = make(map[uint64][]byte, len(g.Keys))
+	for gen, k := range g.Keys {
+		out.Keys[gen] = k
+	}
+	out.Taken = make(map[string]uint64, len(g.Taken))
+	for m, gen := range g.Taken {
+		out.Taken[m] = gen
+	}
+	return out
+}
+
+// pruneKeys keeps the newest groupKeepGens keys.
+func (g *groupState) pruneKeys() {
+	for gen := range g.Keys {
+		if gen+groupKeepGens <= g.Gen {
+			delete(g.Keys, gen)
+		}
+	}
+}
+
+func (gs *groupStore) view(g *groupState) groupView {
+	v := groupView{Group: groupLabel(gs.self, g), Owner: g.Owner, Name: g.Name, Owned: g.Owner == gs.self,
+		Members: slices.Clone(g.Members), Gen: g.Gen, Updated: g.Updated}
+	if v.Owned {
+		for _, m := range g.Members {
+			if m != g.Owner && g.Taken[m] < g.Gen {
+				v.Pending = append(v.Pending, m)
+			}
+		}
+	}
+	return v
+}
+
+func (gs *groupStore) list() []groupView {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	out := make([]groupView, 0, len(gs.m))
+	for _, g := range gs.m {
+		out = append(out, gs.view(g))
+	}
+	slices.SortFunc(out, func(a, b groupView) int { return strings.Compare(a.Group, b.Group) })
+	return out
+}
+
+// find resolves a label from ?group=.
+func (gs *groupStore) find(label string) (groupState, bool) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	for _, g := range gs.m {
+		if groupLabel(gs.self, g) == label {
+			return copyGroup(g), true
+		}
+	}
+	return groupState{}, false
+}
+
+// define creates or updates one of our groups. A new group or a changed
+// member list gets a new generation and key.
+func (gs *groupStore) define(name string, members []string) (groupView, error) {
+	members = append(slices.Clone(members), gs.self)
+	slices.Sort(members)
+	members = slices.Compact(members)
+	key, err := newFileKey()
+	if err != nil {
+		return groupView{}, err
+	}
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	id := groupID(gs.self, name)
+	g := gs.m[id]
+	if g == nil {
+		g = &groupState{Owner: gs.self, Name: name, Keys: make(map[uint64][]byte), Taken: make(map[string]uint64)}
+		gs.m[id] = g
+	} else if slices.Equal(g.Members, members) {
+		return gs.view(g), nil
+	}
+	g.Members = members
+	g.Gen++
+	g.Keys[g.Gen] = key[:]
+	g.Taken[gs.self] = g.Gen
+	for m := range g.Taken {
+		if !slices.Contains(members, m) {
+			delete(g.Taken, m)
+		}
+	}
+	g.pruneKeys()
+	g.Updated = time.Now().UTC()
+	gs.saveLocked()
+	gs.poke()
+	return gs.view(g), nil
+}
+
+func (gs *groupStore) remove(label string) bool {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	for id, g := range gs.m {
+		if groupLabel(gs.self, g) == label {
+			delete(gs.m, id)
+			gs.saveLocked()
+			return true
+		}
+	}
+	return false
+}
+
+// owned returns our groups with members still missing the current key.
+func (gs *groupStore) owned() []groupState {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	var out []groupState
+	for _, g := range gs.m {
+		if g.Owner == gs.self && len(gs.view(g).Pending) > 0 {
+			out = append(out, copyGroup(g))
+		}
+	}
+	return out
+}
+
+// took records that member acknowledged generation gen of our group name.
+func (gs *groupStore) took(name, member string, gen uint64) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	g := gs.m[groupID(gs.self, name)]
+	if g == nil || !slices.Contains(g.Members, member) || g.Taken[member] >= gen {
+		return
+	}
+	g.Taken[member] = gen
+	gs.saveLocked()
+}
+
+// receive stores a key an owner sent us. An older generation than the one
+// held is ignored.
+func (gs *groupStore) receive(owner, name string, gen uint64, members []string, key []byte) bool {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	id := groupID(owner, name)
+	g := gs.m[id]
+	if g == nil {
+		g = &groupState{Owner: owner, Name: name, Keys: make(map[uint64][]byte)}
+		gs.m[id] = g
+	}
+	if gen < g.Gen {
+		return false
+	}
+	g.Members, g.Gen, g.Keys[gen] = members, gen, key
+	g.pruneKeys()
+	g.Updated = time.Now().UTC()
+	gs.saveLocked()
+	return true
+}
+
+// ---- crypto ----
+
+// groupKeyMsg is the data of a group-key mix message.
+type groupKeyMsg struct {
+	Owner   string   `json:"owner"`
+	Name    string   `json:"name"`
+	Gen     uint64   `json:"gen"`
+	Members []string `json:"members"`
+	Member  string   `json:"member"`  // the recipient
+	EphPub  string   `json:"eph_pub"` // X25519, base64url
+	Wrapped string   `json:"wrapped"` // the key sealed to X25519(eph, member's mix key)
+	Sig     string   `json:"sig"`     // owner's Ed25519 signature over the fields above
+}
+
+func (m groupKeyMsg) signed() []byte {
+	return []byte(strings.Join([]string{"hz-groupkey", m.Owner, m.Name, strconv.FormatUint(m.Gen, 10),
+		strings.Join(m.Members, ","), m.Member, m.EphPub, m.Wrapped}, "|"))
+}
+
+// wrapGroupKey seals key to a member's mix pubkey.
+func wrapGroupKey(memberPub, key []byte) (ephPub, wrapped []byte, err error) {
+	eph, err := secureRandom(32)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer wipeBytes(eph)
+	if ephPub, err = curve25519.X25519(eph, curve25519.Basepoint); err != nil {
+		return nil, nil, err
+	}
+	shared, err := curve25519.X25519(eph, memberPub)
+	if err != nil {
+		return nil, nil, err
+	}
+	wrapped, err = aeadEncrypt(sharedToKey(shared), key)
+	return ephPub, wrapped, err
+}
+
+func unwrapGroupKey(priv, ephPub, wrapped []byte) ([]byte, error) {
+	shared, err := curve25519.X25519(priv, ephPub)
+	if err != nil {
+		return nil, err
+	}
+	return aeadDecrypt(sharedToKey(shared), wrapped)
+}
+
+func groupAD(owner, name string, gen uint64, sender, msgid string) []byte {
+	return []byte("hz-group|" + owner + "|" + name + "|" + strconv.FormatUint(gen, 10) + "|" + sender + "|" + msgid)
+}
+
+func groupSeal(key, ad, plain []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := secureRandom(chacha20poly1305.NonceSizeX)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plain, ad), nil
+}
+
+func groupOpen(key, ad, blob []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(blob) < chacha20poly1305.NonceSizeX {
+		return nil, errors.New("ciphertext too short")
+	}
+	return aead.Open(nil, blob[:chacha20poly1305.NonceSizeX], blob[chacha20poly1305.NonceSizeX:], ad)
+}
+
+// ---- sending ----
+
+// sendMix routes env to env.ReceiverID through a fresh path of class and
+// returns the first hop, which took it when the error is nil.
+func (s *Server) sendMix(env FinalEnvelope, className string, class mixClass) (string, error) {
+	if s.dups.duplicated(env.ReceiverID) {
+		return "", errors.New("NodeID is held by more than one machine")
+	}
+	hops, _, err := s.mixPath(class.Path, env.ReceiverID, class.Hops)
+	if err != nil {
+		return "", err
+	}
+	envBytes, _ := json.Marshal(env)
+	onion, err := buildOnion(hops, envBytes, mixTTL, env.MsgID, "", className, class.PadCell)
+	if err != nil {
+		return "", err
+	}
+	for attempt := 0; ; attempt++ {
+		resp, first, err := s.postToAddr(hops[0].Addr, "/mix/relay", onion, onionHeader(firstForm(hops, class.PadCell)))
+		if err == nil {
+			msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return first, nil
+			}
+			err = fmt.Errorf("HTTP %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+			if resp.StatusCode < 500 || resp.StatusCode == http.StatusInsufficientStorage {
+				return first, err
+			}
+		}
+		if attempt >= class.Retries {
+			return "", err
+		}
+		time.Sleep(time.Duration(attempt+1) * 500 * time.Millisecond)
+	}
+}
+
+// sendGroupKey wraps g's current key to member and sends it.
+func (s *Server) sendGroupKey(g groupState, member string) error {
+	p, ok := s.peers.Get(member)
+	if !ok || len(p.PubKey) != 32 {
+		return errors.New("member's mix key not known")
+	}
+	priv, err := receiptKey(s.paths)
+	if err != nil {
+		return err
+	}
+	ephPub, wrapped, err := wrapGroupKey(p.PubKey, g.Keys[g.Gen])
+	if err != nil {
+		return err
+	}
+	m := groupKeyMsg{Owner: g.Owner, Name: g.Name, Gen: g.Gen, Members: g.Members, Member: member,
+		EphPub: base64.RawURLEncoding.EncodeToString(ephPub), Wrapped: base64.RawURLEncoding.EncodeToString(wrapped)}
+	m.Sig = base64.RawURLEncoding.EncodeToString(ed25519.Sign(priv, m.signed()))
+	data, _ := json.Marshal(m)
+	msgid, err := randomMsgID()
+	if err != nil {
+		return err
+	}
+	class, _ := s.cfg.mixClassFor(defaultMixClass)
+	_, err = s.sendMix(FinalEnvelope{
+		Type:       mixGroupKey,
+		SenderID:   s.id.NodeID,
+		ReceiverID: member,
+		MsgID:      msgid,
+		DataB64:    base64.RawURLEncoding.EncodeToString(data),
+		Logical:    s.lamport.tick(),
+		SentUnix:   time.Now().Unix(),
+	}, defaultMixClass, class)
+	return err
+}
+
+// distributeGroupKeys sends the current key of our groups to every member
+// that hasn't acknowledged it yet.
+func (s *Server) distributeGroupKeys(ctx context.Context) {
+	for _, g := range s.groups.owned() {
+		for _, m := range s.groups.view(&g).Pending {
+			if ctx.Err() != nil {
+				return
+			}
+			if err := s.sendGroupKey(g, m); err != nil {
+				log.Printf("[group] %s gen %d to %.8s: %v", g.Name, g.Gen, m, err)
+			}
+		}
+	}
+}
+
+func (s *Server) startGroupKeyLoop(ctx context.Context) {
+	ticker := time.NewTicker(groupRetry)
+	defer ticker.Stop()
+	for {
+		s.distributeGroupKeys(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.groups.kick:
+		case <-ticker.C:
+		}
+	}
+}
+
+// ---- receiving (final hop) ----
+
+// acceptGroupKey handles a group-key message sent to us.
+func (s *Server) acceptGroupKey(env *FinalEnvelope, data []byte) (int, error) {
+	var m groupKeyMsg
+	if err := json.Unmarshal(data, &m); err != nil {
+		return http.StatusBadRequest, errors.New("bad group key message")
+	}
+	if m.Owner != env.SenderID || m.Member != s.id.NodeID || m.Owner == s.id.NodeID ||
+		!groupNameRe.MatchString(m.Name) || !slices.Contains(m.Members, s.id.NodeID) {
+		return http.StatusBadRequest, errors.New("group key message not for us")
+	}
+	owner, ok := s.peers.Get(m.Owner)
+	if !ok || len(owner.SignKey) != ed25519.PublicKeySize {
+		return http.StatusForbidden, errors.New("owner's signing key not pinned yet")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(m.Sig)
+	if err != nil || !ed25519.Verify(owner.SignKey, m.signed(), sig) {
+		return http.StatusForbidden, errors.New("bad owner signature")
+	}
+	ephPub, err1 := base64.RawURLEncoding.DecodeString(m.EphPub)
+	wrapped, err2 := base64.RawURLEncoding.DecodeString(m.Wrapped)
+	if err1 != nil || err2 != nil {
+		return http.StatusBadRequest, errors.New("bad wrapped key")
+	}
+	key, err := unwrapGroupKey(s.nodeKeys.Priv[:], ephPub, wrapped)
+	if err != nil || len(key) != 32 {
+		return http.StatusForbidden, errors.New("group key doesn't unwrap with our mix key")
+	}
+	members := slices.Clone(m.Members)
+	slices.Sort(members)
+	if s.groups.receive(m.Owner, m.Name, m.Gen, members, key) {
+		log.Printf("[group] %s@%.8s gen %d: key taken, %d members", m.Name, m.Owner, m.Gen, len(members))
+	}
+	ack := groupKeyAck{Owner: m.Owner, Name: m.Name, Gen: m.Gen, Member: s.id.NodeID}
+	s.fwdPool.submit(func() { s.sendGroupKeyAck(ack) })
+	return http.StatusOK, nil
+}
+
+// groupKeyAck is the data of a group-key-ack mix message.
+type groupKeyAck struct {
+	Owner  string `json:"owner"`
+	Name   string `json:"name"`
+	Gen    uint64 `json:"gen"`
+	Member string `json:"member"`
+	Sig    string `json:"sig"` // member's Ed25519 signature over the fields above
+}
+
+func (a groupKeyAck) signed() []byte {
+	return []byte(strings.Join([]string{"hz-groupack", a.Owner, a.Name, strconv.FormatUint(a.Gen, 10), a.Member}, "|"))
+}
+
+// sendGroupKeyAck tells the owner we hold a generation. A lost ack only
+// costs a resend of the key.
+func (s *Server) sendGroupKeyAck(a groupKeyAck) {
+	priv, err := receiptKey(s.paths)
+	if err != nil {
+		return
+	}
+	a.Sig = base64.RawURLEncoding.EncodeToString(ed25519.Sign(priv, a.signed()))
+	data, _ := json.Marshal(a)
+	msgid, err := randomMsgID()
+	if err != nil {
+		log.Printf("[group] ack of %s gen %d: %v", a.Name, a.Gen, err)
+		return
+	}
+	class, _ := s.cfg.mixClassFor(defaultMixClass)
+	if _, err := s.sendMix(FinalEnvelope{
+		Type:       mixGroupKeyAck,
+		SenderID:   s.id.NodeID,
+		ReceiverID: a.Owner,
+		MsgID:      msgid,
+		DataB64:    base64.RawURLEncoding.EncodeToString(data),
+		Logical:    s.lamport.tick(),
+		SentUnix:   time.Now().Unix(),
+	}, defaultMixClass, class); err != nil {
+		log.Printf("[group] ack of %s gen %d to %.8s: %v", a.Name, a.Gen, a.Owner, err)
+	}
+}
+
+// acceptGroupKeyAck handles a member's ack of one of our groups' keys.
+func (s *Server) acceptGroupKeyAck(env *FinalEnvelope, data []byte) (int, error) {
+	var a groupKeyAck
+	if err := json.Unmarshal(data, &a); err != nil || a.Owner != s.id.NodeID || a.Member != env.SenderID {
+		return http.StatusBadRequest, errors.New("bad group key ack")
+	}
+	p, ok := s.peers.Get(a.Member)
+	if !ok || len(p.SignKey) != ed25519.PublicKeySize {
+		return http.StatusForbidden, errors.New("member's signing key not pinned yet")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(a.Sig)
+	if err != nil || !ed25519.Verify(p.SignKey, a.signed(), sig) {
+		return http.StatusForbidden, errors.New("bad member signature")
+	}
+	s.groups.took(a.Name, a.Member, a.Gen)
+	log.Printf("[group] %s gen %d acknowledged by %.8s", a.Name, a.Gen, a.Member)
+	return http.StatusOK, nil
+}
+
+// openGroupMessage opens a group message sent to us and returns the
+// group's label and the text.
+func (s *Server) openGroupMessage(env *FinalEnvelope, data []byte) (string, []byte, int, error) {
+	gs := s.groups
+	gs.mu.Lock()
+	g := gs.m[groupID(env.GroupOwner, env.Group)]
+	var key []byte
+	var label string
+	member := false
+	if g != nil {
+		key, label, member = g.Keys[env.GroupGen], groupLabel(gs.self, g), slices.Contains(g.Members, env.SenderID)
+	}
+	gs.mu.Unlock()
+	switch {
+	case g == nil:
+		return "", nil, http.StatusNotFound, errGroupUnknown
+	case !member:
+		return "", nil, http.StatusForbidden, errors.New("sender is not a group member")
+	case key == nil:
+		return "", nil, http.StatusConflict, errors.New("group generation not held")
+	}
+	text, err := groupOpen(key, groupAD(env.GroupOwner, env.Group, env.GroupGen, env.SenderID, env.MsgID), data)
+	if err != nil {
+		return "", nil, http.StatusForbidden, errors.New("group message doesn't open")
+	}
+	return label, text, http.StatusOK, nil
+}
+
+// ---- control API ----
+
+// GET /groups (control): our groups and the ones we were given a key for.
+// POST /groups?name=<name> with {"members": [NodeID, ...]}: define or
+// change one of ours. DELETE /groups?group=<group>: forget a group.
+func (s *Server) handleGroups(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, s.groups.list())
+	case http.MethodPost:
+		name := r.URL.Query().Get("name")
+		if !groupNameRe.MatchString(name) {
+			http.Error(w, "name must be 1-64 of A-Z a-z 0-9 . _ -", http.StatusBadRequest)
+			return
+		}
+		var req struct {
+			Members []string `json:"members"`
+		}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil {
+			http.Error(w, "bad json: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		members := make([]string, 0, len(req.Members))
+		for _, v := range req.Members {
+			id, ok := s.nodeIDParam(w, "members", v)
+			if !ok {
+				return
+			}
+			if id != "" {
+				members = append(members, id)
+			}
+		}
+		v, err := s.groups.define(name, members)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, v)
+	case http.MethodDelete:
+		if !s.groups.remove(r.URL.Query().Get("group")) {
+			http.Error(w, errGroupUnknown.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, map[string]any{"status": "ok"})
+	default:
+		http.Error(w, "use GET, POST or DELETE", http.StatusMethodNotAllowed)
+	}
+}
+
+// groupSendResult is one member's outcome of a group send.
+type groupSendResult struct {
+	Member   string `json:"member"`
+	FirstHop string `json:"first_hop,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// POST /mix/send-group?group=<group>[&class=][&expires_in=] (control):
+// body is the text; one onion per member.
+func (s *Server) handleSendGroup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	g, ok := s.groups.find(q.Get("group"))
+	if !ok {
+		http.Error(w, errGroupUnknown.Error(), http.StatusNotFound)
+		return
+	}
+	key := g.Keys[g.Gen]
+	if key == nil {
+		http.Error(w, "no key for the group's current generation", http.StatusConflict)
+		return
+	}
+	className := q.Get("class")
+	if className == "" {
+		className = defaultMixClass
+	}
+	class, ok := s.cfg.mixClassFor(className)
+	if !ok {
+		http.Error(w, "unknown class; one of "+strings.Join(mixClassNames(s.cfg.MixClasses), ", "), http.StatusBadRequest)
+		return
+	}
+	class, err := applyMixOverrides(class, q)
+	if err != nil {
+		http.Error(w, "bad class override: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var expires int64
+	if v := q.Get("expires_in"); v != "" {
+		d, err := parseRetentionAge(v)
+		if err != nil {
+			http.Error(w, "bad expires_in: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		expires = time.Now().Add(d).Unix()
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	msgid, err := randomMsgID()
+	if err != nil {
+		http.Error(w, "msgid: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ct, err := groupSeal(key, groupAD(g.Owner, g.Name, g.Gen, s.id.NodeID, msgid), body)
+	if err != nil {
+		http.Error(w, "encrypt fail: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logical := s.lamport.tick()
+	results := []groupSendResult{}
+	sent := 0
+	for _, m := range g.Members {
+		if m == s.id.NodeID {
+			continue
+		}
+		res := groupSendResult{Member: m}
+		res.FirstHop, err = s.sendMix(FinalEnvelope{
+			Type:       mixGroup,
+			SenderID:   s.id.NodeID,
+			ReceiverID: m,
+			MsgID:      msgid,
+			DataB64:    base64.RawURLEncoding.EncodeToString(ct),
+			Logical:    logical,
+			SentUnix:   time.Now().Unix(),
+			Expires:    expires,
+			Group:      g.Name,
+			GroupOwner: g.Owner,
+			GroupGen:   g.Gen,
+		}, className, class)
+		if err != nil {
+			res.Error = err.Error()
+		} else {
+			sent++
+		}
+		results = append(results, res)
+	}
+	label := groupLabel(s.id.NodeID, &g)
+	s.convs.add(s.id.NodeID, groupThreadPrefix+label, convMessage{MsgID: msgid, Dir: convOut, Text: string(body), Logical: logical, At: time.Now().Unix(), State: "sent"})
+	status, code := "sent", http.StatusOK
+	switch {
+	case sent == 0 && len(results) > 0:
+		status, code = "failed", http.StatusBadGateway
+	case sent < len(results):
+		status = "partial"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]any{"status": status, "msgid": msgid, "group": label, "gen": g.Gen, "sent": sent, "members": results})
+}
@@ -4,9 +4,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"io" // <-- added
+	"log"
 	"net"
 	"net/http"
 	"os"
+	"time"
 	// <-- added
 )
 
@@ -19,8 +21,10 @@ func (n *Node) serveHTTP() {
 			PeerID string   `json:"peerId"`
 			Addrs  []string `json:"addrs"`
 			Geo    string   `json:"geo"`
+			NAT    string   `json:"nat"`        // AutoNAT reachability: Unknown, Public or Private
+			Relays []string `json:"relayAddrs"` // dial these when NAT is Private
 		}
-		out := resp{NodeID: n.nodeID, PeerID: n.peerID.String(), Geo: n.geo}
+		out := resp{NodeID: n.nodeID, PeerID: n.peerID.String(), Geo: n.geo, NAT: n.natStatus(), Relays: n.relayAddrs()}
 		for _, a := range n.h.Addrs() {
 			out.Addrs = append(out.Addrs, fmt.Sprintf("%s/p2p/%s", a, n.peerID))
 		}
@@ -42,16 +46,21 @@ func (n *Node) serveHTTP() {
 	})
 
 	mux.HandleFunc("/peers", func(w http.ResponseWriter, r *http.Request) {
-		type pr struct{ ID, RTT string }
+		type pr struct{ ID, RTT, Path string } // Path: direct or relayed
 		var list []pr
 		n.latMu.Lock()
 		for _, p := range n.h.Network().Peers() {
-			list = append(list, pr{p.String(), n.rtts[p].String()})
+			list = append(list, pr{p.String(), n.rtts[p].String(), n.peerPath(p)})
 		}
 		n.latMu.Unlock()
 		_ = json.NewEncoder(w).Encode(list)
 	})
 
+	mux.HandleFunc("/peers/connect", n.handlePeerConnect)
+	mux.HandleFunc("/peers/disconnect", n.handlePeerDisconnect)
+	mux.HandleFunc("/peers/protect", n.handlePeerProtect)
+	mux.HandleFunc("/peers/detail", n.handlePeerDetail)
+
 	mux.HandleFunc("/nearest", func(w http.ResponseWriter, r *http.Request) {
 		id, rtt := n.nearestPeer()
 		_ = json.NewEncoder(w).Encode(struct{ PeerID, RTT string }{id.String(), rtt.String()})
@@ -91,14 +100,21 @@ func (n *Node) serveHTTP() {
 		}
 		var out []item
 		for id, m := range n.manifests {
+			if n.quarantine.held(id) {
+				continue
+			}
 			comp := len(n.recvMap[id]) == m.Chunks
 			out = append(out, item{id, m.FileName, m.Chunks, comp})
 		}
 		_ = json.NewEncoder(w).Encode(out)
 	})
 
-	s := &http.Server{Addr: httpAddr, Handler: logReq(mux)}
-	go s.ListenAndServe()
+	n.httpSrv = &http.Server{Addr: n.httpAddr, Handler: logReq(mux), ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		if err := n.httpSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("[p2p] local API on %s: %v", n.httpAddr, err)
+		}
+	}()
 }
 func handleFileSend(n *Node) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -116,7 +132,11 @@ func handleFileSend(n *Node) http.HandlerFunc {
 			return
 		}
 		defer f.Close()
-		tmp := tempUploadPath(hdr.Filename)
+		tmp, err := tempUploadPath(n.tmpDir, hdr.Filename)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		out, err := os.Create(tmp)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
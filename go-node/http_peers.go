@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const dialTimeout = 15 * time.Second
+
+// POST /peers/connect  body: multiaddr ending in /p2p/<peerID> (plain text or {"addr":...})
+func (n *Node) handlePeerConnect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	raw, err := io.ReadAll(io.LimitReader(r.Body, 4096))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	addr := trim(string(raw))
+	if strings.HasPrefix(addr, "{") {
+		var req struct{ Addr string }
+		if json.Unmarshal(raw, &req) != nil {
+			http.Error(w, "bad json", http.StatusBadRequest)
+			return
+		}
+		addr = trim(req.Addr)
+	}
+	info, err := peer.AddrInfoFromString(addr)
+	if err != nil {
+		http.Error(w, "bad multiaddr: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), dialTimeout)
+	defer cancel()
+	if err := n.h.Connect(ctx, *info); err != nil {
+		http.Error(w, "dial "+info.ID.String()+": "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(struct{ PeerID, Status string }{info.ID.String(), "connected"})
+}
+
+// POST /peers/disconnect?id=<peerID>
+func (n *Node) handlePeerDisconnect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	id, ok := queryPeerID(w, r)
+	if !ok {
+		return
+	}
+	if len(n.h.Network().ConnsToPeer(id)) == 0 {
+		http.Error(w, "not connected", http.StatusNotFound)
+		return
+	}
+	if err := n.h.Network().ClosePeer(id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST /peers/protect?id=&tag=  keeps the connection out of the connection
+// manager's trimming; DELETE with the same query unprotects it.
+func (n *Node) handlePeerProtect(w http.ResponseWriter, r *http.Request) {
+	id, ok := queryPeerID(w, r)
+	if !ok {
+		return
+	}
+	tag := trim(r.URL.Query().Get("tag"))
+	if tag == "" {
+		http.Error(w, "missing tag", http.StatusBadRequest)
+		return
+	}
+	cm := n.h.ConnManager()
+	switch r.Method {
+	case "POST":
+		cm.Protect(id, tag)
+	case "DELETE":
+		cm.Unprotect(id, tag)
+	default:
+		http.Error(w, "POST or DELETE", http.StatusMethodNotAllowed)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(struct {
+		PeerID    string
+		Tag       string
+		Protected bool
+	}{id.String(), tag, cm.IsProtected(id, tag)})
+}
+
+type connDetail struct {
+	Transport string
+	Remote    string
+	Direction string
+	Age       string
+	Streams   map[string]int // open streams by protocol
+}
+
+type peerDetail struct {
+	PeerID    string
+	RTT       string
+	ChunkSize int // what a file sent now would use (chunk_size.go)
+	Protected bool
+	Conns     []connDetail
+}
+
+// GET /peers/detail
+func (n *Node) handlePeerDetail(w http.ResponseWriter, r *http.Request) {
+	nw := n.h.Network()
+	cm := n.h.ConnManager()
+	n.latMu.Lock()
+	rtts := make(map[peer.ID]time.Duration, len(n.rtts))
+	for k, v := range n.rtts {
+		rtts[k] = v
+	}
+	n.latMu.Unlock()
+
+	out := []peerDetail{}
+	for _, p := range nw.Peers() {
+		d := peerDetail{PeerID: p.String(), RTT: rtts[p].String(), ChunkSize: n.chunkSizeFor(p), Protected: cm.IsProtected(p, "")}
+		for _, c := range nw.ConnsToPeer(p) {
+			st := c.Stat()
+			cd := connDetail{
+				Transport: c.ConnState().Transport,
+				Remote:    fmt.Sprint(c.RemoteMultiaddr()),
+				Direction: st.Direction.String(),
+				Age:       time.Since(st.Opened).Round(time.Second).String(),
+				Streams:   map[string]int{},
+			}
+			for _, s := range c.GetStreams() {
+				cd.Streams[string(s.Protocol())]++
+			}
+			d.Conns = append(d.Conns, cd)
+		}
+		out = append(out, d)
+	}
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+func queryPeerID(w http.ResponseWriter, r *http.Request) (peer.ID, bool) {
+	id, err := peer.Decode(trim(r.URL.Query().Get("id")))
+	if err != nil {
+		http.Error(w, "bad peer id: "+err.Error(), http.StatusBadRequest)
+		return "", false
+	}
+	return id, true
+}
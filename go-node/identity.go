@@ -9,7 +9,12 @@ import (
 	"strings"
 )
 
-func buildNodeIdentity() NodeIdentity {
+// buildNodeIdentity derives the NodeID from the machine. A non-empty
+// instance (see instanceName) is mixed in so nodes sharing a host differ,
+// and so are the board serial and display (fingerprint_hw.go) when there
+// are any: a machine without them keeps the NodeID it had before they
+// were collected.
+func buildNodeIdentity(instance, sn, disp string) NodeIdentity {
 	attrs := map[string]string{
 		"goos":   runtime.GOOS,
 		"goarch": runtime.GOARCH,
@@ -39,6 +44,18 @@ func buildNodeIdentity() NodeIdentity {
 
 	// Deterministic hash over ordered keys
 	keys := []string{"macs", "osver", "win_build", "win_install_date", "machine_guid", "board_name", "hostname", "goos", "goarch"}
+	if instance != "" {
+		attrs["instance"] = instance
+		keys = append(keys, "instance")
+	}
+	if sn != "" {
+		attrs["sn"] = sn
+		keys = append(keys, "sn")
+	}
+	if disp != "" {
+		attrs["disp"] = disp
+		keys = append(keys, "disp")
+	}
 	var buf bytes.Buffer
 	for _, k := range keys {
 		buf.WriteString(k + "=" + attrs[k] + ";")
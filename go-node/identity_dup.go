@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Duplicate identities. VM templates and disk clones derive the same
+// NodeID on every copy. The listener notes which source IPs beacon each
+// NodeID and with which mix pubkey (full beacons carry it); two IPs that
+// beacon one NodeID at the same time with different pubkeys are two
+// machines. The NodeID is then left out of fanout and mix paths, /status
+// carries a duplicate_identity alert and an identity.duplicate event goes
+// out. Our own NodeID counts too: another machine beaconing it with a
+// different pubkey means we are a clone. The conflict clears once only one
+// machine has beaconed for dupWindow.
+//
+// POST /identity/regenerate mints a random NodeID into identity.json, which
+// overrides the fingerprint from then on. The running node stops beaconing
+// its old NodeID at once; the new one is announced after a restart.
+
+const (
+	dupWindow    = 3 * time.Minute // sightings older than this are forgotten
+	identityFile = "identity.json"
+	alertDupID   = "duplicate_identity"
+)
+
+// identitySighting is one source IP beaconing a NodeID.
+type identitySighting struct {
+	IP     string    `json:"ip"`
+	PubKey string    `json:"pubkey,omitempty"` // from the last full beacon
+	First  time.Time `json:"first"`
+	Last   time.Time `json:"last"`
+}
+
+// overlaps reports whether a and b beaconed at the same time, as opposed to
+// one node that restarted (new pubkey) on a new address.
+func (a identitySighting) overlaps(b identitySighting) bool {
+	return !a.Last.Before(b.First) && !b.Last.Before(a.First)
+}
+
+type dupConflict struct {
+	NodeID  string             `json:"node_id"`
+	Self    bool               `json:"self"` // our own NodeID: we are one of the clones
+	Since   time.Time          `json:"since"`
+	Sources []identitySighting `json:"sources"`
+}
+
+type dupDetector struct {
+	selfID  string
+	selfPub string
+	started time.Time
+	onFlag  func(dupConflict)
+
+	mu      sync.Mutex
+	seen    map[string]map[string]*identitySighting // node -> ip -> sighting
+	flagged map[string]*dupConflict
+}
+
+func newDupDetector(selfID, selfPub string, onFlag func(dupConflict)) *dupDetector {
+	return &dupDetector{
+		selfID:  selfID,
+		selfPub: selfPub,
+		started: time.Now(),
+		onFlag:  onFlag,
+		seen:    make(map[string]map[string]*identitySighting),
+		flagged: make(map[string]*dupConflict),
+	}
+}
+
+// observe records a beacon for nodeID from ip; pubkey is "" for minimal
+// beacons.
+func (d *dupDetector) observe(nodeID, ip, pubkey string, now time.Time) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	srcs := d.seen[nodeID]
+	if srcs == nil {
+		srcs = make(map[string]*identitySighting)
+		d.seen[nodeID] = srcs
+	}
+	sg := srcs[ip]
+	if sg == nil || (pubkey != "" && sg.PubKey != "" && pubkey != sg.PubKey) {
+		sg = &identitySighting{IP: ip, First: now} // new source, or it restarted
+		srcs[ip] = sg
+	}
+	sg.Last = now
+	if pubkey != "" {
+		sg.PubKey = pubkey
+	}
+	for k, v := range srcs {
+		if now.Sub(v.Last) > dupWindow {
+			delete(srcs, k)
+		}
+	}
+	conflicting := d.conflictingLocked(nodeID, srcs, now)
+	c, was := d.flagged[nodeID]
+	switch {
+	case conflicting != nil && !was:
+		c = &dupConflict{NodeID: nodeID, Self: nodeID == d.selfID, Since: now, Sources: conflicting}
+		d.flagged[nodeID] = c
+	case conflicting != nil:
+		c.Sources = conflicting
+		c = nil // already reported
+	case was && now.Sub(c.Sources[len(c.Sources)-1].Last) > dupWindow:
+		delete(d.flagged, nodeID)
+		log.Printf("[identity] %.8s: only one machine left, duplicate cleared", nodeID)
+		c = nil
+	default:
+		c = nil
+	}
+	d.mu.Unlock()
+	if c != nil && d.onFlag != nil {
+		d.onFlag(*c)
+	}
+}
+
+// conflictingLocked returns the sources of nodeID that beaconed at the same
+// time with different pubkeys, or nil. Our own NodeID is always "beaconing"
+// with our pubkey.
+func (d *dupDetector) conflictingLocked(nodeID string, srcs map[string]*identitySighting, now time.Time) []identitySighting {
+	all := make([]identitySighting, 0, len(srcs)+1)
+	if nodeID == d.selfID {
+		all = append(all, identitySighting{IP: "self", PubKey: d.selfPub, First: d.started, Last: now})
+	}
+	for _, v := range srcs {
+		if v.PubKey != "" {
+			all = append(all, *v)
+		}
+	}
+	seen := make(map[string]identitySighting)
+	for i, a := range all {
+		for _, b := range all[i+1:] {
+			if a.IP != b.IP && a.PubKey != b.PubKey && a.overlaps(b) {
+				seen[a.IP], seen[b.IP] = a, b
+			}
+		}
+	}
+	if len(seen) == 0 {
+		return nil
+	}
+	out := make([]identitySighting, 0, len(seen))
+	for _, v := range seen {
+		out = append(out, v)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Last.Before(out[j].Last) })
+	return out
+}
+
+// duplicated reports whether nodeID is flagged; such peers are not routed to.
+func (d *dupDetector) duplicated(nodeID string) bool {
+	if d == nil {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, ok := d.flagged[nodeID]
+	return ok
+}
+
+// conflicts lists the flagged NodeIDs, dropping ones no longer seen twice.
+func (d *dupDetector) conflicts(now time.Time) []dupConflict {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	out := make([]dupConflict, 0, len(d.flagged))
+	for id, c := range d.flagged {
+		if now.Sub(c.Sources[len(c.Sources)-1].Last) > dupWindow {
+			delete(d.flagged, id)
+			continue
+		}
+		cp := *c
+		cp.Sources = append([]identitySighting(nil), c.Sources...)
+		out = append(out, cp)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].NodeID < out[j].NodeID })
+	return out
+}
+
+// identityConflict is the detector's onFlag.
+func (s *Server) identityConflict(c dupConflict) {
+	if c.Self {
+		log.Printf("[identity] WARNING: another machine beacons our NodeID %.8s with a different key; this looks like a cloned machine, run POST /identity/regenerate on one of them", c.NodeID)
+	} else {
+		log.Printf("[identity] WARNING: NodeID %.8s is beaconed by %d machines; not routing to it", c.NodeID, len(c.Sources))
+	}
+	ips := make([]string, 0, len(c.Sources))
+	for _, sg := range c.Sources {
+		ips = append(ips, sg.IP)
+	}
+	s.emit(eventIdentityDuplicate, map[string]any{"node_id": c.NodeID, "self": c.Self, "sources": ips})
+}
+
+// routable drops peers whose NodeID is held by more than one machine.
+func (s *Server) routable(peers []PeerInfo) []PeerInfo {
+	out := make([]PeerInfo, 0, len(peers))
+	for _, p := range peers {
+		if !s.dups.duplicated(p.NodeID) {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// ---- persisted identity ----
+
+// persistedIdentity is identity.json: a NodeID that replaces the
+// fingerprint, and the cached hardware fingerprint inputs
+// (fingerprint_hw.go). Either may be missing.
+type persistedIdentity struct {
+	NodeID      string      `json:"node_id,omitempty"`
+	Previous    string      `json:"previous,omitempty"`
+	Created     string      `json:"created,omitempty"`
+	Fingerprint *fpHardware `json:"fingerprint,omitempty"`
+}
+
+// loadNodeIdentity builds the identity of the node in paths, taking the
+// NodeID from identity.json when one was minted or pinned.
+func loadNodeIdentity(paths *EnvPaths) NodeIdentity {
+	hw := fingerprintHardware(paths)
+	id := buildNodeIdentity(instanceName(paths), trySerial(hw), primaryDisplay(hw))
+	fp := filepath.Join(paths.BaseDir, identityFile)
+	pi, err := readPersistedIdentity(fp)
+	if errors.Is(err, os.ErrNotExist) || (err == nil && pi.NodeID == "") {
+		return id
+	}
+	if err != nil || !validHexID(pi.NodeID) {
+		log.Printf("[identity] ignoring bad %s", fp)
+		return id
+	}
+	id.Attrs["fingerprint_id"] = id.NodeID
+	id.NodeID = pi.NodeID
+	return id
+}
+
+func validHexID(s string) bool {
+	b, err := hex.DecodeString(s)
+	return err == nil && len(b) == 32
+}
+
+// mintIdentity writes a fresh random NodeID to identity.json.
+func mintIdentity(paths *EnvPaths, previous string) (string, error) {
+	b, err := secureRandom(32)
+	if err != nil {
+		return "", err
+	}
+	fp := filepath.Join(paths.BaseDir, identityFile)
+	old, _ := readPersistedIdentity(fp)
+	pi := persistedIdentity{NodeID: hex.EncodeToString(b), Previous: previous, Created: time.Now().UTC().Format(time.RFC3339), Fingerprint: old.Fingerprint}
+	if err := writePersistedIdentity(fp, pi); err != nil {
+		return "", err
+	}
+	return pi.NodeID, nil
+}
+
+// POST /identity/regenerate (control, token): mint a new NodeID for the
+// next start and stop beaconing the current one.
+func (s *Server) handleIdentityRegenerate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := mintIdentity(s.paths, s.id.NodeID)
+	if err != nil {
+		http.Error(w, "persist: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.retired.Store(true)
+	log.Printf("[identity] regenerated: %.8s -> %.8s; beacons stopped until restart", s.id.NodeID, id)
+	writeJSON(w, map[string]any{"status": "regenerated", "node_id": id, "previous": s.id.NodeID, "restart_required": true})
+}
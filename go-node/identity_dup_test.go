@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func pubB64(b byte) string { return base64.RawURLEncoding.EncodeToString(key32(b)) }
+
+// Two machines beaconing one NodeID with different keys, through the
+// listener: flagged, reported in /status, announced, and not routed to.
+func TestDuplicateIdentityThroughListener(t *testing.T) {
+	s := newTestServer(t, "s", nil)
+	events, cancel, _ := s.events.subscribe()
+	defer cancel()
+	clone := strings.Repeat("c", 64)
+	beacon := func(ip string, key byte) {
+		t.Helper()
+		b := Beacon{NodeID: clone, APIPort: 1, API: apiVersion, PubKey: pubB64(key)}
+		if out := hearBeacon(s, ip, b, nil); out != beaconAccepted {
+			t.Fatal(out)
+		}
+	}
+
+	// one machine that restarted (new key) on a new address is not a clone
+	beacon("10.0.0.2", 1)
+	beacon("10.0.0.3", 2)
+	if s.dups.duplicated(clone) {
+		t.Fatal("a restart on a new address flagged as a duplicate")
+	}
+	// ... but the first address beaconing again means both are up
+	beacon("10.0.0.2", 1)
+	if !s.dups.duplicated(clone) {
+		t.Fatal("two live machines with one NodeID not flagged")
+	}
+	for got := false; !got; { // peer.appeared and the like come first
+		select {
+		case ev := <-events:
+			got = ev.Type == eventIdentityDuplicate && ev.Data.(map[string]any)["node_id"] == clone
+		case <-time.After(time.Second):
+			t.Fatal("no identity.duplicate event")
+		}
+	}
+
+	var st StatusResponse
+	rr := callControl(s, http.MethodGet, "/status", "", nil)
+	if err := json.Unmarshal(rr.Body.Bytes(), &st); err != nil {
+		t.Fatal(err)
+	}
+	if len(st.Alerts) != 1 || st.Alerts[0] != alertDupID || len(st.Duplicates) != 1 || len(st.Duplicates[0].Sources) != 2 {
+		t.Fatalf("/status: %s", rr.Body)
+	}
+	if got := s.routable(s.peers.List()); len(got) != 0 {
+		t.Fatalf("still routing to %v", got)
+	}
+
+	// minimal beacons carry no key and can't tell machines apart
+	other := strings.Repeat("d", 64)
+	hearBeacon(s, "10.0.0.4", Beacon{NodeID: other, APIPort: 1, API: apiVersion, Gen: 1}, nil)
+	hearBeacon(s, "10.0.0.5", Beacon{NodeID: other, APIPort: 1, API: apiVersion, Gen: 1}, nil)
+	if s.dups.duplicated(other) {
+		t.Fatal("flagged on minimal beacons alone")
+	}
+}
+
+// Another machine beaconing our own NodeID means we are a clone;
+// regenerating mints a new NodeID and stops the beacons.
+func TestSelfCloneRegenerate(t *testing.T) {
+	s := newTestServer(t, "s", nil)
+	hearBeacon(s, "10.0.0.9", Beacon{NodeID: s.id.NodeID, APIPort: 1, API: apiVersion, PubKey: pubB64(9)}, nil)
+	cs := s.dups.conflicts(time.Now())
+	if len(cs) != 1 || !cs[0].Self {
+		t.Fatalf("self clone: %+v", cs)
+	}
+
+	if rr := callControl(s, http.MethodPost, "/identity/regenerate", "", nil); rr.Code == http.StatusOK {
+		t.Fatalf("regenerate without a token: HTTP %d", rr.Code)
+	}
+	rr := callControl(s, http.MethodPost, "/identity/regenerate", s.ctlToken, nil)
+	var res struct {
+		NodeID   string `json:"node_id"`
+		Previous string `json:"previous"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &res)
+	if rr.Code != http.StatusOK || res.Previous != s.id.NodeID || !validHexID(res.NodeID) || res.NodeID == s.id.NodeID {
+		t.Fatalf("regenerate: HTTP %d %s", rr.Code, rr.Body)
+	}
+	if !s.beaconPaused() {
+		t.Fatal("still beaconing the old NodeID")
+	}
+	if _, err := os.Stat(filepath.Join(s.paths.BaseDir, identityFile)); err != nil {
+		t.Fatal(err)
+	}
+	if id := loadNodeIdentity(s.paths); id.NodeID != res.NodeID || id.Attrs["fingerprint_id"] == "" {
+		t.Fatalf("next start gets %s (%v)", id.NodeID, id.Attrs)
+	}
+}
@@ -3,10 +3,7 @@
 package main
 
 import (
-	"bytes"
 	"errors"
-	"fmt"
-	"os/exec"
 	"strings"
 )
 
@@ -41,14 +38,3 @@ func readReg(path, value string) (string, error) {
 	}
 	return "", errors.New("value not found")
 }
-
-func runExec(name string, args ...string) (string, error) {
-	var stdout, stderr bytes.Buffer
-	cmd := exec.Command(name, args...)
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-	if err := cmd.Run(); err != nil {
-		return "", fmt.Errorf("%v: %s", err, stderr.String())
-	}
-	return stdout.String(), nil
-}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+)
+
+// Inbox expiry. A final-hop message is kept until its expiry: the one the
+// sender put in the FinalEnvelope (/mix/send-text?expires_in=), capped at
+// --inbox-max-ttl, or --inbox-ttl after it arrived when the sender set
+// none. Both can be changed at runtime with PATCH /config and apply to
+// messages that arrive afterwards. Every inboxExpireEvery the janitor
+// drops expired messages from kv and expired texts from conversations.enc
+// (a text stored without an expiry counts from when it arrived).
+// A message that expires before it was read, which for a text means past
+// its conversation's read mark and for anything else always, emits
+// inbox.expired_unread. Mix sends have no end-to-end ack, so that event on
+// the receiver is what tells "delivered but expired unread" from "read".
+
+const (
+	defaultInboxTTL    = 7 * 24 * time.Hour
+	defaultInboxMaxTTL = 30 * 24 * time.Hour
+	inboxExpireEvery   = time.Minute
+)
+
+// expiry returns when a message arriving now expires (unix, 0 = never):
+// sent, the sender's wish (0 = none), capped at maxTTL, else now + ttl.
+func (q *inboxQuota) expiry(sent int64, now time.Time) int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if sent > 0 {
+		if q.maxTTL > 0 && sent > now.Add(q.maxTTL).Unix() {
+			return now.Add(q.maxTTL).Unix()
+		}
+		return sent
+	}
+	if q.ttl > 0 {
+		return now.Add(q.ttl).Unix()
+	}
+	return 0
+}
+
+func (q *inboxQuota) ttls() (ttl, maxTTL time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.ttl, q.maxTTL
+}
+
+func (q *inboxQuota) setTTLs(ttl, maxTTL time.Duration) {
+	q.mu.Lock()
+	q.ttl, q.maxTTL = ttl, maxTTL
+	q.mu.Unlock()
+}
+
+// parseInboxTTL reads a PATCH /config expiry: "0" turns it off.
+func parseInboxTTL(v string) (time.Duration, error) {
+	if v == "0" || v == "0s" {
+		return 0, nil
+	}
+	return parseRetentionAge(v)
+}
+
+// expiredMsg is one message the janitor removed.
+type expiredMsg struct {
+	sender string
+	msgid  string
+	key    string // kv key; "" for a text only in conversations.enc
+	read   bool
+}
+
+// expire removes the entries that expired by now and returns them.
+func (q *inboxQuota) expire(now int64) []expiredMsg {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var out []expiredMsg
+	for id, u := range q.senders {
+		kept := u.entries[:0]
+		for _, e := range u.entries {
+			if e.expires == 0 || e.expires > now {
+				kept = append(kept, e)
+				continue
+			}
+			out = append(out, expiredMsg{sender: id, msgid: e.msgid, key: e.key})
+			u.bytes -= e.size
+			q.bytes -= e.size
+			q.msgs--
+		}
+		u.entries = kept
+		if len(u.entries) == 0 {
+			delete(q.senders, id)
+		}
+	}
+	return out
+}
+
+// counted adds a pass's results to the totals.
+func (q *inboxQuota) counted(read, unread int) {
+	q.mu.Lock()
+	q.expiredRead += int64(read)
+	q.expiredUnread += int64(unread)
+	q.mu.Unlock()
+}
+
+// expire drops received messages that expired by now, from messages
+// without an expiry those that arrived more than ttl ago (0 = keep them),
+// and returns them.
+func (cs *conversationStore) expire(now int64, ttl time.Duration) []expiredMsg {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	var out []expiredMsg
+	for _, c := range cs.m {
+		kept := c.Messages[:0]
+		for _, m := range c.Messages {
+			at := m.Expires
+			if at == 0 && ttl > 0 {
+				at = m.At + int64(ttl/time.Second)
+			}
+			if m.Dir != convIn || at == 0 || at > now {
+				kept = append(kept, m)
+				continue
+			}
+			out = append(out, expiredMsg{sender: c.Peer, msgid: m.MsgID, read: m.Seq <= c.ReadSeq})
+		}
+		c.Messages = kept
+	}
+	if len(out) > 0 {
+		cs.saveLocked()
+	}
+	return out
+}
+
+// expireInbox runs one janitor pass.
+func (s *Server) expireInbox(now time.Time) {
+	gone := s.inbox.expire(now.Unix())
+	s.mu.Lock()
+	for _, m := range gone {
+		delete(s.kv, m.key)
+	}
+	s.mu.Unlock()
+
+	// a text is in both; its read mark is in the conversation
+	ttl, _ := s.inbox.ttls()
+	texts := make(map[string]expiredMsg)
+	for _, m := range s.convs.expire(now.Unix(), ttl) {
+		texts[m.sender+"|"+m.msgid] = m
+	}
+	for i, m := range gone {
+		if strings.HasPrefix(m.key, "text-") {
+			if t, ok := texts[m.sender+"|"+m.msgid]; ok {
+				gone[i].read = t.read
+				delete(texts, m.sender+"|"+m.msgid)
+			}
+		}
+	}
+	for _, t := range texts {
+		gone = append(gone, t)
+	}
+
+	read := 0
+	for _, m := range gone {
+		if m.read {
+			read++
+			continue
+		}
+		s.emit(eventInboxExpired, map[string]any{"msgid": m.msgid, "sender": m.sender, "key": m.key})
+	}
+	s.inbox.counted(read, len(gone)-read)
+	if len(gone) > 0 {
+		log.Printf("[inbox] expired %d messages (%d unread)", len(gone), len(gone)-read)
+	}
+}
+
+func (s *Server) startInboxExpiryLoop(ctx context.Context) {
+	t := time.NewTicker(inboxExpireEvery)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			func() {
+				defer recoverOnce("inbox-expiry")
+				s.expireInbox(now)
+			}()
+		}
+	}
+}
+
+// inboxExpiryStatus is the "inbox_expiry" part of /sync/status.
+func (s *Server) inboxExpiryStatus() map[string]any {
+	q := s.inbox
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	pending := 0
+	var next int64
+	for _, u := range q.senders {
+		for _, e := range u.entries {
+			if e.expires == 0 {
+				continue
+			}
+			pending++
+			if next == 0 || e.expires < next {
+				next = e.expires
+			}
+		}
+	}
+	return map[string]any{
+		"ttl":            q.ttl.String(),
+		"max_ttl":        q.maxTTL.String(),
+		"held":           q.msgs,
+		"expiring":       pending,
+		"next_unix":      next,
+		"expired_read":   q.expiredRead,
+		"expired_unread": q.expiredUnread,
+	}
+}
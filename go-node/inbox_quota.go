@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultInboxMaxMsgs        = 10000
+	defaultInboxMaxBytes       = 256 << 20
+	defaultInboxSenderMaxMsgs  = 500
+	defaultInboxSenderMaxBytes = 32 << 20
+
+	inboxRawSender = "raw" // final payloads that didn't parse as a FinalEnvelope
+	inboxRawType   = "raw"
+)
+
+// StorageFull is the body of a 507 from a final hop that refused a message.
+// Relays pass it back upstream unchanged so the origin learns why.
+type StorageFull struct {
+	Status string `json:"status"` // always "storage_full"
+	NodeID string `json:"node_id"`
+	Scope  string `json:"scope"` // "global" | "sender" | "disk" | "quarantine"
+	MsgID  string `json:"msgid,omitempty"`
+}
+
+type inboxEntry struct {
+	key      string
+	size     int64
+	msgid    string
+	logical  uint64 // sender's Lamport stamp (0 from older senders)
+	received int64
+	expires  int64  // unix; 0 = kept until deleted (inbox_expiry.go)
+	typ      string // FinalEnvelope.Type, or inboxRawType
+	name     string // file name or group label
+}
+
+type senderUsage struct {
+	entries []inboxEntry // oldest first
+	bytes   int64
+}
+
+// inboxQuota accounts final-hop mix messages held in Server.kv, per sender
+// and globally.
+type inboxQuota struct {
+	mu             sync.Mutex
+	maxMsgs        int
+	maxBytes       int64
+	senderMaxMsgs  int
+	senderMaxBytes int64
+	senders        map[string]*senderUsage
+	msgs           int
+	bytes          int64
+	rejected       int64
+	evicted        int64
+
+	// expiry (inbox_expiry.go)
+	ttl           time.Duration // for messages that don't set one; 0 = none
+	maxTTL        time.Duration // cap on what senders ask for; 0 = none
+	expiredRead   int64
+	expiredUnread int64
+}
+
+func newInboxQuota(cfg *Config) *inboxQuota {
+	return &inboxQuota{
+		maxMsgs:        cfg.InboxMaxMsgs,
+		maxBytes:       cfg.InboxMaxBytes,
+		senderMaxMsgs:  cfg.InboxSenderMaxMsgs,
+		senderMaxBytes: cfg.InboxSenderMaxBytes,
+		senders:        make(map[string]*senderUsage),
+		ttl:            cfg.InboxTTL,
+		maxTTL:         cfg.InboxMaxTTL,
+	}
+}
+
+// admit reserves room for message e (e.size bytes under e.key) from sender.
+// An over-quota sender loses its own oldest messages first; the returned
+// keys must be deleted from kv. scope is non-empty when the message is
+// refused.
+func (q *inboxQuota) admit(sender string, e inboxEntry) (evict []string, scope string) {
+	key, size := e.key, e.size
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.senderMaxBytes > 0 && size > q.senderMaxBytes {
+		q.rejected++
+		return nil, "sender"
+	}
+	u := q.senders[sender]
+	if u == nil {
+		u = &senderUsage{}
+		q.senders[sender] = u
+	}
+	if u.has(key) {
+		return nil, "" // re-delivered msgid: already accounted for
+	}
+
+	// count the sender's oldest messages that must go for this one to fit
+	n, freed := 0, int64(0)
+	for n < len(u.entries) &&
+		((q.senderMaxMsgs > 0 && len(u.entries)-n+1 > q.senderMaxMsgs) ||
+			(q.senderMaxBytes > 0 && u.bytes-freed+size > q.senderMaxBytes)) {
+		freed += u.entries[n].size
+		n++
+	}
+	if (q.maxMsgs > 0 && q.msgs-n+1 > q.maxMsgs) || (q.maxBytes > 0 && q.bytes-freed+size > q.maxBytes) {
+		q.rejected++
+		return nil, "global"
+	}
+	for _, old := range u.entries[:n] {
+		evict = append(evict, old.key)
+	}
+	u.entries = u.entries[n:]
+	u.bytes -= freed
+	q.msgs -= n
+	q.bytes -= freed
+	q.evicted += int64(n)
+	u.entries = append(u.entries, e)
+	u.bytes += size
+	q.msgs++
+	q.bytes += size
+	return evict, ""
+}
+
+func (u *senderUsage) has(key string) bool {
+	for _, e := range u.entries {
+		if e.key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// reset clears sender's usage (all senders if sender is empty) and returns
+// the kv keys it held.
+func (q *inboxQuota) reset(sender string) []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var keys []string
+	for id, u := range q.senders {
+		if sender != "" && id != sender {
+			continue
+		}
+		for _, e := range u.entries {
+			keys = append(keys, e.key)
+		}
+		q.msgs -= len(u.entries)
+		q.bytes -= u.bytes
+		delete(q.senders, id)
+	}
+	return keys
+}
+
+type senderQuotaView struct {
+	Sender string `json:"sender"`
+	Msgs   int    `json:"msgs"`
+	Bytes  int64  `json:"bytes"`
+}
+
+func (q *inboxQuota) snapshot() map[string]any {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	senders := make([]senderQuotaView, 0, len(q.senders))
+	for id, u := range q.senders {
+		senders = append(senders, senderQuotaView{Sender: id, Msgs: len(u.entries), Bytes: u.bytes})
+	}
+	sort.Slice(senders, func(i, j int) bool { return senders[i].Bytes > senders[j].Bytes })
+	return map[string]any{
+		"msgs":             q.msgs,
+		"bytes":            q.bytes,
+		"max_msgs":         q.maxMsgs,
+		"max_bytes":        q.maxBytes,
+		"sender_max_msgs":  q.senderMaxMsgs,
+		"sender_max_bytes": q.senderMaxBytes,
+		"rejected":         q.rejected,
+		"evicted":          q.evicted,
+		"senders":          senders,
+	}
+}
+
+// storeInbox admits and stores one final-hop message of type typ (name is
+// the file name or group label), to expire at expires (unix, from
+// inboxQuota.expiry). On refusal it writes a 507 StorageFull and returns
+// false.
+func (s *Server) storeInbox(w http.ResponseWriter, sender, msgid string, logical uint64, typ, name, key string, val []byte, expires int64) bool {
+	if sender == "" {
+		sender = inboxRawSender
+	}
+	evict, scope := s.inbox.admit(sender, inboxEntry{
+		key:      key,
+		size:     int64(len(val)),
+		msgid:    msgid,
+		logical:  logical,
+		received: time.Now().Unix(),
+		expires:  expires,
+		typ:      typ,
+		name:     name,
+	})
+	s.mu.Lock()
+	for _, k := range evict {
+		delete(s.kv, k)
+	}
+	if scope == "" {
+		s.kv[key] = val
+	}
+	s.mu.Unlock()
+	if len(evict) > 0 {
+		log.Printf("[inbox] sender %s over quota: evicted %d oldest", sender, len(evict))
+	}
+	if scope != "" {
+		log.Printf("[inbox] storage full (%s) for sender %s, msgid=%s", scope, sender, msgid)
+		writeStorageFull(w, StorageFull{Status: "storage_full", NodeID: s.id.NodeID, Scope: scope, MsgID: msgid})
+		return false
+	}
+	s.emit(eventInboxMessage, map[string]any{"msgid": msgid, "sender": sender, "bytes": len(val), "logical": logical})
+	return true
+}
+
+func writeStorageFull(w http.ResponseWriter, sf StorageFull) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusInsufficientStorage)
+	_ = json.NewEncoder(w).Encode(sf)
+}
+
+// passStorageFull relays a downstream 507 to our caller unchanged. Returns
+// false (and writes nothing) for any other response.
+func passStorageFull(w http.ResponseWriter, resp *http.Response) bool {
+	if resp.StatusCode != http.StatusInsufficientStorage {
+		return false
+	}
+	var sf StorageFull
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 4<<10)).Decode(&sf); err != nil {
+		sf = StorageFull{Status: "storage_full"}
+	}
+	writeStorageFull(w, sf)
+	return true
+}
+
+// GET /inbox/quota (control): usage against the final-hop quotas.
+func (s *Server) handleInboxQuota(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.inbox.snapshot())
+}
+
+func (e inboxEntry) view(sender string) InboxMessage {
+	return InboxMessage{Key: e.key, Sender: sender, MsgID: e.msgid, Type: e.typ, Name: e.name, Logical: e.logical, Size: e.size, Received: e.received, Expires: e.expires}
+}
+
+// list returns the held messages in cross-node order: (logical, sender,
+// msgid). Local receive time only breaks ties between stamp-less ones.
+func (q *inboxQuota) list() []InboxMessage {
+	q.mu.Lock()
+	out := make([]InboxMessage, 0, q.msgs)
+	for id, u := range q.senders {
+		for _, e := range u.entries {
+			out = append(out, e.view(id))
+		}
+	}
+	q.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool {
+		a, b := out[i], out[j]
+		if a.Logical != b.Logical {
+			return a.Logical < b.Logical
+		}
+		if a.Sender != b.Sender {
+			return a.Sender < b.Sender
+		}
+		if a.MsgID != b.MsgID {
+			return a.MsgID < b.MsgID
+		}
+		if a.Received != b.Received {
+			return a.Received < b.Received
+		}
+		return a.Key < b.Key
+	})
+	return out
+}
+
+// GET /inbox (control): stored mix messages in Lamport order.
+// DELETE /inbox[?sender=<NodeID>]: drop stored mix messages and reset the
+// matching quota counters.
+func (s *Server) handleInbox(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, InboxList{LogicalClock: s.lamport.value(), Messages: s.inbox.list()})
+		return
+	case http.MethodDelete:
+	default:
+		http.Error(w, "use GET or DELETE", http.StatusMethodNotAllowed)
+		return
+	}
+	sender := strings.TrimSpace(r.URL.Query().Get("sender"))
+	keys := s.inbox.reset(sender)
+	s.mu.Lock()
+	for _, k := range keys {
+		delete(s.kv, k)
+	}
+	s.mu.Unlock()
+	writeJSON(w, map[string]any{"status": "ok", "deleted": len(keys), "sender": sender})
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"log"
+	"runtime"
+	"syscall"
+)
+
+const (
+	ioprioWhoProcess = 1 // with who=0: the calling thread
+	ioprioClassIdle  = 3
+	ioprioClassShift = 13
+)
+
+// lowerIOPriority puts the calling goroutine's thread in the idle I/O class,
+// so its disk reads only get bandwidth nobody else wants. The goroutine is
+// pinned to the thread for the rest of its life.
+func lowerIOPriority() {
+	runtime.LockOSThread()
+	_, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, 0, ioprioClassIdle<<ioprioClassShift)
+	if errno != 0 {
+		log.Printf("[ioprio] idle class: %v", errno)
+	}
+}
@@ -0,0 +1,7 @@
+//go:build !linux && !windows
+
+package main
+
+// lowerIOPriority is a no-op where there's no per-thread I/O priority; the
+// scrubber's read rate cap still applies.
+func lowerIOPriority() {}
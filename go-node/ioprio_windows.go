@@ -0,0 +1,27 @@
+//go:build windows
+
+package main
+
+import (
+	"log"
+	"runtime"
+	"syscall"
+)
+
+const threadModeBackgroundBegin = 0x00010000
+
+var (
+	procGetCurrentThread  = syscall.NewLazyDLL("kernel32.dll").NewProc("GetCurrentThread")
+	procSetThreadPriority = syscall.NewLazyDLL("kernel32.dll").NewProc("SetThreadPriority")
+)
+
+// lowerIOPriority switches the calling goroutine's thread to background
+// mode (low CPU, memory and I/O priority). The goroutine is pinned to the
+// thread for the rest of its life.
+func lowerIOPriority() {
+	runtime.LockOSThread()
+	h, _, _ := procGetCurrentThread.Call()
+	if ok, _, err := procSetThreadPriority.Call(h, threadModeBackgroundBegin); ok == 0 {
+		log.Printf("[ioprio] background mode: %v", err)
+	}
+}
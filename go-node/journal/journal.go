@@ -0,0 +1,432 @@
+// Package journal is a crash-safe queue file for work that must survive a
+// restart: outgoing replicates, key escrow uploads and the like.
+//
+// A journal is one append-only file. Each item gets the next offset (a
+// sequence number, not a byte position), is sealed with XChaCha20-Poly1305
+// under the caller's key and written with a length and a CRC-32C, then
+// synced before Append returns. Ack appends an acknowledgement record for an
+// offset. Open replays the file, keeps the items without an ack and cuts the
+// file at the first torn or corrupt record, which is what a crash in the
+// middle of a write leaves behind. Once acknowledged records make up most of
+// the file it is compacted: the pending items are rewritten to a new file
+// that replaces the old one atomically.
+//
+// Delivery is at least once. An item is never lost once Append returned, and
+// never comes back once Ack returned; an item whose ack was in flight when
+// the process died is returned again by Pending after a restart, so
+// consumers must be idempotent.
+package journal
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	magic = "HZJRNL1\n"
+
+	recItem byte = 1 // sealed item
+	recAck  byte = 2 // acknowledges the item at offset
+	recNext byte = 3 // next offset to assign (written by compaction)
+
+	headSize   = 8 // body length, CRC-32C of the body (uint32 BE each)
+	bodyHead   = 9 // record type, offset (uint64 BE)
+	maxBody    = 64 << 20
+	compactMin = 1 << 20 // don't compact for less dead weight than this
+)
+
+var (
+	ErrClosed     = errors.New("journal: closed")
+	ErrNotPending = errors.New("journal: offset not pending")
+	ErrKey        = errors.New("journal: record does not open with the key")
+
+	errCorrupt = errors.New("torn or corrupt record")
+	castagnoli = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// Record is a pending item.
+type Record struct {
+	Offset uint64
+	Data   []byte
+}
+
+// Stats describes a journal.
+type Stats struct {
+	Pending      int    `json:"pending"`
+	Acked        uint64 `json:"acked"` // every offset below this is acknowledged
+	Next         uint64 `json:"next"`  // offset the next Append gets
+	Bytes        int64  `json:"bytes"`
+	DeadBytes    int64  `json:"dead_bytes"` // acknowledged items and acks, dropped by compaction
+	Compactions  int    `json:"compactions"`
+	CompactError string `json:"compact_error,omitempty"`
+	Truncated    int64  `json:"truncated"` // bytes cut from a torn or corrupt tail at Open
+}
+
+type entry struct {
+	data []byte
+	size int64 // bytes of its record
+}
+
+// Journal is safe for concurrent use.
+type Journal struct {
+	path string
+	aead cipher.AEAD
+
+	mu          sync.Mutex
+	f           *os.File
+	size        int64
+	next        uint64
+	pending     map[uint64]entry
+	dead        int64
+	compactions int
+	compactErr  error
+	truncated   int64
+	closed      bool
+}
+
+// Open opens or creates the journal at path. key (32 bytes) seals the items.
+// A torn or corrupt tail is cut off (see Stats.Truncated); an intact record
+// that doesn't open with key is an error, so a wrong key never costs data.
+func Open(path string, key []byte) (*Journal, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	j := &Journal{path: path, aead: aead, f: f, next: 1, pending: make(map[uint64]entry)}
+	if err := j.load(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *Journal) load() error {
+	st, err := j.f.Stat()
+	if err != nil {
+		return err
+	}
+	if st.Size() == 0 {
+		if _, err := j.f.WriteAt([]byte(magic), 0); err != nil {
+			return err
+		}
+		j.size = int64(len(magic))
+		return j.f.Sync()
+	}
+	r := bufio.NewReader(io.NewSectionReader(j.f, 0, st.Size()))
+	hdr := make([]byte, len(magic))
+	if _, err := io.ReadFull(r, hdr); err != nil || string(hdr) != magic {
+		return fmt.Errorf("journal: %s is not a journal", j.path)
+	}
+	off := int64(len(magic))
+	for {
+		body, n, err := readRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			err = j.apply(body, n)
+		}
+		if errors.Is(err, ErrKey) {
+			return fmt.Errorf("%w (%s, byte %d)", err, j.path, off)
+		}
+		if err != nil {
+			j.truncated = st.Size() - off
+			if err := j.f.Truncate(off); err != nil {
+				return err
+			}
+			if err := j.f.Sync(); err != nil {
+				return err
+			}
+			break
+		}
+		off += n
+	}
+	j.size = off
+	return nil
+}
+
+func readRecord(r io.Reader) ([]byte, int64, error) {
+	var h [headSize]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		if err == io.EOF {
+			return nil, 0, io.EOF
+		}
+		return nil, 0, errCorrupt
+	}
+	n := binary.BigEndian.Uint32(h[0:4])
+	if n < bodyHead || n > maxBody {
+		return nil, 0, errCorrupt
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, 0, errCorrupt
+	}
+	if crc32.Checksum(body, castagnoli) != binary.BigEndian.Uint32(h[4:8]) {
+		return nil, 0, errCorrupt
+	}
+	return body, headSize + int64(n), nil
+}
+
+// apply replays one record read by load.
+func (j *Journal) apply(body []byte, n int64) error {
+	typ, off := body[0], binary.BigEndian.Uint64(body[1:bodyHead])
+	switch typ {
+	case recItem:
+		data, err := j.open(off, body[bodyHead:])
+		if err != nil {
+			return ErrKey
+		}
+		j.pending[off] = entry{data: data, size: n}
+		j.next = max(j.next, off+1)
+	case recAck:
+		if e, ok := j.pending[off]; ok {
+			j.dead += e.size
+			delete(j.pending, off)
+		}
+		j.dead += n
+	case recNext:
+		j.next = max(j.next, off)
+	default:
+		return errCorrupt
+	}
+	return nil
+}
+
+func (j *Journal) seal(off uint64, data []byte) ([]byte, error) {
+	nonce := make([]byte, chacha20poly1305.NonceSizeX, chacha20poly1305.NonceSizeX+len(data)+j.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return j.aead.Seal(nonce, nonce, data, offsetAD(off)), nil
+}
+
+func (j *Journal) open(off uint64, blob []byte) ([]byte, error) {
+	if len(blob) < chacha20poly1305.NonceSizeX {
+		return nil, errCorrupt
+	}
+	return j.aead.Open(nil, blob[:chacha20poly1305.NonceSizeX], blob[chacha20poly1305.NonceSizeX:], offsetAD(off))
+}
+
+// offsetAD binds a sealed item to its offset, so items can't be swapped.
+func offsetAD(off uint64) []byte {
+	return binary.BigEndian.AppendUint64([]byte("journal-item|"), off)
+}
+
+func encodeRecord(typ byte, off uint64, payload []byte) []byte {
+	rec := make([]byte, headSize+bodyHead+len(payload))
+	body := rec[headSize:]
+	body[0] = typ
+	binary.BigEndian.PutUint64(body[1:bodyHead], off)
+	copy(body[bodyHead:], payload)
+	binary.BigEndian.PutUint32(rec[0:4], uint32(len(body)))
+	binary.BigEndian.PutUint32(rec[4:8], crc32.Checksum(body, castagnoli))
+	return rec
+}
+
+// writeLocked appends rec and syncs it. A failed write is cut off again, so
+// later records don't land behind a torn one.
+func (j *Journal) writeLocked(rec []byte) error {
+	if _, err := j.f.WriteAt(rec, j.size); err != nil {
+		_ = j.f.Truncate(j.size)
+		return err
+	}
+	if err := j.f.Sync(); err != nil {
+		_ = j.f.Truncate(j.size)
+		return err
+	}
+	j.size += int64(len(rec))
+	return nil
+}
+
+// Append stores data durably and returns its offset.
+func (j *Journal) Append(data []byte) (uint64, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.closed {
+		return 0, ErrClosed
+	}
+	if len(data) > maxBody-bodyHead-chacha20poly1305.NonceSizeX-j.aead.Overhead() {
+		return 0, errors.New("journal: item too large")
+	}
+	off := j.next
+	sealed, err := j.seal(off, data)
+	if err != nil {
+		return 0, err
+	}
+	rec := encodeRecord(recItem, off, sealed)
+	if err := j.writeLocked(rec); err != nil {
+		return 0, err
+	}
+	j.next++
+	j.pending[off] = entry{data: append([]byte(nil), data...), size: int64(len(rec))}
+	return off, nil
+}
+
+// Ack durably marks the item at off as done. It compacts the file once
+// acknowledged records outweigh the live ones; a failed compaction is kept
+// in Stats and retried by the next Ack, and doesn't fail this one.
+func (j *Journal) Ack(off uint64) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.closed {
+		return ErrClosed
+	}
+	e, ok := j.pending[off]
+	if !ok {
+		return ErrNotPending
+	}
+	rec := encodeRecord(recAck, off, nil)
+	if err := j.writeLocked(rec); err != nil {
+		return err
+	}
+	delete(j.pending, off)
+	j.dead += e.size + int64(len(rec))
+	if j.dead >= compactMin && j.dead > j.size/2 {
+		j.compactErr = j.compactLocked()
+	}
+	return nil
+}
+
+// Pending returns the items not yet acknowledged, oldest first.
+func (j *Journal) Pending() []Record {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	out := make([]Record, 0, len(j.pending))
+	for off, e := range j.pending {
+		out = append(out, Record{Offset: off, Data: append([]byte(nil), e.data...)})
+	}
+	sort.Slice(out, func(a, b int) bool { return out[a].Offset < out[b].Offset })
+	return out
+}
+
+// Len is the number of pending items.
+func (j *Journal) Len() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return len(j.pending)
+}
+
+// Compact rewrites the file with only the pending items.
+func (j *Journal) Compact() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.closed {
+		return ErrClosed
+	}
+	j.compactErr = j.compactLocked()
+	return j.compactErr
+}
+
+// compactLocked writes the pending items to path.tmp, syncs it and renames
+// it over the journal. A crash before the rename leaves the old file in
+// place; a stale .tmp is overwritten by the next compaction.
+func (j *Journal) compactLocked() error {
+	tmp := j.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	fail := func(err error) error {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	w := bufio.NewWriter(f)
+	size := int64(len(magic))
+	w.WriteString(magic)
+	rec := encodeRecord(recNext, j.next, nil)
+	w.Write(rec)
+	size += int64(len(rec))
+	offs := make([]uint64, 0, len(j.pending))
+	for off := range j.pending {
+		offs = append(offs, off)
+	}
+	sort.Slice(offs, func(a, b int) bool { return offs[a] < offs[b] })
+	sizes := make(map[uint64]int64, len(offs))
+	for _, off := range offs {
+		sealed, err := j.seal(off, j.pending[off].data)
+		if err != nil {
+			return fail(err)
+		}
+		rec := encodeRecord(recItem, off, sealed)
+		w.Write(rec)
+		sizes[off] = int64(len(rec))
+		size += int64(len(rec))
+	}
+	if err := w.Flush(); err != nil {
+		return fail(err)
+	}
+	if err := f.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := os.Rename(tmp, j.path); err != nil {
+		return fail(err)
+	}
+	syncDir(filepath.Dir(j.path))
+	j.f.Close()
+	j.f, j.size, j.dead = f, size, 0
+	for off, n := range sizes {
+		e := j.pending[off]
+		e.size = n
+		j.pending[off] = e
+	}
+	j.compactions++
+	return nil
+}
+
+// syncDir makes a rename in dir durable where the OS allows it.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		_ = d.Sync()
+		d.Close()
+	}
+}
+
+// Stats reports the journal's state.
+func (j *Journal) Stats() Stats {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	st := Stats{
+		Pending:     len(j.pending),
+		Acked:       j.next,
+		Next:        j.next,
+		Bytes:       j.size,
+		DeadBytes:   j.dead,
+		Compactions: j.compactions,
+		Truncated:   j.truncated,
+	}
+	for off := range j.pending {
+		st.Acked = min(st.Acked, off)
+	}
+	if j.compactErr != nil {
+		st.CompactError = j.compactErr.Error()
+	}
+	return st
+}
+
+// Close closes the file. Pending items stay for the next Open.
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.closed {
+		return nil
+	}
+	j.closed = true
+	return j.f.Close()
+}
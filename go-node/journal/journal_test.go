@@ -0,0 +1,279 @@
+package journal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+var testKey = bytes.Repeat([]byte{7}, 32)
+
+func open(t *testing.T, path string) *Journal {
+	t.Helper()
+	j, err := Open(path, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { j.Close() })
+	return j
+}
+
+func pendingData(j *Journal) []string {
+	var out []string
+	for _, r := range j.Pending() {
+		out = append(out, fmt.Sprintf("%d:%s", r.Offset, r.Data))
+	}
+	return out
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+	st, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st.Size()
+}
+
+// Reopening returns the unacknowledged items in order and goes on from the
+// next offset; the first journal is dropped without Close, as a crash
+// would leave it.
+func TestReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "q.log")
+	j := open(t, path)
+	for _, s := range []string{"a", "b", "c", "d", "e"} {
+		if _, err := j.Append([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, off := range []uint64{2, 4} {
+		if err := j.Ack(off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := j.Ack(2); !errors.Is(err, ErrNotPending) {
+		t.Fatalf("second ack: %v", err)
+	}
+
+	j2 := open(t, path)
+	if got, want := pendingData(j2), []string{"1:a", "3:c", "5:e"}; !slices.Equal(got, want) {
+		t.Fatalf("pending %v, want %v", got, want)
+	}
+	if st := j2.Stats(); st.Next != 6 || st.Acked != 1 || st.Truncated != 0 {
+		t.Fatalf("stats %+v", st)
+	}
+	if off, err := j2.Append([]byte("f")); err != nil || off != 6 {
+		t.Fatalf("append after replay: %d %v", off, err)
+	}
+	if err := j2.Ack(2); !errors.Is(err, ErrNotPending) {
+		t.Fatalf("acked item came back: %v", err)
+	}
+}
+
+// A crash in the middle of a write leaves a prefix of its record. Whatever
+// the prefix, Open cuts it off, keeps everything before it, and the file
+// takes new records again.
+func TestTornWrite(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "q.log")
+	j := open(t, path)
+	j.Append([]byte("kept"))
+	j.Append([]byte("acked"))
+	j.Ack(2)
+	before := fileSize(t, path)
+	j.Append([]byte("torn"))
+	itemEnd := fileSize(t, path)
+	j.Ack(3)
+	ackEnd := fileSize(t, path)
+	j.Close()
+	full, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for cut := before; cut < ackEnd; cut++ {
+		p := filepath.Join(dir, fmt.Sprintf("cut-%d.log", cut))
+		if err := os.WriteFile(p, full[:cut], 0o600); err != nil {
+			t.Fatal(err)
+		}
+		j := open(t, p)
+		want := []string{"1:kept"}
+		wantCut := cut - before
+		if cut >= itemEnd {
+			// the item made it, its ack didn't: delivered again
+			want = append(want, "3:torn")
+			wantCut = cut - itemEnd
+		}
+		if got := pendingData(j); !slices.Equal(got, want) {
+			t.Fatalf("cut at %d: pending %v, want %v", cut, got, want)
+		}
+		if st := j.Stats(); st.Truncated != wantCut || fileSize(t, p) != cut-wantCut {
+			t.Fatalf("cut at %d: truncated %d, want %d", cut, st.Truncated, wantCut)
+		}
+		if _, err := j.Append([]byte("after")); err != nil {
+			t.Fatal(err)
+		}
+		j.Close()
+		if got := pendingData(open(t, p)); len(got) != len(want)+1 || got[len(got)-1][1:] != ":after" {
+			t.Fatalf("cut at %d: after reopening %v", cut, got)
+		}
+	}
+}
+
+// Garbage after the last record, such as a write that landed only partly
+// or with junk, is cut off like a torn record.
+func TestGarbageTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "q.log")
+	j := open(t, path)
+	j.Append([]byte("one"))
+	j.Close()
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	f.Write([]byte{0, 0, 0, 40, 1, 2, 3, 4, 5, 6})
+	f.Close()
+	j = open(t, path)
+	if got := pendingData(j); !slices.Equal(got, []string{"1:one"}) || j.Stats().Truncated != 10 {
+		t.Fatalf("pending %v, stats %+v", got, j.Stats())
+	}
+}
+
+// A flipped bit in a middle record loses that record and the ones after
+// it, never the ones before.
+func TestCorruptRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "q.log")
+	j := open(t, path)
+	j.Append([]byte("first"))
+	mid := fileSize(t, path)
+	j.Append([]byte("second"))
+	j.Append([]byte("third"))
+	j.Close()
+	b, _ := os.ReadFile(path)
+	b[mid+headSize+bodyHead+3] ^= 1
+	os.WriteFile(path, b, 0o600)
+
+	j = open(t, path)
+	if got := pendingData(j); !slices.Equal(got, []string{"1:first"}) {
+		t.Fatalf("pending %v", got)
+	}
+	if st := j.Stats(); st.Truncated != int64(len(b))-mid || st.Next != 2 {
+		t.Fatalf("stats %+v", st)
+	}
+}
+
+// The wrong key is an error and leaves the file alone.
+func TestWrongKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "q.log")
+	j := open(t, path)
+	j.Append([]byte("secret"))
+	j.Close()
+	before, _ := os.ReadFile(path)
+	if bytes.Contains(before, []byte("secret")) {
+		t.Fatal("item stored in the clear")
+	}
+	if _, err := Open(path, bytes.Repeat([]byte{8}, 32)); !errors.Is(err, ErrKey) {
+		t.Fatalf("wrong key: %v", err)
+	}
+	if after, _ := os.ReadFile(path); !bytes.Equal(before, after) {
+		t.Fatal("wrong key changed the file")
+	}
+	os.WriteFile(path, []byte("not a journal"), 0o600)
+	if _, err := Open(path, testKey); err == nil {
+		t.Fatal("opened a file without the magic")
+	}
+}
+
+// Compaction keeps the pending items and the offset counter, and a crash
+// during one leaves the old file, and a stale .tmp that doesn't matter.
+func TestCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "q.log")
+	j := open(t, path)
+	big := bytes.Repeat([]byte("x"), 64<<10)
+	for i := range 40 {
+		if _, err := j.Append(append([]byte(fmt.Sprint(i)), big...)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for off := uint64(1); off <= 38; off++ {
+		if err := j.Ack(off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	st := j.Stats()
+	if st.Compactions == 0 || st.CompactError != "" || st.Bytes > 5*int64(len(big)) {
+		t.Fatalf("not compacted: %+v", st)
+	}
+	j.Ack(39)
+	j.Ack(40)
+	if err := j.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a compaction that died before its rename
+	os.WriteFile(path+".tmp", []byte("half a compaction"), 0o600)
+	j2 := open(t, path)
+	if j2.Len() != 0 {
+		t.Fatalf("pending after compaction: %v", pendingData(j2))
+	}
+	if off, _ := j2.Append([]byte("next")); off != 41 {
+		t.Fatalf("offset after compacting everything: %d", off)
+	}
+	if err := j2.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if got := pendingData(open(t, path)); !slices.Equal(got, []string{"41:next"}) {
+		t.Fatalf("after a second compaction: %v", got)
+	}
+}
+
+// A consumer that crashes at any point sees every unacknowledged item
+// again after the restart and no acknowledged one: each item is handled
+// at least once, and twice only if the crash fell between the work and
+// its ack.
+func TestAtLeastOnce(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "q.log")
+	j := open(t, path)
+	const n = 50
+	for i := range n {
+		j.Append([]byte(fmt.Sprint(i)))
+	}
+	handled := make(map[string]int)
+	for crashAt := 7; j.Len() > 0; crashAt += 7 {
+		for _, r := range j.Pending() {
+			handled[string(r.Data)]++
+			if int(r.Offset)%crashAt == 0 {
+				break // crash after the work, before the ack
+			}
+			if err := j.Ack(r.Offset); err != nil {
+				t.Fatal(err)
+			}
+		}
+		j = open(t, path)
+	}
+	redone := 0
+	for i := range n {
+		switch c := handled[fmt.Sprint(i)]; {
+		case c == 0:
+			t.Fatalf("item %d lost", i)
+		case c > 1:
+			redone++
+		}
+	}
+	if redone > n/7 {
+		t.Fatalf("%d items handled more than once", redone)
+	}
+}
+
+func TestClosed(t *testing.T) {
+	j := open(t, filepath.Join(t.TempDir(), "q.log"))
+	j.Append([]byte("a"))
+	j.Close()
+	if _, err := j.Append([]byte("b")); !errors.Is(err, ErrClosed) {
+		t.Fatal(err)
+	}
+	if err := j.Ack(1); !errors.Is(err, ErrClosed) {
+		t.Fatal(err)
+	}
+}
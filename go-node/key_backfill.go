@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Mix pubkey backfill. A peer restored from an old snapshot or learned from
+// a bootstrap list can have an address but no mix pubkey, which keeps it out
+// of every mix path until a full beacon happens by (never, for a peer off
+// our LAN). Such peers are marked pending-key and their /peer-info is
+// fetched in the background through the capability cache; applyProfile then
+// fills in the pubkey, hostname and caps. A send to a pending peer waits up
+// to keyBackfillWait for the fetch and otherwise answers 503 pending_key,
+// which a client can tell apart from an unknown destination.
+
+const (
+	keyPending = "pending-key" // PeerInfo.KeyState
+
+	keyBackfillEvery = 5 * time.Second
+	keyBackfillWait  = 3 * time.Second // a send waits this long for a key
+)
+
+// errPendingKey is returned by mixPath when the destination is known and
+// has an address but its pubkey is still being fetched.
+var errPendingKey = errors.New("destination pubkey not learned yet")
+
+type keyBackfill struct {
+	mu       sync.Mutex
+	inflight map[string]chan struct{} // closed when the fetch ends
+	failedAt map[string]time.Time     // last failed fetch, for the loop's backoff
+
+	backfilled, failed atomic.Uint64
+}
+
+func newKeyBackfill() *keyBackfill {
+	return &keyBackfill{inflight: make(map[string]chan struct{}), failedAt: make(map[string]time.Time)}
+}
+
+// needsKey is true for a peer we could reach but can't route to.
+func needsKey(p PeerInfo) bool {
+	return len(p.PubKey) != 32 && p.Addr != ""
+}
+
+// backfillKey fetches nodeID's profile in the background unless a fetch is
+// already running, marking the peer pending-key until it ends. force skips
+// the cached failure of a recent fetch (a send is waiting). The channel is
+// closed when the fetch ends.
+func (s *Server) backfillKey(nodeID string, force bool) <-chan struct{} {
+	kb := s.keys
+	kb.mu.Lock()
+	if ch, ok := kb.inflight[nodeID]; ok {
+		kb.mu.Unlock()
+		return ch
+	}
+	ch := make(chan struct{})
+	kb.inflight[nodeID] = ch
+	kb.mu.Unlock()
+	s.peers.setKeyState(nodeID, keyPending)
+
+	go func() {
+		defer recoverOnce("key-backfill")
+		defer func() {
+			kb.mu.Lock()
+			delete(kb.inflight, nodeID)
+			kb.mu.Unlock()
+			close(ch)
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), 2*capsFetchTimeout)
+		defer cancel()
+		caps, err := s.peerCaps.get(ctx, nodeID, force)
+		if err == nil {
+			s.peers.applyProfile(nodeID, caps) // a cache hit skipped it
+		}
+		if p, ok := s.peers.Get(nodeID); ok && !needsKey(p) {
+			kb.mu.Lock()
+			delete(kb.failedAt, nodeID)
+			kb.mu.Unlock()
+			kb.backfilled.Add(1)
+			log.Printf("[peers] %.8s pubkey backfilled from /peer-info", nodeID)
+			return
+		}
+		if err == nil {
+			err = errors.New("peer-info has no pubkey")
+		}
+		kb.mu.Lock()
+		kb.failedAt[nodeID] = time.Now()
+		kb.mu.Unlock()
+		kb.failed.Add(1)
+		log.Printf("[peers] %.8s pubkey backfill: %v", nodeID, err)
+	}()
+	return ch
+}
+
+// startKeyBackfillLoop looks for peers without a pubkey every
+// keyBackfillEvery, retrying one whose fetch failed after capsNegativeTTL.
+func (s *Server) startKeyBackfillLoop(ctx context.Context) {
+	ticker := time.NewTicker(keyBackfillEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, p := range s.peers.List() {
+			if p.NodeID == s.id.NodeID || !needsKey(p) {
+				continue
+			}
+			s.keys.mu.Lock()
+			recent := time.Since(s.keys.failedAt[p.NodeID]) < capsNegativeTTL
+			s.keys.mu.Unlock()
+			if !recent {
+				s.backfillKey(p.NodeID, false)
+			}
+		}
+	}
+}
+
+// mixPath picks hops to destID by strategy under the configured diversity
+// rules. If the destination is known and reachable but has no pubkey yet,
+// it waits up to keyBackfillWait for the backfill and tries again,
+// returning errPendingKey if it is still missing.
+func (s *Server) mixPath(strategy, destID string, maxHops int) ([]hopInfo, PathDiversity, error) {
+	return s.mixPathAvoiding(strategy, destID, maxHops, nil)
+}
+
+// mixPathAvoiding is mixPath without the relays in avoid (mix_failover.go).
+func (s *Server) mixPathAvoiding(strategy, destID string, maxHops int, avoid map[string]bool) ([]hopInfo, PathDiversity, error) {
+	peers := func() []PeerInfo {
+		all := s.routable(s.peers.List())
+		if len(avoid) == 0 {
+			return all
+		}
+		out := all[:0]
+		for _, p := range all {
+			if !avoid[p.NodeID] || p.NodeID == destID {
+				out = append(out, p)
+			}
+		}
+		return out
+	}
+	hops, div, err := chooseHops(strategy, s.id.NodeID, destID, peers(), maxHops, s.pathRules())
+	if err == nil {
+		return hops, div, nil
+	}
+	if errors.Is(err, errOnionV1Dest) {
+		s.legacy.refused(legacyOnionV1)
+		return nil, div, err
+	}
+	dest, ok := s.peers.Get(destID)
+	if !ok || !needsKey(dest) || s.dups.duplicated(destID) {
+		return nil, div, err
+	}
+	select {
+	case <-s.backfillKey(destID, true):
+	case <-time.After(keyBackfillWait):
+		return nil, div, errPendingKey
+	}
+	hops, div, err = chooseHops(strategy, s.id.NodeID, destID, peers(), maxHops, s.pathRules())
+	if err != nil {
+		if dest, ok := s.peers.Get(destID); ok && needsKey(dest) {
+			return nil, div, errPendingKey
+		}
+	}
+	if errors.Is(err, errOnionV1Dest) {
+		s.legacy.refused(legacyOnionV1)
+	}
+	return hops, div, err
+}
+
+// PendingKey is the 503 body for a send to a peer whose pubkey isn't known
+// yet.
+type PendingKey struct {
+	Status string `json:"status"` // "pending_key"
+	Code   string `json:"code"`   // "pending_key"
+	NodeID string `json:"node_id"`
+}
+
+func writePendingKey(w http.ResponseWriter, destID string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(int(keyBackfillEvery.Seconds())))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	_ = json.NewEncoder(w).Encode(PendingKey{Status: "pending_key", Code: "pending_key", NodeID: destID})
+}
+
+// keyBackfillStatus is the pubkey_backfill object of /sync/status.
+type keyBackfillStatus struct {
+	Pending    int    `json:"pending"`    // peers with an address but no pubkey
+	Fetching   int    `json:"fetching"`   // of those, with a fetch running
+	Backfilled uint64 `json:"backfilled"` // fetches that filled a pubkey in
+	Failed     uint64 `json:"failed"`
+}
+
+func (s *Server) keyBackfillStatus() keyBackfillStatus {
+	st := keyBackfillStatus{Backfilled: s.keys.backfilled.Load(), Failed: s.keys.failed.Load()}
+	for _, p := range s.peers.List() {
+		if p.NodeID != s.id.NodeID && needsKey(p) {
+			st.Pending++
+		}
+	}
+	s.keys.mu.Lock()
+	st.Fetching = len(s.keys.inflight)
+	s.keys.mu.Unlock()
+	return st
+}
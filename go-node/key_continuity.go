@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Mix key continuity. A node mints a new mix keypair at every start, so a
+// peer's pubkey changes routinely, and until now whoever beaconed a known
+// NodeID with a new key took over its mix traffic. Each node now signs its
+// mix key with its persistent Ed25519 key (receipt.key, see escrow.go) and
+// sends the signature and that signing key in full beacons and /peer-info.
+//
+// The first signing key seen for a NodeID is pinned (trust on first use). A
+// new mix key signed by the pinned key, and issued later than the current
+// one, replaces it at once. Any other new key is unconfirmed: the old key
+// stays in use, the peer shows key_state "key-changed-unconfirmed" with the
+// new key as pending_key, mix paths don't use it as a relay, and a
+// peer.key_changed event goes out. After --key-change-quarantine the pending
+// key is taken, unless the old key was beaconed again meanwhile
+// (key_conflict: two machines claim the NodeID), which only an operator
+// settles with POST /peers/key. A rejected key is ignored from then on.
+// --key-change-quarantine=0 takes unsigned keys at once, as before.
+
+const (
+	keyUnconfirmed = "key-changed-unconfirmed" // PeerInfo.KeyState
+
+	defaultKeyChangeQuarantine = 10 * time.Minute
+
+	keyRotated     = "rotated"     // signed by the pinned key, taken
+	keyQuarantined = "quarantined" // unconfirmed, old key kept
+	keyConflicting = "conflict"    // old key seen again during quarantine
+	keyAccepted    = "accepted"    // quarantine over, or confirmed by hand
+	keyRejected    = "rejected"    // rejected by hand
+)
+
+// mixKeyProof is what a node advertises about its mix key.
+type mixKeyProof struct {
+	SignKey string // Ed25519 public key, base64url
+	Sig     string // over mixKeyMessage, base64url
+	Issued  int64  // unix time the mix key was minted
+}
+
+func mixKeyMessage(nodeID string, pub []byte, issued int64) []byte {
+	msg := []byte("hz-mixkey|" + nodeID + "|")
+	msg = append(msg, pub...)
+	return strconv.AppendInt(append(msg, '|'), issued, 10)
+}
+
+// signMixKey signs pub for nodeID. A node without a signing key advertises
+// nothing and its key changes are quarantined.
+func signMixKey(paths *EnvPaths, nodeID string, pub []byte) mixKeyProof {
+	priv, err := receiptKey(paths)
+	if err != nil {
+		log.Printf("[identity] no signing key, mix key goes out unsigned: %v", err)
+		return mixKeyProof{}
+	}
+	issued := time.Now().Unix()
+	return mixKeyProof{
+		SignKey: base64.RawURLEncoding.EncodeToString(priv.Public().(ed25519.PublicKey)),
+		Sig:     base64.RawURLEncoding.EncodeToString(ed25519.Sign(priv, mixKeyMessage(nodeID, pub, issued))),
+		Issued:  issued,
+	}
+}
+
+// mixKeyProof is the beacon source's: the proof for this run's mix key.
+func (s *Server) mixKeyProof() mixKeyProof { return s.keyProof }
+
+// verify returns the signing key if the proof holds for pub.
+func (kp mixKeyProof) verify(nodeID string, pub []byte) ([]byte, bool) {
+	sk, err := base64.RawURLEncoding.DecodeString(kp.SignKey)
+	if err != nil || len(sk) != ed25519.PublicKeySize || len(pub) != 32 {
+		return nil, false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(kp.Sig)
+	if err != nil || !ed25519.Verify(sk, mixKeyMessage(nodeID, pub, kp.Issued), sig) {
+		return nil, false
+	}
+	return sk, true
+}
+
+// keyChange is a continuity decision worth telling the operator about.
+type keyChange struct {
+	NodeID  string
+	Outcome string
+}
+
+// continuityLocked decides which mix key out (mergePeer of old and in)
+// keeps. proof came with in's key, if any. It returns a change to report.
+func (ps *PeerStore) continuityLocked(old PeerInfo, existed bool, in PeerInfo, proof mixKeyProof, out *PeerInfo, now time.Time) *keyChange {
+	if existed {
+		// beacons and profiles don't carry this state; a restored record does
+		out.SignKey, out.KeyIssued, out.RejectedKey = old.SignKey, old.KeyIssued, old.RejectedKey
+		out.PendingKey, out.PendingSignKey, out.PendingIssued = old.PendingKey, old.PendingSignKey, old.PendingIssued
+		out.KeyChangedAt, out.KeyConflict = old.KeyChangedAt, old.KeyConflict
+	}
+	if len(out.PendingKey) > 0 {
+		out.KeyState = keyUnconfirmed
+	}
+	sk, signed := proof.verify(in.NodeID, in.PubKey)
+	if !existed || len(old.PubKey) != 32 || len(in.PubKey) != 32 {
+		if len(in.PubKey) == 0 && ps.quarantineOver(old, now) {
+			// the node keeps beaconing and nobody claimed the old key
+			out.takePendingKey()
+			return &keyChange{NodeID: in.NodeID, Outcome: keyAccepted}
+		}
+		// first key: trust on first use
+		if signed && len(out.SignKey) == 0 && bytes.Equal(out.PubKey, in.PubKey) {
+			out.SignKey, out.KeyIssued = sk, proof.Issued
+		}
+		return nil
+	}
+	newKey := in.PubKey
+	change := func(outcome string) *keyChange {
+		return &keyChange{NodeID: in.NodeID, Outcome: outcome}
+	}
+	switch {
+	case bytes.Equal(newKey, old.PubKey):
+		if signed && len(out.SignKey) == 0 {
+			out.SignKey, out.KeyIssued = sk, proof.Issued
+		}
+		if len(old.PendingKey) > 0 && !old.KeyConflict {
+			out.KeyConflict = true
+			return &keyChange{NodeID: in.NodeID, Outcome: keyConflicting}
+		}
+		return nil
+	case bytes.Equal(newKey, old.RejectedKey):
+		out.PubKey = old.PubKey
+		return nil
+	case signed && len(old.SignKey) > 0 && bytes.Equal(sk, old.SignKey) && proof.Issued > old.KeyIssued:
+		out.KeyIssued = proof.Issued
+		out.clearPendingKey()
+		return change(keyRotated)
+	case ps.keyQuarantine <= 0:
+		out.SignKey, out.KeyIssued = nil, 0
+		if signed {
+			out.SignKey, out.KeyIssued = sk, proof.Issued
+		}
+		out.clearPendingKey()
+		return change(keyAccepted)
+	}
+	out.PubKey, out.KeyState = old.PubKey, keyUnconfirmed
+	if !bytes.Equal(old.PendingKey, newKey) {
+		out.KeyConflict = len(old.PendingKey) > 0 // a second new key: someone else is at it too
+		out.PendingKey, out.PendingSignKey, out.PendingIssued, out.KeyChangedAt = newKey, nil, 0, now
+		if signed {
+			out.PendingSignKey, out.PendingIssued = sk, proof.Issued
+		}
+		if out.KeyConflict {
+			return change(keyConflicting)
+		}
+		return change(keyQuarantined)
+	}
+	if ps.quarantineOver(old, now) {
+		out.takePendingKey()
+		return change(keyAccepted)
+	}
+	return nil
+}
+
+// quarantineOver reports whether p's pending key has waited out the
+// quarantine without a conflict.
+func (ps *PeerStore) quarantineOver(p PeerInfo, now time.Time) bool {
+	return len(p.PendingKey) > 0 && !p.KeyConflict && now.Sub(p.KeyChangedAt) >= ps.keyQuarantine
+}
+
+// takePendingKey makes the pending key current. Its signing key, if it came
+// with one, is pinned instead of the old one.
+func (p *PeerInfo) takePendingKey() {
+	p.PubKey, p.SignKey, p.KeyIssued = p.PendingKey, p.PendingSignKey, p.PendingIssued
+	p.RejectedKey = nil
+	p.clearPendingKey()
+}
+
+func (p *PeerInfo) clearPendingKey() {
+	p.PendingKey, p.PendingSignKey, p.PendingIssued = nil, nil, 0
+	p.KeyChangedAt, p.KeyConflict, p.KeyState = time.Time{}, false, ""
+}
+
+// resolveKeyChange confirms or rejects nodeID's pending key.
+func (ps *PeerStore) resolveKeyChange(nodeID string, confirm bool) (*keyChange, bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	p, ok := ps.peers[nodeID]
+	if !ok || len(p.PendingKey) == 0 {
+		return nil, false
+	}
+	c := &keyChange{NodeID: nodeID, Outcome: keyRejected}
+	if confirm {
+		c.Outcome = keyAccepted
+		p.takePendingKey()
+	} else {
+		p.RejectedKey = p.PendingKey
+		p.clearPendingKey()
+	}
+	ps.peers[nodeID] = p
+	ps.bumpLocked(true)
+	return c, true
+}
+
+// keyChanged is the peer store's onKeyChange.
+func (s *Server) keyChanged(c keyChange) {
+	s.peerLog.record([]peerTransition{{NodeID: c.NodeID, Event: peerKeyEvent, Reason: c.Outcome, At: time.Now()}})
+	switch c.Outcome {
+	case keyRotated:
+		log.Printf("[identity] node=%.8s rotated its mix key (signed)", c.NodeID)
+		return
+	case keyQuarantined:
+		log.Printf("[identity] WARNING: node=%.8s beacons a new mix key without a valid signature; keeping the old one for %s (POST /peers/key to confirm or reject)", c.NodeID, s.cfg.KeyChangeQuarantine)
+	case keyConflicting:
+		log.Printf("[identity] WARNING: node=%.8s is beaconed with two mix keys; not taking the new one without an operator", c.NodeID)
+	default:
+		log.Printf("[identity] node=%.8s mix key change %s", c.NodeID, c.Outcome)
+	}
+	s.emit(eventPeerKeyChanged, map[string]any{"node_id": c.NodeID, "outcome": c.Outcome})
+}
+
+// POST /peers/key?node_id=<id>&action=confirm|reject (control): settle an
+// unconfirmed mix key change.
+func (s *Server) handlePeerKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	action := q.Get("action")
+	if action != "confirm" && action != "reject" {
+		http.Error(w, "action must be confirm or reject", http.StatusBadRequest)
+		return
+	}
+	c, ok := s.peers.resolveKeyChange(canonicalNodeID(q.Get("node_id")), action == "confirm")
+	if !ok {
+		http.Error(w, "no unconfirmed key change for that node", http.StatusNotFound)
+		return
+	}
+	s.keyChanged(*c)
+	p, _ := s.peers.Get(c.NodeID)
+	writeJSON(w, p)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+// claimant beacons a NodeID: a mix key and, if it has one, the Ed25519 key
+// that signs it.
+type claimant struct {
+	nodeID string
+	sign   ed25519.PrivateKey
+}
+
+func newClaimant(t *testing.T, nodeID string) claimant {
+	_, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return claimant{nodeID: nodeID, sign: priv}
+}
+
+// beacon is a full beacon for mix key pub, signed at issued unless the
+// claimant has no signing key.
+func (c claimant) beacon(pub []byte, issued int64) Beacon {
+	b := Beacon{NodeID: c.nodeID, APIPort: 9000, API: 1, PubKey: base64.RawURLEncoding.EncodeToString(pub)}
+	if c.sign != nil {
+		b.SignKey = base64.RawURLEncoding.EncodeToString(c.sign.Public().(ed25519.PublicKey))
+		b.KeySig = base64.RawURLEncoding.EncodeToString(ed25519.Sign(c.sign, mixKeyMessage(c.nodeID, pub, issued)))
+		b.KeyIssued = issued
+	}
+	return b
+}
+
+// keyEvents records s's key change outcomes.
+func keyEvents(s *Server) *[]string {
+	var got []string
+	next := s.peers.onKeyChange
+	s.peers.onKeyChange = func(c keyChange) {
+		got = append(got, c.Outcome)
+		next(c)
+	}
+	return &got
+}
+
+func mixKey(b byte) []byte { return bytes.Repeat([]byte{b}, 32) }
+
+func peerKey(t *testing.T, s *Server, nodeID string) PeerInfo {
+	t.Helper()
+	p, ok := s.peers.Get(nodeID)
+	if !ok {
+		t.Fatalf("%.8s not known", nodeID)
+	}
+	return p
+}
+
+// A node restarting with a new mix key signed by its pinned key takes
+// over at once; a stale signed key replayed afterwards doesn't.
+func TestKeyRotationSigned(t *testing.T) {
+	s := newTestServer(t, "s", nil)
+	events := keyEvents(s)
+	node := newClaimant(t, hexA)
+	hearBeacon(s, "10.0.0.2", node.beacon(mixKey(1), 100), nil)
+	if p := peerKey(t, s, hexA); !bytes.Equal(p.PubKey, mixKey(1)) || len(p.SignKey) == 0 {
+		t.Fatalf("first key not pinned: %+v", p)
+	}
+
+	hearBeacon(s, "10.0.0.2", node.beacon(mixKey(2), 200), nil)
+	p := peerKey(t, s, hexA)
+	if !bytes.Equal(p.PubKey, mixKey(2)) || p.KeyState != "" || len(p.PendingKey) != 0 || p.KeyIssued != 200 {
+		t.Fatalf("signed rotation not taken: %+v", p)
+	}
+	if !slices.Equal(*events, []string{keyRotated}) {
+		t.Fatalf("events %v", *events)
+	}
+
+	// an old, validly signed key is not a rotation
+	hearBeacon(s, "10.0.0.2", node.beacon(mixKey(1), 100), nil)
+	if p := peerKey(t, s, hexA); !bytes.Equal(p.PubKey, mixKey(2)) || p.KeyState != keyUnconfirmed {
+		t.Fatalf("replayed old key: %+v", p)
+	}
+}
+
+// Someone else beacons a known NodeID with their own key. The old key
+// stays in use, the peer is flagged and kept out of paths, the real node
+// beaconing again makes it a conflict that the quarantine doesn't settle,
+// and once an operator rejects the key it's ignored.
+func TestKeyConflictingBeacon(t *testing.T) {
+	s := newTestServer(t, "s", nil)
+	events := keyEvents(s)
+	node, attacker := newClaimant(t, hexA), newClaimant(t, hexA)
+	hearBeacon(s, "10.0.0.2", node.beacon(mixKey(1), 100), nil)
+	hearBeacon(s, "10.0.0.66", attacker.beacon(mixKey(9), 200), nil)
+
+	p := peerKey(t, s, hexA)
+	if !bytes.Equal(p.PubKey, mixKey(1)) || p.KeyState != keyUnconfirmed || !bytes.Equal(p.PendingKey, mixKey(9)) {
+		t.Fatalf("attacker's key taken: %+v", p)
+	}
+	if rr := callControl(s, http.MethodGet, "/peers", s.ctlToken, nil); !bytes.Contains(rr.Body.Bytes(), []byte(`"key_state":"`+keyUnconfirmed+`"`)) {
+		t.Fatalf("peers view doesn't flag it: %s", rr.Body)
+	}
+	dest := PeerInfo{NodeID: hexB, Addr: "10.1.0.3:9000", PubKey: mixKey(3)}
+	hops, _, err := chooseHopsFurthest(s.id.NodeID, hexB, []PeerInfo{p, dest}, 3, pathRules{})
+	if err != nil || len(hops) != 1 {
+		t.Fatalf("path through an unconfirmed peer: %v %v", hops, err)
+	}
+
+	hearBeacon(s, "10.0.0.2", node.beacon(mixKey(1), 100), nil)
+	if p := peerKey(t, s, hexA); !p.KeyConflict {
+		t.Fatalf("old key again: no conflict: %+v", p)
+	}
+	// the quarantine runs out; the conflict keeps the old key
+	s.peers.mu.Lock()
+	p = s.peers.peers[hexA]
+	p.KeyChangedAt = time.Now().Add(-2 * s.cfg.KeyChangeQuarantine)
+	s.peers.peers[hexA] = p
+	s.peers.mu.Unlock()
+	hearBeacon(s, "10.0.0.66", attacker.beacon(mixKey(9), 200), nil)
+	if p := peerKey(t, s, hexA); !bytes.Equal(p.PubKey, mixKey(1)) {
+		t.Fatalf("conflicting key taken after the quarantine: %+v", p)
+	}
+	if !slices.Equal(*events, []string{keyQuarantined, keyConflicting}) {
+		t.Fatalf("events %v", *events)
+	}
+
+	if rr := callControl(s, http.MethodPost, "/peers/key?action=reject&node_id="+hexA, s.ctlToken, nil); rr.Code != http.StatusOK {
+		t.Fatalf("reject: %d %s", rr.Code, rr.Body)
+	}
+	hearBeacon(s, "10.0.0.66", attacker.beacon(mixKey(9), 300), nil)
+	if p := peerKey(t, s, hexA); !bytes.Equal(p.PubKey, mixKey(1)) || p.KeyState != "" || len(p.PendingKey) != 0 {
+		t.Fatalf("rejected key came back: %+v", p)
+	}
+	if rr := callControl(s, http.MethodPost, "/peers/key?action=confirm&node_id="+hexA, s.ctlToken, nil); rr.Code != http.StatusNotFound {
+		t.Fatalf("confirm with nothing pending: %d", rr.Code)
+	}
+}
+
+// An unsigned new key nobody disputes is taken once the quarantine is
+// over, or at once when an operator confirms it.
+func TestKeyQuarantineAndConfirm(t *testing.T) {
+	s := newTestServer(t, "s", nil)
+	node := claimant{nodeID: hexA}
+	hearBeacon(s, "10.0.0.2", node.beacon(mixKey(1), 0), nil)
+	hearBeacon(s, "10.0.0.2", node.beacon(mixKey(2), 0), nil)
+	if p := peerKey(t, s, hexA); !bytes.Equal(p.PubKey, mixKey(1)) || p.KeyState != keyUnconfirmed {
+		t.Fatalf("unsigned key taken at once: %+v", p)
+	}
+	hearBeacon(s, "10.0.0.2", node.beacon(mixKey(2), 0), nil)
+	if p := peerKey(t, s, hexA); !bytes.Equal(p.PubKey, mixKey(1)) {
+		t.Fatal("taken before the quarantine ran out")
+	}
+	s.peers.mu.Lock()
+	p := s.peers.peers[hexA]
+	p.KeyChangedAt = time.Now().Add(-s.cfg.KeyChangeQuarantine)
+	s.peers.peers[hexA] = p
+	s.peers.mu.Unlock()
+	hearBeacon(s, "10.0.0.2", node.beacon(mixKey(2), 0), nil)
+	if p := peerKey(t, s, hexA); !bytes.Equal(p.PubKey, mixKey(2)) || p.KeyState != "" {
+		t.Fatalf("not taken after the quarantine: %+v", p)
+	}
+
+	hearBeacon(s, "10.0.0.2", node.beacon(mixKey(3), 0), nil)
+	rr := callControl(s, http.MethodPost, "/peers/key?action=confirm&node_id="+hexA, s.ctlToken, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("confirm: %d %s", rr.Code, rr.Body)
+	}
+	if p := peerKey(t, s, hexA); !bytes.Equal(p.PubKey, mixKey(3)) || p.KeyState != "" {
+		t.Fatalf("confirmed key not taken: %+v", p)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Key usage proof. A file that is re-sent while an escrow of the old key is
+// still pending can leave a key behind that no longer matches its chunk, and
+// escrowing that key loses the file. So a key is checked against the local
+// chunk before it is trusted: chunks are one XChaCha20-Poly1305 blob
+// (nonce||ct), so the check opens the whole chunk. The outcome goes into the
+// key's sidecar, verified_at on success, verify_failed_at and verify_error
+// otherwise. escrowKey refuses a key that fails and sends verified:true with
+// one that passes (verified:false when the chunk isn't on disk to check);
+// /filekeys/import stamps the keys it checked, and /escrow/audit re-checks
+// our own keys. A key that fails fires filekey.mismatch and is listed by
+// GET /filekeys/unverified until it passes again, so the origin can re-send
+// the file.
+
+var (
+	errKeyMismatch = errors.New("key does not decrypt the local chunk")
+	errNoChunk     = errors.New("chunk not held locally")
+)
+
+// proveFileKey opens the local chunk of hashHex with k.
+func proveFileKey(paths *EnvPaths, k [32]byte, hashHex string) error {
+	ct, err := os.ReadFile(filepath.Join(paths.ChunksDir, hashHex+".bin"))
+	if errors.Is(err, os.ErrNotExist) {
+		return errNoChunk
+	}
+	if err != nil {
+		return err
+	}
+	pt, err := aeadOpenWithKey(k[:], ct)
+	if err != nil {
+		return errKeyMismatch
+	}
+	wipeBytes(pt)
+	return nil
+}
+
+// verifyFileKey checks k against the chunk of block hash and records the
+// outcome. A missing chunk or a read error proves nothing and isn't
+// recorded.
+func (s *Server) verifyFileKey(hash, name string, k [32]byte) error {
+	err := proveFileKey(s.paths, k, hash)
+	if err == nil || errors.Is(err, errKeyMismatch) {
+		s.recordKeyProof(hash, name, err)
+	}
+	return err
+}
+
+// checkFileKey verifies the local key of block hash, if we hold one.
+func (s *Server) checkFileKey(hash, name string) error {
+	k, err := findFileKey(s.paths, hash, name)
+	if err != nil {
+		return err
+	}
+	defer wipeBytes(k[:])
+	return s.verifyFileKey(hash, name, k)
+}
+
+// recordKeyProof writes a check's outcome to the sidecar of hash.
+func (s *Server) recordKeyProof(hash, name string, proof error) {
+	dir := filepath.Join(s.paths.BaseDir, "keys")
+	meta, ok := readFileKeyMeta(dir, hash)
+	if !ok {
+		meta.Name = name
+	}
+	flagged := meta.VerifyFailed != 0
+	now := time.Now().Unix()
+	if proof == nil {
+		meta.VerifiedAt, meta.VerifyFailed, meta.VerifyError = now, 0, ""
+	} else {
+		meta.VerifiedAt, meta.VerifyFailed, meta.VerifyError = 0, now, proof.Error()
+	}
+	mb, _ := json.Marshal(meta)
+	if err := writeFileAtomic(filepath.Join(dir, fileKeyMetaName(hash)), mb); err != nil {
+		log.Printf("[keyfile] %s: record verification: %v", hash, err)
+	}
+	switch {
+	case proof != nil && !flagged:
+		log.Printf("[keyfile] WARNING: key for %s (%s) does not decrypt its chunk; not escrowing it, re-send the file", hash, meta.Name)
+		s.emit(eventFileKeyMismatch, map[string]any{"hash": hash, "name": meta.Name})
+	case proof == nil && flagged:
+		log.Printf("[keyfile] key for %s verifies again", hash)
+	}
+}
+
+// GET /filekeys/unverified (control): keys whose last check failed.
+func (s *Server) handleFileKeysUnverified(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	keys := []fileKeyEntry{}
+	for _, it := range s.listFileKeys() {
+		if it.VerifyFailed != 0 {
+			keys = append(keys, it)
+		}
+	}
+	writeJSON(w, map[string]any{"count": len(keys), "keys": keys})
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"keysaver-server/keysaverclient"
+)
+
+// Keysaver failover. --keysaver-url takes an ordered, comma-separated list,
+// primary first. Endpoint n (1-based) authenticates with
+// MIXNETS_KEYSAVER_TOKEN_<n>, else MIXNETS_KEYSAVER_TOKEN. A call goes to
+// the endpoint that last answered and moves down the list after a
+// transport error, a 5xx, 401 or 429. Every minute each endpoint's /health
+// is probed, and once an endpoint ahead of the current one is healthy
+// again the node fails back to it. Saves are idempotent on the keysaver
+// (same hash, same key), so a save retried against the replica is
+// harmless, and its receipt names the endpoint that confirmed it. Key
+// fetches for recovery try every endpoint before a key counts as missing;
+// revokes go to all of them. GET /escrow/status shows each endpoint's
+// health and which one served the last operations.
+
+const (
+	keysaverProbeEvery = time.Minute
+	keysaverOpsKeep    = 50
+)
+
+var errNoKeysaver = errors.New("no --keysaver-url")
+
+// keysaverURLs is cfg.KeySaverURL split into endpoints, in order.
+func (c *Config) keysaverURLs() []string {
+	var out []string
+	for _, u := range splitList(c.KeySaverURL) {
+		out = append(out, strings.TrimRight(u, "/"))
+	}
+	return out
+}
+
+type keysaverEndpoint struct {
+	URL       string     `json:"url"`
+	ID        string     `json:"id"` // sha256 of the URL, as receipts record it
+	Healthy   bool       `json:"healthy"`
+	LastOK    *time.Time `json:"last_ok,omitempty"`
+	LastFail  *time.Time `json:"last_fail,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+	Successes uint64     `json:"successes"`
+	Failures  uint64     `json:"failures"`
+
+	token string
+}
+
+// keysaverOp is one completed keysaver operation.
+type keysaverOp struct {
+	Time     time.Time `json:"time"`
+	Op       string    `json:"op"` // save | get | list | revoke
+	Hash     string    `json:"hash,omitempty"`
+	Endpoint string    `json:"endpoint,omitempty"` // URL that served it; none if all failed
+	Status   int       `json:"status,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+type keysaverPool struct {
+	mu     sync.Mutex
+	eps    []*keysaverEndpoint
+	active int // index of the endpoint that last answered
+	ops    []keysaverOp
+}
+
+func newKeysaverPool(cfg *Config) *keysaverPool {
+	kp := &keysaverPool{}
+	for i, u := range cfg.keysaverURLs() {
+		tok := os.Getenv(keysaverTokenEnv + "_" + strconv.Itoa(i+1))
+		if tok == "" {
+			tok = os.Getenv(keysaverTokenEnv)
+		}
+		kp.eps = append(kp.eps, &keysaverEndpoint{URL: u, ID: sha256Hex([]byte(u)), Healthy: true, token: tok})
+	}
+	return kp
+}
+
+// order is the endpoints to try: the active one, then the rest in list
+// order.
+func (kp *keysaverPool) order() []*keysaverEndpoint {
+	kp.mu.Lock()
+	defer kp.mu.Unlock()
+	if len(kp.eps) == 0 {
+		return nil
+	}
+	out := []*keysaverEndpoint{kp.eps[kp.active]}
+	for i, ep := range kp.eps {
+		if i != kp.active {
+			out = append(out, ep)
+		}
+	}
+	return out
+}
+
+// ids are the receipt IDs of the configured endpoints.
+func (kp *keysaverPool) ids() []string {
+	kp.mu.Lock()
+	defer kp.mu.Unlock()
+	out := make([]string, len(kp.eps))
+	for i, ep := range kp.eps {
+		out[i] = ep.ID
+	}
+	return out
+}
+
+// mark records an endpoint's answer (err nil) or failure.
+func (kp *keysaverPool) mark(ep *keysaverEndpoint, err error) {
+	kp.mu.Lock()
+	defer kp.mu.Unlock()
+	now := time.Now().UTC()
+	if err != nil {
+		ep.Healthy, ep.LastFail, ep.LastError = false, &now, err.Error()
+		ep.Failures++
+		return
+	}
+	ep.Healthy, ep.LastOK = true, &now
+	ep.Successes++
+}
+
+// use makes ep the endpoint calls start at.
+func (kp *keysaverPool) use(ep *keysaverEndpoint, why string) {
+	kp.mu.Lock()
+	defer kp.mu.Unlock()
+	if i := slices.Index(kp.eps, ep); i >= 0 && i != kp.active {
+		log.Printf("[keysaver] %s; now using %s instead of %s", why, ep.URL, kp.eps[kp.active].URL)
+		kp.active = i
+	}
+}
+
+func (kp *keysaverPool) record(op keysaverOp) {
+	op.Time = time.Now().UTC()
+	kp.mu.Lock()
+	defer kp.mu.Unlock()
+	kp.ops = append(kp.ops, op)
+	if len(kp.ops) > keysaverOpsKeep {
+		kp.ops = slices.Delete(kp.ops, 0, len(kp.ops)-keysaverOpsKeep)
+	}
+}
+
+// keysaverClient is ep's keysaverclient, going out through the WAN client.
+func (s *Server) keysaverClient(ep *keysaverEndpoint) *keysaverclient.Client {
+	c := keysaverclient.New(ep.URL, ep.token)
+	c.HTTP = s.wanClient("keysaver", keysaverTimeout)
+	c.NodeID = s.id.NodeID
+	return c
+}
+
+// keysaverStatus is the HTTP status behind a keysaverclient result, 0 for a
+// transport error.
+func keysaverStatus(err error) int {
+	var apiErr *keysaverclient.APIError
+	switch {
+	case err == nil:
+		return http.StatusOK
+	case errors.Is(err, keysaverclient.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, keysaverclient.ErrRevoked):
+		return http.StatusGone
+	case errors.Is(err, keysaverclient.ErrPendingApproval):
+		return http.StatusAccepted
+	case errors.As(err, &apiErr):
+		return apiErr.StatusCode
+	}
+	return 0
+}
+
+// keysaverUnusable is whether err sends the call to the next endpoint: a
+// transport error, a 5xx, 401 or 429.
+func keysaverUnusable(err error) bool {
+	if err == nil {
+		return false
+	}
+	st := keysaverStatus(err)
+	return st == 0 || st >= 500 || st == http.StatusUnauthorized || st == http.StatusTooManyRequests
+}
+
+// keysaverTry makes call against each endpoint in turn until settled
+// accepts its error; an unusable endpoint is always skipped. If no answer
+// is accepted the last usable one is returned. The endpoint is nil when
+// none was usable, and err then joins their errors. The operation is
+// recorded against the endpoint whose answer is returned.
+func keysaverTry[T any](s *Server, op, hash string, call func(*keysaverclient.Client) (T, error), settled func(error) bool) (T, *keysaverEndpoint, error) {
+	var (
+		last    T
+		lastErr error
+		lastEP  *keysaverEndpoint
+		errs    []error
+	)
+	eps := s.keysavers.order()
+	if len(eps) == 0 {
+		return last, nil, errNoKeysaver
+	}
+	for _, ep := range eps {
+		out, err := call(s.keysaverClient(ep))
+		if keysaverUnusable(err) {
+			s.keysavers.mark(ep, err)
+			errs = append(errs, fmt.Errorf("%s: %w", ep.URL, err))
+			continue
+		}
+		s.keysavers.mark(ep, nil)
+		if lastEP == nil && len(errs) > 0 {
+			s.keysavers.use(ep, "failing over")
+		}
+		last, lastErr, lastEP = out, err, ep
+		if settled(err) {
+			break
+		}
+	}
+	if lastEP == nil {
+		err := errors.Join(errs...)
+		s.keysavers.record(keysaverOp{Op: op, Hash: hash, Error: err.Error()})
+		return last, nil, err
+	}
+	s.keysavers.record(keysaverOp{Op: op, Hash: hash, Endpoint: lastEP.URL, Status: keysaverStatus(lastErr)})
+	return last, lastEP, lastErr
+}
+
+// keysaverRequest calls the keysaver with failover: the first usable
+// answer wins.
+func keysaverRequest[T any](s *Server, op, hash string, call func(*keysaverclient.Client) (T, error)) (T, *keysaverEndpoint, error) {
+	return keysaverTry(s, op, hash, call, func(error) bool { return true })
+}
+
+// fetchEscrowedKey asks every keysaver for hash's key until one has it, and
+// stores it locally so later restores don't need the keysaver.
+func (s *Server) fetchEscrowedKey(hash, name string) ([32]byte, error) {
+	var k [32]byte
+	out, ep, err := keysaverTry(s, "get", hash, func(c *keysaverclient.Client) (*keysaverclient.GetKeyResponse, error) {
+		return c.GetKey(context.Background(), hash)
+	}, func(err error) bool { return !errors.Is(err, keysaverclient.ErrNotFound) })
+	switch {
+	case ep == nil:
+		return k, err
+	case errors.Is(err, keysaverclient.ErrNotFound):
+		return k, errors.New("not on any keysaver")
+	case errors.Is(err, keysaverclient.ErrPendingApproval):
+		return k, fmt.Errorf("keysaver %s: release waits for approval %s", ep.URL, out.ApprovalID)
+	case err != nil:
+		return k, fmt.Errorf("keysaver %s: %w", ep.URL, err)
+	case out.Status != "ok":
+		return k, fmt.Errorf("keysaver %s: %s %s", ep.URL, out.Status, out.Error)
+	}
+	raw, err := base64.StdEncoding.DecodeString(out.KeyB64)
+	if err != nil {
+		raw, err = base64.RawURLEncoding.DecodeString(out.KeyB64)
+	}
+	defer wipeBytes(raw)
+	if err != nil || len(raw) != len(k) {
+		return k, fmt.Errorf("keysaver %s: bad key", ep.URL)
+	}
+	copy(k[:], raw)
+	meta := fileKeyMeta{Name: name, Created: time.Now().Unix(), Escrowed: true}
+	if _, err := saveFileKey(s.paths, hash, &k, meta); err != nil {
+		log.Printf("[keysaver] %s: store fetched key: %v", hash, err)
+	}
+	log.Printf("[audit] key for %s fetched from keysaver %s", hash, ep.URL)
+	return k, nil
+}
+
+// fileKeyFor is the local key for block hash, else the escrowed one.
+func (s *Server) fileKeyFor(hash, name string) ([32]byte, error) {
+	k, err := findFileKey(s.paths, hash, name)
+	if err == nil || len(s.keysavers.order()) == 0 {
+		return k, err
+	}
+	return s.fetchEscrowedKey(hash, name)
+}
+
+// probeKeysavers checks /health on every endpoint and fails back to the
+// earliest healthy one.
+func (s *Server) probeKeysavers() {
+	s.keysavers.mu.Lock()
+	eps := slices.Clone(s.keysavers.eps)
+	s.keysavers.mu.Unlock()
+	for _, ep := range eps {
+		_, err := s.keysaverClient(ep).Health(context.Background())
+		kp := s.keysavers
+		kp.mu.Lock()
+		now := time.Now().UTC()
+		back := false
+		if err != nil {
+			ep.Healthy, ep.LastFail, ep.LastError = false, &now, err.Error()
+		} else {
+			ep.Healthy, ep.LastOK = true, &now
+			back = slices.Index(kp.eps, ep) < kp.active
+		}
+		kp.mu.Unlock()
+		if back {
+			kp.use(ep, ep.URL+" healthy again")
+		}
+	}
+}
+
+// keysaverFailing lists the failed checks of a deep health answer, "" if
+// none did. One too old for deep checks answers the plain health, which
+// has no checks; a status other than ok with no failed check (a 503 from
+// a proxy in front, say) still counts as failing.
+func keysaverFailing(h *keysaverclient.HealthResponse) string {
+	var out []string
+	for _, c := range h.Checks {
+		if c.Status == "fail" {
+			out = append(out, c.Name+": "+c.Detail)
+		}
+	}
+	if len(out) == 0 && h.Status != "ok" {
+		return fmt.Sprintf("status %q", h.Status)
+	}
+	return strings.Join(out, "; ")
+}
+
+// diagnoseKeysavers runs the deep health check on every endpoint, for an
+// escrow that failed, and describes the ones that aren't well.
+func (s *Server) diagnoseKeysavers() string {
+	var out []string
+	for _, ep := range s.keysavers.order() {
+		h, err := s.keysaverClient(ep).DeepHealth(context.Background())
+		switch {
+		case err != nil:
+			out = append(out, ep.URL+": "+err.Error())
+		case keysaverFailing(h) != "":
+			out = append(out, ep.URL+": "+keysaverFailing(h))
+		}
+	}
+	return strings.Join(out, "; ")
+}
+
+func (s *Server) startKeysaverProbeLoop(ctx context.Context) {
+	if len(s.keysavers.order()) == 0 {
+		return
+	}
+	ticker := time.NewTicker(keysaverProbeEvery)
+	defer ticker.Stop()
+	for {
+		s.probeKeysavers()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// GET /escrow/status (control): keysaver endpoints in order with their
+// health, the one in use, and the latest operations (newest last).
+func (s *Server) handleEscrowStatus(w http.ResponseWriter, r *http.Request) {
+	kp := s.keysavers
+	kp.mu.Lock()
+	eps := make([]keysaverEndpoint, len(kp.eps))
+	for i, ep := range kp.eps {
+		eps[i] = *ep
+	}
+	resp := map[string]any{"endpoints": eps, "ops": append([]keysaverOp{}, kp.ops...)}
+	if len(kp.eps) > 0 {
+		resp["active"] = kp.eps[kp.active].URL
+	}
+	kp.mu.Unlock()
+	writeJSON(w, resp)
+}
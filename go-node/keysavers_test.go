@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+
+	"keysaver-server/keysaverclient"
+)
+
+// fakeKeysaver is a keysaver-server stand-in holding keys in memory. down
+// makes it answer 503 to everything.
+type fakeKeysaver struct {
+	mu    sync.Mutex
+	keys  map[string]string // hash -> key_b64
+	saves []map[string]any  // raw /keys/save bodies
+	down  bool
+}
+
+func newFakeKeysaver(t *testing.T) (*fakeKeysaver, *httptest.Server) {
+	f := &fakeKeysaver{keys: map[string]string{}}
+	ts := httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(ts.Close)
+	return f, ts
+}
+
+func (f *fakeKeysaver) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.down {
+		http.Error(w, `{"error":"down"}`, http.StatusServiceUnavailable)
+		return
+	}
+	hash := r.URL.Query().Get("hash")
+	switch r.URL.Path {
+	case "/health":
+		json.NewEncoder(w).Encode(keysaverclient.HealthResponse{Status: "ok", Service: "keysaver-server"})
+	case "/keys/save":
+		var raw map[string]any
+		json.NewDecoder(r.Body).Decode(&raw)
+		f.saves = append(f.saves, raw)
+		h, _ := raw["hash"].(string)
+		f.keys[h], _ = raw["key_b64"].(string)
+		json.NewEncoder(w).Encode(keysaverclient.SaveKeyResponse{Status: "ok", FileHash: h, Confirmation: "conf-" + h})
+	case "/keys/get":
+		k, ok := f.keys[hash]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(keysaverclient.GetKeyResponse{Status: "not_found", FileHash: hash})
+			return
+		}
+		json.NewEncoder(w).Encode(keysaverclient.GetKeyResponse{Status: "ok", FileHash: hash, KeyB64: k})
+	case "/keys/revoke":
+		if _, ok := f.keys[hash]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(keysaverclient.ErrorResponse{Status: "not_found", Error: "key not found"})
+			return
+		}
+		delete(f.keys, hash)
+		json.NewEncoder(w).Encode(keysaverclient.RevokeKeyResponse{Status: "ok", Hash: hash})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func keysaverNode(t *testing.T, urls ...string) *Server {
+	cfg := defaultConfig()
+	for i, u := range urls {
+		if i > 0 {
+			cfg.KeySaverURL += ","
+		}
+		cfg.KeySaverURL += u
+	}
+	return newTestServer(t, "escrow", cfg)
+}
+
+// The wire body of /keys/save must stay what nodes sent before they used
+// keysaverclient, so older keysavers keep accepting it.
+func TestEscrowSaveWireCompatible(t *testing.T) {
+	f, ts := newFakeKeysaver(t)
+	s := keysaverNode(t, ts.URL)
+	hash := sha256Hex([]byte("chunk"))
+	var k [32]byte
+	k[0] = 7
+	if _, err := saveFileKey(s.paths, hash, &k, fileKeyMeta{Name: "a.txt"}); err != nil {
+		t.Fatal(err)
+	}
+	conf, ep, err := s.escrowKey(Block{Hash: hash, Name: "a.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf != "conf-"+hash || ep.URL != ts.URL {
+		t.Fatalf("confirmation %q from %v", conf, ep)
+	}
+	got := slices.Sorted(maps.Keys(f.saves[0]))
+	want := []string{"hash", "key_b64", "name", "node_id", "org_id"} // verified omitted: no local chunk
+	if !slices.Equal(got, want) {
+		t.Fatalf("save body fields %v, want %v", got, want)
+	}
+	if f.saves[0]["key_b64"] != base64.StdEncoding.EncodeToString(k[:]) || f.saves[0]["node_id"] != s.id.NodeID {
+		t.Fatalf("save body %v", f.saves[0])
+	}
+}
+
+func TestKeysaverFailover(t *testing.T) {
+	primary, ts1 := newFakeKeysaver(t)
+	replica, ts2 := newFakeKeysaver(t)
+	s := keysaverNode(t, ts1.URL, ts2.URL)
+	hash := sha256Hex([]byte("x"))
+	var k [32]byte
+	k[31] = 9
+	replica.keys[hash] = base64.StdEncoding.EncodeToString(k[:])
+
+	primary.down = true
+	got, err := s.fetchEscrowedKey(hash, "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != k {
+		t.Fatal("wrong key")
+	}
+	if eps := s.keysavers.order(); eps[0].URL != ts2.URL || eps[1].Healthy {
+		t.Fatalf("after a 503 the replica should lead: %s first, primary healthy=%v", eps[0].URL, eps[1].Healthy)
+	}
+
+	// back up, then probed: calls fail back to the primary
+	primary.mu.Lock()
+	primary.down = false
+	primary.mu.Unlock()
+	s.probeKeysavers()
+	if eps := s.keysavers.order(); eps[0].URL != ts1.URL {
+		t.Fatalf("no failback: %s first", eps[0].URL)
+	}
+}
+
+func TestKeysaverNotFoundTriesEvery(t *testing.T) {
+	_, ts1 := newFakeKeysaver(t)
+	replica, ts2 := newFakeKeysaver(t)
+	s := keysaverNode(t, ts1.URL, ts2.URL)
+	hash := sha256Hex([]byte("y"))
+	if _, err := s.fetchEscrowedKey(hash, "y"); err == nil || err.Error() != "not on any keysaver" {
+		t.Fatalf("missing everywhere: %v", err)
+	}
+	var k [32]byte
+	replica.keys[hash] = base64.StdEncoding.EncodeToString(k[:])
+	if _, err := s.fetchEscrowedKey(hash, "y"); err != nil {
+		t.Fatalf("held by the replica only: %v", err)
+	}
+}
+
+func TestRevokeEscrowedKey(t *testing.T) {
+	a, ts1 := newFakeKeysaver(t)
+	_, ts2 := newFakeKeysaver(t)
+	s := keysaverNode(t, ts1.URL, ts2.URL)
+	hash := sha256Hex([]byte("z"))
+	if res := s.revokeEscrowedKey(hash); res != "not_found" {
+		t.Fatalf("revoke unknown: %s", res)
+	}
+	a.keys[hash] = "k"
+	if res := s.revokeEscrowedKey(hash); res != "revoked" {
+		t.Fatalf("revoke held: %s", res)
+	}
+	a.mu.Lock()
+	a.down = true
+	a.mu.Unlock()
+	if res := s.revokeEscrowedKey(hash); res != "error: "+(&keysaverclient.APIError{StatusCode: 503, Message: "down"}).Error() {
+		t.Fatalf("revoke with the primary down: %s", res)
+	}
+}
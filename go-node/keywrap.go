@@ -2,9 +2,14 @@ package main
 
 import (
 	"crypto/rand"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"log"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
 
 	"golang.org/x/crypto/chacha20poly1305"
 )
@@ -20,6 +25,7 @@ func newFileKey() ([32]byte, error) {
 }
 
 func aeadSealWithKey(k []byte, plain []byte) ([]byte, error) {
+	defer hSeal.time()()
 	aead, err := chacha20poly1305.NewX(k)
 	if err != nil {
 		return nil, err
@@ -33,6 +39,7 @@ func aeadSealWithKey(k []byte, plain []byte) ([]byte, error) {
 }
 
 func aeadOpenWithKey(k []byte, blob []byte) ([]byte, error) {
+	defer hOpen.time()()
 	aead, err := chacha20poly1305.NewX(k)
 	if err != nil {
 		return nil, err
@@ -55,15 +62,78 @@ func ensureKeysDir(paths *EnvPaths) (string, error) {
 	return dir, err
 }
 
-func saveFileKey(paths *EnvPaths, name string, k *[32]byte) (string, error) {
+// fileKeyMeta is the JSON sidecar stored next to each key file.
+type fileKeyMeta struct {
+	Name     string `json:"name"`
+	Created  int64  `json:"created_unix"`
+	Size     int    `json:"size"`               // plaintext bytes
+	Escrowed bool   `json:"escrowed,omitempty"` // key saved to a keysaver
+	// last check against the local chunk (keyproof.go)
+	VerifiedAt   int64  `json:"verified_at,omitempty"`
+	VerifyFailed int64  `json:"verify_failed_at,omitempty"`
+	VerifyError  string `json:"verify_error,omitempty"`
+}
+
+// saveFileKey stores k as <hash>.fkey plus its <hash>.json sidecar.
+func saveFileKey(paths *EnvPaths, hashHex string, k *[32]byte, meta fileKeyMeta) (string, error) {
 	dir, err := ensureKeysDir(paths)
 	if err != nil {
 		return "", err
 	}
-	fp := filepath.Join(dir, name)
+	fp := filepath.Join(dir, fileKeyName(hashHex))
 	// store raw bytes (local secure dir). If you want, store base64 instead.
-	err = os.WriteFile(fp, k[:], 0o600)
-	return fp, err
+	if err := os.WriteFile(fp, k[:], 0o600); err != nil {
+		return fp, err
+	}
+	mb, _ := json.Marshal(meta)
+	return fp, os.WriteFile(filepath.Join(dir, fileKeyMetaName(hashHex)), mb, 0o600)
+}
+
+// fileKeyName is the local key filename for a chunk: <full ciphertext sha256>.fkey
+func fileKeyName(hashHex string) string {
+	return hashHex + ".fkey"
+}
+
+func fileKeyMetaName(hashHex string) string {
+	return hashHex + ".json"
+}
+
+// legacyFileKeyName is the pre-migration name: <first16_of_hash>.<ext>.fkey
+func legacyFileKeyName(hashHex, name string) string {
+	ext := "bin"
+	if dot := strings.LastIndex(name, "."); dot >= 0 && dot+1 < len(name) {
+		ext = name[dot+1:]
+	}
+	prefix := hashHex
+	if len(prefix) > 16 {
+		prefix = prefix[:16]
+	}
+	return fmt.Sprintf("%s.%s.fkey", prefix, ext)
+}
+
+var legacyKeyRe = regexp.MustCompile(`^([0-9a-f]{16})\.[^./\\]+\.fkey$`)
+
+// findFileKey loads the key for a chunk by its full hash, falling back to
+// legacy names: the one derived from name if given, else the only legacy
+// file with the hash prefix.
+func findFileKey(paths *EnvPaths, hashHex, name string) ([32]byte, error) {
+	k, err := loadFileKey(paths, fileKeyName(hashHex))
+	if err == nil || !os.IsNotExist(err) {
+		return k, err
+	}
+	if name != "" {
+		if k, lerr := loadFileKey(paths, legacyFileKeyName(hashHex, name)); lerr == nil {
+			return k, nil
+		}
+	}
+	if len(hashHex) < 16 {
+		return k, err
+	}
+	matches, _ := filepath.Glob(filepath.Join(paths.BaseDir, "keys", hashHex[:16]+".*.fkey"))
+	if len(matches) != 1 {
+		return k, err
+	}
+	return loadFileKey(paths, filepath.Base(matches[0]))
 }
 
 func loadFileKey(paths *EnvPaths, name string) ([32]byte, error) {
@@ -79,3 +149,75 @@ func loadFileKey(paths *EnvPaths, name string) ([32]byte, error) {
 	copy(k[:], b)
 	return k, nil
 }
+
+// migrateFileKeys renames legacy <prefix16>.<ext>.fkey files to <hash>.fkey,
+// using the chain to map prefixes to full hashes.
+func (s *Server) migrateFileKeys() {
+	if moved := renameLegacyFileKeys(s.paths, s.readChain()); len(moved) > 0 {
+		log.Printf("[keyfile] renamed %d legacy key files to full-hash names", len(moved))
+	}
+}
+
+// renameLegacyFileKeys renames the legacy key files it can match to a
+// block in chain and returns the old names. When several blocks share a
+// prefix, the key that opens the local chunk wins; otherwise the file is
+// left for findFileKey's fallback.
+func renameLegacyFileKeys(paths *EnvPaths, chain []Block) []string {
+	dir := filepath.Join(paths.BaseDir, "keys")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	byPrefix := make(map[string][]Block)
+	for _, b := range chain {
+		if len(b.Hash) < 16 {
+			continue
+		}
+		p := b.Hash[:16]
+		dup := false
+		for _, o := range byPrefix[p] {
+			dup = dup || o.Hash == b.Hash
+		}
+		if !dup {
+			byPrefix[p] = append(byPrefix[p], b)
+		}
+	}
+	var moved []string
+	for _, e := range entries {
+		m := legacyKeyRe.FindStringSubmatch(e.Name())
+		if m == nil {
+			continue
+		}
+		k, err := loadFileKey(paths, e.Name())
+		if err != nil {
+			continue
+		}
+		var match *Block
+		for i, b := range byPrefix[m[1]] {
+			if len(byPrefix[m[1]]) == 1 || keyOpensChunk(paths, k, b.Hash) {
+				match = &byPrefix[m[1]][i]
+				break
+			}
+		}
+		if match == nil {
+			continue
+		}
+		target := filepath.Join(dir, fileKeyName(match.Hash))
+		if _, err := os.Stat(target); err == nil {
+			continue
+		}
+		if err := os.Rename(filepath.Join(dir, e.Name()), target); err != nil {
+			log.Printf("[keyfile] migrate %s: %v", e.Name(), err)
+			continue
+		}
+		mb, _ := json.Marshal(fileKeyMeta{Name: match.Name, Created: match.Created, Size: match.Size})
+		_ = os.WriteFile(filepath.Join(dir, fileKeyMetaName(match.Hash)), mb, 0o600)
+		moved = append(moved, e.Name())
+	}
+	return moved
+}
+
+// keyOpensChunk reports whether k decrypts the local chunk for hashHex.
+func keyOpensChunk(paths *EnvPaths, k [32]byte, hashHex string) bool {
+	return proveFileKey(paths, k, hashHex) == nil
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() { registerFeature(featureKVReconcile) }
+
+// Anti-entropy for the kv store. kv is memory-only and fanout best-effort,
+// so blob-* envelopes and published peer snapshots drift between nodes
+// after restarts. Every KVReconcileInterval a node picks one recently heard
+// peer and compares kv summaries with it (GET /kv/summary). A summary holds,
+// per key prefix, a count and a hash of the key set split into kvBuckets
+// buckets by key hash, so it stays about 10 KB per prefix however many keys
+// there are. Only buckets that differ are listed (GET /kv/keys), and the keys the
+// node lacks are pulled through /fetch and checked against the hash in the
+// listing and, for blobs, the hash in the key. Pulls only fill gaps: a key
+// both sides hold is left alone even if the values differ. Mix inbox
+// messages and keys of other orgs are never reconciled.
+
+const (
+	defaultKVReconcileInterval = 10 * time.Minute
+
+	kvBuckets          = 256
+	kvBucketHashLen    = 8 // bytes of the XOR of key hashes shown per bucket
+	kvReconcileMaxPull = 512
+	kvReconcileKeep    = 16
+	kvPeerTimeout      = 15 * time.Second
+	kvSummaryBody      = 1 << 20
+	kvKeysBody         = 16 << 20
+
+	kvPrefixBlob  = "blob"
+	kvPrefixPeers = "peers"
+)
+
+var kvPrefixes = []string{kvPrefixBlob, kvPrefixPeers}
+
+// kvPrefix says which reconciled prefix key belongs to, or "" for keys that
+// stay local.
+func (s *Server) kvPrefix(key string) string {
+	switch {
+	case blobKeyRe.MatchString(key):
+		return kvPrefixBlob
+	case strings.HasPrefix(key, s.orgDHTKey("peers:")):
+		return kvPrefixPeers
+	}
+	return ""
+}
+
+type kvBucket struct {
+	Count int    `json:"n"`
+	Hash  string `json:"h,omitempty"`
+}
+
+type kvPrefixSummary struct {
+	Count   int        `json:"count"`
+	Hash    string     `json:"hash"`
+	Buckets []kvBucket `json:"buckets"`
+}
+
+// kvSummary is what /kv/summary serves.
+type kvSummary struct {
+	NodeID   string                      `json:"node_id"`
+	Prefixes map[string]*kvPrefixSummary `json:"prefixes"`
+}
+
+// kvKeyEntry is one key of a /kv/keys listing.
+type kvKeyEntry struct {
+	Key    string `json:"key"`
+	SHA256 string `json:"sha256"` // of the value
+	Size   int    `json:"size"`
+}
+
+func kvKeyHash(key string) [sha256.Size]byte { return sha256.Sum256([]byte(key)) }
+
+// summarizeKV hashes the reconciled part of kv. Bucket and prefix hashes
+// are XORs of key hashes, so they don't depend on insertion order.
+func (s *Server) summarizeKV() kvSummary {
+	type acc struct {
+		count   int
+		all     [sha256.Size]byte
+		counts  [kvBuckets]int
+		buckets [kvBuckets][sha256.Size]byte
+	}
+	accs := make(map[string]*acc, len(kvPrefixes))
+	for _, p := range kvPrefixes {
+		accs[p] = &acc{}
+	}
+	s.mu.RLock()
+	for k := range s.kv {
+		p := s.kvPrefix(k)
+		if p == "" {
+			continue
+		}
+		a, h := accs[p], kvKeyHash(k)
+		b := int(h[0]) % kvBuckets
+		a.count++
+		a.counts[b]++
+		for i := range h {
+			a.all[i] ^= h[i]
+			a.buckets[b][i] ^= h[i]
+		}
+	}
+	s.mu.RUnlock()
+	sum := kvSummary{NodeID: s.id.NodeID, Prefixes: make(map[string]*kvPrefixSummary, len(accs))}
+	for p, a := range accs {
+		ps := &kvPrefixSummary{Count: a.count, Hash: hex.EncodeToString(a.all[:kvBucketHashLen]), Buckets: make([]kvBucket, kvBuckets)}
+		for i := range ps.Buckets {
+			if a.counts[i] > 0 {
+				ps.Buckets[i] = kvBucket{Count: a.counts[i], Hash: hex.EncodeToString(a.buckets[i][:kvBucketHashLen])}
+			}
+		}
+		sum.Prefixes[p] = ps
+	}
+	return sum
+}
+
+// kvBucketKeys lists the reconciled keys of prefix in bucket b.
+func (s *Server) kvBucketKeys(prefix string, b int) []kvKeyEntry {
+	var out []kvKeyEntry
+	s.mu.RLock()
+	for k, v := range s.kv {
+		if s.kvPrefix(k) != prefix {
+			continue
+		}
+		if h := kvKeyHash(k); int(h[0])%kvBuckets != b {
+			continue
+		}
+		out = append(out, kvKeyEntry{Key: k, SHA256: sha256Hex(v), Size: len(v)})
+	}
+	s.mu.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out
+}
+
+// GET /kv/summary?org=<id> (public)
+func (s *Server) handleKVSummary(w http.ResponseWriter, r *http.Request) {
+	org := r.URL.Query().Get("org")
+	if org == "" && s.refuseLegacy(w, legacyUntaggedOrg) {
+		return
+	}
+	if !s.org.accept(org, &s.org.foreignReplicates) {
+		http.Error(w, "foreign org", http.StatusForbidden)
+		return
+	}
+	writeJSON(w, s.summarizeKV())
+}
+
+// GET /kv/keys?prefix=<p>&bucket=<n>&org=<id> (public): the keys of one
+// summary bucket with the hash of each value.
+func (s *Server) handleKVKeys(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("org") == "" && s.refuseLegacy(w, legacyUntaggedOrg) {
+		return
+	}
+	if !s.org.accept(q.Get("org"), &s.org.foreignReplicates) {
+		http.Error(w, "foreign org", http.StatusForbidden)
+		return
+	}
+	prefix := q.Get("prefix")
+	if prefix != kvPrefixBlob && prefix != kvPrefixPeers {
+		http.Error(w, "bad ?prefix=", http.StatusBadRequest)
+		return
+	}
+	b, err := strconv.Atoi(q.Get("bucket"))
+	if err != nil || b < 0 || b >= kvBuckets {
+		http.Error(w, "bad ?bucket=", http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, s.kvBucketKeys(prefix, b))
+}
+
+// kvRound is the outcome of one reconciliation with one peer.
+type kvRound struct {
+	Peer     string    `json:"peer"`
+	Started  time.Time `json:"started"`
+	Millis   int64     `json:"ms"`
+	InSync   bool      `json:"in_sync"`
+	Buckets  int       `json:"buckets"` // buckets that differed
+	Listed   int       `json:"listed"`  // keys in those buckets on the peer
+	Missing  int       `json:"missing"`
+	Pulled   int       `json:"pulled"`
+	OnDisk   int       `json:"on_disk"` // missing from memory but served from the chunk store
+	Deleted  int       `json:"deleted"` // tombstoned or expired here, not pulled
+	Failed   int       `json:"failed"`
+	Deferred int       `json:"deferred,omitempty"` // over kvReconcileMaxPull, left for the next round
+	Error    string    `json:"error,omitempty"`
+}
+
+type kvSync struct {
+	mu      sync.Mutex
+	running bool
+	rounds  int
+	pulled  int
+	failed  int
+	history []kvRound // newest last
+}
+
+func (ks *kvSync) begin() bool {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if ks.running {
+		return false
+	}
+	ks.running = true
+	return true
+}
+
+func (ks *kvSync) end(r kvRound) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.running = false
+	ks.rounds++
+	ks.pulled += r.Pulled
+	ks.failed += r.Failed
+	ks.history = append(ks.history, r)
+	if len(ks.history) > kvReconcileKeep {
+		ks.history = ks.history[len(ks.history)-kvReconcileKeep:]
+	}
+}
+
+var errKVBusy = errors.New("reconciliation already running")
+
+// reconcileKV runs one round against p, recording it in s.kvs.
+func (s *Server) reconcileKV(ctx context.Context, p PeerInfo) (r kvRound, err error) {
+	if !s.kvs.begin() {
+		return r, errKVBusy
+	}
+	r = kvRound{Peer: p.NodeID, Started: time.Now()}
+	defer func() { // also on panic, or the next round never starts
+		if err != nil {
+			r.Error = err.Error()
+		}
+		r.Millis = time.Since(r.Started).Milliseconds()
+		s.kvs.end(r)
+	}()
+	err = s.reconcileWith(ctx, p, &r)
+	return r, err
+}
+
+func (s *Server) reconcileWith(ctx context.Context, p PeerInfo, r *kvRound) error {
+	var theirs kvSummary
+	if err := s.kvFromPeer(p, "/kv/summary", url.Values{}, kvSummaryBody, &theirs); err != nil {
+		return err
+	}
+	ours := s.summarizeKV()
+	type bucketRef struct {
+		prefix string
+		b      int
+	}
+	var diff []bucketRef
+	for _, prefix := range kvPrefixes {
+		tp, op := theirs.Prefixes[prefix], ours.Prefixes[prefix]
+		if tp == nil || tp.Count == 0 || (tp.Count == op.Count && tp.Hash == op.Hash) {
+			continue
+		}
+		for b := 0; b < kvBuckets && b < len(tp.Buckets); b++ {
+			if tp.Buckets[b].Count > 0 && tp.Buckets[b] != op.Buckets[b] {
+				diff = append(diff, bucketRef{prefix, b})
+			}
+		}
+	}
+	r.Buckets = len(diff)
+	r.InSync = len(diff) == 0
+	if r.InSync {
+		return nil
+	}
+
+	gone := tombstonesIn(s.readChain())
+	for _, d := range diff {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		var keys []kvKeyEntry
+		q := url.Values{"prefix": {d.prefix}, "bucket": {strconv.Itoa(d.b)}}
+		if err := s.kvFromPeer(p, "/kv/keys", q, kvKeysBody, &keys); err != nil {
+			return err
+		}
+		r.Listed += len(keys)
+		for _, e := range keys {
+			if s.kvPrefix(e.Key) != d.prefix {
+				continue // not ours to take (e.g. another org's snapshot)
+			}
+			s.mu.RLock()
+			_, have := s.kv[e.Key]
+			s.mu.RUnlock()
+			if have {
+				continue
+			}
+			r.Missing++
+			if m := blobKeyRe.FindStringSubmatch(e.Key); m != nil {
+				_, tomb := gone[m[1]]
+				_, expired := s.retention.expired(m[1])
+				if tomb || expired {
+					r.Deleted++
+					continue
+				}
+				if _, ok := s.blobFromDisk(e.Key); ok {
+					r.OnDisk++
+					continue
+				}
+			}
+			if r.Pulled+r.Failed >= kvReconcileMaxPull {
+				r.Deferred++
+				continue
+			}
+			if err := s.pullKVEntry(p, e); err != nil {
+				log.Printf("[kv] pull %s from %.8s: %v", e.Key, p.NodeID, err)
+				r.Failed++
+				continue
+			}
+			r.Pulled++
+		}
+	}
+	return nil
+}
+
+// pullKVEntry fetches e from p and keeps it if it matches the listing.
+func (s *Server) pullKVEntry(p PeerInfo, e kvKeyEntry) error {
+	b, _, err := s.fetchFromPeer(p, e.Key)
+	if err != nil {
+		return err
+	}
+	if sha256Hex(b) != e.SHA256 {
+		err := errors.New("value hash does not match listing")
+		s.badContent(p, e.Key, err)
+		return err
+	}
+	s.mu.Lock()
+	if _, ok := s.kv[e.Key]; !ok {
+		s.kv[e.Key] = b
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *Server) kvFromPeer(p PeerInfo, path string, q url.Values, limit int64, out any) error {
+	q.Set("org", s.org.ID)
+	resp, _, err := s.getFromPeer(p, http.MethodGet, peerPath(p, path)+"?"+q.Encode(), kvPeerTimeout)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return fmt.Errorf("%s: HTTP %d", path, resp.StatusCode)
+	}
+	b, err := readPeerBody(resp, limit)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, out)
+}
+
+// kvReconcilePeer picks a random peer heard from recently.
+func (s *Server) kvReconcilePeer() (PeerInfo, bool) {
+	heard := 3 * s.cfg.BroadcastIntv
+	var live []PeerInfo
+	for _, p := range s.peers.List() {
+		if p.NodeID == s.id.NodeID || p.Addr == "" || time.Since(p.LastSeen) > heard {
+			continue
+		}
+		live = append(live, p)
+	}
+	if len(live) == 0 {
+		return PeerInfo{}, false
+	}
+	n, _ := rand.Int(rand.Reader, big.NewInt(int64(len(live))))
+	return live[n.Int64()], true
+}
+
+// startKVReconcileLoop reconciles with one random live peer per interval.
+func (s *Server) startKVReconcileLoop(ctx context.Context) {
+	if s.cfg.KVReconcileInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(s.cfg.KVReconcileInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		p, ok := s.kvReconcilePeer()
+		if !ok {
+			continue
+		}
+		func() {
+			defer recoverOnce("kv-reconcile")
+			r, err := s.reconcileKV(ctx, p)
+			switch {
+			case errors.Is(err, errKVBusy):
+			case err != nil:
+				log.Printf("[kv] reconcile with %.8s: %v", p.NodeID, err)
+			case r.Pulled > 0 || r.Failed > 0:
+				log.Printf("[kv] reconcile with %.8s: %d buckets differ, %d pulled, %d failed", p.NodeID, r.Buckets, r.Pulled, r.Failed)
+			}
+		}()
+	}
+}
+
+// POST /kv/reconcile[?with=<node_id>] (control): one round now, with the
+// given peer or a random live one.
+func (s *Server) handleKVReconcile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	var p PeerInfo
+	with, ok := s.nodeIDParam(w, "with", r.URL.Query().Get("with"))
+	if !ok {
+		return
+	}
+	if with != "" {
+		if p, ok = s.peers.Get(with); !ok || p.Addr == "" {
+			http.Error(w, "unknown peer", http.StatusNotFound)
+			return
+		}
+	} else {
+		var ok bool
+		if p, ok = s.kvReconcilePeer(); !ok {
+			http.Error(w, "no live peers", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	round, err := s.reconcileKV(r.Context(), p)
+	switch {
+	case errors.Is(err, errKVBusy):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	default:
+		writeJSON(w, round)
+	}
+}
+
+// GET /kv/reconcile-status (control)
+func (s *Server) handleKVReconcileStatus(w http.ResponseWriter, r *http.Request) {
+	sum := s.summarizeKV()
+	keys := make(map[string]int, len(sum.Prefixes))
+	for p, ps := range sum.Prefixes {
+		keys[p] = ps.Count
+	}
+	ks := s.kvs
+	ks.mu.Lock()
+	hist := append([]kvRound(nil), ks.history...)
+	out := map[string]any{
+		"enabled":  s.cfg.KVReconcileInterval > 0,
+		"interval": s.cfg.KVReconcileInterval.String(),
+		"keys":     keys,
+		"running":  ks.running,
+		"rounds":   ks.rounds,
+		"pulled":   ks.pulled,
+		"failed":   ks.failed,
+		"history":  hist,
+	}
+	ks.mu.Unlock()
+	writeJSON(w, out)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Lamport clock for a cross-node order that doesn't depend on wall clocks.
+// Every send ticks it and stamps the value into the envelope; every receive
+// merges (local = max(local, received) + 1). Listings sort by
+// (logical, origin, msgid), which every node agrees on.
+//
+// The state file holds a high-water mark, not the value: we reserve
+// lamportReserve ticks per write and restart from the mark, so the counter
+// never goes backwards across restarts and we don't fsync on every message.
+
+const (
+	lamportFile    = "lamport.state"
+	lamportReserve = 256
+
+	logicalClockHeader = "X-Logical-Clock" // on /chain/list
+)
+
+type lamportClock struct {
+	path string
+
+	mu    sync.Mutex
+	n     uint64
+	limit uint64 // persisted high-water mark; n must stay below it
+}
+
+func newLamportClock(paths *EnvPaths) *lamportClock {
+	c := &lamportClock{path: filepath.Join(paths.BaseDir, lamportFile)}
+	if b, err := os.ReadFile(c.path); err == nil {
+		n, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+		if err != nil {
+			log.Printf("[lamport] ignoring bad %s: %v", c.path, err)
+		}
+		c.n, c.limit = n, n
+	}
+	return c
+}
+
+// tick advances the clock for a local send and returns the stamp.
+func (c *lamportClock) tick() uint64 {
+	return c.observe(0)
+}
+
+// observe merges a received stamp (0 = none) and returns the new value.
+func (c *lamportClock) observe(remote uint64) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if remote > c.n {
+		c.n = remote
+	}
+	c.n++
+	if c.n >= c.limit {
+		limit := c.n + lamportReserve
+		if err := writeFileAtomic(c.path, []byte(strconv.FormatUint(limit, 10)+"\n")); err != nil {
+			// keep counting; a restart may repeat values but never reorder
+			// what was already stamped with a higher one
+			log.Printf("[lamport] persist: %v", err)
+		} else {
+			c.limit = limit
+		}
+	}
+	return c.n
+}
+
+func (c *lamportClock) value() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.n
+}
+
+// sortBlocksLogical orders blocks by (logical, origin, hash); the chain
+// order is kept among equal keys.
+func sortBlocksLogical(blocks []Block) {
+	sort.SliceStable(blocks, func(i, j int) bool {
+		a, b := blocks[i], blocks[j]
+		if a.Logical != b.Logical {
+			return a.Logical < b.Logical
+		}
+		if a.OriginID != b.OriginID {
+			return a.OriginID < b.OriginID
+		}
+		return a.Hash < b.Hash
+	})
+}
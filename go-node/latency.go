@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"log"
+	"math"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Inter-node latency. Each node times HEAD /peer-info against a few random
+// peers heard in recent beacons, within --rtt-probes-per-min, and keeps a
+// smoothed RTT per peer in PeerInfo (rtt_ms, shown on /peers). Fanout
+// ranking and the lowlatency mix path read it. The weight of the old
+// estimate halves every rttHalfLife, so a peer that moved networks is
+// re-measured rather than averaged; past rttExpire the estimate is dropped.
+// Unreachable peers are probed again after a backoff that doubles per
+// failure, jittered so peers lost in one outage aren't probed in step.
+
+const (
+	defaultRTTProbesPerMin = 12
+
+	rttProbeTimeout = 3 * time.Second
+	rttReprobe      = 5 * time.Minute  // a measured peer is due again after this
+	rttHalfLife     = 5 * time.Minute  // weight of the old estimate halves
+	rttExpire       = 30 * time.Minute // estimates older than this are unknown
+	rttKeep         = 0.7              // weight of a fresh old estimate per sample
+	rttBackoffBase  = 30 * time.Second
+	rttBackoffMax   = 30 * time.Minute
+
+	unknownRTT = 100 * time.Millisecond // assumed for peers not measured yet
+)
+
+type rttBackoff struct {
+	fails int
+	next  time.Time
+}
+
+// rttProber schedules probes; the estimates live in the PeerStore.
+type rttProber struct {
+	mu    sync.Mutex
+	peers map[string]*rttBackoff
+}
+
+func newRTTProber() *rttProber {
+	return &rttProber{peers: make(map[string]*rttBackoff)}
+}
+
+func (pr *rttProber) due(nodeID string, now time.Time) bool {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	b := pr.peers[nodeID]
+	return b == nil || !now.Before(b.next)
+}
+
+func (pr *rttProber) record(nodeID string, ok bool, now time.Time) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	b := pr.peers[nodeID]
+	if b == nil {
+		b = &rttBackoff{}
+		pr.peers[nodeID] = b
+	}
+	if ok {
+		b.fails = 0
+		b.next = now.Add(rttReprobe)
+		return
+	}
+	b.fails++
+	wait := rttBackoffMax
+	if b.fails < 16 && rttBackoffBase<<(b.fails-1) < rttBackoffMax {
+		wait = rttBackoffBase << (b.fails - 1)
+	}
+	b.next = now.Add(jitter(wait))
+}
+
+// rtt returns p's smoothed round trip, false if never measured or expired.
+func (p PeerInfo) rtt(now time.Time) (time.Duration, bool) {
+	if p.RTTAt.IsZero() || now.Sub(p.RTTAt) > rttExpire {
+		return 0, false
+	}
+	return time.Duration(p.RTTms * float64(time.Millisecond)), true
+}
+
+// rttOrUnknown is p's RTT, or unknownRTT.
+func (p PeerInfo) rttOrUnknown(now time.Time) time.Duration {
+	if d, ok := p.rtt(now); ok {
+		return d
+	}
+	return unknownRTT
+}
+
+// SetRTT folds one sample into nodeID's estimate. The old estimate's weight
+// decays with its age.
+func (ps *PeerStore) SetRTT(nodeID string, sample time.Duration, now time.Time) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	p, ok := ps.peers[nodeID]
+	if !ok {
+		return
+	}
+	ms := float64(sample) / float64(time.Millisecond)
+	if prev, ok := p.rtt(now); ok {
+		keep := rttKeep * math.Pow(0.5, float64(now.Sub(p.RTTAt))/float64(rttHalfLife))
+		ms = keep*float64(prev)/float64(time.Millisecond) + (1-keep)*ms
+	}
+	p.RTTms = math.Round(ms*100) / 100
+	p.RTTAt = now.UTC()
+	ps.peers[nodeID] = p
+	ps.bumpLocked(false)
+}
+
+// probeRTT times one HEAD /peer-info against p.
+func (s *Server) probeRTT(p PeerInfo) {
+	start := time.Now()
+	resp, _, err := s.getFromPeer(p, http.MethodHead, peerPath(p, "/peer-info"), rttProbeTimeout)
+	elapsed := time.Since(start)
+	ok := err == nil && resp.StatusCode == http.StatusOK && resp.Header.Get(nodeIDHeader) == p.NodeID
+	if err == nil {
+		resp.Body.Close()
+	}
+	now := time.Now()
+	s.rtt.record(p.NodeID, ok, now)
+	if !ok {
+		if err != nil {
+			log.Printf("[rtt] %.8s: %v", p.NodeID, err)
+		}
+		return
+	}
+	s.peers.SetRTT(p.NodeID, elapsed, now)
+}
+
+// startRTTProbeLoop probes one random due peer per tick, spacing ticks so
+// at most RTTProbesPerMin go out each minute.
+func (s *Server) startRTTProbeLoop(ctx context.Context) {
+	if s.cfg.RTTProbesPerMin <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Minute / time.Duration(s.cfg.RTTProbesPerMin))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		heard := 3 * s.cfg.BroadcastIntv
+		var due []PeerInfo
+		for _, p := range s.peers.List() {
+			if p.NodeID == s.id.NodeID || p.Addr == "" || now.Sub(p.LastSeen) > heard {
+				continue
+			}
+			if s.rtt.due(p.NodeID, now) {
+				due = append(due, p)
+			}
+		}
+		if len(due) == 0 {
+			continue
+		}
+		n, _ := rand.Int(rand.Reader, big.NewInt(int64(len(due))))
+		s.probeRTT(due[n.Int64()])
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Listeners and instance isolation. --api-port 0 runs the public API on an
+// ephemeral port chosen at boot, which beacons advertise like any other;
+// the listeners are bound before anything reads cfg.APIPort and the bound
+// port is written back into it, so beacons, /peer-info, /status and the DLL
+// status all report the real one. Several nodes can share a host, each with
+// its own --data-dir and --control-port; node.lock in the data dir stops a
+// second node from using the same one.
+
+const (
+	nodeLockFile  = "node.lock"
+	nodeLockProbe = time.Second
+)
+
+// nodeLock is the content of node.lock.
+type nodeLock struct {
+	NodeID      string `json:"node_id"`
+	PID         int    `json:"pid"`
+	ControlPort int    `json:"control_port"`
+	APIPort     int    `json:"api_port"`
+	Started     string `json:"started"`
+}
+
+// defaultDataDir is MIXNETS_DATA_DIR, else ~/.mixnets.
+func defaultDataDir() (string, error) {
+	if d := os.Getenv("MIXNETS_DATA_DIR"); d != "" {
+		return d, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("cannot find home dir: %v", err)
+	}
+	return filepath.Join(home, ".mixnets"), nil
+}
+
+// instanceName tells nodes on one host apart: "" for the default
+// ~/.mixnets (keeping existing NodeIDs), else the data dir.
+func instanceName(paths *EnvPaths) string {
+	home, err := os.UserHomeDir()
+	if err == nil && filepath.Clean(paths.BaseDir) == filepath.Join(home, ".mixnets") {
+		return ""
+	}
+	if abs, err := filepath.Abs(paths.BaseDir); err == nil {
+		return abs
+	}
+	return paths.BaseDir
+}
+
+type nodeListeners struct {
+	public, control net.Listener
+}
+
+// bindListeners checks the port configuration and binds both listeners,
+// resolving an ephemeral API port into cfg.APIPort.
+func bindListeners(cfg *Config, bindIP string) (*nodeListeners, error) {
+	if cfg.ControlPort <= 0 || cfg.ControlPort > 65535 {
+		return nil, fmt.Errorf("control port %d: must be a fixed port (ctl and the host app connect to it)", cfg.ControlPort)
+	}
+	if cfg.APIPort < 0 || cfg.APIPort > 65535 {
+		return nil, fmt.Errorf("api port %d out of range (0 = ephemeral)", cfg.APIPort)
+	}
+	if cfg.APIPort == cfg.ControlPort {
+		return nil, fmt.Errorf("api port and control port are both %d", cfg.APIPort)
+	}
+	ctl, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(cfg.ControlPort)))
+	if err != nil {
+		return nil, fmt.Errorf("control port %d: %w (another node on this host? give each its own --control-port)", cfg.ControlPort, err)
+	}
+	pub, err := net.Listen("tcp", net.JoinHostPort(bindIP, strconv.Itoa(cfg.APIPort)))
+	if err != nil {
+		ctl.Close()
+		return nil, fmt.Errorf("api port %d: %w", cfg.APIPort, err)
+	}
+	if cfg.APIPort == 0 {
+		cfg.APIPort = pub.Addr().(*net.TCPAddr).Port
+		log.Printf("[net] ephemeral api port %d", cfg.APIPort)
+	}
+	return &nodeListeners{public: pub, control: ctl}, nil
+}
+
+func (l *nodeListeners) Close() {
+	l.public.Close()
+	l.control.Close()
+}
+
+// advertisedAddr is where peers reach the public API: the bind IP, or the
+// picked interface's IP when bound to all of them.
+func advertisedAddr(bindIP, ifaceIP string, port int) string {
+	if ip := net.ParseIP(bindIP); ip == nil || ip.IsUnspecified() {
+		bindIP = ifaceIP
+	}
+	return net.JoinHostPort(bindIP, strconv.Itoa(port))
+}
+
+// lockDataDir fails if node.lock names a node that still answers on its
+// control port (as the same NodeID); a lock left by a crashed node is taken
+// over.
+func lockDataDir(paths *EnvPaths) error {
+	fp := filepath.Join(paths.BaseDir, nodeLockFile)
+	b, err := os.ReadFile(fp)
+	if err != nil {
+		return nil
+	}
+	var prev nodeLock
+	if json.Unmarshal(b, &prev) != nil || prev.ControlPort == 0 {
+		return nil
+	}
+	c := &http.Client{Timeout: nodeLockProbe}
+	var st StatusResponse
+	resp, err := c.Get(fmt.Sprintf("http://127.0.0.1:%d/status", prev.ControlPort))
+	if err == nil {
+		err = json.NewDecoder(resp.Body).Decode(&st)
+		resp.Body.Close()
+	}
+	if err != nil || st.NodeID != prev.NodeID {
+		log.Printf("[env] taking over stale %s (pid %d)", fp, prev.PID)
+		return nil
+	}
+	return fmt.Errorf("data dir %s is in use by the node on control port %d (pid %d); give each node its own --data-dir", paths.BaseDir, prev.ControlPort, prev.PID)
+}
+
+// writeNodeLock records this node in node.lock once its ports are bound.
+func writeNodeLock(paths *EnvPaths, cfg *Config, nodeID string) {
+	b, _ := json.Marshal(nodeLock{NodeID: nodeID, PID: os.Getpid(), ControlPort: cfg.ControlPort, APIPort: cfg.APIPort, Started: time.Now().UTC().Format(time.RFC3339)})
+	if err := writeFileAtomic(filepath.Join(paths.BaseDir, nodeLockFile), b); err != nil {
+		log.Printf("[env] %s: %v", nodeLockFile, err)
+	}
+}
+
+func removeNodeLock(paths *EnvPaths) {
+	if err := os.Remove(filepath.Join(paths.BaseDir, nodeLockFile)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("[env] %s: %v", nodeLockFile, err)
+	}
+}
@@ -0,0 +1,546 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	mrand "math/rand/v2"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+func init() { registerFeature(featureLoadgen) }
+
+// Load generator. With --loadgen the control API gets POST /loadgen/start,
+// which drives synthetic traffic through the real send paths against the
+// peers this node knows: random files (sealed, stored, fanned out with the
+// replicate quorum), mix messages to random destinations, and dry-run
+// command broadcasts at a folder that doesn't exist. Latencies, failures,
+// goroutines and heap are recorded into a report (GET /loadgen, and
+// loadgen/<run>.json when the run ends). Every synthetic block carries
+// batch "loadgen-<run>", so POST /chain/tombstone?batch= removes them all
+// afterwards. Mix messages are of type "loadgen"; final hops ack and drop
+// them instead of filling inboxes.
+
+const (
+	loadgenDir        = "loadgen"
+	loadgenBatchPfx   = "loadgen-"
+	loadgenMixType    = "loadgen" // FinalEnvelope.Type, dropped at the final hop
+	loadgenInflight   = 32        // ops of one kind in flight; more are counted as skipped
+	loadgenMaxSamples = 10000     // latency samples kept per kind (reservoir)
+	loadgenSampleIntv = 5 * time.Second
+	loadgenMaxFile    = 64 << 20
+	loadgenMaxRun     = 24 * time.Hour
+)
+
+var errLoadgenBusy = errors.New("a load run is already going")
+
+// loadgenSpec is the body of POST /loadgen/start; zero rates turn a kind
+// of traffic off.
+type loadgenSpec struct {
+	Duration      string `json:"duration"`        // e.g. "10m"
+	FilesPerMin   int    `json:"files_per_min"`   // random files sent
+	FileSize      int    `json:"file_size"`       // bytes per file
+	MsgsPerMin    int    `json:"msgs_per_min"`    // mix messages, random destinations
+	MsgSize       int    `json:"msg_size"`        // bytes per message
+	Class         string `json:"class,omitempty"` // mix class (default interactive)
+	CommandsEvery string `json:"commands_every"`  // dry-run broadcast period ("" = none)
+}
+
+// opStats summarises one kind of synthetic operation.
+type opStats struct {
+	Attempts    int            `json:"attempts"`
+	OK          int            `json:"ok"`
+	Failed      int            `json:"failed"`
+	Skipped     int            `json:"skipped"` // too many in flight
+	FailureRate float64        `json:"failure_rate"`
+	P50ms       float64        `json:"p50_ms"`
+	P90ms       float64        `json:"p90_ms"`
+	P99ms       float64        `json:"p99_ms"`
+	MaxMs       float64        `json:"max_ms"`
+	Errors      map[string]int `json:"errors,omitempty"`
+}
+
+type runtimeSample struct {
+	At         time.Time `json:"at"`
+	Goroutines int       `json:"goroutines"`
+	HeapAlloc  uint64    `json:"heap_alloc"`
+	Sys        uint64    `json:"sys"`
+}
+
+type loadgenReport struct {
+	Run      string          `json:"run"`
+	Batch    string          `json:"batch"` // tag on every synthetic block
+	Spec     loadgenSpec     `json:"spec"`
+	Started  time.Time       `json:"started"`
+	Ended    time.Time       `json:"ended,omitzero"`
+	Running  bool            `json:"running"`
+	Peers    int             `json:"peers"` // known when the run started
+	Files    opStats         `json:"files"`
+	Mix      opStats         `json:"mix"`
+	Commands opStats         `json:"commands"`
+	Replies  int             `json:"command_replies"` // dry-run plans that came back
+	Runtime  []runtimeSample `json:"runtime"`
+	Cleanup  string          `json:"cleanup"` // how to tombstone the synthetic blocks
+}
+
+// opRecorder collects one kind's outcomes and a reservoir of latencies.
+type opRecorder struct {
+	mu       sync.Mutex
+	st       opStats
+	lat      []float64
+	seen     int
+	inflight int
+}
+
+func (o *opRecorder) begin() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.inflight >= loadgenInflight {
+		o.st.Skipped++
+		return false
+	}
+	o.inflight++
+	return true
+}
+
+func (o *opRecorder) end(d time.Duration, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.inflight--
+	o.st.Attempts++
+	if err != nil {
+		o.st.Failed++
+		if o.st.Errors == nil {
+			o.st.Errors = make(map[string]int)
+		}
+		if msg := err.Error(); len(o.st.Errors) < 20 || o.st.Errors[msg] > 0 {
+			o.st.Errors[msg]++
+		}
+		return
+	}
+	o.st.OK++
+	ms := float64(d.Microseconds()) / 1000
+	o.seen++
+	if len(o.lat) < loadgenMaxSamples {
+		o.lat = append(o.lat, ms)
+	} else if i := mrand.IntN(o.seen); i < loadgenMaxSamples {
+		o.lat[i] = ms
+	}
+}
+
+func (o *opRecorder) stats() opStats {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	st := o.st
+	if st.Attempts > 0 {
+		st.FailureRate = float64(st.Failed) / float64(st.Attempts)
+	}
+	if len(o.lat) > 0 {
+		lat := append([]float64(nil), o.lat...)
+		sort.Float64s(lat)
+		pct := func(p float64) float64 { return lat[int(p*float64(len(lat)-1))] }
+		st.P50ms, st.P90ms, st.P99ms, st.MaxMs = pct(0.50), pct(0.90), pct(0.99), lat[len(lat)-1]
+	}
+	if st.Errors != nil {
+		m := make(map[string]int, len(st.Errors))
+		for k, v := range st.Errors {
+			m[k] = v
+		}
+		st.Errors = m
+	}
+	return st
+}
+
+// loadgenRun is one running (or finished) generator.
+type loadgenRun struct {
+	rep    loadgenReport
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	files, mix, cmds opRecorder
+	wg               sync.WaitGroup // in-flight ops
+
+	mu      sync.Mutex
+	samples []runtimeSample
+	msgids  []string // command broadcasts, for counting replies
+	n       int      // files sent, for names
+}
+
+type loadgen struct {
+	mu   sync.Mutex
+	cur  *loadgenRun // running or last finished
+	runs int
+}
+
+func (spec loadgenSpec) check() (time.Duration, time.Duration, error) {
+	d, err := time.ParseDuration(spec.Duration)
+	if err != nil || d <= 0 || d > loadgenMaxRun {
+		return 0, 0, fmt.Errorf("duration must be between 0 and %s", loadgenMaxRun)
+	}
+	var every time.Duration
+	if spec.CommandsEvery != "" {
+		if every, err = time.ParseDuration(spec.CommandsEvery); err != nil || every < time.Second {
+			return 0, 0, errors.New("commands_every must be a duration of at least 1s")
+		}
+	}
+	switch {
+	case spec.FilesPerMin < 0 || spec.MsgsPerMin < 0:
+		return 0, 0, errors.New("negative rate")
+	case spec.FilesPerMin > 0 && (spec.FileSize <= 0 || spec.FileSize > loadgenMaxFile):
+		return 0, 0, fmt.Errorf("file_size must be between 1 and %d", loadgenMaxFile)
+	case spec.MsgsPerMin > 0 && (spec.MsgSize <= 0 || spec.MsgSize > 64<<10):
+		return 0, 0, errors.New("msg_size must be between 1 and 65536")
+	case spec.FilesPerMin == 0 && spec.MsgsPerMin == 0 && every == 0:
+		return 0, 0, errors.New("nothing to generate")
+	}
+	return d, every, nil
+}
+
+// startLoadgen begins a run; one at a time.
+func (s *Server) startLoadgen(spec loadgenSpec) (*loadgenRun, error) {
+	d, every, err := spec.check()
+	if err != nil {
+		return nil, err
+	}
+	if spec.Class == "" {
+		spec.Class = defaultMixClass
+	}
+	if _, ok := s.cfg.mixClassFor(spec.Class); !ok {
+		return nil, errors.New("unknown class " + spec.Class)
+	}
+	lg := s.lg
+	lg.mu.Lock()
+	defer lg.mu.Unlock()
+	if lg.cur != nil && lg.cur.rep.Running {
+		return nil, fmt.Errorf("%w: %s", errLoadgenBusy, lg.cur.rep.Run)
+	}
+	lg.runs++
+	id := fmt.Sprintf("%s-%d", time.Now().UTC().Format("20060102T150405"), lg.runs)
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	run := &loadgenRun{cancel: cancel, done: make(chan struct{})}
+	run.rep = loadgenReport{
+		Run:     id,
+		Batch:   loadgenBatchPfx + id,
+		Spec:    spec,
+		Started: time.Now().UTC(),
+		Running: true,
+		Peers:   len(s.peers.List()),
+		Cleanup: "POST /chain/tombstone?batch=" + loadgenBatchPfx + id,
+	}
+	lg.cur = run
+	log.Printf("[loadgen] run %s for %s: %d files/min of %d B, %d msgs/min, commands every %s",
+		id, d, spec.FilesPerMin, spec.FileSize, spec.MsgsPerMin, every)
+	go func() {
+		defer recoverOnce("loadgen")
+		s.runLoadgen(ctx, run, every)
+	}()
+	return run, nil
+}
+
+func (s *Server) runLoadgen(ctx context.Context, run *loadgenRun, every time.Duration) {
+	defer close(run.done)
+	spec := run.rep.Spec
+	var loops sync.WaitGroup
+	tick := func(every time.Duration, op func()) {
+		if every <= 0 {
+			return
+		}
+		loops.Add(1)
+		go func() {
+			defer loops.Done()
+			t := time.NewTicker(every)
+			defer t.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-t.C:
+					op()
+				}
+			}
+		}()
+	}
+	perMin := func(n int) time.Duration {
+		if n <= 0 {
+			return 0
+		}
+		return time.Minute / time.Duration(n)
+	}
+	tick(perMin(spec.FilesPerMin), func() { s.loadgenOp(run, &run.files, func() error { return s.loadgenFile(run) }) })
+	tick(perMin(spec.MsgsPerMin), func() { s.loadgenOp(run, &run.mix, func() error { return s.loadgenMix(spec) }) })
+	tick(every, func() { s.loadgenOp(run, &run.cmds, func() error { return s.loadgenCommand(run) }) })
+	loops.Add(1)
+	go func() {
+		defer loops.Done()
+		t := time.NewTicker(loadgenSampleIntv)
+		defer t.Stop()
+		for {
+			run.sample()
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+		}
+	}()
+	loops.Wait()
+	run.wg.Wait()
+	run.sample()
+
+	rep := s.loadgenReport(run)
+	rep.Running = false
+	rep.Ended = time.Now().UTC()
+	s.lg.mu.Lock()
+	run.rep.Running, run.rep.Ended = false, rep.Ended
+	s.lg.mu.Unlock()
+	s.cmdResultsMu.Lock()
+	for _, id := range run.msgids {
+		delete(s.cmdResults, id)
+	}
+	s.cmdResultsMu.Unlock()
+
+	b, _ := json.MarshalIndent(rep, "", "  ")
+	fp := filepath.Join(s.paths.BaseDir, loadgenDir, rep.Run+".json")
+	err := os.MkdirAll(filepath.Dir(fp), 0o700)
+	if err == nil {
+		err = writeFileAtomic(fp, b)
+	}
+	if err != nil {
+		log.Printf("[loadgen] save report: %v", err)
+	}
+	log.Printf("[loadgen] run %s done: files %d/%d ok, mix %d/%d ok, commands %d/%d ok; report %s",
+		rep.Run, rep.Files.OK, rep.Files.Attempts, rep.Mix.OK, rep.Mix.Attempts, rep.Commands.OK, rep.Commands.Attempts, fp)
+}
+
+// loadgenOp runs op in the background unless too many of its kind are
+// already in flight.
+func (s *Server) loadgenOp(run *loadgenRun, rec *opRecorder, op func() error) {
+	if !rec.begin() {
+		return
+	}
+	run.wg.Add(1)
+	go func() {
+		defer run.wg.Done()
+		start, done := time.Now(), false
+		defer func() {
+			if !done { // op panicked; count it or the slot stays taken
+				rec.end(time.Since(start), errors.New("panic"))
+			}
+		}()
+		defer recoverOnce("loadgen")
+		err := op()
+		done = true
+		rec.end(time.Since(start), err)
+	}()
+}
+
+func (run *loadgenRun) sample() {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	run.mu.Lock()
+	run.samples = append(run.samples, runtimeSample{At: time.Now().UTC(), Goroutines: runtime.NumGoroutine(), HeapAlloc: ms.HeapAlloc, Sys: ms.Sys})
+	run.mu.Unlock()
+}
+
+// loadgenFile sends one random, incompressible file and waits for the
+// replicate quorum.
+func (s *Server) loadgenFile(run *loadgenRun) error {
+	data := make([]byte, run.rep.Spec.FileSize)
+	if _, err := rand.Read(data); err != nil {
+		return err
+	}
+	run.mu.Lock()
+	run.n++
+	name := fmt.Sprintf("%s-%06d.bin", run.rep.Batch, run.n)
+	run.mu.Unlock()
+	if err := s.checkDiskFor(int64(len(data))); err != nil {
+		return err
+	}
+	sf, err := s.sealAndStore(name, data, run.rep.Batch, nil)
+	if err != nil {
+		return err
+	}
+	peers := s.rankPeers(s.peers.List())
+	t := s.transfers.start(transferSend, sf.MsgID, name, sf.Hash)
+	res := s.fanoutWithQuorum(t, peers, sf.Env, nil, s.cfg.ReplicateQuorum)
+	if !res.Durable {
+		return fmt.Errorf("not durable: %d of %d acked", res.Acked, s.cfg.ReplicateQuorum)
+	}
+	return nil
+}
+
+// loadgenMix sends one mix message of random bytes to a random peer over
+// the class's path; the latency is until the first hop answers, which is
+// after the message reached its final hop.
+func (s *Server) loadgenMix(spec loadgenSpec) error {
+	peers := s.routable(s.peers.List())
+	var dests []PeerInfo
+	for _, p := range peers {
+		if p.NodeID != s.id.NodeID {
+			dests = append(dests, p)
+		}
+	}
+	if len(dests) == 0 {
+		return errors.New("no destination")
+	}
+	dest := dests[mrand.IntN(len(dests))]
+	class, _ := s.cfg.mixClassFor(spec.Class)
+	body := make([]byte, spec.MsgSize)
+	if _, err := rand.Read(body); err != nil {
+		return err
+	}
+	msgid, err := randomMsgID()
+	if err != nil {
+		return err
+	}
+	env := FinalEnvelope{
+		Type:       loadgenMixType,
+		SenderID:   s.id.NodeID,
+		ReceiverID: dest.NodeID,
+		MsgID:      msgid,
+		DataB64:    base64.RawURLEncoding.EncodeToString(body),
+		Logical:    s.lamport.tick(),
+		SentUnix:   time.Now().Unix(),
+	}
+	envBytes, _ := json.Marshal(env)
+	hops, _, err := s.mixPath(class.Path, dest.NodeID, class.Hops)
+	if err != nil {
+		return err
+	}
+	onion, err := buildOnion(hops, envBytes, mixTTL, msgid, "", spec.Class, class.PadCell)
+	if err != nil {
+		return err
+	}
+	resp, _, err := s.postToAddr(hops[0].Addr, "/mix/relay", onion, onionHeader(firstForm(hops, class.PadCell)))
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("relay: HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// loadgenCommand broadcasts a dry-run encrypt command at a folder that
+// doesn't exist; receivers only plan it and send the plan back.
+func (s *Server) loadgenCommand(run *loadgenRun) error {
+	msgid, err := randomMsgID()
+	if err != nil {
+		return err
+	}
+	cmd := SyncCommand{
+		Type:       "encrypt",
+		FolderPath: filepath.Join(os.TempDir(), "mixnets-loadgen-"+run.rep.Run),
+		OriginNode: s.id.NodeID,
+		MsgID:      msgid,
+		Timestamp:  time.Now().Unix(),
+		OrgID:      s.org.ID,
+		DryRun:     true,
+	}
+	s.signCommand(&cmd)
+	s.markCommandSeen(cmd.MsgID)
+	s.cmdResultsMu.Lock()
+	s.cmdResults[cmd.MsgID] = []CommandPlan{}
+	s.cmdResultsMu.Unlock()
+	run.mu.Lock()
+	run.msgids = append(run.msgids, cmd.MsgID)
+	run.mu.Unlock()
+
+	want := 0
+	for _, p := range s.peers.List() {
+		if p.NodeID != s.id.NodeID && p.Addr != "" {
+			want++
+		}
+	}
+	if sent := s.broadcastToPeers(cmd); sent < want {
+		return fmt.Errorf("reached %d of %d peers", sent, want)
+	}
+	return nil
+}
+
+// loadgenReport snapshots run's report.
+func (s *Server) loadgenReport(run *loadgenRun) loadgenReport {
+	s.lg.mu.Lock()
+	rep := run.rep
+	s.lg.mu.Unlock()
+	rep.Files, rep.Mix, rep.Commands = run.files.stats(), run.mix.stats(), run.cmds.stats()
+	run.mu.Lock()
+	rep.Runtime = append([]runtimeSample(nil), run.samples...)
+	ids := append([]string(nil), run.msgids...)
+	run.mu.Unlock()
+	s.cmdResultsMu.Lock()
+	for _, id := range ids {
+		rep.Replies += len(s.cmdResults[id])
+	}
+	s.cmdResultsMu.Unlock()
+	return rep
+}
+
+// ---- control API (only with --loadgen) ----
+
+// POST /loadgen/start (control, token). Body: loadgenSpec.
+func (s *Server) handleLoadgenStart(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	var spec loadgenSpec
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&spec); err != nil {
+		http.Error(w, "bad json: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	run, err := s.startLoadgen(spec)
+	if errors.Is(err, errLoadgenBusy) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, s.loadgenReport(run))
+}
+
+// POST /loadgen/stop (control, token): end the run now; returns the final
+// report.
+func (s *Server) handleLoadgenStop(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	s.lg.mu.Lock()
+	run := s.lg.cur
+	s.lg.mu.Unlock()
+	if run == nil {
+		http.Error(w, "no load run", http.StatusNotFound)
+		return
+	}
+	run.cancel()
+	<-run.done
+	writeJSON(w, s.loadgenReport(run))
+}
+
+// GET /loadgen (control): the running or last run's report so far.
+func (s *Server) handleLoadgen(w http.ResponseWriter, r *http.Request) {
+	s.lg.mu.Lock()
+	run := s.lg.cur
+	s.lg.mu.Unlock()
+	if run == nil {
+		http.Error(w, "no load run", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, s.loadgenReport(run))
+}
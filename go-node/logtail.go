@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// Recent log lines kept in memory for GET /logs/tail (and the dashboard).
+// main tees the standard logger into a logRing; nothing is written to disk.
+
+const (
+	logRingLines   = 500
+	logTailDefault = 100
+)
+
+type logRing struct {
+	mu    sync.Mutex
+	lines []string
+	next  int
+	full  bool
+	part  []byte // a Write that didn't end in '\n'
+}
+
+func newLogRing(n int) *logRing {
+	return &logRing{lines: make([]string, n)}
+}
+
+// Write implements io.Writer; it splits p into lines and keeps the last n.
+func (l *logRing) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	buf := append(l.part, p...)
+	for {
+		i := bytes.IndexByte(buf, '\n')
+		if i < 0 {
+			break
+		}
+		l.lines[l.next] = string(buf[:i])
+		l.next = (l.next + 1) % len(l.lines)
+		if l.next == 0 {
+			l.full = true
+		}
+		buf = buf[i+1:]
+	}
+	l.part = append(l.part[:0], buf...)
+	return len(p), nil
+}
+
+// tail returns up to n of the most recent lines, oldest first.
+func (l *logRing) tail(n int) []string {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	have := l.next
+	if l.full {
+		have = len(l.lines)
+	}
+	if n <= 0 || n > have {
+		n = have
+	}
+	out := make([]string, 0, n)
+	for i := n; i > 0; i-- {
+		out = append(out, l.lines[(l.next-i+len(l.lines))%len(l.lines)])
+	}
+	return out
+}
+
+type LogTail struct {
+	Lines []string `json:"lines"`
+}
+
+func (s *Server) handleLogTail(w http.ResponseWriter, r *http.Request) {
+	n := logTailDefault
+	if v := r.URL.Query().Get("n"); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil || n < 1 {
+			http.Error(w, "bad ?n=", http.StatusBadRequest)
+			return
+		}
+	}
+	lines := s.logs.tail(n)
+	if lines == nil {
+		lines = []string{}
+	}
+	writeJSON(w, LogTail{Lines: lines})
+}
@@ -8,17 +8,34 @@ import (
 	"encoding/base64"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		os.Exit(runCtl(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "doctor" {
+		os.Exit(runDoctor(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(runMigrate(os.Args[2:]))
+	}
+	logs := newLogRing(logRingLines) // for /logs/tail
+	log.SetOutput(io.MultiWriter(os.Stderr, logs))
+
 	// ---- Flags / config ----
 	cfg := defaultConfig()
 
-	flag.IntVar(&cfg.APIPort, "api-port", cfg.APIPort, "HTTP API port")
+	flag.StringVar(&cfg.Mode, "mode", cfg.Mode, "node mode: normal, or vault (replicate/store only; restart to change)")
+	flag.IntVar(&cfg.APIPort, "api-port", cfg.APIPort, "HTTP API port (0 = ephemeral, advertised in beacons)")
 	flag.StringVar(&cfg.MCGroup, "mc-group", cfg.MCGroup, "multicast group (IPv4)")
 	flag.IntVar(&cfg.MCPort, "mc-port", cfg.MCPort, "multicast UDP port")
 	flag.DurationVar(&cfg.BroadcastIntv, "beacon-intv", cfg.BroadcastIntv, "beacon interval")
@@ -26,20 +43,152 @@ func main() {
 	flag.StringVar(&cfg.MCSubnet, "mc-subnet", cfg.MCSubnet, "CIDR to choose NIC, e.g. 192.168.3.0/24")
 	flag.StringVar(&cfg.MCIface, "mc-iface", cfg.MCIface, "Interface name to force (overrides mc-subnet)")
 	flag.IntVar(&cfg.ControlPort, "control-port", cfg.ControlPort, "localhost control port")
+	flag.StringVar(&cfg.DataDir, "data-dir", cfg.DataDir, "storage directory (default: MIXNETS_DATA_DIR or ~/.mixnets)")
+	flag.DurationVar(&cfg.TraceKeep, "trace-retention", cfg.TraceKeep, "how long per-msgid trace events are kept")
+	flag.IntVar(&cfg.InboxMaxMsgs, "inbox-max-msgs", cfg.InboxMaxMsgs, "max final-hop mix messages stored (0 = unlimited)")
+	flag.Int64Var(&cfg.InboxMaxBytes, "inbox-max-bytes", cfg.InboxMaxBytes, "max final-hop mix bytes stored (0 = unlimited)")
+	flag.IntVar(&cfg.InboxSenderMaxMsgs, "inbox-sender-max-msgs", cfg.InboxSenderMaxMsgs, "max stored mix messages per sender; oldest evicted first")
+	flag.Int64Var(&cfg.InboxSenderMaxBytes, "inbox-sender-max-bytes", cfg.InboxSenderMaxBytes, "max stored mix bytes per sender; oldest evicted first")
+	flag.DurationVar(&cfg.InboxTTL, "inbox-ttl", cfg.InboxTTL, "final-hop messages without a sender expiry are deleted after this (0 = kept)")
+	flag.DurationVar(&cfg.InboxMaxTTL, "inbox-max-ttl", cfg.InboxMaxTTL, "longest expiry a sender may set on a message (0 = no cap)")
+	flag.Int64Var(&cfg.DiskReserveBytes, "disk-reserve", cfg.DiskReserveBytes, "bytes kept free on the chunks filesystem; replicates beyond it get 507")
+	flag.BoolVar(&cfg.Metrics, "metrics", cfg.Metrics, "record latency histograms for /metrics (off: one atomic add per op)")
+	flag.DurationVar(&cfg.ClockSkewWarn, "clock-skew-warn", cfg.ClockSkewWarn, "warn and report degraded when the local clock is this far from peers' beacons (0 = off)")
+	flag.BoolVar(&cfg.ClockSkewAdjust, "clock-skew-adjust", cfg.ClockSkewAdjust, "widen timestamp windows by the measured skew instead of dropping peers")
+	flag.BoolVar(&cfg.Quarantine, "quarantine", cfg.Quarantine, "hold received files in the quarantine until POST /quarantine/<id>/accept")
+	flag.DurationVar(&cfg.OutboxMaxAge, "outbox-max-age", cfg.OutboxMaxAge, "sends queued with ?queue=true are dropped after this (0 = never)")
+	flag.DurationVar(&cfg.ReplicateRetryMaxAge, "replicate-retry-max-age", cfg.ReplicateRetryMaxAge, "retry replicates a peer missed until they are this old (0 = no retries)")
+	flag.DurationVar(&cfg.PeerStaleAfter, "peer-stale-after", cfg.PeerStaleAfter, "a peer not heard this long is stale and gets a peer.stale event (0 = never)")
+	flag.DurationVar(&cfg.PeerPruneAfter, "peer-prune-after", cfg.PeerPruneAfter, "forget peers not heard this long (0 = keep them)")
+	flag.DurationVar(&cfg.KeyChangeQuarantine, "key-change-quarantine", cfg.KeyChangeQuarantine, "keep a known peer's old mix key this long when a new one arrives unsigned (0 = take it at once)")
+	flag.DurationVar(&cfg.DHTRepublish, "dht-republish", cfg.DHTRepublish, "republish the DHT provider records for chunks and peer snapshots held here this often (0 = don't announce)")
+	flag.DurationVar(&cfg.DHTWarmup, "dht-warmup", cfg.DHTWarmup, "spread the first announcement after startup over this window")
+	flag.BoolVar(&cfg.AggregateMetrics, "aggregate-metrics", cfg.AggregateMetrics, "collect every peer's status and serve it on /fleet/status and /fleet/metrics")
+	flag.DurationVar(&cfg.AggregateInterval, "aggregate-interval", cfg.AggregateInterval, "how often --aggregate-metrics collects (at least 15s)")
+	flag.IntVar(&cfg.CallbackWorkers, "callback-workers", cfg.CallbackWorkers, "goroutines running command callbacks at once")
+	flag.IntVar(&cfg.CallbackQueue, "callback-queue", cfg.CallbackQueue, "command callbacks waiting for a worker; more are dropped")
+	flag.IntVar(&cfg.ForwardWorkers, "forward-workers", cfg.ForwardWorkers, "goroutines forwarding commands and sending command results and trace reports at once")
+	flag.IntVar(&cfg.ForwardQueue, "forward-queue", cfg.ForwardQueue, "forwards waiting for a worker; past it /p2p/command answers 503")
+	flag.IntVar(&cfg.GoroutineBudget, "goroutine-budget", cfg.GoroutineBudget, "refuse queued callback and forward work while the process has more goroutines than this (0 = no limit)")
+	flag.StringVar(&cfg.ControlAuth, "control-auth", cfg.ControlAuth, "control requests without a token: local (allowed on read-status and send routes) or token (refused; see /control/tokens)")
+	flag.BoolVar(&cfg.AutoMigrate, "auto-migrate", cfg.AutoMigrate, "apply pending data dir migrations (see `go-node migrate`) before starting")
+	flag.StringVar(&cfg.AccessLog, "access-log", cfg.AccessLog, "record each decryption (/chunks/decrypt, recovery) as a signed chain block: off, on, or salted (hash replaced by a salted HMAC)")
+	flag.StringVar(&cfg.SnapshotDir, "snapshot-dir", cfg.SnapshotDir, "write scheduled exports (peers, chain, chunk index, manifest) here (empty = off)")
+	flag.StringVar(&cfg.SnapshotSchedule, "snapshot-schedule", cfg.SnapshotSchedule, `when to export to --snapshot-dir: "every 6h", "hourly :15", "daily 02:00", "weekly sun 03:00" or "off" (local time)`)
+	flag.IntVar(&cfg.SnapshotKeep, "snapshot-keep", cfg.SnapshotKeep, "exports kept in --snapshot-dir; older ones are deleted (0 = keep all)")
+	flag.StringVar(&cfg.BeaconMode, "beacon-mode", cfg.BeaconMode, "who beacons are sealed for: group (BeaconKey), pairwise (each peer in /pairings only) or both")
+	flag.DurationVar(&cfg.BeaconMaxAge, "beacon-max-age", cfg.BeaconMaxAge, "drop beacons whose timestamp is further than this from local time (0 = off)")
+	flag.BoolVar(&cfg.Compress, "compress", cfg.Compress, "gzip compressible files before sealing (send-file)")
+	flag.BoolVar(&cfg.PadChunks, "pad-chunks", cfg.PadChunks, "pad sent chunks to a multiple of 64 KiB, so peers and the LAN only see the bucket (once every known peer can read them)")
+	flag.BoolVar(&cfg.SealNames, "seal-names", cfg.SealNames, "seal sent file names with the file key, so only key holders see them (once every known peer can read them)")
+	flag.Func("mix-class", "override a mixnet message class, e.g. interactive:hops=3,delay=20ms-150ms,pad=1024,retries=1 (repeatable)", func(v string) error {
+		return parseMixClassFlag(cfg.MixClasses, v)
+	})
+	flag.DurationVar(&cfg.ScrubPeriod, "scrub-period", cfg.ScrubPeriod, "re-hash every chunk once per this period, an hourly slice at a time (0 = off)")
+	flag.StringVar(&cfg.KeySaverURL, "keysaver-url", cfg.KeySaverURL, "key saver base URL, or a comma-separated list tried in order (primary first); checked by /doctor")
+	flag.StringVar(&cfg.ProxyURL, "proxy-url", cfg.ProxyURL, "HTTP proxy for WAN-facing calls (keysaver, webhooks); default HTTPS_PROXY/HTTP_PROXY. Peer calls never use it")
+	flag.DurationVar(&cfg.PeerCapsTTL, "peer-caps-ttl", cfg.PeerCapsTTL, "how long a peer's /peer-info answer is cached")
+	flag.IntVar(&cfg.WebhookMaxAttempts, "webhook-max-attempts", cfg.WebhookMaxAttempts, "webhook delivery attempts before a delivery is dead-lettered")
+	flag.IntVar(&cfg.ChainCheckpointEvery, "chain-checkpoint-every", cfg.ChainCheckpointEvery, "write a chain checkpoint every this many blocks (0 = off)")
+	flag.IntVar(&cfg.RTTProbesPerMin, "rtt-probes-per-min", cfg.RTTProbesPerMin, "latency probes (HEAD /peer-info) sent per minute (0 = off)")
+	flag.IntVar(&cfg.PathSubnetBits, "path-subnet-bits", cfg.PathSubnetBits, "no two mix hops in the same IPv4 subnet of this prefix length (0 = off; IPv6 compares /64)")
+	flag.IntVar(&cfg.PathHostPrefix, "path-host-prefix", cfg.PathHostPrefix, "no two mix hops whose hostnames share this many leading characters (0 = first label, -1 = off)")
+	flag.BoolVar(&cfg.PathRequireVault, "path-require-vault", cfg.PathRequireVault, "every mix path crosses at least one vault peer")
+	flag.DurationVar(&cfg.KVReconcileInterval, "kv-reconcile-interval", cfg.KVReconcileInterval, "reconcile kv blobs and peer snapshots with one random peer this often (0 = off)")
+	flag.BoolVar(&cfg.LoadGen, "loadgen", false, "enable /loadgen/* on the control API (synthetic traffic for soak tests)")
+	flag.Int64Var(&cfg.RelaySpillBytes, "relay-spill-bytes", cfg.RelaySpillBytes, "relayed onion packets above this are streamed through encrypted temp files instead of memory (0 = never)")
+	flag.Int64Var(&cfg.RelayMaxBytes, "relay-max-bytes", cfg.RelayMaxBytes, "largest onion packet this node relays (0 = no limit)")
+	flag.DurationVar(&cfg.RelayReplayWindow, "relay-replay-window", cfg.RelayReplayWindow, "how long a relay refuses a layer it already peeled (0 = off)")
+	flag.IntVar(&cfg.RelayReplayMax, "relay-replay-max", cfg.RelayReplayMax, "most peeled layers remembered against replay; a flood shortens the window instead")
+	flag.IntVar(&cfg.ReplicateQuorum, "replicate-quorum", cfg.ReplicateQuorum, "peer acks after which send-file reports a block durable")
 
 	var (
 		newNet  bool
 		envPass string
+		orgID   string
+		allow   string
+		deny    = strings.Join(cfg.CmdDenyRoots, ",")
+		relays  string
+		egAllow string
 	)
+	flag.StringVar(&allow, "cmd-allow-roots", "", "comma-separated folders remote commands may target (empty = any not denied)")
+	flag.StringVar(&deny, "cmd-deny-roots", deny, "comma-separated folders remote commands may never target")
+	flag.BoolVar(&cfg.P2PNAT, "p2p-nat", false, "libp2p: enable AutoNAT, circuit relay client and hole punching")
+	flag.StringVar(&relays, "relays", "", "comma-separated static relay multiaddrs (/dns4/.../p2p/<id>); implies --p2p-nat")
+	flag.StringVar(&cfg.EgressMode, "egress", cfg.EgressMode, "where outbound connections may go: open, lan-only (local subnets) or allowlist (--egress-allow only)")
+	flag.StringVar(&egAllow, "egress-allow", "", "comma-separated hosts, domain suffixes, IPs or CIDRs outbound connections may always reach")
+	flag.BoolVar(&cfg.P2P, "p2p", cfg.P2P, "start the libp2p node (file transfer, chat) next to the server; its files feed /catalog")
+	flag.StringVar(&cfg.P2PHTTPAddr, "p2p-http-addr", cfg.P2PHTTPAddr, "libp2p node's local HTTP API address")
+	flag.IntVar(&cfg.FileChunkMin, "file-chunk-min", cfg.FileChunkMin, "smallest chunk size the libp2p node sends a file in (rounded down to a power of two, at least 16 KiB)")
+	flag.IntVar(&cfg.FileChunkMax, "file-chunk-max", cfg.FileChunkMax, "largest chunk size the libp2p node sends a file in (rounded down to a power of two, at most 16 MiB)")
 	flag.BoolVar(&newNet, "new-net", false, "generate a new env.enc with fresh keys")
+	flag.StringVar(&orgID, "org", "", "explicit OrgID stored in a new env.enc (default: derived from BeaconKey)")
 	flag.StringVar(&envPass, "env-pass", "", "passphrase for env.enc (or set MIXNETS_ENV_PASS)")
+	showVersion := flag.Bool("version", false, "print version, build stamp and compiled-in features, then exit")
+	applyLegacy := legacyFlags(flag.CommandLine, cfg)
 	flag.Parse()
+	if *showVersion {
+		fmt.Print(buildInfo())
+		return
+	}
+	if err := applyLegacy(); err != nil {
+		log.Fatalf("config: %v", err)
+	}
+	cfg.CmdAllowRoots, cfg.CmdDenyRoots = splitList(allow), splitList(deny)
+	if cfg.Relays = splitList(relays); len(cfg.Relays) > 0 {
+		cfg.P2PNAT = true
+	}
+	if err := validateMode(cfg.Mode); err != nil {
+		log.Fatalf("config: %v", err)
+	}
+	if cfg.LoadGen && cfg.Mode == modeVault {
+		log.Fatalf("config: --loadgen originates traffic, which a --mode=vault node never does")
+	}
+	if err := validateBeaconMode(cfg.BeaconMode); err != nil {
+		log.Fatalf("config: %v", err)
+	}
+	if err := validatePathRules(pathRules{SubnetBits: cfg.PathSubnetBits, HostPrefix: cfg.PathHostPrefix}); err != nil {
+		log.Fatalf("config: %v", err)
+	}
+	if _, err := parseProxyURL(cfg.ProxyURL); err != nil {
+		log.Fatalf("config: %v", err)
+	}
+	if _, err := parseSnapshotSchedule(cfg.SnapshotSchedule); err != nil {
+		log.Fatalf("config: %v", err)
+	}
+	if err := validateAccessLog(cfg.AccessLog); err != nil {
+		log.Fatalf("config: %v", err)
+	}
+	if err := validateControlAuth(cfg.ControlAuth); err != nil {
+		log.Fatalf("config: %v", err)
+	}
+	if cfg.AggregateMetrics && cfg.AggregateInterval < minAggregateInterval {
+		log.Fatalf("config: --aggregate-interval must be at least %v", minAggregateInterval)
+	}
+	if cfg.CallbackWorkers < 1 || cfg.ForwardWorkers < 1 {
+		log.Fatalf("config: --callback-workers and --forward-workers must be at least 1")
+	}
+	if cfg.CallbackQueue < 0 || cfg.ForwardQueue < 0 || cfg.GoroutineBudget < 0 {
+		log.Fatalf("config: --callback-queue, --forward-queue and --goroutine-budget can't be negative")
+	}
+	if cfg.AccessLog != accessOff {
+		log.Printf("[access] access log %s: decryptions are recorded in the chain and replicated to peers", cfg.AccessLog)
+	}
+	cfg.EgressAllow = splitList(egAllow)
+	if err := validateEgressMode(cfg.EgressMode); err != nil {
+		log.Fatalf("config: %v", err)
+	}
+	applyModeDefaults(cfg)
+	metricsEnabled.Store(cfg.Metrics)
 
 	// ---- Environment (cross-platform ~/.mixnets) ----
-	envPaths, err := initStorageEnv()
+	envPaths, err := initStorageEnv(cfg.DataDir)
 	if err != nil {
 		log.Fatalf("env init fail: %v", err)
 	}
+	if err := lockDataDir(envPaths); err != nil {
+		log.Fatalf("env: %v", err)
+	}
 
 	// ---- Require passphrase (flag or env var) ----
 	if envPass == "" {
@@ -51,8 +200,9 @@ func main() {
 
 	// ---- Load or create encrypted env.enc using passphrase ----
 	var secrets *EnvSecrets
+	pass := []byte(envPass)
 	if _, err := os.Stat(envPaths.EnvEnc); err == nil {
-		secrets, err = loadEnvSecrets(envPaths, []byte(envPass))
+		secrets, err = loadEnvSecrets(envPaths, pass)
 		if err != nil {
 			log.Fatalf("env.enc load: %v", err)
 		}
@@ -60,21 +210,45 @@ func main() {
 		if !newNet {
 			log.Fatalf("environment not set. Run with --new-net and provide --env-pass (or MIXNETS_ENV_PASS) to create %s", envPaths.EnvEnc)
 		}
-		secrets, err = createEnvSecrets(envPaths, []byte(envPass))
+		secrets, err = createEnvSecrets(envPaths, pass, orgID)
 		if err != nil {
 			log.Fatalf("env.enc create: %v", err)
 		}
 		log.Printf("[env] created %s", envPaths.EnvEnc)
+		if err := markSchemaCurrent(envPaths); err != nil {
+			log.Printf("[migrate] %v", err)
+		}
+	}
+	if cfg.AutoMigrate {
+		rep, err := runMigrations(envPaths, pass, secrets)
+		if rep != nil {
+			logMigrations(rep)
+		}
+		if err != nil {
+			log.Fatalf("migrate: %v", err)
+		}
+	} else if st, err := loadSchema(envPaths); err == nil && st.Version < currentSchema() {
+		log.Printf("[migrate] data dir is at schema v%d of v%d; run `go-node migrate` or start with --auto-migrate", st.Version, currentSchema())
+	}
+	wipeBytes(pass)
+	if !lockSecrets(secrets) {
+		log.Printf("[env] could not lock keys in memory; they may reach swap")
 	}
 
 	// ---- Identity & MixNet keypair ----
-	id := buildNodeIdentity()
+	id := loadNodeIdentity(envPaths)
 	nodeKeys, err := newNodeKeypair()
 	if err != nil {
 		log.Fatalf("keypair: %v", err)
 	}
-	log.Printf("[node] id=%s host=%s", id.NodeID[:8], id.Hostname)
+	log.Printf("[node] id=%s host=%s org=%s mode=%s", id.NodeID[:8], id.Hostname, secrets.OrgID, cfg.Mode)
 	log.Printf("[mix] pubkey(base64)=%s", base64.RawURLEncoding.EncodeToString(nodeKeys.Pub[:]))
+	if cfg.StrictCrypto {
+		if err := checkStrictCrypto(cfg, secrets, nodeKeys); err != nil {
+			log.Fatalf("strict-crypto: %v", err)
+		}
+	}
+	log.Printf("[crypto] posture=%s", cfg.cryptoPosture())
 
 	// ---- Pick interface & IP ----
 	pick, err := pickInterface(cfg)
@@ -84,6 +258,19 @@ func main() {
 	log.Printf("[net] using iface=%s ip=%s net=%s (forced=%v byName=%v byCIDR=%v)",
 		pick.Iface.Name, pick.IPStr, pick.NetStr, pick.Forced, pick.ByName, pick.ByCIDR)
 
+	// ---- Bind HTTP listeners first: an ephemeral API port must be known
+	// before beacons advertise it ----
+	bindIP := cfg.BindIP
+	if bindIP == "" {
+		bindIP = pick.IPStr
+	}
+	lns, err := bindListeners(cfg, bindIP)
+	if err != nil {
+		log.Fatalf("listen: %v", err)
+	}
+	writeNodeLock(envPaths, cfg, id.NodeID)
+	defer removeNodeLock(envPaths)
+
 	// ---- Discovery + DHT ----
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -93,50 +280,79 @@ func main() {
 
 	// Restore and auto-persist peers using env.enc FileKey
 	loadPeersOnStart(ps, envPaths.PeersEnc, secrets.FileKey[:])
-	go startAutoSavePeersLoop(ctx, ps, envPaths.PeersEnc, secrets.FileKey[:])
 
-	// Encrypted beacon broadcaster/listener using env.enc BeaconKey
-	if err := startBroadcaster(ctx, cfg, id, pick, nodeKeys, secrets.BeaconKey[:]); err != nil {
-		log.Fatalf("broadcaster: %v", err)
+	// Pass secrets into the server so control endpoints can use them
+	srv := newServer(cfg, id, ps, dht, nodeKeys, envPaths, secrets)
+	srv.logs = logs
+	srv.selfAddr = advertisedAddr(bindIP, pick.IPStr, cfg.APIPort)
+	srv.health.goSafe("peers-autosave", func() { startAutoSavePeersLoop(ctx, ps, envPaths.PeersEnc, secrets.FileKey[:], srv.maint) })
+	srv.health.goSafe("addr-probe", func() { srv.startAddrProbeLoop(ctx) })
+	srv.health.goSafe("disk-watch", func() { srv.startDiskWatchLoop(ctx) })
+	srv.health.goSafe("scrub", func() { srv.startScrubLoop(ctx) })
+	srv.health.goSafe("webhooks", func() { srv.startWebhookLoop(ctx) })
+	srv.health.goSafe("peer-caps", func() { srv.startCapsRefreshLoop(ctx) })
+	srv.health.goSafe("key-backfill", func() { srv.startKeyBackfillLoop(ctx) })
+	srv.health.goSafe("rtt-probe", func() { srv.startRTTProbeLoop(ctx) })
+	srv.health.goSafe("kv-reconcile", func() { srv.startKVReconcileLoop(ctx) })
+	srv.health.goSafe("relay-spill", func() { srv.startRelaySpillSweepLoop(ctx) })
+	srv.health.goSafe("catalog", func() { srv.startCatalogLoop(ctx) })
+	srv.health.goSafe("outbox", func() { srv.startOutboxLoop(ctx) })
+	srv.health.goSafe("replicate-retry", func() { srv.startReplicateRetryLoop(ctx) })
+	srv.health.goSafe("escrow-queue", func() { srv.startEscrowQueueLoop(ctx) })
+	srv.health.goSafe("peer-lifecycle", func() { srv.startPeerLifecycleLoop(ctx) })
+	srv.health.goSafe("group-keys", func() { srv.startGroupKeyLoop(ctx) })
+	srv.health.goSafe("inbox-expiry", func() { srv.startInboxExpiryLoop(ctx) })
+	srv.health.goSafe("snapshot", func() { srv.startSnapshotLoop(ctx) })
+	srv.health.goSafe("keysaver-probe", func() { srv.startKeysaverProbeLoop(ctx) })
+	srv.health.goSafe("dht-announce", func() { srv.startDHTAnnounceLoop(ctx) })
+	srv.health.goSafe("dht-save", func() { srv.startDHTSaveLoop(ctx) })
+	srv.health.goSafe("fleet", func() { srv.startFleetLoop(ctx) })
+
+	// Encrypted beacon broadcaster/listener using env.enc BeaconKey. Without
+	// discovery the node still serves known peers: degrade, don't exit.
+	if err := startBroadcaster(ctx, cfg, id, pick, nodeKeys, secrets.BeaconKey[:], srv.org.ID, srv, srv.health); err != nil {
+		srv.health.markDegraded("broadcaster", err.Error())
 	}
-	if err := startListener(ctx, cfg, ps, pick, secrets.BeaconKey[:]); err != nil {
-		log.Fatalf("listener: %v", err)
+	if err := startListener(ctx, cfg, ps, pick, secrets.BeaconKey[:], srv.pairings, srv.disco, srv.org, srv.clock, srv.dups, srv.fetchProfile, srv.health); err != nil {
+		srv.health.markDegraded("listener", err.Error())
 	}
 
-	// ---- HTTP servers: public + control ----
-	bindIP := cfg.BindIP
-	if bindIP == "" {
-		bindIP = pick.IPStr
+	if cfg.P2P {
+		if err := srv.startP2PNode(ctx); err != nil {
+			srv.health.markDegraded("p2p", err.Error())
+		}
 	}
-	publicAddr := fmt.Sprintf("%s:%d", bindIP, cfg.APIPort)     // peer-facing on NIC IP
-	controlAddr := fmt.Sprintf("127.0.0.1:%d", cfg.ControlPort) // local-only
-
-	// Pass secrets into the server so control endpoints can use them
-	srv := newServer(cfg, id, ps, dht, nodeKeys, envPaths, secrets)
 
+	// ---- HTTP servers: public (peer-facing on NIC IP) + control (local-only) ----
 	publicSrv := &http.Server{
-		Addr:              publicAddr,
 		Handler:           srv.PublicHandler(),
 		ReadHeaderTimeout: 5 * time.Second,
 	}
 	controlSrv := &http.Server{
-		Addr:              controlAddr,
 		Handler:           srv.ControlHandler(),
 		ReadHeaderTimeout: 5 * time.Second,
 	}
 
 	go func() {
-		log.Printf("[public http] listening on %s", publicAddr)
-		if err := publicSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("public http: %v", err)
-		}
+		log.Printf("[public http] listening on %s", lns.public.Addr())
+		srv.health.serveOrDegrade("public http", publicSrv, lns.public)
 	}()
 	go func() {
-		log.Printf("[control http] listening on %s (local only)", controlAddr)
-		if err := controlSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("control http: %v", err)
-		}
+		log.Printf("[control http] listening on %s (local only)", lns.control.Addr())
+		srv.health.serveOrDegrade("control http", controlSrv, lns.control)
 	}()
 
-	select {} // block forever
+	// run until interrupted, then flush state and stop listening
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+	log.Printf("[main] shutting down")
+	cancel()
+	savePeersIfDirty(ps, envPaths.PeersEnc, secrets.FileKey[:])
+	srv.catalog.save()
+	srv.saveDHTStore()
+	shutCtx, shutCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer shutCancel()
+	_ = publicSrv.Shutdown(shutCtx)
+	_ = controlSrv.Shutdown(shutCtx)
 }
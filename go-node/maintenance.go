@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Maintenance mode. POST /maintenance/enter?duration=30m pauses the
+// background work that rewrites or deletes files under ~/.mixnets (chunk
+// GC, the integrity scrub, retention enforcement and the peers.enc
+// autosave) so operators can snapshot the directory. Reads and /replicate
+// carry on. Entering waits for running jobs to stop, flushes the chain
+// file, peers.enc and the scrub cursor, and only then sets the flag. The
+// node advertises the "maintenance" capability so peers rank it last for
+// fanout. It exits at the deadline or on POST /maintenance/exit.
+
+const (
+	capMaintenance = "maintenance" // beacon capability: busy being backed up
+
+	defaultMaintenance = 30 * time.Minute
+	maxMaintenance     = 24 * time.Hour
+)
+
+type maintenance struct {
+	// gate is held shared by a destructive job while it runs and
+	// exclusively while entering, so no job straddles the flag
+	gate sync.RWMutex
+
+	mu       sync.Mutex
+	entering bool
+	since    time.Time
+	until    time.Time
+	timer    *time.Timer
+}
+
+// maintenanceView is the state reported by /maintenance and /status.
+type maintenanceView struct {
+	Active bool      `json:"active"`
+	Since  time.Time `json:"since,omitzero"`
+	Until  time.Time `json:"until,omitzero"`
+}
+
+func (m *maintenance) active() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return !m.until.IsZero()
+}
+
+// paused is true while entering or in maintenance; long jobs poll it to
+// stop early.
+func (m *maintenance) paused() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.entering || !m.until.IsZero()
+}
+
+// hold reports whether a destructive job may run now. If it returns true
+// the caller must call release when done.
+func (m *maintenance) hold() bool {
+	m.gate.RLock()
+	if m.active() {
+		m.gate.RUnlock()
+		return false
+	}
+	return true
+}
+
+func (m *maintenance) release() { m.gate.RUnlock() }
+
+func (m *maintenance) view() maintenanceView {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return maintenanceView{Active: !m.until.IsZero(), Since: m.since, Until: m.until}
+}
+
+// enterMaintenance waits for running jobs, flushes pending writes and sets
+// the flag until now+d. Entering again moves the deadline.
+func (s *Server) enterMaintenance(d time.Duration) (maintenanceView, error) {
+	m := s.maint
+	m.mu.Lock()
+	m.entering = true
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		m.entering = false
+		m.mu.Unlock()
+	}()
+
+	m.gate.Lock()
+	defer m.gate.Unlock()
+	if err := s.flushForMaintenance(); err != nil {
+		return maintenanceView{}, err
+	}
+	now := time.Now().UTC()
+	m.mu.Lock()
+	if m.until.IsZero() {
+		m.since = now
+	}
+	m.until = now.Add(d)
+	if m.timer != nil {
+		m.timer.Stop()
+	}
+	m.timer = time.AfterFunc(d, func() {
+		defer recoverOnce("maintenance")
+		s.exitMaintenance("deadline")
+	})
+	v := maintenanceView{Active: true, Since: m.since, Until: m.until}
+	m.mu.Unlock()
+	log.Printf("[audit] maintenance mode until %s", v.Until.Format(time.RFC3339))
+	return v, nil
+}
+
+// exitMaintenance clears the flag; false if it wasn't set.
+func (s *Server) exitMaintenance(why string) bool {
+	m := s.maint
+	m.mu.Lock()
+	if m.until.IsZero() {
+		m.mu.Unlock()
+		return false
+	}
+	if m.timer != nil {
+		m.timer.Stop()
+		m.timer = nil
+	}
+	m.since, m.until = time.Time{}, time.Time{}
+	m.mu.Unlock()
+	log.Printf("[audit] maintenance mode ended (%s)", why)
+	return true
+}
+
+// flushForMaintenance puts what is still in memory or OS buffers on disk:
+// the chain file, peers.enc and the scrub cursor.
+func (s *Server) flushForMaintenance() error {
+	s.chainMu.Lock()
+	err := syncFile(s.chainPath())
+	s.chainMu.Unlock()
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("sync chain: %w", err)
+	}
+	savePeersIfDirty(s.peers, s.paths.PeersEnc, s.secrets.FileKey[:])
+	s.scrub.mu.Lock()
+	s.scrub.saveLocked()
+	s.scrub.mu.Unlock()
+	return nil
+}
+
+func syncFile(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// writeMaintenance answers 409 to a destructive request during maintenance.
+func (s *Server) writeMaintenance(w http.ResponseWriter) {
+	v := s.maint.view()
+	http.Error(w, "maintenance mode until "+v.Until.Format(time.RFC3339), http.StatusConflict)
+}
+
+// POST /maintenance/enter[?duration=30m] (control, token)
+func (s *Server) handleMaintenanceEnter(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	d := defaultMaintenance
+	if v := r.URL.Query().Get("duration"); v != "" {
+		var err error
+		if d, err = time.ParseDuration(v); err != nil || d <= 0 {
+			http.Error(w, "bad duration", http.StatusBadRequest)
+			return
+		}
+	}
+	if d > maxMaintenance {
+		http.Error(w, "duration over "+maxMaintenance.String(), http.StatusBadRequest)
+		return
+	}
+	v, err := s.enterMaintenance(d)
+	if err != nil {
+		http.Error(w, "flush: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, v)
+}
+
+// POST /maintenance/exit (control, token)
+func (s *Server) handleMaintenanceExit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	s.exitMaintenance("exit request")
+	writeJSON(w, s.maint.view())
+}
+
+// GET /maintenance (control)
+func (s *Server) handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.maint.view())
+}
@@ -0,0 +1,10 @@
+//go:build !windows
+
+package main
+
+import "syscall"
+
+// lockMemory keeps b's pages out of swap.
+func lockMemory(b []byte) bool {
+	return syscall.Mlock(b) == nil
+}
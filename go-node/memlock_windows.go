@@ -0,0 +1,20 @@
+//go:build windows
+
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+var procVirtualLock = syscall.NewLazyDLL("kernel32.dll").NewProc("VirtualLock")
+
+// lockMemory keeps b's pages out of the page file. VirtualLock is bounded by
+// the process working set, which is ample for a few keys.
+func lockMemory(b []byte) bool {
+	if len(b) == 0 {
+		return false
+	}
+	ok, _, _ := procVirtualLock.Call(uintptr(unsafe.Pointer(&b[0])), uintptr(len(b)))
+	return ok != 0
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"math"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Replicate metadata minimization. File contents are sealed, but envelopes
+// travel over plain HTTP, so every LAN observer saw each file's exact
+// ciphertext size and its name. Two options hide them:
+//
+//   - --pad-chunks pads the payload before sealing so the chunk is a whole
+//     number of 64 KiB buckets. A header inside the ciphertext keeps the
+//     payload's true length and, for a compressed file, the original size
+//     that raw_size would otherwise show. The block records pad=65536.
+//   - --seal-names replaces the name on the wire and in every chain with the
+//     name sealed under the file key (base64url nonce||ct, name_sealed=true).
+//     Key holders open it on /recover; the origin's key sidecar keeps the
+//     plain name.
+//
+// Every node of this release reads both and advertises the padded-chunks and
+// sealed-names capabilities. An origin applies an option only while every
+// peer it knows advertises the capability; otherwise the file goes out plain
+// and meta_plain_fallback_total counts it, so an older node can still
+// restore it.
+
+const (
+	capPaddedChunks = "padded-chunks" // beacon capability: reads padded chunks
+	capSealedNames  = "sealed-names"  // beacon capability: reads sealed names
+
+	padBucket     = 64 << 10
+	padHeaderSize = 16 // payload length, raw size (uint64 BE each)
+	aeadOverhead  = chacha20poly1305.NonceSizeX + chacha20poly1305.Overhead
+)
+
+var metaFallback = metricDef{"meta_plain_fallback_total", "sends that skipped a metadata option because a known peer doesn't advertise it", "capability"}
+
+// padPayload prefixes payload with its header and zero-fills it so that the
+// sealed chunk ends on a padBucket boundary.
+func padPayload(payload []byte, rawSize int) []byte {
+	n := padHeaderSize + len(payload) + aeadOverhead
+	total := (n + padBucket - 1) / padBucket * padBucket
+	out := make([]byte, total-aeadOverhead)
+	binary.BigEndian.PutUint64(out[0:8], uint64(len(payload)))
+	binary.BigEndian.PutUint64(out[8:16], uint64(rawSize))
+	copy(out[padHeaderSize:], payload)
+	return out
+}
+
+// unpadPayload undoes padPayload.
+func unpadPayload(b []byte) ([]byte, int, error) {
+	if len(b) < padHeaderSize {
+		return nil, 0, errors.New("padded payload too short")
+	}
+	n := binary.BigEndian.Uint64(b[0:8])
+	raw := binary.BigEndian.Uint64(b[8:16])
+	if n > uint64(len(b)-padHeaderSize) || raw > math.MaxInt32 {
+		return nil, 0, errors.New("bad padding header")
+	}
+	return b[padHeaderSize : padHeaderSize+int(n)], int(raw), nil
+}
+
+// openPayload turns a chunk's plaintext back into the file: it strips the
+// padding, then undoes compression.
+func openPayload(b Block, plain []byte) ([]byte, error) {
+	rawSize := b.RawSize
+	if b.Pad > 0 {
+		var err error
+		if plain, rawSize, err = unpadPayload(plain); err != nil {
+			return nil, err
+		}
+	}
+	return decompressPayload(b.Comp, plain, rawSize)
+}
+
+func sealName(k [32]byte, name string) (string, error) {
+	ct, err := aeadSealWithKey(k[:], []byte(name))
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(ct), nil
+}
+
+func openName(k [32]byte, sealed string) (string, error) {
+	ct, err := base64.RawURLEncoding.DecodeString(sealed)
+	if err != nil {
+		return "", err
+	}
+	name, err := aeadOpenWithKey(k[:], ct)
+	if err != nil {
+		return "", errors.New("sealed name does not open with the file key")
+	}
+	return string(name), nil
+}
+
+// blockName returns b's file name, opening a sealed one with k. ok is false
+// when the name stays sealed.
+func blockName(b Block, k *[32]byte) (name string, ok bool) {
+	if !b.NameSealed {
+		return b.Name, true
+	}
+	if k == nil {
+		return b.Name, false
+	}
+	name, err := openName(*k, b.Name)
+	if err != nil {
+		return b.Name, false
+	}
+	return name, true
+}
+
+// fleetReads reports whether every known peer advertises capability c.
+func (s *Server) fleetReads(c string) bool {
+	for _, p := range s.peers.List() {
+		if p.NodeID != s.id.NodeID && !p.hasCap(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// metaOptions picks the metadata options for the next send.
+func (s *Server) metaOptions() (pad, seal bool) {
+	if s.cfg.PadChunks {
+		if pad = s.fleetReads(capPaddedChunks); !pad {
+			s.metrics.counter(metaFallback).inc(capPaddedChunks)
+		}
+	}
+	if s.cfg.SealNames {
+		if seal = s.fleetReads(capSealedNames); !seal {
+			s.metrics.counter(metaFallback).inc(capSealedNames)
+		}
+	}
+	return pad, seal
+}
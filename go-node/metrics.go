@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A tiny metrics registry: latency histograms with fixed buckets, and
+// counters and gauges with one label, rendered in Prometheus text format at
+// GET /metrics (control). When metrics are disabled a timer costs one
+// atomic add (the op count).
+//
+// Two registries feed /metrics. processMetrics holds what belongs to the
+// process: the crypto timings, panics and the goroutine count. Every other
+// counter is a node's and lives in its Server's registry (s.metrics), so
+// two nodes in one process count their own traffic. A node metric is
+// declared as a metricDef next to the code that bumps it and looked up in
+// the node's registry by name.
+
+var metricsEnabled atomic.Bool
+
+func init() { metricsEnabled.Store(true) }
+
+// histBuckets are upper bounds, ×4 apart: 10µs .. ~10s.
+var histBuckets = func() []time.Duration {
+	var out []time.Duration
+	for b := 10 * time.Microsecond; b < 15*time.Second; b *= 4 {
+		out = append(out, b)
+	}
+	return out
+}()
+
+type histogram struct {
+	name, help string
+	count      atomic.Int64
+	sumNanos   atomic.Int64
+	buckets    []atomic.Int64 // len(histBuckets)+1, last is +Inf
+}
+
+// metricsRegistry is one set of named metrics.
+type metricsRegistry struct {
+	mu         sync.Mutex
+	histograms map[string]*histogram
+	counters   map[string]*counterVec
+	gauges     map[string]*gaugeVec
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{histograms: map[string]*histogram{}, counters: map[string]*counterVec{}, gauges: map[string]*gaugeVec{}}
+}
+
+var processMetrics = newMetricsRegistry()
+
+// metricDef names a counter or gauge with one label.
+type metricDef struct{ name, help, label string }
+
+// newHistogram registers (or returns the existing) process histogram
+// called name.
+func newHistogram(name, help string) *histogram {
+	m := processMetrics
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if h, ok := m.histograms[name]; ok {
+		return h
+	}
+	h := &histogram{name: name, help: help, buckets: make([]atomic.Int64, len(histBuckets)+1)}
+	m.histograms[name] = h
+	return h
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := sort.Search(len(histBuckets), func(i int) bool { return d <= histBuckets[i] })
+	h.buckets[i].Add(1)
+	h.sumNanos.Add(int64(d))
+}
+
+// time starts a measurement; call the returned func when the op is done:
+//
+//	defer hSeal.time()()
+func (h *histogram) time() func() {
+	h.count.Add(1)
+	if !metricsEnabled.Load() {
+		return noopTimer
+	}
+	start := time.Now()
+	return func() { h.observe(time.Since(start)) }
+}
+
+func noopTimer() {}
+
+// counterVec is a counter with one label, e.g. panics by scope.
+type counterVec struct {
+	name, help, label string
+	mu                sync.Mutex
+	vals              map[string]int64
+}
+
+// newCounterVec registers a process counter.
+func newCounterVec(name, help, label string) *counterVec {
+	return processMetrics.counter(metricDef{name, help, label})
+}
+
+// counter returns m's counter for d, registering it on first use. A nil
+// registry (a helper built outside any node) hands out nil, which counts
+// nothing.
+func (m *metricsRegistry) counter(d metricDef) *counterVec {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if c, ok := m.counters[d.name]; ok {
+		return c
+	}
+	c := &counterVec{name: d.name, help: d.help, label: d.label, vals: map[string]int64{}}
+	m.counters[d.name] = c
+	return c
+}
+
+func (c *counterVec) inc(v string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.vals[v]++
+	c.mu.Unlock()
+}
+
+// gaugeVec is a gauge with one label, e.g. peers heard by interface.
+type gaugeVec struct {
+	name, help, label string
+	mu                sync.Mutex
+	vals              map[string]float64
+}
+
+// newGaugeVec registers a process gauge.
+func newGaugeVec(name, help, label string) *gaugeVec {
+	return processMetrics.gauge(metricDef{name, help, label})
+}
+
+// gauge returns m's gauge for d, registering it on first use.
+func (m *metricsRegistry) gauge(d metricDef) *gaugeVec {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if g, ok := m.gauges[d.name]; ok {
+		return g
+	}
+	g := &gaugeVec{name: d.name, help: d.help, label: d.label, vals: map[string]float64{}}
+	m.gauges[d.name] = g
+	return g
+}
+
+func (g *gaugeVec) set(v string, x float64) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	g.vals[v] = x
+	g.mu.Unlock()
+}
+
+// GET /metrics (control): this node's metrics and the process's.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetrics(w, processMetrics, s.metrics)
+}
+
+func writeMetrics(w io.Writer, regs ...*metricsRegistry) {
+	var hs []*histogram
+	var cs []*counterVec
+	var gs []*gaugeVec
+	for _, m := range regs {
+		m.mu.Lock()
+		for _, h := range m.histograms {
+			hs = append(hs, h)
+		}
+		for _, c := range m.counters {
+			cs = append(cs, c)
+		}
+		for _, g := range m.gauges {
+			gs = append(gs, g)
+		}
+		m.mu.Unlock()
+	}
+	sort.Slice(hs, func(i, j int) bool { return hs[i].name < hs[j].name })
+	sort.Slice(cs, func(i, j int) bool { return cs[i].name < cs[j].name })
+	sort.Slice(gs, func(i, j int) bool { return gs[i].name < gs[j].name })
+
+	for _, c := range cs {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+		c.mu.Lock()
+		keys := make([]string, 0, len(c.vals))
+		for k := range c.vals {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(w, "%s{%s=%q} %d\n", c.name, c.label, k, c.vals[k])
+		}
+		c.mu.Unlock()
+	}
+	for _, g := range gs {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+		g.mu.Lock()
+		keys := make([]string, 0, len(g.vals))
+		for k := range g.vals {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(w, "%s{%s=%q} %g\n", g.name, g.label, k, g.vals[k])
+		}
+		g.mu.Unlock()
+	}
+	for _, h := range hs {
+		n := h.name
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", n, h.help, n)
+		var cum int64
+		for i, b := range histBuckets {
+			cum += h.buckets[i].Load()
+			fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", n, b.Seconds(), cum)
+		}
+		cum += h.buckets[len(histBuckets)].Load()
+		fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", n, cum)
+		fmt.Fprintf(w, "%s_sum %g\n", n, time.Duration(h.sumNanos.Load()).Seconds())
+		// _count is every call, timed or not (metrics may be disabled)
+		fmt.Fprintf(w, "%s_count %d\n", n, h.count.Load())
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func scrape(t *testing.T, s *Server) string {
+	t.Helper()
+	rr := callControl(s, http.MethodGet, "/metrics", s.ctlToken, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("/metrics: %d %s", rr.Code, rr.Body)
+	}
+	return rr.Body.String()
+}
+
+// Two nodes in one process count their own traffic; the process metrics
+// show on both.
+func TestMetricsPerServer(t *testing.T) {
+	a, b := newTestServer(t, "a", nil), newTestServer(t, "b", nil)
+	eph := make([]byte, 32)
+	for range 2 {
+		a.refuseReplay(httptest.NewRecorder(), "memory", onionV2, eph)
+	}
+	b.disco.record("10.0.0.9", beaconMalformed, time.Now())
+
+	ma, mb := scrape(t, a), scrape(t, b)
+	if !strings.Contains(ma, `relay_replays_total{path="memory"} 1`) || strings.Contains(mb, "relay_replays_total{") {
+		t.Fatalf("relay replays leaked between nodes:\na: %s\nb: %s", ma, mb)
+	}
+	if !strings.Contains(mb, `discovery_packets_total{outcome="malformed"} 1`) || strings.Contains(ma, "discovery_packets_total{") {
+		t.Fatalf("discovery packets leaked between nodes:\na: %s\nb: %s", ma, mb)
+	}
+	for _, m := range []string{ma, mb} {
+		if !strings.Contains(m, "# TYPE crypto_kdf_seconds histogram") || !strings.Contains(m, "# TYPE panics_total counter") {
+			t.Fatalf("process metrics missing: %s", m)
+		}
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Data dir migrations. Early installs carry layouts later releases moved
+// away from: peers.enc sealed with a key derived from key.pem, key files
+// named by hash prefix, one chain for every org, env.enc v1, and a NodeID
+// derived without the board serial and display. `go-node
+// migrate` (or --auto-migrate at startup) applies the migrations newer
+// than the version in schema.json, in order, recording each one as it
+// completes. Every migration looks at the files themselves rather than
+// trusting the version, so running it again, or after an interruption,
+// only does what is left. A file that is rewritten (not just renamed) is
+// first copied to migrate-backup/<version>-<name>/; a backup that is
+// already there is kept, since it is the original.
+
+const (
+	schemaFile       = "schema.json"
+	migrateBackupDir = "migrate-backup"
+)
+
+type migration struct {
+	version int
+	name    string
+	run     func(mc *migrateCtx) error
+}
+
+// migrations in the order they apply; the last version is the current one.
+var migrations = []migration{
+	{1, "peers-rekey", migratePeersRekey},
+	{2, "fkey-rename", migrateFkeyRename},
+	{3, "chain-split", migrateChainSplit},
+	{4, "env-v2", migrateEnvV2},
+	{5, "node-id-pin", migrateNodeIDPin},
+}
+
+func currentSchema() int { return migrations[len(migrations)-1].version }
+
+type schemaState struct {
+	Version int          `json:"version"`
+	Applied []schemaStep `json:"applied,omitempty"`
+}
+
+type schemaStep struct {
+	Version int       `json:"version"`
+	Name    string    `json:"name"`
+	At      time.Time `json:"at"`
+	Changes int       `json:"changes"`
+}
+
+// migrateChange is one line of the summary.
+type migrateChange struct {
+	Migration string `json:"migration"`
+	Path      string `json:"path"` // relative to the data dir
+	Action    string `json:"action"`
+	Backup    string `json:"backup,omitempty"`
+}
+
+type migrateReport struct {
+	From    int             `json:"from"`
+	To      int             `json:"to"`
+	Changes []migrateChange `json:"changes"`
+}
+
+type migrateCtx struct {
+	paths *EnvPaths
+	pass  []byte
+	sec   *EnvSecrets
+	cur   migration
+	rep   *migrateReport
+}
+
+func (mc *migrateCtx) rel(path string) string {
+	if r, err := filepath.Rel(mc.paths.BaseDir, path); err == nil {
+		return r
+	}
+	return path
+}
+
+func (mc *migrateCtx) changed(path, action, backup string) {
+	mc.rep.Changes = append(mc.rep.Changes, migrateChange{Migration: mc.cur.name, Path: mc.rel(path), Action: action, Backup: backup})
+}
+
+// backup copies path under this migration's backup dir, keeping a copy
+// that is already there, and returns where it is.
+func (mc *migrateCtx) backup(path string) (string, error) {
+	dst := filepath.Join(mc.paths.BaseDir, migrateBackupDir, fmt.Sprintf("%d-%s", mc.cur.version, mc.cur.name), mc.rel(path))
+	if _, err := os.Stat(dst); err == nil {
+		return mc.rel(dst), nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return "", err
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	if err := writeFileAtomic(dst, b); err != nil {
+		return "", err
+	}
+	return mc.rel(dst), nil
+}
+
+func loadSchema(paths *EnvPaths) (schemaState, error) {
+	var st schemaState
+	b, err := os.ReadFile(filepath.Join(paths.BaseDir, schemaFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return st, nil
+	}
+	if err != nil {
+		return st, err
+	}
+	if err := json.Unmarshal(b, &st); err != nil {
+		return st, fmt.Errorf("%s: %w", schemaFile, err)
+	}
+	return st, nil
+}
+
+func saveSchema(paths *EnvPaths, st schemaState) error {
+	b, _ := json.MarshalIndent(st, "", "  ")
+	return writeFileAtomic(filepath.Join(paths.BaseDir, schemaFile), append(b, '\n'))
+}
+
+// markSchemaCurrent records a data dir that was just created as needing
+// no migrations.
+func markSchemaCurrent(paths *EnvPaths) error {
+	return saveSchema(paths, schemaState{Version: currentSchema()})
+}
+
+// runMigrations applies the pending migrations. sec may be nil, in which
+// case env.enc is opened with pass; a data dir without env.enc has nothing
+// to migrate. It stops at the first migration that fails, having recorded
+// the ones before it.
+func runMigrations(paths *EnvPaths, pass []byte, sec *EnvSecrets) (*migrateReport, error) {
+	st, err := loadSchema(paths)
+	if err != nil {
+		return nil, err
+	}
+	rep := &migrateReport{From: st.Version, To: st.Version, Changes: []migrateChange{}}
+	if st.Version >= currentSchema() {
+		return rep, nil
+	}
+	if sec == nil {
+		if _, err := os.Stat(paths.EnvEnc); errors.Is(err, os.ErrNotExist) {
+			rep.To = currentSchema()
+			return rep, markSchemaCurrent(paths)
+		}
+		if sec, err = openEnvSecrets(paths.EnvEnc, pass); err != nil {
+			return rep, fmt.Errorf("env.enc: %w", err)
+		}
+	}
+	mc := &migrateCtx{paths: paths, pass: pass, sec: sec, rep: rep}
+	for _, m := range migrations {
+		if m.version <= st.Version {
+			continue
+		}
+		mc.cur = m
+		before := len(rep.Changes)
+		if err := m.run(mc); err != nil {
+			return rep, fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+		st.Version = m.version
+		st.Applied = append(st.Applied, schemaStep{Version: m.version, Name: m.name, At: time.Now().UTC(), Changes: len(rep.Changes) - before})
+		if err := saveSchema(paths, st); err != nil {
+			return rep, err
+		}
+		rep.To = m.version
+	}
+	return rep, nil
+}
+
+// logMigrations logs a startup run's changes.
+func logMigrations(rep *migrateReport) {
+	for _, c := range rep.Changes {
+		log.Printf("[migrate] %s: %s %s", c.Migration, c.Path, c.Action)
+	}
+	if rep.To != rep.From {
+		log.Printf("[migrate] data dir schema v%d -> v%d (%d changes)", rep.From, rep.To, len(rep.Changes))
+	}
+}
+
+// 1: peers.enc from before the env.enc FileKey was sealed, as a peer
+// snapshot, with SHA-256 of key.pem. Reseal it the current way.
+func migratePeersRekey(mc *migrateCtx) error {
+	fp := mc.paths.PeersEnc
+	data, err := os.ReadFile(fp)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := openPeers(data, mc.sec.FileKey[:]); err == nil {
+		return nil
+	}
+	snap, err := loadPeersEncrypted(fp, mc.paths.KeyPath)
+	if err != nil {
+		mc.changed(fp, "left alone: opens with neither the env.enc FileKey nor key.pem", "")
+		return nil
+	}
+	ps := newPeerStore()
+	mergeSnapshot(ps, snap)
+	out, err := sealPeers(ps.List(), mc.sec.FileKey[:])
+	if err != nil {
+		return err
+	}
+	bk, err := mc.backup(fp)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(fp, out); err != nil {
+		return err
+	}
+	mc.changed(fp, fmt.Sprintf("resealed %d peers with the env.enc FileKey (was key.pem)", len(snap.Peers)), bk)
+	return nil
+}
+
+// 2: keys/<prefix16>.<ext>.fkey to keys/<hash>.fkey. The chain may still
+// be unsplit at this point.
+func migrateFkeyRename(mc *migrateCtx) error {
+	chain := readChainFile(filepath.Join(mc.paths.BaseDir, "chain", mc.sec.OrgID, "chain.jsonl"))
+	if chain == nil {
+		chain = readChainFile(filepath.Join(mc.paths.BaseDir, "chain", "chain.jsonl"))
+	}
+	dir := filepath.Join(mc.paths.BaseDir, "keys")
+	for _, name := range renameLegacyFileKeys(mc.paths, chain) {
+		mc.changed(filepath.Join(dir, name), "renamed to its full-hash name", "")
+	}
+	return nil
+}
+
+// 3: chain/chain.jsonl to chain/<org>/chain.jsonl.
+func migrateChainSplit(mc *migrateCtx) error {
+	moved, err := splitLegacyChain(mc.paths, mc.sec.OrgID)
+	if moved {
+		mc.changed(filepath.Join(mc.paths.BaseDir, "chain", "chain.jsonl"), "moved to chain/"+mc.sec.OrgID+"/", "")
+	}
+	return err
+}
+
+// 4: env.enc v1 to v2, which records its Argon2id parameters. Needs the
+// passphrase.
+func migrateEnvV2(mc *migrateCtx) error {
+	v, err := envFileVersion(mc.paths.EnvEnc)
+	if err != nil || v != 1 {
+		return err
+	}
+	if len(mc.pass) == 0 {
+		return errors.New("env.enc is v1 and no passphrase was given")
+	}
+	bk, err := mc.backup(mc.paths.EnvEnc)
+	if err != nil {
+		return err
+	}
+	if err := sealEnvSecrets(mc.paths.EnvEnc, mc.pass, mc.sec); err != nil {
+		return err
+	}
+	mc.changed(mc.paths.EnvEnc, "rewritten as v2", bk)
+	return nil
+}
+
+// 5: the NodeID now hashes the board serial and display as well
+// (fingerprint_hw.go), which moves it on a machine that has either. Pin
+// the NodeID this data dir has been announcing in identity.json, so peers,
+// pairings and keysaver records keep matching it.
+func migrateNodeIDPin(mc *migrateCtx) error {
+	fp := filepath.Join(mc.paths.BaseDir, identityFile)
+	pi, err := readPersistedIdentity(fp)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if pi.NodeID != "" {
+		return nil
+	}
+	hw := fingerprintHardware(mc.paths)
+	inst := instanceName(mc.paths)
+	old := buildNodeIdentity(inst, "", "").NodeID
+	if buildNodeIdentity(inst, trySerial(hw), primaryDisplay(hw)).NodeID == old {
+		return nil
+	}
+	if pi, err = readPersistedIdentity(fp); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	pi.NodeID, pi.Created = old, time.Now().UTC().Format(time.RFC3339)
+	if err := writePersistedIdentity(fp, pi); err != nil {
+		return err
+	}
+	mc.changed(fp, "pinned NodeID "+old[:8]+" from before the hardware fingerprint", "")
+	return nil
+}
+
+// readChainFile reads a chain.jsonl, skipping lines that don't parse.
+func readChainFile(path string) []Block {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var blocks []Block
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var blk Block
+		if json.Unmarshal(line, &blk) == nil {
+			blocks = append(blocks, blk)
+		}
+	}
+	return blocks
+}
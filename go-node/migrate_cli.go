@@ -0,0 +1,65 @@
+//go:build !dll
+// +build !dll
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// `go-node migrate [--data-dir D] [--env-pass P] [--json]` brings a data
+// dir up to the current schema and prints what it changed. It refuses to
+// run while a node is using the data dir. Exit 1 on failure; whatever was
+// done before the failure stays done and is printed.
+func runMigrate(args []string) int {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	dataDir := fs.String("data-dir", "", "storage directory (default: MIXNETS_DATA_DIR or ~/.mixnets)")
+	envPass := fs.String("env-pass", "", "passphrase for env.enc (or set MIXNETS_ENV_PASS)")
+	asJSON := fs.Bool("json", false, "print the summary as JSON")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	paths, err := initStorageEnv(*dataDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "migrate: storage: %v\n", err)
+		return 1
+	}
+	if err := lockDataDir(paths); err != nil {
+		fmt.Fprintf(os.Stderr, "migrate: %v\n", err)
+		return 1
+	}
+	pass := []byte(*envPass)
+	if len(pass) == 0 {
+		pass = []byte(os.Getenv("MIXNETS_ENV_PASS"))
+	}
+	defer wipeBytes(pass)
+	rep, err := runMigrations(paths, pass, nil)
+	if rep != nil {
+		if *asJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			_ = enc.Encode(rep)
+		} else {
+			for _, c := range rep.Changes {
+				fmt.Printf("[%s] %s: %s\n", c.Migration, c.Path, c.Action)
+				if c.Backup != "" {
+					fmt.Printf("    backup: %s\n", c.Backup)
+				}
+			}
+			switch {
+			case rep.From != rep.To:
+				fmt.Printf("schema v%d -> v%d, %d changes\n", rep.From, rep.To, len(rep.Changes))
+			case err == nil:
+				fmt.Printf("schema v%d: up to date\n", rep.To)
+			}
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "migrate: %v\n", err)
+		return 1
+	}
+	return 0
+}
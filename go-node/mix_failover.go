@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Mix path failover. A send-text used to retry one onion against one first
+// hop, so a dead relay on the path failed the send however many peers were
+// up; a relay gave up on the first error from its next hop. Now:
+//   - send-text tries up to mixPathAttempts paths, each built without the
+//     first hops that already failed (a one-hop path to the destination
+//     itself is simply retried);
+//   - a relay retries a failed forward once after relayForwardBackoff
+//     (jittered); a 5xx
+//     answer is a failure like no answer at all, and whatever error the
+//     next hop finally answers goes back toward the sender, so a failure
+//     anywhere down the path reaches send-text's failover;
+//   - each failure bumps the peer's mix_fails in the PeerStore, a success
+//     clears it, and buildHops puts peers with recent failures behind the
+//     rest whatever the strategy. Failures older than mixFailForget don't
+//     count.
+
+const (
+	mixPathAttempts     = 3
+	mixFailForget       = 15 * time.Minute
+	relayForwardBackoff = 250 * time.Millisecond
+)
+
+// recentMixFails is p's mix failure count, 0 once mixFailForget passed.
+func (p PeerInfo) recentMixFails(now time.Time) int {
+	if p.MixFails == 0 || now.Sub(p.MixFailAt) > mixFailForget {
+		return 0
+	}
+	return p.MixFails
+}
+
+// MarkMix records a relay or injection outcome against nodeID.
+func (ps *PeerStore) MarkMix(nodeID string, ok bool, now time.Time) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	p, found := ps.peers[nodeID]
+	if !found || (ok && p.MixFails == 0) {
+		return
+	}
+	if ok {
+		p.MixFails, p.MixFailAt = 0, time.Time{}
+	} else {
+		p.MixFails = p.recentMixFails(now) + 1
+		p.MixFailAt = now.UTC()
+	}
+	ps.peers[nodeID] = p
+	ps.bumpLocked(false)
+}
+
+// markMixAddr is MarkMix for the peer at addr, if it is known.
+func (s *Server) markMixAddr(addr string, ok bool) {
+	if p, found := s.peers.ByAddr(addr); found {
+		s.peers.MarkMix(p.NodeID, ok, time.Now())
+	}
+}
+
+// forwardOK reports whether a hop took a packet. 507 is the final hop's
+// quota, an answer rather than a failure of the path.
+func forwardOK(resp *http.Response, err error) bool {
+	return err == nil && (resp.StatusCode < 500 || resp.StatusCode == http.StatusInsufficientStorage)
+}
+
+// relayForward POSTs a peeled packet in form to the next hop, once more
+// after relayForwardBackoff if the first try fails or gets a 5xx.
+func (s *Server) relayForward(next string, body bodySource, form onionForm) (*http.Response, string, error) {
+	resp, to, err := s.postSourceToAddr(next, "/mix/relay", body, onionHeader(form))
+	if !forwardOK(resp, err) {
+		if err == nil {
+			log.Printf("[mix] forward to %s got %d, retrying", next, resp.StatusCode)
+			resp.Body.Close()
+		} else {
+			log.Printf("[mix] forward to %s failed, retrying: %v", next, err)
+		}
+		time.Sleep(jitter(relayForwardBackoff))
+		resp, to, err = s.postSourceToAddr(next, "/mix/relay", body, onionHeader(form))
+	}
+	s.markMixAddr(next, forwardOK(resp, err))
+	return resp, to, err
+}
+
+// relayFailed answers for a forward that failed or got an error back, and
+// reports whether it did. The next hop's error status goes back as is (507
+// with its quota body), and after a failure the layer v/ephPub is
+// forgotten so the hop before can retry it.
+func (s *Server) relayFailed(w http.ResponseWriter, resp *http.Response, err error, v int, ephPub []byte) bool {
+	if !forwardOK(resp, err) {
+		s.relayReplay.forget(v, ephPub)
+	}
+	if err != nil {
+		http.Error(w, "forward fail", http.StatusBadGateway)
+		return true
+	}
+	if passStorageFull(w, resp) {
+		resp.Body.Close()
+		return true
+	}
+	if resp.StatusCode < 300 {
+		return false
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+	resp.Body.Close()
+	http.Error(w, "next hop: "+strings.TrimSpace(string(msg)), resp.StatusCode)
+	return true
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A next hop answering 503 is retried once, marked as failing and its
+// status goes back to the previous hop. The layer is forgotten, so the
+// same packet is taken again once the next hop recovers, and only then
+// refused as a replay.
+func TestRelayForwardFailingNextHop(t *testing.T) {
+	var hits atomic.Int64
+	var failing atomic.Bool
+	failing.Store(true)
+	next := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if failing.Load() {
+			http.Error(w, "forward fail", http.StatusServiceUnavailable)
+		}
+	}))
+	t.Cleanup(next.Close)
+	nextAddr := strings.TrimPrefix(next.URL, "http://")
+
+	b := newTestServer(t, "b", nil)
+	b.peers.Upsert(PeerInfo{NodeID: hexB, Addr: nextAddr, LastSeen: time.Now()})
+	env, _ := json.Marshal(FinalEnvelope{Type: loadgenMixType, MsgID: "m"})
+	var plain onionLayerPlain
+	plain.Next, plain.Meta.MsgID, plain.Meta.TTL, plain.Meta.Class = nextAddr, "m", 2, classInteractive
+	packet := sealLayer(t, b, plain, env)
+
+	if rr := relay(b, packet); rr.Code != http.StatusServiceUnavailable || !strings.Contains(rr.Body.String(), "next hop: forward fail") {
+		t.Fatalf("failing next hop: HTTP %d %s", rr.Code, rr.Body)
+	}
+	if n := hits.Load(); n != 2 {
+		t.Fatalf("next hop tried %d times, want 2", n)
+	}
+	if p, _ := b.peers.Get(hexB); p.MixFails != 1 {
+		t.Fatalf("mix_fails %d, want 1", p.MixFails)
+	}
+
+	failing.Store(false)
+	if rr := relay(b, packet); rr.Code != http.StatusOK {
+		t.Fatalf("after recovery: HTTP %d %s", rr.Code, rr.Body)
+	}
+	if p, _ := b.peers.Get(hexB); p.MixFails != 0 {
+		t.Fatalf("mix_fails %d after a success", p.MixFails)
+	}
+	if rr := relay(b, packet); rr.Code != http.StatusConflict {
+		t.Fatalf("forwarded packet again: HTTP %d %s", rr.Code, rr.Body)
+	}
+}
+
+// A relay that can't reach the third hop fails the second, and the first
+// passes that back: send-text sees the failure, runs through its attempts
+// and records the text as failed instead of sent.
+func TestSendTextFailurePastFirstHop(t *testing.T) {
+	a, x, y, z, d := newTestServer(t, "a", nil), newTestServer(t, "x", nil), newTestServer(t, "y", nil), newTestServer(t, "z", nil), newTestServer(t, "d", nil)
+	mesh(t, a, x, y, z, d)
+	hops, _, err := a.mixPath(pathFurthest, d.id.NodeID, 4)
+	if err != nil || len(hops) != 4 {
+		t.Fatalf("hops %+v %v", hops, err)
+	}
+	// a sends the third hop's traffic to a closed port
+	a.peers.mu.Lock()
+	p := a.peers.peers[hops[2].NodeID]
+	p.Addr, p.Addrs = "127.0.0.1:"+strconv.Itoa(freePort(t)), nil
+	a.peers.peers[hops[2].NodeID] = p
+	a.peers.mu.Unlock()
+
+	rr := httptest.NewRecorder()
+	a.handleSendText(rr, httptest.NewRequest(http.MethodPost, "/mix/send-text?to="+d.id.NodeID+"&hops=4", strings.NewReader("lost")))
+	if rr.Code != http.StatusBadGateway || !strings.Contains(rr.Body.String(), "status 502") {
+		t.Fatalf("send-text: HTTP %d %s", rr.Code, rr.Body)
+	}
+	st := a.deliveries.list(time.Now())
+	if len(st) != 1 || st[0].State != deliveryFailed {
+		t.Fatalf("deliveries %+v", st)
+	}
+}
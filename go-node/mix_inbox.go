@@ -0,0 +1,185 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Per-message inbox API. GET /inbox dumps everything the final hop holds
+// and DELETE /inbox drops whole senders, so reading one text meant guessing
+// its kv key for /backup/get. /mix/inbox pages through the same entries
+// (the quota's record of each message: msgid, type, name, sender, size,
+// received), /mix/inbox/read returns one message's plaintext and DELETE
+// /mix/inbox?msgid= drops one.
+//
+// ?after= is the Next cursor of the previous page: the sort position of its
+// last message, not the message itself, so a client may delete what it has
+// read and still page on.
+
+const (
+	mixInboxPageDef = 100
+	mixInboxPageMax = 1000
+)
+
+func inboxCursor(m InboxMessage) string {
+	return strconv.FormatUint(m.Logical, 10) + ":" + m.Sender + ":" + m.MsgID
+}
+
+// afterCursor reports whether m sorts after the cursor position (see
+// inboxQuota.list).
+func afterCursor(m InboxMessage, logical uint64, sender, msgid string) bool {
+	if m.Logical != logical {
+		return m.Logical > logical
+	}
+	if m.Sender != sender {
+		return m.Sender > sender
+	}
+	return m.MsgID > msgid
+}
+
+func parseInboxCursor(c string) (logical uint64, sender, msgid string, ok bool) {
+	parts := strings.SplitN(c, ":", 3)
+	if len(parts) != 3 {
+		return 0, "", "", false
+	}
+	n, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return 0, "", "", false
+	}
+	return n, parts[1], parts[2], true
+}
+
+// find returns the first held message with msgid (from sender, if set) in
+// list order.
+func (q *inboxQuota) find(msgid, sender string) (InboxMessage, bool) {
+	for _, m := range q.list() {
+		if m.MsgID == msgid && (sender == "" || m.Sender == sender) {
+			return m, true
+		}
+	}
+	return InboxMessage{}, false
+}
+
+// remove drops the messages with msgid (from sender, if set) and returns
+// their kv keys.
+func (q *inboxQuota) remove(msgid, sender string) []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var keys []string
+	for id, u := range q.senders {
+		if sender != "" && id != sender {
+			continue
+		}
+		kept := u.entries[:0]
+		for _, e := range u.entries {
+			if e.msgid != msgid {
+				kept = append(kept, e)
+				continue
+			}
+			keys = append(keys, e.key)
+			u.bytes -= e.size
+			q.bytes -= e.size
+			q.msgs--
+		}
+		u.entries = kept
+		if len(u.entries) == 0 {
+			delete(q.senders, id)
+		}
+	}
+	return keys
+}
+
+// GET /mix/inbox[?limit=&after=] (control): one page of held messages in
+// Lamport order; Next is set while more remain.
+// DELETE /mix/inbox?msgid=[&sender=]: drop one message.
+func (s *Server) handleMixInbox(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		msgid := strings.TrimSpace(q.Get("msgid"))
+		if msgid == "" {
+			http.Error(w, "need ?msgid= (DELETE /inbox drops whole senders)", http.StatusBadRequest)
+			return
+		}
+		keys := s.inbox.remove(msgid, strings.TrimSpace(q.Get("sender")))
+		if len(keys) == 0 {
+			http.Error(w, "no such message", http.StatusNotFound)
+			return
+		}
+		s.mu.Lock()
+		for _, k := range keys {
+			delete(s.kv, k)
+		}
+		s.mu.Unlock()
+		writeJSON(w, map[string]any{"status": "ok", "deleted": len(keys), "msgid": msgid})
+		return
+	default:
+		http.Error(w, "use GET or DELETE", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit, _ := strconv.Atoi(q.Get("limit"))
+	if limit <= 0 {
+		limit = mixInboxPageDef
+	}
+	limit = min(limit, mixInboxPageMax)
+	all := s.inbox.list()
+	i := 0
+	if c := q.Get("after"); c != "" {
+		logical, sender, msgid, ok := parseInboxCursor(c)
+		if !ok {
+			http.Error(w, "bad ?after=", http.StatusBadRequest)
+			return
+		}
+		for i < len(all) && !afterCursor(all[i], logical, sender, msgid) {
+			i++
+		}
+	}
+	page := all[i:min(i+limit, len(all))]
+	res := InboxList{LogicalClock: s.lamport.value(), Messages: page}
+	if i+len(page) < len(all) && len(page) > 0 {
+		res.Next = inboxCursor(page[len(page)-1])
+	}
+	writeJSON(w, res)
+}
+
+// GET /mix/inbox/read?msgid=[&sender=] (control): one message's plaintext.
+// Texts and group messages come back as text/plain, files as an attachment
+// under their name.
+func (s *Server) handleMixInboxRead(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	msgid := strings.TrimSpace(q.Get("msgid"))
+	if msgid == "" {
+		http.Error(w, "need ?msgid=", http.StatusBadRequest)
+		return
+	}
+	m, ok := s.inbox.find(msgid, strings.TrimSpace(q.Get("sender")))
+	if !ok {
+		http.Error(w, "no such message", http.StatusNotFound)
+		return
+	}
+	s.mu.RLock()
+	val, ok := s.kv[m.Key]
+	s.mu.RUnlock()
+	if !ok {
+		http.Error(w, "message gone", http.StatusNotFound)
+		return
+	}
+	switch m.Type {
+	case "text", mixGroup:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	default:
+		w.Header().Set("Content-Type", "application/octet-stream")
+		if m.Type == "file" && m.Name != "" {
+			w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": m.Name}))
+		}
+	}
+	_, _ = w.Write(val)
+}
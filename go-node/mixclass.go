@@ -0,0 +1,200 @@
+package main
+
+import (
+	"cmp"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Message classes trade latency for anonymity. The sender picks hops,
+// padding and retries from its class; every layer carries the class name
+// so relays pick the matching delay bounds from their own table. The hint
+// sits inside the encrypted, padded layer, so it says how to queue the
+// message, never what the payload is.
+
+const (
+	classInteractive = "interactive"
+	classBulk        = "bulk"
+	classBackground  = "background"
+
+	defaultMixClass = classInteractive
+	mixTTL          = 8 // hop budget: layer i of an onion carries mixTTL-i
+)
+
+type mixClass struct {
+	Hops     int           `json:"hops"`
+	DelayMin time.Duration `json:"delay_min"` // per-relay hold, uniform in [min, max]
+	DelayMax time.Duration `json:"delay_max"`
+	PadCell  int           `json:"pad_cell"` // layer plaintext padded to its bucket, then a multiple (0 = off)
+	Cover    bool          `json:"cover"`    // may be mixed with cover traffic
+	Retries  int           `json:"retries"`  // extra injection attempts
+	Path     string        `json:"path"`     // path strategy: furthest | lowlatency | random | nearest
+}
+
+// bulk keeps the old fixed behavior: 4 hops, 100–600ms per relay.
+func defaultMixClasses() map[string]mixClass {
+	return map[string]mixClass{
+		classInteractive: {Hops: 3, DelayMin: 20 * time.Millisecond, DelayMax: 150 * time.Millisecond, PadCell: 1 << 10, Retries: 1, Path: pathFurthest},
+		classBulk:        {Hops: 4, DelayMin: 100 * time.Millisecond, DelayMax: 600 * time.Millisecond, PadCell: 16 << 10, Cover: true, Retries: 2, Path: pathFurthest},
+		classBackground:  {Hops: 5, DelayMin: 500 * time.Millisecond, DelayMax: 3 * time.Second, PadCell: 4 << 10, Cover: true, Retries: 4, Path: pathFurthest},
+	}
+}
+
+// mixClassFor returns the named class; unknown or empty names fall back to
+// bulk at relays (an old sender sends no hint) and are an error for senders.
+func (cfg *Config) mixClassFor(name string) (mixClass, bool) {
+	c, ok := cfg.MixClasses[name]
+	if !ok {
+		return cfg.MixClasses[classBulk], false
+	}
+	return c, true
+}
+
+// relayDelay draws this relay's hold time for a message of class name.
+func (cfg *Config) relayDelay(name string) time.Duration {
+	c, _ := cfg.mixClassFor(name)
+	span := c.DelayMax - c.DelayMin
+	if span <= 0 {
+		return c.DelayMin
+	}
+	n, _ := rand.Int(rand.Reader, big.NewInt(int64(span)))
+	return c.DelayMin + time.Duration(n.Int64())
+}
+
+// applyMixOverrides lets a request tweak its class (?hops=, ?pad=,
+// ?retries=, ?path= or its alias ?strategy=). Delay bounds are applied by relays from their own table and
+// can't be set per request.
+func applyMixOverrides(c mixClass, q url.Values) (mixClass, error) {
+	var err error
+	geti := func(k string, dst *int) {
+		if v := q.Get(k); v != "" && err == nil {
+			*dst, err = strconv.Atoi(v)
+		}
+	}
+	geti("hops", &c.Hops)
+	geti("pad", &c.PadCell)
+	geti("retries", &c.Retries)
+	if err != nil {
+		return c, err
+	}
+	if v := cmp.Or(q.Get("path"), q.Get("strategy")); v != "" {
+		c.Path = v
+	}
+	if c.Hops < 1 || c.Hops > mixTTL {
+		return c, fmt.Errorf("hops must be 1..%d", mixTTL)
+	}
+	if c.PadCell < 0 || c.Retries < 0 {
+		return c, fmt.Errorf("pad and retries must be >= 0")
+	}
+	if !validPath(c.Path) {
+		return c, fmt.Errorf("path must be one of %s", strings.Join(pathStrategies, ", "))
+	}
+	return c, nil
+}
+
+// checkPathLen refuses a path that came out shorter than an explicit ?hops=
+// asked for; a class's own hop count stays best effort, so small networks
+// still get the longest path they can.
+func checkPathLen(q url.Values, c mixClass, hops []hopInfo) error {
+	if !q.Has("hops") || len(hops) >= c.Hops {
+		return nil
+	}
+	return fmt.Errorf("not enough eligible peers for %d hops: only %d relays usable besides the destination", c.Hops, len(hops)-1)
+}
+
+// parseMixClassFlag parses --mix-class name:key=val,... into classes.
+// Keys: hops, delay (min-max durations), pad, cover, retries, path.
+func parseMixClassFlag(classes map[string]mixClass, s string) error {
+	name, spec, ok := strings.Cut(s, ":")
+	if !ok || name == "" {
+		return fmt.Errorf("want name:key=val,... got %q", s)
+	}
+	c := classes[name]
+	for _, kv := range strings.Split(spec, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(kv), "=")
+		var err error
+		switch k {
+		case "hops":
+			c.Hops, err = strconv.Atoi(v)
+		case "pad":
+			c.PadCell, err = strconv.Atoi(v)
+		case "retries":
+			c.Retries, err = strconv.Atoi(v)
+		case "cover":
+			c.Cover, err = strconv.ParseBool(v)
+		case "path":
+			if c.Path = v; !validPath(v) {
+				err = fmt.Errorf("path must be one of %s", strings.Join(pathStrategies, ", "))
+			}
+		case "delay":
+			lo, hi, _ := strings.Cut(v, "-")
+			if c.DelayMin, err = time.ParseDuration(lo); err == nil {
+				c.DelayMax = c.DelayMin
+				if hi != "" {
+					c.DelayMax, err = time.ParseDuration(hi)
+				}
+			}
+		default:
+			err = fmt.Errorf("unknown key %q", k)
+		}
+		if err != nil {
+			return fmt.Errorf("mix class %s: %v", name, err)
+		}
+	}
+	if c.Hops < 1 || c.Hops > mixTTL || c.DelayMax < c.DelayMin {
+		return fmt.Errorf("mix class %s: hops must be 1..%d and delay min <= max", name, mixTTL)
+	}
+	classes[name] = c
+	return nil
+}
+
+func validPath(s string) bool {
+	return s == "" || slices.Contains(pathStrategies, s)
+}
+
+func mixClassNames(classes map[string]mixClass) []string {
+	out := make([]string, 0, len(classes))
+	for n := range classes {
+		out = append(out, n)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// padLayer marshals a JSON layer padded up to its bucket (padTarget),
+// using its "pad" field; cell 0 turns padding off. Padding happens before
+// sealing, so it shows on the wire only as size. Every relay and final hop
+// drops the field when it parses the layer.
+func padLayer(plain onionLayerPlain, cell int) []byte {
+	b, _ := json.Marshal(plain)
+	if cell <= 0 {
+		return b
+	}
+	const overhead = len(`,"pad":""`)
+	need := padTarget(len(b)+overhead, cell) - len(b) - overhead
+	plain.Pad = strings.Repeat("0", need)
+	b, _ = json.Marshal(plain)
+	return b
+}
+
+// padTarget is the padded size of n bytes: its bucket (onionPadBuckets),
+// rounded up to a multiple of cell bytes.
+func padTarget(n, cell int) int {
+	top := onionPadBuckets[len(onionPadBuckets)-1]
+	size := (n + top - 1) / top * top
+	for _, b := range onionPadBuckets {
+		if n <= b {
+			size = b
+			break
+		}
+	}
+	return (size + cell - 1) / cell * cell
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+// classNodes returns a fresh config whose interactive and bulk classes
+// hold messages for disjoint, short delay ranges, so a test can tell them
+// apart without waiting out the real defaults.
+func classNodes() *Config {
+	cfg := defaultConfig()
+	cfg.Quarantine = false
+	cfg.MixClasses[classInteractive] = mixClass{Hops: 2, DelayMax: 5 * time.Millisecond, Path: pathFurthest}
+	cfg.MixClasses[classBulk] = mixClass{Hops: 2, DelayMin: 60 * time.Millisecond, DelayMax: 90 * time.Millisecond, Path: pathFurthest}
+	return cfg
+}
+
+func TestRelayDelayBounds(t *testing.T) {
+	cfg := classNodes()
+	for _, name := range []string{classInteractive, classBulk, "", "unknown"} {
+		c, _ := cfg.mixClassFor(name)
+		for range 200 {
+			if d := cfg.relayDelay(name); d < c.DelayMin || d > c.DelayMax {
+				t.Fatalf("%q: delay %v outside [%v, %v]", name, d, c.DelayMin, c.DelayMax)
+			}
+		}
+	}
+	if c, ok := cfg.mixClassFor(""); ok || c != cfg.MixClasses[classBulk] {
+		t.Fatal("no hint must queue as bulk")
+	}
+}
+
+// Two classes sent over the same in-process path come out with latency
+// distributions that don't overlap: each relay holds a message for its
+// class's bounds, whatever the payload.
+func TestMixClassLatency(t *testing.T) {
+	a, relay, c := newTestServer(t, "a", classNodes()), newTestServer(t, "relay", classNodes()), newTestServer(t, "c", classNodes())
+	mesh(t, a, relay, c)
+	const n = 8
+	latency := func(class string) []time.Duration {
+		var out []time.Duration
+		for range n {
+			start := time.Now()
+			res := sendText(t, a, c, "class="+class, "hello")
+			inboxText(t, c, res.MsgID)
+			out = append(out, time.Since(start))
+		}
+		slices.Sort(out)
+		return out
+	}
+	fast, slow := latency(classInteractive), latency(classBulk)
+	t.Logf("interactive %v..%v, bulk %v..%v", fast[0], fast[n-1], slow[0], slow[n-1])
+	if fast[n-1] >= slow[0] {
+		t.Fatalf("interactive p100 %v not below bulk p0 %v", fast[n-1], slow[0])
+	}
+	// two hops: the relay holds it, the destination delivers at once
+	if hold := classNodes().MixClasses[classBulk].DelayMin; slow[0] < hold {
+		t.Fatalf("bulk crossed the relay in %v, under its %v hold", slow[0], hold)
+	}
+}
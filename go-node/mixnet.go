@@ -3,24 +3,23 @@ package main
 
 import (
 	"bytes"
-	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
-	"math/big"
 	"net/http"
 	"sort"
 	"time"
 
 	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
 )
 
-// FinalEnvelope is what the LAST hop receives as plaintext.
-// For Type "text", Data is the encrypted text (hard-coded key); for "file", Data is raw file bytes.
 // ---------------- Hard-coded text encryption (prototype) ----------------
 
 // WARNING: for demo only. Derive a static 32-byte key from a hard-coded passphrase.
@@ -32,8 +31,8 @@ func encryptTextHardcoded(plain []byte) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	nonce := make([]byte, chacha20poly1305.NonceSizeX)
-	if _, err := rand.Read(nonce); err != nil {
+	nonce, err := secureRandom(chacha20poly1305.NonceSizeX)
+	if err != nil {
 		return "", err
 	}
 	ct := aead.Seal(nil, nonce, plain, nil)
@@ -46,6 +45,10 @@ func decryptTextHardcoded(b64 string) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	return openTextHardcoded(raw)
+}
+
+func openTextHardcoded(raw []byte) ([]byte, error) {
 	if len(raw) < chacha20poly1305.NonceSizeX {
 		return nil, errors.New("ciphertext too short")
 	}
@@ -58,22 +61,91 @@ func decryptTextHardcoded(b64 string) ([]byte, error) {
 	return aead.Open(nil, nonce, ct, nil)
 }
 
-// ---------------- Build "furthest" path ----------------
+// ---------------- Build path ----------------
+
+// Path strategies, picked per mix class (see mixclass.go).
+const (
+	pathFurthest   = "furthest"
+	pathLowLatency = "lowlatency"
+	pathRandom     = "random"
+	pathNearest    = "nearest"
+)
+
+var pathStrategies = []string{pathFurthest, pathLowLatency, pathRandom, pathNearest}
+
+// chooseHops builds a path with strategy ("" = furthest) under the
+// diversity rules (see path_diversity.go).
+func chooseHops(strategy, selfID, destID string, peers []PeerInfo, maxHops int, rules pathRules) ([]hopInfo, PathDiversity, error) {
+	switch strategy {
+	case "", pathFurthest:
+		return chooseHopsFurthest(selfID, destID, peers, maxHops, rules)
+	case pathLowLatency:
+		return chooseHopsLowLatency(selfID, destID, peers, maxHops, rules)
+	case pathRandom:
+		return chooseHopsRandom(selfID, destID, peers, maxHops, rules)
+	case pathNearest:
+		return chooseHopsNearest(selfID, destID, peers, maxHops, rules)
+	}
+	return nil, PathDiversity{}, fmt.Errorf("unknown path strategy %q", strategy)
+}
 
 // chooseHopsFurthest selects up to maxHops peers that:
 //  1. end with dest (if present in the peer list),
 //  2. otherwise are the farthest by XOR distance from selfID.
 //
 // Requires PeerInfo to carry Addr (ip:port) and PubKey (32 bytes).
-func chooseHopsFurthest(selfID, destID string, peers []PeerInfo, maxHops int) ([]hopInfo, error) {
+func chooseHopsFurthest(selfID, destID string, peers []PeerInfo, maxHops int, rules pathRules) ([]hopInfo, PathDiversity, error) {
+	return buildHops(selfID, destID, peers, maxHops, rules, func(a, b PeerInfo) bool {
+		return xorDistance(selfID, a.NodeID).Cmp(xorDistance(selfID, b.NodeID)) > 0
+	})
+}
+
+// chooseHopsLowLatency is chooseHopsFurthest with relays taken by lowest
+// measured RTT from this node (unmeasured peers count as unknownRTT).
+// RTT between relays is not known, so this only bounds each hop's distance
+// from us.
+func chooseHopsLowLatency(selfID, destID string, peers []PeerInfo, maxHops int, rules pathRules) ([]hopInfo, PathDiversity, error) {
+	now := time.Now()
+	return buildHops(selfID, destID, peers, maxHops, rules, func(a, b PeerInfo) bool {
+		return a.rttOrUnknown(now) < b.rttOrUnknown(now)
+	})
+}
+
+// chooseHopsNearest takes the relays nearest to selfID by XOR distance.
+func chooseHopsNearest(selfID, destID string, peers []PeerInfo, maxHops int, rules pathRules) ([]hopInfo, PathDiversity, error) {
+	return buildHops(selfID, destID, peers, maxHops, rules, func(a, b PeerInfo) bool {
+		return xorDistance(selfID, a.NodeID).Cmp(xorDistance(selfID, b.NodeID)) < 0
+	})
+}
+
+// chooseHopsRandom samples relays uniformly: every candidate gets a random
+// rank (from crypto/rand, so paths can't be predicted) for this path.
+func chooseHopsRandom(selfID, destID string, peers []PeerInfo, maxHops int, rules pathRules) ([]hopInfo, PathDiversity, error) {
+	seed, err := secureRandom(8 * len(peers))
+	if err != nil {
+		return nil, PathDiversity{}, err
+	}
+	rank := make(map[string]uint64, len(peers))
+	for i, p := range peers {
+		rank[p.NodeID] = binary.BigEndian.Uint64(seed[8*i:])
+	}
+	return buildHops(selfID, destID, peers, maxHops, rules, func(a, b PeerInfo) bool {
+		return rank[a.NodeID] < rank[b.NodeID]
+	})
+}
+
+// buildHops takes the first maxHops-1 candidates in less order that keep
+// the diversity rules, then dest.
+func buildHops(selfID, destID string, peers []PeerInfo, maxHops int, rules pathRules, less func(a, b PeerInfo) bool) ([]hopInfo, PathDiversity, error) {
 	if maxHops < 1 {
 		maxHops = 1
 	}
 	// First, see if dest is known
 	var dest *PeerInfo
 	candidates := make([]PeerInfo, 0, len(peers))
+	taken := make(map[string]bool, len(peers)) // a node is never two hops
 	for _, p := range peers {
-		if p.NodeID == selfID {
+		if p.NodeID == selfID || taken[p.NodeID] {
 			continue
 		}
 		if len(p.PubKey) != 32 || p.Addr == "" {
@@ -84,30 +156,52 @@ func chooseHopsFurthest(selfID, destID string, peers []PeerInfo, maxHops int) ([
 			dest = &cp
 			continue
 		}
+		if p.KeyState == keyUnconfirmed {
+			continue // not a relay while its identity is in doubt
+		}
+		if rules.V2Only && !p.hasCap(capOnionV2) {
+			continue // would need a v1 layer
+		}
+		taken[p.NodeID] = true
 		candidates = append(candidates, p)
 	}
 	if dest == nil {
-		return nil, fmt.Errorf("destination %s not found among peers", destID)
+		return nil, PathDiversity{}, fmt.Errorf("destination %s not found among peers", destID)
+	}
+	if rules.V2Only && !dest.hasCap(capOnionV2) {
+		return nil, PathDiversity{}, fmt.Errorf("destination %s: %w", destID, errOnionV1Dest)
 	}
 
-	// Sort candidates by XOR distance from selfID, descending (furthest first)
+	// peers that failed to relay lately go last, whatever the strategy
+	now := time.Now()
 	sort.Slice(candidates, func(i, j int) bool {
-		di := xorDistance(selfID, candidates[i].NodeID)
-		dj := xorDistance(selfID, candidates[j].NodeID)
-		return di.Cmp(dj) > 0
+		if fi, fj := candidates[i].recentMixFails(now), candidates[j].recentMixFails(now); fi != fj {
+			return fi < fj
+		}
+		return less(candidates[i], candidates[j])
 	})
 
-	// Build path: pick farthest (maxHops-1) + final dest
+	// Build path: pick (maxHops-1) diverse relays + final dest
+	relays, div := rules.diverseRelays(candidates, *dest, min(maxHops-1, len(candidates)))
 	hops := make([]hopInfo, 0, maxHops)
-	for _, p := range candidates {
-		if len(hops) >= maxHops-1 {
-			break
-		}
-		hops = append(hops, hopInfo{NodeID: p.NodeID, Addr: p.Addr, PubKey: p.PubKey})
+	for _, p := range relays {
+		hops = append(hops, hopFor(p))
 	}
 	// Ensure final hop is dest
-	hops = append(hops, hopInfo{NodeID: dest.NodeID, Addr: dest.Addr, PubKey: dest.PubKey})
-	return hops, nil
+	hops = append(hops, hopFor(*dest))
+	return hops, div, nil
+}
+
+func hopFor(p PeerInfo) hopInfo {
+	return hopInfo{NodeID: p.NodeID, Addr: p.Addr, PubKey: p.PubKey, V: onionVersionFor(p), Bin: p.hasCap(capOnionBin), Cell: p.hasCap(capOnionCell)}
+}
+
+// onionVersionFor is the layer version p can peel.
+func onionVersionFor(p PeerInfo) int {
+	if p.hasCap(capOnionV2) {
+		return onionV2
+	}
+	return onionV1
 }
 
 // ------------------- Node keypair -------------------
@@ -118,10 +212,12 @@ type NodeKeypair struct {
 }
 
 func newNodeKeypair() (*NodeKeypair, error) {
-	var priv [32]byte
-	if _, err := rand.Read(priv[:]); err != nil {
+	b, err := secureRandom(32)
+	if err != nil {
 		return nil, err
 	}
+	var priv [32]byte
+	copy(priv[:], b)
 	// clamp private according to X25519 spec (not strictly necessary when using curve25519.X25519 helper)
 	priv[0] &= 248
 	priv[31] &= 127
@@ -150,18 +246,12 @@ func newNodeKeypair() (*NodeKeypair, error) {
 // For simplicity we'll create functions to build onion and to peel one layer.
 
 // ------------------- Helpers -------------------
-func randBytes(n int) ([]byte, error) {
-	b := make([]byte, n)
-	_, err := rand.Read(b)
-	return b, err
-}
-
 func aeadEncrypt(key32, plaintext []byte) ([]byte, error) {
 	aead, err := chacha20poly1305.NewX(key32)
 	if err != nil {
 		return nil, err
 	}
-	nonce, err := randBytes(chacha20poly1305.NonceSizeX)
+	nonce, err := secureRandom(chacha20poly1305.NonceSizeX)
 	if err != nil {
 		return nil, err
 	}
@@ -186,8 +276,62 @@ func aeadDecrypt(key32, nonceAndCT []byte) ([]byte, error) {
 	return pt, nil
 }
 
-// naive HKDF: here we just use the shared secret and expand to 32 bytes by hashing (for prototype).
-// In production use proper HKDF.
+// Onion layer key derivation. v1 keyed each layer with SHA-256 of the
+// X25519 secret; v2 runs it through HKDF-SHA256 salted with both public
+// keys, so a layer key is bound to the ephemeral and the recipient key it
+// was made for. Relays of this release peel both and advertise onion-hkdf;
+// a sender uses v2 for the hops that advertise it and v1 for the rest, so
+// older relays keep working until they upgrade. v1 is the legacy_onion_v1
+// shim (crypto_posture.go): with it off, relays refuse v1 layers and paths
+// only take hops that advertise onion-hkdf.
+//
+// Older senders have no "v" in the packet, and older relays ignore it, so a
+// v1 layer goes out without it (version byte 0 in a binary packet), and an
+// absent version and an explicit "v":1 both peel as v1.
+const (
+	onionV1    = 1 // SHA-256(shared); "v" absent or 1
+	onionV2    = 2
+	capOnionV2 = "onion-hkdf" // beacon capability: peels v2 layers
+
+	onionV2Info = "mixnet-layer-v2"
+)
+
+var errOnionV1Dest = errors.New("peels only v1 onion layers (no onion-hkdf) and legacy_onion_v1 is off")
+
+// onionVersion is the layer version of a packet's "v" or version byte.
+func onionVersion(v int) int {
+	if v == 0 {
+		return onionV1
+	}
+	return v
+}
+
+// wireOnionVersion is what a layer sealed at v carries on the wire.
+func wireOnionVersion(v int) int {
+	if v == onionV1 {
+		return 0
+	}
+	return v
+}
+
+// layerKey derives the AEAD key of an onion layer sealed at version v.
+func layerKey(v int, shared, ephPub, recipPub []byte) ([]byte, error) {
+	switch onionVersion(v) {
+	case onionV1:
+		return sharedToKey(shared), nil
+	case onionV2:
+		salt := append(append(make([]byte, 0, 64), ephPub...), recipPub...)
+		key := make([]byte, 32)
+		if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(onionV2Info)), key); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown onion version %d", v)
+}
+
+// sharedToKey is the v1 layer key (and the group key wrap): SHA-256 of the
+// X25519 secret.
 func sharedToKey(shared []byte) []byte {
 	// Use simple SHA-256(shared) -> 32
 	h := sha256Sum(shared)
@@ -210,37 +354,78 @@ type hopInfo struct {
 	NodeID string
 	Addr   string // ip:port
 	PubKey []byte // 32 bytes
+	V      int    // layer version the hop peels (onionV1 or onionV2)
+	Bin    bool   // takes binary layers (onion_binary.go)
+	Cell   bool   // takes cells (onion_cell.go)
 }
 
 // buildOnion: hops is ordered [hop0, hop1, ..., finalHop]. payload is final plaintext (file chunk).
-// Returns top-level onionPacket as bytes that should be sent to hops[0].Addr
-func buildOnion(hops []hopInfo, payload []byte, ttl int) ([]byte, error) {
+// msgid is stamped into every layer (random if empty); traceTo, when set, asks
+// each hop to report trace events to that origin NodeID.
+// Returns the top-level packet that should be sent to hops[0].Addr, in the
+// form firstForm gives (post it with onionHeader): cells if the path takes
+// them, binary if hops[0].Bin, else a JSON onionPacket.
+// Layer i carries ttl-i: a layer is sealed, so a relay can't pass on a
+// decremented TTL, and the count is baked in instead. A hop refuses a layer
+// whose TTL is 0 or less, so a path longer than ttl is refused here.
+// class is stamped into every layer for relay queueing. padCell > 0 pads:
+// on a cell path every hop gets a cell of one size (cellSize); on any other
+// path each layer is padded up to its bucket (padLayer, binLayer), which
+// hides the payload size but not how many layers are left.
+func buildOnion(hops []hopInfo, payload []byte, ttl int, msgid, traceTo, class string, padCell int) ([]byte, error) {
 	// start from final payload (inner-most plaintext)
 	inner := payload
-	msgidBytes, _ := randBytes(16)
-	msgid := base64.RawURLEncoding.EncodeToString(msgidBytes)
+	if len(hops) > ttl {
+		return nil, fmt.Errorf("path of %d hops exceeds ttl %d", len(hops), ttl)
+	}
+	if msgid == "" {
+		msgidBytes, err := secureRandom(16)
+		if err != nil {
+			return nil, err
+		}
+		msgid = base64.RawURLEncoding.EncodeToString(msgidBytes)
+	}
 
-	for i := len(hops) - 1; i >= 0; i-- {
-		h := hops[i]
+	layer := func(i int) onionLayerPlain {
 		plain := onionLayerPlain{}
 		if i == len(hops)-1 { // final
 			plain.Next = ""
-			plain.Payload = base64.RawURLEncoding.EncodeToString(inner)
 			plain.Meta.Final = true
 			plain.Meta.MsgID = msgid
-			plain.Meta.TTL = ttl
+			plain.Meta.TTL = ttl - i
+			plain.Meta.Trace = traceTo
+			plain.Meta.Class = class
 		} else {
 			plain.Next = hops[i+1].Addr
-			plain.Payload = base64.RawURLEncoding.EncodeToString(inner)
 			plain.Meta.Final = false
 			plain.Meta.MsgID = msgid
-			plain.Meta.TTL = ttl
+			plain.Meta.TTL = ttl - i
+			plain.Meta.Trace = traceTo
+			plain.Meta.Class = class
+			plain.Meta.Bin = binHop(hops, i+1)
+		}
+		return plain
+	}
+	if cellPath(hops, padCell) {
+		return buildCellOnion(hops, layer, payload, ttl, padCell)
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		h := hops[i]
+		plain := layer(i)
+		bin := binHop(hops, i)
+		var plainB []byte
+		if bin {
+			plainB = binLayer(plain, inner, padCell)
+		} else {
+			plain.Payload = base64.RawURLEncoding.EncodeToString(inner)
+			plainB = padLayer(plain, padCell)
 		}
-		plainB, _ := json.Marshal(plain)
 
 		// ephemeral key for this layer
-		ephemeralPriv := make([]byte, 32)
-		if _, err := rand.Read(ephemeralPriv); err != nil {
+		stop := hOnionLayer.time()
+		ephemeralPriv, err := secureRandom(32)
+		if err != nil {
 			return nil, err
 		}
 		ephemeralPub, _ := curve25519.X25519(ephemeralPriv, curve25519.Basepoint)
@@ -250,64 +435,153 @@ func buildOnion(hops []hopInfo, payload []byte, ttl int) ([]byte, error) {
 		if err != nil {
 			return nil, err
 		}
-		aeadKey := sharedToKey(shared)
+		aeadKey, err := layerKey(h.V, shared, ephemeralPub, h.PubKey)
+		if err != nil {
+			stop()
+			return nil, err
+		}
+		if bin {
+			inner, err = sealBinPacket(wireOnionVersion(h.V), ephemeralPub, aeadKey, plainB)
+			stop()
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
 		ct, err := aeadEncrypt(aeadKey, plainB)
+		stop()
 		if err != nil {
 			return nil, err
 		}
 		op := onionPacket{
+			V:            wireOnionVersion(h.V),
 			EphemeralPub: base64.RawURLEncoding.EncodeToString(ephemeralPub),
 			Ciphertext:   base64.RawURLEncoding.EncodeToString(ct),
 		}
 		inner, _ = json.Marshal(op) // inner becomes the ciphertext for next outer layer
 	}
-	return inner, nil // fully wrapped onion (JSON bytes) to send to first hop
+	return inner, nil // fully wrapped onion to send to first hop
+}
+
+// binHop reports whether the packet for hops[i] is binary: the hop takes
+// it and so does the hop that forwards it (we send the first).
+func binHop(hops []hopInfo, i int) bool {
+	return hops[i].Bin && (i == 0 || hops[i-1].Bin)
 }
 
 // ------------------- Relay handler: peel one layer -------------------
 
 // relayHandler should be registered on each node as POST /mix/relay
-// Body: JSON onionPacket (outermost). The handler will:
+// Body: JSON onionPacket (outermost), or a binary packet sent as
+// onionBinType (onion_binary.go). The handler will:
 //   - decode JSON, use its own privkey to derive shared key and decrypt one layer
 //   - obtain next and payload; if next=="" then this node is final receiver and will process payload
 //   - else forward to next address via HTTP POST to /mix/relay
 func relayHandler(nodeKeys *NodeKeypair, srv *Server) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Parse outer onion packet
-		var op onionPacket
-		if err := json.NewDecoder(r.Body).Decode(&op); err != nil {
+		if srv.cfg.RelayMaxBytes > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, srv.cfg.RelayMaxBytes)
+		}
+		// Up to RelaySpillBytes is handled in memory; a larger packet
+		// streams through spill files (relay_spill.go)
+		body := io.Reader(r.Body)
+		if srv.cfg.RelaySpillBytes > 0 {
+			body = io.LimitReader(r.Body, srv.cfg.RelaySpillBytes+1)
+		}
+		head, err := io.ReadAll(body)
+		if err != nil {
 			http.Error(w, "bad packet", http.StatusBadRequest)
 			return
 		}
-
-		epub, err := base64.RawURLEncoding.DecodeString(op.EphemeralPub)
-		if err != nil || len(epub) != 32 {
-			http.Error(w, "bad ephemeral", http.StatusBadRequest)
+		form := onionFormOf(r)
+		if srv.cfg.RelaySpillBytes > 0 && int64(len(head)) > srv.cfg.RelaySpillBytes {
+			srv.relaySpilled(w, nodeKeys, io.MultiReader(bytes.NewReader(head), r.Body), r.ContentLength, form)
 			return
 		}
-		ct, err := base64.RawURLEncoding.DecodeString(op.Ciphertext)
-		if err != nil {
-			http.Error(w, "bad ct", http.StatusBadRequest)
+
+		// Parse outer onion packet
+		var v int
+		var epub, ct, nonce, tag []byte
+		switch form {
+		case formBin:
+			if v, epub, ct, err = splitBinPacket(head); err != nil {
+				http.Error(w, "bad packet", http.StatusBadRequest)
+				return
+			}
+		case formCell:
+			if v, epub, nonce, tag, ct, err = splitCell(head); err != nil {
+				http.Error(w, "bad packet", http.StatusBadRequest)
+				return
+			}
+		default:
+			var op onionPacket
+			if err := json.Unmarshal(head, &op); err != nil {
+				http.Error(w, "bad packet", http.StatusBadRequest)
+				return
+			}
+			v = op.V
+			epub, err = base64.RawURLEncoding.DecodeString(op.EphemeralPub)
+			if err != nil || len(epub) != 32 {
+				http.Error(w, "bad ephemeral", http.StatusBadRequest)
+				return
+			}
+			ct, err = base64.RawURLEncoding.DecodeString(op.Ciphertext)
+			if err != nil {
+				http.Error(w, "bad ct", http.StatusBadRequest)
+				return
+			}
+		}
+
+		v = onionVersion(v)
+		if v == onionV1 && srv.refuseLegacy(w, legacyOnionV1) {
 			return
 		}
 
-		// Derive per-hop key: X25519(selfPriv, ephPub) -> AEAD(sha256(shared))
+		// Derive per-hop key: X25519(selfPriv, ephPub) -> layerKey at v
+		stop := hRelayPeel.time()
 		shared, err := curve25519.X25519(nodeKeys.Priv[:], epub)
 		if err != nil {
+			stop()
 			http.Error(w, "shared fail", http.StatusInternalServerError)
 			return
 		}
-		aeadKey := sharedToKey(shared)
+		aeadKey, err := layerKey(v, shared, epub, nodeKeys.Pub[:])
+		if err != nil {
+			stop()
+			http.Error(w, "bad version", http.StatusBadRequest)
+			return
+		}
 
-		plainB, err := aeadDecrypt(aeadKey, ct)
+		var plainB []byte
+		switch form {
+		case formBin:
+			plainB, err = openInPlace(aeadKey, ct) // ct is ours: a slice of head
+		case formCell:
+			plainB, err = openCell(aeadKey, nonce, tag, ct)
+		default:
+			plainB, err = aeadDecrypt(aeadKey, ct)
+		}
+		stop()
 		if err != nil {
 			http.Error(w, "decrypt fail", http.StatusForbidden)
 			return
 		}
+		if srv.refuseReplay(w, "memory", v, epub) {
+			return
+		}
 
 		// One hop's plaintext
 		var plain onionLayerPlain
-		if err := json.Unmarshal(plainB, &plain); err != nil {
+		var innerB []byte
+		switch form {
+		case formBin:
+			plain, innerB, err = parseBinLayer(plainB)
+		case formCell:
+			plain, innerB, err = peelCell(aeadKey, plainB)
+		default:
+			err = json.Unmarshal(plainB, &plain)
+		}
+		if err != nil {
 			http.Error(w, "bad layer", http.StatusBadRequest)
 			return
 		}
@@ -315,82 +589,200 @@ func relayHandler(nodeKeys *NodeKeypair, srv *Server) http.HandlerFunc {
 			http.Error(w, "ttl expired", http.StatusBadRequest)
 			return
 		}
+		srv.reportTrace(plain.Meta.Trace, srv.trace(plain.Meta.MsgID, traceRelayIn, ""))
 
-		// innerB is the next content (either another onionPacket JSON or FinalEnvelope JSON)
-		innerB, err := base64.RawURLEncoding.DecodeString(plain.Payload)
-		if err != nil {
-			http.Error(w, "bad inner payload", http.StatusBadRequest)
-			return
+		// innerB is the next content (either another onion packet or FinalEnvelope JSON)
+		if form == formJSON {
+			innerB, err = base64.RawURLEncoding.DecodeString(plain.Payload)
+			if err != nil {
+				http.Error(w, "bad inner payload", http.StatusBadRequest)
+				return
+			}
 		}
 
 		// FINAL HOP?
 		if plain.Next == "" || plain.Meta.Final {
+			whole := func() ([]byte, error) { return innerB, nil }
 			// Try to parse FinalEnvelope
 			var env FinalEnvelope
 			if err := json.Unmarshal(innerB, &env); err != nil {
-				// Store raw if not an envelope
-				key := "mixmsg-" + time.Now().Format("150405.000")
-				srv.mu.Lock()
-				srv.kv[key] = innerB
-				srv.mu.Unlock()
-				log.Printf("[mix] final: stored RAW %d bytes (couldn't parse envelope)", len(innerB))
-				writeJSON(w, map[string]any{"status": "ok", "final": true, "raw": true})
+				srv.deliverFinal(w, &plain, nil, nil, nil, whole)
 				return
 			}
-
-			switch env.Type {
-			case "text":
-				plainTxt, err := decryptTextHardcoded(env.DataB64)
-				if err != nil {
-					log.Printf("[mix] final text decrypt fail: %v", err)
-					http.Error(w, "decrypt fail", http.StatusForbidden)
-					return
-				}
-				key := "text-" + env.MsgID
-				srv.mu.Lock()
-				srv.kv[key] = plainTxt
-				srv.mu.Unlock()
-				log.Printf("[mix] final TEXT: msgid=%s from=%s to=%s size=%d", env.MsgID, env.SenderID, env.ReceiverID, len(plainTxt))
-				writeJSON(w, map[string]any{"status": "ok", "final": true, "type": "text", "msgid": env.MsgID})
-
-			case "file":
-				raw, err := base64.RawURLEncoding.DecodeString(env.DataB64)
-				if err != nil {
-					http.Error(w, "bad file payload", http.StatusBadRequest)
-					return
-				}
-				key := "file-" + env.MsgID + "-" + env.Name
-				srv.mu.Lock()
-				srv.kv[key] = raw
-				srv.mu.Unlock()
-				log.Printf("[mix] final FILE: msgid=%s name=%s from=%s to=%s size=%d", env.MsgID, env.Name, env.SenderID, env.ReceiverID, len(raw))
-				writeJSON(w, map[string]any{"status": "ok", "final": true, "type": "file", "msgid": env.MsgID, "name": env.Name})
-
-			default:
-				key := "mixmsg-" + env.MsgID
-				srv.mu.Lock()
-				srv.kv[key] = innerB
-				srv.mu.Unlock()
-				writeJSON(w, map[string]any{"status": "ok", "final": true, "type": "unknown", "msgid": env.MsgID})
+			var data []byte
+			var dataErr error
+			if env.Type == "text" || env.Type == "file" || env.Type == mixGroup || env.Type == mixGroupKey || env.Type == mixGroupKeyAck || env.Type == mixTextAck {
+				data, dataErr = base64.RawURLEncoding.DecodeString(env.DataB64)
 			}
+			srv.deliverFinal(w, &plain, &env, data, dataErr, whole)
 			return
 		}
 
-		// NOT FINAL: forward inner onion JSON (innerB) to next hop with jitter
-		plain.Meta.TTL--
+		// NOT FINAL: forward the inner packet (innerB) to next hop with jitter
+		// (the next layer carries its own, lower TTL)
 
-		// Random small delay (100–600ms) as mixing jitter
-		jitter, _ := rand.Int(rand.Reader, big.NewInt(500))
-		time.Sleep(time.Millisecond * (100 + time.Duration(jitter.Int64())))
+		// Hold for a random delay within this relay's bounds for the class
+		// (no hint: bulk, the old 100–600ms jitter)
+		time.Sleep(srv.cfg.relayDelay(plain.Meta.Class))
 
-		nextURL := fmt.Sprintf("http://%s/mix/relay", plain.Next)
-		resp, err := http.Post(nextURL, "application/json", bytes.NewReader(innerB))
+		resp, to, err := srv.relayForward(plain.Next, bytesBody(innerB), nextForm(form, &plain))
 		if err != nil {
 			log.Printf("[mix] forward err to %s: %v", plain.Next, err)
-			http.Error(w, "forward fail", http.StatusBadGateway)
+		}
+		if srv.relayFailed(w, resp, err, v, epub) {
+			return
+		}
+		defer resp.Body.Close()
+		srv.reportTrace(plain.Meta.Trace, srv.trace(plain.Meta.MsgID, traceRelayForward, to))
+		writeJSON(w, map[string]any{"status": "forwarded", "to": to})
+	}
+}
+
+// deliverFinal stores what a final hop received. env is nil when the inner
+// packet isn't an envelope; data is env's data_b64 decoded (text and file
+// only, dataErr if that failed), and whole returns the inner packet for the
+// types stored verbatim.
+func (s *Server) deliverFinal(w http.ResponseWriter, plain *onionLayerPlain, env *FinalEnvelope, data []byte, dataErr error, whole func() ([]byte, error)) {
+	if env == nil {
+		// Store raw if not an envelope
+		if s.refuseLegacy(w, legacyRawMix) {
+			return
+		}
+		innerB, err := whole()
+		if err != nil {
+			http.Error(w, "spill fail", http.StatusInternalServerError)
+			return
+		}
+		key := "mixmsg-" + time.Now().Format("150405.000")
+		if !s.storeInbox(w, "", plain.Meta.MsgID, 0, inboxRawType, "", key, innerB, s.inbox.expiry(0, time.Now())) {
+			return
+		}
+		s.reportTrace(plain.Meta.Trace, s.trace(plain.Meta.MsgID, traceFinalStore, "raw"))
+		log.Printf("[mix] final: stored RAW %d bytes (couldn't parse envelope)", len(innerB))
+		writeJSON(w, map[string]any{"status": "ok", "final": true, "raw": true})
+		return
+	}
+
+	s.lamport.observe(env.Logical)
+	expires := s.inbox.expiry(env.Expires, time.Now())
+
+	switch env.Type {
+	case "text":
+		var plainTxt []byte
+		var err error
+		if env.TextEph == "" {
+			if s.refuseLegacy(w, legacyHardcodedText) {
+				return
+			}
+			plainTxt, err = openTextHardcoded(data)
+		} else {
+			plainTxt, err = openText(s.nodeKeys, env, data)
+		}
+		if dataErr != nil {
+			err = dataErr
+		}
+		if err != nil {
+			log.Printf("[mix] final text decrypt fail: %v", err)
+			http.Error(w, "decrypt fail", http.StatusForbidden)
+			return
+		}
+		key := "text-" + env.MsgID
+		if !s.storeInbox(w, env.SenderID, env.MsgID, env.Logical, "text", "", key, plainTxt, expires) {
+			return
+		}
+		s.convReceived(env.SenderID, env.MsgID, env.Logical, plainTxt, expires)
+		s.ackDelivery(env)
+		s.reportTrace(plain.Meta.Trace, s.trace(plain.Meta.MsgID, traceFinalStore, "text"))
+		log.Printf("[mix] final TEXT: msgid=%s from=%s to=%s size=%d", env.MsgID, env.SenderID, env.ReceiverID, len(plainTxt))
+		writeJSON(w, map[string]any{"status": "ok", "final": true, "type": "text", "msgid": env.MsgID})
+
+	case "file":
+		if dataErr != nil {
+			http.Error(w, "bad file payload", http.StatusBadRequest)
+			return
+		}
+		if s.quarantineMixFile(w, env, data) {
+			s.reportTrace(plain.Meta.Trace, s.trace(plain.Meta.MsgID, traceFinalStore, "quarantine"))
+			return
+		}
+		key := "file-" + env.MsgID + "-" + env.Name
+		if !s.storeInbox(w, env.SenderID, env.MsgID, env.Logical, "file", env.Name, key, data, expires) {
+			return
+		}
+		s.reportTrace(plain.Meta.Trace, s.trace(plain.Meta.MsgID, traceFinalStore, "file"))
+		log.Printf("[mix] final FILE: msgid=%s name=%s from=%s to=%s size=%d", env.MsgID, env.Name, env.SenderID, env.ReceiverID, len(data))
+		writeJSON(w, map[string]any{"status": "ok", "final": true, "type": "file", "msgid": env.MsgID, "name": env.Name})
+
+	case mixGroupKey:
+		if dataErr != nil {
+			http.Error(w, "bad group key payload", http.StatusBadRequest)
+			return
+		}
+		if code, err := s.acceptGroupKey(env, data); err != nil {
+			log.Printf("[mix] final GROUP-KEY from=%.8s refused: %v", env.SenderID, err)
+			http.Error(w, err.Error(), code)
+			return
+		}
+		writeJSON(w, map[string]any{"status": "ok", "final": true, "type": mixGroupKey, "msgid": env.MsgID})
+
+	case mixGroupKeyAck:
+		if dataErr != nil {
+			http.Error(w, "bad group key ack payload", http.StatusBadRequest)
+			return
+		}
+		if code, err := s.acceptGroupKeyAck(env, data); err != nil {
+			log.Printf("[mix] final GROUP-KEY-ACK from=%.8s refused: %v", env.SenderID, err)
+			http.Error(w, err.Error(), code)
+			return
+		}
+		writeJSON(w, map[string]any{"status": "ok", "final": true, "type": mixGroupKeyAck, "msgid": env.MsgID})
+
+	case mixTextAck:
+		if dataErr != nil {
+			http.Error(w, "bad ack payload", http.StatusBadRequest)
+			return
+		}
+		if code, err := s.acceptMixAck(env, data); err != nil {
+			log.Printf("[mix] final TEXT-ACK from=%.8s refused: %v", env.SenderID, err)
+			http.Error(w, err.Error(), code)
+			return
+		}
+		writeJSON(w, map[string]any{"status": "ok", "final": true, "type": mixTextAck, "msgid": env.MsgID})
+
+	case mixGroup:
+		if dataErr != nil {
+			http.Error(w, "bad group payload", http.StatusBadRequest)
+			return
+		}
+		label, text, code, err := s.openGroupMessage(env, data)
+		if err != nil {
+			log.Printf("[mix] final GROUP %s from=%.8s refused: %v", env.Group, env.SenderID, err)
+			http.Error(w, err.Error(), code)
+			return
+		}
+		if !s.storeInbox(w, env.SenderID, env.MsgID, env.Logical, mixGroup, label, "group-"+label+"-"+env.MsgID, text, expires) {
+			return
+		}
+		s.convs.add(s.id.NodeID, groupThreadPrefix+label, convMessage{MsgID: env.MsgID, Dir: convIn, From: env.SenderID, Text: string(text), Logical: env.Logical, At: time.Now().Unix(), State: "received", Expires: expires})
+		s.reportTrace(plain.Meta.Trace, s.trace(plain.Meta.MsgID, traceFinalStore, "group"))
+		log.Printf("[mix] final GROUP: msgid=%s group=%s from=%s size=%d", env.MsgID, label, env.SenderID, len(text))
+		writeJSON(w, map[string]any{"status": "ok", "final": true, "type": mixGroup, "msgid": env.MsgID, "group": label})
+
+	case loadgenMixType:
+		// synthetic (see loadgen.go): ack, keep nothing
+		writeJSON(w, map[string]any{"status": "ok", "final": true, "type": loadgenMixType, "msgid": env.MsgID})
+
+	default:
+		innerB, err := whole()
+		if err != nil {
+			http.Error(w, "spill fail", http.StatusInternalServerError)
+			return
+		}
+		key := "mixmsg-" + env.MsgID
+		if !s.storeInbox(w, env.SenderID, env.MsgID, env.Logical, env.Type, "", key, innerB, expires) {
 			return
 		}
-		_ = resp.Body.Close()
-		writeJSON(w, map[string]any{"status": "forwarded", "to": plain.Next})
+		s.reportTrace(plain.Meta.Trace, s.trace(plain.Meta.MsgID, traceFinalStore, "unknown"))
+		writeJSON(w, map[string]any{"status": "ok", "final": true, "type": "unknown", "msgid": env.MsgID})
 	}
 }
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// dropCap makes s see peer as a release without capability c.
+func dropCap(s, peer *Server, c string) {
+	s.peers.mu.Lock()
+	defer s.peers.mu.Unlock()
+	p := s.peers.peers[peer.id.NodeID]
+	p.Caps = slices.DeleteFunc(slices.Clone(p.Caps), func(x string) bool { return x == c })
+	s.peers.peers[peer.id.NodeID] = p
+}
+
+// A path with a relay that only peels v1 layers gets a v1 layer for that
+// hop and v2 for the rest, and the text arrives.
+func TestOnionMixedVersionsRoundTrip(t *testing.T) {
+	a, b, c := newTestServer(t, "a", nil), newTestServer(t, "b", nil), newTestServer(t, "c", nil)
+	mesh(t, a, b, c)
+	dropCap(a, b, capOnionV2)
+	hops, _, err := a.mixPath(pathFurthest, c.id.NodeID, 2)
+	if err != nil || len(hops) != 2 || hops[0].V != onionV1 || hops[1].V != onionV2 {
+		t.Fatalf("hops %+v %v", hops, err)
+	}
+	resp := sendText(t, a, c, "hops=2", "through an old relay")
+	if got := inboxText(t, c, resp.MsgID); got != "through an old relay" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+// A JSON layer without "v" and one with "v":1 both peel as v1, "v":2 as
+// v2, and any other version is refused.
+func TestOnionVersionField(t *testing.T) {
+	s := newTestServer(t, "s", nil)
+	env, _ := json.Marshal(FinalEnvelope{Type: loadgenMixType, MsgID: "m"})
+	withV := func(packet []byte, v any) []byte {
+		var op map[string]any
+		if err := json.Unmarshal(packet, &op); err != nil {
+			t.Fatal(err)
+		}
+		if v == nil {
+			delete(op, "v")
+		} else {
+			op["v"] = v
+		}
+		out, _ := json.Marshal(op)
+		return out
+	}
+	for _, tc := range []struct {
+		name   string
+		packet []byte
+		want   int
+	}{
+		{"absent", withV(mixTo(t, s, onionV1, env), nil), http.StatusOK},
+		{"v1", withV(mixTo(t, s, onionV1, env), 1), http.StatusOK},
+		{"v2", mixTo(t, s, onionV2, env), http.StatusOK},
+		{"v2 layer sent as v1", withV(mixTo(t, s, onionV2, env), 1), http.StatusForbidden},
+		{"v3", withV(mixTo(t, s, onionV2, env), 3), http.StatusBadRequest},
+	} {
+		rr := httptest.NewRecorder()
+		relayHandler(s.nodeKeys, s)(rr, httptest.NewRequest(http.MethodPost, "/v1/mix/relay", bytes.NewReader(tc.packet)))
+		if rr.Code != tc.want {
+			t.Errorf("%s: HTTP %d %s, want %d", tc.name, rr.Code, rr.Body, tc.want)
+		}
+	}
+}
+
+// sealLayer seals plain, carrying inner, as a v2 layer for s by hand, so
+// that its meta can be anything buildOnion wouldn't write.
+func sealLayer(t *testing.T, s *Server, plain onionLayerPlain, inner []byte) []byte {
+	t.Helper()
+	plain.Payload = base64.RawURLEncoding.EncodeToString(inner)
+	plainB, _ := json.Marshal(plain)
+	eph := make([]byte, 32)
+	rand.Read(eph)
+	ephPub, _ := curve25519.X25519(eph, curve25519.Basepoint)
+	shared, _ := curve25519.X25519(eph, s.nodeKeys.Pub[:])
+	key, err := layerKey(onionV2, shared, ephPub, s.nodeKeys.Pub[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct, err := aeadEncrypt(key, plainB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _ := json.Marshal(onionPacket{V: onionV2, EphemeralPub: base64.RawURLEncoding.EncodeToString(ephPub), Ciphertext: base64.RawURLEncoding.EncodeToString(ct)})
+	return out
+}
+
+// A layer whose TTL is used up gets 400 and goes nowhere, whether it's a
+// relay layer or a final one; a path longer than the TTL isn't built.
+func TestOnionTTLExpired(t *testing.T) {
+	s := newTestServer(t, "s", nil)
+	var forwarded atomic.Int64
+	next := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { forwarded.Add(1) }))
+	t.Cleanup(next.Close)
+	nextAddr := strings.TrimPrefix(next.URL, "http://")
+	env, _ := json.Marshal(FinalEnvelope{Type: loadgenMixType, MsgID: "m"})
+
+	for _, tc := range []struct {
+		name  string
+		ttl   int
+		final bool
+		want  int
+	}{
+		{"relay ttl 1", 1, false, http.StatusOK},
+		{"relay ttl 0", 0, false, http.StatusBadRequest},
+		{"relay ttl -1", -1, false, http.StatusBadRequest},
+		{"final ttl 0", 0, true, http.StatusBadRequest},
+	} {
+		var plain onionLayerPlain
+		plain.Meta.MsgID, plain.Meta.TTL, plain.Meta.Final, plain.Meta.Class = "m", tc.ttl, tc.final, classInteractive
+		if !tc.final {
+			plain.Next = nextAddr
+		}
+		before := forwarded.Load()
+		rr := relay(s, sealLayer(t, s, plain, env))
+		if rr.Code != tc.want {
+			t.Errorf("%s: HTTP %d %s, want %d", tc.name, rr.Code, rr.Body, tc.want)
+		}
+		if sent := forwarded.Load() - before; tc.want == http.StatusBadRequest && (sent != 0 || !strings.Contains(rr.Body.String(), "ttl expired")) {
+			t.Errorf("%s: forwarded %d times: %s", tc.name, sent, rr.Body)
+		}
+	}
+	if forwarded.Load() != 1 {
+		t.Fatalf("%d forwards, want the one live layer", forwarded.Load())
+	}
+
+	// a loop through s: every layer's TTL is one lower, so the path can't
+	// be longer than the TTL
+	hop := hopInfo{NodeID: s.id.NodeID, Addr: s.selfAddr, PubKey: s.nodeKeys.Pub[:], V: onionV2}
+	if _, err := buildOnion([]hopInfo{hop, hop, hop}, env, 2, "", "", classInteractive, 0); err == nil {
+		t.Fatal("built a 3-hop path with ttl 2")
+	}
+}
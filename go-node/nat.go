@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	libp2p "github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+const (
+	// Circuit relay v2 caps each relayed connection (128 KiB per direction by
+	// default); stay under it so a relay never cuts a transfer halfway.
+	relayByteBudget = 96 << 10
+	holePunchWait   = 10 * time.Second // how long a big send waits for DCUtR to go direct
+)
+
+// natOptions enables AutoNAT service, port mapping, the circuit relay v2
+// client and DCUtR hole punching when cfg.P2PNAT is set. Static relays are
+// used for reservations so NATed peers stay dialable through them.
+func natOptions(cfg *Config) ([]libp2p.Option, error) {
+	if !cfg.P2PNAT {
+		return nil, nil
+	}
+	opts := []libp2p.Option{
+		libp2p.EnableNATService(),
+		libp2p.NATPortMap(),
+		libp2p.EnableRelay(),
+		libp2p.EnableHolePunching(),
+	}
+	if len(cfg.Relays) > 0 {
+		relays := make([]peer.AddrInfo, 0, len(cfg.Relays))
+		for _, s := range cfg.Relays {
+			ai, err := peer.AddrInfoFromString(s)
+			if err != nil {
+				return nil, fmt.Errorf("relay %q: %w", s, err)
+			}
+			relays = append(relays, *ai)
+		}
+		opts = append(opts, libp2p.EnableAutoRelayWithStaticRelays(relays))
+	}
+	return opts, nil
+}
+
+// watchReachability tracks what AutoNAT concluded about our dialability.
+func (n *Node) watchReachability(ctx context.Context) {
+	sub, err := n.h.EventBus().Subscribe(new(event.EvtLocalReachabilityChanged))
+	if err != nil {
+		log.Printf("[nat] reachability subscribe: %v", err)
+		return
+	}
+	defer sub.Close()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev, ok := <-sub.Out():
+			if !ok {
+				return
+			}
+			r := ev.(event.EvtLocalReachabilityChanged).Reachability
+			n.natMu.Lock()
+			n.reach = r
+			n.natMu.Unlock()
+			log.Printf("[nat] reachability: %s", r)
+		}
+	}
+}
+
+func (n *Node) natStatus() string {
+	n.natMu.Lock()
+	defer n.natMu.Unlock()
+	return n.reach.String()
+}
+
+// relayAddrs lists our /p2p-circuit addresses (present once a relay
+// reservation is held), ready for the other side to dial.
+func (n *Node) relayAddrs() []string {
+	var out []string
+	for _, a := range n.h.Addrs() {
+		if s := a.String(); strings.Contains(s, "/p2p-circuit") {
+			out = append(out, fmt.Sprintf("%s/p2p/%s", s, n.peerID))
+		}
+	}
+	return out
+}
+
+// isRelayed reports whether every connection to p goes through a relay.
+func (n *Node) isRelayed(p peer.ID) bool {
+	conns := n.h.Network().ConnsToPeer(p)
+	for _, c := range conns {
+		if !c.Stat().Limited {
+			return false
+		}
+	}
+	return len(conns) > 0
+}
+
+func (n *Node) peerPath(p peer.ID) string {
+	if n.isRelayed(p) {
+		return "relayed"
+	}
+	return "direct"
+}
+
+// waitDirect gives hole punching a chance to replace a relayed connection.
+func (n *Node) waitDirect(ctx context.Context, p peer.ID) bool {
+	deadline := time.Now().Add(holePunchWait)
+	for n.isRelayed(p) {
+		if time.Now().After(deadline) {
+			return false
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+	return true
+}
+
+// openStream opens proto to p, allowing relayed (limited) connections.
+func (n *Node) openStream(ctx context.Context, p peer.ID, proto protocol.ID) (network.Stream, error) {
+	return n.h.NewStream(network.WithAllowLimitedConn(ctx, string(proto)), p, proto)
+}
@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"sort"
 	"strconv"
@@ -22,6 +23,8 @@ import (
 	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
 )
 
+func init() { registerFeature(featureLibp2p) }
+
 func envPort(key string, def int) int {
 	v := strings.TrimSpace(os.Getenv(key))
 	if v == "" {
@@ -60,6 +63,12 @@ type Node struct {
 
 	latMu sync.Mutex
 	rtts  map[peer.ID]time.Duration
+	rates map[peer.ID]float64 // smoothed transfer throughput, bytes/s
+
+	chunkMin, chunkMax int // chunk size bounds (chunk_size.go)
+
+	natMu sync.Mutex
+	reach network.Reachability
 
 	chatMu  sync.Mutex
 	chatLog []ChatMsg
@@ -67,6 +76,17 @@ type Node struct {
 	fileMu    sync.Mutex
 	manifests map[string]FileManifest
 	recvMap   map[string]map[int]bool
+
+	httpAddr string       // local HTTP API (Config.P2PHTTPAddr)
+	httpSrv  *http.Server // serving httpAddr once serveHTTP ran
+	storeDir string       // EnvPaths.StoreDir
+	tmpDir   string       // EnvPaths.TmpDir
+
+	orgKey []byte       // org_mac key (p2p_org.go)
+	legacy *legacyGuard // the Server's; untagged manifests are a legacy shim
+
+	catalog    *catalogStore    // the Server's file catalog, if any
+	quarantine *quarantineStore // received files wait here when set
 }
 
 type mdnsNotifeeImpl struct{ h host.Host }
@@ -75,9 +95,30 @@ func (m *mdnsNotifeeImpl) HandlePeerFound(info peer.AddrInfo) {
 	_ = m.h.Connect(context.Background(), info)
 }
 
-func newNode(ctx context.Context, _ []string, orgSalt []byte) (*Node, error) {
-	// fingerprint → ed25519 + NodeID
-	priv, pub, nodeID := deriveNodeKeyPair(orgSalt)
+// startP2PNode starts the libp2p node (file transfer, chat and its local
+// API on --p2p-http-addr) next to s, with --p2p. Its manifests and
+// assembled files feed s's catalog, received files wait in s's quarantine,
+// and its dials go through s's egress policy. It stops with ctx.
+func (s *Server) startP2PNode(ctx context.Context) error {
+	n, err := newNode(ctx, s)
+	if err != nil {
+		return err
+	}
+	s.p2p = n
+	n.serveHTTP()
+	log.Printf("[p2p] peer=%s node=%.8s api=%s", n.peerID, n.nodeID, n.httpAddr)
+	go func() {
+		<-ctx.Done()
+		n.close()
+	}()
+	return nil
+}
+
+func newNode(ctx context.Context, srv *Server) (*Node, error) {
+	cfg, paths := srv.cfg, srv.paths
+	// fingerprint → ed25519 + NodeID; the server's NodeID in the salt keeps
+	// nodes sharing a host (--instance) apart
+	priv, pub, nodeID := deriveNodeKeyPair([]byte(srv.secrets.OrgID+srv.id.NodeID), fingerprintHardware(paths))
 	libPriv, _, err := crypto.KeyPairFromStdKey(&priv)
 	if err != nil {
 		return nil, err
@@ -85,19 +126,29 @@ func newNode(ctx context.Context, _ []string, orgSalt []byte) (*Node, error) {
 
 	// Use libp2p defaults (include QUIC & WebRTC) + explicit listen addrs so we
 	// actually expose those UDP transports on predictable ports for dialers.
-	h, err := libp2p.New(
+	natOpts, err := natOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.EgressMode != "" && cfg.EgressMode != egressOpen {
+		natOpts = append(natOpts, libp2p.ConnectionGater(srv.egress.gater()))
+	}
+	h, err := libp2p.New(append([]libp2p.Option{
 		libp2p.Identity(libPriv),
 		libp2p.DefaultSecurity,
 		libp2p.DefaultMuxers,
 		libp2p.DefaultTransports, // includes TCP + QUIC + WebRTC (and others)
 		libp2p.ListenAddrStrings(buildListenAddrs()...),
-	)
+	}, natOpts...)...)
 	if err != nil {
 		return nil, err
 	}
 
-	// mDNS (new API signature)
-	_ = mdns.NewMdnsService(h, mdnsTag, &mdnsNotifeeImpl{h})
+	// mDNS (new API signature), on our network's tag (p2p_org.go)
+	_ = mdns.NewMdnsService(h, p2pMDNSTag(srv.secrets.BeaconKey), &mdnsNotifeeImpl{h})
+	if srv.legacy.on(legacyUntaggedOrg) {
+		_ = mdns.NewMdnsService(h, mdnsTag, &mdnsNotifeeImpl{h})
+	}
 
 	n := &Node{
 		h:         h,
@@ -106,9 +157,20 @@ func newNode(ctx context.Context, _ []string, orgSalt []byte) (*Node, error) {
 		peerID:    h.ID(),
 		nodeID:    nodeID,
 		rtts:      map[peer.ID]time.Duration{},
+		rates:     map[peer.ID]float64{},
 		manifests: map[string]FileManifest{},
 		recvMap:   map[string]map[int]bool{},
+		httpAddr:  cfg.P2PHTTPAddr,
+		storeDir:  paths.StoreDir,
+		tmpDir:    paths.TmpDir,
+		orgKey:    p2pOrgKey(srv.secrets.BeaconKey),
+		legacy:    srv.legacy,
+		catalog:   srv.catalog,
 	}
+	if cfg.Quarantine {
+		n.quarantine = srv.quarantine
+	}
+	n.chunkMin, n.chunkMax = chunkBounds(cfg.FileChunkMin, cfg.FileChunkMax)
 
 	// stream handlers (unchanged)
 	h.SetStreamHandler(protoChat, n.handleChatStream)
@@ -116,12 +178,21 @@ func newNode(ctx context.Context, _ []string, orgSalt []byte) (*Node, error) {
 
 	// ping loop (RTT for nearest)
 	go n.pingLoop(ctx)
+	go n.watchReachability(ctx)
 	return n, nil
 }
 
+// close stops the local API and the libp2p host.
+func (n *Node) close() {
+	if n.httpSrv != nil {
+		_ = n.httpSrv.Close()
+	}
+	_ = n.h.Close()
+}
+
 func (n *Node) pingLoop(ctx context.Context) {
 	p := ping.NewPingService(n.h)
-	for {
+	for ctx.Err() == nil {
 		for _, pid := range n.h.Network().Peers() {
 			ch := p.Ping(ctx, pid)
 			select {
@@ -134,7 +205,10 @@ func (n *Node) pingLoop(ctx context.Context) {
 			case <-time.After(2 * time.Second):
 			}
 		}
-		time.Sleep(3 * time.Second)
+		select {
+		case <-ctx.Done():
+		case <-time.After(3 * time.Second):
+		}
 	}
 }
 
@@ -185,7 +259,7 @@ func (n *Node) handleFileStream(s network.Stream) {
 		if err := dec.Decode(&probe); err != nil {
 			return
 		}
-		if _, ok := probe["fileName"]; ok {
+		if isManifest(probe) {
 			// manifest
 			b, _ := json.Marshal(probe)
 			var man FileManifest
@@ -193,12 +267,19 @@ func (n *Node) handleFileStream(s network.Stream) {
 			if !n.verifyManifest(man) {
 				continue
 			}
+			if err := checkChunking(man); err != nil {
+				log.Printf("[man] %s %s refused: %v", man.PeerID, man.FileName, err)
+				continue
+			}
 			n.fileMu.Lock()
 			n.manifests[man.ID] = man
 			if _, ok := n.recvMap[man.ID]; !ok {
 				n.recvMap[man.ID] = map[int]bool{}
 			}
 			n.fileMu.Unlock()
+			if n.quarantine == nil {
+				n.catalog.observeManifest(man, false)
+			}
 			log.Printf("[man] %s %s (%d bytes, %d chunks)", man.PeerID, man.FileName, man.Size, man.Chunks)
 		} else {
 			// chunk
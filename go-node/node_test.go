@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// p2pServer is a test server of the network holding beaconKey, running its
+// libp2p node on ports of its own.
+func p2pServer(t *testing.T, name string, beaconKey [32]byte) *Server {
+	t.Helper()
+	cfg := defaultConfig()
+	cfg.P2P = true
+	cfg.Quarantine = false
+	cfg.P2PHTTPAddr = "127.0.0.1:" + strconv.Itoa(freePort(t))
+	s := newTestServer(t, name, cfg)
+	s.secrets.BeaconKey = beaconKey
+	t.Setenv("MIXNET_QUIC_PORT", strconv.Itoa(freePort(t)))
+	t.Setenv("MIXNET_WRTC_PORT", strconv.Itoa(freePort(t)))
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	if err := s.startP2PNode(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// connectP2P connects a's libp2p node to b's over TCP only: the quic-go
+// this module pins panics in its handshake under current Go toolchains.
+func connectP2P(t *testing.T, a, b *Server) {
+	t.Helper()
+	var tcp []ma.Multiaddr
+	for _, addr := range b.p2p.h.Addrs() {
+		if _, err := addr.ValueForProtocol(ma.P_TCP); err == nil {
+			tcp = append(tcp, addr)
+		}
+	}
+	if err := a.p2p.h.Connect(context.Background(), peer.AddrInfo{ID: b.p2p.peerID, Addrs: tcp}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// catalogRow is s's /catalog row for the one file whose name has name in
+// it, zero if there isn't exactly one.
+func catalogRow(s *Server, name string) (e catalogEntry) {
+	rr := callControl(s, http.MethodGet, "/catalog?name_contains="+name, s.ctlToken, nil)
+	var page struct{ Files []catalogEntry }
+	_ = json.Unmarshal(rr.Body.Bytes(), &page)
+	if len(page.Files) == 1 {
+		e = page.Files[0]
+	}
+	return e
+}
+
+// A file sent over libp2p shows up in both nodes' /catalog.
+func TestP2PManifestsReachCatalog(t *testing.T) {
+	t.Setenv("GROUP_KEY_HEX", strings.Repeat("ab", 32))
+	key := [32]byte{1}
+	a, b := p2pServer(t, "a", key), p2pServer(t, "b", key)
+	connectP2P(t, a, b)
+	f := filepath.Join(t.TempDir(), "report.txt")
+	os.WriteFile(f, []byte("quarterly numbers"), 0o600)
+	man, err := a.p2p.broadcastFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	row := func(s *Server) catalogEntry { return catalogRow(s, "report") }
+	if e := row(a); len(e.Manifests) != 1 || e.PlainHash != man.PlainSHA256 {
+		t.Fatalf("sender: %+v", e)
+	}
+	eventually(t, "the receiver to assemble the file", func() bool { return row(b).Assembled })
+	if e := row(b); e.ID != row(a).ID || !e.Local {
+		t.Fatalf("receiver: %+v", e)
+	}
+}
+
+// Two networks in one process, Server and Node each, with different
+// BeaconKeys: neither takes the other's beacons, their libp2p nodes look
+// for different mDNS tags, and a file sent on one doesn't reach a node of
+// the other even over a direct connection, while a node of its own network
+// gets it.
+func TestNetworksIsolated(t *testing.T) {
+	t.Setenv("GROUP_KEY_HEX", strings.Repeat("ab", 32))
+	one, two := [32]byte{1}, [32]byte{2}
+	a, a2, b := p2pServer(t, "a", one), p2pServer(t, "a2", one), p2pServer(t, "b", two)
+
+	beacon := func(from *Server) []byte {
+		pkts, _, err := sealBeacons(Beacon{Type: "beacon", NodeID: from.id.NodeID, APIPort: 1, TS: time.Now().Unix(), Org: from.secrets.OrgID, API: apiVersion},
+			from.cfg.BeaconMode, from.secrets.BeaconKey[:], from.pairings)
+		if err != nil || len(pkts) != 1 {
+			t.Fatalf("beacon: %v", err)
+		}
+		return pkts[0]
+	}
+	hear := func(to, from *Server) string {
+		_, outcome := acceptBeacon(to.cfg, to.peers, &net.UDPAddr{IP: net.ParseIP("10.0.0.5"), Port: 5000}, beacon(from),
+			to.secrets.BeaconKey[:], to.pairings, to.org, to.clock, to.dups, nil)
+		return outcome
+	}
+	if got := hear(a2, a); got != beaconAccepted {
+		t.Fatalf("same network: %s", got)
+	}
+	if got := hear(b, a); got == beaconAccepted {
+		t.Fatal("b took a's beacon")
+	}
+	if got := hear(a, b); got == beaconAccepted {
+		t.Fatal("a took b's beacon")
+	}
+	if _, ok := b.peers.Get(a.id.NodeID); ok {
+		t.Fatal("b knows a")
+	}
+	if _, ok := a.peers.Get(b.id.NodeID); ok {
+		t.Fatal("a knows b")
+	}
+	if p2pMDNSTag(one) == p2pMDNSTag(two) {
+		t.Fatal("one mDNS tag for both networks")
+	}
+
+	connectP2P(t, a, a2)
+	connectP2P(t, a, b)
+	f := filepath.Join(t.TempDir(), "minutes.txt")
+	os.WriteFile(f, []byte("board minutes"), 0o600)
+	if _, err := a.p2p.broadcastFile(f); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "a2 to assemble the file", func() bool { return catalogRow(a2, "minutes").Assembled })
+	b.p2p.fileMu.Lock()
+	n := len(b.p2p.manifests)
+	b.p2p.fileMu.Unlock()
+	if e := catalogRow(b, "minutes"); n != 0 || e.ID != "" {
+		t.Fatalf("b took the file: %d manifests, %+v", n, e)
+	}
+
+	// a manifest of an earlier release carries no org_mac: taken only while
+	// legacy_untagged_org is on
+	untagged := FileManifest{ID: "m"}
+	if !b.p2p.fromOrg(untagged) {
+		t.Fatal("untagged manifest refused by default")
+	}
+	strict := defaultConfig()
+	strict.LegacyAccept = map[string]bool{}
+	b.p2p.legacy = newLegacyGuard(strict)
+	if b.p2p.fromOrg(untagged) {
+		t.Fatal("untagged manifest taken with the shim off")
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// NodeID inputs. The repo has two NodeID schemes: the HTTP node's hex
+// SHA-256 (64 characters, identity.go, or minted into identity.json) and
+// the libp2p node's unpadded base32 (52 characters, a-z and 2-7,
+// fingerprint.go). Both are lowercase, so that is the canonical form, and
+// PeerStore keys and lookups go through canonicalNodeID. Control
+// endpoints that take a NodeID (?to=, ?from=, ?node_id=, ?peer=, ?with=,
+// {peer}) also accept a prefix of at least minNodeIDPrefix characters, like
+// a git short hash, resolved against the PeerStore and this node. A malformed
+// value is a 400 naming the expected format. A prefix nobody matches is a
+// 404, and one that matches several nodes is a 409 listing them.
+
+const (
+	nodeIDHexLen    = 64
+	nodeIDBase32Len = 52
+	minNodeIDPrefix = 6
+)
+
+// NodeID is a NodeID in canonical form.
+type NodeID string
+
+const nodeIDFormat = "a 64-character hex NodeID, a 52-character base32 one (a-z, 2-7), or a unique prefix of either of at least 6 characters"
+
+func canonicalNodeID(s string) string { return strings.ToLower(strings.TrimSpace(s)) }
+
+func isHexID(s string) bool {
+	return strings.Trim(s, "0123456789abcdef") == ""
+}
+
+func isBase32ID(s string) bool {
+	return strings.Trim(s, "abcdefghijklmnopqrstuvwxyz234567") == ""
+}
+
+// parseNodeID accepts a full NodeID of either scheme.
+func parseNodeID(s string) (NodeID, error) {
+	id := canonicalNodeID(s)
+	switch {
+	case len(id) == nodeIDHexLen && isHexID(id):
+	case len(id) == nodeIDBase32Len && isBase32ID(id):
+	default:
+		return "", fmt.Errorf("bad NodeID %q: want a 64-character hex NodeID or a 52-character base32 one (a-z, 2-7)", s)
+	}
+	return NodeID(id), nil
+}
+
+// nodeIDError is why an input didn't resolve; Status is the HTTP answer.
+type nodeIDError struct {
+	Status     int
+	Input      string
+	Msg        string
+	Candidates []string
+}
+
+func (e *nodeIDError) Error() string { return e.Msg }
+
+// resolveNodeID turns a full NodeID or a unique prefix into a canonical
+// NodeID. A full one is returned whether or not the node is known.
+func (s *Server) resolveNodeID(in string) (NodeID, error) {
+	if id, err := parseNodeID(in); err == nil {
+		return id, nil
+	}
+	prefix := canonicalNodeID(in)
+	if len(prefix) < minNodeIDPrefix || len(prefix) > nodeIDHexLen || !(isHexID(prefix) || isBase32ID(prefix)) {
+		return "", &nodeIDError{Status: http.StatusBadRequest, Input: in, Msg: fmt.Sprintf("bad NodeID %q: want %s", in, nodeIDFormat)}
+	}
+	matches := s.peers.matchPrefix(prefix)
+	if strings.HasPrefix(s.id.NodeID, prefix) && !slices.Contains(matches, s.id.NodeID) {
+		matches = append(matches, s.id.NodeID)
+		sort.Strings(matches)
+	}
+	switch len(matches) {
+	case 0:
+		return "", &nodeIDError{Status: http.StatusNotFound, Input: in, Msg: fmt.Sprintf("no known node starts with %q", prefix)}
+	case 1:
+		return NodeID(matches[0]), nil
+	}
+	return "", &nodeIDError{Status: http.StatusConflict, Input: in, Msg: fmt.Sprintf("%q matches %d nodes; give more characters", prefix, len(matches)), Candidates: matches}
+}
+
+// nodeIDParam resolves the NodeID input named param, writing the error
+// itself. An empty value comes back as "" and ok.
+func (s *Server) nodeIDParam(w http.ResponseWriter, param, value string) (string, bool) {
+	if value == "" {
+		return "", true
+	}
+	id, err := s.resolveNodeID(value)
+	if err == nil {
+		return string(id), true
+	}
+	ne, _ := err.(*nodeIDError)
+	if ne == nil || ne.Status != http.StatusConflict {
+		status := http.StatusBadRequest
+		if ne != nil {
+			status = ne.Status
+		}
+		http.Error(w, param+": "+err.Error(), status)
+		return "", false
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"error":      "ambiguous NodeID prefix",
+		"param":      param,
+		"prefix":     canonicalNodeID(value),
+		"candidates": ne.Candidates,
+	})
+	return "", false
+}
+
+// matchPrefix returns the NodeIDs starting with prefix, sorted.
+func (ps *PeerStore) matchPrefix(prefix string) []string {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	var out []string
+	for id := range ps.peers {
+		if strings.HasPrefix(id, prefix) {
+			out = append(out, id)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const (
+	hexA = "abcdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789"
+	hexB = "abcdef01ffffffffffffffffffffffffffffffffffffffffffffffffffffffff"
+	b32C = "abcdefghijklmnopqrstuvwxyz234567abcdefghijklmnopqrst"
+)
+
+func TestParseNodeID(t *testing.T) {
+	for in, want := range map[string]string{
+		strings.ToUpper(hexA): hexA,
+		" " + b32C + "\n":     b32C,
+	} {
+		if got, err := parseNodeID(in); err != nil || string(got) != want {
+			t.Errorf("parseNodeID(%q) = %q, %v", in, got, err)
+		}
+	}
+	for _, in := range []string{"", hexA[:63], hexA + "0", "g" + hexA[1:], b32C[:51] + "8", b32C[:51] + "1"} {
+		if _, err := parseNodeID(in); err == nil {
+			t.Errorf("parseNodeID(%q) accepted", in)
+		}
+	}
+}
+
+func TestResolveNodeID(t *testing.T) {
+	s := newTestServer(t, "s", nil)
+	for _, id := range []string{hexA, strings.ToUpper(hexB), b32C} {
+		s.peers.Upsert(PeerInfo{NodeID: id, Addr: "127.0.0.1:1"})
+	}
+	status := func(err error) int {
+		if ne, ok := err.(*nodeIDError); ok {
+			return ne.Status
+		}
+		return 0
+	}
+	for _, tc := range []struct {
+		in, want string
+		status   int
+	}{
+		{hexA, hexA, 0},
+		{"ABCDEF0123", hexA, 0},
+		{"abcdef01f", hexB, 0},
+		{b32C[:12], b32C, 0},
+		{s.id.NodeID[:12], s.id.NodeID, 0},
+		{strings.Repeat("7", 64), strings.Repeat("7", 64), 0}, // full and unknown
+		{"abcde", "", http.StatusBadRequest},                  // too short
+		{"abc-def", "", http.StatusBadRequest},
+		{"0000000000", "", http.StatusNotFound},
+		{"abcdef01", "", http.StatusConflict}, // hexA and hexB
+		{"abcdef", "", http.StatusConflict},   // all three
+	} {
+		got, err := s.resolveNodeID(tc.in)
+		if string(got) != tc.want || status(err) != tc.status {
+			t.Errorf("resolveNodeID(%q) = %q, %v; want %q, %d", tc.in, got, err, tc.want, tc.status)
+		}
+	}
+	_, err := s.resolveNodeID("ABCDEF")
+	if ne, _ := err.(*nodeIDError); ne == nil || !slices.Equal(ne.Candidates, []string{hexA, hexB, b32C}) {
+		t.Fatalf("candidates: %v", err)
+	}
+}
+
+// An ambiguous prefix on an endpoint is a 409 listing the candidates, in
+// canonical form, and nothing is sent.
+func TestNodeIDAmbiguousPrefix(t *testing.T) {
+	s := newTestServer(t, "s", nil)
+	s.peers.Upsert(PeerInfo{NodeID: hexA, Addr: "127.0.0.1:1"})
+	s.peers.Upsert(PeerInfo{NodeID: strings.ToUpper(hexB), Addr: "127.0.0.1:2"})
+
+	for _, path := range []string{"/mix/send-text?to=ABCDEF01", "/peers/fetch?pem=k.pem&from=abcdef01"} {
+		rr := callControl(s, http.MethodPost, path, s.ctlToken, strings.NewReader("hi"))
+		if rr.Code != http.StatusConflict || rr.Header().Get("Content-Type") != "application/json" {
+			t.Fatalf("%s: %d %s", path, rr.Code, rr.Body)
+		}
+		var body struct {
+			Error      string   `json:"error"`
+			Param      string   `json:"param"`
+			Prefix     string   `json:"prefix"`
+			Candidates []string `json:"candidates"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Error != "ambiguous NodeID prefix" || body.Prefix != "abcdef01" || !slices.Equal(body.Candidates, []string{hexA, hexB}) {
+			t.Fatalf("%s: %+v", path, body)
+		}
+	}
+	if n := len(s.outbox.list()); n != 0 {
+		t.Fatalf("%d messages queued", n)
+	}
+
+	rr := callControl(s, http.MethodPost, "/mix/send-text?to=abcde", s.ctlToken, strings.NewReader("hi"))
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "to: bad NodeID") {
+		t.Fatalf("short prefix: %d %s", rr.Code, rr.Body)
+	}
+	rr = callControl(s, http.MethodPost, "/mix/send-text?to=0000000000", s.ctlToken, strings.NewReader("hi"))
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("unknown prefix: %d %s", rr.Code, rr.Body)
+	}
+}
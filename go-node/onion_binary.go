@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Binary onion layers. A JSON layer carries its ciphertext in base64 inside
+// a packet that is itself base64 in the layer around it, so every hop adds
+// about 1.8x and each relay decodes and copies the whole packet several
+// times over. A hop that advertises capOnionBin takes the binary form
+// instead, POSTed as onionBinType:
+//
+//	packet: version (1 byte, the layer's key version) | ephemeral pub (32)
+//	        | nonce (24) | ciphertext
+//	layer:  header length (4, big endian) | header JSON (next, meta, len)
+//	        | payload (len bytes, the next packet raw)
+//
+// A relay doesn't know which form the next hop takes, so the sender says in
+// meta.bin. A packet goes binary only when its hop and the hop forwarding
+// it both advertise the capability (the sender for the first hop), so an
+// older relay never has to pass one on. Other paths stay JSON end to end.
+// A binary layer decrypts in place in the request buffer, and its payload
+// is a slice of it.
+
+const (
+	capOnionBin  = "onion-bin" // beacon capability: takes binary layers
+	onionBinType = "application/x-mixnet-onion"
+
+	binPacketHead   = 1 + 32 + chacha20poly1305.NonceSizeX
+	binLayerHeadMax = 16 << 10
+)
+
+var errBinLayer = errors.New("bad binary layer")
+
+// onionForm is the content type an onion packet is POSTed with.
+type onionForm string
+
+const (
+	formJSON onionForm = ""
+	formBin  onionForm = onionBinType
+	formCell onionForm = onionCellType // onion_cell.go
+)
+
+// onionHeader is the header of a POST carrying a packet in form; nil keeps
+// the default JSON type.
+func onionHeader(form onionForm) http.Header {
+	if form == formJSON {
+		return nil
+	}
+	return http.Header{"Content-Type": {string(form)}}
+}
+
+// onionFormOf is the form of the packet r carries.
+func onionFormOf(r *http.Request) onionForm {
+	mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mt == onionBinType || mt == onionCellType {
+		return onionForm(mt)
+	}
+	return formJSON
+}
+
+// firstForm is the form of the packet buildOnion makes for hops.
+func firstForm(hops []hopInfo, padCell int) onionForm {
+	switch {
+	case cellPath(hops, padCell):
+		return formCell
+	case hops[0].Bin:
+		return formBin
+	}
+	return formJSON
+}
+
+// nextForm is the form a relay that got a form packet forwards plain's
+// payload in.
+func nextForm(form onionForm, plain *onionLayerPlain) onionForm {
+	switch {
+	case form == formCell:
+		return formCell
+	case plain.Meta.Bin:
+		return formBin
+	}
+	return formJSON
+}
+
+// binLayer frames plain and payload as a binary layer plaintext, zero
+// padded up to its bucket (padTarget) when cell > 0.
+func binLayer(plain onionLayerPlain, payload []byte, cell int) []byte {
+	plain.Payload, plain.Pad, plain.Len = "", "", int64(len(payload))
+	hdr, _ := json.Marshal(plain)
+	n := 4 + len(hdr) + len(payload)
+	size := n
+	if cell > 0 {
+		size = padTarget(n, cell)
+	}
+	b := make([]byte, size, size+chacha20poly1305.Overhead)
+	binary.BigEndian.PutUint32(b, uint32(len(hdr)))
+	copy(b[4:], hdr)
+	copy(b[4+len(hdr):], payload)
+	return b
+}
+
+// parseBinLayer splits a binary layer plaintext; payload aliases b.
+func parseBinLayer(b []byte) (plain onionLayerPlain, payload []byte, err error) {
+	if len(b) < 4 {
+		return plain, nil, errBinLayer
+	}
+	n := int(binary.BigEndian.Uint32(b))
+	if n > binLayerHeadMax || n > len(b)-4 {
+		return plain, nil, errBinLayer
+	}
+	if err := json.Unmarshal(b[4:4+n], &plain); err != nil {
+		return plain, nil, errBinLayer
+	}
+	rest := b[4+n:]
+	if plain.Len < 0 || plain.Len > int64(len(rest)) {
+		return plain, nil, errBinLayer
+	}
+	return plain, rest[:plain.Len], nil
+}
+
+// readBinLayer is parseBinLayer for a streamed layer: the payload goes to
+// payload and any padding is skipped.
+func readBinLayer(r io.Reader, payload io.Writer) (onionLayerPlain, error) {
+	var plain onionLayerPlain
+	var h [4]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return plain, errBinLayer
+	}
+	n := binary.BigEndian.Uint32(h[:])
+	if n > binLayerHeadMax {
+		return plain, errBinLayer
+	}
+	hdr := make([]byte, n)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return plain, errBinLayer
+	}
+	if err := json.Unmarshal(hdr, &plain); err != nil || plain.Len < 0 {
+		return plain, errBinLayer
+	}
+	if _, err := io.CopyN(payload, r, plain.Len); err != nil {
+		return plain, errBinLayer
+	}
+	_, err := io.Copy(io.Discard, r)
+	return plain, err
+}
+
+// sealBinPacket seals a layer plaintext into a binary packet.
+func sealBinPacket(v int, ephPub, key, plain []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := secureRandom(chacha20poly1305.NonceSizeX)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, binPacketHead+len(plain)+chacha20poly1305.Overhead)
+	out = append(append(append(out, byte(v)), ephPub...), nonce...)
+	return aead.Seal(out, nonce, plain, nil), nil
+}
+
+// splitBinPacket returns a binary packet's key version, ephemeral pub and
+// nonce+ciphertext, all aliasing b.
+func splitBinPacket(b []byte) (v int, ephPub, nonceCT []byte, err error) {
+	if len(b) < binPacketHead+chacha20poly1305.Overhead {
+		return 0, nil, nil, errors.New("short binary packet")
+	}
+	return int(b[0]), b[1:33], b[33:], nil
+}
+
+// openInPlace is aeadDecrypt writing the plaintext over the ciphertext.
+func openInPlace(key, nonceCT []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce, ct := nonceCT[:chacha20poly1305.NonceSizeX], nonceCT[chacha20poly1305.NonceSizeX:]
+	return aead.Open(ct[:0], nonce, ct, nil)
+}
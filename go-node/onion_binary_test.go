@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+func hopOf(s *Server, bin bool) hopInfo {
+	return hopInfo{NodeID: s.id.NodeID, Addr: s.selfAddr, PubKey: s.nodeKeys.Pub[:], V: onionV2, Bin: bin}
+}
+
+// peelForm opens packet with nk in form and returns the layer and what it
+// carries.
+func peelForm(t *testing.T, nk *NodeKeypair, form onionForm, packet []byte) (onionLayerPlain, []byte) {
+	t.Helper()
+	var v int
+	var epub, ct []byte
+	if form == formBin {
+		var err error
+		if v, epub, ct, err = splitBinPacket(bytes.Clone(packet)); err != nil {
+			t.Fatal(err)
+		}
+	} else {
+		var op onionPacket
+		if err := json.Unmarshal(packet, &op); err != nil {
+			t.Fatalf("not a JSON packet: %v", err)
+		}
+		v = op.V
+		epub, _ = base64.RawURLEncoding.DecodeString(op.EphemeralPub)
+		ct, _ = base64.RawURLEncoding.DecodeString(op.Ciphertext)
+	}
+	shared, _ := curve25519.X25519(nk.Priv[:], epub)
+	key, err := layerKey(v, shared, epub, nk.Pub[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	pt, err := aeadDecrypt(key, ct)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if form == formBin {
+		plain, inner, err := parseBinLayer(pt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return plain, inner
+	}
+	var plain onionLayerPlain
+	if err := json.Unmarshal(pt, &plain); err != nil {
+		t.Fatal(err)
+	}
+	inner, _ := base64.RawURLEncoding.DecodeString(plain.Payload)
+	return plain, inner
+}
+
+// Each hop gets its layer in the form the sender picked for it: binary only
+// when it and the hop before it take binary. Every switch between the two
+// forms peels to the same payload.
+func TestOnionFormsRoundTrip(t *testing.T) {
+	payload := make([]byte, 3000)
+	rand.Read(payload)
+	for _, bins := range [][]bool{
+		{false, false, false, false},
+		{true, true, true, true},
+		{true, false, true, true},  // binary, JSON, JSON, binary
+		{false, true, true, false}, // JSON, JSON, binary, JSON
+	} {
+		hops, keys := cellHops(t, len(bins))
+		for i := range hops {
+			hops[i].Bin, hops[i].Cell = bins[i], false
+		}
+		packet, err := buildOnion(hops, payload, mixTTL, "m", "", classBulk, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		form := firstForm(hops, 0)
+		for i, nk := range keys {
+			if want := binHop(hops, i); (form == formBin) != want {
+				t.Fatalf("%v: hop %d gets %q", bins, i, form)
+			}
+			plain, inner := peelForm(t, nk, form, packet)
+			form, packet = nextForm(form, &plain), inner
+		}
+		if !bytes.Equal(packet, payload) {
+			t.Fatalf("%v: payload differs", bins)
+		}
+	}
+}
+
+// A padded class off a cell path pads every layer, JSON and binary: texts
+// of 100 and 1,500 bytes give packets of one size at every hop.
+func TestOnionPaddedOffCellPath(t *testing.T) {
+	for _, bins := range [][]bool{{false, false, false}, {true, true, true}, {true, false, true}} {
+		hops, keys := cellHops(t, len(bins))
+		for i := range hops {
+			hops[i].Bin, hops[i].Cell = bins[i], false
+		}
+		sizes := func(textLen, padCell int) []int {
+			payload := bytes.Repeat([]byte("x"), textLen)
+			packet, err := buildOnion(hops, payload, mixTTL, "m", "", classInteractive, padCell)
+			if err != nil {
+				t.Fatal(err)
+			}
+			form := firstForm(hops, padCell)
+			if form == formCell {
+				t.Fatal("a cell path")
+			}
+			var out []int
+			for _, nk := range keys {
+				out = append(out, len(packet))
+				plain, inner := peelForm(t, nk, form, packet)
+				form, packet = nextForm(form, &plain), inner
+			}
+			if !bytes.Equal(packet, payload) {
+				t.Fatalf("%v: payload differs", bins)
+			}
+			return out
+		}
+		if short, long := sizes(100, 1<<10), sizes(1500, 1<<10); !slices.Equal(short, long) {
+			t.Fatalf("%v: padded sizes %v and %v", bins, short, long)
+		}
+		if sizes(100, 0)[0] == sizes(1500, 0)[0] {
+			t.Fatalf("%v: unpadded sizes match", bins)
+		}
+	}
+}
+
+// Real relays with and without onion-bin pass a text along a path that
+// switches forms, and cells aren't used unless every hop takes them.
+func TestOnionMixedCapabilityPath(t *testing.T) {
+	a, b, c, d := newTestServer(t, "a", nil), newTestServer(t, "b", nil), newTestServer(t, "c", nil), newTestServer(t, "d", nil)
+	for i, bins := range [][]bool{{true, false, true}, {false, true, true}, {true, true, false}} {
+		hops := []hopInfo{hopOf(b, bins[0]), hopOf(c, bins[1]), hopOf(d, bins[2])}
+		hops[0].Cell = true // the rest don't take cells
+		env := FinalEnvelope{Type: "text", SenderID: a.id.NodeID, ReceiverID: d.id.NodeID, MsgID: "mixed-" + string(rune('0'+i))}
+		if err := sealText(&env, d.nodeKeys.Pub[:], []byte("across forms")); err != nil {
+			t.Fatal(err)
+		}
+		envB, _ := json.Marshal(env)
+		packet, err := buildOnion(hops, envB, mixTTL, env.MsgID, "", classInteractive, 1<<10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		form := firstForm(hops, 1<<10)
+		if form == formCell {
+			t.Fatal("cells on a path that doesn't take them")
+		}
+		resp, _, err := a.postToAddr(b.selfAddr, "/mix/relay", packet, onionHeader(form))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%v: HTTP %d %s", bins, resp.StatusCode, body)
+		}
+		if got := inboxText(t, d, env.MsgID); got != "across forms" {
+			t.Fatalf("%v: got %q", bins, got)
+		}
+	}
+}
+
+// BenchmarkOnion4Hop1MiB builds a 4-hop onion around 1 MiB in each form and
+// has the first relay peel and forward it. wire-bytes is the first-hop
+// packet; the allocations are the relay's.
+func BenchmarkOnion4Hop1MiB(b *testing.B) {
+	payload := make([]byte, 1<<20)
+	rand.Read(payload)
+	for _, f := range []struct {
+		name      string
+		bin, cell bool
+		pad       int
+	}{
+		{"json", false, false, 0},
+		{"binary", true, false, 0},
+		{"cell", true, true, 1 << 10},
+	} {
+		b.Run(f.name, func(b *testing.B) {
+			cfg := defaultConfig()
+			cfg.MixClasses["bench"] = mixClass{Hops: 4} // no relay delay
+			cfg.RelayReplayWindow, cfg.RelaySpillBytes, cfg.RelayMaxBytes = 0, 0, 0
+			relay := newTestServer(b, "relay", cfg)
+			next := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.Copy(io.Discard, r.Body) }))
+			b.Cleanup(next.Close)
+
+			hops := make([]hopInfo, 4)
+			for i := range hops {
+				nk, _ := newNodeKeypair()
+				hops[i] = hopInfo{NodeID: string(rune('a' + i)), Addr: next.Listener.Addr().String(), PubKey: nk.Pub[:], V: onionV2, Bin: f.bin, Cell: f.cell}
+			}
+			hops[0].PubKey = relay.nodeKeys.Pub[:]
+			packet, err := buildOnion(hops, payload, mixTTL, "m", "", "bench", f.pad)
+			if err != nil {
+				b.Fatal(err)
+			}
+			form := firstForm(hops, f.pad)
+			handler := relayHandler(relay.nodeKeys, relay)
+			b.ReportAllocs()
+			for b.Loop() {
+				req := httptest.NewRequest(http.MethodPost, "/v1/mix/relay", bytes.NewReader(packet))
+				if h := onionHeader(form); h != nil {
+					req.Header = h
+				}
+				rr := httptest.NewRecorder()
+				handler(rr, req)
+				if rr.Code != http.StatusOK {
+					b.Fatalf("HTTP %d %s", rr.Code, rr.Body)
+				}
+			}
+			b.ReportMetric(float64(len(packet)), "wire-bytes")
+		})
+	}
+}
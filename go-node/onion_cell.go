@@ -0,0 +1,268 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/poly1305"
+)
+
+// Fixed-size onion cells. Padding each layer up to a bucket hid the payload
+// size but not the path: a layer wraps the next, so each hop's packet was
+// larger than the next one's, and a relay could tell from the size alone
+// how far it was from either end. When the class pads and every hop
+// advertises capOnionCell, the sender builds cells instead, POSTed as
+// onionCellType, and every hop of the path receives the same number of
+// bytes:
+//
+//	cell:  version (1) | ephemeral pub (32) | nonce (24) | tag (16)
+//	       | ciphertext
+//	layer: header length (4) | header JSON (next, meta, len), zero padded
+//	       to cellHeadSize | body
+//
+// The ciphertext is XChaCha20-Poly1305 with the tag moved in front of it. A
+// relay's body is the next cell less its last cellShift bytes; the relay
+// appends cellShift bytes of filler drawn from its layer key, which brings
+// the next cell back to full size. The sender holds every layer key, so it
+// works out the filler each relay will append and seals each layer so that
+// the filled-in tail authenticates. The final hop's body is the envelope
+// (len bytes: the length prefix), then random bytes. The cell size is
+// picked once, from the envelope plus cellShift for each of the ttl hops a
+// path may have, and rounded up by padTarget, so it tells only which bucket
+// the envelope fell in.
+
+const (
+	capOnionCell  = "onion-cell" // beacon capability: takes and relays cells
+	onionCellType = "application/x-mixnet-cell"
+
+	cellPacketHead = 1 + 32 + chacha20poly1305.NonceSizeX + poly1305.TagSize
+	cellHeadSize   = 384
+	cellShift      = cellPacketHead + cellHeadSize // bytes a relay strips and refills
+
+	cellFillerInfo = "mixnet-cell-filler"
+)
+
+var errCellLayer = errors.New("bad cell layer")
+
+// cellPath reports whether an onion over hops is sent as cells: the class
+// pads, and every hop takes cells and v2 layers.
+func cellPath(hops []hopInfo, padCell int) bool {
+	if padCell <= 0 {
+		return false
+	}
+	for _, h := range hops {
+		if !h.Cell || h.V != onionV2 {
+			return false
+		}
+	}
+	return true
+}
+
+// cellSize is the size of every cell of an onion carrying n payload bytes
+// over a path of up to ttl hops.
+func cellSize(n, ttl, padCell int) int {
+	return padTarget(cellPacketHead+cellHeadSize+n+(ttl-1)*cellShift, padCell)
+}
+
+// buildCellOnion is buildOnion for a cell path; layer returns hop i's
+// header.
+func buildCellOnion(hops []hopInfo, layer func(i int) onionLayerPlain, payload []byte, ttl, padCell int) ([]byte, error) {
+	body := cellSize(len(payload), ttl, padCell) - cellPacketHead
+	keys := make([][]byte, len(hops))
+	ephs := make([][]byte, len(hops))
+	nonces := make([][]byte, len(hops))
+	for i, h := range hops {
+		stop := hOnionLayer.time()
+		eph := make([]byte, 32)
+		if _, err := rand.Read(eph); err != nil {
+			return nil, err
+		}
+		ephs[i], _ = curve25519.X25519(eph, curve25519.Basepoint)
+		shared, err := curve25519.X25519(eph, h.PubKey)
+		if err == nil {
+			keys[i], err = layerKey(h.V, shared, ephs[i], h.PubKey)
+		}
+		stop()
+		if err != nil {
+			return nil, err
+		}
+		if nonces[i], err = secureRandom(chacha20poly1305.NonceSizeX); err != nil {
+			return nil, err
+		}
+	}
+
+	// tails[i] is how hop i's cell ends: what the relays before it appended,
+	// as the relays after them decrypted it
+	tails := make([][]byte, len(hops))
+	for i := range len(hops) - 1 {
+		t := cellKeystream(keys[i], nonces[i], body-len(tails[i]), len(tails[i]))
+		subtle.XORBytes(t, t, tails[i])
+		tails[i+1] = append(t, cellFiller(keys[i])...)
+	}
+
+	var next []byte
+	for i := len(hops) - 1; i >= 0; i-- {
+		plain := make([]byte, body, body+chacha20poly1305.Overhead)
+		l := layer(i)
+		final := i == len(hops)-1
+		if final {
+			l.Len = int64(len(payload))
+		}
+		if err := putCellHead(plain, l); err != nil {
+			return nil, err
+		}
+		if final {
+			end, tail := cellHeadSize+len(payload), body-len(tails[i])
+			if end > tail {
+				return nil, errors.New("payload does not fit the cell")
+			}
+			copy(plain[cellHeadSize:], payload)
+			if _, err := rand.Read(plain[end:tail]); err != nil {
+				return nil, err
+			}
+			// sealed, this part turns into the relays' filler
+			ks := cellKeystream(keys[i], nonces[i], tail, len(tails[i]))
+			subtle.XORBytes(plain[tail:], ks, tails[i])
+		} else {
+			copy(plain[cellHeadSize:], next) // all but its last cellShift bytes
+		}
+		aead, err := chacha20poly1305.NewX(keys[i])
+		if err != nil {
+			return nil, err
+		}
+		sealed := aead.Seal(plain[:0], nonces[i], plain, nil)
+		ct, tag := sealed[:body], sealed[body:]
+		cell := make([]byte, 0, cellPacketHead+body)
+		cell = append(append(append(append(cell, byte(wireOnionVersion(hops[i].V))), ephs[i]...), nonces[i]...), tag...)
+		next = append(cell, ct...)
+	}
+	return next, nil
+}
+
+// cellKeystream is n bytes of the XChaCha20-Poly1305 keystream for key and
+// nonce, from byte off of the ciphertext.
+func cellKeystream(key, nonce []byte, off, n int) []byte {
+	c, err := chacha20.NewUnauthenticatedCipher(key, nonce)
+	if err != nil {
+		panic(err) // key and nonce sizes are fixed
+	}
+	c.SetCounter(1 + uint32(off/64)) // block 0 is the Poly1305 key
+	ks := make([]byte, off%64+n)
+	c.XORKeyStream(ks, ks)
+	return ks[off%64:]
+}
+
+// cellFiller is what the relay holding layer key appends to the next cell.
+func cellFiller(key []byte) []byte {
+	k := sha256.Sum256(append([]byte(cellFillerInfo), key...))
+	c, err := chacha20.NewUnauthenticatedCipher(k[:], make([]byte, chacha20.NonceSize))
+	if err != nil {
+		panic(err)
+	}
+	f := make([]byte, cellShift)
+	c.XORKeyStream(f, f)
+	return f
+}
+
+func putCellHead(b []byte, plain onionLayerPlain) error {
+	plain.Payload = ""
+	hdr, _ := json.Marshal(plain)
+	if 4+len(hdr) > cellHeadSize {
+		return errors.New("cell header too long")
+	}
+	binary.BigEndian.PutUint32(b, uint32(len(hdr)))
+	copy(b[4:], hdr)
+	return nil
+}
+
+func parseCellHead(b []byte) (plain onionLayerPlain, err error) {
+	if len(b) < cellHeadSize {
+		return plain, errCellLayer
+	}
+	n := int(binary.BigEndian.Uint32(b))
+	if n > cellHeadSize-4 || json.Unmarshal(b[4:4+n], &plain) != nil || plain.Len < 0 {
+		return plain, errCellLayer
+	}
+	return plain, nil
+}
+
+// splitCell returns a cell's key version, ephemeral pub, nonce, tag and
+// ciphertext, all aliasing b.
+func splitCell(b []byte) (v int, ephPub, nonce, tag, ct []byte, err error) {
+	if len(b) < cellPacketHead+cellHeadSize {
+		return 0, nil, nil, nil, nil, errors.New("short cell")
+	}
+	return int(b[0]), b[1:33], b[33:57], b[57:cellPacketHead], b[cellPacketHead:], nil
+}
+
+// openCell authenticates ct against tag and decrypts it in place.
+func openCell(key, nonce, tag, ct []byte) ([]byte, error) {
+	c, err := chacha20.NewUnauthenticatedCipher(key, nonce)
+	if err != nil {
+		return nil, err
+	}
+	var polyKey [32]byte
+	c.XORKeyStream(polyKey[:], polyKey[:])
+	mac := poly1305.New(&polyKey)
+	mac.Write(ct)
+	var trailer [16 + 16]byte
+	mac.Write(trailer[:(16-len(ct)%16)%16])
+	binary.LittleEndian.PutUint64(trailer[24:], uint64(len(ct)))
+	mac.Write(trailer[16:])
+	if !mac.Verify(tag) {
+		return nil, errors.New("chacha20poly1305: message authentication failed")
+	}
+	c.SetCounter(1)
+	c.XORKeyStream(ct, ct)
+	return ct, nil
+}
+
+// peelCell splits an opened layer into its header and what it carries: the
+// envelope at the final hop, else the next cell, filled back to full size.
+func peelCell(key, plainB []byte) (onionLayerPlain, []byte, error) {
+	plain, err := parseCellHead(plainB)
+	if err != nil {
+		return plain, nil, err
+	}
+	body := plainB[cellHeadSize:]
+	if plain.Next == "" || plain.Meta.Final {
+		if plain.Len > int64(len(body)) {
+			return plain, nil, errCellLayer
+		}
+		return plain, body[:plain.Len], nil
+	}
+	return plain, append(body, cellFiller(key)...), nil
+}
+
+// readCellLayer is peelCell for a streamed layer, writing what it carries
+// to out.
+func readCellLayer(r io.Reader, key []byte, out io.Writer) (onionLayerPlain, error) {
+	head := make([]byte, cellHeadSize)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return onionLayerPlain{}, errCellLayer
+	}
+	plain, err := parseCellHead(head)
+	if err != nil {
+		return plain, err
+	}
+	if plain.Next == "" || plain.Meta.Final {
+		if _, err := io.CopyN(out, r, plain.Len); err != nil {
+			return plain, errCellLayer
+		}
+		_, err = io.Copy(io.Discard, r)
+		return plain, err
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		return plain, err
+	}
+	_, err = out.Write(cellFiller(key))
+	return plain, err
+}
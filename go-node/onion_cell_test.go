@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// relayCell peels cell with nk as a relay does and returns the layer and
+// what it carries.
+func relayCell(t *testing.T, nk *NodeKeypair, cell []byte) (onionLayerPlain, []byte) {
+	t.Helper()
+	cell = bytes.Clone(cell)
+	v, epub, nonce, tag, ct, err := splitCell(cell)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared, _ := curve25519.X25519(nk.Priv[:], epub)
+	key, err := layerKey(v, shared, epub, nk.Pub[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	plainB, err := openCell(key, nonce, tag, ct)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	plain, inner, err := peelCell(key, plainB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return plain, inner
+}
+
+func cellHops(t *testing.T, n int) ([]hopInfo, []*NodeKeypair) {
+	hops := make([]hopInfo, n)
+	keys := make([]*NodeKeypair, n)
+	for i := range hops {
+		nk, err := newNodeKeypair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[i] = nk
+		hops[i] = hopInfo{NodeID: strings.Repeat(string(rune('a'+i)), 64), Addr: "10.0.0.1:900" + string(rune('0'+i)), PubKey: nk.Pub[:], V: onionV2, Cell: true}
+	}
+	return hops, keys
+}
+
+// Texts of 100 and 1,500 bytes over 1 to mixTTL hops all give first-hop
+// packets of one size, and every relay on the path gets and forwards that
+// same size, down to the final hop, which finds the envelope intact.
+func TestCellSizeInvariant(t *testing.T) {
+	class, _ := defaultConfig().mixClassFor(classInteractive)
+	size := 0
+	for _, textLen := range []int{100, 1500} {
+		for n := 1; n <= mixTTL; n++ {
+			hops, keys := cellHops(t, n)
+			env := FinalEnvelope{Type: "text", SenderID: hexA, ReceiverID: hops[n-1].NodeID, MsgID: "m", Logical: 12345, SentUnix: 1700000000}
+			if err := sealText(&env, hops[n-1].PubKey, bytes.Repeat([]byte("x"), textLen)); err != nil {
+				t.Fatal(err)
+			}
+			envB, _ := json.Marshal(env)
+			if !cellPath(hops, class.PadCell) {
+				t.Fatal("not a cell path")
+			}
+			cell, err := buildOnion(hops, envB, mixTTL, "m", "", classInteractive, class.PadCell)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if size == 0 {
+				size = len(cell)
+			}
+			for i, nk := range keys {
+				if len(cell) != size {
+					t.Fatalf("%d-byte text, %d hops: hop %d gets %d bytes, want %d", textLen, n, i, len(cell), size)
+				}
+				plain, inner := relayCell(t, nk, cell)
+				if final := i == n-1; plain.Meta.Final != final || plain.Meta.TTL != mixTTL-i {
+					t.Fatalf("%d hops: hop %d: %+v", n, i, plain.Meta)
+				}
+				cell = inner
+			}
+			if !bytes.Equal(cell, envB) {
+				t.Fatalf("%d hops: final envelope differs", n)
+			}
+		}
+	}
+	if size != onionPadBuckets[0] {
+		t.Fatalf("cells of %d bytes, want the first bucket", size)
+	}
+}
+
+// A bit flipped anywhere in a cell, the relays' filler included, fails the
+// hop that opens it.
+func TestCellTampered(t *testing.T) {
+	hops, keys := cellHops(t, 3)
+	cell, err := buildOnion(hops, []byte(`{"type":"loadgen"}`), mixTTL, "m", "", classBulk, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, second := relayCell(t, keys[0], cell)
+	for _, at := range []int{0, cellPacketHead, len(second) - 1} {
+		bad := bytes.Clone(second)
+		bad[at] ^= 1
+		v, epub, nonce, tag, ct, _ := splitCell(bad)
+		shared, _ := curve25519.X25519(keys[1].Priv[:], epub)
+		key, err := layerKey(v, shared, epub, keys[1].Pub[:])
+		if err == nil {
+			_, err = openCell(key, nonce, tag, ct)
+		}
+		if err == nil {
+			t.Fatalf("byte %d flipped: opened", at)
+		}
+	}
+}
+
+// Servers that take cells relay them, in memory and through the spill
+// files, and a relay without onion-cell puts the path back on the old
+// forms.
+func TestCellPathDelivery(t *testing.T) {
+	spill := defaultConfig()
+	spill.RelaySpillBytes = 1 << 10
+	a, b, c := newTestServer(t, "a", nil), newTestServer(t, "b", spill), newTestServer(t, "c", nil)
+	mesh(t, a, b, c)
+	class, _ := a.cfg.mixClassFor(classInteractive)
+	hops, _, err := a.mixPath(pathFurthest, c.id.NodeID, 2)
+	if err != nil || firstForm(hops, class.PadCell) != formCell {
+		t.Fatalf("hops %+v %v: not a cell path", hops, err)
+	}
+	resp := sendText(t, a, c, "hops=2", "in cells")
+	if got := inboxText(t, c, resp.MsgID); got != "in cells" {
+		t.Fatalf("got %q", got)
+	}
+
+	dropCap(a, b, capOnionCell)
+	hops, _, _ = a.mixPath(pathFurthest, c.id.NodeID, 2)
+	if firstForm(hops, class.PadCell) == formCell {
+		t.Fatal("cells through a relay that doesn't take them")
+	}
+	resp = sendText(t, a, c, "hops=2", "not in cells")
+	if got := inboxText(t, c, resp.MsgID); got != "not in cells" {
+		t.Fatalf("got %q", got)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// deriveOrgID gives deployments that never set an explicit org a stable label
+// derived from their BeaconKey, so two nets with different keys never collide.
+func deriveOrgID(beaconKey [32]byte) string {
+	h := sha256.Sum256(append([]byte("mixnets-org-v1"), beaconKey[:]...))
+	return hex.EncodeToString(h[:8])
+}
+
+// orgGuard holds the local OrgID and counts traffic dropped for carrying a
+// foreign one (a strong hint that two deployments share a BeaconKey).
+type orgGuard struct {
+	ID                string
+	foreignBeacons    atomic.Int64
+	foreignReplicates atomic.Int64
+	foreignCommands   atomic.Int64
+	legacy            *legacyGuard // untagged traffic is a legacy shim
+}
+
+func newOrgGuard(id string) *orgGuard {
+	return &orgGuard{ID: id}
+}
+
+// accept reports whether traffic tagged with other belongs to our org.
+// Untagged traffic from older nodes is accepted, unless the untagged-org
+// shim is off; it already proved knowledge of the BeaconKey.
+func (o *orgGuard) accept(other string, counter *atomic.Int64) bool {
+	if other == "" {
+		return o.legacy.allow(legacyUntaggedOrg)
+	}
+	if other == o.ID {
+		return true
+	}
+	counter.Add(1)
+	return false
+}
+
+// orgDHTKey namespaces DHT keys so foreign orgs can't resolve our providers.
+func (s *Server) orgDHTKey(key string) string {
+	return s.org.ID + "/" + key
+}
+
+// chainDir is chain/<org>/ under BaseDir.
+func (s *Server) chainDir() string {
+	return filepath.Join(s.paths.BaseDir, "chain", s.org.ID)
+}
+
+func (s *Server) chainPath() string {
+	return filepath.Join(s.chainDir(), "chain.jsonl")
+}
+
+// migrateLegacyChain moves a pre-org chain/chain.jsonl into chain/<org>/.
+func (s *Server) migrateLegacyChain() {
+	moved, err := splitLegacyChain(s.paths, s.org.ID)
+	if err != nil {
+		log.Printf("[org] chain migrate: %v", err)
+	} else if moved {
+		log.Printf("[org] moved legacy chain into %s", s.chainDir())
+	}
+}
+
+// splitLegacyChain moves chain/chain.jsonl to chain/<org>/chain.jsonl
+// unless the latter already exists.
+func splitLegacyChain(paths *EnvPaths, org string) (bool, error) {
+	legacy := filepath.Join(paths.BaseDir, "chain", "chain.jsonl")
+	dir := filepath.Join(paths.BaseDir, "chain", org)
+	if _, err := os.Stat(legacy); err != nil {
+		return false, nil
+	}
+	if _, err := os.Stat(filepath.Join(dir, "chain.jsonl")); err == nil {
+		return false, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return false, err
+	}
+	if err := os.Rename(legacy, filepath.Join(dir, "chain.jsonl")); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// GET /org (control)
+func (s *Server) handleOrg(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]any{
+		"org_id": s.org.ID,
+		"foreign": map[string]int64{
+			"beacons":    s.org.foreignBeacons.Load(),
+			"replicates": s.org.foreignReplicates.Load(),
+			"commands":   s.org.foreignCommands.Load(),
+		},
+	})
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() { registerFeature(featureWANTLS) }
+
+// Outbound connections. Peer calls stay on the LAN and never use a proxy
+// (lanTransport), whatever HTTP_PROXY says. Calls that leave the site
+// (keysaver, webhooks) go through one WAN transport: --proxy-url if set,
+// else HTTPS_PROXY / HTTP_PROXY; NO_PROXY is honoured either way. Proxy
+// basic-auth credentials live in env.enc, set with PUT /env/proxy-auth, and
+// are used when the proxy URL carries none.
+
+// lanTransport is http.DefaultTransport without a proxy.
+var lanTransport = func() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil
+	return t
+}()
+
+// proxyRejected is the error when the proxy answers CONNECT with anything
+// but 200.
+type proxyRejected struct {
+	Proxy  string
+	Status string
+	Code   int
+}
+
+func (e *proxyRejected) Error() string {
+	return fmt.Sprintf("proxy %s rejected CONNECT: %s", e.Proxy, e.Status)
+}
+
+// wanOutbound is the shared transport for WAN-facing calls.
+type wanOutbound struct {
+	proxy *url.URL // --proxy-url; nil = from the environment
+	tr    *http.Transport
+
+	mu         sync.RWMutex
+	user, pass string
+}
+
+// parseProxyURL checks --proxy-url ("" = none).
+func parseProxyURL(s string) (*url.URL, error) {
+	if s == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("proxy url %q: want http://host:port or https://host:port", s)
+	}
+	return u, nil
+}
+
+// newWANOutbound builds the WAN transport; a bad cfg.ProxyURL (main checks
+// it) is logged and ignored. sec may be nil.
+func newWANOutbound(cfg *Config, sec *EnvSecrets) *wanOutbound {
+	o := &wanOutbound{}
+	u, err := parseProxyURL(cfg.ProxyURL)
+	if err != nil {
+		log.Printf("[net] %v; using the environment", err)
+	}
+	o.proxy = u
+	if sec != nil {
+		o.user, o.pass = sec.ProxyUser, sec.ProxyPass
+	}
+	o.tr = http.DefaultTransport.(*http.Transport).Clone()
+	o.tr.Proxy = o.proxyFor
+	if cfg.StrictCrypto {
+		// explicit, so GODEBUG can't lower it
+		o.tr.TLSClientConfig = &tls.Config{MinVersion: strictTLSMin}
+	}
+	o.tr.OnProxyConnectResponse = func(_ context.Context, proxyURL *url.URL, _ *http.Request, res *http.Response) error {
+		if res.StatusCode != http.StatusOK {
+			return &proxyRejected{Proxy: proxyURL.Redacted(), Status: res.Status, Code: res.StatusCode}
+		}
+		return nil
+	}
+	return o
+}
+
+func (o *wanOutbound) setAuth(user, pass string) {
+	o.mu.Lock()
+	o.user, o.pass = user, pass
+	o.mu.Unlock()
+}
+
+// proxyFor picks the proxy for req, adding the env.enc credentials.
+func (o *wanOutbound) proxyFor(req *http.Request) (*url.URL, error) {
+	u := o.proxy
+	if u == nil {
+		var err error
+		if u, err = http.ProxyFromEnvironment(req); err != nil || u == nil {
+			return u, err
+		}
+	} else if noProxy(req.URL.Hostname(), envAny("NO_PROXY", "no_proxy")) {
+		return nil, nil
+	}
+	o.mu.RLock()
+	user, pass := o.user, o.pass
+	o.mu.RUnlock()
+	if u.User == nil && user != "" {
+		cp := *u
+		cp.User = url.UserPassword(user, pass)
+		u = &cp
+	}
+	return u, nil
+}
+
+// client returns a WAN client with timeout.
+func (o *wanOutbound) client(timeout time.Duration) *http.Client {
+	return &http.Client{Transport: o.tr, Timeout: timeout}
+}
+
+// viaProxy reports the proxy rawURL would use, "" for none.
+func (o *wanOutbound) viaProxy(rawURL string) string {
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return ""
+	}
+	u, err := o.proxyFor(req)
+	if err != nil || u == nil {
+		return ""
+	}
+	return u.Redacted()
+}
+
+func envAny(keys ...string) string {
+	for _, k := range keys {
+		if v := os.Getenv(k); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// noProxy matches host against a NO_PROXY list: "*", IPs, CIDRs, and
+// domains ("example.com" and ".example.com" both cover subdomains).
+func noProxy(host, list string) bool {
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+	for _, e := range strings.Split(list, ",") {
+		e = strings.ToLower(strings.TrimSpace(e))
+		if h, _, err := net.SplitHostPort(e); err == nil {
+			e = h
+		}
+		switch {
+		case e == "":
+		case e == "*":
+			return true
+		case ip != nil && strings.Contains(e, "/"):
+			if _, n, err := net.ParseCIDR(e); err == nil && n.Contains(ip) {
+				return true
+			}
+		case ip != nil:
+			if ip.Equal(net.ParseIP(e)) {
+				return true
+			}
+		default:
+			d := strings.TrimPrefix(e, ".")
+			if host == d || strings.HasSuffix(host, "."+d) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wanFailure explains a failed WAN call for the doctor: the proxy refused
+// us, the proxy is unreachable, or the target is.
+func wanFailure(target, proxy string, err error) (detail, hint string) {
+	var rej *proxyRejected
+	var op *net.OpError
+	switch {
+	case errors.As(err, &rej) && rej.Code == http.StatusProxyAuthRequired:
+		return rej.Error(), "set the proxy credentials with PUT /env/proxy-auth (stored in env.enc)"
+	case errors.As(err, &rej):
+		return rej.Error(), "the proxy refuses this destination; ask for " + target + " to be allowed"
+	case errors.As(err, &op) && op.Op == "proxyconnect":
+		return fmt.Sprintf("proxy %s unreachable: %v", proxy, op.Err), "check --proxy-url or HTTPS_PROXY/HTTP_PROXY"
+	case proxy != "":
+		return fmt.Sprintf("%s unreachable via proxy %s: %v", target, proxy, err), ""
+	}
+	return fmt.Sprintf("%s unreachable: %v", target, err), ""
+}
+
+// ---- credentials ----
+
+type proxyAuthRequest struct {
+	User string `json:"user"`
+	Pass string `json:"pass"`
+}
+
+// PUT/DELETE /env/proxy-auth (control, token) with the env.enc passphrase
+// in X-Passphrase: store or clear the proxy credentials in env.enc.
+func (s *Server) handleProxyAuth(w http.ResponseWriter, r *http.Request) {
+	var req proxyAuthRequest
+	switch r.Method {
+	case http.MethodPut:
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.User == "" {
+			http.Error(w, "want {\"user\":...,\"pass\":...}", http.StatusBadRequest)
+			return
+		}
+	case http.MethodDelete:
+	default:
+		http.Error(w, "use PUT or DELETE", http.StatusMethodNotAllowed)
+		return
+	}
+	pass := []byte(r.Header.Get(passphraseHeader))
+	defer wipeBytes(pass)
+	sec, err := loadEnvSecrets(s.paths, pass)
+	if err != nil {
+		http.Error(w, "env.enc: "+err.Error(), http.StatusForbidden)
+		return
+	}
+	sec.ProxyUser, sec.ProxyPass = req.User, req.Pass
+	if err := sealEnvSecrets(s.paths.EnvEnc, pass, sec); err != nil {
+		http.Error(w, "seal: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.wan.setAuth(req.User, req.Pass)
+	if req.User == "" {
+		log.Printf("[net] proxy credentials cleared")
+	} else {
+		log.Printf("[net] proxy credentials stored for %s", req.User)
+	}
+	writeJSON(w, map[string]any{"status": "ok", "user": req.User})
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Outbox. A /mix/send-text or /mix/send-file called with ?queue=true that
+// can't go out now (no peer known, no path, the destination's key still
+// pending, the first hop down) is kept instead of failing: the payload and
+// the request's parameters are sealed with the FileKey under
+// ~/.mixnets/outbox/ and the caller gets 202 with an outbox ID. A dispatcher
+// replays the request when the peer list changes, and otherwise with
+// jittered backoff, until it succeeds or the item is older than --outbox-max-age,
+// when it is dropped with an outbox.expired event. A send-file is only
+// deferred before it is sealed (no peer known): once its block is on the
+// chain, replication carries it. GET /outbox lists the items, DELETE
+// /outbox/<id> discards one.
+
+const (
+	outboxDir           = "outbox" // under BaseDir
+	outboxMaxBytes      = 512 << 20
+	outboxRetryMin      = 30 * time.Second
+	outboxRetryMax      = 10 * time.Minute
+	outboxTick          = 15 * time.Second
+	defaultOutboxMaxAge = 24 * time.Hour
+
+	outboxText = "text"
+	outboxFile = "file"
+)
+
+var errOutboxFull = errors.New("outbox full")
+
+// OutboxItem is one pending send; the payload is kept apart.
+type OutboxItem struct {
+	ID        string    `json:"id"`
+	Kind      string    `json:"kind"`  // outboxText | outboxFile
+	Query     string    `json:"query"` // the send's query string, without queue
+	To        string    `json:"to,omitempty"`
+	Name      string    `json:"name,omitempty"`
+	Size      int64     `json:"size"`
+	Created   time.Time `json:"created"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"last_error,omitempty"`
+	NextTry   time.Time `json:"next_try"`
+}
+
+type outboxStore struct {
+	mu    sync.Mutex
+	dir   string
+	key   []byte
+	items map[string]*OutboxItem
+	bytes int64
+	kick  chan struct{} // a new item was queued
+}
+
+func newOutboxStore(paths *EnvPaths, key []byte) *outboxStore {
+	ob := &outboxStore{
+		dir:   filepath.Join(paths.BaseDir, outboxDir),
+		key:   key,
+		items: make(map[string]*OutboxItem),
+		kick:  make(chan struct{}, 1),
+	}
+	metas, _ := filepath.Glob(filepath.Join(ob.dir, "*.meta"))
+	for _, p := range metas {
+		var it OutboxItem
+		if err := ob.readSealed(p, &it); err != nil || it.ID == "" {
+			log.Printf("[outbox] ignoring unreadable %s: %v", p, err)
+			continue
+		}
+		ob.items[it.ID] = &it
+		ob.bytes += it.Size
+	}
+	if len(ob.items) > 0 {
+		log.Printf("[outbox] %d pending sends restored", len(ob.items))
+	}
+	return ob
+}
+
+func (ob *outboxStore) readSealed(path string, v any) error {
+	blob, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	plain, err := aeadOpenWithKey(ob.key, blob)
+	if err != nil {
+		return err
+	}
+	defer wipeBytes(plain)
+	return json.Unmarshal(plain, v)
+}
+
+func (ob *outboxStore) writeSealed(path string, plain []byte) error {
+	blob, err := aeadSealWithKey(ob.key, plain)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, blob)
+}
+
+func (ob *outboxStore) metaPath(id string) string { return filepath.Join(ob.dir, id+".meta") }
+func (ob *outboxStore) dataPath(id string) string { return filepath.Join(ob.dir, id+".bin") }
+
+// saveLocked rewrites the item's meta file; callers hold ob.mu.
+func (ob *outboxStore) saveLocked(it *OutboxItem) {
+	b, _ := json.Marshal(it)
+	if err := ob.writeSealed(ob.metaPath(it.ID), b); err != nil {
+		log.Printf("[outbox] save %s: %v", it.ID, err)
+	}
+}
+
+// add queues a send of kind with the request's query and payload.
+func (ob *outboxStore) add(kind string, q url.Values, payload []byte) (OutboxItem, error) {
+	idb, err := secureRandom(12)
+	if err != nil {
+		return OutboxItem{}, err
+	}
+	q = cloneValues(q)
+	q.Del("queue")
+	q.Del("progress") // nobody is listening to a replay
+	now := time.Now().UTC()
+	it := &OutboxItem{
+		ID:      base64.RawURLEncoding.EncodeToString(idb),
+		Kind:    kind,
+		Query:   q.Encode(),
+		To:      q.Get("to"),
+		Name:    q.Get("name"),
+		Size:    int64(len(payload)),
+		Created: now,
+		NextTry: now,
+	}
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	if ob.bytes+it.Size > outboxMaxBytes {
+		return OutboxItem{}, errOutboxFull
+	}
+	if err := os.MkdirAll(ob.dir, 0o700); err != nil {
+		return OutboxItem{}, err
+	}
+	if err := ob.writeSealed(ob.dataPath(it.ID), payload); err != nil {
+		return OutboxItem{}, err
+	}
+	ob.items[it.ID] = it
+	ob.bytes += it.Size
+	ob.saveLocked(it)
+	select {
+	case ob.kick <- struct{}{}:
+	default:
+	}
+	return *it, nil
+}
+
+func cloneValues(q url.Values) url.Values {
+	out := make(url.Values, len(q))
+	for k, v := range q {
+		out[k] = append([]string(nil), v...)
+	}
+	return out
+}
+
+// payload opens the sealed payload of id.
+func (ob *outboxStore) payload(id string) ([]byte, error) {
+	blob, err := os.ReadFile(ob.dataPath(id))
+	if err != nil {
+		return nil, err
+	}
+	return aeadOpenWithKey(ob.key, blob)
+}
+
+// remove deletes id and its files; false if it isn't queued.
+func (ob *outboxStore) remove(id string) (OutboxItem, bool) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	it, ok := ob.items[id]
+	if !ok {
+		return OutboxItem{}, false
+	}
+	delete(ob.items, id)
+	ob.bytes -= it.Size
+	os.Remove(ob.dataPath(id))
+	os.Remove(ob.metaPath(id))
+	return *it, true
+}
+
+// failed records a failed attempt and backs the item off.
+func (ob *outboxStore) failed(id string, err error) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	it, ok := ob.items[id]
+	if !ok {
+		return
+	}
+	it.Attempts++
+	it.LastError = err.Error()
+	wait := outboxRetryMin << min(it.Attempts-1, 5)
+	it.NextTry = time.Now().UTC().Add(jitter(min(wait, outboxRetryMax)))
+	ob.saveLocked(it)
+}
+
+// list returns the queued items, oldest first.
+func (ob *outboxStore) list() []OutboxItem {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	out := make([]OutboxItem, 0, len(ob.items))
+	for _, it := range ob.items {
+		out = append(out, *it)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].Created.Equal(out[j].Created) {
+			return out[i].Created.Before(out[j].Created)
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+// queueRequested reports whether the caller asked for ?queue=true.
+func queueRequested(r *http.Request) bool {
+	return r.URL.Query().Get("queue") == "true"
+}
+
+// queueSend puts a send that couldn't go out into the outbox if the caller
+// asked for it, answering 202; false means the caller reports cause itself.
+func (s *Server) queueSend(w http.ResponseWriter, r *http.Request, kind string, payload []byte, cause error) bool {
+	if !queueRequested(r) {
+		return false
+	}
+	it, err := s.outbox.add(kind, r.URL.Query(), payload)
+	if errors.Is(err, errOutboxFull) {
+		writeStorageFull(w, StorageFull{Status: "storage_full", NodeID: s.id.NodeID, Scope: "outbox"})
+		return true
+	}
+	if err != nil {
+		http.Error(w, "outbox: "+err.Error(), http.StatusInternalServerError)
+		return true
+	}
+	log.Printf("[outbox] queued %s %s (%d bytes): %v", kind, it.ID, it.Size, cause)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]any{"status": "queued", "outbox_id": it.ID, "kind": kind, "reason": cause.Error()})
+	return true
+}
+
+// outboxReply captures a replayed send's response.
+type outboxReply struct {
+	hdr  http.Header
+	code int
+	body bytes.Buffer
+}
+
+func (o *outboxReply) Header() http.Header { return o.hdr }
+func (o *outboxReply) WriteHeader(code int) {
+	if o.code == 0 {
+		o.code = code
+	}
+}
+func (o *outboxReply) Write(b []byte) (int, error) {
+	o.WriteHeader(http.StatusOK)
+	return o.body.Write(b)
+}
+
+// dispatch replays it through its send handler, without ?queue.
+func (s *Server) dispatchOutbox(it OutboxItem) error {
+	payload, err := s.outbox.payload(it.ID)
+	if err != nil {
+		return err
+	}
+	path, h := "/mix/send-text", s.handleSendText
+	if it.Kind == outboxFile {
+		path, h = "/mix/send-file", s.handleSendFileDistribute
+	}
+	req, err := http.NewRequest(http.MethodPost, path+"?"+it.Query, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.RemoteAddr = "127.0.0.1:0"
+	rep := &outboxReply{hdr: http.Header{}}
+	h(rep, req)
+	if rep.code >= 300 {
+		return fmt.Errorf("status %d: %s", rep.code, strings.TrimSpace(rep.body.String()))
+	}
+	return nil
+}
+
+// runOutbox drops expired items and replays the due ones; all ignores the
+// backoff (the peer list just changed).
+func (s *Server) runOutbox(all bool) {
+	now := time.Now().UTC()
+	for _, it := range s.outbox.list() {
+		if s.cfg.OutboxMaxAge > 0 && now.Sub(it.Created) > s.cfg.OutboxMaxAge {
+			if _, ok := s.outbox.remove(it.ID); ok {
+				log.Printf("[outbox] %s %s expired after %d attempts: %s", it.Kind, it.ID, it.Attempts, it.LastError)
+				s.emit(eventOutboxExpired, it)
+			}
+			continue
+		}
+		if len(s.peers.List()) == 0 || (!all && now.Before(it.NextTry)) {
+			continue
+		}
+		if err := s.dispatchOutbox(it); err != nil {
+			log.Printf("[outbox] %s %s attempt %d failed: %v", it.Kind, it.ID, it.Attempts+1, err)
+			s.outbox.failed(it.ID, err)
+			continue
+		}
+		if _, ok := s.outbox.remove(it.ID); ok {
+			log.Printf("[outbox] %s %s sent", it.Kind, it.ID)
+			s.emit(eventOutboxSent, it)
+		}
+	}
+}
+
+// startOutboxLoop replays queued sends when peers appear or change, when
+// an item is queued, and on a timer for backoff and expiry.
+func (s *Server) startOutboxLoop(ctx context.Context) {
+	changed := s.peers.watch()
+	ticker := time.NewTicker(outboxTick)
+	defer ticker.Stop()
+	for {
+		all := false
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+			all = true
+		case <-s.outbox.kick:
+		case <-ticker.C:
+		}
+		s.runOutbox(all)
+	}
+}
+
+// GET /outbox (control): queued sends, oldest first. Payloads aren't shown.
+func (s *Server) handleOutbox(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	items := s.outbox.list()
+	var total int64
+	for _, it := range items {
+		total += it.Size
+	}
+	writeJSON(w, map[string]any{"items": items, "bytes": total, "max_bytes": outboxMaxBytes, "max_age": s.cfg.OutboxMaxAge.String()})
+}
+
+// DELETE /outbox/{id} (control): discard a queued send.
+func (s *Server) handleOutboxDelete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "use DELETE", http.StatusMethodNotAllowed)
+		return
+	}
+	it, ok := s.outbox.remove(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "no such outbox item", http.StatusNotFound)
+		return
+	}
+	log.Printf("[audit] outbox %s %s discarded", it.Kind, it.ID)
+	writeJSON(w, map[string]any{"status": "deleted", "id": it.ID})
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+)
+
+// Network scoping for the libp2p node. Beacons are sealed with the
+// BeaconKey, so two networks on one LAN never learn of each other's
+// Servers, but the libp2p node found every other one through a fixed mDNS
+// tag and took a manifest from anyone who signed it, so files crossed
+// between networks. Now:
+//   - the mDNS service tag carries a hash of the BeaconKey, so nodes of
+//     another network aren't found; the old shared tag is joined too while
+//     legacy_untagged_org is on, for nodes of earlier releases;
+//   - a manifest carries org_mac, an HMAC of its ID under a key derived from
+//     the BeaconKey, and a manifest whose MAC doesn't check out is dropped,
+//     and with it every chunk of the file. A manifest without one (earlier
+//     releases) is taken only while legacy_untagged_org is on.
+
+// p2pOrgKey is the org_mac key; every node holding the BeaconKey derives
+// the same one.
+func p2pOrgKey(beaconKey [32]byte) []byte {
+	h := sha256.Sum256(append([]byte("mixnets-p2p-org-v1"), beaconKey[:]...))
+	return h[:]
+}
+
+// p2pMDNSTag is the mDNS service tag of the network holding beaconKey.
+func p2pMDNSTag(beaconKey [32]byte) string {
+	h := sha256.Sum256(append([]byte("mixnets-p2p-mdns-v1"), beaconKey[:]...))
+	return mdnsTag + "-" + hex.EncodeToString(h[:8])
+}
+
+func manifestOrgMAC(key []byte, id string) string {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte("p2p-manifest|" + id))
+	return base64.StdEncoding.EncodeToString(m.Sum(nil))
+}
+
+// fromOrg reports whether man was sent by a node of our network.
+func (n *Node) fromOrg(man FileManifest) bool {
+	if man.OrgMAC == "" {
+		return n.legacy.allow(legacyUntaggedOrg)
+	}
+	return hmac.Equal([]byte(man.OrgMAC), []byte(manifestOrgMAC(n.orgKey, man.ID)))
+}
@@ -40,6 +40,31 @@ typedef struct {
 	int control_port;
 } P2PStatus;
 
+// P2PPassphraseFn writes the passphrase into buf (at most cap bytes, no
+// terminator needed) and returns its length, or <= 0 to refuse.
+typedef int (*P2PPassphraseFn)(void* ctx, char* buf, int cap);
+// P2PWipeFn tells the host to wipe its own copy of the passphrase.
+typedef void (*P2PWipeFn)(void* ctx);
+
+static inline int p2p_get_pass(P2PPassphraseFn fn, void* ctx, char* buf, int cap) {
+	return fn(ctx, buf, cap);
+}
+static inline void p2p_host_wipe(P2PWipeFn fn, void* ctx) {
+	if (fn) fn(ctx);
+}
+static inline void p2p_wipe(void* p, size_t n) {
+	volatile unsigned char* v = (volatile unsigned char*)p;
+	while (n--) *v++ = 0;
+}
+
+// P2PEventFn receives each node event as JSON, the body webhooks and
+// /events get; json is only valid during the call.
+typedef void (*P2PEventFn)(void* ctx, const char* json);
+
+static inline void p2p_event(P2PEventFn fn, void* ctx, const char* json) {
+	fn(ctx, json);
+}
+
 #line 1 "cgo-generated-wrapper"
 
 
@@ -106,14 +131,35 @@ extern "C" {
 // P2P_Init initializes the p2p node with the given parameters.
 // Returns 0 on success, non-zero on error.
 // forceNewEnv: if 1, recreate env.enc even if it exists (like --new-net)
+// apiPort 0 picks an ephemeral port at P2P_Start; P2P_GetStatus reports it.
+// The data dir is MIXNETS_DATA_DIR, else ~/.mixnets.
+// The Go-side copy of envPass is wiped before returning; envPass itself is
+// the caller's to wipe. Prefer P2P_InitSecure.
 //
 extern __declspec(dllexport) int P2P_Init(char* envPass, int apiPort, int controlPort, char* mcGroup, int mcPort, char* keySaverUrl, int forceNewEnv);
 
+// P2P_InitSecure is P2P_Init with the passphrase supplied by a one-shot
+// callback: getPass fills a buffer owned by the DLL, the DLL copies it,
+// wipes and frees the buffer, then calls wipe(ctx) so the host can clear
+// its own copy (wipe may be NULL). The Go-side copy is locked in memory
+// and wiped once env.enc is open. Returns -2 if getPass refuses or
+// overflows the buffer; other codes as P2P_Init.
+//
+extern __declspec(dllexport) int P2P_InitSecure(P2PPassphraseFn getPass, P2PWipeFn wipe, void* ctx, int apiPort, int controlPort, char* mcGroup, int mcPort, char* keySaverUrl, int forceNewEnv);
+
 // P2P_Start starts the p2p node services (discovery, HTTP servers).
 // Returns 0 on success.
 //
 extern __declspec(dllexport) int P2P_Start(void);
 
+// P2P_SetEventCallback registers fn to receive every node event (peer
+// lifecycle, inbox, commands, ... the same as GET /events) as JSON, on a
+// goroutine of the DLL, one event at a time. A callback slower than the
+// events misses some rather than holding up the node. NULL unregisters.
+// It may be called before or after P2P_Start and survives P2P_Stop.
+//
+extern __declspec(dllexport) int P2P_SetEventCallback(P2PEventFn fn, void* ctx);
+
 // P2P_Stop gracefully stops all p2p services.
 //
 extern __declspec(dllexport) void P2P_Stop(void);
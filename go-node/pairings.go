@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+// Pairwise beacons. Where not every LAN device holding the BeaconKey can be
+// trusted, --beacon-mode=pairwise replaces the group beacon with one blob
+// per paired peer, sealed to that peer's pairing key: a device that isn't
+// paired learns nothing from them and can't forge one. --beacon-mode=both
+// sends and accepts both kinds while a fleet migrates; group (the default)
+// only sends group beacons but still accepts blobs from paired peers.
+//
+// Each node has a static X25519 pairing key, kept apart from the mix
+// keypair (a new one every start). A blob is
+//
+//	"MIXP1" || ephemeral pub (32) || nonce (24) || XChaCha20-Poly1305(beacon)
+//
+// keyed with SHA-256(X25519(eph, peer) || X25519(self, peer) || eph pub).
+// The ephemeral term keeps blobs from being linked to a recipient, the
+// static one proves the sender is one of our pairings. A listener tries a
+// blob against each pairing and drops it silently if none opens it. The
+// pairing key and the pairing list (GET/POST/DELETE /pairings) live in
+// pairings.enc, sealed with the env FileKey.
+
+const (
+	pairingsFile    = "pairings.enc"
+	pairingsMax     = 64 // one datagram per pairing per beacon tick
+	pairingLabelMax = 128
+
+	beaconModeGroup    = "group"
+	beaconModePairwise = "pairwise"
+	beaconModeBoth     = "both"
+)
+
+var pairwiseMagic = []byte("MIXP1")
+
+func validateBeaconMode(mode string) error {
+	switch mode {
+	case beaconModeGroup, beaconModePairwise, beaconModeBoth:
+		return nil
+	}
+	return fmt.Errorf("unknown beacon mode %q (want %s, %s or %s)", mode, beaconModeGroup, beaconModePairwise, beaconModeBoth)
+}
+
+type pairing struct {
+	NodeID  string    `json:"node_id"`
+	PubKey  string    `json:"pubkey"` // peer's X25519 pairing key, base64url
+	Label   string    `json:"label,omitempty"`
+	AddedAt time.Time `json:"added_at"`
+}
+
+type pairingState struct {
+	Key      string     `json:"key"` // our X25519 pairing private key, base64url
+	Pairings []*pairing `json:"pairings"`
+}
+
+// pairPeer is a pairing decoded for sealing and opening blobs.
+type pairPeer struct {
+	nodeID string
+	pub    []byte
+	static []byte // X25519(self, peer)
+}
+
+type pairingStore struct {
+	path string
+	key  []byte
+
+	mu    sync.Mutex
+	st    pairingState
+	priv  []byte
+	pub   []byte
+	peers []pairPeer
+}
+
+// newPairingStore loads pairings.enc, creating our pairing key on first
+// use. An unreadable file is left alone until the list changes, so a wrong
+// FileKey doesn't cost the operator their pairings.
+func newPairingStore(paths *EnvPaths, key []byte) *pairingStore {
+	ps := &pairingStore{path: filepath.Join(paths.BaseDir, pairingsFile), key: key}
+	blob, err := os.ReadFile(ps.path)
+	missing := os.IsNotExist(err)
+	if err == nil {
+		var plain []byte
+		plain, err = aeadOpenWithKey(key, blob)
+		if err == nil {
+			err = json.Unmarshal(plain, &ps.st)
+		}
+		wipeBytes(plain)
+	}
+	if err == nil {
+		ps.priv, err = base64.RawURLEncoding.DecodeString(ps.st.Key)
+		if err == nil && len(ps.priv) != curve25519.ScalarSize {
+			err = errors.New("bad pairing key")
+		}
+	}
+	if err != nil {
+		if !missing {
+			log.Printf("[pairing] ignoring unreadable %s: %v", ps.path, err)
+		}
+		ps.st = pairingState{}
+		ps.priv = make([]byte, curve25519.ScalarSize)
+		if _, err := rand.Read(ps.priv); err != nil {
+			log.Printf("[pairing] key: %v", err)
+		}
+		ps.st.Key = base64.RawURLEncoding.EncodeToString(ps.priv)
+	}
+	ps.pub, _ = curve25519.X25519(ps.priv, curve25519.Basepoint)
+	ps.mu.Lock()
+	ps.rebuildLocked()
+	if missing {
+		ps.saveLocked()
+	}
+	ps.mu.Unlock()
+	return ps
+}
+
+// saveLocked seals and writes the state; callers hold ps.mu.
+func (ps *pairingStore) saveLocked() {
+	b, _ := json.Marshal(ps.st)
+	blob, err := aeadSealWithKey(ps.key, b)
+	wipeBytes(b)
+	if err == nil {
+		err = writeFileAtomic(ps.path, blob)
+	}
+	if err != nil {
+		log.Printf("[pairing] save: %v", err)
+	}
+}
+
+// rebuildLocked recomputes peers from the list; callers hold ps.mu.
+func (ps *pairingStore) rebuildLocked() {
+	ps.peers = ps.peers[:0]
+	for _, p := range ps.st.Pairings {
+		pub, err := base64.RawURLEncoding.DecodeString(p.PubKey)
+		if err != nil {
+			continue
+		}
+		static, err := curve25519.X25519(ps.priv, pub)
+		if err != nil {
+			continue
+		}
+		ps.peers = append(ps.peers, pairPeer{nodeID: p.NodeID, pub: pub, static: static})
+	}
+}
+
+// selfPub is our pairing key, base64url: what a peer adds to pair with us.
+func (ps *pairingStore) selfPub() string {
+	return base64.RawURLEncoding.EncodeToString(ps.pub)
+}
+
+func (ps *pairingStore) list() []pairing {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	out := make([]pairing, 0, len(ps.st.Pairings))
+	for _, p := range ps.st.Pairings {
+		out = append(out, *p)
+	}
+	return out
+}
+
+// add stores p, replacing an existing pairing with the same NodeID (a
+// re-key).
+func (ps *pairingStore) add(p pairing) (replaced bool, err error) {
+	pub, err := base64.RawURLEncoding.DecodeString(p.PubKey)
+	if err != nil || len(pub) != curve25519.PointSize {
+		return false, errors.New("pubkey must be a base64url X25519 public key")
+	}
+	if _, err := curve25519.X25519(ps.priv, pub); err != nil {
+		return false, errors.New("pubkey is a low-order point")
+	}
+	if bytes.Equal(pub, ps.pub) {
+		return false, errors.New("that is this node's own pairing key")
+	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for i, old := range ps.st.Pairings {
+		if old.NodeID == p.NodeID {
+			ps.st.Pairings[i] = &p
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		if len(ps.st.Pairings) >= pairingsMax {
+			return false, fmt.Errorf("at most %d pairings", pairingsMax)
+		}
+		ps.st.Pairings = append(ps.st.Pairings, &p)
+	}
+	ps.rebuildLocked()
+	ps.saveLocked()
+	return replaced, nil
+}
+
+func (ps *pairingStore) remove(nodeID string) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for i, p := range ps.st.Pairings {
+		if p.NodeID == nodeID {
+			ps.st.Pairings = append(ps.st.Pairings[:i:i], ps.st.Pairings[i+1:]...)
+			ps.rebuildLocked()
+			ps.saveLocked()
+			return true
+		}
+	}
+	return false
+}
+
+func pairwiseKey(eph, static, ephPub []byte) []byte {
+	k := sha256Sum(append(append(append(make([]byte, 0, 96), eph...), static...), ephPub...))
+	return k[:]
+}
+
+// seal returns one blob of b per pairing.
+func (ps *pairingStore) seal(b Beacon) ([][]byte, error) {
+	ps.mu.Lock()
+	peers := append([]pairPeer(nil), ps.peers...)
+	ps.mu.Unlock()
+	if len(peers) == 0 {
+		return nil, nil
+	}
+	plain, err := json.Marshal(b)
+	if err != nil {
+		return nil, err
+	}
+	out := make([][]byte, 0, len(peers))
+	for _, p := range peers {
+		pkt, err := sealPairwise(plain, p)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, pkt)
+	}
+	return out, nil
+}
+
+func sealPairwise(plain []byte, p pairPeer) ([]byte, error) {
+	defer hBeaconSeal.time()()
+	ephPriv := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(ephPriv); err != nil {
+		return nil, err
+	}
+	ephPub, err := curve25519.X25519(ephPriv, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	eph, err := curve25519.X25519(ephPriv, p.pub)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.NewX(pairwiseKey(eph, p.static, ephPub))
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := append(append(pairwiseMagic[:0:0], pairwiseMagic...), ephPub...)
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, plain, nil), nil
+}
+
+func isPairwiseBeacon(pkt []byte) bool {
+	return bytes.HasPrefix(pkt, pairwiseMagic)
+}
+
+var errNotForUs = errors.New("pairwise beacon not addressed to this node")
+
+// open decrypts a blob sealed to us by one of our pairings into out and
+// returns that pairing's NodeID.
+func (ps *pairingStore) open(pkt []byte, out any) (string, error) {
+	defer hBeaconOpen.time()()
+	hdr := len(pairwiseMagic) + curve25519.PointSize + chacha20poly1305.NonceSizeX
+	if len(pkt) <= hdr || !isPairwiseBeacon(pkt) {
+		return "", errors.New("packet too short")
+	}
+	ephPub := pkt[len(pairwiseMagic) : len(pairwiseMagic)+curve25519.PointSize]
+	nonce := pkt[len(pairwiseMagic)+curve25519.PointSize : hdr]
+	ct := pkt[hdr:]
+	ps.mu.Lock()
+	peers := append([]pairPeer(nil), ps.peers...)
+	ps.mu.Unlock()
+	if len(peers) == 0 {
+		return "", errNotForUs
+	}
+	eph, err := curve25519.X25519(ps.priv, ephPub)
+	if err != nil {
+		return "", err
+	}
+	for _, p := range peers {
+		aead, err := chacha20poly1305.NewX(pairwiseKey(eph, p.static, ephPub))
+		if err != nil {
+			return "", err
+		}
+		plain, err := aead.Open(nil, nonce, ct, nil)
+		if err != nil {
+			continue
+		}
+		return p.nodeID, json.Unmarshal(plain, out)
+	}
+	return "", errNotForUs
+}
+
+// beaconPairings lets the broadcaster seal pairwise beacons.
+func (s *Server) beaconPairings() *pairingStore { return s.pairings }
+
+// ---------------------- Control API ----------------------
+
+type pairingCreate struct {
+	NodeID string `json:"node_id"`
+	PubKey string `json:"pubkey"`
+	Label  string `json:"label"`
+}
+
+// GET /pairings: this node's pairing key and beacon mode, and the list.
+// POST /pairings {node_id, pubkey, label?} pairs (or re-keys) a peer.
+// DELETE /pairings?node_id= unpairs one.
+func (s *Server) handlePairings(w http.ResponseWriter, r *http.Request) {
+	ps := s.pairings
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, map[string]any{
+			"node_id":     s.id.NodeID,
+			"pubkey":      ps.selfPub(),
+			"beacon_mode": s.cfg.BeaconMode,
+			"pairings":    ps.list(),
+		})
+	case http.MethodPost:
+		var req pairingCreate
+		if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil {
+			http.Error(w, "bad json", http.StatusBadRequest)
+			return
+		}
+		id, err := parseNodeID(req.NodeID)
+		if err != nil {
+			http.Error(w, "node_id: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		req.NodeID = string(id)
+		if req.NodeID == s.id.NodeID {
+			http.Error(w, "cannot pair with this node", http.StatusBadRequest)
+			return
+		}
+		if len(req.Label) > pairingLabelMax {
+			http.Error(w, fmt.Sprintf("label longer than %d bytes", pairingLabelMax), http.StatusBadRequest)
+			return
+		}
+		p := pairing{NodeID: req.NodeID, PubKey: strings.TrimSpace(req.PubKey), Label: req.Label, AddedAt: time.Now().UTC()}
+		replaced, err := ps.add(p)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("[audit] pairing %s for node=%s (replaced=%v)", p.PubKey[:8], p.NodeID[:8], replaced)
+		writeJSON(w, map[string]any{"status": "paired", "replaced": replaced, "pairing": p})
+	case http.MethodDelete:
+		id, ok := s.nodeIDParam(w, "node_id", r.URL.Query().Get("node_id"))
+		if !ok {
+			return
+		}
+		if id == "" {
+			http.Error(w, "missing ?node_id=", http.StatusBadRequest)
+			return
+		}
+		if !ps.remove(id) {
+			http.Error(w, "no such pairing", http.StatusNotFound)
+			return
+		}
+		log.Printf("[audit] pairing for node=%s deleted", id[:8])
+		writeJSON(w, map[string]any{"status": "deleted", "node_id": id})
+	default:
+		http.Error(w, "use GET, POST or DELETE", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Fault isolation: a panic in one request or one background loop must not
+// take down a node that may hold the only copy of recent chunks. Handlers
+// get a 500 with an incident ID (grep the log for it); background
+// subsystems that die are reported as degraded on /ready instead of
+// exiting the process.
+
+var panicsTotal = newCounterVec("panics_total", "recovered panics", "scope")
+
+// health is one node's subsystem health: name -> reason it is down. Each
+// Server has its own, so nodes sharing a process report only their own.
+type health struct {
+	mu       sync.Mutex
+	degraded map[string]string
+}
+
+func newHealth() *health { return &health{degraded: map[string]string{}} }
+
+func (h *health) markDegraded(name, reason string) {
+	h.mu.Lock()
+	h.degraded[name] = reason
+	h.mu.Unlock()
+	log.Printf("[health] %s degraded: %s", name, reason)
+}
+
+// degradedSubsystems returns the failed subsystems, sorted by name.
+func (h *health) degradedSubsystems() ([]string, map[string]string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	names := make([]string, 0, len(h.degraded))
+	out := make(map[string]string, len(h.degraded))
+	for n, r := range h.degraded {
+		names = append(names, n)
+		out[n] = r
+	}
+	sort.Strings(names)
+	return names, out
+}
+
+// incidentID ties a panic's log line to the 500 the client got. It is no
+// secret, so the clock stands in if the CSPRNG fails.
+func incidentID() string {
+	b, err := secureRandom(6)
+	if err != nil {
+		return fmt.Sprintf("t%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// recoverHTTP turns a handler panic into a 500 carrying an incident ID.
+func recoverHTTP(scope string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler { // deliberate abort, not a bug
+				panic(v)
+			}
+			id := incidentID()
+			panicsTotal.inc(scope)
+			log.Printf("[panic] incident=%s %s %s %s: %v\n%s", id, scope, r.Method, r.URL.Path, v, debug.Stack())
+			http.Error(w, "internal error (incident "+id+")", http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// goSafe runs fn in a goroutine; if it panics the subsystem is marked
+// degraded and the process keeps running.
+func (h *health) goSafe(name string, fn func()) {
+	go func() {
+		defer h.recoverSubsystem(name)
+		fn()
+	}()
+}
+
+// recoverSubsystem must be deferred directly.
+func (h *health) recoverSubsystem(name string) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	id := incidentID()
+	panicsTotal.inc(name)
+	log.Printf("[panic] incident=%s %s: %v\n%s", id, name, v, debug.Stack())
+	h.markDegraded(name, fmt.Sprintf("panic: %v (incident %s)", v, id))
+}
+
+// recoverOnce guards one unit of work inside a long-lived loop (one beacon,
+// one tick): the panic is logged and counted, and the loop goes on.
+func recoverOnce(scope string) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	panicsTotal.inc(scope)
+	log.Printf("[panic] incident=%s %s: %v\n%s", incidentID(), scope, v, debug.Stack())
+}
+
+// serveOrDegrade runs an HTTP server; a listen failure degrades the node
+// instead of exiting it.
+func (h *health) serveOrDegrade(name string, srv *http.Server, ln net.Listener) {
+	if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("[%s] %v", name, err)
+		h.markDegraded(name, err.Error())
+	}
+}
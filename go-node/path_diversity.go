@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"strings"
+)
+
+// Path diversity. Relays ranked purely by XOR distance or RTT regularly sit
+// on one /24, or are VMs of one physical host, which defeats the mix. The
+// ranked candidates are therefore filtered so that no two hops (the
+// destination included) share a subnet or a hostname prefix and, if asked,
+// so that the path crosses a vault. When the peers can't satisfy every
+// rule, rules are relaxed one at a time, preferring vault, then subnet,
+// then hostname, until a path as long as the unconstrained one fits; the
+// send response lists what held and what was relaxed.
+
+// Diversity rules, in the order they are relaxed.
+const (
+	ruleVault    = "vault"
+	ruleSubnet   = "subnet"
+	ruleHostname = "hostname"
+)
+
+const (
+	defaultPathSubnetBits = 24
+	pathSubnetBits6       = 64 // IPv6 hops are compared by /64
+)
+
+// pathRules are the diversity rules from Config.
+type pathRules struct {
+	SubnetBits int  // IPv4 prefix hops must differ in (0 = off)
+	HostPrefix int  // hostname chars compared (0 = first DNS label, -1 = off)
+	Vault      bool // some hop must have the vault capability
+	V2Only     bool // every hop must peel v2 layers (legacy_onion_v1 off)
+}
+
+func (s *Server) pathRules() pathRules {
+	return pathRules{SubnetBits: s.cfg.PathSubnetBits, HostPrefix: s.cfg.PathHostPrefix, Vault: s.cfg.PathRequireVault,
+		V2Only: !s.legacy.on(legacyOnionV1)}
+}
+
+func validatePathRules(r pathRules) error {
+	if r.SubnetBits < 0 || r.SubnetBits > 32 {
+		return fmt.Errorf("--path-subnet-bits must be 0..32, got %d", r.SubnetBits)
+	}
+	if r.HostPrefix < -1 {
+		return fmt.Errorf("--path-host-prefix must be -1 (off), 0 (first label) or a length, got %d", r.HostPrefix)
+	}
+	return nil
+}
+
+// enabled lists the configured rules in relaxation order.
+func (r pathRules) enabled() []string {
+	var out []string
+	if r.Vault {
+		out = append(out, ruleVault)
+	}
+	if r.SubnetBits > 0 {
+		out = append(out, ruleSubnet)
+	}
+	if r.HostPrefix >= 0 {
+		out = append(out, ruleHostname)
+	}
+	return out
+}
+
+// PathDiversity reports which diversity rules a chosen path satisfies.
+type PathDiversity struct {
+	Enforced []string `json:"enforced"`
+	Relaxed  []string `json:"relaxed,omitempty"`
+}
+
+// subnetOf is the masked network of addr ("" if it isn't ip:port).
+func subnetOf(addr string, bits int) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return ""
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ""
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(bits, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(pathSubnetBits6, 128)).String()
+}
+
+// hostPrefixOf is the part of a hostname hops must not share ("" if the
+// hostname is unknown, which never conflicts).
+func hostPrefixOf(hostname string, n int) string {
+	h := strings.ToLower(strings.TrimSpace(hostname))
+	if n == 0 {
+		h, _, _ = strings.Cut(h, ".")
+	} else if len(h) > n {
+		h = h[:n]
+	}
+	return h
+}
+
+// conflicts reports whether p breaks rule against one of the chosen hops.
+func (r pathRules) conflicts(rule string, p PeerInfo, chosen []PeerInfo) bool {
+	for _, c := range chosen {
+		switch rule {
+		case ruleSubnet:
+			if a := subnetOf(p.Addr, r.SubnetBits); a != "" && a == subnetOf(c.Addr, r.SubnetBits) {
+				return true
+			}
+		case ruleHostname:
+			if a := hostPrefixOf(p.Hostname, r.HostPrefix); a != "" && a == hostPrefixOf(c.Hostname, r.HostPrefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// pickRelays takes up to n ranked candidates that keep the active rules
+// against each other and dest. With the vault rule active the last slot is
+// held for a vault unless dest or an earlier pick is one. ok is false if
+// fewer than n fit or no vault was found.
+func (r pathRules) pickRelays(cands []PeerInfo, dest PeerInfo, n int, active []string) ([]PeerInfo, bool) {
+	vault := false
+	for _, a := range active {
+		vault = vault || a == ruleVault
+	}
+	haveVault := dest.hasCap(capVault)
+	chosen := []PeerInfo{dest}
+	for _, p := range cands {
+		if len(chosen)-1 >= n {
+			break
+		}
+		if vault && !haveVault && len(chosen) == n && !p.hasCap(capVault) {
+			continue
+		}
+		ok := true
+		for _, a := range active {
+			if a != ruleVault && r.conflicts(a, p, chosen) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			chosen = append(chosen, p)
+			haveVault = haveVault || p.hasCap(capVault)
+		}
+	}
+	return chosen[1:], len(chosen)-1 == n && (!vault || haveVault)
+}
+
+// diverseRelays picks n relays from the ranked candidates. If the rules
+// can't all be kept, the first rule (in relaxation order) whose removal
+// alone makes the path fit is relaxed; if none does, the first is dropped
+// and the search repeats.
+func (r pathRules) diverseRelays(cands []PeerInfo, dest PeerInfo, n int) ([]PeerInfo, PathDiversity) {
+	active := r.enabled()
+	div := PathDiversity{Enforced: []string{}}
+	relax := func(i int) {
+		log.Printf("[mix] path to %.8s: %d candidate relays can't satisfy %q; relaxing it", dest.NodeID, len(cands), active[i])
+		div.Relaxed = append(div.Relaxed, active[i])
+		active = slices.Delete(slices.Clone(active), i, i+1)
+	}
+	if relays, ok := r.pickRelays(cands, dest, n, active); ok {
+		div.Enforced = append(div.Enforced, active...)
+		return relays, div
+	}
+	for len(active) > 0 {
+		for i := range active {
+			rest := slices.Delete(slices.Clone(active), i, i+1)
+			if relays, ok := r.pickRelays(cands, dest, n, rest); ok {
+				relax(i)
+				div.Enforced = append(div.Enforced, active...)
+				return relays, div
+			}
+		}
+		relax(0)
+	}
+	relays, _ := r.pickRelays(cands, dest, n, nil)
+	return relays, div
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	maxPeerAddrs  = 4
+	addrProbeIntv = 30 * time.Second
+	addrProbeTO   = 2 * time.Second
+
+	addrUnknown     = "unknown"
+	addrReachable   = "reachable"
+	addrUnreachable = "unreachable"
+
+	nodeIDHeader = "X-Node-ID"
+)
+
+// PeerAddr is one recently observed "ip:apiport" for a peer.
+type PeerAddr struct {
+	Addr      string    `json:"addr"`
+	LastSeen  time.Time `json:"last_seen"`
+	State     string    `json:"state"`
+	LastProbe time.Time `json:"last_probe,omitempty"`
+}
+
+// sortAddrs orders addresses freshest first, with known-unreachable ones last.
+func sortAddrs(addrs []PeerAddr) {
+	sort.SliceStable(addrs, func(i, j int) bool {
+		di, dj := addrs[i].State == addrUnreachable, addrs[j].State == addrUnreachable
+		if di != dj {
+			return dj
+		}
+		return addrs[i].LastSeen.After(addrs[j].LastSeen)
+	})
+}
+
+// mergePeer folds an incoming record (beacon, snapshot, restore) into the
+// existing one: addresses are unioned rather than replaced, so a DHCP change
+// demotes the old address instead of dropping it.
+func mergePeer(old, in PeerInfo) PeerInfo {
+	byAddr := make(map[string]PeerAddr)
+	add := func(a PeerAddr) {
+		if a.Addr == "" {
+			return
+		}
+		if a.State == "" {
+			a.State = addrUnknown
+		}
+		cur, ok := byAddr[a.Addr]
+		if !ok {
+			byAddr[a.Addr] = a
+			return
+		}
+		if a.LastSeen.After(cur.LastSeen) {
+			cur.LastSeen = a.LastSeen
+		}
+		if a.LastProbe.After(cur.LastProbe) {
+			cur.LastProbe, cur.State = a.LastProbe, a.State
+		}
+		byAddr[a.Addr] = cur
+	}
+	for _, a := range old.Addrs {
+		add(a)
+	}
+	add(PeerAddr{Addr: old.Addr, LastSeen: old.LastSeen})
+	for _, a := range in.Addrs {
+		add(a)
+	}
+	add(PeerAddr{Addr: in.Addr, LastSeen: in.LastSeen})
+
+	out := in
+	out.Addrs = make([]PeerAddr, 0, len(byAddr))
+	for _, a := range byAddr {
+		out.Addrs = append(out.Addrs, a)
+	}
+	sortAddrs(out.Addrs)
+	if len(out.Addrs) > maxPeerAddrs {
+		out.Addrs = out.Addrs[:maxPeerAddrs]
+	}
+	if len(out.Addrs) > 0 {
+		out.Addr = out.Addrs[0].Addr
+		out.APIPort = parsePortFromAddr(out.Addr)
+	}
+	if old.LastSeen.After(out.LastSeen) {
+		out.LastSeen = old.LastSeen
+	}
+	if len(out.PubKey) == 0 {
+		out.PubKey = old.PubKey
+	}
+	if len(out.PubKey) == 32 {
+		out.KeyState = ""
+	} else if out.KeyState == "" {
+		out.KeyState = old.KeyState // the backfill is still running
+	}
+	if out.FreeBytes == 0 {
+		out.FreeBytes = old.FreeBytes // beacons don't carry it, only probes do
+	}
+	if out.Hostname == "" {
+		out.Hostname = old.Hostname
+	}
+	if out.Posture == "" {
+		out.Posture = old.Posture // only beacons carry it
+	}
+	if out.RTTAt.IsZero() {
+		out.RTTms, out.RTTAt = old.RTTms, old.RTTAt // measured here, not beaconed
+	}
+	if out.MixFailAt.IsZero() {
+		out.MixFails, out.MixFailAt = old.MixFails, old.MixFailAt
+	}
+	if out.Caps == nil && in.ProfileGen != 0 && in.ProfileGen == old.ProfileGen {
+		out.Caps = old.Caps // minimal beacon: caps come with the profile
+	}
+	return out
+}
+
+// addrList returns the peer's addresses in the order callers should try them.
+func (p PeerInfo) addrList() []string {
+	if len(p.Addrs) == 0 {
+		if p.Addr == "" {
+			return nil
+		}
+		return []string{p.Addr}
+	}
+	out := make([]string, 0, len(p.Addrs))
+	for _, a := range p.Addrs {
+		out = append(out, a.Addr)
+	}
+	return out
+}
+
+// Get returns one peer by NodeID.
+func (ps *PeerStore) Get(nodeID string) (PeerInfo, bool) {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	p, ok := ps.peers[canonicalNodeID(nodeID)]
+	return p, ok
+}
+
+// setKeyState marks nodeID's record (see key_backfill.go); a peer that
+// meanwhile got a pubkey is left alone.
+func (ps *PeerStore) setKeyState(nodeID, state string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if p, ok := ps.peers[nodeID]; ok && len(p.PubKey) != 32 {
+		p.KeyState = state
+		ps.peers[nodeID] = p
+	}
+}
+
+// ByAddr finds the peer that currently or recently used addr.
+func (ps *PeerStore) ByAddr(addr string) (PeerInfo, bool) {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	for _, p := range ps.peers {
+		for _, a := range p.addrList() {
+			if a == addr {
+				return p, true
+			}
+		}
+	}
+	return PeerInfo{}, false
+}
+
+// MarkAddr records the outcome of a probe or call against one address.
+func (ps *PeerStore) MarkAddr(nodeID, addr string, ok bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	p, found := ps.peers[nodeID]
+	if !found {
+		return
+	}
+	p.Addrs = slices.Clone(p.Addrs) // Get and List hand out the old one
+	for i := range p.Addrs {
+		if p.Addrs[i].Addr != addr {
+			continue
+		}
+		p.Addrs[i].LastProbe = time.Now()
+		if ok {
+			p.Addrs[i].State = addrReachable
+		} else {
+			p.Addrs[i].State = addrUnreachable
+		}
+	}
+	sortAddrs(p.Addrs)
+	if len(p.Addrs) > 0 {
+		p.Addr = p.Addrs[0].Addr
+		p.APIPort = parsePortFromAddr(p.Addr)
+	}
+	ps.peers[nodeID] = p
+	ps.bumpLocked(false)
+}
+
+// applyProfile records what a peer advertised on /peer-info: the profile
+// minimal beacons leave out, plus API version and free storage.
+func (ps *PeerStore) applyProfile(nodeID string, c PeerCaps) {
+	ps.mu.Lock()
+	p, ok := ps.peers[nodeID]
+	if !ok {
+		ps.mu.Unlock()
+		return
+	}
+	orig, now := p, time.Now()
+	material := false
+	var change *keyChange
+	if pk, err := base64.RawURLEncoding.DecodeString(c.PubKey); err == nil && len(pk) == 32 {
+		old := p
+		if len(p.PubKey) != 32 {
+			p.KeyState = ""
+		}
+		p.PubKey = pk
+		change = ps.continuityLocked(old, true, PeerInfo{NodeID: nodeID, PubKey: pk}, mixKeyProof{SignKey: c.SignKey, Sig: c.KeySig, Issued: c.KeyIssued}, &p, now)
+		material = !bytes.Equal(old.PubKey, p.PubKey) || !bytes.Equal(old.PendingKey, p.PendingKey) || !bytes.Equal(old.SignKey, p.SignKey)
+	}
+	if c.Hostname != "" && c.Hostname != p.Hostname {
+		p.Hostname, material = c.Hostname, true
+	}
+	p.APIVersion, p.FreeBytes, p.Caps = c.API, c.FreeBytes, c.Caps
+	ps.peers[nodeID] = p
+	ps.bumpLocked(material)
+	t := ps.noteLocked(orig, true, p, now)
+	onKeyChange, hook := ps.onKeyChange, ps.onTransition
+	ps.mu.Unlock()
+	if change != nil && onKeyChange != nil {
+		onKeyChange(*change)
+	}
+	ps.transitioned(hook, t)
+}
+
+// postToPeer POSTs JSON to path (unversioned, e.g. "/replicate") on p over
+// its best transport, trying addresses freshest first (see peerDo). The path is
+// versioned per peerPath; a 404 on a versioned path retries the legacy one in
+// case the peer was downgraded. Returns the address that accepted the request.
+func (s *Server) postToPeer(p PeerInfo, path string, body []byte, hdr http.Header) (*http.Response, string, error) {
+	return s.postSourceToPeer(p, path, bytesBody(body), hdr)
+}
+
+// bodySource opens a fresh copy of a request body for every attempt, so a
+// body too large to hold (a spilled relay packet) can be sent from disk.
+type bodySource struct {
+	size int64
+	open func() (io.ReadCloser, error)
+}
+
+func bytesBody(b []byte) bodySource {
+	return bodySource{size: int64(len(b)), open: func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(b)), nil
+	}}
+}
+
+func (s *Server) postSourceToPeer(p PeerInfo, path string, body bodySource, hdr http.Header) (*http.Response, string, error) {
+	resp, addr, err := s.postToPeerPath(p, peerPath(p, path), body, hdr)
+	if err == nil && resp.StatusCode == http.StatusNotFound && peerPath(p, path) != path {
+		resp.Body.Close()
+		return s.postToPeerPath(p, path, body, hdr)
+	}
+	return resp, addr, err
+}
+
+func (s *Server) postToPeerPath(p PeerInfo, path string, body bodySource, hdr http.Header) (*http.Response, string, error) {
+	return s.peerDo(p, 0, func(base string) (*http.Request, error) {
+		rc, err := body.open()
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequest(http.MethodPost, base+path, rc)
+		if err != nil {
+			rc.Close()
+			return nil, err
+		}
+		req.ContentLength = body.size
+		req.GetBody = body.open
+		req.Header.Set("Content-Type", "application/json")
+		for k, v := range hdr {
+			req.Header[k] = v
+		}
+		return req, nil
+	})
+}
+
+// postToAddr POSTs to addr, or to the peer that addr belongs to if known so a
+// stale address (e.g. one baked into an onion layer) falls back to fresher ones.
+func (s *Server) postToAddr(addr, path string, body []byte, hdr http.Header) (*http.Response, string, error) {
+	return s.postSourceToAddr(addr, path, bytesBody(body), hdr)
+}
+
+func (s *Server) postSourceToAddr(addr, path string, body bodySource, hdr http.Header) (*http.Response, string, error) {
+	if p, ok := s.peers.ByAddr(addr); ok {
+		return s.postSourceToPeer(p, path, body, hdr)
+	}
+	return s.postSourceToPeer(PeerInfo{Addr: addr}, path, body, hdr)
+}
+
+// GET|HEAD /peer-info (public): cheap identity probe. HEAD answers with
+// headers only so address probing costs almost nothing.
+func (s *Server) handlePeerInfo(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(nodeIDHeader, s.id.NodeID)
+	w.Header().Set(apiVersionHeader, strconv.Itoa(apiVersion))
+	free := s.freeBytes()
+	w.Header().Set(freeBytesHeader, strconv.FormatInt(free, 10))
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	writeJSON(w, PeerCaps{
+		NodeID:    s.id.NodeID,
+		Hostname:  s.id.Hostname,
+		APIPort:   s.cfg.APIPort,
+		PubKey:    base64.RawURLEncoding.EncodeToString(s.nodeKeys.Pub[:]),
+		Org:       s.org.ID,
+		API:       apiVersion,
+		Mode:      s.cfg.Mode,
+		Caps:      s.beaconCaps(),
+		FreeBytes: free,
+		Gen:       s.profileGen(),
+		SignKey:   s.keyProof.SignKey,
+		KeySig:    s.keyProof.Sig,
+		KeyIssued: s.keyProof.Issued,
+	})
+}
+
+// startAddrProbeLoop periodically HEADs every known address of every peer so
+// stale DHCP leases get marked unreachable and sorted last. What the peer
+// advertises is left to the capability cache (peer_caps.go).
+func (s *Server) startAddrProbeLoop(ctx context.Context) {
+	client := &http.Client{Transport: s.egress.wrap("addr-probe", lanTransport), Timeout: addrProbeTO}
+	ticker := time.NewTicker(addrProbeIntv)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, p := range s.peers.List() {
+			if p.NodeID == s.id.NodeID {
+				continue
+			}
+			for _, a := range p.Addrs {
+				if time.Since(a.LastProbe) < addrProbeIntv {
+					continue
+				}
+				ok := probeAddr(ctx, client, a.Addr, peerPath(p, "/peer-info"), p.NodeID)
+				if !ok && a.State != addrUnreachable {
+					log.Printf("[peers] %s addr %s unreachable", p.NodeID[:8], a.Addr)
+				}
+				s.peers.MarkAddr(p.NodeID, a.Addr, ok)
+			}
+		}
+	}
+}
+
+// probeAddr checks that addr answers path (/peer-info) as the expected node
+// (an IP reassigned to another machine counts as unreachable for this peer).
+func probeAddr(ctx context.Context, client *http.Client, addr, path, nodeID string) bool {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, "http://"+addr+path, nil)
+	if err != nil {
+		return false
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK && resp.Header.Get(nodeIDHeader) == nodeID
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+// A record from Get or List is a snapshot: MarkAddr reorders the peer's
+// addresses without touching the ones already handed out, so callers can
+// walk them while probes land (run with -race).
+func TestMarkAddrSnapshot(t *testing.T) {
+	ps := newPeerStore()
+	now := time.Now()
+	ps.Upsert(PeerInfo{NodeID: hexA, Addr: "10.0.0.1:9000", LastSeen: now, Addrs: []PeerAddr{
+		{Addr: "10.0.0.1:9000", LastSeen: now},
+		{Addr: "10.0.0.2:9000", LastSeen: now.Add(-time.Minute)},
+	}})
+	p, _ := ps.Get(hexA)
+	listed := ps.List()[0]
+	want := p.addrList()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range 200 {
+			ps.MarkAddr(hexA, "10.0.0.1:9000", i%2 == 0)
+		}
+	}()
+	for range 200 {
+		p.addrList()
+		listed.addrList()
+	}
+	<-done
+
+	ps.MarkAddr(hexA, "10.0.0.1:9000", false)
+	if got := p.addrList(); !slices.Equal(got, want) {
+		t.Fatalf("snapshot changed: %v, was %v", got, want)
+	}
+	if got, _ := ps.Get(hexA); got.Addrs[0].Addr != "10.0.0.2:9000" {
+		t.Fatalf("unreachable address still first: %v", got.addrList())
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Peer capability cache. What a peer advertises on GET /peer-info (API
+// version, mode, caps, free storage) is fetched at most once per TTL per
+// peer, however many sends ask at once: concurrent callers wait for the one
+// fetch in flight. Peers heard in beacons are refreshed in the background
+// before their entry expires, so sends normally hit a warm entry. A beacon
+// with a new profile generation (see beacon_profile.go), or from an older
+// node a different pubkey or API port, drops the entry.
+
+const (
+	defaultPeerCapsTTL = 5 * time.Minute
+
+	capsFetchTimeout = 5 * time.Second
+	capsNegativeTTL  = 30 * time.Second // failed fetches are retried after this
+	capsRankWait     = 2 * time.Second  // rankPeers waits this long for cold entries
+	capsBody         = 16 << 10
+)
+
+// PeerCaps is the body of GET /peer-info.
+type PeerCaps struct {
+	NodeID    string   `json:"node_id"`
+	Hostname  string   `json:"hostname"`
+	APIPort   int      `json:"api_port"`
+	PubKey    string   `json:"pubkey"`
+	Org       string   `json:"org"`
+	API       int      `json:"api"`
+	Mode      string   `json:"mode"`
+	Caps      []string `json:"caps"`
+	FreeBytes int64    `json:"free_bytes"`
+	Gen       uint64   `json:"gen,omitempty"` // profile generation, as in beacons
+
+	SignKey   string `json:"sign_key,omitempty"` // mix key signature, as in full beacons
+	KeySig    string `json:"key_sig,omitempty"`
+	KeyIssued int64  `json:"key_issued,omitempty"`
+}
+
+type capsEntry struct {
+	caps    PeerCaps
+	err     error
+	fetched time.Time
+	expires time.Time
+	key     string        // capsKey the entry was fetched under
+	done    chan struct{} // closed when the fetch in flight ends; nil = none
+}
+
+type capsCache struct {
+	s   *Server
+	ttl time.Duration
+
+	mu sync.Mutex
+	m  map[string]*capsEntry
+
+	hits, fetches, invalidations atomic.Uint64
+}
+
+func newCapsCache(s *Server, ttl time.Duration) *capsCache {
+	if ttl <= 0 {
+		ttl = defaultPeerCapsTTL
+	}
+	return &capsCache{s: s, ttl: ttl, m: make(map[string]*capsEntry)}
+}
+
+// capsKey is what a cached entry is valid for: a changed profile
+// generation, pubkey or port means the peer's profile changed (or a
+// different node process is behind the same NodeID).
+func capsKey(p PeerInfo) string {
+	if p.ProfileGen != 0 {
+		return "g" + strconv.FormatUint(p.ProfileGen, 10) + ":" + strconv.Itoa(p.APIPort)
+	}
+	return base64.RawURLEncoding.EncodeToString(p.PubKey) + ":" + strconv.Itoa(p.APIPort)
+}
+
+// fetchProfile refreshes nodeID's profile in the background after a beacon
+// announced a generation we don't have.
+func (s *Server) fetchProfile(nodeID string) {
+	go func() {
+		defer recoverOnce("peer-caps")
+		ctx, cancel := context.WithTimeout(context.Background(), 2*capsFetchTimeout)
+		defer cancel()
+		if _, err := s.peerCaps.GetOrFetch(ctx, nodeID); err != nil {
+			log.Printf("[peers] %.8s profile fetch: %v", nodeID, err)
+		}
+	}()
+}
+
+// GetOrFetch returns nodeID's capabilities, fetching /peer-info if the
+// cached entry is missing, expired or invalidated.
+func (c *capsCache) GetOrFetch(ctx context.Context, nodeID string) (PeerCaps, error) {
+	return c.get(ctx, nodeID, false)
+}
+
+func (c *capsCache) get(ctx context.Context, nodeID string, force bool) (PeerCaps, error) {
+	for {
+		p, ok := c.s.peers.Get(nodeID)
+		if !ok {
+			return PeerCaps{}, errors.New("unknown peer")
+		}
+		key := capsKey(p)
+		c.mu.Lock()
+		e := c.m[nodeID]
+		if e != nil && e.key != key {
+			delete(c.m, nodeID)
+			c.invalidations.Add(1)
+			e = nil
+		}
+		if e != nil && e.done != nil {
+			wait := e.done
+			c.mu.Unlock()
+			select {
+			case <-wait:
+				force = false // the fetch we waited for is fresh enough
+				continue
+			case <-ctx.Done():
+				return PeerCaps{}, ctx.Err()
+			}
+		}
+		if e != nil && !force && time.Now().Before(e.expires) {
+			caps, err := e.caps, e.err
+			c.mu.Unlock()
+			c.hits.Add(1)
+			return caps, err
+		}
+		ne := &capsEntry{key: key, done: make(chan struct{})}
+		if e != nil {
+			ne.caps, ne.err, ne.fetched = e.caps, e.err, e.fetched // shown while refreshing
+		}
+		c.m[nodeID] = ne
+		c.mu.Unlock()
+
+		// the fetch outlives a cancelled caller: others may be waiting on it
+		caps, err := c.fetch(p)
+		now := time.Now()
+		c.mu.Lock()
+		ne.caps, ne.err, ne.fetched = caps, err, now
+		ne.expires = now.Add(c.ttl)
+		if err != nil {
+			ne.expires = now.Add(capsNegativeTTL)
+		}
+		close(ne.done)
+		ne.done = nil
+		c.mu.Unlock()
+		if err == nil {
+			c.s.peers.applyProfile(nodeID, caps)
+		}
+		return caps, err
+	}
+}
+
+func (c *capsCache) fetch(p PeerInfo) (PeerCaps, error) {
+	c.fetches.Add(1)
+	resp, _, err := c.s.getFromPeer(p, http.MethodGet, peerPath(p, "/peer-info"), capsFetchTimeout)
+	if err != nil {
+		return PeerCaps{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return PeerCaps{}, fmt.Errorf("peer-info: HTTP %d", resp.StatusCode)
+	}
+	b, err := readPeerBody(resp, capsBody)
+	if err != nil {
+		return PeerCaps{}, err
+	}
+	var caps PeerCaps
+	if err := json.Unmarshal(b, &caps); err != nil {
+		return PeerCaps{}, fmt.Errorf("peer-info: %w", err)
+	}
+	if caps.NodeID != p.NodeID {
+		return PeerCaps{}, fmt.Errorf("peer-info: answered by %.8s", caps.NodeID)
+	}
+	return caps, nil
+}
+
+// startCapsRefreshLoop refreshes entries of peers heard in recent beacons
+// before they expire.
+func (s *Server) startCapsRefreshLoop(ctx context.Context) {
+	c := s.peerCaps
+	ticker := time.NewTicker(c.ttl / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		heard := 3 * s.cfg.BroadcastIntv
+		for _, p := range s.peers.List() {
+			if p.NodeID == s.id.NodeID || time.Since(p.LastSeen) > heard {
+				continue
+			}
+			c.mu.Lock()
+			e := c.m[p.NodeID]
+			due := e == nil || (e.done == nil && time.Until(e.expires) < c.ttl/4)
+			c.mu.Unlock()
+			if due {
+				_, _ = c.get(ctx, p.NodeID, true)
+			}
+		}
+	}
+}
+
+// withCaps fills the fields rankPeers scores on from the cache, fetching
+// cold entries in parallel for at most capsRankWait. Caps stay as the last
+// beacon said: beacons carry the dynamic ones (lowdisk) and are fresher.
+func (s *Server) withCaps(peers []PeerInfo) {
+	ctx, cancel := context.WithTimeout(context.Background(), capsRankWait)
+	defer cancel()
+	var wg sync.WaitGroup
+	for i := range peers {
+		wg.Add(1)
+		go func(p *PeerInfo) {
+			defer wg.Done()
+			caps, err := s.peerCaps.GetOrFetch(ctx, p.NodeID)
+			if err != nil {
+				return
+			}
+			p.APIVersion, p.FreeBytes = caps.API, caps.FreeBytes
+		}(&peers[i])
+	}
+	wg.Wait()
+}
+
+type capsView struct {
+	NodeID   string    `json:"node_id"`
+	Caps     *PeerCaps `json:"caps,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Fetched  time.Time `json:"fetched,omitempty"`
+	Expires  time.Time `json:"expires,omitempty"`
+	Fresh    bool      `json:"fresh"`
+	Fetching bool      `json:"fetching"`
+}
+
+// GET /peers/capabilities (control): the cache, with hit/fetch counters.
+func (s *Server) handlePeerCapabilities(w http.ResponseWriter, r *http.Request) {
+	c := s.peerCaps
+	now := time.Now()
+	c.mu.Lock()
+	out := make([]capsView, 0, len(c.m))
+	for id, e := range c.m {
+		v := capsView{NodeID: id, Fetched: e.fetched, Expires: e.expires, Fresh: now.Before(e.expires), Fetching: e.done != nil}
+		if e.err != nil {
+			v.Error = e.err.Error()
+		} else if !e.fetched.IsZero() {
+			caps := e.caps
+			v.Caps = &caps
+		}
+		out = append(out, v)
+	}
+	c.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].NodeID < out[j].NodeID })
+	writeJSON(w, map[string]any{
+		"ttl_seconds":   int(c.ttl.Seconds()),
+		"hits":          c.hits.Load(),
+		"fetches":       c.fetches.Load(),
+		"invalidations": c.invalidations.Load(),
+		"peers":         out,
+	})
+}
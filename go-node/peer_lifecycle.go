@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Peer lifecycle. GUIs want to hear that a peer appeared, went stale, came
+// back, was banned or removed without diffing /peers every second, so the
+// PeerStore classifies each peer as active, stale (not heard for
+// --peer-stale-after) or banned (a duplicate identity, see identity_dup.go)
+// and reports every transition with the peer's state before and after.
+// Upsert and profile fetches report appearances, returns and changes of
+// address, hostname, key, API version or caps; a sweep every
+// peerSweepIntv reports staleness and bans, and drops peers unseen for
+// --peer-prune-after. DELETE /peers?node_id= removes one by hand.
+//
+// Every transition goes into a per-peer ring (GET /peers/history). Events
+// (peer.appeared, peer.updated, peer.stale, peer.returned, peer.banned,
+// peer.unbanned, peer.removed) go to webhooks, /events and the DLL event
+// callback, at most one per peer per peerEventGap: transitions in between
+// are folded into one event with the first prev and the last next state,
+// and dropped when the peer ended up where it started.
+
+const (
+	peerActive = "active"
+	peerStale  = "stale"
+	peerBanned = "banned"
+
+	defaultPeerStaleAfter = 30 * time.Second
+
+	peerSweepIntv    = 5 * time.Second
+	peerEventGap     = 10 * time.Second
+	peerHistoryKeep  = 64   // transitions per peer
+	peerHistoryPeers = 2048 // peers with a history; the quietest is dropped beyond it
+
+	peerAppeared  = "appeared"
+	peerUpdated   = "updated"
+	peerGoneStale = "stale"
+	peerReturned  = "returned"
+	peerBan       = "banned"
+	peerUnban     = "unbanned"
+	peerRemoved   = "removed"
+	peerKeyEvent  = "key_changed" // history only; the event is peer.key_changed
+)
+
+// peerSnap is what a transition shows of a peer: identifiers, never keys.
+type peerSnap struct {
+	State      string    `json:"state"`
+	Addr       string    `json:"addr,omitempty"`
+	Hostname   string    `json:"hostname,omitempty"`
+	LastSeen   time.Time `json:"last_seen,omitzero"`
+	APIVersion int       `json:"api_version,omitempty"`
+	Caps       []string  `json:"caps,omitempty"`
+	KeyFP      string    `json:"key_fp,omitempty"` // first 8 bytes of SHA-256 of the mix key, hex
+	KeyState   string    `json:"key_state,omitempty"`
+}
+
+func snapPeer(p PeerInfo, state string) *peerSnap {
+	s := &peerSnap{State: state, Addr: p.Addr, Hostname: p.Hostname, LastSeen: p.LastSeen, APIVersion: p.APIVersion, Caps: p.Caps, KeyState: p.KeyState}
+	if len(p.PubKey) > 0 {
+		sum := sha256.Sum256(p.PubKey)
+		s.KeyFP = hex.EncodeToString(sum[:8])
+	}
+	return s
+}
+
+// changed lists the fields that differ between a and b, leaving out state
+// and last_seen.
+func (a *peerSnap) changed(b *peerSnap) []string {
+	var out []string
+	if a.Addr != b.Addr {
+		out = append(out, "addr")
+	}
+	if a.Hostname != b.Hostname {
+		out = append(out, "hostname")
+	}
+	if a.KeyFP != b.KeyFP || a.KeyState != b.KeyState {
+		out = append(out, "key")
+	}
+	if a.APIVersion != b.APIVersion {
+		out = append(out, "api_version")
+	}
+	if !slices.Equal(a.Caps, b.Caps) {
+		out = append(out, "caps")
+	}
+	return out
+}
+
+// peerTransition is one lifecycle change of a peer.
+type peerTransition struct {
+	NodeID    string    `json:"node_id"`
+	Event     string    `json:"event"`
+	Changed   []string  `json:"changed,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	Prev      *peerSnap `json:"prev,omitempty"` // nil: the peer was new
+	Next      *peerSnap `json:"next,omitempty"` // nil: the peer is gone
+	At        time.Time `json:"at"`
+	Coalesced int       `json:"coalesced,omitempty"` // transitions folded into this event
+}
+
+// freshState is active or stale by when p was last heard.
+func (ps *PeerStore) freshState(p PeerInfo, now time.Time) string {
+	if ps.staleAfter > 0 && now.Sub(p.LastSeen) > ps.staleAfter {
+		return peerStale
+	}
+	return peerActive
+}
+
+// noteLocked classifies p after a write and returns the transition from
+// old, if any; callers hold ps.mu.
+func (ps *PeerStore) noteLocked(old PeerInfo, existed bool, p PeerInfo, now time.Time) *peerTransition {
+	prevState := ps.life[p.NodeID]
+	state := ps.freshState(p, now)
+	if prevState == peerBanned {
+		state = peerBanned // only the sweep lifts a ban
+	}
+	ps.life[p.NodeID] = state
+	next := snapPeer(p, state)
+	if !existed {
+		return &peerTransition{NodeID: p.NodeID, Event: peerAppeared, Next: next, At: now}
+	}
+	prev := snapPeer(old, prevState)
+	t := &peerTransition{NodeID: p.NodeID, Event: peerUpdated, Changed: prev.changed(next), Prev: prev, Next: next, At: now}
+	if prevState == peerStale && state == peerActive {
+		t.Event = peerReturned
+	} else if len(t.Changed) == 0 {
+		return nil
+	}
+	return t
+}
+
+// transitioned hands ts to the lifecycle hook; called without ps.mu.
+func (ps *PeerStore) transitioned(hook func([]peerTransition), ts ...*peerTransition) {
+	var out []peerTransition
+	for _, t := range ts {
+		if t != nil {
+			out = append(out, *t)
+		}
+	}
+	if hook != nil && len(out) > 0 {
+		hook(out)
+	}
+}
+
+// Remove drops nodeID from the store. reason goes into the transition.
+func (ps *PeerStore) Remove(nodeID, reason string) bool {
+	nodeID = canonicalNodeID(nodeID)
+	ps.mu.Lock()
+	p, ok := ps.peers[nodeID]
+	if !ok {
+		ps.mu.Unlock()
+		return false
+	}
+	t := &peerTransition{NodeID: nodeID, Event: peerRemoved, Reason: reason, Prev: snapPeer(p, ps.life[nodeID]), At: time.Now()}
+	delete(ps.peers, nodeID)
+	delete(ps.life, nodeID)
+	ps.bumpLocked(true)
+	hook := ps.onTransition
+	ps.mu.Unlock()
+	ps.transitioned(hook, t)
+	return true
+}
+
+// sweepLifecycle moves peers between active, stale and banned and drops
+// those unseen for pruneAfter (0 = never). banned holds the NodeIDs under
+// a ban now.
+func (ps *PeerStore) sweepLifecycle(now time.Time, pruneAfter time.Duration, banned map[string]bool) {
+	ps.mu.Lock()
+	var ts []*peerTransition
+	for id, p := range ps.peers {
+		prevState := ps.life[id]
+		if pruneAfter > 0 && now.Sub(p.LastSeen) > pruneAfter && !banned[id] {
+			ts = append(ts, &peerTransition{NodeID: id, Event: peerRemoved, Reason: "pruned", Prev: snapPeer(p, prevState), At: now})
+			delete(ps.peers, id)
+			delete(ps.life, id)
+			ps.bumpLocked(true)
+			continue
+		}
+		state := ps.freshState(p, now)
+		if banned[id] {
+			state = peerBanned
+		}
+		if state == prevState {
+			continue
+		}
+		ps.life[id] = state
+		if prevState == "" {
+			continue // restored before anyone listened
+		}
+		t := &peerTransition{NodeID: id, Prev: snapPeer(p, prevState), Next: snapPeer(p, state), At: now}
+		switch {
+		case state == peerBanned:
+			t.Event, t.Reason = peerBan, alertDupID
+		case prevState == peerBanned:
+			t.Event = peerUnban
+		case state == peerStale:
+			t.Event = peerGoneStale
+		default:
+			t.Event = peerReturned
+		}
+		ts = append(ts, t)
+	}
+	hook := ps.onTransition
+	ps.mu.Unlock()
+	ps.transitioned(hook, ts...)
+}
+
+// lifeState returns nodeID's lifecycle state, "" if unknown.
+func (ps *PeerStore) lifeState(nodeID string) string {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	return ps.life[nodeID]
+}
+
+// peerEvents keeps the per-peer history and debounces events.
+type peerEvents struct {
+	emit func(typ string, data any)
+
+	mu      sync.Mutex
+	hist    map[string][]peerTransition // newest last
+	emitted map[string]time.Time        // last event per peer
+	held    map[string]*peerTransition  // folded while within peerEventGap
+}
+
+func newPeerEvents(emit func(typ string, data any)) *peerEvents {
+	return &peerEvents{emit: emit, hist: make(map[string][]peerTransition), emitted: make(map[string]time.Time), held: make(map[string]*peerTransition)}
+}
+
+// record is the PeerStore's lifecycle hook.
+func (pe *peerEvents) record(ts []peerTransition) {
+	var out []peerTransition
+	pe.mu.Lock()
+	for _, t := range ts {
+		pe.remember(t)
+		if t.Event == peerKeyEvent {
+			continue
+		}
+		if h := pe.held[t.NodeID]; h != nil {
+			h.Event, h.Next, h.At, h.Reason = t.Event, t.Next, t.At, t.Reason
+			h.Coalesced++
+			continue
+		}
+		if t.At.Sub(pe.emitted[t.NodeID]) < peerEventGap {
+			h := t
+			h.Coalesced = 1
+			pe.held[t.NodeID] = &h
+			continue
+		}
+		pe.emitted[t.NodeID] = t.At
+		out = append(out, t)
+	}
+	pe.mu.Unlock()
+	pe.send(out)
+}
+
+// remember appends t to its peer's ring; callers hold pe.mu.
+func (pe *peerEvents) remember(t peerTransition) {
+	h, ok := pe.hist[t.NodeID]
+	if !ok && len(pe.hist) >= peerHistoryPeers {
+		var quiet string
+		var at time.Time
+		for id, hs := range pe.hist {
+			if last := hs[len(hs)-1].At; quiet == "" || last.Before(at) {
+				quiet, at = id, last
+			}
+		}
+		delete(pe.hist, quiet)
+		delete(pe.emitted, quiet)
+	}
+	h = append(h, t)
+	if over := len(h) - peerHistoryKeep; over > 0 {
+		h = append([]peerTransition(nil), h[over:]...)
+	}
+	pe.hist[t.NodeID] = h
+}
+
+// flush emits folded events whose gap is over.
+func (pe *peerEvents) flush(now time.Time) {
+	var out []peerTransition
+	pe.mu.Lock()
+	for id, h := range pe.held {
+		if now.Sub(pe.emitted[id]) < peerEventGap {
+			continue
+		}
+		delete(pe.held, id)
+		if h.Prev != nil && h.Next != nil {
+			if h.Changed = h.Prev.changed(h.Next); h.Prev.State == h.Next.State && len(h.Changed) == 0 {
+				continue // flapped back to where it was
+			}
+		}
+		pe.emitted[id] = now
+		out = append(out, *h)
+	}
+	pe.mu.Unlock()
+	pe.send(out)
+}
+
+func (pe *peerEvents) send(ts []peerTransition) {
+	for _, t := range ts {
+		pe.emit("peer."+t.Event, t)
+	}
+}
+
+// history returns nodeID's recorded transitions, oldest first.
+func (pe *peerEvents) history(nodeID string) []peerTransition {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	return append([]peerTransition{}, pe.hist[nodeID]...)
+}
+
+// startPeerLifecycleLoop sweeps the PeerStore and flushes folded events
+// every peerSweepIntv.
+func (s *Server) startPeerLifecycleLoop(ctx context.Context) {
+	t := time.NewTicker(peerSweepIntv)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		now := time.Now()
+		banned := map[string]bool{}
+		for _, c := range s.dups.conflicts(now) {
+			if !c.Self {
+				banned[c.NodeID] = true
+			}
+		}
+		s.peers.sweepLifecycle(now, s.cfg.PeerPruneAfter, banned)
+		s.peerLog.flush(now)
+	}
+}
+
+// GET /peers/history?node_id=<id> (control): one peer's recent lifecycle
+// transitions, oldest first.
+func (s *Server) handlePeerHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	id, ok := s.nodeIDParam(w, "node_id", r.URL.Query().Get("node_id"))
+	if !ok {
+		return
+	}
+	if id == "" {
+		http.Error(w, "node_id required", http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, map[string]any{
+		"node_id":     id,
+		"state":       s.peers.lifeState(id),
+		"transitions": s.peerLog.history(id),
+	})
+}
+
+// DELETE /peers?node_id=<id> (control): forget a peer. It comes back with
+// its next beacon.
+func (s *Server) handlePeerRemove(w http.ResponseWriter, r *http.Request) {
+	id, ok := s.nodeIDParam(w, "node_id", r.URL.Query().Get("node_id"))
+	if !ok {
+		return
+	}
+	if id == "" {
+		http.Error(w, "node_id required", http.StatusBadRequest)
+		return
+	}
+	if !s.peers.Remove(id, "operator") {
+		http.Error(w, "no such peer", http.StatusNotFound)
+		return
+	}
+	log.Printf("[peers] removed %.8s by request", id)
+	writeJSON(w, map[string]any{"removed": id})
+}
@@ -2,11 +2,12 @@
 package main
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
-	"math/rand"
+	"log"
 	"net"
 	"os"
 	"strconv"
@@ -21,15 +22,50 @@ import (
 
 func newPeerStore() *PeerStore {
 	return &PeerStore{
-		peers: make(map[string]PeerInfo),
+		peers:         make(map[string]PeerInfo),
+		changed:       make(chan struct{}, 1),
+		keyQuarantine: defaultKeyChangeQuarantine,
+		life:          make(map[string]string),
+		staleAfter:    defaultPeerStaleAfter,
 	}
 }
 
-// Upsert inserts or updates a peer by NodeID.
+// Upsert inserts or updates a peer by NodeID, keeping previously seen
+// addresses (see mergePeer).
 func (ps *PeerStore) Upsert(p PeerInfo) {
+	ps.upsertProved(p, mixKeyProof{})
+}
+
+// upsertProved is Upsert for a record whose mix key came with proof (a full
+// beacon). A changed key goes through the continuity check.
+func (ps *PeerStore) upsertProved(p PeerInfo, proof mixKeyProof) {
+	p.NodeID = canonicalNodeID(p.NodeID)
+	now := time.Now()
+	ps.mu.Lock()
+	old, existed := ps.peers[p.NodeID]
+	merged := mergePeer(old, p)
+	change := ps.continuityLocked(old, existed, p, proof, &merged, now)
+	ps.peers[p.NodeID] = merged
+	t := ps.noteLocked(old, existed, merged, now)
+	ps.bumpLocked(!existed || old.Addr != merged.Addr || old.Hostname != merged.Hostname ||
+		!bytes.Equal(old.PubKey, merged.PubKey) || !bytes.Equal(old.PendingKey, merged.PendingKey) ||
+		!bytes.Equal(old.SignKey, merged.SignKey) || len(old.Addrs) != len(merged.Addrs))
+	onKeyChange, hook := ps.onKeyChange, ps.onTransition
+	ps.mu.Unlock()
+	if change != nil && onKeyChange != nil {
+		onKeyChange(*change)
+	}
+	ps.transitioned(hook, t)
+}
+
+// watch returns a channel poked whenever a peer appears or its address or
+// key changes; pokes coalesce while the receiver is busy.
+func (ps *PeerStore) watch() <-chan struct{} {
+	c := make(chan struct{}, 1)
 	ps.mu.Lock()
-	defer ps.mu.Unlock()
-	ps.peers[p.NodeID] = p
+	ps.watchers = append(ps.watchers, c)
+	ps.mu.Unlock()
+	return c
 }
 
 // List returns a snapshot copy of all peers.
@@ -47,6 +83,10 @@ func (ps *PeerStore) List() []PeerInfo {
 // === Existing helpers for encrypted peer snapshots (unchanged) ===
 //
 
+// peerSnapshotVersion is bumped to 2 for snapshots whose nonce comes from
+// crypto/rand. v1 blobs were sealed with math/rand nonces and are suspect.
+const peerSnapshotVersion = 2
+
 func deriveSymKeyFromPEM(pemPath string) ([]byte, error) {
 	b, err := os.ReadFile(pemPath)
 	if err != nil {
@@ -66,15 +106,18 @@ func exportPeersSnapshot(selfID string, ps *PeerStore) PeerSnapshot {
 			pkb64 = base64.RawURLEncoding.EncodeToString(p.PubKey)
 		}
 		out = append(out, PeerBrief{
-			NodeID:    p.NodeID,
-			Addr:      p.Addr,
-			Hostname:  p.Hostname,
-			LastSeen:  p.LastSeen,
-			PubKeyB64: pkb64,
+			NodeID:     p.NodeID,
+			Addr:       p.Addr,
+			Hostname:   p.Hostname,
+			LastSeen:   p.LastSeen,
+			PubKeyB64:  pkb64,
+			Addrs:      p.Addrs,
+			APIVersion: p.APIVersion,
+			Caps:       p.Caps,
 		})
 	}
 	return PeerSnapshot{
-		Version: 1,
+		Version: peerSnapshotVersion,
 		NodeID:  selfID,
 		Created: time.Now().UTC(),
 		Peers:   out,
@@ -86,10 +129,11 @@ func encryptSnapshot(key32 []byte, snap PeerSnapshot) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	nonce := make([]byte, chacha20poly1305.NonceSizeX)
-	if _, err := rand.Read(nonce); err != nil {
+	nonce, err := secureRandom(chacha20poly1305.NonceSizeX)
+	if err != nil {
 		return nil, err
 	}
+	snap.Version = peerSnapshotVersion
 	plain, _ := json.Marshal(snap)
 	ct := aead.Seal(nil, nonce, plain, nil)
 	return append(nonce, ct...), nil
@@ -113,6 +157,9 @@ func decryptSnapshot(key32, nonceAndCT []byte) (PeerSnapshot, error) {
 	if err := json.Unmarshal(pt, &snap); err != nil {
 		return snap, err
 	}
+	if snap.Version < peerSnapshotVersion {
+		log.Printf("[peers] snapshot v%d from %s was sealed with a weak (math/rand) nonce; re-save it", snap.Version, snap.NodeID)
+	}
 	return snap, nil
 }
 
@@ -126,7 +173,7 @@ func savePeersEncrypted(path, pemPath, selfID string, ps *PeerStore) error {
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(path, blob, 0600)
+	return writeFileAtomic(path, blob)
 }
 
 func loadPeersEncrypted(path, pemPath string) (PeerSnapshot, error) {
@@ -153,12 +200,15 @@ func mergeSnapshot(ps *PeerStore, snap PeerSnapshot) int {
 			}
 		}
 		ps.Upsert(PeerInfo{
-			NodeID:   b.NodeID,
-			Addr:     b.Addr,
-			APIPort:  parsePortFromAddr(b.Addr),
-			Hostname: b.Hostname,
-			LastSeen: b.LastSeen,
-			PubKey:   pk,
+			NodeID:     b.NodeID,
+			Addr:       b.Addr,
+			APIPort:    parsePortFromAddr(b.Addr),
+			Hostname:   b.Hostname,
+			LastSeen:   b.LastSeen,
+			PubKey:     pk,
+			Addrs:      b.Addrs,
+			APIVersion: b.APIVersion,
+			Caps:       b.Caps,
 		})
 		count++
 	}
@@ -2,8 +2,9 @@ package main
 
 import (
 	"context"
-	"crypto/rand"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"os"
 	"time"
@@ -18,79 +19,178 @@ func loadPeersOnStart(ps *PeerStore, encPath string, key []byte) {
 	if err != nil {
 		return // file missing on first run is normal
 	}
-	aead, err := chacha20poly1305.NewX(key)
+	peers, err := openPeers(data, key)
 	if err != nil {
-		log.Printf("[autosave] AEAD init fail: %v", err)
+		log.Printf("[autosave] %s: %v", encPath, err)
 		return
 	}
+	for _, p := range peers {
+		ps.Upsert(p)
+	}
+	ps.markClean()
+	log.Printf("[autosave] restored %d peers from %s", len(peers), encPath)
+}
+
+// openPeers reverses sealPeers.
+func openPeers(data, key []byte) ([]PeerInfo, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, fmt.Errorf("AEAD init: %w", err)
+	}
 	if len(data) < aead.NonceSize() {
-		log.Printf("[autosave] corrupted peers.enc (too short)")
-		return
+		return nil, errors.New("corrupted peers.enc (too short)")
 	}
 	nonce, ct := data[:aead.NonceSize()], data[aead.NonceSize():]
 	plain, err := aead.Open(nil, nonce, ct, nil)
 	if err != nil {
-		log.Printf("[autosave] decrypt peers.enc fail: %v", err)
-		return
+		return nil, fmt.Errorf("decrypt peers.enc: %w", err)
 	}
-
 	var peers []PeerInfo
 	if err := json.Unmarshal(plain, &peers); err != nil {
-		log.Printf("[autosave] unmarshal fail: %v", err)
+		return nil, fmt.Errorf("unmarshal peers: %w", err)
+	}
+	return peers, nil
+}
+
+const (
+	peersSaveDebounce = 5 * time.Second // after a change, wait for the burst to settle
+	peersSaveIntv     = 5 * time.Minute // seen/probe-only updates are saved this often
+)
+
+// bumpLocked records a change; material ones (new peer, new address or key)
+// trigger a debounced save. Caller holds ps.mu.
+func (ps *PeerStore) bumpLocked(material bool) {
+	if !material {
+		ps.touched++
 		return
 	}
-	for _, p := range peers {
-		ps.Upsert(p)
+	ps.gen++
+	select {
+	case ps.changed <- struct{}{}:
+	default:
+	}
+	for _, c := range ps.watchers {
+		select {
+		case c <- struct{}{}:
+		default:
+		}
 	}
-	log.Printf("[autosave] restored %d peers from %s", len(peers), encPath)
 }
 
-// startAutoSavePeersLoop periodically encrypts and saves the peer list (every 5m).
-func startAutoSavePeersLoop(ctx context.Context, ps *PeerStore, encPath string, key []byte) {
-	// save immediately once
-	savePeersOnce(ps, encPath, key)
+// markClean treats the current state as saved (e.g. right after loading it).
+func (ps *PeerStore) markClean() {
+	ps.mu.Lock()
+	ps.savedGen, ps.savedTouched = ps.gen, ps.touched
+	ps.mu.Unlock()
+}
 
-	ticker := time.NewTicker(5 * time.Minute)
+func (ps *PeerStore) dirty() bool {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	return ps.gen != ps.savedGen || ps.touched != ps.savedTouched
+}
+
+type peersPersistState struct {
+	Generation      uint64     `json:"generation"`
+	SavedGeneration uint64     `json:"saved_generation"`
+	LastSave        *time.Time `json:"last_save,omitempty"`
+	Dirty           bool       `json:"dirty"`
+}
+
+func (ps *PeerStore) persistState() peersPersistState {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	st := peersPersistState{
+		Generation:      ps.gen,
+		SavedGeneration: ps.savedGen,
+		Dirty:           ps.gen != ps.savedGen || ps.touched != ps.savedTouched,
+	}
+	if !ps.lastSave.IsZero() {
+		t := ps.lastSave
+		st.LastSave = &t
+	}
+	return st
+}
+
+// startAutoSavePeersLoop saves peers.enc shortly after the peer set changes,
+// and every 5m if only seen/probe state moved. Clean stores aren't rewritten,
+// and nothing is written in maintenance mode.
+func startAutoSavePeersLoop(ctx context.Context, ps *PeerStore, encPath string, key []byte, m *maintenance) {
+	save := func() {
+		if !m.hold() {
+			return
+		}
+		defer m.release()
+		savePeersIfDirty(ps, encPath, key)
+	}
+	save()
+
+	ticker := time.NewTicker(peersSaveIntv)
 	defer ticker.Stop()
+	var debounce <-chan time.Time
 
 	for {
 		select {
 		case <-ctx.Done():
 			return
+		case <-ps.changed:
+			if debounce == nil {
+				debounce = time.After(peersSaveDebounce)
+			}
+		case <-debounce:
+			debounce = nil
+			save()
 		case <-ticker.C:
-			savePeersOnce(ps, encPath, key)
+			save()
 		}
 	}
 }
 
+// savePeersIfDirty is savePeersOnce when something changed since the last save.
+func savePeersIfDirty(ps *PeerStore, encPath string, key []byte) {
+	if ps.dirty() {
+		savePeersOnce(ps, encPath, key)
+	}
+}
+
 // savePeersOnce serializes peers and writes to ~/.mixnets/peers.enc using the FILE KEY.
 func savePeersOnce(ps *PeerStore, encPath string, key []byte) {
+	ps.mu.RLock()
+	gen, touched := ps.gen, ps.touched
+	ps.mu.RUnlock()
 	peers := ps.List()
 	if len(peers) == 0 {
 		return // nothing to save
 	}
-	data, err := json.MarshalIndent(peers, "", "  ")
+	out, err := sealPeers(peers, key)
 	if err != nil {
-		log.Printf("[autosave] marshal peers: %v", err)
+		log.Printf("[autosave] %v", err)
 		return
 	}
+	if err := writeFileAtomic(encPath, out); err != nil {
+		log.Printf("[autosave] write fail: %v", err)
+		return
+	}
+	ps.mu.Lock()
+	ps.savedGen, ps.savedTouched, ps.lastSave = gen, touched, time.Now()
+	ps.mu.Unlock()
+	log.Printf("[autosave] peers saved -> %s (%d peers, gen %d)", encPath, len(peers), gen)
+}
 
-	aead, err := chacha20poly1305.NewX(key)
+// sealPeers is the peers.enc encoding: the peer list as JSON, sealed with
+// XChaCha20-Poly1305 under key, nonce first.
+func sealPeers(peers []PeerInfo, key []byte) ([]byte, error) {
+	data, err := json.MarshalIndent(peers, "", "  ")
 	if err != nil {
-		log.Printf("[autosave] AEAD init fail: %v", err)
-		return
+		return nil, fmt.Errorf("marshal peers: %w", err)
 	}
-	nonce := make([]byte, aead.NonceSize())
-	if _, err := rand.Read(nonce); err != nil {
-		log.Printf("[autosave] nonce gen fail: %v", err)
-		return
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, fmt.Errorf("AEAD init: %w", err)
 	}
-	ct := aead.Seal(nil, nonce, data, nil)
-	out := append(nonce, ct...)
-
-	if err := os.WriteFile(encPath, out, 0o600); err != nil {
-		log.Printf("[autosave] write fail: %v", err)
-		return
+	nonce, err := secureRandom(aead.NonceSize())
+	if err != nil {
+		return nil, fmt.Errorf("nonce gen: %w", err)
 	}
-	log.Printf("[autosave] peers saved -> %s (%d peers)", encPath, len(peers))
+	return append(nonce, aead.Seal(nil, nonce, data, nil)...), nil
 }
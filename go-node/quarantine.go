@@ -0,0 +1,475 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Received-file quarantine. A file that arrives as a final-hop mix envelope
+// or an assembled libp2p transfer carries a name the sender chose. Instead
+// of landing in the inbox or the store, it is written to
+// ~/.mixnets/quarantine/<id>/payload.bin (the claimed name is never used
+// on disk) next to a meta.json with sender, claimed name, size and hashes.
+// It is listed on GET /quarantine and moves into the regular store (the
+// inbox, or the libp2p store and the catalog) only on POST
+// /quarantine/<id>/accept, or at once when an auto-accept rule covers its
+// sender. Reject deletes it and can tell a mix sender through its trace
+// collector. Nothing here is served on the public port or opened.
+
+const (
+	quarantineHoldDir  = "quarantine" // under BaseDir; scrub.go quarantines chunks under ChunksDir
+	quarantineRules    = "rules.json"
+	quarantinePayload  = "payload.bin"
+	quarantineMeta     = "meta.json"
+	quarantineMaxBytes = 1 << 30 // held payloads in total; more is refused as storage_full
+
+	quarantineMix    = "mix"
+	quarantineLibp2p = "libp2p"
+
+	traceQuarantineRejected = "quarantine-rejected"
+)
+
+var (
+	errQuarantineFull = errors.New("quarantine full")
+	errQuarantineDup  = errors.New("already quarantined")
+
+	quarantineIDRe = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+)
+
+// QuarantineItem is the meta.json of one held file.
+type QuarantineItem struct {
+	ID            string `json:"id"`     // msgid (mix) or manifest ID (libp2p)
+	Source        string `json:"source"` // quarantineMix | quarantineLibp2p
+	Sender        string `json:"sender"` // NodeID, or libp2p peer ID
+	ClaimedName   string `json:"claimed_name"`
+	Name          string `json:"name"` // what accept stores it as
+	Size          int64  `json:"size"`
+	SHA256        string `json:"sha256"`
+	ClaimedSHA256 string `json:"claimed_sha256,omitempty"` // manifest's plaintext hash
+	Logical       uint64 `json:"logical,omitempty"`
+	Created       int64  `json:"created_unix,omitempty"` // manifest timestamp
+	Received      int64  `json:"received_unix"`
+}
+
+// quarantineRule auto-accepts files from Sender up to MaxBytes (0 = any).
+type quarantineRule struct {
+	Sender   string    `json:"sender"`
+	MaxBytes int64     `json:"max_bytes,omitempty"`
+	AddedAt  time.Time `json:"added_at"`
+}
+
+type quarantineStore struct {
+	mu    sync.Mutex
+	dir   string
+	items map[string]*QuarantineItem
+	rules map[string]quarantineRule
+	bytes int64
+}
+
+func newQuarantineStore(paths *EnvPaths) *quarantineStore {
+	qs := &quarantineStore{
+		dir:   filepath.Join(paths.BaseDir, quarantineHoldDir),
+		items: make(map[string]*QuarantineItem),
+		rules: make(map[string]quarantineRule),
+	}
+	if b, err := os.ReadFile(filepath.Join(qs.dir, quarantineRules)); err == nil {
+		var rules []quarantineRule
+		if err := json.Unmarshal(b, &rules); err != nil {
+			log.Printf("[quarantine] ignoring bad %s: %v", quarantineRules, err)
+		}
+		for _, r := range rules {
+			qs.rules[r.Sender] = r
+		}
+	}
+	entries, _ := os.ReadDir(qs.dir)
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(qs.dir, e.Name(), quarantineMeta))
+		var it QuarantineItem
+		if err == nil {
+			err = json.Unmarshal(b, &it)
+		}
+		if err != nil || it.ID != e.Name() {
+			// a hold interrupted before its meta was written
+			log.Printf("[quarantine] removing incomplete %s", e.Name())
+			_ = os.RemoveAll(filepath.Join(qs.dir, e.Name()))
+			continue
+		}
+		qs.items[it.ID] = &it
+		qs.bytes += it.Size
+	}
+	return qs
+}
+
+// quarantineID is id if it is safe as a directory name, else a digest of it.
+func quarantineID(id string) string {
+	if quarantineIDRe.MatchString(id) {
+		return id
+	}
+	return sha256Hex([]byte(id))[:32]
+}
+
+// storedName is the claimed name reduced to a single safe path element.
+func storedName(claimed string) string {
+	n := sanitize(filepath.Base(strings.ReplaceAll(claimed, `\`, "/")))
+	if n == "" || n == "." || n == ".." {
+		n = "file"
+	}
+	return n
+}
+
+// releasedPath is where a released libp2p file goes under storeDir.
+func releasedPath(storeDir string, it QuarantineItem) (string, error) {
+	return safeJoin(storeDir, it.ID+"__"+it.Name)
+}
+
+// hold writes a payload through write into the quarantine and records it.
+// Size and SHA256 of it are filled in from what was written.
+func (qs *quarantineStore) hold(it QuarantineItem, write func(io.Writer) error) (*QuarantineItem, error) {
+	if qs == nil {
+		return nil, errors.New("no quarantine")
+	}
+	it.ID = quarantineID(it.ID)
+	it.Name = storedName(it.ClaimedName)
+	it.Received = time.Now().Unix()
+	qs.mu.Lock()
+	if _, ok := qs.items[it.ID]; ok {
+		qs.mu.Unlock()
+		return nil, errQuarantineDup
+	}
+	if qs.bytes+it.Size > quarantineMaxBytes {
+		qs.mu.Unlock()
+		return nil, errQuarantineFull
+	}
+	qs.items[it.ID] = &QuarantineItem{ID: it.ID} // reserves the ID; unlisted until written
+	qs.mu.Unlock()
+
+	dir := filepath.Join(qs.dir, it.ID)
+	err := qs.writeHeld(dir, &it, write)
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	if err != nil {
+		delete(qs.items, it.ID)
+		_ = os.RemoveAll(dir)
+		return nil, err
+	}
+	qs.items[it.ID] = &it
+	qs.bytes += it.Size
+	cp := it
+	return &cp, nil
+}
+
+func (qs *quarantineStore) writeHeld(dir string, it *QuarantineItem, write func(io.Writer) error) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, quarantinePayload), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	cw := &countingWriter{w: io.MultiWriter(f, h)}
+	err = write(cw)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	it.Size, it.SHA256 = cw.n, hex.EncodeToString(h.Sum(nil))
+	b, _ := json.MarshalIndent(it, "", "  ")
+	return writeFileAtomic(filepath.Join(dir, quarantineMeta), b)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// autoAccept reports whether a rule lets size bytes from sender skip the
+// quarantine.
+func (qs *quarantineStore) autoAccept(sender string, size int64) bool {
+	if qs == nil {
+		return true
+	}
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	r, ok := qs.rules[sender]
+	return ok && (r.MaxBytes == 0 || size <= r.MaxBytes)
+}
+
+// held reports whether id is waiting in the quarantine.
+func (qs *quarantineStore) held(id string) bool {
+	if qs == nil {
+		return false
+	}
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	_, ok := qs.items[quarantineID(id)]
+	return ok
+}
+
+func (qs *quarantineStore) get(id string) (QuarantineItem, string, bool) {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	it, ok := qs.items[id]
+	if !ok || it.SHA256 == "" {
+		return QuarantineItem{}, "", false
+	}
+	return *it, filepath.Join(qs.dir, id, quarantinePayload), true
+}
+
+// drop deletes a held file.
+func (qs *quarantineStore) drop(id string) {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	if it, ok := qs.items[id]; ok {
+		qs.bytes -= it.Size
+		delete(qs.items, id)
+	}
+	if err := os.RemoveAll(filepath.Join(qs.dir, id)); err != nil {
+		log.Printf("[quarantine] remove %s: %v", id, err)
+	}
+}
+
+// list returns the held files, oldest first.
+func (qs *quarantineStore) list() []QuarantineItem {
+	qs.mu.Lock()
+	out := make([]QuarantineItem, 0, len(qs.items))
+	for _, it := range qs.items {
+		if it.SHA256 != "" {
+			out = append(out, *it)
+		}
+	}
+	qs.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Received != out[j].Received {
+			return out[i].Received < out[j].Received
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+func (qs *quarantineStore) saveRulesLocked() {
+	rules := make([]quarantineRule, 0, len(qs.rules))
+	for _, r := range qs.rules {
+		rules = append(rules, r)
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Sender < rules[j].Sender })
+	b, _ := json.MarshalIndent(rules, "", "  ")
+	err := os.MkdirAll(qs.dir, 0700)
+	if err == nil {
+		err = writeFileAtomic(filepath.Join(qs.dir, quarantineRules), b)
+	}
+	if err != nil {
+		log.Printf("[quarantine] save rules: %v", err)
+	}
+}
+
+// quarantineMixFile holds a final-hop file envelope, writing the response.
+// It returns false if the file wasn't held and the caller should store it
+// as before (quarantine off, or an auto-accept rule).
+func (s *Server) quarantineMixFile(w http.ResponseWriter, env *FinalEnvelope, data []byte) bool {
+	if !s.cfg.Quarantine || s.quarantine.autoAccept(env.SenderID, int64(len(data))) {
+		return false
+	}
+	it, err := s.quarantine.hold(QuarantineItem{
+		ID:          env.MsgID,
+		Source:      quarantineMix,
+		Sender:      env.SenderID,
+		ClaimedName: env.Name,
+		Size:        int64(len(data)),
+		Logical:     env.Logical,
+	}, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+	switch {
+	case errors.Is(err, errQuarantineDup):
+		writeJSON(w, map[string]any{"status": "ok", "final": true, "type": "file", "msgid": env.MsgID, "quarantined": true, "duplicate": true})
+		return true
+	case errors.Is(err, errQuarantineFull):
+		log.Printf("[quarantine] full, refusing msgid=%s from %.8s", env.MsgID, env.SenderID)
+		writeStorageFull(w, StorageFull{Status: "storage_full", NodeID: s.id.NodeID, Scope: "quarantine", MsgID: env.MsgID})
+		return true
+	case err != nil:
+		http.Error(w, "quarantine fail: "+err.Error(), http.StatusInternalServerError)
+		return true
+	}
+	log.Printf("[quarantine] held %s from %.8s: %q, %d bytes", it.ID, it.Sender, it.ClaimedName, it.Size)
+	s.emit(eventQuarantineHeld, it)
+	writeJSON(w, map[string]any{"status": "ok", "final": true, "type": "file", "msgid": env.MsgID, "quarantined": true, "quarantine_id": it.ID})
+	return true
+}
+
+// GET /quarantine (control): held files, oldest first.
+func (s *Server) handleQuarantine(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	items := s.quarantine.list()
+	var total int64
+	for _, it := range items {
+		total += it.Size
+	}
+	writeJSON(w, map[string]any{"enabled": s.cfg.Quarantine, "bytes": total, "max_bytes": quarantineMaxBytes, "files": items})
+}
+
+// GET /quarantine/{id} (control): one held file's metadata. The payload is
+// never served.
+func (s *Server) handleQuarantineGet(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	it, _, ok := s.quarantine.get(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "not in quarantine", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, it)
+}
+
+// POST /quarantine/{id}/accept (control): move a held file into the inbox
+// (mix) or the libp2p store and the catalog (libp2p).
+func (s *Server) handleQuarantineAccept(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	it, payload, ok := s.quarantine.get(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "not in quarantine", http.StatusNotFound)
+		return
+	}
+	var stored string
+	switch it.Source {
+	case quarantineMix:
+		data, err := os.ReadFile(payload)
+		if err != nil {
+			http.Error(w, "read payload: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		stored = "file-" + it.ID + "-" + it.Name
+		if !s.storeInbox(w, it.Sender, it.ID, it.Logical, "file", it.Name, stored, data, s.inbox.expiry(0, time.Now())) {
+			return
+		}
+	case quarantineLibp2p:
+		out, err := releasedPath(s.paths.StoreDir, it)
+		if err == nil {
+			err = os.MkdirAll(s.paths.StoreDir, 0o755)
+		}
+		if err == nil {
+			err = os.Rename(payload, out)
+		}
+		if err != nil {
+			http.Error(w, "move payload: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		stored = out
+		s.catalog.observeManifest(FileManifest{ID: it.ID, FileName: it.ClaimedName, Size: it.Size, PlainSHA256: it.SHA256, PeerID: it.Sender, Timestamp: it.Created}, true)
+	default:
+		http.Error(w, "unknown source "+it.Source, http.StatusInternalServerError)
+		return
+	}
+	s.quarantine.drop(it.ID)
+	log.Printf("[audit] quarantine accept %s from %.8s as %s", it.ID, it.Sender, stored)
+	writeJSON(w, map[string]any{"status": "accepted", "id": it.ID, "stored": stored})
+}
+
+// POST /quarantine/{id}/reject[?notify=true&reason=] (control): delete a
+// held file; notify reports the rejection to a mix sender as a trace event.
+func (s *Server) handleQuarantineReject(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	it, _, ok := s.quarantine.get(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "not in quarantine", http.StatusNotFound)
+		return
+	}
+	s.quarantine.drop(it.ID)
+	notified := false
+	if r.URL.Query().Get("notify") == "true" && it.Source == quarantineMix {
+		p, ok := s.peers.Get(it.Sender)
+		notified = ok && p.Addr != ""
+		s.reportTrace(it.Sender, s.trace(it.ID, traceQuarantineRejected, r.URL.Query().Get("reason")))
+	}
+	log.Printf("[audit] quarantine reject %s from %.8s (notify=%v)", it.ID, it.Sender, notified)
+	writeJSON(w, map[string]any{"status": "rejected", "id": it.ID, "notified": notified})
+}
+
+// /quarantine/rules (control): GET lists auto-accept rules, POST
+// {"sender","max_bytes"} adds or replaces one, DELETE ?sender= removes it.
+func (s *Server) handleQuarantineRules(w http.ResponseWriter, r *http.Request) {
+	qs := s.quarantine
+	switch r.Method {
+	case http.MethodGet:
+		qs.mu.Lock()
+		rules := make([]quarantineRule, 0, len(qs.rules))
+		for _, rule := range qs.rules {
+			rules = append(rules, rule)
+		}
+		qs.mu.Unlock()
+		sort.Slice(rules, func(i, j int) bool { return rules[i].Sender < rules[j].Sender })
+		writeJSON(w, rules)
+	case http.MethodPost:
+		var rule quarantineRule
+		if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&rule); err != nil {
+			http.Error(w, "bad json", http.StatusBadRequest)
+			return
+		}
+		rule.Sender = strings.TrimSpace(rule.Sender)
+		if rule.Sender == "" || rule.MaxBytes < 0 {
+			http.Error(w, "sender required, max_bytes >= 0", http.StatusBadRequest)
+			return
+		}
+		rule.AddedAt = time.Now().UTC()
+		qs.mu.Lock()
+		qs.rules[rule.Sender] = rule
+		qs.saveRulesLocked()
+		qs.mu.Unlock()
+		log.Printf("[audit] quarantine auto-accept for %.8s up to %d bytes", rule.Sender, rule.MaxBytes)
+		writeJSON(w, map[string]any{"status": "ok", "rule": rule})
+	case http.MethodDelete:
+		sender := r.URL.Query().Get("sender")
+		qs.mu.Lock()
+		_, ok := qs.rules[sender]
+		delete(qs.rules, sender)
+		if ok {
+			qs.saveRulesLocked()
+		}
+		qs.mu.Unlock()
+		if !ok {
+			http.Error(w, "no rule for sender", http.StatusNotFound)
+			return
+		}
+		log.Printf("[audit] quarantine auto-accept removed for %.8s", sender)
+		writeJSON(w, map[string]any{"status": "ok", "removed": sender})
+	default:
+		http.Error(w, "use GET, POST or DELETE", http.StatusMethodNotAllowed)
+	}
+}
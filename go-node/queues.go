@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"p2pnode-R3/journal"
+)
+
+// Persistent work queues. Work that must outlive a crash (replicates a peer
+// missed, key escrows the keysaver couldn't take) goes into a journal under
+// ~/.mixnets/journal/<queue>.log, sealed with the env FileKey (see the
+// journal package). An item is acknowledged once it is done or given up, so
+// after a restart only unfinished items come back. That is at least once: an
+// item done just before a crash may run again, which both queues tolerate (a
+// peer answers already_have, a repeated escrow finds its receipt).
+//
+// Each queue retries due items every queueTick and when kicked, with backoff
+// from queueRetryMin to queueRetryMax per item, jittered (util.go). GET
+// /queues shows both.
+
+const (
+	journalDir    = "journal" // under BaseDir
+	queueTick     = 15 * time.Second
+	queueRetryMin = 30 * time.Second
+	queueRetryMax = 10 * time.Minute
+	queueMaxItems = 10000
+
+	queueReplicate = "replicate"
+	queueEscrow    = "escrow"
+)
+
+var (
+	errQueueFull = errors.New("queue full")
+	errNoJournal = errors.New("queue journal unavailable")
+
+	queuePending = metricDef{"queue_pending", "items waiting in a persistent queue", "queue"}
+)
+
+type queueTry struct {
+	Attempts  int       `json:"attempts"`
+	NextTry   time.Time `json:"next_try,omitzero"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// workQueue is a journal plus the in-memory retry state of its items.
+// keyOf names an item for deduplication; items with the same key are
+// queued once.
+type workQueue struct {
+	name  string
+	j     *journal.Journal // nil: the journal didn't open, nothing is queued
+	keyOf func([]byte) string
+	gauge *gaugeVec // queue_pending
+
+	mu    sync.Mutex
+	keys  map[string]uint64
+	tries map[uint64]*queueTry
+	kick  chan struct{}
+}
+
+func openWorkQueue(paths *EnvPaths, key []byte, name string, keyOf func([]byte) string, m *metricsRegistry) *workQueue {
+	q := &workQueue{name: name, keyOf: keyOf, gauge: m.gauge(queuePending), keys: make(map[string]uint64), tries: make(map[uint64]*queueTry), kick: make(chan struct{}, 1)}
+	dir := filepath.Join(paths.BaseDir, journalDir)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		log.Printf("[queue] %s: %v; queue disabled", name, err)
+		return q
+	}
+	j, err := journal.Open(filepath.Join(dir, name+".log"), key)
+	if err != nil {
+		log.Printf("[queue] %s: %v; queue disabled", name, err)
+		return q
+	}
+	q.j = j
+	st := j.Stats()
+	if st.Truncated > 0 {
+		log.Printf("[queue] %s: cut %d bytes of a torn or corrupt tail", name, st.Truncated)
+	}
+	for _, r := range j.Pending() {
+		q.keys[keyOf(r.Data)] = r.Offset
+	}
+	if st.Pending > 0 {
+		log.Printf("[queue] %s: %d pending items restored", name, st.Pending)
+	}
+	q.gauge.set(name, float64(st.Pending))
+	return q
+}
+
+// add queues v unless an item with the same key is pending. It returns the
+// item's offset and whether it was added now.
+func (q *workQueue) add(v any) (uint64, bool, error) {
+	if q.j == nil {
+		return 0, false, errNoJournal
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return 0, false, err
+	}
+	k := q.keyOf(b)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if off, ok := q.keys[k]; ok {
+		return off, false, nil
+	}
+	if q.j.Len() >= queueMaxItems {
+		return 0, false, errQueueFull
+	}
+	off, err := q.j.Append(b)
+	if err != nil {
+		return 0, false, err
+	}
+	q.keys[k] = off
+	q.gauge.set(q.name, float64(q.j.Len()))
+	select {
+	case q.kick <- struct{}{}:
+	default:
+	}
+	return off, true, nil
+}
+
+// due returns the items whose next try has come.
+func (q *workQueue) due(now time.Time) []journal.Record {
+	if q.j == nil {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var out []journal.Record
+	for _, r := range q.j.Pending() {
+		if t := q.tries[r.Offset]; t == nil || !now.Before(t.NextTry) {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// done acknowledges r: finished or given up.
+func (q *workQueue) done(r journal.Record) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.j.Ack(r.Offset); err != nil && !errors.Is(err, journal.ErrNotPending) {
+		log.Printf("[queue] %s: ack %d: %v", q.name, r.Offset, err)
+		return
+	}
+	delete(q.keys, q.keyOf(r.Data))
+	delete(q.tries, r.Offset)
+	q.gauge.set(q.name, float64(q.j.Len()))
+}
+
+// failed schedules the item at off for a later try.
+func (q *workQueue) failed(off uint64, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	t := q.tries[off]
+	if t == nil {
+		t = &queueTry{}
+		q.tries[off] = t
+	}
+	t.Attempts++
+	t.LastError = err.Error()
+	backoff := queueRetryMin << min(t.Attempts-1, 8)
+	if backoff > queueRetryMax {
+		backoff = queueRetryMax
+	}
+	t.NextTry = time.Now().Add(jitter(backoff))
+}
+
+// try returns the retry state of the item at off.
+func (q *workQueue) try(off uint64) queueTry {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if t := q.tries[off]; t != nil {
+		return *t
+	}
+	return queueTry{}
+}
+
+func (q *workQueue) stats() journal.Stats {
+	if q.j == nil {
+		return journal.Stats{}
+	}
+	return q.j.Stats()
+}
+
+// runQueue works q until ctx ends. work returns true when the item is done
+// or given up, false with the reason to retry it later.
+func (s *Server) runQueue(ctx context.Context, q *workQueue, work func(journal.Record) (bool, error)) {
+	ticker := time.NewTicker(queueTick)
+	defer ticker.Stop()
+	for {
+		for _, r := range q.due(time.Now()) {
+			if ctx.Err() != nil {
+				return
+			}
+			if ok, err := work(r); ok {
+				q.done(r)
+			} else {
+				q.failed(r.Offset, err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.kick:
+		case <-ticker.C:
+		}
+	}
+}
+
+type queueItemView struct {
+	Offset uint64 `json:"offset"`
+	Item   any    `json:"item"`
+	queueTry
+}
+
+type queueView struct {
+	journal.Stats
+	Items []queueItemView `json:"items"`
+}
+
+func viewQueue[T any](q *workQueue, show func(T) any) queueView {
+	v := queueView{Stats: q.stats(), Items: []queueItemView{}}
+	if q.j == nil {
+		return v
+	}
+	for _, r := range q.j.Pending() {
+		var it T
+		if json.Unmarshal(r.Data, &it) != nil {
+			continue
+		}
+		v.Items = append(v.Items, queueItemView{Offset: r.Offset, Item: show(it), queueTry: q.try(r.Offset)})
+	}
+	return v
+}
+
+// GET /queues (control): the persistent queues with their items.
+func (s *Server) handleQueues(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, map[string]any{
+		queueReplicate: viewQueue(s.replicateQ, func(it replicateRetry) any { it.Env = nil; return it }),
+		queueEscrow:    viewQueue(s.escrowQ, func(it escrowJob) any { return it }),
+	})
+}
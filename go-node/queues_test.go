@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"p2pnode-R3/journal"
+)
+
+// drainQueue runs one pass of q as runQueue would, and returns how many
+// items finished.
+func drainQueue(q *workQueue, work func(journal.Record) (bool, error)) int {
+	n := 0
+	for _, r := range q.due(time.Now()) {
+		if ok, err := work(r); ok {
+			q.done(r)
+			n++
+		} else {
+			q.failed(r.Offset, err)
+		}
+	}
+	return n
+}
+
+// A replicate a peer missed survives a crash, a torn write after it
+// included, reaches the peer after the restart, and stays done across the
+// next one. A crash between the replicate and its ack sends it again,
+// which the peer takes as already_have.
+func TestReplicateQueueSurvivesCrash(t *testing.T) {
+	a, b := newTestServer(t, "a", nil), newTestServer(t, "b", nil)
+	addr := b.selfAddr
+	b.selfAddr = fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	meet(t, a, b)
+	b.selfAddr = addr
+	if rr := callControl(a, http.MethodPost, "/mix/send-file?name=q.txt", a.ctlToken, strings.NewReader("queued")); rr.Code != http.StatusOK {
+		t.Fatalf("send: %d %s", rr.Code, rr.Body)
+	}
+	if n := a.replicateQ.stats().Pending; n != 1 {
+		t.Fatalf("%d retries queued, want 1", n)
+	}
+
+	// crash mid-append of a second item: a torn record after the first
+	path := filepath.Join(a.paths.BaseDir, journalDir, queueReplicate+".log")
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 1, 0, 0xde, 0xad})
+	f.Close()
+
+	a2 := restart(t, a)
+	if st := a2.replicateQ.stats(); st.Pending != 1 || st.Truncated != 6 {
+		t.Fatalf("after the crash: %+v", st)
+	}
+	meet(t, a2, b)
+	// the work is done, then the process dies before the ack
+	for _, r := range a2.replicateQ.due(time.Now()) {
+		if ok, err := a2.retryReplicate(r); !ok {
+			t.Fatal(err)
+		}
+	}
+	if len(b.readChain()) != 1 {
+		t.Fatal("peer never got the block")
+	}
+
+	a3 := restart(t, a2)
+	meet(t, a3, b)
+	if n := drainQueue(a3.replicateQ, a3.retryReplicate); n != 1 {
+		t.Fatalf("%d items finished after the second restart, want 1", n)
+	}
+	if len(b.readChain()) != 1 {
+		t.Fatal("the repeated replicate added a block")
+	}
+	if n := restart(t, a3).replicateQ.stats().Pending; n != 0 {
+		t.Fatalf("%d items back after the ack", n)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reachability. GET /peers/reachability probes every known peer over each
+// transport that supports it and each of its addresses (HEAD /peer-info,
+// checked against X-Node-ID), a few peers at a time with a short timeout.
+// The report also says how long ago the peer's last beacon was heard and
+// whether fanout and mix routing skip it. Reports are cached for
+// reachCacheTTL so GUI refreshes don't re-probe; ?refresh=true forces a
+// new run. Probes don't feed the transport scores or the RTT average.
+
+const (
+	reachCacheTTL    = 15 * time.Second
+	reachTimeout     = 2 * time.Second
+	reachConcurrency = 8
+
+	// why a peer is left out of fanout / routing
+	excludeDuplicate = "duplicate_identity"
+	excludeNoAddr    = "no_address"
+)
+
+type reachProbe struct {
+	Transport string  `json:"transport"`
+	Addr      string  `json:"addr"`
+	OK        bool    `json:"ok"`
+	LatencyMs float64 `json:"latency_ms,omitempty"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type peerReach struct {
+	NodeID     string       `json:"node_id"`
+	Hostname   string       `json:"hostname"`
+	Reachable  bool         `json:"reachable"` // some probe succeeded
+	BeaconAgeS float64      `json:"beacon_age_seconds"`
+	Caps       []string     `json:"caps,omitempty"`
+	Excluded   string       `json:"excluded,omitempty"` // excludeDuplicate | excludeNoAddr
+	Probes     []reachProbe `json:"probes"`
+}
+
+type reachReport struct {
+	At         time.Time   `json:"at"`
+	Cached     bool        `json:"cached"`
+	Transports []string    `json:"transports"` // what this node can speak
+	Reachable  int         `json:"reachable"`
+	Peers      []peerReach `json:"peers"`
+}
+
+// reachCache holds the last report; mu is held for a whole probe run so
+// concurrent callers wait for it instead of probing again.
+type reachCache struct {
+	mu   sync.Mutex
+	last *reachReport
+}
+
+func (s *Server) reachability(refresh bool) reachReport {
+	rc := &s.reach
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if !refresh && rc.last != nil && time.Since(rc.last.At) < reachCacheTTL {
+		rep := *rc.last
+		rep.Cached = true
+		return rep
+	}
+	rep := s.probeReachability()
+	rc.last = &rep
+	return rep
+}
+
+func (s *Server) probeReachability() reachReport {
+	now := time.Now()
+	rep := reachReport{At: now.UTC(), Transports: []string{}, Peers: []peerReach{}}
+	for _, t := range s.transports.transports {
+		rep.Transports = append(rep.Transports, t.Name())
+	}
+	var peers []PeerInfo
+	for _, p := range s.peers.List() {
+		if p.NodeID != s.id.NodeID {
+			peers = append(peers, p)
+		}
+	}
+	out := make([]peerReach, len(peers))
+	sem := make(chan struct{}, reachConcurrency)
+	var wg sync.WaitGroup
+	for i, p := range peers {
+		out[i] = peerReach{
+			NodeID:     p.NodeID,
+			Hostname:   p.Hostname,
+			BeaconAgeS: now.Sub(p.LastSeen).Round(time.Second).Seconds(),
+			Caps:       p.Caps,
+			Probes:     []reachProbe{},
+		}
+		switch {
+		case s.dups.duplicated(p.NodeID):
+			out[i].Excluded = excludeDuplicate
+		case p.Addr == "":
+			out[i].Excluded = excludeNoAddr
+		}
+		wg.Add(1)
+		go func(pr *peerReach, p PeerInfo) {
+			defer wg.Done()
+			defer recoverOnce("reachability")
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			pr.Probes = append(pr.Probes, s.probePeer(p)...)
+			for _, pb := range pr.Probes {
+				pr.Reachable = pr.Reachable || pb.OK
+			}
+		}(&out[i], p)
+	}
+	wg.Wait()
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].Reachable != out[j].Reachable {
+			return out[i].Reachable
+		}
+		return out[i].Hostname < out[j].Hostname
+	})
+	for _, pr := range out {
+		if pr.Reachable {
+			rep.Reachable++
+		}
+	}
+	rep.Peers = out
+	return rep
+}
+
+// probePeer tries every address of every transport p supports.
+func (s *Server) probePeer(p PeerInfo) []reachProbe {
+	var out []reachProbe
+	path := peerPath(p, "/peer-info")
+	for _, t := range s.transports.transports {
+		if !t.Supports(p) {
+			continue
+		}
+		client := &http.Client{Transport: s.egress.wrap("reachability", t.RoundTripper()), Timeout: reachTimeout}
+		for _, base := range t.BaseURLs(p) {
+			pb := reachProbe{Transport: t.Name(), Addr: base[strings.Index(base, "://")+3:]}
+			start := time.Now()
+			resp, err := client.Head(base + path)
+			elapsed := time.Since(start)
+			switch {
+			case err != nil:
+				pb.Error = err.Error()
+			case resp.StatusCode != http.StatusOK:
+				pb.Error = resp.Status
+			case resp.Header.Get(nodeIDHeader) != p.NodeID:
+				pb.Error = fmt.Sprintf("answered by %.8s", resp.Header.Get(nodeIDHeader))
+			default:
+				pb.OK = true
+				pb.LatencyMs = float64(elapsed.Microseconds()) / 1000
+			}
+			if resp != nil {
+				resp.Body.Close()
+			}
+			out = append(out, pb)
+		}
+	}
+	return out
+}
+
+// GET /peers/reachability[?refresh=true] (control)
+func (s *Server) handlePeerReachability(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, s.reachability(r.URL.Query().Get("refresh") == "true"))
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// Recovery actions reported per block.
+const (
+	recoverWrite         = "write"
+	recoverSkipCollision = "skip-collision"
+	recoverSkipNoChunk   = "skip-no-chunk"
+	recoverSkipNoKey     = "skip-no-key"
+	recoverSkipBadName   = "skip-bad-name" // the block's name can't be written safely
+	recoverFailed        = "failed"
+)
+
+type recoverItem struct {
+	Hash      string `json:"hash"`
+	Name      string `json:"name"`
+	Target    string `json:"target"`
+	Size      int    `json:"size"`
+	Collision bool   `json:"collision"`
+	Action    string `json:"action"`
+	KeyFrom   string `json:"key_from,omitempty"` // "keysaver": not local, fetched (or, dry run, to fetch)
+	Error     string `json:"error,omitempty"`
+}
+
+type recoverPlan struct {
+	ID        string        `json:"id,omitempty"` // transfer ID; cancel with POST /recover/<id>/cancel
+	DryRun    bool          `json:"dry_run"`
+	OutDir    string        `json:"out_dir"`
+	Items     []recoverItem `json:"items"`
+	Written   int           `json:"written"`
+	Cancelled bool          `json:"cancelled,omitempty"` // stopped early; Items is what was done
+
+	Batch      string   `json:"batch,omitempty"`      // ?batch=: only this batch's members
+	Missing    []string `json:"missing,omitempty"`    // batch members with no block here
+	Incomplete bool     `json:"incomplete,omitempty"` // some batch member can't be (or wasn't) restored
+}
+
+// planRecovery walks the chain and decides, per block, where its plaintext
+// would be restored. execute=true performs the writes using the same plan.
+// Progress goes to the transfer t, which stops the walk when cancelled.
+// Batch members keep their folders under outDir.
+func (s *Server) planRecovery(t *transfer, outDir, onlyHash, batch, user string, overwrite, execute bool) recoverPlan {
+	plan := recoverPlan{ID: t.ID, DryRun: !execute, OutDir: outDir, Batch: batch}
+	done := make(map[string]struct{})
+	blocks := s.readChain()
+	deleted := tombstonesIn(blocks)
+	for _, b := range blocks {
+		if t.ctx.Err() != nil {
+			plan.Cancelled = true
+			break
+		}
+		if _, gone := deleted[b.Hash]; gone || !b.isData() || (onlyHash != "" && b.Hash != onlyHash) || (batch != "" && b.Batch != batch) {
+			continue
+		}
+		if _, ok := done[b.Hash]; ok {
+			continue
+		}
+		done[b.Hash] = struct{}{}
+
+		chunkPath := filepath.Join(s.paths.ChunksDir, b.Hash+".bin")
+		k, keyErr := findFileKey(s.paths, b.Hash, b.Name)
+		it := recoverItem{Hash: b.Hash, Size: b.Size}
+		var nameErr error
+		// a sealed name (metapad.go) needs the key; without it the target
+		// uses the sealed form
+		target := func(k *[32]byte) {
+			it.Name, _ = blockName(b, k)
+			it.Target, nameErr = recoverTarget(outDir, it.Name, b.Batch != "")
+			_, err := os.Stat(it.Target)
+			it.Collision = nameErr == nil && err == nil
+		}
+		if keyErr == nil {
+			target(&k)
+		} else {
+			target(nil)
+		}
+		if keyErr != nil && len(s.keysavers.order()) > 0 && nameErr == nil && fileExists(chunkPath) && (!it.Collision || overwrite) {
+			// a dry run doesn't pull key material; it assumes the fetch works
+			it.KeyFrom, keyErr = "keysaver", nil
+			if execute {
+				if k, keyErr = s.fetchEscrowedKey(b.Hash, b.Name); keyErr == nil && b.NameSealed {
+					target(&k)
+				}
+			}
+		}
+		switch {
+		case nameErr != nil:
+			it.Action = recoverSkipBadName
+			it.Error = nameErr.Error()
+		case !fileExists(chunkPath):
+			it.Action = recoverSkipNoChunk
+		case keyErr != nil:
+			it.Action = recoverSkipNoKey
+			if it.KeyFrom != "" {
+				it.Error = keyErr.Error()
+			}
+		case it.Collision && !overwrite:
+			it.Action = recoverSkipCollision
+		default:
+			it.Action = recoverWrite
+		}
+
+		if execute && it.Action == recoverWrite {
+			if err := restoreChunk(chunkPath, k, b, it.Target); err != nil {
+				it.Action = recoverFailed
+				it.Error = err.Error()
+				s.logAccess(b.Hash, accessViaRecover, user, accessFailed)
+			} else {
+				plan.Written++
+				s.logAccess(b.Hash, accessViaRecover, user, accessOK)
+			}
+		}
+		plan.Items = append(plan.Items, it)
+		snap := plan
+		s.transfers.update(t, func(t *transfer) { t.Plan = &snap })
+	}
+	if batch != "" {
+		s.checkBatchRecovery(&plan, done)
+	}
+	snap := plan
+	s.transfers.update(t, func(t *transfer) { t.Plan = &snap })
+	if execute {
+		log.Printf("[recover] wrote %d files into %s (cancelled: %v)", plan.Written, outDir, plan.Cancelled)
+	}
+	return plan
+}
+
+// checkBatchRecovery lists the members of plan's batch that have no block
+// here (from the local batch record, when this node sent it) and flags a
+// batch that won't come back whole.
+func (s *Server) checkBatchRecovery(plan *recoverPlan, done map[string]struct{}) {
+	if rec, ok := s.batches.get(plan.Batch); ok {
+		for _, m := range rec.Members {
+			if _, ok := done[m.Hash]; !ok || m.Hash == "" {
+				plan.Missing = append(plan.Missing, m.Name)
+			}
+		}
+	}
+	plan.Incomplete = len(plan.Missing) > 0 || plan.Cancelled || len(plan.Items) == 0
+	for _, it := range plan.Items {
+		if it.Action != recoverWrite {
+			plan.Incomplete = true
+		}
+	}
+}
+
+// recoverTarget is where recovery writes a block named name under outDir;
+// only batch members keep their folders.
+func recoverTarget(outDir, name string, batch bool) (string, error) {
+	if batch {
+		return batchTarget(outDir, name)
+	}
+	return safeJoin(outDir, sanitize(name))
+}
+
+func restoreChunk(chunkPath string, k [32]byte, b Block, target string) error {
+	ct, err := os.ReadFile(chunkPath)
+	if err != nil {
+		return err
+	}
+	plain, err := aeadOpenWithKey(k[:], ct)
+	if err != nil {
+		return err
+	}
+	if plain, err = openPayload(b, plain); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(target, plain, 0600)
+}
+
+func fileExists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
+}
+
+// POST /recover?out=<dir>[&hash=<sha256>|&batch=<id>][&overwrite=true][&dry_run=true][&async=true][&user=<hint>]
+// Restores decrypted files for chain blocks whose chunk and key are local.
+// With async=true it answers 202 with the transfer record at once; follow
+// it on GET /recover/<id>.
+func (s *Server) handleRecover(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	outDir := q.Get("out")
+	if outDir == "" {
+		outDir = filepath.Join(s.paths.BaseDir, "recovered")
+	}
+	hash, ok := s.catalogHash(w, q.Get("catalog"), q.Get("hash"))
+	if !ok {
+		return
+	}
+	batch, overwrite, execute := q.Get("batch"), q.Get("overwrite") == "true", !isDryRun(r)
+	user := accessUser(r)
+	t := s.transfers.start(transferRecover, newRecoverID(), outDir, hash)
+	run := func() recoverPlan {
+		defer s.transfers.finish(t)
+		return s.planRecovery(t, outDir, hash, batch, user, overwrite, execute)
+	}
+	if q.Get("async") == "true" {
+		go func() {
+			defer recoverOnce("recover")
+			run()
+		}()
+		rec, _ := s.transfers.get(t.ID)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		_ = json.NewEncoder(w).Encode(rec)
+		return
+	}
+	writeJSON(w, run())
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Relay replay protection. A captured onion packet could be POSTed to
+// /mix/relay again and again: each copy was peeled and forwarded, so one
+// packet amplified into traffic down the path and repeated delivery at the
+// final hop. A relay now remembers each layer it peeled, by its version and
+// ephemeral pubkey, and answers 409 to a second copy without forwarding it.
+// A layer is remembered only after it authenticated, so a forged packet
+// can't claim an ephemeral key ahead of the real one; a sender never reuses
+// one. Entries live in a ring of time buckets covering
+// --relay-replay-window. The ring also caps the entries (--relay-replay-max):
+// a full bucket rotates early, which shortens the window under a flood
+// rather than growing. A relay whose forward fails forgets the layer
+// (relayFailed), so the hop before it can retry the same packet. The mix key is minted at startup, so a packet from
+// before a restart can't be peeled at all and the cache needn't persist.
+
+const (
+	defaultRelayReplayWindow = 10 * time.Minute
+	defaultRelayReplayMax    = 1 << 18
+	relayReplayBuckets       = 10
+)
+
+var relayReplays = metricDef{"relay_replays_total", "onion layers refused because this relay already peeled them", "path"}
+
+type replayKey [sha256.Size]byte
+
+type relayReplayCache struct {
+	mu      sync.Mutex
+	buckets [relayReplayBuckets]map[replayKey]struct{}
+	cur     int       // bucket new entries go to
+	started time.Time // when cur began
+	span    time.Duration
+	perBkt  int
+}
+
+func newRelayReplayCache(window time.Duration, max int) *relayReplayCache {
+	c := &relayReplayCache{span: window / relayReplayBuckets, perBkt: max / relayReplayBuckets}
+	for i := range c.buckets {
+		c.buckets[i] = make(map[replayKey]struct{})
+	}
+	return c
+}
+
+func layerReplayKey(v int, ephPub []byte) replayKey {
+	return sha256.Sum256(append([]byte("relay-layer|"+strconv.Itoa(v)+"|"), ephPub...))
+}
+
+// seen records the layer and reports whether it was already recorded. A
+// zero window turns the check off.
+func (c *relayReplayCache) seen(v int, ephPub []byte, now time.Time) bool {
+	if c.span <= 0 || c.perBkt <= 0 {
+		return false
+	}
+	k := layerReplayKey(v, ephPub)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.advance(now)
+	for _, b := range c.buckets {
+		if _, ok := b[k]; ok {
+			return true
+		}
+	}
+	if len(c.buckets[c.cur]) >= c.perBkt {
+		c.rotate(now)
+	}
+	c.buckets[c.cur][k] = struct{}{}
+	return false
+}
+
+// forget drops the layer, so a retry of it is peeled again.
+func (c *relayReplayCache) forget(v int, ephPub []byte) {
+	k := layerReplayKey(v, ephPub)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, b := range c.buckets {
+		delete(b, k)
+	}
+}
+
+// advance rotates past every bucket whose span has ended.
+func (c *relayReplayCache) advance(now time.Time) {
+	if c.started.IsZero() || now.Sub(c.started) >= c.span*relayReplayBuckets {
+		for i := range c.buckets {
+			clear(c.buckets[i])
+		}
+		c.started = now
+		return
+	}
+	for now.Sub(c.started) >= c.span {
+		c.rotate(c.started.Add(c.span))
+	}
+}
+
+// rotate starts a new bucket at t, dropping the oldest.
+func (c *relayReplayCache) rotate(t time.Time) {
+	c.cur = (c.cur + 1) % relayReplayBuckets
+	clear(c.buckets[c.cur])
+	c.started = t
+}
+
+// refuseReplay answers 409 if this layer was already peeled here.
+func (s *Server) refuseReplay(w http.ResponseWriter, path string, v int, ephPub []byte) bool {
+	if !s.relayReplay.seen(v, ephPub, time.Now()) {
+		return false
+	}
+	s.metrics.counter(relayReplays).inc(path)
+	http.Error(w, "replayed packet", http.StatusConflict)
+	return true
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// The same packet twice: the first copy is forwarded, the second gets 409
+// and isn't, on the in-memory path and the spill path alike, and a final
+// layer replayed isn't delivered again.
+func TestRelayReplayRefused(t *testing.T) {
+	var forwarded atomic.Int64
+	next := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { forwarded.Add(1) }))
+	t.Cleanup(next.Close)
+	env, _ := json.Marshal(FinalEnvelope{Type: loadgenMixType, MsgID: "m"})
+
+	spill := defaultConfig()
+	spill.RelaySpillBytes = 64
+	for _, tc := range []struct {
+		path string
+		cfg  *Config
+	}{{"memory", nil}, {"spill", spill}} {
+		s := newTestServer(t, "s-"+tc.path, tc.cfg)
+		var plain onionLayerPlain
+		plain.Next, plain.Meta.MsgID, plain.Meta.TTL, plain.Meta.Class = strings.TrimPrefix(next.URL, "http://"), "m", 2, classInteractive
+		packet := sealLayer(t, s, plain, env)
+		before := forwarded.Load()
+		for i, want := range []int{http.StatusOK, http.StatusConflict, http.StatusConflict} {
+			if rr := relay(s, packet); rr.Code != want {
+				t.Fatalf("%s: copy %d: HTTP %d %s, want %d", tc.path, i+1, rr.Code, rr.Body, want)
+			}
+		}
+		if n := forwarded.Load() - before; n != 1 {
+			t.Fatalf("%s: forwarded %d times", tc.path, n)
+		}
+		if m := scrape(t, s); !strings.Contains(m, `relay_replays_total{path="`+tc.path+`"} 2`) {
+			t.Fatalf("%s: replays not counted", tc.path)
+		}
+	}
+
+	s := newTestServer(t, "final", nil)
+	text := FinalEnvelope{Type: "text", SenderID: hexA, ReceiverID: s.id.NodeID, MsgID: "once"}
+	if err := sealText(&text, s.nodeKeys.Pub[:], []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	textB, _ := json.Marshal(text)
+	packet := mixTo(t, s, onionV2, textB)
+	if rr := relay(s, packet); rr.Code != http.StatusOK {
+		t.Fatalf("final: HTTP %d %s", rr.Code, rr.Body)
+	}
+	s.inbox.remove(text.MsgID, "")
+	if rr := relay(s, packet); rr.Code != http.StatusConflict {
+		t.Fatalf("final replay: HTTP %d %s", rr.Code, rr.Body)
+	}
+	if _, ok := s.inbox.find(text.MsgID, ""); ok {
+		t.Fatal("replayed text delivered again")
+	}
+}
+
+// A layer stays refused while its bucket is in the ring, across rotations,
+// and is forgotten once the window is over. A bucket that fills up rotates
+// early, so a flood shortens the window instead of growing the cache.
+func TestRelayReplayRotation(t *testing.T) {
+	c := newRelayReplayCache(10*time.Second, 100) // 1s buckets of 10
+	t0 := time.Now()
+	eph := []byte("packet one")
+	if c.seen(onionV2, eph, t0) {
+		t.Fatal("new layer seen")
+	}
+	for _, d := range []time.Duration{0, 999 * time.Millisecond, time.Second, 5500 * time.Millisecond, 9 * time.Second} {
+		if !c.seen(onionV2, eph, t0.Add(d)) {
+			t.Fatalf("replay after %v not refused", d)
+		}
+	}
+	if c.seen(onionV1, eph, t0) {
+		t.Fatal("another version's layer refused")
+	}
+	if c.seen(onionV2, eph, t0.Add(10*time.Second)) {
+		t.Fatal("refused after the window")
+	}
+
+	// one instant, 10 per bucket: the 101st entry pushes out the first
+	t1 := t0.Add(time.Minute)
+	c = newRelayReplayCache(10*time.Second, 100)
+	for i := range 100 {
+		c.seen(onionV2, []byte{byte(i)}, t1)
+	}
+	if !c.seen(onionV2, []byte{0}, t1) {
+		t.Fatal("first entry dropped before the ring was full")
+	}
+	c.seen(onionV2, []byte{100}, t1)
+	if c.seen(onionV2, []byte{0}, t1) {
+		t.Fatal("first entry kept past the cap")
+	}
+	n := 0
+	for _, b := range c.buckets {
+		n += len(b)
+	}
+	if n > 100 {
+		t.Fatalf("%d entries, cap 100", n)
+	}
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+// Relay spillover. An onion packet larger than --relay-spill-bytes is never
+// held whole: each stage streams into a temp file under tmp/relay, and each
+// file is sealed in 64 KiB chunks under a key that exists only in memory.
+//   1. The outer packet's ciphertext is base64-decoded into a spill file
+//      (a binary packet's or a cell's is copied as is).
+//   2. The layer is authenticated in one read of that file. A second read
+//      decrypts it, and its payload is base64-decoded into another file.
+//   3. That file is the next hop's packet, POSTed straight from disk; a
+//      final hop decodes the envelope from it the same way.
+// Memory per relayed message stays at a few buffers whatever its size. A
+// spill file is removed once the next hop answers. A file left behind (a
+// crash, a stuck hop) is removed after relaySpillTTL, and at startup. Its
+// key died with the process, so it is unreadable anyway.
+
+const (
+	defaultRelaySpillBytes = 8 << 20
+	relaySpillChunk        = 64 << 10
+	relaySpillTTL          = 30 * time.Minute
+	relaySpillSweepEvery   = time.Minute
+
+	spillLastChunk = 1 << 31 // flag in a chunk's length header
+)
+
+type relaySpill struct {
+	dir string
+}
+
+func newRelaySpill(paths *EnvPaths) *relaySpill {
+	tmp := paths.TmpDir
+	if tmp == "" {
+		tmp = filepath.Join(paths.BaseDir, "tmp")
+	}
+	sp := &relaySpill{dir: filepath.Join(tmp, "relay")}
+	if ents, err := os.ReadDir(sp.dir); err == nil && len(ents) > 0 {
+		os.RemoveAll(sp.dir)
+		log.Printf("[mix] removed %d relay spill files left from a previous run", len(ents))
+	}
+	return sp
+}
+
+// spillFile is a temp file written once, sealed chunk by chunk, and read
+// back any number of times.
+type spillFile struct {
+	path   string
+	f      *os.File
+	aead   cipher.AEAD
+	prefix [16]byte
+	chunks uint64
+	buf    []byte
+	size   int64 // plaintext bytes
+}
+
+func (sp *relaySpill) create() (*spillFile, error) {
+	if err := os.MkdirAll(sp.dir, 0o700); err != nil {
+		return nil, err
+	}
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(sp.dir, "spill-*")
+	if err != nil {
+		return nil, err
+	}
+	sf := &spillFile{path: f.Name(), f: f, aead: aead, buf: make([]byte, 0, relaySpillChunk)}
+	if _, err := rand.Read(sf.prefix[:]); err != nil {
+		f.Close()
+		os.Remove(sf.path)
+		return nil, err
+	}
+	return sf, nil
+}
+
+func (sf *spillFile) nonce(i uint64) []byte {
+	n := make([]byte, chacha20poly1305.NonceSizeX)
+	copy(n, sf.prefix[:])
+	binary.BigEndian.PutUint64(n[16:], i)
+	return n
+}
+
+func (sf *spillFile) Write(p []byte) (int, error) {
+	total := len(p)
+	for len(p) > 0 {
+		n := copy(sf.buf[len(sf.buf):cap(sf.buf)], p)
+		sf.buf = sf.buf[:len(sf.buf)+n]
+		p = p[n:]
+		if len(sf.buf) == cap(sf.buf) {
+			if err := sf.flush(false); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return total, nil
+}
+
+// flush seals the buffered chunk. The last chunk is marked, in the header
+// and the AD, so a truncated file fails instead of reading short.
+func (sf *spillFile) flush(last bool) error {
+	hdr := uint32(len(sf.buf) + chacha20poly1305.Overhead)
+	if last {
+		hdr |= spillLastChunk
+	}
+	var h [4]byte
+	binary.BigEndian.PutUint32(h[:], hdr)
+	ct := sf.aead.Seal(nil, sf.nonce(sf.chunks), sf.buf, h[:])
+	if _, err := sf.f.Write(h[:]); err != nil {
+		return err
+	}
+	if _, err := sf.f.Write(ct); err != nil {
+		return err
+	}
+	sf.size += int64(len(sf.buf))
+	sf.chunks++
+	sf.buf = sf.buf[:0]
+	return nil
+}
+
+// Close finishes writing; the file stays until remove.
+func (sf *spillFile) Close() error {
+	if sf.f == nil {
+		return nil
+	}
+	err := sf.flush(true)
+	if cerr := sf.f.Close(); err == nil {
+		err = cerr
+	}
+	sf.f, sf.buf = nil, nil
+	return err
+}
+
+func (sf *spillFile) remove() {
+	if sf == nil || sf.path == "" {
+		return
+	}
+	if sf.f != nil {
+		sf.f.Close()
+		sf.f = nil
+	}
+	os.Remove(sf.path)
+	sf.path = ""
+}
+
+// Open reads the plaintext back from the start.
+func (sf *spillFile) Open() (io.ReadCloser, error) {
+	f, err := os.Open(sf.path)
+	if err != nil {
+		return nil, err
+	}
+	return &spillReader{sf: sf, f: f, r: bufio.NewReaderSize(f, relaySpillChunk+chacha20poly1305.Overhead+4)}, nil
+}
+
+type spillReader struct {
+	sf    *spillFile
+	f     *os.File
+	r     *bufio.Reader
+	chunk uint64
+	ct    []byte
+	pt    []byte
+	done  bool
+}
+
+func (sr *spillReader) Read(p []byte) (int, error) {
+	for len(sr.pt) == 0 {
+		if sr.done {
+			return 0, io.EOF
+		}
+		var h [4]byte
+		if _, err := io.ReadFull(sr.r, h[:]); err != nil {
+			return 0, errors.New("spill file truncated")
+		}
+		hdr := binary.BigEndian.Uint32(h[:])
+		n := int(hdr &^ spillLastChunk)
+		if n < chacha20poly1305.Overhead || n > relaySpillChunk+chacha20poly1305.Overhead {
+			return 0, errors.New("spill file corrupt")
+		}
+		if cap(sr.ct) < n {
+			sr.ct = make([]byte, n)
+		}
+		if _, err := io.ReadFull(sr.r, sr.ct[:n]); err != nil {
+			return 0, errors.New("spill file truncated")
+		}
+		pt, err := sr.sf.aead.Open(sr.ct[:0], sr.sf.nonce(sr.chunk), sr.ct[:n], h[:])
+		if err != nil {
+			return 0, errors.New("spill file corrupt")
+		}
+		sr.chunk++
+		sr.pt = pt
+		sr.done = hdr&spillLastChunk != 0
+	}
+	n := copy(p, sr.pt)
+	sr.pt = sr.pt[n:]
+	return n, nil
+}
+
+func (sr *spillReader) Close() error { return sr.f.Close() }
+
+func (sf *spillFile) source() bodySource {
+	return bodySource{size: sf.size, open: sf.Open}
+}
+
+// readAll materializes the file, for the legacy final-hop paths that store
+// the whole inner packet.
+func (sf *spillFile) readAll() ([]byte, error) {
+	rc, err := sf.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	b := make([]byte, 0, sf.size)
+	buf := bytes.NewBuffer(b)
+	_, err = buf.ReadFrom(rc)
+	return buf.Bytes(), err
+}
+
+// startRelaySpillSweepLoop removes spill files not written for
+// relaySpillTTL: a hop that never answered, or a handler that died.
+func (s *Server) startRelaySpillSweepLoop(ctx context.Context) {
+	t := time.NewTicker(relaySpillSweepEvery)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		ents, err := os.ReadDir(s.spill.dir)
+		if err != nil {
+			continue
+		}
+		n := 0
+		for _, e := range ents {
+			if fi, err := e.Info(); err == nil && time.Since(fi.ModTime()) > relaySpillTTL {
+				if os.Remove(filepath.Join(s.spill.dir, e.Name())) == nil {
+					n++
+				}
+			}
+		}
+		if n > 0 {
+			log.Printf("[mix] removed %d expired relay spill files", n)
+		}
+	}
+}
+
+// relaySpilled is relayHandler for a packet over the spill threshold; body
+// replays what the handler already read, in form. The two spill files
+// take about 1.3x the packet (-1 if unknown), checked against
+// --disk-reserve.
+func (s *Server) relaySpilled(w http.ResponseWriter, nodeKeys *NodeKeypair, body io.Reader, size int64, form onionForm) {
+	if size > 0 {
+		if err := s.checkDiskFor(size + size/2); err != nil {
+			s.writeDiskFull(w, "relay", err)
+			return
+		}
+	}
+
+	// 1. outer packet: ciphertext to disk
+	ctf, err := s.spill.create()
+	if err != nil {
+		log.Printf("[mix] spill: %v", err)
+		http.Error(w, "spill fail", http.StatusInternalServerError)
+		return
+	}
+	defer ctf.remove()
+	var op onionPacket
+	var epub []byte
+	switch form {
+	case formBin:
+		var head [33]byte
+		if _, err = io.ReadFull(body, head[:]); err == nil {
+			op.V, epub = int(head[0]), head[1:]
+			_, err = io.Copy(ctf, body)
+		}
+	case formCell:
+		// laid out as openXStream reads it: nonce, ciphertext, tag
+		var head [cellPacketHead]byte
+		if _, err = io.ReadFull(body, head[:]); err == nil {
+			op.V, epub = int(head[0]), head[1:33]
+			if _, err = ctf.Write(head[33:57]); err == nil {
+				_, err = io.Copy(ctf, body)
+			}
+			if err == nil {
+				_, err = ctf.Write(head[57:])
+			}
+		}
+	default:
+		err = streamJSONObject(body, map[string]any{"v": &op.V, "ephemeral_pub": &op.EphemeralPub},
+			map[string]func() io.WriteCloser{"ciphertext": func() io.WriteCloser { return newB64Writer(ctf) }})
+	}
+	if err == nil {
+		err = ctf.Close()
+	}
+	if err != nil {
+		var mbe *http.MaxBytesError
+		if errors.As(err, &mbe) {
+			http.Error(w, "packet too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "bad packet", http.StatusBadRequest)
+		return
+	}
+	if form == formJSON {
+		epub, err = base64.RawURLEncoding.DecodeString(op.EphemeralPub)
+		if err != nil || len(epub) != 32 {
+			http.Error(w, "bad ephemeral", http.StatusBadRequest)
+			return
+		}
+	}
+
+	op.V = onionVersion(op.V)
+	if op.V == onionV1 && s.refuseLegacy(w, legacyOnionV1) {
+		return
+	}
+
+	// 2. authenticate, then decrypt the layer with its payload to disk
+	stop := hRelayPeel.time()
+	shared, err := curve25519.X25519(nodeKeys.Priv[:], epub)
+	if err != nil {
+		stop()
+		http.Error(w, "shared fail", http.StatusInternalServerError)
+		return
+	}
+	key, err := layerKey(op.V, shared, epub, nodeKeys.Pub[:])
+	if err != nil {
+		stop()
+		http.Error(w, "bad version", http.StatusBadRequest)
+		return
+	}
+	pt, err := openXStream(key, ctf)
+	stop()
+	if err != nil {
+		http.Error(w, "decrypt fail", http.StatusForbidden)
+		return
+	}
+	if s.refuseReplay(w, "spill", op.V, epub) {
+		pt.Close()
+		return
+	}
+	inner, err := s.spill.create()
+	if err != nil {
+		pt.Close()
+		log.Printf("[mix] spill: %v", err)
+		http.Error(w, "spill fail", http.StatusInternalServerError)
+		return
+	}
+	defer inner.remove()
+	var plain onionLayerPlain
+	switch form {
+	case formBin:
+		plain, err = readBinLayer(pt, inner)
+	case formCell:
+		plain, err = readCellLayer(pt, key, inner)
+	default:
+		err = streamJSONObject(pt, map[string]any{"next": &plain.Next, "meta": &plain.Meta},
+			map[string]func() io.WriteCloser{"payload": func() io.WriteCloser { return newB64Writer(inner) }})
+	}
+	pt.Close()
+	if err == nil {
+		err = inner.Close()
+	}
+	if err != nil {
+		http.Error(w, "bad layer", http.StatusBadRequest)
+		return
+	}
+	ctf.remove()
+	if plain.Meta.TTL <= 0 {
+		http.Error(w, "ttl expired", http.StatusBadRequest)
+		return
+	}
+	s.reportTrace(plain.Meta.Trace, s.trace(plain.Meta.MsgID, traceRelayIn, ""))
+
+	// 3. final: decode the envelope from disk; else forward from disk
+	if plain.Next == "" || plain.Meta.Final {
+		s.relaySpilledFinal(w, &plain, inner)
+		return
+	}
+	time.Sleep(s.cfg.relayDelay(plain.Meta.Class))
+	resp, to, err := s.relayForward(plain.Next, inner.source(), nextForm(form, &plain))
+	if err != nil {
+		log.Printf("[mix] forward err to %s: %v", plain.Next, err)
+	}
+	if s.relayFailed(w, resp, err, op.V, epub) {
+		return
+	}
+	defer resp.Body.Close()
+	log.Printf("[mix] relayed %d bytes via spill to %s", inner.size, to)
+	s.reportTrace(plain.Meta.Trace, s.trace(plain.Meta.MsgID, traceRelayForward, to))
+	writeJSON(w, map[string]any{"status": "forwarded", "to": to})
+}
+
+// relaySpilledFinal decodes a spilled FinalEnvelope: data_b64 straight into
+// its decoded bytes (dropped for loadgen), the other fields as usual.
+func (s *Server) relaySpilledFinal(w http.ResponseWriter, plain *onionLayerPlain, inner *spillFile) {
+	var env FinalEnvelope
+	var data bytes.Buffer
+	rc, err := inner.Open()
+	if err != nil {
+		http.Error(w, "spill fail", http.StatusInternalServerError)
+		return
+	}
+	err = streamJSONObject(rc, map[string]any{
+		"type": &env.Type, "sender_id": &env.SenderID, "receiver_id": &env.ReceiverID, "name": &env.Name,
+		"msgid": &env.MsgID, "logical": &env.Logical, "sent_unix": &env.SentUnix, "text_eph": &env.TextEph,
+		"group": &env.Group, "group_owner": &env.GroupOwner, "group_gen": &env.GroupGen, "ack": &env.Ack,
+	}, map[string]func() io.WriteCloser{"data_b64": func() io.WriteCloser {
+		if env.Type == loadgenMixType {
+			return newB64Writer(io.Discard)
+		}
+		return newB64Writer(&data)
+	}})
+	rc.Close()
+	whole := inner.readAll
+	if err != nil {
+		var b64err base64.CorruptInputError
+		if errors.As(err, &b64err) {
+			http.Error(w, "bad file payload", http.StatusBadRequest)
+			return
+		}
+		// not an envelope: the legacy raw store keeps the whole packet
+		s.deliverFinal(w, plain, nil, nil, nil, whole)
+		return
+	}
+	s.deliverFinal(w, plain, &env, data.Bytes(), nil, whole)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"testing"
+	"time"
+)
+
+// A 200 MB payload relayed through three in-process hops goes through the
+// spill files at each one (an error anywhere on the path would come back
+// here): the heap never grows by more than a small part of the payload
+// while the packet is in flight.
+func TestRelaySpill200MB(t *testing.T) {
+	if testing.Short() {
+		t.Skip("relays 200 MB")
+	}
+	const size = 200 << 20
+	x, y, z := newTestServer(t, "x", nil), newTestServer(t, "y", nil), newTestServer(t, "z", nil)
+	mesh(t, x, y, z)
+
+	// build the onion, park it in a file and drop it from the heap, so what
+	// the heap holds from here on is the relays'
+	packetFile := filepath.Join(t.TempDir(), "onion")
+	func() {
+		data := make([]byte, size)
+		rand.Read(data)
+		env, _ := json.Marshal(FinalEnvelope{Type: loadgenMixType, MsgID: "big", DataB64: base64.RawURLEncoding.EncodeToString(data)})
+		data = nil
+		hops := []hopInfo{hopOf(x, true), hopOf(y, true), hopOf(z, true)}
+		packet, err := buildOnion(hops, env, mixTTL, "big", "", classInteractive, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(packetFile, packet, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	// collect often, so HeapAlloc follows what is live rather than the
+	// garbage allowed to pile up on top of the other tests' heap
+	defer debug.SetGCPercent(debug.SetGCPercent(10))
+	runtime.GC()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	base, peak := ms.HeapAlloc, ms.HeapAlloc
+
+	done := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		for {
+			var ms runtime.MemStats
+			runtime.ReadMemStats(&ms)
+			if ms.HeapAlloc > peak {
+				peak = ms.HeapAlloc
+			}
+			select {
+			case <-done:
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+		}
+	}()
+	st, _ := os.Stat(packetFile)
+	body := bodySource{size: st.Size(), open: func() (io.ReadCloser, error) { return os.Open(packetFile) }}
+	resp, _, err := x.postSourceToAddr(x.selfAddr, "/mix/relay", body, onionHeader(formBin))
+	close(done)
+	<-sampled
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("HTTP %d %s", resp.StatusCode, msg)
+	}
+	growth := int64(peak) - int64(base)
+	t.Logf("%d-byte packet, heap grew by at most %d bytes", st.Size(), growth)
+	if growth > size/4 {
+		t.Fatalf("heap grew by %d bytes relaying %d", growth, size)
+	}
+}
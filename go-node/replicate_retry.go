@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"p2pnode-R3/journal"
+)
+
+// Replicate retries. A fanout that fails to reach a peer queues the
+// envelope for that peer in the replicate journal (queues.go), and the peer
+// gets it again later until it takes it or the item is older than
+// --replicate-retry-max-age (0 = no retries). Small envelopes (receipts,
+// tombstones, access records) are kept as sent; data envelopes by their blob
+// key, rebuilt from the chunk on disk when retried. Items whose block was
+// deleted, expired or abandoned meanwhile are dropped.
+
+const (
+	defaultReplicateRetryMaxAge = 24 * time.Hour
+
+	retryInlineMax = 64 << 10 // envelopes up to this are journaled whole
+)
+
+type replicateRetry struct {
+	Peer   string `json:"peer"`
+	Hash   string `json:"hash"`
+	Key    string `json:"key,omitempty"` // blob key of a data envelope
+	Env    []byte `json:"env,omitempty"` // a small envelope, as sent
+	Queued int64  `json:"queued_unix"`
+}
+
+func replicateRetryKey(b []byte) string {
+	var it replicateRetry
+	_ = json.Unmarshal(b, &it)
+	return it.Peer + "|" + it.Hash
+}
+
+// queueReplicateRetry journals envBytes for a later try at p.
+func (s *Server) queueReplicateRetry(p PeerInfo, hash string, envBytes []byte) {
+	if s.cfg.ReplicateRetryMaxAge <= 0 {
+		return
+	}
+	it := replicateRetry{Peer: p.NodeID, Hash: hash, Queued: time.Now().Unix()}
+	if len(envBytes) <= retryInlineMax {
+		it.Env = envBytes
+	} else {
+		var env struct {
+			HashHex string `json:"hash_hex"`
+			Name    string `json:"name"`
+		}
+		if err := json.Unmarshal(envBytes, &env); err != nil {
+			return
+		}
+		it.Key = "blob-" + env.HashHex + "-" + env.Name
+	}
+	if _, added, err := s.replicateQ.add(it); err != nil {
+		log.Printf("[replicate] %.8s: can't queue retry of %s: %v", p.NodeID, hash, err)
+	} else if added {
+		log.Printf("[replicate] %.8s: %s queued for retry", p.NodeID, hash)
+	}
+}
+
+// retryReplicate is the replicate queue's work function.
+func (s *Server) retryReplicate(r journal.Record) (bool, error) {
+	var it replicateRetry
+	if err := json.Unmarshal(r.Data, &it); err != nil {
+		return true, nil
+	}
+	drop := func(why string) (bool, error) {
+		log.Printf("[replicate] dropping retry of %s to %.8s: %s", it.Hash, it.Peer, why)
+		return true, nil
+	}
+	if time.Since(time.Unix(it.Queued, 0)) > s.cfg.ReplicateRetryMaxAge {
+		return drop("older than --replicate-retry-max-age")
+	}
+	if _, ok := s.tombstoneFor(it.Hash); ok || s.abandoned.has(it.Hash) {
+		return drop("deleted or abandoned by its origin")
+	}
+	if _, ok := s.retention.expired(it.Hash); ok {
+		return drop("expired by retention policy")
+	}
+	p, ok := s.peers.Get(it.Peer)
+	if !ok {
+		return false, errors.New("peer not known")
+	}
+	env := it.Env
+	if env == nil {
+		s.mu.Lock()
+		env = s.kv[it.Key]
+		s.mu.Unlock()
+		if env == nil {
+			if env, ok = s.blobFromDisk(it.Key); !ok {
+				return drop("chunk no longer here")
+			}
+		}
+	}
+	if _, ok := s.replicateTo(p, it.Hash, env, nil); !ok {
+		return false, fmt.Errorf("replicate to %.8s failed", it.Peer)
+	}
+	log.Printf("[replicate] %.8s took %s on retry", it.Peer, it.Hash)
+	return true, nil
+}
+
+func (s *Server) startReplicateRetryLoop(ctx context.Context) {
+	s.runQueue(ctx, s.replicateQ, s.retryReplicate)
+}
@@ -0,0 +1,624 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"keysaver-server/keysaverclient"
+)
+
+// Retention policies. A policy matches blocks by origin NodeID, name glob
+// and/or an explicit hash list (every criterion given must match) and has
+// one action: retain-forever, expire-after a duration counted from the
+// block's creation, or replicate-minimum, which keeps the block and tops up
+// its copies (this node's included) to at least min. A block matched by
+// several policies gets the most conservative result: any non-expiring
+// policy keeps it forever, otherwise the longest expiry wins; min copies is
+// the largest asked. Blocks no policy matches are kept, as before.
+//
+// The scrub loop applies the policies every hour; POST /retention/apply
+// does it at once. An expired block's chunk is deleted and its file key
+// soft-deleted: moved to keys/revoked/ and, if escrowed, revoked on the
+// keysaver (MIXNETS_KEYSAVER_TOKEN). The chain entry stays and is annotated
+// as expired (retention.json, shown on /chain/list); the node no longer
+// accepts or repairs the block. Policies are per node: set them on every
+// node that holds the data.
+
+const (
+	retentionFile = "retention.json"
+
+	retainForever   = "retain-forever"
+	retainExpire    = "expire-after"
+	retainReplicate = "replicate-minimum"
+	retainNone      = "none" // no policy matches
+
+	retentionCopyChecks = 100 // replicate-minimum blocks whose copies are counted per pass
+	keysaverTimeout     = 15 * time.Second
+	revokedKeysDir      = "revoked"
+)
+
+type retentionMatch struct {
+	Origin string   `json:"origin,omitempty"`
+	Name   string   `json:"name,omitempty"` // glob (path.Match syntax)
+	Hashes []string `json:"hashes,omitempty"`
+}
+
+type retentionPolicy struct {
+	ID      string         `json:"id"`
+	Match   retentionMatch `json:"match"`
+	Action  string         `json:"action"`
+	After   string         `json:"after,omitempty"` // expire-after: "30d", "7y", "36h"
+	Min     int            `json:"min,omitempty"`   // replicate-minimum: copies
+	Created time.Time      `json:"created"`
+
+	after time.Duration
+}
+
+// expiredMark annotates the chain entry of an expired block.
+type expiredMark struct {
+	At           time.Time `json:"at"`
+	Policy       string    `json:"policy"`
+	ChunkDeleted bool      `json:"chunk_deleted"`
+	KeyRevoked   bool      `json:"key_revoked"`        // local key moved to keys/revoked
+	Keysaver     string    `json:"keysaver,omitempty"` // escrowed keys: revoked | not_found | error
+}
+
+// retentionVerdict is the policy evaluation for one block.
+type retentionVerdict struct {
+	Hash      string       `json:"hash"`
+	Name      string       `json:"name"`
+	OriginID  string       `json:"origin_id"`
+	Policies  []string     `json:"policies"`         // matching policy IDs
+	Action    string       `json:"action"`           // the one that decides retention
+	Policy    string       `json:"policy,omitempty"` // the deciding policy
+	ExpiresAt *time.Time   `json:"expires_at,omitempty"`
+	MinCopies int          `json:"min_copies,omitempty"`
+	Expired   *expiredMark `json:"expired,omitempty"`
+}
+
+// chainEntry is a block as /chain/list shows it.
+type chainEntry struct {
+	Block
+	Expired   *expiredMark `json:"expired,omitempty"`
+	DeletedBy string       `json:"deleted_by,omitempty"` // tombstone hash
+}
+
+type retentionState struct {
+	Policies []retentionPolicy      `json:"policies"`
+	Expired  map[string]expiredMark `json:"expired,omitempty"`
+}
+
+type retentionStore struct {
+	path string
+
+	mu      sync.Mutex
+	st      retentionState
+	copyPos int // round-robin position among replicate-minimum blocks
+}
+
+func newRetentionStore(paths *EnvPaths) *retentionStore {
+	rs := &retentionStore{path: filepath.Join(paths.BaseDir, retentionFile)}
+	if b, err := os.ReadFile(rs.path); err == nil {
+		if err := json.Unmarshal(b, &rs.st); err != nil {
+			log.Printf("[retention] ignoring bad %s: %v", rs.path, err)
+			rs.st = retentionState{}
+		}
+	}
+	if rs.st.Expired == nil {
+		rs.st.Expired = make(map[string]expiredMark)
+	}
+	kept := rs.st.Policies[:0]
+	for _, p := range rs.st.Policies {
+		if err := p.validate(); err != nil {
+			log.Printf("[retention] dropping policy %s: %v", p.ID, err)
+			continue
+		}
+		kept = append(kept, p)
+	}
+	rs.st.Policies = kept
+	return rs
+}
+
+// saveLocked persists the state; callers hold rs.mu.
+func (rs *retentionStore) saveLocked() error {
+	b, _ := json.MarshalIndent(rs.st, "", "  ")
+	return writeFileAtomic(rs.path, b)
+}
+
+// parseRetentionAge reads a duration with d (day) and y (365 days) units
+// besides Go's own, e.g. "30d", "7y", "36h".
+func parseRetentionAge(s string) (time.Duration, error) {
+	unit := time.Duration(0)
+	switch {
+	case strings.HasSuffix(s, "d"):
+		unit = 24 * time.Hour
+	case strings.HasSuffix(s, "y"):
+		unit = 365 * 24 * time.Hour
+	}
+	if unit != 0 {
+		n, err := strconv.Atoi(strings.TrimSpace(s[:len(s)-1]))
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("bad duration %q", s)
+		}
+		return time.Duration(n) * unit, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("bad duration %q (want e.g. 30d, 7y, 36h)", s)
+	}
+	return d, nil
+}
+
+// validate checks p and fills in its parsed duration.
+func (p *retentionPolicy) validate() error {
+	m := &p.Match
+	if m.Origin == "" && m.Name == "" && len(m.Hashes) == 0 {
+		return errors.New("match needs origin, name or hashes")
+	}
+	if m.Name != "" {
+		if _, err := path.Match(m.Name, ""); err != nil {
+			return fmt.Errorf("name glob %q: %v", m.Name, err)
+		}
+	}
+	for i, h := range m.Hashes {
+		h = strings.ToLower(strings.TrimSpace(h))
+		if b, err := hex.DecodeString(h); err != nil || len(b) != 32 {
+			return fmt.Errorf("hash %q: want 64 hex chars", h)
+		}
+		m.Hashes[i] = h
+	}
+	switch p.Action {
+	case retainForever:
+	case retainExpire:
+		d, err := parseRetentionAge(p.After)
+		if err != nil {
+			return err
+		}
+		p.after = d
+	case retainReplicate:
+		if p.Min < 1 {
+			return errors.New("replicate-minimum needs min >= 1")
+		}
+	default:
+		return fmt.Errorf("action %q: want %s, %s or %s", p.Action, retainForever, retainExpire, retainReplicate)
+	}
+	return nil
+}
+
+func (p *retentionPolicy) matches(b Block) bool {
+	m := p.Match
+	if m.Origin != "" && m.Origin != b.OriginID {
+		return false
+	}
+	if m.Name != "" {
+		if ok, _ := path.Match(m.Name, b.Name); !ok {
+			return false
+		}
+	}
+	if len(m.Hashes) > 0 {
+		for _, h := range m.Hashes {
+			if h == b.Hash {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func (rs *retentionStore) policies() []retentionPolicy {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return append([]retentionPolicy{}, rs.st.Policies...)
+}
+
+// put adds p, replacing a policy with the same ID.
+func (rs *retentionStore) put(p retentionPolicy) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	replaced := false
+	for i := range rs.st.Policies {
+		if rs.st.Policies[i].ID == p.ID {
+			rs.st.Policies[i], replaced = p, true
+		}
+	}
+	if !replaced {
+		rs.st.Policies = append(rs.st.Policies, p)
+	}
+	return rs.saveLocked()
+}
+
+func (rs *retentionStore) remove(id string) (bool, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	for i, p := range rs.st.Policies {
+		if p.ID == id {
+			rs.st.Policies = append(rs.st.Policies[:i], rs.st.Policies[i+1:]...)
+			return true, rs.saveLocked()
+		}
+	}
+	return false, nil
+}
+
+// expired returns the annotation of an expired block.
+func (rs *retentionStore) expired(hash string) (expiredMark, bool) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	m, ok := rs.st.Expired[hash]
+	return m, ok
+}
+
+func (rs *retentionStore) markExpired(hash string, m expiredMark) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.st.Expired[hash] = m
+	return rs.saveLocked()
+}
+
+// evaluate resolves the policies matching b into one verdict.
+func (rs *retentionStore) evaluate(b Block) retentionVerdict {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	v := retentionVerdict{Hash: b.Hash, Name: b.Name, OriginID: b.OriginID, Policies: []string{}, Action: retainNone}
+	if m, ok := rs.st.Expired[b.Hash]; ok {
+		v.Expired = &m
+	}
+	var keep, expire *retentionPolicy
+	for i := range rs.st.Policies {
+		p := &rs.st.Policies[i]
+		if !p.matches(b) {
+			continue
+		}
+		v.Policies = append(v.Policies, p.ID)
+		switch p.Action {
+		case retainExpire:
+			if expire == nil || p.after > expire.after {
+				expire = p
+			}
+		case retainReplicate:
+			v.MinCopies = max(v.MinCopies, p.Min)
+			if keep == nil {
+				keep = p
+			}
+		case retainForever:
+			if keep == nil || keep.Action != retainForever {
+				keep = p
+			}
+		}
+	}
+	switch {
+	case keep != nil:
+		v.Action, v.Policy = keep.Action, keep.ID
+	case expire != nil:
+		at := time.Unix(b.Created, 0).Add(expire.after).UTC()
+		v.Action, v.Policy, v.ExpiresAt = retainExpire, expire.ID, &at
+	}
+	return v
+}
+
+// due reports whether v's block should be expired now.
+func (v retentionVerdict) due(now time.Time) bool {
+	return v.Expired == nil && v.ExpiresAt != nil && !now.Before(*v.ExpiresAt)
+}
+
+// ---- applying ----
+
+type retentionReport struct {
+	DryRun    bool               `json:"dry_run"`
+	Evaluated int                `json:"evaluated"`
+	Expired   []retentionVerdict `json:"expired"` // expired by this run (due, on a dry run)
+	Copies    int                `json:"copies_added"`
+	Short     []string           `json:"short,omitempty"` // blocks still under their min copies
+}
+
+// applyRetention evaluates every block in the chain. With execute=false it
+// only reports what would expire.
+func (s *Server) applyRetention(ctx context.Context, execute bool) retentionReport {
+	rep := retentionReport{DryRun: !execute, Expired: []retentionVerdict{}}
+	now := time.Now()
+	seen := make(map[string]bool)
+	var replicate []Block
+	var mins []int
+	blocks := s.readChain()
+	deleted := tombstonesIn(blocks)
+	for _, b := range blocks {
+		if execute && s.maint.paused() {
+			break // entering maintenance: stop deleting
+		}
+		if _, gone := deleted[b.Hash]; gone || seen[b.Hash] || !b.isData() {
+			continue
+		}
+		seen[b.Hash] = true
+		rep.Evaluated++
+		v := s.retention.evaluate(b)
+		if v.due(now) {
+			if execute {
+				m := s.expireBlock(b, v.Policy)
+				v.Expired = &m
+			}
+			rep.Expired = append(rep.Expired, v)
+			continue
+		}
+		if v.Expired == nil && v.MinCopies > 1 {
+			replicate = append(replicate, b)
+			mins = append(mins, v.MinCopies)
+		}
+	}
+	if !execute || len(replicate) == 0 {
+		return rep
+	}
+	s.retention.mu.Lock()
+	start := s.retention.copyPos % len(replicate)
+	s.retention.copyPos = start + retentionCopyChecks
+	s.retention.mu.Unlock()
+	for i := 0; i < min(len(replicate), retentionCopyChecks); i++ {
+		if ctx.Err() != nil || s.maint.paused() {
+			break
+		}
+		j := (start + i) % len(replicate)
+		added, ok := s.ensureCopies(replicate[j], mins[j])
+		rep.Copies += added
+		if !ok {
+			rep.Short = append(rep.Short, replicate[j].Hash)
+		}
+	}
+	return rep
+}
+
+// expireBlock deletes b's chunk and soft-deletes its key, then annotates
+// the chain entry. Each step tolerates a previous, interrupted run.
+func (s *Server) expireBlock(b Block, policy string) expiredMark {
+	m := expiredMark{At: time.Now().UTC(), Policy: policy}
+	err := os.Remove(filepath.Join(s.paths.ChunksDir, b.Hash+".bin"))
+	m.ChunkDeleted = err == nil || os.IsNotExist(err)
+	if !m.ChunkDeleted {
+		log.Printf("[retention] %s: delete chunk: %v", b.Hash, err)
+	}
+	s.mu.Lock()
+	delete(s.kv, "blob-"+b.Hash+"-"+b.Name)
+	s.mu.Unlock()
+	escrowed, err := revokeFileKey(s.paths, b.Hash, b.Name)
+	m.KeyRevoked = err == nil
+	if err != nil {
+		log.Printf("[retention] %s: revoke key: %v", b.Hash, err)
+	}
+	if escrowed {
+		m.Keysaver = s.revokeEscrowedKey(b.Hash)
+	}
+	if err := s.retention.markExpired(b.Hash, m); err != nil {
+		log.Printf("[retention] persist: %v", err)
+	}
+	log.Printf("[retention] %s (%s) expired by policy %s", b.Hash, b.Name, policy)
+	s.emit(eventBlockExpired, map[string]any{"hash": b.Hash, "name": b.Name, "policy": policy, "keysaver": m.Keysaver})
+	return m
+}
+
+// revokeFileKey moves the key files of hash into keys/revoked/, reporting
+// whether the key had been escrowed. No key at all is not an error.
+func revokeFileKey(paths *EnvPaths, hash, name string) (escrowed bool, err error) {
+	dir := filepath.Join(paths.BaseDir, "keys")
+	if meta, ok := readFileKeyMeta(dir, hash); ok {
+		escrowed = meta.Escrowed
+	}
+	names := []string{fileKeyName(hash), fileKeyMetaName(hash)}
+	if name != "" {
+		names = append(names, legacyFileKeyName(hash, name))
+	}
+	for _, n := range names {
+		src := filepath.Join(dir, n)
+		if !fileExists(src) {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Join(dir, revokedKeysDir), 0o700); err != nil {
+			return escrowed, err
+		}
+		if err := os.Rename(src, filepath.Join(dir, revokedKeysDir, n)); err != nil {
+			return escrowed, err
+		}
+	}
+	return escrowed, nil
+}
+
+// revokeEscrowedKey soft-deletes hash's key on every keysaver: revoked if
+// one held it, not_found if none did, else the first error.
+func (s *Server) revokeEscrowedKey(hash string) string {
+	eps := s.keysavers.order()
+	if len(eps) == 0 {
+		return "error: " + errNoKeysaver.Error()
+	}
+	res := ""
+	for _, ep := range eps {
+		op := keysaverOp{Op: "revoke", Hash: hash}
+		_, err := s.keysaverClient(ep).RevokeKey(context.Background(), hash, s.id.NodeID)
+		if st := keysaverStatus(err); st != 0 {
+			op.Endpoint, op.Status = ep.URL, st
+		}
+		if keysaverUnusable(err) {
+			s.keysavers.mark(ep, err)
+		} else {
+			s.keysavers.mark(ep, nil)
+		}
+		switch {
+		case err == nil:
+			res = "revoked"
+		case errors.Is(err, keysaverclient.ErrNotFound):
+			if res == "" {
+				res = "not_found"
+			}
+		case keysaverUnusable(err):
+			log.Printf("[retention] keysaver %s revoke %s: %v", ep.URL, hash, err)
+			op.Error = err.Error()
+			if res == "" {
+				res = "error: " + err.Error()
+			}
+		default:
+			log.Printf("[retention] keysaver %s revoke %s: %v", ep.URL, hash, err)
+			if res == "" || res == "not_found" {
+				res = fmt.Sprintf("error: HTTP %d", keysaverStatus(err))
+			}
+		}
+		s.keysavers.record(op)
+	}
+	return res
+}
+
+// ensureCopies counts the peers holding b's chunk and replicates it to
+// others until want copies exist, this node's included. Returns the copies
+// added and whether want was reached.
+func (s *Server) ensureCopies(b Block, want int) (int, bool) {
+	if !fileExists(filepath.Join(s.paths.ChunksDir, b.Hash+".bin")) {
+		return 0, true // not ours to top up
+	}
+	have := 1
+	var lacking []PeerInfo
+	for _, p := range s.rankPeers(s.peers.List()) {
+		if have >= want {
+			return 0, true
+		}
+		if p.NodeID == s.id.NodeID {
+			continue
+		}
+		if _, ok := s.peerHasChunk(p, b.Hash); ok {
+			have++
+		} else {
+			lacking = append(lacking, p)
+		}
+	}
+	if have >= want {
+		return 0, true
+	}
+	env, ok := s.blobFromDisk("blob-" + b.Hash + "-" + b.Name)
+	if !ok {
+		return 0, false
+	}
+	added := 0
+	for _, p := range lacking {
+		if have >= want {
+			break
+		}
+		if _, ok := s.replicateTo(p, b.Hash, env, nil); ok {
+			have++
+			added++
+		}
+	}
+	if have < want {
+		log.Printf("[retention] %s: %d of %d copies", b.Hash, have, want)
+	}
+	return added, have >= want
+}
+
+// ---- control API ----
+
+// GET /retention/policies, POST (token) to add or replace one
+func (s *Server) handleRetentionPolicies(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, s.retention.policies())
+	case http.MethodPost:
+		s.requireToken(s.addRetentionPolicy)(w, r)
+	default:
+		http.Error(w, "use GET or POST", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) addRetentionPolicy(w http.ResponseWriter, r *http.Request) {
+	var p retentionPolicy
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		http.Error(w, "bad policy: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := p.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if p.ID == "" {
+		b, err := secureRandom(6)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		p.ID = hex.EncodeToString(b)
+	}
+	p.Created = time.Now().UTC()
+	if err := s.retention.put(p); err != nil {
+		http.Error(w, "persist: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("[audit] retention policy %s set: %s", p.ID, p.Action)
+	writeJSON(w, p)
+}
+
+// DELETE /retention/policies/{id} (control, token)
+func (s *Server) handleRetentionPolicyDelete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "use DELETE", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.PathValue("id")
+	ok, err := s.retention.remove(id)
+	if err != nil {
+		http.Error(w, "persist: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "no such policy", http.StatusNotFound)
+		return
+	}
+	log.Printf("[audit] retention policy %s removed", id)
+	writeJSON(w, map[string]any{"status": "removed", "id": id})
+}
+
+// GET /retention/blocks[?hash=] (control): the verdict for every block, or
+// one.
+func (s *Server) handleRetentionBlocks(w http.ResponseWriter, r *http.Request) {
+	hash := r.URL.Query().Get("hash")
+	out := []retentionVerdict{}
+	seen := make(map[string]bool)
+	blocks := s.readChain()
+	deleted := tombstonesIn(blocks)
+	for _, b := range blocks {
+		if _, gone := deleted[b.Hash]; gone || seen[b.Hash] || !b.isData() || (hash != "" && b.Hash != hash) {
+			continue
+		}
+		seen[b.Hash] = true
+		out = append(out, s.retention.evaluate(b))
+	}
+	if hash != "" {
+		if len(out) == 0 {
+			http.Error(w, "unknown block", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, out[0])
+		return
+	}
+	writeJSON(w, out)
+}
+
+// POST /retention/apply[?dry_run=true] (control, token)
+func (s *Server) handleRetentionApply(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	execute := !isDryRun(r)
+	if execute {
+		if !s.maint.hold() {
+			s.writeMaintenance(w)
+			return
+		}
+		defer s.maint.release()
+	}
+	writeJSON(w, s.applyRetention(r.Context(), execute))
+}
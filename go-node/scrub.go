@@ -0,0 +1,421 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Background integrity scrub. Every hour the scrubber re-hashes the slice of
+// chunk files that keeps it on pace to cover the whole store once per
+// ScrubPeriod. The cursor (the last chunk checked, in name order) is saved
+// to scrub.state so a restart resumes the cycle. A chunk whose hash doesn't
+// match is moved to chunks/quarantine and pulled again from a peer that
+// holds an intact copy. Scrubbing runs at idle I/O priority where the OS
+// has one, caps its read rate, and pauses while the node is busy.
+
+const (
+	defaultScrubPeriod = 7 * 24 * time.Hour
+
+	scrubFile       = "scrub.state"
+	scrubTick       = time.Hour
+	scrubFirstDelay = 2 * time.Minute
+	scrubKeepCycles = 8
+	scrubSaveEvery  = 50       // files between cursor saves within a pass
+	scrubReadRate   = 16 << 20 // bytes/s
+	scrubBusyRPS    = 20       // pause while serving more requests than this
+	scrubBusyWait   = 5 * time.Second
+
+	quarantineDir = "quarantine"
+)
+
+// scrubCycle is one full pass over the chunk store.
+type scrubCycle struct {
+	Cycle        int       `json:"cycle"`
+	Started      time.Time `json:"started"`
+	Finished     time.Time `json:"finished"`
+	Checked      int       `json:"checked"`
+	Bytes        int64     `json:"bytes"`
+	Corrupt      int       `json:"corrupt"`
+	Repaired     int       `json:"repaired"`
+	RepairFailed int       `json:"repair_failed"`
+	Quarantined  []string  `json:"quarantined,omitempty"` // hashes, this cycle
+}
+
+// scrubState is persisted in scrub.state and served by /chunks/scrub-status.
+type scrubState struct {
+	Cursor   string       `json:"cursor"` // last chunk file checked in the current cycle
+	LastPass time.Time    `json:"last_pass"`
+	Current  scrubCycle   `json:"current"`
+	History  []scrubCycle `json:"history,omitempty"` // newest last
+}
+
+type scrubber struct {
+	path string
+
+	mu      sync.Mutex
+	st      scrubState
+	running bool
+
+	// request-rate sampling for yielding to foreground traffic
+	lastReqs uint64
+	lastAt   time.Time
+	rps      float64
+}
+
+func newScrubber(paths *EnvPaths) *scrubber {
+	sc := &scrubber{path: filepath.Join(paths.BaseDir, scrubFile)}
+	if b, err := os.ReadFile(sc.path); err == nil {
+		if err := json.Unmarshal(b, &sc.st); err != nil {
+			log.Printf("[scrub] ignoring bad %s: %v", sc.path, err)
+			sc.st = scrubState{}
+		}
+	}
+	if sc.st.Current.Cycle == 0 {
+		sc.st.Current = scrubCycle{Cycle: 1, Started: time.Now()}
+	}
+	return sc
+}
+
+// saveLocked persists the state; callers hold sc.mu.
+func (sc *scrubber) saveLocked() {
+	b, _ := json.MarshalIndent(sc.st, "", "  ")
+	if err := writeFileAtomic(sc.path, b); err != nil {
+		log.Printf("[scrub] save state: %v", err)
+	}
+}
+
+// startScrubLoop runs the scrub (if enabled), the retention policies (see
+// retention.go) and the tombstone sweep once an hour, except in
+// maintenance mode.
+func (s *Server) startScrubLoop(ctx context.Context) {
+	lowerIOPriority()
+	timer := time.NewTimer(scrubFirstDelay)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		func() {
+			defer recoverOnce("retention")
+			if !s.maint.hold() {
+				log.Printf("[retention] skipped: maintenance mode")
+				return
+			}
+			defer s.maint.release()
+			if n := s.sweepTombstones(); n > 0 {
+				log.Printf("[tombstone] swept %d deleted blocks", n)
+			}
+			if rep := s.applyRetention(ctx, true); len(rep.Expired) > 0 || rep.Copies > 0 {
+				log.Printf("[retention] %d blocks expired, %d copies added", len(rep.Expired), rep.Copies)
+			}
+		}()
+		if s.cfg.ScrubPeriod <= 0 {
+			timer.Reset(scrubTick)
+			continue
+		}
+		func() {
+			defer recoverOnce("scrub")
+			if !s.maint.hold() {
+				log.Printf("[scrub] skipped: maintenance mode")
+				return
+			}
+			defer s.maint.release()
+			s.scrubPass(ctx)
+		}()
+		timer.Reset(scrubTick)
+	}
+}
+
+// chunkNames lists chunk files (<hash>.bin) in name order.
+func (s *Server) chunkNames() []string {
+	entries, err := os.ReadDir(s.paths.ChunksDir)
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".bin") {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// scrubPass checks this hour's share of the store, continuing after the
+// saved cursor. Reaching the end closes the cycle.
+func (s *Server) scrubPass(ctx context.Context) {
+	sc := s.scrub
+	sc.mu.Lock()
+	if sc.running {
+		sc.mu.Unlock()
+		return
+	}
+	sc.running = true
+	cursor := sc.st.Cursor
+	sc.mu.Unlock()
+	defer func() {
+		sc.mu.Lock()
+		sc.running = false
+		sc.st.LastPass = time.Now()
+		sc.saveLocked()
+		sc.mu.Unlock()
+	}()
+
+	names := s.chunkNames()
+	quota := scrubQuota(len(names), s.cfg.ScrubPeriod)
+	start := sort.SearchStrings(names, cursor)
+	if start < len(names) && names[start] == cursor {
+		start++
+	}
+	done := 0
+	for i := start; i < len(names) && done < quota; i++ {
+		if !s.waitIdle(ctx) || s.maint.paused() {
+			return
+		}
+		s.scrubOne(names[i])
+		done++
+		sc.mu.Lock()
+		sc.st.Cursor = names[i]
+		if done%scrubSaveEvery == 0 {
+			sc.saveLocked()
+		}
+		sc.mu.Unlock()
+	}
+	if len(names) > 0 && start+done >= len(names) {
+		sc.mu.Lock()
+		cur := sc.st.Current
+		cur.Finished = time.Now()
+		log.Printf("[scrub] cycle %d done: %d checked, %d corrupt, %d repaired", cur.Cycle, cur.Checked, cur.Corrupt, cur.Repaired)
+		sc.st.History = append(sc.st.History, cur)
+		if len(sc.st.History) > scrubKeepCycles {
+			sc.st.History = sc.st.History[len(sc.st.History)-scrubKeepCycles:]
+		}
+		sc.st.Current = scrubCycle{Cycle: cur.Cycle + 1, Started: time.Now()}
+		sc.st.Cursor = ""
+		sc.mu.Unlock()
+	}
+}
+
+// scrubQuota is how many of n files one hourly pass checks so that the
+// whole store is covered once per period.
+func scrubQuota(n int, period time.Duration) int {
+	if n == 0 {
+		return 0
+	}
+	passes := int(period / scrubTick)
+	if passes < 1 {
+		passes = 1
+	}
+	q := (n + passes - 1) / passes
+	if q < 1 {
+		q = 1
+	}
+	return q
+}
+
+// waitIdle blocks while the node serves more than scrubBusyRPS requests.
+// Returns false if ctx ended.
+func (s *Server) waitIdle(ctx context.Context) bool {
+	sc := s.scrub
+	for {
+		now := time.Now()
+		n := s.requests.Load()
+		sc.mu.Lock()
+		if el := now.Sub(sc.lastAt); el >= time.Second {
+			if !sc.lastAt.IsZero() {
+				sc.rps = float64(n-sc.lastReqs) / el.Seconds()
+			}
+			sc.lastReqs, sc.lastAt = n, now
+		}
+		busy := sc.rps > scrubBusyRPS
+		sc.mu.Unlock()
+		if !busy {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(scrubBusyWait):
+		}
+	}
+}
+
+// scrubOne re-hashes one chunk file; a mismatch is quarantined and repaired.
+func (s *Server) scrubOne(name string) {
+	hash := strings.TrimSuffix(name, ".bin")
+	path := filepath.Join(s.paths.ChunksDir, name)
+	sum, n, err := hashFileThrottled(path, scrubReadRate)
+	if errors.Is(err, os.ErrNotExist) {
+		return // deleted (gc) since we listed it
+	}
+	sc := s.scrub
+	sc.mu.Lock()
+	sc.st.Current.Checked++
+	sc.st.Current.Bytes += n
+	sc.mu.Unlock()
+	if err == nil && sum == hash {
+		if st, err := os.Stat(path); err == nil {
+			s.chunkCheck.mu.Lock()
+			s.chunkCheck.seen[hash] = chunkVerified{size: st.Size(), mod: st.ModTime(), at: time.Now()}
+			s.chunkCheck.mu.Unlock()
+		}
+		return
+	}
+	if err != nil {
+		log.Printf("[scrub] %s: read error: %v", hash, err)
+	} else {
+		log.Printf("[scrub] %s: CORRUPT (content hashes to %s)", hash, sum)
+	}
+	s.chunkCheck.mu.Lock()
+	delete(s.chunkCheck.seen, hash)
+	s.chunkCheck.mu.Unlock()
+
+	sc.mu.Lock()
+	sc.st.Current.Corrupt++
+	sc.st.Current.Quarantined = append(sc.st.Current.Quarantined, hash)
+	sc.mu.Unlock()
+	if qerr := quarantineChunk(s.paths.ChunksDir, name); qerr != nil {
+		log.Printf("[scrub] %s: quarantine: %v", hash, qerr)
+	}
+
+	from, rerr := s.repairChunk(hash)
+	sc.mu.Lock()
+	if rerr != nil {
+		sc.st.Current.RepairFailed++
+	} else {
+		sc.st.Current.Repaired++
+	}
+	sc.mu.Unlock()
+	s.emit(eventChunkCorrupt, map[string]any{"hash": hash, "repaired": rerr == nil, "from": from})
+	if rerr != nil {
+		log.Printf("[scrub] %s: repair failed: %v", hash, rerr)
+		return
+	}
+	log.Printf("[scrub] %s: repaired from %.8s", hash, from)
+}
+
+// hashFileThrottled hashes path reading at most rate bytes per second.
+func hashFileThrottled(path string, rate int64) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	buf := make([]byte, 1<<20)
+	start := time.Now()
+	var n int64
+	for {
+		m, err := f.Read(buf)
+		h.Write(buf[:m])
+		n += int64(m)
+		if ahead := time.Duration(n*int64(time.Second)/rate) - time.Since(start); ahead > 0 {
+			time.Sleep(ahead)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", n, err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// quarantineChunk moves a bad chunk aside so nothing serves it, keeping the
+// bytes for inspection.
+func quarantineChunk(chunksDir, name string) error {
+	dir := filepath.Join(chunksDir, quarantineDir)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	return os.Rename(filepath.Join(chunksDir, name), filepath.Join(dir, fmt.Sprintf("%s.%d", name, time.Now().Unix())))
+}
+
+// repairChunk pulls an intact copy of hash from a peer that has it and its
+// block, checks it, and writes it back. Returns the peer's node ID.
+func (s *Server) repairChunk(hash string) (string, error) {
+	blk, err := s.blockFor(hash)
+	if err != nil {
+		return "", err // not in our chain: nothing to name the blob by
+	}
+	if s.abandoned.has(hash) {
+		return "", errors.New("abandoned by its origin")
+	}
+	if _, ok := s.retention.expired(hash); ok {
+		return "", errors.New("expired by retention policy")
+	}
+	if _, ok := s.tombstoneFor(hash); ok {
+		return "", errors.New("deleted by its origin")
+	}
+	key := "blob-" + hash + "-" + blk.Name
+	for _, p := range s.rankPeers(s.peers.List()) {
+		if p.NodeID == s.id.NodeID {
+			continue
+		}
+		if _, ok := s.peerHasChunk(p, hash); !ok {
+			continue
+		}
+		b, _, err := s.fetchFromPeer(p, key)
+		var env ReplicateEnvelope
+		if err == nil {
+			err = json.Unmarshal(b, &env)
+		}
+		var ct []byte
+		if err == nil {
+			ct, err = base64.RawURLEncoding.DecodeString(env.CipherB64)
+		}
+		if err == nil {
+			err = writeChunk(filepath.Join(s.paths.ChunksDir, hash+".bin"), ct)
+		}
+		if err != nil {
+			log.Printf("[scrub] %s from %.8s: %v", hash, p.NodeID, err)
+			continue
+		}
+		return p.NodeID, nil
+	}
+	return "", errors.New("no peer holds an intact copy")
+}
+
+// GET /chunks/scrub-status (control)
+func (s *Server) handleScrubStatus(w http.ResponseWriter, r *http.Request) {
+	sc := s.scrub
+	total := len(s.chunkNames())
+	sc.mu.Lock()
+	st := sc.st
+	st.History = append([]scrubCycle(nil), sc.st.History...)
+	running := sc.running
+	rps := sc.rps
+	sc.mu.Unlock()
+	writeJSON(w, map[string]any{
+		"enabled":        s.cfg.ScrubPeriod > 0,
+		"period":         s.cfg.ScrubPeriod.String(),
+		"chunks":         total,
+		"per_pass":       scrubQuota(total, s.cfg.ScrubPeriod),
+		"running":        running,
+		"request_rate":   rps,
+		"cursor":         st.Cursor,
+		"last_pass":      st.LastPass,
+		"current":        st.Current,
+		"history":        st.History,
+		"read_rate_bps":  scrubReadRate,
+		"busy_threshold": scrubBusyRPS,
+	})
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"unsafe"
+)
+
+// Secret memory hygiene. Passphrase bytes and the key derived from them are
+// wiped as soon as env.enc is opened or sealed, and so is the decrypted
+// env.enc plaintext. The BeaconKey and FileKey stay in EnvSecrets for the
+// life of the node; lockSecrets pins them in RAM (mlock / VirtualLock) so
+// they are not written to swap. Go strings cannot be wiped, so secrets are
+// carried as byte slices or arrays wherever this code controls the copy.
+
+// wipeBytes zeroes b.
+func wipeBytes(b []byte) {
+	clear(b)
+}
+
+// takePassphrase copies the n bytes a host wrote into buf to locked memory
+// and wipes buf. ok is false when n overflows buf; n <= 0 (the host
+// refused) gives no passphrase.
+func takePassphrase(buf []byte, n int) (pass []byte, ok bool) {
+	if n > 0 && n <= len(buf) {
+		pass = make([]byte, n)
+		lockMemory(pass)
+		copy(pass, buf[:n])
+	}
+	wipeBytes(buf)
+	return pass, n <= len(buf)
+}
+
+// lockSecrets locks the key arrays of sec in memory, false where the
+// platform refuses (rlimit, privileges) or has no support.
+func lockSecrets(sec *EnvSecrets) bool {
+	if sec == nil {
+		return false
+	}
+	b := unsafe.Slice((*byte)(unsafe.Pointer(&sec.BeaconKey)), unsafe.Offsetof(sec.FileKey)-unsafe.Offsetof(sec.BeaconKey)+uintptr(len(sec.FileKey)))
+	return lockMemory(b)
+}
+
+// envKey is a 32-byte key stored in env.enc as unpadded base64url. It
+// decodes straight from the plaintext into the array, without an
+// intermediate string.
+type envKey [32]byte
+
+func (k *envKey) UnmarshalJSON(b []byte) error {
+	if len(b) < 2 || b[0] != '"' || b[len(b)-1] != '"' {
+		return errors.New("key: want a string")
+	}
+	src := b[1 : len(b)-1]
+	if base64.RawURLEncoding.DecodedLen(len(src)) != len(k) {
+		return errors.New("key: want 32 bytes")
+	}
+	_, err := base64.RawURLEncoding.Decode(k[:], src)
+	return err
+}
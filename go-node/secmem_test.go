@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"log"
+	"testing"
+)
+
+// The sequence P2P_InitSecure runs: take the passphrase out of the host's
+// buffer, open env.enc with it, wipe it. Afterwards neither the buffer nor
+// the Go copy holds a byte of it, and nothing derived from it was logged.
+func TestPassphraseZeroedAfterInit(t *testing.T) {
+	secret := []byte("correct horse battery staple")
+	paths, err := initStorageEnv(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logs bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&logs)
+
+	var sec *EnvSecrets
+	for _, create := range []bool{true, false} { // first start, then a restart
+		buf := make([]byte, 64)
+		n := copy(buf, secret)
+		pass, ok := takePassphrase(buf, n)
+		if !ok || !bytes.Equal(pass, secret) {
+			t.Fatalf("took %q", pass)
+		}
+		if !allZero(buf) {
+			t.Fatal("host buffer not wiped")
+		}
+		if create {
+			sec, err = createEnvSecrets(paths, pass, "")
+		} else {
+			sec, err = loadEnvSecrets(paths, pass)
+		}
+		wipeBytes(pass) // P2P_InitSecure defers this
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !allZero(pass) {
+			t.Fatal("Go copy not wiped")
+		}
+	}
+	lockSecrets(sec) // best effort; must not fault
+
+	out := logs.String()
+	for _, leak := range []string{
+		string(secret),
+		base64.RawURLEncoding.EncodeToString(sec.BeaconKey[:]),
+		base64.StdEncoding.EncodeToString(sec.BeaconKey[:]),
+		base64.RawURLEncoding.EncodeToString(sec.FileKey[:]),
+	} {
+		if bytes.Contains([]byte(out), []byte(leak)) {
+			t.Fatalf("log carries secret material %q", leak)
+		}
+	}
+}
+
+func TestTakePassphraseRefusals(t *testing.T) {
+	buf := []byte("secret")
+	if pass, ok := takePassphrase(buf, 0); pass != nil || !ok || !allZero(buf) {
+		t.Fatalf("host refused: %q %v", pass, ok)
+	}
+	buf = []byte("secret")
+	if pass, ok := takePassphrase(buf, 7); pass != nil || ok || !allZero(buf) {
+		t.Fatalf("overflow: %q %v", pass, ok)
+	}
+}
+
+func allZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Send-file progress. /mix/send-file?progress=chunked answers with NDJSON
+// instead of a single document: one {"event": ...} line per step as it
+// happens (read, encrypted, chunk_written, block_appended, fanout per
+// peer), flushed right away, and last the SendFileResponse as the plain
+// call would return it. A failure after the first line can't change the
+// status code, so it ends the stream with {"event":"error","error":...,
+// "code":...} instead.
+// Deliveries still running after the quorum keep going but are no longer
+// reported; GET /transfers has them.
+
+const progressReadEvery = 4 << 20 // bytes between "read" events
+
+type sendProgress struct {
+	mu     sync.Mutex
+	w      http.ResponseWriter
+	fl     http.Flusher
+	enc    *json.Encoder
+	closed bool
+}
+
+// newSendProgress returns the stream for a ?progress=chunked request, nil
+// for one without it. ok is false when the request asked for it and the
+// writer can't flush; the error has been written then.
+func newSendProgress(w http.ResponseWriter, r *http.Request) (*sendProgress, bool) {
+	if r.URL.Query().Get("progress") != "chunked" {
+		return nil, true
+	}
+	fl, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return nil, false
+	}
+	// "read" events go out while the body is still coming in; without
+	// full duplex an HTTP/1 server drains the unread body at the first
+	// flush, taking the rest of the file with it
+	if err := http.NewResponseController(w).EnableFullDuplex(); err != nil && r.ProtoMajor == 1 {
+		http.Error(w, "streaming unsupported: "+err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no")
+	return &sendProgress{w: w, fl: fl, enc: json.NewEncoder(w)}, true
+}
+
+// emit writes one event line. A nil or closed stream drops it.
+func (p *sendProgress) emit(event string, fields map[string]any) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	line := map[string]any{"event": event}
+	for k, v := range fields {
+		line[k] = v
+	}
+	_ = p.enc.Encode(line)
+	p.fl.Flush()
+}
+
+// tail returns the writer for the request's response: w itself without a
+// stream, else one that ends the stream with the response as its last line
+// (a non-JSON one, i.e. an http.Error, as an "error" event).
+func (p *sendProgress) tail(w http.ResponseWriter) http.ResponseWriter {
+	if p == nil {
+		return w
+	}
+	return &progressTail{p: p, hdr: http.Header{}, code: http.StatusOK}
+}
+
+type progressTail struct {
+	p    *sendProgress
+	hdr  http.Header
+	code int
+}
+
+func (t *progressTail) Header() http.Header  { return t.hdr }
+func (t *progressTail) WriteHeader(code int) { t.code = code }
+
+func (t *progressTail) Write(b []byte) (int, error) {
+	p := t.p
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return len(b), nil
+	}
+	if strings.HasPrefix(t.hdr.Get("Content-Type"), "application/json") {
+		_, _ = p.w.Write(b)
+	} else {
+		_ = p.enc.Encode(map[string]any{"event": "error", "error": strings.TrimSpace(string(b)), "code": t.code})
+	}
+	p.fl.Flush()
+	p.closed = true
+	return len(b), nil
+}
+
+// progressReader reports every progressReadEvery bytes read.
+type progressReader struct {
+	r    io.Reader
+	p    *sendProgress
+	n    int64
+	next int64
+}
+
+func (pr *progressReader) Read(b []byte) (int, error) {
+	n, err := pr.r.Read(b)
+	pr.n += int64(n)
+	if pr.n >= pr.next {
+		pr.p.emit("read", map[string]any{"bytes": pr.n})
+		pr.next = pr.n + progressReadEvery
+	}
+	return n, err
+}
+
+// reader wraps r to report reads; without a stream it returns r.
+func (p *sendProgress) reader(r io.Reader) io.Reader {
+	if p == nil {
+		return r
+	}
+	return &progressReader{r: r, p: p, next: progressReadEvery}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// streamSendFile posts body to s's /mix/send-file?progress=chunked over a
+// real connection and returns the response and a reader over its lines.
+func streamSendFile(t *testing.T, s *Server, name string, body io.Reader) (*http.Response, *bufio.Scanner) {
+	t.Helper()
+	ts := httptest.NewServer(s.ControlHandler())
+	t.Cleanup(ts.Close)
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/mix/send-file?progress=chunked&name="+name, body)
+	req.Header.Set("Authorization", "Bearer "+s.ctlToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	sc := bufio.NewScanner(resp.Body)
+	sc.Buffer(nil, 1<<20)
+	return resp, sc
+}
+
+// The events arrive one NDJSON line at a time, in the order the send goes
+// through them, and the last line is the plain call's SendFileResponse.
+func TestSendFileProgressStream(t *testing.T) {
+	a, b := newTestServer(t, "a", nil), newTestServer(t, "b", nil)
+	meet(t, a, b)
+	data := bytes.Repeat([]byte("progress "), 1000)
+	resp, sc := streamSendFile(t, a, "p.txt", bytes.NewReader(data))
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/x-ndjson" || !slices.Contains(resp.TransferEncoding, "chunked") {
+		t.Fatalf("%d %v %v", resp.StatusCode, resp.Header, resp.TransferEncoding)
+	}
+	var events []string
+	var last []byte
+	for sc.Scan() {
+		last = slices.Clone(sc.Bytes())
+		var ev map[string]any
+		if err := json.Unmarshal(last, &ev); err != nil {
+			t.Fatalf("line %q: %v", last, err)
+		}
+		if e, ok := ev["event"].(string); ok {
+			events = append(events, e)
+			if e == "fanout" && (ev["peer"] != b.id.NodeID || ev["ok"] != true) {
+				t.Fatalf("fanout event %v", ev)
+			}
+		}
+	}
+	if want := []string{"read", "encrypted", "chunk_written", "block_appended", "fanout_start", "fanout"}; !slices.Equal(events, want) {
+		t.Fatalf("events %v, want %v", events, want)
+	}
+	var res SendFileResponse
+	if err := json.Unmarshal(last, &res); err != nil || res.Status != "ok" || res.Fanout != 1 || res.RawSize != len(data) || !res.Durable {
+		t.Fatalf("summary %s: %v", last, err)
+	}
+	if len(b.readChain()) != 1 {
+		t.Fatal("peer never got the block")
+	}
+
+	// without the flag: one JSON document, as before
+	rr := callControl(a, http.MethodPost, "/mix/send-file?name=q.txt", a.ctlToken, bytes.NewReader(data))
+	if err := json.Unmarshal(rr.Body.Bytes(), &res); err != nil || rr.Header().Get("Content-Type") != "application/json" || res.Status != "ok" {
+		t.Fatalf("plain: %s %v", rr.Body, err)
+	}
+}
+
+// A "read" event goes out while the upload is still coming in, and
+// flushing it doesn't cut the rest of the body off.
+func TestSendFileProgressFlushesMidUpload(t *testing.T) {
+	s := newTestServer(t, "a", nil)
+	meet(t, s, newTestServer(t, "b", nil))
+	pr, pw := io.Pipe()
+	first := bytes.Repeat([]byte{'x'}, progressReadEvery+1)
+	go pw.Write(first)
+	resp, sc := streamSendFile(t, s, "big.bin", pr)
+	lines := make(chan []byte)
+	go func() {
+		defer close(lines)
+		for sc.Scan() {
+			lines <- slices.Clone(sc.Bytes())
+		}
+	}()
+	select {
+	case l := <-lines:
+		var ev struct {
+			Event string `json:"event"`
+			Bytes int    `json:"bytes"`
+			Done  bool   `json:"done"`
+		}
+		if json.Unmarshal(l, &ev) != nil || ev.Event != "read" || ev.Done || ev.Bytes < progressReadEvery {
+			t.Fatalf("first line %s", l)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("no event before the upload finished: not flushed")
+	}
+	pw.Write([]byte("tail"))
+	pw.Close()
+	var last []byte
+	for l := range lines {
+		last = l
+	}
+	var res SendFileResponse
+	if err := json.Unmarshal(last, &res); err != nil || res.RawSize != len(first)+4 {
+		t.Fatalf("status %d, last line %s: %v", resp.StatusCode, last, err)
+	}
+}
+
+// A failure once lines have gone out can't change the status any more:
+// an http.Error ends the stream as an error event, a JSON answer such as
+// storage_full as the last line.
+func TestSendFileProgressError(t *testing.T) {
+	s := newTestServer(t, "a", nil)
+	meet(t, s, newTestServer(t, "b", nil))
+	lastLine := func() map[string]any {
+		resp, sc := streamSendFile(t, s, "f.txt", bytes.NewReader([]byte("x")))
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status %d", resp.StatusCode)
+		}
+		var last map[string]any
+		for sc.Scan() {
+			last = nil
+			if err := json.Unmarshal(sc.Bytes(), &last); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return last
+	}
+
+	// the chunk can't be written: chunks/ is a file
+	blocker := filepath.Join(t.TempDir(), "chunks")
+	if err := os.WriteFile(blocker, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	dir := s.paths.ChunksDir
+	s.paths.ChunksDir = blocker
+	if last := lastLine(); last["event"] != "error" || last["code"] != float64(http.StatusInternalServerError) || last["error"] == "" {
+		t.Fatalf("write failure: %v", last)
+	}
+	s.paths.ChunksDir = dir
+
+	s.cfg.DiskReserveBytes = 1 << 62
+	if last := lastLine(); last["status"] != "storage_full" {
+		t.Fatalf("disk full: %v", last)
+	}
+}
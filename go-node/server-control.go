@@ -2,9 +2,10 @@ package main
 
 import (
 	"bytes"
-	"crypto/rand"
+	"cmp"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -12,6 +13,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -20,18 +22,49 @@ import (
 
 // ---- Control-plane actions (localhost only) ----
 
-// POST /mix/send-text?to=<DEST_NODE_ID>
-// Body: raw text (encrypted with demo key), routed via mixnet to the final hop.
+// POST /mix/send-text?to=<DEST_NODE_ID>[&class=interactive|bulk|background][&hops=N&pad=N&retries=N][&strategy=furthest|lowlatency|random|nearest][&queue=true][&expires_in=24h]
+// Body: raw text, sealed to the destination's X25519 key (text_seal.go; the
+// shared hard-coded key with legacy=1) and routed via mixnet to the final hop.
+// With queue=true a send that finds no path or first hop goes to the outbox.
+// expires_in asks the receiver to drop the message that long after the send
+// (inbox_expiry.go); the receiver caps it. A receiver that acks texts is
+// asked to; GET /mix/status?msgid= follows the delivery (delivery_ack.go).
 func (s *Server) handleSendText(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "use POST", http.StatusMethodNotAllowed)
 		return
 	}
-	destID := r.URL.Query().Get("to")
+	destID, ok := s.nodeIDParam(w, "to", r.URL.Query().Get("to"))
+	if !ok {
+		return
+	}
 	if destID == "" {
 		http.Error(w, "missing ?to=<destNodeID>", http.StatusBadRequest)
 		return
 	}
+	className := r.URL.Query().Get("class")
+	if className == "" {
+		className = defaultMixClass
+	}
+	class, ok := s.cfg.mixClassFor(className)
+	if !ok {
+		http.Error(w, "unknown class; one of "+strings.Join(mixClassNames(s.cfg.MixClasses), ", "), http.StatusBadRequest)
+		return
+	}
+	class, err := applyMixOverrides(class, r.URL.Query())
+	if err != nil {
+		http.Error(w, "bad class override: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var expires int64
+	if v := r.URL.Query().Get("expires_in"); v != "" {
+		d, err := parseRetentionAge(v)
+		if err != nil {
+			http.Error(w, "bad expires_in: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		expires = time.Now().Add(d).Unix()
+	}
 	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20)) // 1MB cap
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -39,65 +72,159 @@ func (s *Server) handleSendText(w http.ResponseWriter, r *http.Request) {
 	}
 	defer r.Body.Close()
 
-	ctB64, err := encryptTextHardcoded(body)
-	if err != nil {
-		http.Error(w, "encrypt fail: "+err.Error(), http.StatusInternalServerError)
+	// ?legacy=1: the shared hardcoded key, for receivers that can't open a
+	// boxed text yet
+	legacy := r.URL.Query().Get("legacy") == "1"
+	if legacy && s.refuseLegacy(w, legacyHardcodedText) {
 		return
 	}
 
 	// msg id
-	msgidBytes := make([]byte, 12)
-	if _, err := rand.Read(msgidBytes); err != nil {
+	msgidBytes, err := secureRandom(12)
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	msgid := base64.RawURLEncoding.EncodeToString(msgidBytes)
 
+	if s.dups.duplicated(destID) {
+		http.Error(w, "destination NodeID is held by more than one machine", http.StatusConflict)
+		return
+	}
+	// choose path (by the class's strategy, ends at dest)
+	hops, div, err := s.mixPath(class.Path, destID, class.Hops)
+	if err != nil && s.queueSend(w, r, outboxText, body, err) {
+		return
+	}
+	if errors.Is(err, errPendingKey) {
+		writePendingKey(w, destID)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkPathLen(r.URL.Query(), class, hops); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	env := FinalEnvelope{
 		Type:       "text",
 		SenderID:   s.id.NodeID,
 		ReceiverID: destID,
 		MsgID:      msgid,
-		DataB64:    ctB64,
+		Logical:    s.lamport.tick(),
+		SentUnix:   time.Now().Unix(),
+		Expires:    expires,
+		Ack:        s.wantsAck(destID),
+	}
+	if legacy {
+		env.DataB64, err = encryptTextHardcoded(body)
+	} else {
+		err = sealText(&env, hops[len(hops)-1].PubKey, body) // the path ends at dest
 	}
-	envBytes, _ := json.Marshal(env)
-
-	// choose path (furthest, ends at dest)
-	peers := s.peers.List()
-	hops, err := chooseHopsFurthest(s.id.NodeID, destID, peers, 4)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		http.Error(w, "encrypt fail: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
+	envBytes, _ := json.Marshal(env)
 
-	onion, err := buildOnion(hops, envBytes, 8)
+	// ?trace=1 asks every hop to report back to us (opt-in: reveals origin to hops)
+	traceTo := ""
+	if r.URL.Query().Get("trace") == "1" {
+		traceTo = s.id.NodeID
+	}
+	onion, err := buildOnion(hops, envBytes, mixTTL, msgid, traceTo, className, class.PadCell)
 	if err != nil {
 		http.Error(w, "onion build failed: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	first := hops[0].Addr
-	resp, err := http.Post(fmt.Sprintf("http://%s/mix/relay", first), "application/json", bytes.NewReader(onion))
-	if err != nil {
-		http.Error(w, "inject fail: "+err.Error(), http.StatusBadGateway)
+	// Injection failures (first hop or anything down the path answering
+	// with an error) are retried within the class's budget, at least
+	// mixPathAttempts times; each of the first mixPathAttempts tries a new
+	// path without the first hops that failed (mix_failover.go)
+	var resp *http.Response
+	var first string
+	failedFirst := make(map[string]bool)
+	attempt := 1
+	for ; ; attempt++ {
+		resp, first, err = s.postToAddr(hops[0].Addr, "/mix/relay", onion, onionHeader(firstForm(hops, class.PadCell)))
+		if forwardOK(resp, err) {
+			break
+		}
+		if err == nil {
+			err = fmt.Errorf("status %d", resp.StatusCode)
+			resp.Body.Close()
+		} else {
+			s.peers.MarkMix(hops[0].NodeID, false, time.Now())
+		}
+		if attempt >= max(class.Retries+1, mixPathAttempts) {
+			if s.queueSend(w, r, outboxText, body, err) {
+				return
+			}
+			s.deliveries.failed(msgid, destID, err.Error(), time.Now())
+			http.Error(w, "inject fail: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		log.Printf("[mix] send-text %s attempt %d via %.8s failed: %v", msgid, attempt, hops[0].NodeID, err)
+		time.Sleep(time.Duration(attempt) * 500 * time.Millisecond)
+		if attempt < mixPathAttempts && hops[0].NodeID != destID {
+			failedFirst[hops[0].NodeID] = true
+			// an alternate path is never shorter than the first one
+			if alt, altDiv, err := s.mixPathAvoiding(class.Path, destID, class.Hops, failedFirst); err == nil && len(alt) >= len(hops) {
+				if o, err := buildOnion(alt, envBytes, mixTTL, msgid, traceTo, className, class.PadCell); err == nil {
+					hops, div, onion = alt, altDiv, o
+				}
+			}
+		}
+	}
+	defer resp.Body.Close()
+	now := time.Now()
+	if resp.StatusCode >= 300 {
+		// refused on the path (4xx) or the destination's quota (507): the
+		// delivery record and the answer both say so
+		if passStorageFull(w, resp) {
+			s.deliveries.failed(msgid, destID, "storage full", now)
+			return
+		}
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+		reason := fmt.Sprintf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+		s.deliveries.failed(msgid, destID, reason, now)
+		code := resp.StatusCode
+		if code < 400 {
+			code = http.StatusBadGateway
+		}
+		http.Error(w, "inject fail: "+reason, code)
 		return
 	}
-	_ = resp.Body.Close()
+	for _, h := range hops {
+		s.peers.MarkMix(h.NodeID, true, now)
+	}
+	s.deliveries.sent(msgid, destID, env.Ack, now)
+	s.trace(msgid, traceInject, first)
+	s.convSent(destID, msgid, env.Logical, body)
 
-	writeJSON(w, map[string]any{
-		"status":    "sent",
-		"type":      "text",
-		"msgid":     msgid,
-		"first_hop": first,
-		"hops":      len(hops),
+	writeJSON(w, SendTextResponse{
+		Status:    "sent",
+		Type:      "text",
+		MsgID:     msgid,
+		FirstHop:  first,
+		Hops:      len(hops),
+		Class:     className,
+		Strategy:  cmp.Or(class.Path, pathFurthest),
+		Attempt:   attempt,
+		Ack:       env.Ack,
+		Diversity: div,
 	})
 }
 
-// POST /mix/send-file?name=<filename>
-// Body: file bytes. Encrypt once, hash ciphertext, store locally, then fanout SAME blob to all peers.
-// POST /mix/send-file?name=<filename>
+// POST /mix/send-file?name=<filename>[&queue=true][&progress=chunked]
 // Body: file bytes. Encrypt once with a fresh per-file key, hash ciphertext,
-// store locally, append to chain, then fanout SAME blob to all peers.
+// store locally, append to chain, then fanout SAME blob to all peers. With
+// queue=true and no peer known, the file waits in the outbox instead.
+// progress=chunked streams the steps as NDJSON (send_progress.go).
 func (s *Server) handleSendFileDistribute(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "use POST", http.StatusMethodNotAllowed)
@@ -108,54 +235,151 @@ func (s *Server) handleSendFileDistribute(w http.ResponseWriter, r *http.Request
 		http.Error(w, "missing ?name=<filename>", http.StatusBadRequest)
 		return
 	}
+	prog, ok := newSendProgress(w, r)
+	if !ok {
+		return
+	}
+	out := prog.tail(w)
 
-	data, err := io.ReadAll(io.LimitReader(r.Body, 128<<20)) // 128MB cap; tune as needed
+	data, err := io.ReadAll(io.LimitReader(prog.reader(r.Body), 128<<20)) // 128MB cap; tune as needed
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		http.Error(out, err.Error(), http.StatusBadRequest)
 		return
 	}
 	defer r.Body.Close()
+	prog.emit("read", map[string]any{"bytes": len(data), "done": true})
+	if len(s.peers.List()) == 0 && s.queueSend(out, r, outboxFile, data, errors.New("no peers known")) {
+		return
+	}
+	if err := s.checkDiskFor(int64(len(data))); err != nil {
+		s.writeDiskFull(out, name, err)
+		return
+	}
+	sf, err := s.sealAndStore(name, data, "", prog)
+	if err != nil {
+		http.Error(out, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// ---- Fanout SAME ciphertext to ALL peers (no re-encrypt)
+	traced := r.URL.Query().Get("trace") == "1"
+	s.trace(sf.MsgID, traceInject, name)
+	peers := s.rankPeers(s.peers.List())
+	hdr := http.Header{}
+	if traced {
+		hdr.Set(traceHeader, "1")
+	}
+	// best-scored peers first; once the quorum acked the block is durable and
+	// the rest keeps going in the background
+	// the transfer ID is the msgid: POST /transfers/<msgid>/cancel stops it
+	t := s.transfers.start(transferSend, sf.MsgID, name, sf.Hash)
+	s.transfers.update(t, func(t *transfer) { t.progress = prog })
+	prog.emit("fanout_start", map[string]any{"peers": len(peers), "quorum": s.cfg.ReplicateQuorum})
+	res := s.fanoutWithQuorum(t, peers, sf.Env, hdr, s.cfg.ReplicateQuorum)
+
+	writeJSON(out, SendFileResponse{
+		Status:    "ok",
+		MsgID:     sf.MsgID,
+		Name:      name,
+		Hash:      sf.Hash,
+		StoreKey:  sf.StoreKey,
+		Fanout:    res.Acked,
+		PeersSeen: len(peers),
+		Quorum:    s.cfg.ReplicateQuorum,
+		Durable:   res.Durable,
+		Pending:   res.Pending,
+		Cancelled: res.Cancelled,
+		KeyFile:   sf.KeyFile,
+
+		Compression: sf.Comp,
+		RawSize:     len(data),
+		Ratio:       float64(sf.Sealed) / float64(max(len(data), 1)),
+	})
+}
 
-	// ---- Encrypt ONCE with a fresh per-file key (anti-ransomware design)
+// sealedFile is one file encrypted, stored and appended by sealAndStore.
+type sealedFile struct {
+	MsgID    string
+	Hash     string
+	StoreKey string
+	KeyFile  string
+	Comp     string
+	Sealed   int    // payload bytes sealed (after compression)
+	Env      []byte // the envelope fanned out to peers
+}
+
+// sealAndStore encrypts data once with a fresh per-file key (anti-ransomware
+// design), saves the key locally, writes the chunk and appends the block
+// linked to the current chain tip. batch tags the block with its BatchID
+// ("" for single sends); prog, if not nil, is told each step.
+func (s *Server) sealAndStore(name string, data []byte, batch string, prog *sendProgress) (sealedFile, error) {
 	fileKey, err := newFileKey()
 	if err != nil {
-		http.Error(w, "file key gen fail: "+err.Error(), http.StatusInternalServerError)
-		return
+		return sealedFile{}, fmt.Errorf("file key gen fail: %w", err)
 	}
-	ctRaw, err := aeadSealWithKey(fileKey[:], data) // nonce||ct
+	// compress first: ciphertext doesn't compress
+	payload, comp := data, ""
+	if s.cfg.Compress {
+		payload, comp = maybeCompress(name, data)
+	}
+	rawSize := 0
+	if comp != "" {
+		rawSize = len(data)
+	}
+	// padded, the sizes go inside the ciphertext (metapad.go)
+	pad, sealNames := s.metaOptions()
+	sealed := payload
+	if pad {
+		sealed, rawSize = padPayload(payload, rawSize), 0
+	}
+	ctRaw, err := aeadSealWithKey(fileKey[:], sealed) // nonce||ct
 	if err != nil {
-		http.Error(w, "encrypt fail: "+err.Error(), http.StatusInternalServerError)
-		return
+		return sealedFile{}, fmt.Errorf("encrypt fail: %w", err)
 	}
 	hashHex := sha256Hex(ctRaw)
-
-	// Key filename: <first16_of_hash>.<ext>.fkey (stored locally only)
-	ext := "bin"
-	if dot := strings.LastIndex(name, "."); dot >= 0 && dot+1 < len(name) {
-		ext = name[dot+1:]
+	prog.emit("encrypted", map[string]any{"bytes": len(ctRaw), "hash": hashHex, "compression": comp, "padded": pad})
+	wireName := name
+	if sealNames {
+		if wireName, err = sealName(fileKey, name); err != nil {
+			return sealedFile{}, fmt.Errorf("seal name fail: %w", err)
+		}
 	}
-	keyFileName := fmt.Sprintf("%s.%s.fkey", hashHex[:16], ext)
-	if _, err := saveFileKey(s.paths, keyFileName, &fileKey); err != nil {
+
+	// Key filename: <hash>.fkey plus a <hash>.json sidecar (stored locally only)
+	meta := fileKeyMeta{Name: name, Created: time.Now().Unix(), Size: len(data)}
+	if _, err := saveFileKey(s.paths, hashHex, &fileKey, meta); err != nil {
 		log.Printf("[keyfile] save failed: %v", err)
 	}
 
 	// ---- Build envelope (no keys inside), link to current chain tip
-	msgidBytes := make([]byte, 16)
-	_, _ = rand.Read(msgidBytes)
+	msgidBytes, err := secureRandom(16)
+	if err != nil {
+		return sealedFile{}, err
+	}
 	msgid := base64.RawURLEncoding.EncodeToString(msgidBytes)
 	prev := s.getChainTip()
 
 	env := ReplicateEnvelope{
 		MsgID:     msgid,
 		OriginID:  s.id.NodeID,
-		Name:      name,
+		Name:      wireName,
 		HashHex:   hashHex,
 		PrevHash:  prev,
+		OrgID:     s.org.ID,
 		CipherB64: base64.RawURLEncoding.EncodeToString(ctRaw),
 		Created:   time.Now().Unix(),
 		Hops:      0,
+		Comp:      comp,
+		Logical:   s.lamport.tick(),
+		Batch:     batch,
+		PlainHash: sha256Hex(data),
+	}
+	env.RawSize = rawSize
+	if pad {
+		env.Pad = padBucket
 	}
-	storeKey := "blob-" + hashHex + "-" + name
+	env.NameSealed = sealNames
+	storeKey := "blob-" + hashHex + "-" + wireName
 	envBytes, _ := json.Marshal(env)
 
 	// ---- Cache envelope and persist chunk locally
@@ -163,69 +387,62 @@ func (s *Server) handleSendFileDistribute(w http.ResponseWriter, r *http.Request
 	s.kv[storeKey] = envBytes
 	s.mu.Unlock()
 
+	// the block is only appended once the chunk is durably on disk
 	chunkPath := filepath.Join(s.paths.ChunksDir, hashHex+".bin")
-	if err := os.WriteFile(chunkPath, ctRaw, 0600); err != nil {
+	if err := writeChunk(chunkPath, ctRaw); err != nil {
 		log.Printf("[chunk-save] failed: %v", err)
-	} else {
-		log.Printf("[chunk-save] saved chunk %s (%d bytes)", chunkPath, len(ctRaw))
+		return sealedFile{}, fmt.Errorf("chunk write fail: %w", err)
 	}
+	log.Printf("[chunk-save] saved chunk %s (%d bytes)", chunkPath, len(ctRaw))
+	prog.emit("chunk_written", map[string]any{"bytes": len(ctRaw)})
 
 	// ---- Append block to local chain
 	blk := Block{
-		Hash:     env.HashHex,
-		PrevHash: env.PrevHash,
-		Name:     env.Name,
-		Size:     len(ctRaw),
-		Created:  env.Created,
-		OriginID: env.OriginID,
+		Hash:      env.HashHex,
+		PrevHash:  env.PrevHash,
+		Name:      env.Name,
+		Size:      len(ctRaw),
+		Created:   env.Created,
+		OriginID:  env.OriginID,
+		Comp:      env.Comp,
+		RawSize:   env.RawSize,
+		Logical:   env.Logical,
+		Batch:     env.Batch,
+		PlainHash: env.PlainHash,
 	}
+	blk.Pad, blk.NameSealed = env.Pad, env.NameSealed
 	if err := s.appendBlock(blk); err != nil {
-		http.Error(w, "append block fail: "+err.Error(), http.StatusInternalServerError)
-		return
+		return sealedFile{}, fmt.Errorf("append block fail: %w", err)
 	}
+	prog.emit("block_appended", map[string]any{"msgid": msgid, "hash": hashHex, "prev": prev})
 
 	// mark seen
 	s.seenMu.Lock()
 	s.seen[msgid] = struct{}{}
 	s.seenMu.Unlock()
 
-	// ---- Fanout SAME ciphertext to ALL peers (no re-encrypt)
-	peers := s.peers.List()
-	sent := 0
-	for _, p := range peers {
-		if p.NodeID == s.id.NodeID || p.Addr == "" {
-			continue
-		}
-		url := fmt.Sprintf("http://%s/replicate", p.Addr)
-		resp, err := http.Post(url, "application/json", bytes.NewReader(envBytes))
-		if err != nil {
-			log.Printf("[replicate] to %s fail: %v", p.Addr, err)
-			continue
-		}
-		_ = resp.Body.Close()
-		sent++
-	}
-
-	writeJSON(w, map[string]any{
-		"status":     "ok",
-		"msgid":      msgid,
-		"name":       name,
-		"hash":       hashHex,
-		"store_key":  storeKey,
-		"fanout":     sent,
-		"peers_seen": len(peers),
-		"key_file":   keyFileName,
-	})
+	return sealedFile{
+		MsgID:    msgid,
+		Hash:     hashHex,
+		StoreKey: storeKey,
+		KeyFile:  fileKeyName(hashHex),
+		Comp:     comp,
+		Sealed:   len(payload),
+		Env:      envBytes,
+	}, nil
 }
 
 // ControlHandler (127.0.0.1 only): status, peers, send-text, send-file, backup/peers ops.
 func (s *Server) ControlHandler() http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/chunks/decrypt", func(w http.ResponseWriter, r *http.Request) {
-		hash := r.URL.Query().Get("hash")
-		name := r.URL.Query().Get("name") // optional but helps ext lookup
+		hash, ok := s.catalogHash(w, r.URL.Query().Get("catalog"), r.URL.Query().Get("hash"))
+		if !ok {
+			return
+		}
+		name := r.URL.Query().Get("name") // optional; only used for legacy key names
 		if hash == "" {
-			http.Error(w, "missing ?hash=<sha256>", http.StatusBadRequest)
+			http.Error(w, "missing ?hash=<sha256> or ?catalog=<id>", http.StatusBadRequest)
 			return
 		}
 		chunkPath := filepath.Join(s.paths.ChunksDir, hash+".bin")
@@ -245,32 +462,40 @@ func (s *Server) ControlHandler() http.Handler {
 			}
 			copy(k[:], b)
 		} else {
-			ext := "bin"
-			if dot := strings.LastIndex(name, "."); dot >= 0 && dot+1 < len(name) {
-				ext = name[dot+1:]
-			}
-			keyFileName := fmt.Sprintf("%s.%s.fkey", hash[:16], ext)
-			k, err = loadFileKey(s.paths, keyFileName)
+			k, err = s.fileKeyFor(hash, name)
 			if err != nil {
-				http.Error(w, "key file not found; provide ?keyB64=", http.StatusNotFound)
+				http.Error(w, "key not found locally or on a keysaver ("+err.Error()+"); provide ?keyB64=", http.StatusNotFound)
 				return
 			}
 		}
 
 		plain, err := aeadOpenWithKey(k[:], ctRaw)
 		if err != nil {
+			s.logAccess(hash, accessViaDecrypt, accessUser(r), accessFailed)
 			http.Error(w, "decrypt fail: "+err.Error(), http.StatusForbidden)
 			return
 		}
+		s.logAccess(hash, accessViaDecrypt, accessUser(r), accessOK)
+		// chunks without a block (e.g. fetched by hand) were stored uncompressed
+		if blk, err := s.blockFor(hash); err == nil {
+			if plain, err = openPayload(blk, plain); err != nil {
+				http.Error(w, "decompress fail: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
 
 		// optional: save to file
 		if outName := r.URL.Query().Get("out"); outName != "" {
-			outPath := filepath.Join(s.paths.ChunksDir, outName)
+			outPath, err := safeJoin(s.paths.ChunksDir, outName)
+			if err != nil {
+				http.Error(w, "bad out: "+err.Error(), http.StatusBadRequest)
+				return
+			}
 			if err := os.WriteFile(outPath, plain, 0600); err != nil {
 				http.Error(w, "write fail: "+err.Error(), http.StatusInternalServerError)
 				return
 			}
-			writeJSON(w, map[string]any{"status": "saved", "path": outPath, "bytes": len(plain)})
+			writeJSON(w, DecryptSavedResponse{Status: "saved", Path: outPath, Bytes: len(plain)})
 			return
 		}
 
@@ -280,118 +505,265 @@ func (s *Server) ControlHandler() http.Handler {
 
 	// Basic info
 	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
-		writeJSON(w, map[string]any{
-			"node_id":  s.id.NodeID,
-			"hostname": s.id.Hostname,
-			"attrs":    s.id.Attrs,
-			"api_port": s.cfg.APIPort,
-			"control":  true,
-			"time":     time.Now().UTC(),
+		var alerts []string
+		dups := s.dups.conflicts(time.Now())
+		if len(dups) > 0 {
+			alerts = append(alerts, alertDupID)
+		}
+		var maint *maintenanceView
+		if v := s.maint.view(); v.Active {
+			maint = &v
+		}
+		writeJSON(w, StatusResponse{
+			NodeID:   s.id.NodeID,
+			Hostname: s.id.Hostname,
+			Attrs:    s.id.Attrs,
+			APIPort:  s.cfg.APIPort,
+			Mode:     s.cfg.Mode,
+			Control:  true,
+			Time:     time.Now().UTC(),
+
+			ClockSkew: s.clock.state().SkewSeconds,
+
+			Alerts:     alerts,
+			Duplicates: dups,
+
+			Maintenance: maint,
+
+			CryptoPosture:  s.cfg.cryptoPosture(),
+			AccessLog:      s.cfg.AccessLog,
+			LegacyRejected: s.legacy.counts(),
+
+			Build: buildInfo(),
+
+			Egress: s.egress.status(),
 		})
 	})
 
 	// See discovered peers
 	mux.HandleFunc("/peers", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			s.handlePeerRemove(w, r)
+			return
+		}
 		writeJSON(w, s.peers.List())
 	})
 
+	// One peer's lifecycle transitions (peer_lifecycle.go)
+	mux.HandleFunc("/peers/history", s.handlePeerHistory)
+
 	// Sync status - comprehensive sync information
 	mux.HandleFunc("/sync/status", func(w http.ResponseWriter, r *http.Request) {
-		// Count blocks from chain.jsonl
-		blocksCount := 0
-		var lastBlockTime int64
-		chainPath := filepath.Join(s.paths.BaseDir, "chain", "chain.jsonl")
-		if data, err := os.ReadFile(chainPath); err == nil {
-			lines := bytes.Split(data, []byte("\n"))
-			for _, line := range lines {
-				if len(bytes.TrimSpace(line)) > 0 {
-					blocksCount++
-					// Parse last block for timestamp
-					var blk Block
-					if json.Unmarshal(line, &blk) == nil {
-						lastBlockTime = blk.Created
-					}
-				}
-			}
-		}
-
-		// Count chunks in chunks directory
-		chunksCount := 0
-		if entries, err := os.ReadDir(s.paths.ChunksDir); err == nil {
-			for _, e := range entries {
-				if !e.IsDir() && strings.HasSuffix(e.Name(), ".bin") {
-					chunksCount++
-				}
-			}
-		}
-
-		// Peers count
-		peersCount := len(s.peers.List())
-
-		// Chain tip
-		chainTip := s.getChainTip()
-
-		// Determine sync status
-		synced := peersCount > 0 || blocksCount > 0
-
-		writeJSON(w, map[string]any{
-			"blocks_count":    blocksCount,
-			"chunks_count":    chunksCount,
-			"peers_count":     peersCount,
-			"chain_tip":       chainTip,
-			"node_id":         s.id.NodeID,
-			"last_block_time": lastBlockTime,
-			"synced":          synced,
-			"time":            time.Now().Unix(),
-		})
+		writeJSON(w, s.syncStatus())
 	})
 
 	// Chain list - list all blocks in the chain
+	// ?order=logical sorts by (logical, origin, hash) instead of chain order
+	// ?kind=data|escrow-receipt|tombstone|access and ?origin=<NodeID> filter
+	// Expired blocks carry their retention annotation, deleted ones their
+	// tombstone
 	mux.HandleFunc("/chain/list", func(w http.ResponseWriter, r *http.Request) {
-		var blocks []Block
-		chainPath := filepath.Join(s.paths.BaseDir, "chain", "chain.jsonl")
-		if data, err := os.ReadFile(chainPath); err == nil {
-			lines := bytes.Split(data, []byte("\n"))
-			for _, line := range lines {
-				if len(bytes.TrimSpace(line)) > 0 {
-					var blk Block
-					if json.Unmarshal(line, &blk) == nil {
-						blocks = append(blocks, blk)
-					}
-				}
+		q := r.URL.Query()
+		kind, origin := q.Get("kind"), q.Get("origin")
+		switch kind {
+		case "", "data", blockEscrowReceipt, blockTombstone, blockAccess:
+		default:
+			http.Error(w, "kind must be data, escrow-receipt, tombstone or access", http.StatusBadRequest)
+			return
+		}
+		if kind == "data" {
+			kind = ""
+		} else if kind == "" {
+			kind = "*"
+		}
+		blocks := s.readChain()
+		if q.Get("order") == "logical" {
+			sortBlocksLogical(blocks)
+		}
+		deleted := tombstonesIn(blocks)
+		out := make([]chainEntry, 0, len(blocks))
+		for _, b := range blocks {
+			if (kind != "*" && b.Kind != kind) || (origin != "" && b.OriginID != origin) {
+				continue
 			}
+			e := chainEntry{Block: b}
+			if m, ok := s.retention.expired(b.Hash); ok {
+				e.Expired = &m
+			}
+			if t, ok := deleted[b.Hash]; ok {
+				e.DeletedBy = t.Hash
+			}
+			out = append(out, e)
 		}
-		writeJSON(w, blocks)
+		w.Header().Set(logicalClockHeader, strconv.FormatUint(s.lamport.value(), 10))
+		writeJSON(w, out)
 	})
 
+	// Chain verification (?full=true walks everything) and bootstrap from a
+	// peer's checkpoint
+	mux.HandleFunc("/chain/verify", s.handleChainVerify)
+	mux.HandleFunc("/chain/bootstrap", s.handleChainBootstrap)
+
+	// A new NodeID for a cloned machine (see identity_dup.go)
+	mux.HandleFunc("/identity/regenerate", s.requireToken(s.handleIdentityRegenerate))
+
+	// Confirm or reject a peer's unconfirmed mix key (key_continuity.go)
+	mux.HandleFunc("/peers/key", s.requireToken(s.handlePeerKey))
+
 	// Command sync endpoints (localhost only)
-	mux.HandleFunc("/command/broadcast", s.handleBroadcastCommand)
+	mux.HandleFunc("/command/broadcast", s.originOnly(s.handleBroadcastCommand))
 	mux.HandleFunc("/command/pending", s.handleGetPendingCommand)
 	mux.HandleFunc("/env/export", s.handleExportEnv)
+	mux.HandleFunc("/env/proxy-auth", s.requireToken(s.handleProxyAuth))
+
+	// Runtime config; PATCH edits the command folder policy
+	mux.HandleFunc("/config", s.handleConfig)
+
+	// Local OrgID and foreign-org traffic counters
+	mux.HandleFunc("/org", s.handleOrg)
+
+	// Destructive operations (all support ?dry_run=true)
+	mux.HandleFunc("/chunks/gc", s.handleChunkGC)
+	mux.HandleFunc("/retention/apply", s.requireToken(s.handleRetentionApply))
+
+	// Maintenance mode: pause GC, scrub, retention and autosave for backups
+	mux.HandleFunc("/maintenance", s.handleMaintenance)
+	mux.HandleFunc("/maintenance/enter", s.requireToken(s.handleMaintenanceEnter))
+	mux.HandleFunc("/maintenance/exit", s.requireToken(s.handleMaintenanceExit))
+	mux.HandleFunc("/recover", s.handleRecover)
+	mux.HandleFunc("/catalog", s.handleCatalog)
+	mux.HandleFunc("/recover/{id}", s.handleTransferGet(transferRecover))
+	mux.HandleFunc("/recover/{id}/cancel", s.handleTransferCancel(transferRecover))
+	mux.HandleFunc("/command/results", s.handleCommandResults)
+
+	// Metrics (Prometheus text) and the crypto self-benchmark
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	mux.HandleFunc("/discovery/stats", s.handleDiscoveryStats)
+	mux.HandleFunc("/debug/crypto-bench", handleCryptoBench)
+	mux.HandleFunc("/debug/goroutines", s.handleDebugGoroutines)
+
+	// Readiness: degraded while the chunks disk is below its reserve
+	mux.HandleFunc("/ready", s.handleReady)
+
+	// Background integrity scrub: cursor and per-cycle counts
+	mux.HandleFunc("/chunks/scrub-status", s.handleScrubStatus)
+
+	// kv anti-entropy: one round now, and per-round stats
+	mux.HandleFunc("/kv/reconcile", s.handleKVReconcile)
+	mux.HandleFunc("/kv/reconcile-status", s.handleKVReconcileStatus)
+
+	// Retention policies (changes need the control token) and the verdict
+	// per block
+	mux.HandleFunc("/retention/policies", s.handleRetentionPolicies)
+	mux.HandleFunc("/retention/policies/{id}", s.requireToken(s.handleRetentionPolicyDelete))
+	mux.HandleFunc("/retention/blocks", s.handleRetentionBlocks)
+
+	// Local file keys; export/import need the control token
+	mux.HandleFunc("/filekeys/list", s.handleFileKeysList)
+	mux.HandleFunc("/filekeys/export", s.requireToken(s.handleFileKeysExport))
+	mux.HandleFunc("/filekeys/import", s.requireToken(s.handleFileKeysImport))
+	mux.HandleFunc("/filekeys/unverified", s.handleFileKeysUnverified)
+
+	// Key escrow with a signed receipt in the chain (token), and the audit
+	// of receipts against the keysaver
+	mux.HandleFunc("/filekeys/escrow", s.requireToken(s.handleFileKeyEscrow))
+	mux.HandleFunc("/queues", s.handleQueues)
+	mux.HandleFunc("/escrow/audit", s.handleEscrowAudit)
+	mux.HandleFunc("/escrow/status", s.handleEscrowStatus)
+	mux.HandleFunc("/chain/tombstone", s.requireToken(s.handleTombstone))
+	mux.HandleFunc("/chain/tombstones", s.handleTombstones)
+	if s.cfg.LoadGen {
+		mux.HandleFunc("/loadgen", s.originOnly(s.handleLoadgen))
+		mux.HandleFunc("/loadgen/start", s.originOnly(s.requireToken(s.handleLoadgenStart)))
+		mux.HandleFunc("/loadgen/stop", s.originOnly(s.requireToken(s.handleLoadgenStop)))
+	}
 
-	// Send actions on localhost
-	mux.HandleFunc("/mix/send-text", s.handleSendText)
-	mux.HandleFunc("/mix/send-file", s.handleSendFileDistribute)
+	// Final-hop mix inbox: GET lists in Lamport order, DELETE drops and
+	// resets the quotas
+	mux.HandleFunc("/inbox/quota", s.handleInboxQuota)
+	mux.HandleFunc("/inbox", s.handleInbox)
+	// ...and per message: paged listing, plaintext, single delete
+	mux.HandleFunc("/mix/inbox", s.handleMixInbox)
+	mux.HandleFunc("/mix/inbox/read", s.handleMixInboxRead)
+
+	// Delivery state of sent texts (delivery_ack.go)
+	mux.HandleFunc("/mix/status", s.handleMixStatus)
+
+	// Text messages threaded per peer, with read marks
+	mux.HandleFunc("/mix/conversations", s.handleConversations)
+	mux.HandleFunc("/groups", s.handleGroups)
+	mux.HandleFunc("/mix/conversations/{peer}", s.handleConversation)
+	mux.HandleFunc("/mix/conversations/{peer}/read", s.handleConversationRead)
+
+	// Per-msgid trace timeline
+	mux.HandleFunc("/trace", s.handleTraceGet)
+
+	// Send actions on localhost (404 on vault nodes)
+	mux.HandleFunc("/mix/send-text", s.originOnly(s.handleSendText))
+	mux.HandleFunc("/mix/send-group", s.originOnly(s.handleSendGroup))
+	mux.HandleFunc("/mix/send-file", s.originOnly(s.handleSendFileDistribute))
+	mux.HandleFunc("/mix/send-batch", s.originOnly(s.handleSendBatch))
+	mux.HandleFunc("/batches", s.handleBatches)
+	mux.HandleFunc("/batches/{id}", s.handleBatchGet)
+	mux.HandleFunc("/batches/{id}/resume", s.originOnly(s.handleBatchResume))
+
+	// Send-file fanouts and recoveries in flight (and recent ones); cancel
+	// stops them
+	mux.HandleFunc("/transfers", s.handleTransfers)
+	mux.HandleFunc("/transfers/{id}", s.handleTransferGet(""))
+	mux.HandleFunc("/transfers/{id}/cancel", s.handleTransferCancel(""))
 
 	// Backup / peers save/load/publish/fetch (if you already added them)
+	// /backup/get reads through memory, disk, then DHT providers
 	mux.HandleFunc("/backup/get", func(w http.ResponseWriter, r *http.Request) {
 		k := r.URL.Query().Get("key")
 		if k == "" {
 			http.Error(w, "missing key", http.StatusBadRequest)
 			return
 		}
-		s.mu.RLock()
-		blob, ok := s.kv[k]
-		s.mu.RUnlock()
-		if !ok {
-			http.Error(w, "not found", http.StatusNotFound)
+		if blob, src, ok := s.lookupBlob(k); ok {
+			writeBlob(w, blob, src)
 			return
 		}
-		w.Header().Set("Content-Type", "application/octet-stream")
-		w.Write(blob)
+		blob, from, err := s.pullBlob(k)
+		if err != nil {
+			http.Error(w, "not found: "+err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set(nodeIDHeader, from)
+		writeBlob(w, blob, blobFromRemote)
 	})
 
+	mux.HandleFunc("/doctor", s.handleDoctor)
+	mux.HandleFunc("/webhooks", s.requireToken(s.handleWebhooks))
+	mux.HandleFunc("/webhooks/deliveries", s.requireToken(s.handleWebhookDeliveries))
+	mux.HandleFunc("/pairings", s.requireToken(s.handlePairings))
+	mux.HandleFunc("/quarantine", s.requireToken(s.handleQuarantine))
+	mux.HandleFunc("/quarantine/rules", s.requireToken(s.handleQuarantineRules))
+	mux.HandleFunc("/quarantine/{id}", s.requireToken(s.handleQuarantineGet))
+	mux.HandleFunc("/quarantine/{id}/accept", s.requireToken(s.handleQuarantineAccept))
+	mux.HandleFunc("/quarantine/{id}/reject", s.requireToken(s.handleQuarantineReject))
+	mux.HandleFunc("/outbox", s.requireToken(s.handleOutbox))
+	mux.HandleFunc("/outbox/{id}", s.requireToken(s.handleOutboxDelete))
+	mux.HandleFunc("/snapshots", s.requireToken(s.handleSnapshots))
+	mux.HandleFunc("/snapshots/run", s.requireToken(s.handleSnapshotRun))
+
+	// Dashboard: the page is static; its data calls carry the control token
+	mux.HandleFunc("/ui", s.handleUI)
+	mux.HandleFunc("/events", s.requireToken(s.handleEvents))
+	mux.HandleFunc("/logs/tail", s.requireToken(s.handleLogTail))
+
+	// Named control tokens and their scopes (control_scopes.go)
+	mux.HandleFunc("/control/tokens", s.requireToken(s.handleControlTokens))
+
 	// peers save
+	mux.HandleFunc("/peers/scores", s.handlePeerScores)
+	mux.HandleFunc("/dht/announcements", s.handleDHTAnnouncements)
+	mux.HandleFunc("/fleet/status", s.handleFleetStatus)
+	mux.HandleFunc("/fleet/metrics", s.handleFleetMetrics)
+	mux.HandleFunc("/peers/transports", s.handlePeerTransports)
+	mux.HandleFunc("/peers/reachability", s.handlePeerReachability)
+	mux.HandleFunc("/peers/capabilities", s.handlePeerCapabilities)
 	mux.HandleFunc("/peers/save", func(w http.ResponseWriter, r *http.Request) {
 		pem := r.URL.Query().Get("pem")
 		if pem == "" {
@@ -425,6 +797,9 @@ func (s *Server) ControlHandler() http.Handler {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		if snap.Version < peerSnapshotVersion && s.refuseLegacy(w, legacySnapshotV1) {
+			return
+		}
 		n := mergeSnapshot(s.peers, snap)
 		writeJSON(w, map[string]any{"status": "ok", "merged": n, "from": in})
 	})
@@ -447,7 +822,7 @@ func (s *Server) ControlHandler() http.Handler {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		storeKey := "peers:" + s.id.NodeID
+		storeKey := s.orgDHTKey("peers:" + s.id.NodeID)
 		s.mu.Lock()
 		s.kv[storeKey] = blob
 		s.mu.Unlock()
@@ -457,41 +832,31 @@ func (s *Server) ControlHandler() http.Handler {
 
 	// peers fetch from DHT
 	mux.HandleFunc("/peers/fetch", func(w http.ResponseWriter, r *http.Request) {
-		from := r.URL.Query().Get("from")
+		from, ok := s.nodeIDParam(w, "from", r.URL.Query().Get("from"))
+		if !ok {
+			return
+		}
 		pem := r.URL.Query().Get("pem")
 		if from == "" || pem == "" {
 			http.Error(w, "missing ?from and/or ?pem", http.StatusBadRequest)
 			return
 		}
-		storeKey := "peers:" + from
+		storeKey := s.orgDHTKey("peers:" + from)
 		providers := s.dht.Get(storeKey)
 		if len(providers) == 0 {
 			http.Error(w, "no providers", http.StatusNotFound)
 			return
 		}
-		var addr string
-		for _, p := range s.peers.List() {
-			if p.NodeID == providers[0] && p.Addr != "" {
-				addr = p.Addr
-				break
-			}
-		}
-		if addr == "" {
+		provider, ok := s.peers.Get(providers[0])
+		if !ok || provider.Addr == "" {
 			http.Error(w, "provider address unknown", http.StatusBadRequest)
 			return
 		}
-		resp, err := http.Get("http://" + addr + "/fetch?key=" + storeKey)
+		cipherBlob, addr, err := s.fetchFromPeer(provider, storeKey)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadGateway)
-			return
-		}
-		defer resp.Body.Close()
-		if resp.StatusCode != 200 {
-			b, _ := io.ReadAll(resp.Body)
-			http.Error(w, "provider fetch failed: "+string(b), http.StatusBadGateway)
+			http.Error(w, "provider fetch failed: "+err.Error(), http.StatusBadGateway)
 			return
 		}
-		cipherBlob, _ := io.ReadAll(resp.Body)
 		key, err := deriveSymKeyFromPEM(pem)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
@@ -502,18 +867,82 @@ func (s *Server) ControlHandler() http.Handler {
 			http.Error(w, "decrypt fail: "+err.Error(), http.StatusForbidden)
 			return
 		}
+		if snap.Version < peerSnapshotVersion && s.refuseLegacy(w, legacySnapshotV1) {
+			return
+		}
 		n := mergeSnapshot(s.peers, snap)
 		writeJSON(w, map[string]any{"status": "ok", "merged": n, "from_provider": addr})
 	})
 
 	// Local-only guard (defense in depth)
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	return recoverHTTP("control", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		host, _, _ := net.SplitHostPort(r.RemoteAddr)
 		if host != "127.0.0.1" && host != "::1" {
 			http.Error(w, "local-only", http.StatusForbidden)
 			return
 		}
+		s.requests.Add(1)
 		log.Printf("[control] %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+		if !s.authorizeControl(w, r, mux) {
+			return
+		}
 		mux.ServeHTTP(w, r)
-	})
+	}))
+}
+
+// syncStatus is the body of GET /sync/status (and of /fleet/report).
+func (s *Server) syncStatus() map[string]any {
+	// Count blocks from chain.jsonl
+	blocksCount := 0
+	var lastBlockTime int64
+	if data, err := os.ReadFile(s.chainPath()); err == nil {
+		lines := bytes.Split(data, []byte("\n"))
+		for _, line := range lines {
+			if len(bytes.TrimSpace(line)) > 0 {
+				blocksCount++
+				// Parse last block for timestamp
+				var blk Block
+				if json.Unmarshal(line, &blk) == nil {
+					lastBlockTime = blk.Created
+				}
+			}
+		}
+	}
+
+	// Count chunks in chunks directory
+	chunksCount := 0
+	if entries, err := os.ReadDir(s.paths.ChunksDir); err == nil {
+		for _, e := range entries {
+			if !e.IsDir() && strings.HasSuffix(e.Name(), ".bin") {
+				chunksCount++
+			}
+		}
+	}
+
+	// Peers count
+	peersCount := len(s.peers.List())
+
+	// Chain tip
+	chainTip := s.getChainTip()
+
+	// Determine sync status
+	synced := peersCount > 0 || blocksCount > 0
+
+	return map[string]any{
+		"blocks_count":    blocksCount,
+		"chunks_count":    chunksCount,
+		"peers_count":     peersCount,
+		"chain_tip":       chainTip,
+		"node_id":         s.id.NodeID,
+		"mode":            s.cfg.Mode,
+		"last_block_time": lastBlockTime,
+		"synced":          synced,
+		"time":            time.Now().Unix(),
+
+		"clock_skew_seconds": s.clock.state().SkewSeconds,
+		"peers_persist":      s.peers.persistState(),
+		"logical_clock":      s.lamport.value(),
+		"pubkey_backfill":    s.keyBackfillStatus(),
+		"inbox_expiry":       s.inboxExpiryStatus(),
+	}
 }
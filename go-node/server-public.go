@@ -1,31 +1,94 @@
 package main
 
 import (
-	"bytes"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"log"
 	"net"
 	"net/http"
-	"os"
 	"path/filepath"
 )
 
 func newServer(cfg *Config, id NodeIdentity, peers *PeerStore, dht DHT, nk *NodeKeypair, paths *EnvPaths, secrets *EnvSecrets) *Server {
-	return &Server{
-		cfg:      cfg,
-		id:       id,
-		peers:    peers,
-		dht:      dht,
-		nodeKeys: nk,
-		paths:    paths,
-		secrets:  secrets,
-		kv:       make(map[string][]byte),
-		seen:     make(map[string]struct{}),
+	m := newMetricsRegistry()
+	s := &Server{
+		cfg:        cfg,
+		id:         id,
+		peers:      peers,
+		dht:        dht,
+		nodeKeys:   nk,
+		paths:      paths,
+		secrets:    secrets,
+		kv:         make(map[string][]byte),
+		seen:       make(map[string]struct{}),
+		traces:     newTraceStore(cfg.TraceKeep),
+		inbox:      newInboxQuota(cfg),
+		cmdPolicy:  newCmdPolicy(cfg.CmdAllowRoots, cfg.CmdDenyRoots),
+		fanout:     newFanoutStats(),
+		ctlToken:   loadOrCreateControlToken(paths),
+		ctlTokens:  newControlTokenStore(paths),
+		cmdResults: make(map[string][]CommandPlan),
+		cmdSeen:    make(map[string]struct{}),
+		health:     newHealth(),
+		org:        newOrgGuard(secrets.OrgID),
+		clock:      newClockSkew(id.NodeID, cfg),
+		lamport:    newLamportClock(paths),
+		chunkCheck: newChunkVerifier(),
+		scrub:      newScrubber(paths),
+		transports: newTransportSelector(plainHTTP{}),
+		webhooks:   newWebhookStore(paths, secrets.FileKey[:]),
+		transfers:  newTransferStore(),
+		abandoned:  newAbandonedSet(paths),
+		retention:  newRetentionStore(paths),
+		batches:    newBatchStore(paths),
+		maint:      &maintenance{},
+		lg:         &loadgen{},
+		kvs:        &kvSync{},
+		legacy:     newLegacyGuard(cfg),
+		events:     newEventHub(),
+		spill:      newRelaySpill(paths),
+		pairings:   newPairingStore(paths, secrets.FileKey[:]),
+		keys:       newKeyBackfill(),
+		disco:      newDiscoveryGuard(id.NodeID, m),
+		catalog:    newCatalogStore(paths, id.NodeID),
+		quarantine: newQuarantineStore(paths),
+		outbox:     newOutboxStore(paths, secrets.FileKey[:]),
+		replicateQ: openWorkQueue(paths, secrets.FileKey[:], queueReplicate, replicateRetryKey, m),
+		escrowQ:    openWorkQueue(paths, secrets.FileKey[:], queueEscrow, escrowJobKey, m),
+		announces:  newDHTAnnouncer(),
+		fleet:      newFleetStore(),
+		cbPool:     newWorkPool(poolCallbacks, cfg.CallbackWorkers, cfg.CallbackQueue, cfg.GoroutineBudget, m),
+		fwdPool:    newWorkPool(poolForward, cfg.ForwardWorkers, cfg.ForwardQueue, cfg.GoroutineBudget, m),
+		snapshots:  newSnapshotter(cfg),
+		convs:      newConversationStore(paths, secrets.FileKey[:]),
+		groups:     newGroupStore(paths, secrets.FileKey[:], id.NodeID),
+		rtt:        newRTTProber(),
+		wan:        newWANOutbound(cfg, secrets),
+		egress:     newEgressPolicy(cfg, m),
+		keysavers:  newKeysaverPool(cfg),
+		metrics:    m,
 	}
+	s.org.legacy = s.legacy
+	s.journal = newChainJournal(s.writeChainBatch)
+	s.relayReplay = newRelayReplayCache(cfg.RelayReplayWindow, cfg.RelayReplayMax)
+	s.deliveries = newDeliveryTracker()
+	s.peerCaps = newCapsCache(s, cfg.PeerCapsTTL)
+	s.keyProof = signMixKey(paths, id.NodeID, nk.Pub[:])
+	peers.keyQuarantine, peers.onKeyChange = cfg.KeyChangeQuarantine, s.keyChanged
+	s.peerLog = newPeerEvents(s.emit)
+	peers.mu.Lock()
+	peers.staleAfter, peers.onTransition = cfg.PeerStaleAfter, s.peerLog.record
+	peers.mu.Unlock()
+	s.dups = newDupDetector(id.NodeID, base64.RawURLEncoding.EncodeToString(nk.Pub[:]), s.identityConflict)
+	s.migrateLegacyChain()
+	s.loadChain()
+	s.migrateFileKeys()
+	s.catalog.index(s.readChain())
+	s.loadDHTStore()
+	return s
 }
 
 // ReplicateEnvelope is the exact blob we propagate (no re-encrypt on hops).
@@ -35,10 +98,24 @@ type ReplicateEnvelope struct {
 	Name      string `json:"name"`
 	HashHex   string `json:"hash_hex"`
 	PrevHash  string `json:"prev_hash"` // NEW: chain link
+	OrgID     string `json:"org_id,omitempty"`
 	CipherB64 string `json:"cipher_b64"`
 	EncKeyB64 string `json:"enckey_b64"`
 	Created   int64  `json:"created_unix"`
 	Hops      int    `json:"hops"`
+	Comp      string `json:"comp,omitempty"` // see Block.Comp
+	RawSize   int    `json:"raw_size,omitempty"`
+	Logical   uint64 `json:"logical,omitempty"` // origin's Lamport stamp
+	Batch     string `json:"batch,omitempty"`   // see Block.Batch
+	Kind      string `json:"kind,omitempty"`    // see Block.Kind
+	PlainHash string `json:"plain_sha256,omitempty"`
+
+	Pad        int  `json:"pad,omitempty"`         // see Block.Pad
+	NameSealed bool `json:"name_sealed,omitempty"` // see Block.NameSealed
+
+	Receipt   *escrowReceipt `json:"receipt,omitempty"`
+	Tombstone *tombstone     `json:"tombstone,omitempty"`
+	Access    *accessRecord  `json:"access,omitempty"`
 }
 
 func sha256Hex(b []byte) string {
@@ -51,34 +128,42 @@ func writeJSON(w http.ResponseWriter, v any) {
 	_ = json.NewEncoder(w).Encode(v)
 }
 
-// PublicHandler exposes peer-facing endpoints on NIC IP.
+// PublicHandler exposes peer-facing endpoints on NIC IP, each under /v1/ and
+// as a deprecated unprefixed alias (see handleVersioned).
 // Includes: /fetch (blob fetch), /mix/relay (mix hops), /replicate (blockchain-style fanout), /dht/*
 func (s *Server) PublicHandler() http.Handler {
 	mux := http.NewServeMux()
 
 	// Public fetch: peers get stored blob by key (used by DHT pulls / replication)
-	mux.HandleFunc("/fetch", func(w http.ResponseWriter, r *http.Request) {
+	s.handleVersioned(mux, "/fetch", func(w http.ResponseWriter, r *http.Request) {
 		key := r.URL.Query().Get("key")
 		if key == "" {
 			http.Error(w, "missing ?key", http.StatusBadRequest)
 			return
 		}
-		s.mu.RLock()
-		val, ok := s.kv[key]
-		s.mu.RUnlock()
+		// memory or disk only; a public miss never triggers remote pulls
+		val, src, ok := s.lookupBlob(key)
 		if !ok {
 			http.Error(w, "not found", http.StatusNotFound)
 			return
 		}
-		w.Header().Set("Content-Type", "application/octet-stream")
-		w.Write(val)
+		writeBlob(w, val, src)
 	})
 
+	// Chunk pre-validation: HEAD /chunk?hash= before sending an envelope
+	s.handleVersioned(mux, "/chunk", s.handleChunkProbe)
+
+	// Identity probe used to check peer addresses (HEAD is headers-only)
+	s.handleVersioned(mux, "/peer-info", s.handlePeerInfo)
+
 	// Mixnet relay (peer-to-peer onion hops)
-	mux.HandleFunc("/mix/relay", relayHandler(s.nodeKeys, s))
+	s.handleVersioned(mux, "/mix/relay", relayHandler(s.nodeKeys, s))
+
+	// Delivery acks sent straight back when no mix path leads here
+	s.handleVersioned(mux, "/mix/ack", s.handleMixAck)
 
 	// Replication endpoint: receive SAME ciphertext, verify hash, store, forward-once
-	mux.HandleFunc("/replicate", func(w http.ResponseWriter, r *http.Request) {
+	s.handleVersioned(mux, "/replicate", func(w http.ResponseWriter, r *http.Request) {
 		localTip := s.getChainTip()
 		if r.Method != http.MethodPost {
 			http.Error(w, "use POST", http.StatusMethodNotAllowed)
@@ -89,8 +174,67 @@ func (s *Server) PublicHandler() http.Handler {
 			http.Error(w, "bad envelope", http.StatusBadRequest)
 			return
 		}
+		if env.OrgID == "" && s.refuseLegacy(w, legacyUntaggedOrg) {
+			return
+		}
+		if !s.org.accept(env.OrgID, &s.org.foreignReplicates) {
+			s.emit(eventReplicateForeign, map[string]any{"msgid": env.MsgID, "origin": env.OriginID, "org_id": env.OrgID, "remote": r.RemoteAddr})
+			http.Error(w, "foreign org", http.StatusForbidden)
+			return
+		}
+
+		// its origin cancelled the send: don't take it (or pass it on)
+		if s.abandoned.has(env.HashHex) {
+			http.Error(w, "abandoned by origin", http.StatusGone)
+			return
+		}
+		if _, ok := s.retention.expired(env.HashHex); ok {
+			http.Error(w, "expired by retention policy", http.StatusGone)
+			return
+		}
+		if t, ok := s.tombstoneFor(env.HashHex); ok {
+			http.Error(w, "deleted by origin (tombstone "+t.Hash+")", http.StatusGone)
+			return
+		}
+
+		// escrow receipts, tombstones and access records carry no chunk
+		switch env.Kind {
+		case "":
+		case blockTombstone:
+			s.replicateTombstone(w, env, localTip)
+			return
+		case blockAccess:
+			s.replicateAccess(w, env, localTip)
+			return
+		default:
+			s.replicateReceipt(w, env, localTip)
+			return
+		}
+
+		// cipher_b64 is ~4/3 of the chunk; refuse early if it can't fit
+		if r.ContentLength > 0 {
+			if err := s.checkDiskFor(r.ContentLength * 3 / 4); err != nil {
+				s.writeDiskFull(w, env.MsgID, err)
+				return
+			}
+		}
+
+		// a verified chunk with its block already in our chain: nothing to
+		// write or forward (a re-fanout after partial failure)
+		if _, ok := s.haveChunk(env.HashHex); ok {
+			if _, err := s.blockFor(env.HashHex); err == nil {
+				s.metrics.counter(chunkDedup).inc("already_have")
+				s.lamport.observe(env.Logical)
+				s.seenMu.Lock()
+				s.seen[env.MsgID] = struct{}{}
+				s.seenMu.Unlock()
+				writeJSON(w, map[string]any{"status": "already_have", "hash": env.HashHex, "tip": localTip})
+				return
+			}
+		}
 
 		if env.PrevHash != localTip {
+			s.emit(eventReplicateChain, map[string]any{"msgid": env.MsgID, "origin": env.OriginID, "hash": env.HashHex, "prev": env.PrevHash, "tip": localTip})
 			http.Error(w, "chain mismatch: local tip "+localTip+" != prev "+env.PrevHash, http.StatusConflict)
 			return
 		}
@@ -104,6 +248,8 @@ func (s *Server) PublicHandler() http.Handler {
 		s.seen[env.MsgID] = struct{}{}
 		s.seenMu.Unlock()
 
+		s.lamport.observe(env.Logical)
+
 		// verify ciphertext hash (no decryption)
 		ctRaw, err := base64.RawURLEncoding.DecodeString(env.CipherB64)
 		if err != nil {
@@ -111,21 +257,58 @@ func (s *Server) PublicHandler() http.Handler {
 			return
 		}
 		if sha256Hex(ctRaw) != env.HashHex {
+			s.emit(eventReplicateHash, map[string]any{"msgid": env.MsgID, "origin": env.OriginID, "hash": env.HashHex, "remote": r.RemoteAddr})
 			http.Error(w, "hash mismatch", http.StatusBadRequest)
 			return
 		}
+		// chunk first (durably), then the block, so the chain never claims
+		// data we don't have; a refused replicate may be retried later. An
+		// intact chunk already on disk isn't rewritten.
+		chunkPath := filepath.Join(s.paths.ChunksDir, env.HashHex+".bin")
+		if _, ok := s.haveChunk(env.HashHex); !ok {
+			err = s.checkDiskFor(int64(len(ctRaw)))
+			if err == nil {
+				err = writeChunk(chunkPath, ctRaw)
+			}
+		}
+		if err != nil {
+			s.seenMu.Lock()
+			delete(s.seen, env.MsgID)
+			s.seenMu.Unlock()
+			if errors.Is(err, errDiskFull) {
+				s.writeDiskFull(w, env.MsgID, err)
+				return
+			}
+			http.Error(w, "chunk write fail: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
 		blk := Block{
-			Hash:     env.HashHex,
-			PrevHash: env.PrevHash,
-			Name:     env.Name,
-			Size:     len(ctRaw),
-			Created:  env.Created,
-			OriginID: env.OriginID,
-		}
-		if err := s.appendBlock(blk); err != nil {
+			Hash:      env.HashHex,
+			PrevHash:  env.PrevHash,
+			Name:      env.Name,
+			Size:      len(ctRaw),
+			Created:   env.Created,
+			OriginID:  env.OriginID,
+			Comp:      env.Comp,
+			RawSize:   env.RawSize,
+			Logical:   env.Logical,
+			Batch:     env.Batch,
+			PlainHash: env.PlainHash,
+		}
+		blk.Pad, blk.NameSealed = env.Pad, env.NameSealed
+		if err := s.appendLinkedBlock(blk); err != nil {
+			s.seenMu.Lock()
+			delete(s.seen, env.MsgID)
+			s.seenMu.Unlock()
+			if errors.Is(err, errChainMoved) {
+				http.Error(w, "chain mismatch: "+err.Error(), http.StatusConflict)
+				return
+			}
 			http.Error(w, "append block fail: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
+		traced := r.Header.Get(traceHeader) == "1"
+		evs := []TraceEvent{s.trace(env.MsgID, traceReplicateAccept, "")}
 
 		// store envelope (deterministic key)
 		storeKey := "blob-" + env.HashHex + "-" + env.Name
@@ -135,26 +318,23 @@ func (s *Server) PublicHandler() http.Handler {
 		s.mu.Lock()
 		s.kv[storeKey] = envBytes
 		s.mu.Unlock()
-		chunkPath := filepath.Join(s.paths.ChunksDir, env.HashHex+".bin")
-		if err := os.WriteFile(chunkPath, ctRaw, 0600); err != nil {
-			http.Error(w, "chunk write fail: "+err.Error(), http.StatusInternalServerError)
-			return
-		}
 		// forward to other peers (no re-encrypt, same envelope)
 		sent := 0
-		for _, p := range s.peers.List() {
-			if p.NodeID == s.id.NodeID || p.Addr == "" {
-				continue
-			}
-			url := fmt.Sprintf("http://%s/replicate", p.Addr)
-			resp, err := http.Post(url, "application/json", bytes.NewReader(envBytes))
-			if err != nil {
-				log.Printf("[replicate] fwd -> %s fail: %v", p.Addr, err)
+		hdr := http.Header{}
+		if traced {
+			hdr.Set(traceHeader, "1")
+		}
+		for _, p := range s.rankPeers(s.peers.List()) {
+			addr, ok := s.replicateTo(p, env.HashHex, envBytes, hdr)
+			if !ok {
 				continue
 			}
-			_ = resp.Body.Close()
+			evs = append(evs, s.trace(env.MsgID, traceFanout, addr))
 			sent++
 		}
+		if traced {
+			s.reportTrace(env.OriginID, evs...)
+		}
 
 		writeJSON(w, map[string]any{
 			"status": "stored",
@@ -165,11 +345,18 @@ func (s *Server) PublicHandler() http.Handler {
 		})
 	})
 
+	// Origin cancelled a send: keep the block but stop spreading it
+	s.handleVersioned(mux, "/replicate/abandon", s.handleAbandon)
+
+	// Trace events reported back by hops for msgids we originated
+	s.handleVersioned(mux, "/trace/collect", s.handleTraceCollect)
+
 	// P2P Command sync (receive command from peer)
-	mux.HandleFunc("/p2p/command", s.handleP2PCommand)
+	s.handleVersioned(mux, "/p2p/command", s.handleP2PCommand)
+	s.handleVersioned(mux, "/p2p/command/result", s.handleCommandResult)
 
 	// Minimal DHT endpoints for peers
-	mux.HandleFunc("/dht/put", func(w http.ResponseWriter, r *http.Request) {
+	s.handleVersioned(mux, "/dht/put", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "use POST", http.StatusMethodNotAllowed)
 			return
@@ -189,7 +376,7 @@ func (s *Server) PublicHandler() http.Handler {
 		s.dht.Put(body.Key, body.Providers)
 		writeJSON(w, map[string]string{"status": "ok"})
 	})
-	mux.HandleFunc("/dht/get", func(w http.ResponseWriter, r *http.Request) {
+	s.handleVersioned(mux, "/dht/get", func(w http.ResponseWriter, r *http.Request) {
 		key := r.URL.Query().Get("key")
 		if key == "" {
 			http.Error(w, "missing ?key=", http.StatusBadRequest)
@@ -198,48 +385,53 @@ func (s *Server) PublicHandler() http.Handler {
 		writeJSON(w, map[string]any{"key": key, "providers": s.dht.Get(key)})
 	})
 
+	// Chain checkpoint + tail for bootstrapping new nodes, and history pages
+	s.handleVersioned(mux, "/chain/snapshot", s.handleChainSnapshot)
+	s.handleVersioned(mux, "/chain/blocks", s.handleChainBlocks)
+
+	// kv anti-entropy: bucketed summary and per-bucket key listings
+	s.handleVersioned(mux, "/kv/summary", s.handleKVSummary)
+	s.handleVersioned(mux, "/kv/keys", s.handleKVKeys)
+
+	// Status for fleet aggregators of the same org (fleet.go)
+	s.handleVersioned(mux, "/fleet/report", s.handleFleetReport)
+
+	// Supported API versions (never versioned itself)
+	mux.HandleFunc("/versions", s.handleVersions)
+
 	// Public log wrapper
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	return recoverHTTP("public", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.requests.Add(1)
 		ip, _, _ := net.SplitHostPort(r.RemoteAddr)
 		log.Printf("[public] %s %s from %s", r.Method, r.URL.Path, ip)
 		mux.ServeHTTP(w, r)
-	})
+	}))
 }
+
+// readChain returns all blocks in the local chain file, in append order.
+func (s *Server) readChain() []Block { return readChainFile(s.chainPath()) }
+
 func (s *Server) getChainTip() string {
-	s.chainMu.Lock()
-	defer s.chainMu.Unlock()
-	return s.chainTip
+	tip, _ := s.chainTip.Load().(string)
+	return tip
 }
-func (s *Server) appendBlock(b Block) error {
-	s.chainMu.Lock()
-	defer s.chainMu.Unlock()
 
-	// ensure chain dir
-	chainDir := filepath.Join(s.paths.BaseDir, "chain")
-	if err := os.MkdirAll(chainDir, 0700); err != nil {
-		return err
-	}
+// setChainTip moves the tip; callers hold chainMu.
+func (s *Server) setChainTip(tip string) { s.chainTip.Store(tip) }
 
-	// write JSONL
-	line, _ := json.Marshal(b)
-	line = append(line, '\n')
-	logPath := filepath.Join(chainDir, "chain.jsonl")
-	if err := appendFile(logPath, line); err != nil {
-		return err
-	}
+// appendBlock appends b to the chain through the journal and returns once
+// it is on disk.
+func (s *Server) appendBlock(b Block) error { return s.submitBlock(b, false) }
 
-	// update tip
-	s.chainTip = b.Hash
-	return nil
-}
+// appendLinkedBlock is appendBlock for a block that must follow the tip it
+// was checked against (a replicate): it fails with errChainMoved if another
+// append got there first, instead of forking the chain.
+func (s *Server) appendLinkedBlock(b Block) error { return s.submitBlock(b, true) }
 
-// appendFile appends bytes atomically-ish.
-func appendFile(path string, data []byte) error {
-	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+func (s *Server) submitBlock(b Block, linked bool) error {
+	line, err := json.Marshal(b)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	_, err = f.Write(data)
-	return err
+	return s.journal.submit(&journalReq{b: b, line: append(line, '\n'), linked: linked})
 }
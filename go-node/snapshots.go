@@ -0,0 +1,539 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scheduled snapshot exports. Backup agents pick up files rather than call
+// APIs, so with --snapshot-dir set the node writes a self-describing export
+// there on --snapshot-schedule: peers.enc (the peer list sealed with the
+// FileKey, same format as ~/.mixnets/peers.enc), a copy of chain.jsonl
+// with a checkpoint describing exactly that copy, chunks.json (the index of
+// chunks on disk, not the chunks) and manifest.json with every file's size
+// and SHA-256. An export is built in a dot-directory and renamed into place
+// once complete, so a half-written one never carries the snapshot- name.
+// Only the newest --snapshot-keep are kept. A failed run marks /ready
+// degraded until the next success and emits snapshot.failed; POST
+// /snapshots/run exports now and GET /snapshots lists the exports, checking
+// each against its manifest.
+
+const (
+	snapshotPrefix   = "snapshot-"
+	snapshotStamp    = "20060102T150405Z"
+	snapshotManifest = "manifest.json"
+	snapshotVersion  = 1
+
+	defaultSnapshotSchedule = "daily 02:00"
+	defaultSnapshotKeep     = 7
+)
+
+var (
+	errSnapshotBusy = errors.New("a snapshot is already being written")
+	errSnapshotOff  = errors.New("--snapshot-dir is not set")
+
+	snapshotsTotal = metricDef{"snapshots_total", "snapshot exports by result", "result"}
+)
+
+// snapshotSchedule is a parsed --snapshot-schedule: "every <duration>",
+// "hourly [:MM]", "daily HH:MM" or "weekly <day> HH:MM", in local time.
+type snapshotSchedule struct {
+	every   time.Duration
+	weekday time.Weekday
+	weekly  bool
+	hour    int // -1: hourly
+	minute  int
+}
+
+func parseSnapshotSchedule(spec string) (*snapshotSchedule, error) {
+	f := strings.Fields(strings.ToLower(spec))
+	if len(f) == 0 || f[0] == "off" {
+		return nil, nil
+	}
+	bad := fmt.Errorf(`--snapshot-schedule must be "every <duration>", "hourly [:MM]", "daily HH:MM", "weekly <day> HH:MM" or "off", got %q`, spec)
+	clock := func(v string) (int, int, bool) {
+		h, m, ok := strings.Cut(v, ":")
+		hh, err1 := strconv.Atoi(h)
+		mm, err2 := strconv.Atoi(m)
+		return hh, mm, ok && err1 == nil && err2 == nil && hh >= 0 && hh < 24 && mm >= 0 && mm < 60
+	}
+	sc := &snapshotSchedule{hour: -1}
+	switch {
+	case f[0] == "every" && len(f) == 2:
+		d, err := time.ParseDuration(f[1])
+		if err != nil || d < time.Minute {
+			return nil, fmt.Errorf("--snapshot-schedule: every needs a duration of at least 1m, got %q", f[1])
+		}
+		sc.every = d
+	case f[0] == "hourly" && len(f) <= 2:
+		if len(f) == 2 {
+			m, err := strconv.Atoi(strings.TrimPrefix(f[1], ":"))
+			if err != nil || m < 0 || m > 59 {
+				return nil, bad
+			}
+			sc.minute = m
+		}
+	case f[0] == "daily" && len(f) == 2:
+		h, m, ok := clock(f[1])
+		if !ok {
+			return nil, bad
+		}
+		sc.hour, sc.minute = h, m
+	case f[0] == "weekly" && len(f) == 3:
+		h, m, ok := clock(f[2])
+		if !ok {
+			return nil, bad
+		}
+		day := -1
+		for d := time.Sunday; d <= time.Saturday && len(f[1]) >= 3; d++ {
+			if strings.HasPrefix(strings.ToLower(d.String()), f[1]) {
+				day = int(d)
+			}
+		}
+		if day < 0 {
+			return nil, bad
+		}
+		sc.weekly, sc.weekday, sc.hour, sc.minute = true, time.Weekday(day), h, m
+	default:
+		return nil, bad
+	}
+	return sc, nil
+}
+
+// next is the first run strictly after t.
+func (sc *snapshotSchedule) next(t time.Time) time.Time {
+	if sc.every > 0 {
+		return t.Truncate(sc.every).Add(sc.every)
+	}
+	if sc.hour < 0 {
+		n := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), sc.minute, 0, 0, t.Location())
+		if !n.After(t) {
+			n = n.Add(time.Hour)
+		}
+		return n
+	}
+	n := time.Date(t.Year(), t.Month(), t.Day(), sc.hour, sc.minute, 0, 0, t.Location())
+	for !n.After(t) || (sc.weekly && n.Weekday() != sc.weekday) {
+		n = time.Date(n.Year(), n.Month(), n.Day()+1, sc.hour, sc.minute, 0, 0, t.Location())
+	}
+	return n
+}
+
+// snapshotFile is one file of an export as the manifest lists it.
+type snapshotFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+type snapshotManifestDoc struct {
+	Version     int            `json:"version"`
+	NodeID      string         `json:"node_id"`
+	OrgID       string         `json:"org_id"`
+	Created     time.Time      `json:"created"`
+	Trigger     string         `json:"trigger"` // schedule | manual
+	ChainHeight int            `json:"chain_height"`
+	ChainTip    string         `json:"chain_tip,omitempty"`
+	Peers       int            `json:"peers"`
+	Chunks      int            `json:"chunks"`
+	Files       []snapshotFile `json:"files"`
+}
+
+// snapshotChunk is one row of chunks.json.
+type snapshotChunk struct {
+	Hash    string `json:"hash"`
+	Size    int64  `json:"size"`
+	Name    string `json:"name,omitempty"` // from the chain block, if any
+	Origin  string `json:"origin,omitempty"`
+	Created int64  `json:"created_unix,omitempty"`
+}
+
+// snapshotRun is the outcome of one export, as /snapshots and the
+// snapshot.* events report it.
+type snapshotRun struct {
+	Name    string    `json:"name,omitempty"`
+	Trigger string    `json:"trigger"`
+	Started time.Time `json:"started"`
+	TookMS  int64     `json:"took_ms"`
+	Size    int64     `json:"size,omitempty"`
+	Pruned  []string  `json:"pruned,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// snapshotView is one export on disk.
+type snapshotView struct {
+	Name     string    `json:"name"`
+	Created  time.Time `json:"created,omitzero"`
+	Trigger  string    `json:"trigger,omitempty"`
+	Size     int64     `json:"size"`
+	Files    int       `json:"files"`
+	Height   int       `json:"chain_height"`
+	Verified string    `json:"verified"` // ok | mismatch | incomplete
+	Problems []string  `json:"problems,omitempty"`
+}
+
+type snapshotter struct {
+	dir   string
+	keep  int
+	spec  string
+	sched *snapshotSchedule
+	err   error // schedule parse error
+
+	mu      sync.Mutex
+	running bool
+	last    *snapshotRun
+	next    time.Time
+}
+
+func newSnapshotter(cfg *Config) *snapshotter {
+	sn := &snapshotter{dir: cfg.SnapshotDir, keep: cfg.SnapshotKeep, spec: cfg.SnapshotSchedule}
+	sn.sched, sn.err = parseSnapshotSchedule(cfg.SnapshotSchedule)
+	return sn
+}
+
+// failing reports whether the last export failed (for /ready).
+func (sn *snapshotter) failing() bool {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+	return sn.last != nil && sn.last.Error != ""
+}
+
+// runSnapshot writes one export and prunes old ones.
+func (s *Server) runSnapshot(trigger string) (snapshotRun, error) {
+	sn := s.snapshots
+	if sn.dir == "" {
+		return snapshotRun{}, errSnapshotOff
+	}
+	sn.mu.Lock()
+	if sn.running {
+		sn.mu.Unlock()
+		return snapshotRun{}, errSnapshotBusy
+	}
+	sn.running = true
+	sn.mu.Unlock()
+
+	run := snapshotRun{Trigger: trigger, Started: time.Now().UTC()}
+	name, size, err := s.writeSnapshot(run.Started, trigger)
+	run.TookMS = time.Since(run.Started).Milliseconds()
+	if err != nil {
+		run.Error = err.Error()
+		s.metrics.counter(snapshotsTotal).inc("failed")
+		log.Printf("[snapshot] %s export failed: %v", trigger, err)
+		s.emit(eventSnapshotFailed, run)
+	} else {
+		run.Name, run.Size = name, size
+		run.Pruned = s.pruneSnapshots()
+		s.metrics.counter(snapshotsTotal).inc("ok")
+		log.Printf("[snapshot] wrote %s (%d bytes, %dms)", filepath.Join(sn.dir, name), size, run.TookMS)
+		s.emit(eventSnapshotWritten, run)
+	}
+	sn.mu.Lock()
+	sn.running = false
+	sn.last = &run
+	sn.mu.Unlock()
+	return run, err
+}
+
+// writeSnapshot builds the export in a dot-directory and renames it into
+// place. Returns its name and total size.
+func (s *Server) writeSnapshot(now time.Time, trigger string) (string, int64, error) {
+	dir := s.snapshots.dir
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", 0, err
+	}
+	name := snapshotPrefix + now.Format(snapshotStamp)
+	tmp, err := os.MkdirTemp(dir, "."+name+"-")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.RemoveAll(tmp) // no-op once renamed
+
+	man := snapshotManifestDoc{Version: snapshotVersion, NodeID: s.id.NodeID, OrgID: s.org.ID, Created: now, Trigger: trigger}
+	put := func(file string, b []byte) error {
+		if err := os.WriteFile(filepath.Join(tmp, file), b, 0o600); err != nil {
+			return err
+		}
+		man.Files = append(man.Files, snapshotFile{Name: file, Size: int64(len(b)), SHA256: sha256Hex(b)})
+		return nil
+	}
+
+	peers := s.peers.List()
+	man.Peers = len(peers)
+	blob, err := sealPeers(peers, s.secrets.FileKey[:])
+	if err != nil {
+		return "", 0, fmt.Errorf("peers: %w", err)
+	}
+	if err := put("peers.enc", blob); err != nil {
+		return "", 0, err
+	}
+
+	cp, f, err := s.snapshotChain(tmp)
+	if err != nil {
+		return "", 0, fmt.Errorf("chain: %w", err)
+	}
+	man.Files = append(man.Files, f)
+	man.ChainHeight, man.ChainTip = cp.Height, cp.Tip
+	if cp.Height > 0 {
+		b, _ := json.MarshalIndent(cp, "", "  ")
+		if err := put("checkpoint.json", b); err != nil {
+			return "", 0, err
+		}
+	}
+	if b, err := os.ReadFile(filepath.Join(s.chainDir(), chainBaseFile)); err == nil {
+		if err := put(chainBaseFile, b); err != nil {
+			return "", 0, err
+		}
+	}
+
+	chunks := s.chunkIndex()
+	man.Chunks = len(chunks)
+	b, _ := json.MarshalIndent(chunks, "", "  ")
+	if err := put("chunks.json", b); err != nil {
+		return "", 0, err
+	}
+
+	var size int64
+	for _, f := range man.Files {
+		size += f.Size
+	}
+	b, _ = json.MarshalIndent(man, "", "  ")
+	if err := os.WriteFile(filepath.Join(tmp, snapshotManifest), b, 0o600); err != nil {
+		return "", 0, err
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, name)); err != nil {
+		return "", 0, err
+	}
+	return name, size + int64(len(b)), nil
+}
+
+// snapshotChain copies chain.jsonl as of now into dir and returns a
+// checkpoint describing the copy. The file is opened under chainMu, so the
+// copy is a consistent prefix even if blocks are appended meanwhile.
+func (s *Server) snapshotChain(dir string) (chainCheckpoint, snapshotFile, error) {
+	out := snapshotFile{Name: "chain.jsonl"}
+	s.chainMu.Lock()
+	c := s.chain
+	cp := chainCheckpoint{Height: c.height, Tip: s.getChainTip(), PrefixHash: c.acc, Bytes: c.bytes, Created: time.Now().Unix()}
+	src, err := os.Open(s.chainPath())
+	s.chainMu.Unlock()
+	if errors.Is(err, os.ErrNotExist) {
+		src, err = nil, nil
+	}
+	if err != nil {
+		return cp, out, err
+	}
+	dst, err := os.OpenFile(filepath.Join(dir, out.Name), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o600)
+	if err != nil {
+		if src != nil {
+			src.Close()
+		}
+		return cp, out, err
+	}
+	defer dst.Close()
+	h := sha256.New()
+	if src != nil {
+		defer src.Close()
+		out.Size, err = io.CopyN(io.MultiWriter(dst, h), src, cp.Bytes)
+		if err != nil {
+			return cp, out, err
+		}
+	}
+	out.SHA256 = hex.EncodeToString(h.Sum(nil))
+	return cp, out, dst.Sync()
+}
+
+// chunkIndex lists the chunks on disk with the block that names them.
+func (s *Server) chunkIndex() []snapshotChunk {
+	blocks := make(map[string]Block)
+	for _, b := range s.readChain() {
+		blocks[b.Hash] = b
+	}
+	out := []snapshotChunk{}
+	for _, name := range s.chunkNames() {
+		st, err := os.Stat(filepath.Join(s.paths.ChunksDir, name))
+		if err != nil {
+			continue
+		}
+		hash := strings.TrimSuffix(name, ".bin")
+		row := snapshotChunk{Hash: hash, Size: st.Size()}
+		if b, ok := blocks[hash]; ok {
+			row.Name, row.Origin, row.Created = b.Name, b.OriginID, b.Created
+		}
+		out = append(out, row)
+	}
+	return out
+}
+
+// snapshotNames are the completed exports, oldest first.
+func (sn *snapshotter) snapshotNames() []string {
+	entries, _ := os.ReadDir(sn.dir)
+	var names []string
+	for _, e := range entries {
+		if e.IsDir() && strings.HasPrefix(e.Name(), snapshotPrefix) {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// pruneSnapshots removes all but the newest keep exports (0 keeps all).
+func (s *Server) pruneSnapshots() []string {
+	sn := s.snapshots
+	names := sn.snapshotNames()
+	if sn.keep <= 0 || len(names) <= sn.keep {
+		return nil
+	}
+	var pruned []string
+	for _, name := range names[:len(names)-sn.keep] {
+		if err := os.RemoveAll(filepath.Join(sn.dir, name)); err != nil {
+			log.Printf("[snapshot] prune %s: %v", name, err)
+			continue
+		}
+		pruned = append(pruned, name)
+	}
+	return pruned
+}
+
+// verifySnapshot re-hashes an export's files against its manifest.
+func (sn *snapshotter) verifySnapshot(name string) snapshotView {
+	v := snapshotView{Name: name, Verified: "ok"}
+	dir := filepath.Join(sn.dir, name)
+	b, err := os.ReadFile(filepath.Join(dir, snapshotManifest))
+	var man snapshotManifestDoc
+	if err == nil {
+		err = json.Unmarshal(b, &man)
+	}
+	if err != nil {
+		v.Verified, v.Problems = "incomplete", []string{"manifest: " + err.Error()}
+		return v
+	}
+	v.Created, v.Trigger, v.Height, v.Files = man.Created, man.Trigger, man.ChainHeight, len(man.Files)
+	v.Size = int64(len(b))
+	for _, f := range man.Files {
+		got, err := hashFile(filepath.Join(dir, f.Name))
+		switch {
+		case err != nil:
+			v.Verified = "incomplete"
+			v.Problems = append(v.Problems, f.Name+": "+err.Error())
+		case got.Size != f.Size || got.SHA256 != f.SHA256:
+			if v.Verified == "ok" {
+				v.Verified = "mismatch"
+			}
+			v.Problems = append(v.Problems, f.Name+": content does not match manifest")
+		}
+		v.Size += got.Size
+	}
+	return v
+}
+
+func hashFile(path string) (snapshotFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return snapshotFile{}, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	return snapshotFile{Name: filepath.Base(path), Size: n, SHA256: hex.EncodeToString(h.Sum(nil))}, err
+}
+
+// startSnapshotLoop exports on the schedule until ctx ends.
+func (s *Server) startSnapshotLoop(ctx context.Context) {
+	sn := s.snapshots
+	if sn.dir == "" {
+		return
+	}
+	if sn.err != nil {
+		log.Printf("[snapshot] %v; scheduled exports off", sn.err)
+		return
+	}
+	if sn.sched == nil {
+		log.Printf("[snapshot] no schedule; exports only on POST /snapshots/run")
+		return
+	}
+	for {
+		next := sn.sched.next(time.Now())
+		sn.mu.Lock()
+		sn.next = next
+		sn.mu.Unlock()
+		t := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+		if _, err := s.runSnapshot("schedule"); errors.Is(err, errSnapshotBusy) {
+			log.Printf("[snapshot] scheduled export skipped: %v", err)
+		}
+	}
+}
+
+// GET /snapshots (control, token): the exports on disk, each checked
+// against its manifest, plus the schedule and the last run.
+func (s *Server) handleSnapshots(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	sn := s.snapshots
+	out := map[string]any{"enabled": sn.dir != ""}
+	if sn.dir == "" {
+		writeJSON(w, out)
+		return
+	}
+	views := []snapshotView{}
+	names := sn.snapshotNames()
+	for i := len(names) - 1; i >= 0; i-- {
+		views = append(views, sn.verifySnapshot(names[i]))
+	}
+	sn.mu.Lock()
+	out["dir"], out["schedule"], out["keep"] = sn.dir, sn.spec, sn.keep
+	if !sn.next.IsZero() {
+		out["next"] = sn.next
+	}
+	if sn.last != nil {
+		out["last"] = *sn.last
+	}
+	out["running"] = sn.running
+	sn.mu.Unlock()
+	out["snapshots"] = views
+	writeJSON(w, out)
+}
+
+// POST /snapshots/run (control, token): export now.
+func (s *Server) handleSnapshotRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	run, err := s.runSnapshot("manual")
+	switch {
+	case errors.Is(err, errSnapshotOff):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, errSnapshotBusy):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, "snapshot failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("[audit] snapshot %s written on request", run.Name)
+	writeJSON(w, run)
+}
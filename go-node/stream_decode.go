@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/poly1305"
+)
+
+// Incremental decoders for relay packets too large to hold (relay_spill.go):
+// a JSON object reader that streams chosen string fields out instead of
+// materializing them, a base64url writer, and an XChaCha20-Poly1305 open
+// that authenticates in one pass over a spill file and decrypts in a second.
+// They read exactly what aeadEncrypt and json.Marshal write.
+
+const maxSmallJSON = 64 << 10 // largest non-streamed field value
+
+// streamJSONObject reads one JSON object from r. A key in small is decoded
+// into its target; a key in big must hold a string, whose raw contents are
+// written to the writer big[key] returns when the value starts (fields
+// before it are already decoded) and then closed. Other keys are skipped.
+// Streamed strings may not contain escapes: base64url never needs one.
+func streamJSONObject(r io.Reader, small map[string]any, big map[string]func() io.WriteCloser) error {
+	br := bufio.NewReaderSize(r, 64<<10)
+	if err := expectByte(br, '{'); err != nil {
+		return err
+	}
+	for first := true; ; first = false {
+		c, err := nextByte(br)
+		if err != nil {
+			return err
+		}
+		if c == '}' && first {
+			return nil
+		}
+		if c != '"' {
+			return fmt.Errorf("json: want key, got %q", c)
+		}
+		br.UnreadByte()
+		var kb bytes.Buffer
+		if err := scanValue(br, &kb, 1<<10); err != nil {
+			return err
+		}
+		var key string
+		if err := json.Unmarshal(kb.Bytes(), &key); err != nil {
+			return err
+		}
+		if err := expectByte(br, ':'); err != nil {
+			return err
+		}
+		switch {
+		case big[key] != nil:
+			if err := expectByte(br, '"'); err != nil {
+				return fmt.Errorf("json: %s: %w", key, err)
+			}
+			w := big[key]()
+			if err := copyRawString(br, w); err != nil {
+				w.Close()
+				return fmt.Errorf("json: %s: %w", key, err)
+			}
+			if err := w.Close(); err != nil {
+				return fmt.Errorf("json: %s: %w", key, err)
+			}
+		case small[key] != nil:
+			if _, err := nextByte(br); err != nil {
+				return err
+			}
+			br.UnreadByte()
+			var vb bytes.Buffer
+			if err := scanValue(br, &vb, maxSmallJSON); err != nil {
+				return fmt.Errorf("json: %s: %w", key, err)
+			}
+			if err := json.Unmarshal(vb.Bytes(), small[key]); err != nil {
+				return fmt.Errorf("json: %s: %w", key, err)
+			}
+		default:
+			if _, err := nextByte(br); err != nil {
+				return err
+			}
+			br.UnreadByte()
+			if err := scanValue(br, io.Discard, -1); err != nil {
+				return err
+			}
+		}
+		c, err = nextByte(br)
+		if err != nil {
+			return err
+		}
+		switch c {
+		case ',':
+		case '}':
+			return nil
+		default:
+			return fmt.Errorf("json: want , or }, got %q", c)
+		}
+	}
+}
+
+// nextByte returns the next byte that isn't JSON whitespace.
+func nextByte(br *bufio.Reader) (byte, error) {
+	for {
+		c, err := br.ReadByte()
+		if err != nil {
+			return 0, io.ErrUnexpectedEOF
+		}
+		switch c {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		return c, nil
+	}
+}
+
+func expectByte(br *bufio.Reader, want byte) error {
+	c, err := nextByte(br)
+	if err != nil {
+		return err
+	}
+	if c != want {
+		return fmt.Errorf("json: want %q, got %q", want, c)
+	}
+	return nil
+}
+
+// copyRawString copies string contents up to the closing quote, which it
+// consumes.
+func copyRawString(br *bufio.Reader, w io.Writer) error {
+	for {
+		chunk, err := br.ReadSlice('"')
+		if err != nil && err != bufio.ErrBufferFull {
+			return io.ErrUnexpectedEOF
+		}
+		done := err == nil
+		if done {
+			chunk = chunk[:len(chunk)-1]
+		}
+		if bytes.IndexByte(chunk, '\\') >= 0 {
+			return errors.New("escaped string")
+		}
+		if _, werr := w.Write(chunk); werr != nil {
+			return werr
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+// scanValue copies one JSON value to w, failing past limit bytes (-1 = no
+// limit). It only finds the value's end; json.Unmarshal validates it.
+func scanValue(br *bufio.Reader, w io.Writer, limit int) error {
+	var (
+		n             int
+		depth         int
+		inStr, escape bool
+	)
+	for {
+		c, err := br.ReadByte()
+		if err != nil {
+			return io.ErrUnexpectedEOF
+		}
+		if !inStr && depth == 0 && n > 0 && (c == ',' || c == '}' || c == ']' || c == ' ' || c == '\t' || c == '\r' || c == '\n') {
+			br.UnreadByte() // end of a bare literal
+			return nil
+		}
+		if n++; limit >= 0 && n > limit {
+			return errors.New("value too large")
+		}
+		if _, err := w.Write([]byte{c}); err != nil {
+			return err
+		}
+		switch {
+		case inStr:
+			switch {
+			case escape:
+				escape = false
+			case c == '\\':
+				escape = true
+			case c == '"':
+				inStr = false
+				if depth == 0 {
+					return nil
+				}
+			}
+		case c == '"':
+			inStr = true
+		case c == '{' || c == '[':
+			depth++
+		case c == '}' || c == ']':
+			if depth--; depth <= 0 {
+				return nil
+			}
+		}
+	}
+}
+
+// b64Writer decodes base64url (unpadded) written to it into dst.
+type b64Writer struct {
+	dst io.Writer
+	buf []byte
+	out []byte
+}
+
+func newB64Writer(dst io.Writer) *b64Writer { return &b64Writer{dst: dst} }
+
+func (b *b64Writer) Write(p []byte) (int, error) {
+	b.buf = append(b.buf, p...)
+	whole := len(b.buf) / 4 * 4
+	if whole == 0 {
+		return len(p), nil
+	}
+	if err := b.decode(b.buf[:whole]); err != nil {
+		return 0, err
+	}
+	b.buf = append(b.buf[:0], b.buf[whole:]...)
+	return len(p), nil
+}
+
+func (b *b64Writer) decode(src []byte) error {
+	if need := base64.RawURLEncoding.DecodedLen(len(src)); cap(b.out) < need {
+		b.out = make([]byte, need)
+	}
+	n, err := base64.RawURLEncoding.Decode(b.out[:cap(b.out)], src)
+	if err != nil {
+		return err
+	}
+	_, err = b.dst.Write(b.out[:n])
+	return err
+}
+
+// Close decodes the final partial quantum; it doesn't close dst.
+func (b *b64Writer) Close() error {
+	if len(b.buf) == 0 {
+		return nil
+	}
+	err := b.decode(b.buf)
+	b.buf = nil
+	return err
+}
+
+// openXStream authenticates nonce||ciphertext||tag as sealed by aeadEncrypt
+// (XChaCha20-Poly1305, no additional data) reading src once, then returns
+// the plaintext from a second read. Nothing is returned unless the tag
+// checks out; the spill file is itself sealed, so it can't change between
+// the two reads without failing.
+func openXStream(key []byte, src *spillFile) (io.ReadCloser, error) {
+	ctLen := src.size - chacha20poly1305.NonceSizeX - poly1305.TagSize
+	if ctLen < 0 {
+		return nil, errors.New("ciphertext too short")
+	}
+	rc, err := src.Open()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	if _, err := io.ReadFull(rc, nonce); err != nil {
+		rc.Close()
+		return nil, err
+	}
+	newCipher := func() (*chacha20.Cipher, *[32]byte, error) {
+		c, err := chacha20.NewUnauthenticatedCipher(key, nonce)
+		if err != nil {
+			return nil, nil, err
+		}
+		var polyKey [32]byte
+		c.XORKeyStream(polyKey[:], polyKey[:])
+		c.SetCounter(1)
+		return c, &polyKey, nil
+	}
+	_, polyKey, err := newCipher()
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	mac := poly1305.New(polyKey)
+	if _, err := io.CopyN(mac, rc, ctLen); err != nil {
+		rc.Close()
+		return nil, err
+	}
+	var trailer [16 + 16]byte
+	pad := trailer[:(16-ctLen%16)%16]
+	mac.Write(pad)
+	binary.LittleEndian.PutUint64(trailer[16:], 0)
+	binary.LittleEndian.PutUint64(trailer[24:], uint64(ctLen))
+	mac.Write(trailer[16:])
+	tag := make([]byte, poly1305.TagSize)
+	_, err = io.ReadFull(rc, tag)
+	rc.Close()
+	if err != nil {
+		return nil, err
+	}
+	if !mac.Verify(tag) {
+		return nil, errors.New("chacha20poly1305: message authentication failed")
+	}
+
+	rc, err = src.Open()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(io.Discard, rc, chacha20poly1305.NonceSizeX); err != nil {
+		rc.Close()
+		return nil, err
+	}
+	c, _, err := newCipher()
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return &xorReader{r: io.LimitReader(rc, ctLen), c: c, rc: rc}, nil
+}
+
+type xorReader struct {
+	r  io.Reader
+	c  *chacha20.Cipher
+	rc io.Closer
+}
+
+func (x *xorReader) Read(p []byte) (int, error) {
+	n, err := x.r.Read(p)
+	x.c.XORKeyStream(p[:n], p[:n])
+	return n, err
+}
+
+func (x *xorReader) Close() error { return x.rc.Close() }
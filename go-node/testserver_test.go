@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestServer returns a node named name with its data under a temp dir
+// and its public API on a loopback listener; cfg nil means defaultConfig.
+// Every test node shares the org "test".
+func newTestServer(t testing.TB, name string, cfg *Config) *Server {
+	t.Helper()
+	if cfg == nil {
+		cfg = defaultConfig()
+	}
+	h := sha256.Sum256([]byte(name))
+	id := hex.EncodeToString(h[:])
+	paths, err := initStorageEnv(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	nk, err := newNodeKeypair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sec := &EnvSecrets{OrgID: "test"}
+	copy(sec.FileKey[:], h[:])
+	s := newServer(cfg, NodeIdentity{NodeID: id, Hostname: name}, newPeerStore(), newSimpleDHT(id), nk, paths, sec)
+	ts := httptest.NewServer(s.PublicHandler())
+	t.Cleanup(ts.Close)
+	s.selfAddr = strings.TrimPrefix(ts.URL, "http://")
+	return s
+}
+
+// meet makes b a live peer of a, with b's mix key, caps and receipt key
+// pinned as a beacon and /peer-info would.
+func meet(t testing.TB, a, b *Server) {
+	t.Helper()
+	priv, err := receiptKey(b.paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.peers.Upsert(PeerInfo{
+		NodeID:     b.id.NodeID,
+		Addr:       b.selfAddr,
+		Hostname:   b.id.Hostname,
+		LastSeen:   time.Now(),
+		Caps:       nodeCaps(b.cfg),
+		APIVersion: 1,
+		PubKey:     b.nodeKeys.Pub[:],
+	})
+	a.peers.mu.Lock()
+	p := a.peers.peers[b.id.NodeID]
+	p.SignKey = []byte(priv.Public().(ed25519.PublicKey))
+	a.peers.peers[b.id.NodeID] = p
+	a.peers.mu.Unlock()
+}
+
+// mesh makes every node a peer of every other.
+func mesh(t testing.TB, nodes ...*Server) {
+	t.Helper()
+	for _, a := range nodes {
+		for _, b := range nodes {
+			if a != b {
+				meet(t, a, b)
+			}
+		}
+	}
+}
+
+// eventually polls cond until it holds or 5s pass.
+func eventually(t testing.TB, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// sendText sends body from a to the node to through POST /mix/send-text
+// with the extra query (class, hops, ...) and returns the response.
+func sendText(t testing.TB, a *Server, to *Server, query, body string) SendTextResponse {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	a.handleSendText(rr, httptest.NewRequest(http.MethodPost, "/mix/send-text?to="+to.id.NodeID+"&"+query, strings.NewReader(body)))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("send-text: HTTP %d %s", rr.Code, rr.Body)
+	}
+	var res SendTextResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// inboxText waits for msgid in s's inbox and returns its body.
+func inboxText(t testing.TB, s *Server, msgid string) string {
+	t.Helper()
+	var m InboxMessage
+	eventually(t, "msgid "+msgid+" in the inbox", func() bool {
+		var ok bool
+		m, ok = s.inbox.find(msgid, "")
+		return ok
+	})
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return string(s.kv[m.Key])
+}
+
+// hearBeacon hands b, sealed with s's group key, to s's beacon listener as
+// if it came from ip, and returns the outcome.
+func hearBeacon(s *Server, ip string, b Beacon, profileChanged func(string)) string {
+	if b.Type == "" {
+		b.Type = "beacon"
+	}
+	if b.TS == 0 {
+		b.TS = time.Now().Unix()
+	}
+	if b.Org == "" {
+		b.Org = s.secrets.OrgID
+	}
+	pkt, err := encryptBeaconWithKey(b, s.secrets.BeaconKey[:])
+	if err != nil {
+		panic(err)
+	}
+	_, outcome := acceptBeacon(s.cfg, s.peers, &net.UDPAddr{IP: net.ParseIP(ip), Port: 5000}, pkt, s.secrets.BeaconKey[:], s.pairings, s.org, s.clock, s.dups, profileChanged)
+	return outcome
+}
+
+// callControl calls s's control API from loopback; token "" sends no Authorization header.
+func callControl(s *Server, method, path, token string, body io.Reader) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, body)
+	r.RemoteAddr = "127.0.0.1:40000"
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	rr := httptest.NewRecorder()
+	s.ControlHandler().ServeHTTP(rr, r)
+	return rr
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// peel opens the outer layer of a JSON onion packet with s's mix key, as
+// s's relayHandler does.
+func peel(t *testing.T, s *Server, packet []byte) (onionLayerPlain, error) {
+	t.Helper()
+	var op onionPacket
+	if err := json.Unmarshal(packet, &op); err != nil {
+		t.Fatal(err)
+	}
+	epub, _ := base64.RawURLEncoding.DecodeString(op.EphemeralPub)
+	ct, _ := base64.RawURLEncoding.DecodeString(op.Ciphertext)
+	shared, err := curve25519.X25519(s.nodeKeys.Priv[:], epub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := layerKey(op.V, shared, epub, s.nodeKeys.Pub[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var plain onionLayerPlain
+	pt, err := aeadDecrypt(key, ct)
+	if err != nil {
+		return plain, err
+	}
+	return plain, json.Unmarshal(pt, &plain)
+}
+
+func relay(s *Server, packet []byte) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	relayHandler(s.nodeKeys, s)(rr, httptest.NewRequest(http.MethodPost, "/v1/mix/relay", bytes.NewReader(packet)))
+	return rr
+}
+
+// A text relayed through b to c: b sees only c's sealed layer, can't open
+// the envelope with its own mix key or the old hardcoded one, refuses it
+// when handed the envelope as its final hop, and c reads it.
+func TestTextSealedFromRelay(t *testing.T) {
+	b, c := newTestServer(t, "b", nil), newTestServer(t, "c", nil)
+	meet(t, b, c)
+	secret := []byte("for c's eyes only")
+	env := FinalEnvelope{Type: "text", SenderID: b.id.NodeID, ReceiverID: c.id.NodeID, MsgID: "sealed"}
+	if err := sealText(&env, c.nodeKeys.Pub[:], secret); err != nil {
+		t.Fatal(err)
+	}
+	envB, _ := json.Marshal(env)
+	hops := []hopInfo{
+		{NodeID: b.id.NodeID, Addr: b.selfAddr, PubKey: b.nodeKeys.Pub[:], V: onionV2},
+		{NodeID: c.id.NodeID, Addr: c.selfAddr, PubKey: c.nodeKeys.Pub[:], V: onionV2},
+	}
+	onion, err := buildOnion(hops, envB, mixTTL, env.MsgID, "", classInteractive, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// what b peels is c's layer, which b's key doesn't open
+	plain, err := peel(t, b, onion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner, _ := base64.RawURLEncoding.DecodeString(plain.Payload)
+	if bytes.Contains(inner, secret) || bytes.Contains(inner, []byte(env.DataB64)) {
+		t.Fatal("b's layer carries the text")
+	}
+	if _, err := peel(t, b, inner); err == nil {
+		t.Fatal("b opened c's layer")
+	}
+
+	// b holding the envelope itself still can't read it
+	data, _ := base64.RawURLEncoding.DecodeString(env.DataB64)
+	if _, err := openText(b.nodeKeys, &env, data); err == nil {
+		t.Fatal("b opened the text with its mix key")
+	}
+	if _, err := openTextHardcoded(data); err == nil {
+		t.Fatal("the text opens with the hardcoded key")
+	}
+	if rr := relay(b, mixTo(t, b, onionV2, envB)); rr.Code != http.StatusForbidden {
+		t.Fatalf("b as the final hop: HTTP %d %s", rr.Code, rr.Body)
+	}
+	if _, ok := b.inbox.find(env.MsgID, ""); ok {
+		t.Fatal("b stored the text")
+	}
+
+	if rr := relay(b, onion); rr.Code != http.StatusOK {
+		t.Fatalf("relay: HTTP %d %s", rr.Code, rr.Body)
+	}
+	if got := inboxText(t, c, env.MsgID); got != string(secret) {
+		t.Fatalf("c got %q", got)
+	}
+}
@@ -0,0 +1,490 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Tombstones. POST /chain/tombstone?hash=H removes a data block this node
+// sent from the fleet (?batch=B: all of its blocks in batch B). The node appends a block of kind "tombstone" naming
+// H, signed with its receipt key (see escrow.go), and fans it out like a
+// receipt. A node that takes a tombstone deletes H's chunk, moves its key
+// to keys/revoked/ and answers later /replicate pushes of H with 410; the
+// origin can also revoke the escrowed key. H and the tombstone stay in the
+// chain as evidence. Only H's origin may delete it: the tombstone must
+// come from the same NodeID and be signed by the key this node pinned for
+// that NodeID, the sign_key its beacons prove (key_continuity.go), or our
+// own receipt key for our blocks. Anyone can claim an OriginID, so a
+// tombstone from an origin with no pinned key is refused.
+// GET /chain/tombstones reports the tombstones and which peers still hold
+// a deleted chunk.
+
+const (
+	blockTombstone = "tombstone"
+
+	tombstoneProbes = 8 // peers asked at once by /chain/tombstones
+)
+
+// tombstone is the payload of a tombstone block.
+type tombstone struct {
+	Block  string `json:"block"` // data block being deleted
+	Reason string `json:"reason,omitempty"`
+	At     int64  `json:"at_unix"`
+	Revoke bool   `json:"revoke_escrow,omitempty"` // origin revokes the keysaver copy too
+	Signer string `json:"signer"`                  // Ed25519 public key, base64
+	Sig    string `json:"sig"`
+}
+
+func (ts *tombstone) body(origin string) []byte {
+	return fmt.Appendf(nil, "%s|%s|%s|%s|%d|%t|%s", blockTombstone, origin, ts.Block, ts.Reason, ts.At, ts.Revoke, ts.Signer)
+}
+
+// digest is the tombstone block's hash; it covers the signature too.
+func (ts *tombstone) digest(origin string) string {
+	return sha256Hex(append(ts.body(origin), ts.Sig...))
+}
+
+func (b Block) isTombstone() bool { return b.Kind == blockTombstone }
+
+// isData is true for blocks that stand for a chunk (not receipts,
+// tombstones or access records).
+func (b Block) isData() bool { return b.Kind == "" }
+
+// verifySig checks an Ed25519 signature given as base64 key and signature.
+func verifySig(signer, sig string, body []byte) error {
+	pub, err := base64.StdEncoding.DecodeString(signer)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return errors.New("bad signer key")
+	}
+	sb, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil || !ed25519.Verify(ed25519.PublicKey(pub), body, sb) {
+		return errors.New("bad signature")
+	}
+	return nil
+}
+
+// originSignKey is the signing key pinned for origin: our receipt key for
+// ourselves, else the peer's proven sign_key. nil if none is pinned.
+func (s *Server) originSignKey(origin string) ed25519.PublicKey {
+	if origin == s.id.NodeID {
+		priv, err := receiptKey(s.paths)
+		if err != nil {
+			return nil
+		}
+		return priv.Public().(ed25519.PublicKey)
+	}
+	p, ok := s.peers.Get(origin)
+	if !ok || len(p.SignKey) != ed25519.PublicKeySize {
+		return nil
+	}
+	return p.SignKey
+}
+
+// tombstonesIn maps each deleted block hash to its (first) tombstone.
+func tombstonesIn(blocks []Block) map[string]Block {
+	m := make(map[string]Block)
+	for _, b := range blocks {
+		if b.isTombstone() && b.Tombstone != nil {
+			if _, ok := m[b.Tombstone.Block]; !ok {
+				m[b.Tombstone.Block] = b
+			}
+		}
+	}
+	return m
+}
+
+// tombstoneFor returns the tombstone of block hash, if it was deleted.
+func (s *Server) tombstoneFor(hash string) (Block, bool) {
+	for _, b := range s.readChain() {
+		if b.isTombstone() && b.Tombstone != nil && b.Tombstone.Block == hash {
+			return b, true
+		}
+	}
+	return Block{}, false
+}
+
+// checkTombstone verifies tombstone block t against the chain before it
+// and pinned, the origin's signing key: the signer, signature and digest,
+// a data block to delete from the same origin, not deleted yet.
+func checkTombstone(blocks []Block, t Block, pinned ed25519.PublicKey) error {
+	ts := t.Tombstone
+	if ts == nil || !t.isTombstone() {
+		return errors.New("not a tombstone")
+	}
+	switch {
+	case len(pinned) != ed25519.PublicKeySize:
+		return errors.New("no signing key pinned for the origin")
+	case ts.Signer != base64.StdEncoding.EncodeToString(pinned):
+		return errors.New("signer is not the origin's key")
+	}
+	if err := verifySig(ts.Signer, ts.Sig, ts.body(t.OriginID)); err != nil {
+		return err
+	}
+	if t.Hash != ts.digest(t.OriginID) {
+		return errors.New("block hash is not the tombstone digest")
+	}
+	var target *Block
+	for i := range blocks {
+		if blocks[i].Hash == ts.Block && blocks[i].isData() {
+			target = &blocks[i]
+			break
+		}
+	}
+	switch {
+	case target == nil:
+		return errors.New("no data block " + ts.Block)
+	case target.OriginID != t.OriginID:
+		return errors.New("only the block's origin can delete it")
+	}
+	if _, ok := tombstonesIn(blocks)[ts.Block]; ok {
+		return errors.New("already deleted")
+	}
+	return nil
+}
+
+// appendTombstone signs a tombstone for data block target, appends it to
+// the chain and returns the block and its envelope.
+func (s *Server) appendTombstone(target Block, reason string, revoke bool) (Block, ReplicateEnvelope, error) {
+	priv, err := receiptKey(s.paths)
+	if err != nil {
+		return Block{}, ReplicateEnvelope{}, err
+	}
+	ts := &tombstone{
+		Block:  target.Hash,
+		Reason: reason,
+		At:     time.Now().Unix(),
+		Revoke: revoke,
+		Signer: base64.StdEncoding.EncodeToString(priv.Public().(ed25519.PublicKey)),
+	}
+	ts.Sig = base64.StdEncoding.EncodeToString(ed25519.Sign(priv, ts.body(s.id.NodeID)))
+	msgidBytes, err := secureRandom(16)
+	if err != nil {
+		return Block{}, ReplicateEnvelope{}, err
+	}
+	env := ReplicateEnvelope{
+		MsgID:     base64.RawURLEncoding.EncodeToString(msgidBytes),
+		OriginID:  s.id.NodeID,
+		HashHex:   ts.digest(s.id.NodeID),
+		PrevHash:  s.getChainTip(),
+		OrgID:     s.org.ID,
+		Created:   ts.At,
+		Logical:   s.lamport.tick(),
+		Kind:      blockTombstone,
+		Tombstone: ts,
+	}
+	blk := Block{
+		Hash:      env.HashHex,
+		PrevHash:  env.PrevHash,
+		Created:   env.Created,
+		OriginID:  env.OriginID,
+		Logical:   env.Logical,
+		Kind:      env.Kind,
+		Tombstone: ts,
+	}
+	if err := checkTombstone(s.readChain(), blk, priv.Public().(ed25519.PublicKey)); err != nil {
+		return Block{}, ReplicateEnvelope{}, err
+	}
+	if err := s.appendBlock(blk); err != nil {
+		return Block{}, ReplicateEnvelope{}, err
+	}
+	s.seenMu.Lock()
+	s.seen[env.MsgID] = struct{}{}
+	s.seenMu.Unlock()
+	return blk, env, nil
+}
+
+// tombstoneEffect is what applying a tombstone did on this node.
+type tombstoneEffect struct {
+	Deferred     bool   `json:"deferred,omitempty"` // maintenance mode; the next sweep applies it
+	ChunkDeleted bool   `json:"chunk_deleted"`
+	KeyRevoked   bool   `json:"key_revoked"`
+	Keysaver     string `json:"keysaver,omitempty"` // revoked | not_found | error: ...
+}
+
+// applyTombstone erases target's data unless maintenance mode is on, in
+// which case the next sweep does it.
+func (s *Server) applyTombstone(target Block, t Block) tombstoneEffect {
+	if !s.maint.hold() {
+		log.Printf("[tombstone] %s: deferred, maintenance mode", target.Hash)
+		return tombstoneEffect{Deferred: true}
+	}
+	defer s.maint.release()
+	eff := s.eraseBlock(target, t)
+	s.deleted(target, t, eff)
+	return eff
+}
+
+// eraseBlock deletes target's chunk and soft-deletes its key. Each step
+// tolerates an earlier run, so sweeps can repeat it.
+func (s *Server) eraseBlock(target Block, t Block) tombstoneEffect {
+	var eff tombstoneEffect
+	err := os.Remove(filepath.Join(s.paths.ChunksDir, target.Hash+".bin"))
+	eff.ChunkDeleted = err == nil || os.IsNotExist(err)
+	if !eff.ChunkDeleted {
+		log.Printf("[tombstone] %s: delete chunk: %v", target.Hash, err)
+	}
+	s.mu.Lock()
+	delete(s.kv, "blob-"+target.Hash+"-"+target.Name)
+	s.mu.Unlock()
+	escrowed, err := revokeFileKey(s.paths, target.Hash, target.Name)
+	eff.KeyRevoked = err == nil
+	if err != nil {
+		log.Printf("[tombstone] %s: revoke key: %v", target.Hash, err)
+	}
+	if escrowed && t.Tombstone.Revoke && target.OriginID == s.id.NodeID {
+		eff.Keysaver = s.revokeEscrowedKey(target.Hash)
+	}
+	return eff
+}
+
+// sweepTombstones erases the data of every deleted block whose chunk or
+// key is still here (deferred by maintenance, or a failed delete). Run by
+// the hourly retention tick, which holds the maintenance gate.
+func (s *Server) sweepTombstones() int {
+	blocks := s.readChain()
+	byHash := make(map[string]Block, len(blocks))
+	for _, b := range blocks {
+		byHash[b.Hash] = b
+	}
+	dir := filepath.Join(s.paths.BaseDir, "keys")
+	n := 0
+	for hash, t := range tombstonesIn(blocks) {
+		if !fileExists(filepath.Join(s.paths.ChunksDir, hash+".bin")) && !fileExists(filepath.Join(dir, fileKeyName(hash))) {
+			continue
+		}
+		s.deleted(byHash[hash], t, s.eraseBlock(byHash[hash], t))
+		n++
+	}
+	return n
+}
+
+// deleted logs and announces an applied tombstone.
+func (s *Server) deleted(target, t Block, eff tombstoneEffect) {
+	log.Printf("[tombstone] %s (%s) deleted by origin %.8s: chunk %v, key %v", target.Hash, target.Name, t.OriginID, eff.ChunkDeleted, eff.KeyRevoked)
+	s.emit(eventBlockDeleted, map[string]any{"hash": target.Hash, "name": target.Name, "origin": t.OriginID, "tombstone": t.Hash, "keysaver": eff.Keysaver})
+}
+
+// replicateTombstone is /replicate for tombstone envelopes: verify against
+// our chain, append, pass on, then delete the block's data here.
+func (s *Server) replicateTombstone(w http.ResponseWriter, env ReplicateEnvelope, localTip string) {
+	blk := Block{
+		Hash:      env.HashHex,
+		PrevHash:  env.PrevHash,
+		Created:   env.Created,
+		OriginID:  env.OriginID,
+		Logical:   env.Logical,
+		Kind:      env.Kind,
+		Tombstone: env.Tombstone,
+	}
+	if _, err := s.blockFor(env.HashHex); err != nil {
+		if err := checkTombstone(s.readChain(), blk, s.originSignKey(blk.OriginID)); err != nil {
+			http.Error(w, "bad tombstone: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if !s.replicateRecord(w, env, blk, localTip) {
+		return
+	}
+	target, err := s.blockFor(blk.Tombstone.Block)
+	if err != nil {
+		return
+	}
+	s.applyTombstone(target, blk)
+}
+
+// ---- control API ----
+
+// tombstoneResult is what deleting one block did.
+type tombstoneResult struct {
+	Hash      string          `json:"hash"`
+	Tombstone string          `json:"tombstone"`
+	Local     tombstoneEffect `json:"local"`
+	Fanout    fanoutResult    `json:"fanout"`
+}
+
+// deleteBlock tombstones data block b (ours), erases it here and fans the
+// tombstone out.
+func (s *Server) deleteBlock(b Block, reason string, revoke bool) (tombstoneResult, error) {
+	tb, env, err := s.appendTombstone(b, reason, revoke)
+	if err != nil {
+		return tombstoneResult{}, err
+	}
+	log.Printf("[audit] block %s (%s) deleted; tombstone %s", b.Hash, b.Name, tb.Hash)
+	res := tombstoneResult{Hash: b.Hash, Tombstone: tb.Hash, Local: s.applyTombstone(b, tb)}
+	envBytes, _ := json.Marshal(env)
+	t := s.transfers.start(transferSend, env.MsgID, blockTombstone, tb.Hash)
+	res.Fanout = s.fanoutWithQuorum(t, s.rankPeers(s.peers.List()), envBytes, nil, s.cfg.ReplicateQuorum)
+	return res, nil
+}
+
+// POST /chain/tombstone?hash=<sha256>|batch=<id>[&reason=...][&revoke_escrow=true]
+// (control, token): delete a block this node originated, or all of its
+// blocks in a batch (e.g. a load run's), everywhere.
+func (s *Server) handleTombstone(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	reason, revoke := q.Get("reason"), q.Get("revoke_escrow") == "true"
+	if batch := q.Get("batch"); batch != "" {
+		s.tombstoneBatch(w, batch, reason, revoke)
+		return
+	}
+	b, err := s.blockFor(q.Get("hash"))
+	if err != nil || !b.isData() {
+		http.Error(w, "no data block with that hash", http.StatusNotFound)
+		return
+	}
+	if b.OriginID != s.id.NodeID {
+		http.Error(w, "only the block's origin can delete it", http.StatusForbidden)
+		return
+	}
+	if t, ok := s.tombstoneFor(b.Hash); ok {
+		http.Error(w, "already deleted by tombstone "+t.Hash, http.StatusConflict)
+		return
+	}
+	res, err := s.deleteBlock(b, reason, revoke)
+	if err != nil {
+		http.Error(w, "tombstone: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, map[string]any{
+		"status":    "deleted",
+		"hash":      res.Hash,
+		"tombstone": res.Tombstone,
+		"local":     res.Local,
+		"fanout":    res.Fanout,
+	})
+}
+
+// tombstoneBatch deletes every live block of ours in batch.
+func (s *Server) tombstoneBatch(w http.ResponseWriter, batch, reason string, revoke bool) {
+	blocks := s.readChain()
+	deleted := tombstonesIn(blocks)
+	var todo []Block
+	for _, b := range blocks {
+		if _, gone := deleted[b.Hash]; !gone && b.isData() && b.Batch == batch && b.OriginID == s.id.NodeID {
+			todo = append(todo, b)
+		}
+	}
+	if len(todo) == 0 {
+		http.Error(w, "no live blocks of ours in that batch", http.StatusNotFound)
+		return
+	}
+	out := []tombstoneResult{}
+	var errs []string
+	for _, b := range todo {
+		res, err := s.deleteBlock(b, reason, revoke)
+		if err != nil {
+			errs = append(errs, b.Hash+": "+err.Error())
+			continue
+		}
+		out = append(out, res)
+	}
+	writeJSON(w, map[string]any{
+		"status":  "deleted",
+		"batch":   batch,
+		"deleted": out,
+		"errors":  errs,
+	})
+}
+
+// tombstoneView is one line of GET /chain/tombstones.
+type tombstoneView struct {
+	Tombstone  string   `json:"tombstone"`
+	Block      string   `json:"block"`
+	Name       string   `json:"name"`
+	Origin     string   `json:"origin"`
+	Reason     string   `json:"reason,omitempty"`
+	At         int64    `json:"at_unix"`
+	LocalChunk bool     `json:"local_chunk"`        // not applied here yet
+	HeldBy     []string `json:"held_by,omitempty"`  // peers that still serve the chunk
+	Pending    bool     `json:"pending"`            // the chunk still exists somewhere
+	Unprobed   bool     `json:"unprobed,omitempty"` // ?probe=false
+}
+
+// tombstoneReport lists the chain's tombstones; with probe, every peer is
+// asked (HEAD /chunk) whether it still holds each deleted chunk.
+func (s *Server) tombstoneReport(probe bool) []tombstoneView {
+	blocks := s.readChain()
+	byHash := make(map[string]Block, len(blocks))
+	for _, b := range blocks {
+		byHash[b.Hash] = b
+	}
+	var peers []PeerInfo
+	if probe {
+		for _, p := range s.peers.List() {
+			if p.NodeID != s.id.NodeID {
+				peers = append(peers, p)
+			}
+		}
+	}
+	out := []tombstoneView{}
+	for _, b := range blocks {
+		if !b.isTombstone() || b.Tombstone == nil {
+			continue
+		}
+		ts := b.Tombstone
+		v := tombstoneView{
+			Tombstone:  b.Hash,
+			Block:      ts.Block,
+			Name:       byHash[ts.Block].Name,
+			Origin:     b.OriginID,
+			Reason:     ts.Reason,
+			At:         ts.At,
+			LocalChunk: fileExists(filepath.Join(s.paths.ChunksDir, ts.Block+".bin")),
+			Unprobed:   !probe,
+		}
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		sem := make(chan struct{}, tombstoneProbes)
+		for _, p := range peers {
+			wg.Add(1)
+			go func(p PeerInfo) {
+				defer wg.Done()
+				defer recoverOnce("tombstones")
+				sem <- struct{}{}
+				defer func() { <-sem }()
+				if _, ok := s.peerHasChunk(p, ts.Block); ok {
+					mu.Lock()
+					v.HeldBy = append(v.HeldBy, p.NodeID)
+					mu.Unlock()
+				}
+			}(p)
+		}
+		wg.Wait()
+		v.Pending = v.LocalChunk || len(v.HeldBy) > 0
+		out = append(out, v)
+	}
+	return out
+}
+
+// GET /chain/tombstones[?probe=false][&pending=true] (control)
+func (s *Server) handleTombstones(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	rep := s.tombstoneReport(q.Get("probe") != "false")
+	if q.Get("pending") == "true" {
+		kept := rep[:0]
+		for _, v := range rep {
+			if v.Pending {
+				kept = append(kept, v)
+			}
+		}
+		rep = kept
+	}
+	writeJSON(w, rep)
+}
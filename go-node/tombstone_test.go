@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tombstoneSetup has a send a block that b holds; c is a third node b
+// knows, with its own pinned key.
+func tombstoneSetup(t *testing.T) (a, b, c *Server, target Block) {
+	a, b, c = newTestServer(t, "a", nil), newTestServer(t, "b", nil), newTestServer(t, "c", nil)
+	mesh(t, a, b, c)
+	hash := replicateOnce(t, a, b)
+	target, err := a.blockFor(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, b, c, target
+}
+
+// forge signs a tombstone for target with signer's receipt key while
+// claiming origin.
+func forge(t *testing.T, signer *Server, origin string, target Block, prev string) ReplicateEnvelope {
+	priv, err := receiptKey(signer.paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := &tombstone{Block: target.Hash, At: time.Now().Unix(), Signer: base64.StdEncoding.EncodeToString(priv.Public().(ed25519.PublicKey))}
+	ts.Sig = base64.StdEncoding.EncodeToString(ed25519.Sign(priv, ts.body(origin)))
+	return ReplicateEnvelope{MsgID: "forged-" + signer.id.Hostname, OriginID: origin, HashHex: ts.digest(origin), PrevHash: prev,
+		OrgID: "test", Created: ts.At, Kind: blockTombstone, Tombstone: ts}
+}
+
+func postReplicate(t *testing.T, to *Server, env ReplicateEnvelope) (int, string) {
+	body, _ := json.Marshal(env)
+	resp, err := http.Post("http://"+to.selfAddr+"/v1/replicate", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var msg bytes.Buffer
+	msg.ReadFrom(resp.Body)
+	return resp.StatusCode, msg.String()
+}
+
+func TestTombstoneForgedSigner(t *testing.T) {
+	a, b, c, target := tombstoneSetup(t)
+	code, msg := postReplicate(t, b, forge(t, c, a.id.NodeID, target, b.getChainTip()))
+	if code != http.StatusBadRequest || !strings.Contains(msg, "not the origin's key") {
+		t.Fatalf("c forging a's tombstone: HTTP %d %s", code, msg)
+	}
+	if _, ok := b.haveChunk(target.Hash); !ok {
+		t.Fatal("forged tombstone deleted the chunk")
+	}
+}
+
+// Before the fix the first signer an origin showed was trusted, so an
+// origin b never heard a beacon from could be impersonated outright.
+func TestTombstoneUnpinnedOrigin(t *testing.T) {
+	a, b, _, target := tombstoneSetup(t)
+	b.peers.mu.Lock()
+	p := b.peers.peers[a.id.NodeID]
+	p.SignKey = nil
+	b.peers.peers[a.id.NodeID] = p
+	b.peers.mu.Unlock()
+	code, msg := postReplicate(t, b, forge(t, a, a.id.NodeID, target, b.getChainTip()))
+	if code != http.StatusBadRequest || !strings.Contains(msg, "no signing key pinned") {
+		t.Fatalf("unpinned origin: HTTP %d %s", code, msg)
+	}
+}
+
+func TestTombstoneFromOrigin(t *testing.T) {
+	a, b, _, target := tombstoneSetup(t)
+	_, env, err := a.appendTombstone(target, "test", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, msg := postReplicate(t, b, env); code != http.StatusOK {
+		t.Fatalf("HTTP %d %s", code, msg)
+	}
+	if _, ok := b.haveChunk(target.Hash); ok {
+		t.Fatal("chunk still held after the origin's tombstone")
+	}
+	if _, ok := b.tombstoneFor(target.Hash); !ok {
+		t.Fatal("tombstone not in b's chain")
+	}
+}
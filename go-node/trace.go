@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Trace stages recorded per MsgID.
+const (
+	traceInject          = "inject"
+	traceRelayIn         = "relay-in"
+	traceRelayForward    = "relay-forward"
+	traceFinalStore      = "final-store"
+	traceReplicateAccept = "replicate-accept"
+	traceFanout          = "fanout"
+)
+
+const (
+	traceMaxMsgs      = 1024 // distinct MsgIDs kept
+	traceMaxEvents    = 64   // events kept per MsgID
+	traceHeader       = "X-Trace"
+	defaultTraceKeep  = 30 * time.Minute
+	traceCollectLimit = 256 << 10
+)
+
+// TraceEvent is one hop's view of a message.
+type TraceEvent struct {
+	MsgID  string `json:"msgid"`
+	NodeID string `json:"node_id"`
+	Stage  string `json:"stage"`
+	Detail string `json:"detail,omitempty"`
+	TS     int64  `json:"ts_unix_ms"`
+}
+
+type traceEntry struct {
+	events  []TraceEvent
+	updated time.Time
+}
+
+// traceStore is a bounded, time-expiring map of MsgID -> events.
+type traceStore struct {
+	mu        sync.Mutex
+	retention time.Duration
+	entries   map[string]*traceEntry
+}
+
+func newTraceStore(retention time.Duration) *traceStore {
+	if retention <= 0 {
+		retention = defaultTraceKeep
+	}
+	return &traceStore{retention: retention, entries: make(map[string]*traceEntry)}
+}
+
+// add appends events, pruning expired entries and evicting the stalest
+// MsgID when the store is full.
+func (t *traceStore) add(evs ...TraceEvent) {
+	if len(evs) == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	t.pruneLocked(now)
+	for _, ev := range evs {
+		if ev.MsgID == "" {
+			continue
+		}
+		e, ok := t.entries[ev.MsgID]
+		if !ok {
+			if len(t.entries) >= traceMaxMsgs {
+				t.evictOldestLocked()
+			}
+			e = &traceEntry{}
+			t.entries[ev.MsgID] = e
+		}
+		if len(e.events) < traceMaxEvents {
+			e.events = append(e.events, ev)
+		}
+		e.updated = now
+	}
+}
+
+// has reports whether we hold any trace for msgid (i.e. we touched it).
+func (t *traceStore) has(msgid string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.entries[msgid]
+	return ok
+}
+
+// get returns the events for msgid ordered by timestamp.
+func (t *traceStore) get(msgid string) []TraceEvent {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pruneLocked(time.Now())
+	e, ok := t.entries[msgid]
+	if !ok {
+		return nil
+	}
+	out := append([]TraceEvent(nil), e.events...)
+	sort.SliceStable(out, func(i, j int) bool { return out[i].TS < out[j].TS })
+	return out
+}
+
+func (t *traceStore) pruneLocked(now time.Time) {
+	for id, e := range t.entries {
+		if now.Sub(e.updated) > t.retention {
+			delete(t.entries, id)
+		}
+	}
+}
+
+func (t *traceStore) evictOldestLocked() {
+	var oldestID string
+	var oldest time.Time
+	for id, e := range t.entries {
+		if oldestID == "" || e.updated.Before(oldest) {
+			oldestID, oldest = id, e.updated
+		}
+	}
+	delete(t.entries, oldestID)
+}
+
+// trace records a local event for msgid and returns it so callers can also
+// report it back to the origin.
+func (s *Server) trace(msgid, stage, detail string) TraceEvent {
+	ev := TraceEvent{
+		MsgID:  msgid,
+		NodeID: s.id.NodeID,
+		Stage:  stage,
+		Detail: detail,
+		TS:     time.Now().UnixMilli(),
+	}
+	s.traces.add(ev)
+	return ev
+}
+
+// reportTrace POSTs events to the origin's /trace/collect (opt-in only).
+func (s *Server) reportTrace(originID string, evs ...TraceEvent) {
+	if originID == "" || originID == s.id.NodeID || len(evs) == 0 {
+		return
+	}
+	origin, ok := s.peers.Get(originID)
+	if !ok || origin.Addr == "" {
+		return
+	}
+	body, _ := json.Marshal(evs)
+	// best effort: dropped when the forward pool is full
+	s.fwdPool.submit(func() {
+		resp, _, err := s.postToPeer(origin, "/trace/collect", body, nil)
+		if err != nil {
+			log.Printf("[trace] report to %s fail: %v", originID[:8], err)
+			return
+		}
+		_ = resp.Body.Close()
+	})
+}
+
+// handleTraceCollect (public) accepts hop events for MsgIDs this node
+// originated; anything else is ignored so peers can't fill our store.
+func (s *Server) handleTraceCollect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	var evs []TraceEvent
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, traceCollectLimit)).Decode(&evs); err != nil {
+		http.Error(w, "bad trace events", http.StatusBadRequest)
+		return
+	}
+	accepted := 0
+	for _, ev := range evs {
+		if ev.MsgID == "" || !s.traces.has(ev.MsgID) {
+			continue
+		}
+		s.traces.add(ev)
+		accepted++
+	}
+	writeJSON(w, map[string]any{"status": "ok", "accepted": accepted})
+}
+
+// GET /trace?msgid=<id> (control)
+func (s *Server) handleTraceGet(w http.ResponseWriter, r *http.Request) {
+	msgid := r.URL.Query().Get("msgid")
+	if msgid == "" {
+		http.Error(w, "missing ?msgid=", http.StatusBadRequest)
+		return
+	}
+	evs := s.traces.get(msgid)
+	if evs == nil {
+		http.Error(w, "no trace for msgid", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, map[string]any{"msgid": msgid, "events": evs})
+}
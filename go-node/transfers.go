@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Transfers. Every send-file fanout, batch delivery and recovery runs under
+// an ID (the msgid for sends, the BatchID for batches) with a status record,
+// so a mistaken send or a long recovery can be stopped from the control
+// API. Cancelling a send stops the fanout before the next peer; with
+// ?abandon=true the peers that already acked get a notice and mark the
+// block abandoned: they keep the data but no longer forward it on
+// /replicate or repair it in the scrub. A cancelled recovery keeps the
+// files it already wrote and reports them.
+
+const (
+	transferSend    = "send"
+	transferRecover = "recover"
+	transferBatch   = "batch"
+
+	transferRunning   = "running"
+	transferDone      = "done"
+	transferCancelled = "cancelled"
+
+	transfersKeep = 200 // finished records kept for status queries
+	abandonFile   = "abandoned.json"
+)
+
+var errTransferNotRunning = errors.New("transfer is not running")
+
+type transfer struct {
+	ID       string       `json:"id"`
+	Kind     string       `json:"kind"`
+	State    string       `json:"state"`
+	Name     string       `json:"name,omitempty"`
+	Hash     string       `json:"hash,omitempty"`
+	Started  time.Time    `json:"started"`
+	Ended    time.Time    `json:"ended,omitempty"`
+	Peers    int          `json:"peers,omitempty"`
+	Tried    int          `json:"tried,omitempty"`
+	Acked    int          `json:"acked,omitempty"`
+	Abandon  bool         `json:"abandon,omitempty"`  // notices requested on cancel
+	Notified int          `json:"notified,omitempty"` // peers that accepted the notice
+	Plan     *recoverPlan `json:"plan,omitempty"`     // recoveries: results so far
+
+	ctx      context.Context
+	cancel   context.CancelFunc
+	acked    []PeerInfo    // sends: peers holding the envelope
+	progress *sendProgress // send-file?progress=chunked: told each delivery
+}
+
+type transferStore struct {
+	mu   sync.Mutex
+	m    map[string]*transfer
+	done []string // finished IDs, oldest first
+}
+
+func newTransferStore() *transferStore {
+	return &transferStore{m: make(map[string]*transfer)}
+}
+
+func (ts *transferStore) start(kind, id, name, hash string) *transfer {
+	ctx, cancel := context.WithCancel(context.Background())
+	t := &transfer{ID: id, Kind: kind, State: transferRunning, Name: name, Hash: hash, Started: time.Now().UTC(), ctx: ctx, cancel: cancel}
+	ts.mu.Lock()
+	ts.m[id] = t
+	ts.mu.Unlock()
+	return t
+}
+
+// finish marks t done unless it was cancelled, and ages out old records.
+func (ts *transferStore) finish(t *transfer) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if t.State == transferRunning {
+		t.State = transferDone
+		t.Ended = time.Now().UTC()
+	}
+	ts.done = append(ts.done, t.ID)
+	for len(ts.done) > transfersKeep {
+		delete(ts.m, ts.done[0])
+		ts.done = ts.done[1:]
+	}
+}
+
+// update runs fn on t under the store lock.
+func (ts *transferStore) update(t *transfer, fn func(*transfer)) {
+	ts.mu.Lock()
+	fn(t)
+	ts.mu.Unlock()
+}
+
+func (ts *transferStore) get(id string) (transfer, bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	t, ok := ts.m[id]
+	if !ok {
+		return transfer{}, false
+	}
+	return *t, true
+}
+
+// list returns running transfers first, then the rest newest first.
+func (ts *transferStore) list() []transfer {
+	ts.mu.Lock()
+	out := make([]transfer, 0, len(ts.m))
+	for _, t := range ts.m {
+		out = append(out, *t)
+	}
+	ts.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool {
+		if ri, rj := out[i].State == transferRunning, out[j].State == transferRunning; ri != rj {
+			return ri
+		}
+		return out[i].Started.After(out[j].Started)
+	})
+	return out
+}
+
+// cancelTransfer stops transfer id. For sends with abandon set, it returns
+// the peers that already hold the envelope; ones that ack later are
+// notified by the fanout itself.
+func (ts *transferStore) cancelTransfer(id, kind string, abandon bool) (*transfer, []PeerInfo, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	t, ok := ts.m[id]
+	if !ok || (kind != "" && t.Kind != kind) {
+		return nil, nil, os.ErrNotExist
+	}
+	if t.State != transferRunning {
+		return t, nil, errTransferNotRunning
+	}
+	t.State = transferCancelled
+	t.Ended = time.Now().UTC()
+	t.cancel()
+	if abandon && t.Kind == transferSend {
+		t.Abandon = true
+		return t, append([]PeerInfo(nil), t.acked...), nil
+	}
+	return t, nil, nil
+}
+
+// ackedBy records that p holds the envelope; true if p must be told the
+// block was abandoned (the transfer was cancelled while p was in flight).
+func (ts *transferStore) ackedBy(t *transfer, p PeerInfo) bool {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	t.Acked++
+	t.acked = append(t.acked, p)
+	return t.Abandon
+}
+
+// newRecoverID names a recovery transfer.
+func newRecoverID() string {
+	b, err := secureRandom(9)
+	if err != nil {
+		return fmt.Sprintf("rec-%d", time.Now().UnixNano())
+	}
+	return "rec-" + base64.RawURLEncoding.EncodeToString(b)
+}
+
+// ---- abandon notices ----
+
+// abandonNotice is POSTed to /replicate/abandon on peers that acked a
+// cancelled send.
+type abandonNotice struct {
+	MsgID    string `json:"msgid"`
+	Hash     string `json:"hash"`
+	OriginID string `json:"origin_id"`
+	OrgID    string `json:"org_id,omitempty"`
+}
+
+// notifyAbandon tells peers the block of t is abandoned; returns how many
+// accepted.
+func (s *Server) notifyAbandon(t *transfer, peers []PeerInfo) int {
+	body, _ := json.Marshal(abandonNotice{MsgID: t.ID, Hash: t.Hash, OriginID: s.id.NodeID, OrgID: s.org.ID})
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	n := 0
+	for _, p := range peers {
+		wg.Add(1)
+		go func(p PeerInfo) {
+			defer wg.Done()
+			defer recoverOnce("abandon")
+			resp, _, err := s.postToPeer(p, "/replicate/abandon", body, nil)
+			if err != nil {
+				log.Printf("[transfer] abandon %s to %.8s: %v", t.ID, p.NodeID, err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode/100 != 2 {
+				log.Printf("[transfer] abandon %s to %.8s: HTTP %d", t.ID, p.NodeID, resp.StatusCode)
+				return
+			}
+			mu.Lock()
+			n++
+			mu.Unlock()
+		}(p)
+	}
+	wg.Wait()
+	s.transfers.update(t, func(t *transfer) { t.Notified += n })
+	return n
+}
+
+// abandonedSet holds the hashes whose origin abandoned them, persisted in
+// abandoned.json (hash -> unix time of the notice).
+type abandonedSet struct {
+	path string
+
+	mu sync.Mutex
+	m  map[string]int64
+}
+
+func newAbandonedSet(paths *EnvPaths) *abandonedSet {
+	a := &abandonedSet{path: filepath.Join(paths.BaseDir, abandonFile), m: make(map[string]int64)}
+	if b, err := os.ReadFile(a.path); err == nil {
+		if err := json.Unmarshal(b, &a.m); err != nil {
+			log.Printf("[transfer] ignoring bad %s: %v", a.path, err)
+			a.m = make(map[string]int64)
+		}
+	}
+	return a
+}
+
+func (a *abandonedSet) has(hash string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, ok := a.m[hash]
+	return ok
+}
+
+func (a *abandonedSet) add(hash string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.m[hash]; ok {
+		return nil
+	}
+	a.m[hash] = time.Now().Unix()
+	b, _ := json.Marshal(a.m)
+	return writeFileAtomic(a.path, b)
+}
+
+// POST /replicate/abandon (public): the origin of a block we hold cancelled
+// its send. Only the block's origin may abandon it.
+func (s *Server) handleAbandon(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	var n abandonNotice
+	if err := json.NewDecoder(r.Body).Decode(&n); err != nil || n.Hash == "" {
+		http.Error(w, "bad notice", http.StatusBadRequest)
+		return
+	}
+	if n.OrgID == "" && s.refuseLegacy(w, legacyUntaggedOrg) {
+		return
+	}
+	if !s.org.accept(n.OrgID, &s.org.foreignReplicates) {
+		http.Error(w, "foreign org", http.StatusForbidden)
+		return
+	}
+	blk, err := s.blockFor(n.Hash)
+	if err != nil {
+		http.Error(w, "unknown block", http.StatusNotFound)
+		return
+	}
+	if blk.OriginID != n.OriginID {
+		http.Error(w, "not the block's origin", http.StatusForbidden)
+		return
+	}
+	if err := s.abandoned.add(n.Hash); err != nil {
+		http.Error(w, "persist: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("[transfer] %s abandoned by origin %.8s", n.Hash, n.OriginID)
+	writeJSON(w, map[string]any{"status": "abandoned", "hash": n.Hash})
+}
+
+// ---- control API ----
+
+// GET /transfers (control): running transfers, then recent ones.
+func (s *Server) handleTransfers(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.transfers.list())
+}
+
+// GET /transfers/{id}, GET /recover/{id} (control): one status record.
+func (s *Server) handleTransferGet(kind string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "use GET", http.StatusMethodNotAllowed)
+			return
+		}
+		t, ok := s.transfers.get(r.PathValue("id"))
+		if !ok || (kind != "" && t.Kind != kind) {
+			http.Error(w, "no such transfer", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, t)
+	}
+}
+
+// POST /transfers/{id}/cancel[?abandon=true], POST /recover/{id}/cancel
+// (control). A cancelled send keeps what peers already stored; abandon
+// also asks them not to spread it further.
+func (s *Server) handleTransferCancel(kind string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		id := r.PathValue("id")
+		t, notify, err := s.transfers.cancelTransfer(id, kind, r.URL.Query().Get("abandon") == "true")
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			http.Error(w, "no such transfer", http.StatusNotFound)
+			return
+		case errors.Is(err, errTransferNotRunning):
+			http.Error(w, "transfer already "+t.State, http.StatusConflict)
+			return
+		}
+		log.Printf("[transfer] %s %s cancelled", t.Kind, id)
+		if len(notify) > 0 {
+			s.notifyAbandon(t, notify)
+		}
+		out, _ := s.transfers.get(id)
+		writeJSON(w, out)
+	}
+}
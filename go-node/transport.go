@@ -0,0 +1,244 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Per-peer transport memory. Every outbound peer call (replicate fanout,
+// relay forward, chunk/blob pulls, command and trace reports) gets its
+// client and URL from peerDo, which tries the peer's transports best-first,
+// falls through on failure and records the outcome. Scores decay, so a
+// transport that failed an hour ago gets tried again. A peer whose
+// advertised capabilities change starts from a clean record.
+//
+// Plain HTTP is the only transport the node speaks today; the selector is
+// where TLS or a libp2p-relayed transport plug in (peerTransport), keyed by
+// the capability that advertises them.
+
+const (
+	transportHTTP = "http"
+
+	transportHalfLife = 10 * time.Minute
+)
+
+// peerTransport is one way of reaching a peer's HTTP API.
+type peerTransport interface {
+	Name() string
+	// Supports reports whether p can be reached this way (e.g. by its caps).
+	Supports(p PeerInfo) bool
+	// BaseURLs lists "scheme://host:port" per address, best first.
+	BaseURLs(p PeerInfo) []string
+	RoundTripper() http.RoundTripper
+}
+
+type plainHTTP struct{}
+
+func (plainHTTP) Name() string             { return transportHTTP }
+func (plainHTTP) Supports(p PeerInfo) bool { return len(p.addrList()) > 0 }
+func (plainHTTP) BaseURLs(p PeerInfo) []string {
+	addrs := p.addrList()
+	out := make([]string, len(addrs))
+	for i, a := range addrs {
+		out[i] = "http://" + a
+	}
+	return out
+}
+func (plainHTTP) RoundTripper() http.RoundTripper { return lanTransport }
+
+// transportStat is the decayed success/failure record of one transport to
+// one peer.
+type transportStat struct {
+	OK       float64   `json:"ok"`
+	Fail     float64   `json:"fail"`
+	LastOK   time.Time `json:"last_ok,omitempty"`
+	LastFail time.Time `json:"last_fail,omitempty"`
+	LastErr  string    `json:"last_error,omitempty"`
+	at       time.Time // when OK/Fail were last decayed
+}
+
+func (st *transportStat) decay(now time.Time) {
+	if !st.at.IsZero() {
+		f := math.Pow(0.5, float64(now.Sub(st.at))/float64(transportHalfLife))
+		st.OK *= f
+		st.Fail *= f
+	}
+	st.at = now
+}
+
+// score is the smoothed success rate; an unknown transport scores 0.5.
+func (st transportStat) score() float64 {
+	return (st.OK + 1) / (st.OK + st.Fail + 2)
+}
+
+type peerTransports struct {
+	caps  string // advertised caps the record was built under
+	stats map[string]*transportStat
+}
+
+type transportSelector struct {
+	transports []peerTransport // preference order on equal scores
+
+	mu    sync.Mutex
+	peers map[string]*peerTransports
+}
+
+func newTransportSelector(ts ...peerTransport) *transportSelector {
+	return &transportSelector{transports: ts, peers: make(map[string]*peerTransports)}
+}
+
+// entryLocked returns p's record, resetting it if p's caps changed.
+func (sel *transportSelector) entryLocked(p PeerInfo) *peerTransports {
+	caps := strings.Join(p.Caps, ",")
+	e := sel.peers[p.NodeID]
+	if e == nil || e.caps != caps {
+		e = &peerTransports{caps: caps, stats: make(map[string]*transportStat)}
+		sel.peers[p.NodeID] = e
+	}
+	return e
+}
+
+// order returns the transports p supports, best score first.
+func (sel *transportSelector) order(p PeerInfo) []peerTransport {
+	var out []peerTransport
+	for _, t := range sel.transports {
+		if t.Supports(p) {
+			out = append(out, t)
+		}
+	}
+	if p.NodeID == "" {
+		return out // bare address (no peer record): nothing to remember
+	}
+	sel.mu.Lock()
+	e := sel.entryLocked(p)
+	now := time.Now()
+	scores := make(map[string]float64, len(out))
+	for _, t := range out {
+		st := e.stats[t.Name()]
+		if st == nil {
+			scores[t.Name()] = transportStat{}.score()
+			continue
+		}
+		st.decay(now)
+		scores[t.Name()] = st.score()
+	}
+	sel.mu.Unlock()
+	sort.SliceStable(out, func(i, j int) bool { return scores[out[i].Name()] > scores[out[j].Name()] })
+	return out
+}
+
+func (sel *transportSelector) record(p PeerInfo, transport string, err error) {
+	if p.NodeID == "" {
+		return
+	}
+	sel.mu.Lock()
+	defer sel.mu.Unlock()
+	e := sel.entryLocked(p)
+	st := e.stats[transport]
+	if st == nil {
+		st = &transportStat{}
+		e.stats[transport] = st
+	}
+	now := time.Now()
+	st.decay(now)
+	if err == nil {
+		st.OK++
+		st.LastOK = now
+		return
+	}
+	st.Fail++
+	st.LastFail = now
+	st.LastErr = err.Error()
+}
+
+// peerDo sends the request mk builds for a base URL to p, trying each
+// supported transport and each of its addresses until one answers. A
+// timeout of 0 means none. Returns the response and the address
+// ("host:port") that answered.
+func (s *Server) peerDo(p PeerInfo, timeout time.Duration, mk func(baseURL string) (*http.Request, error)) (*http.Response, string, error) {
+	transports := s.transports.order(p)
+	if len(transports) == 0 {
+		return nil, "", errors.New("peer has no address")
+	}
+	var lastErr error
+	for _, t := range transports {
+		client := &http.Client{Transport: s.egress.wrap("peer", t.RoundTripper()), Timeout: timeout}
+		var terr error
+		for _, base := range t.BaseURLs(p) {
+			addr := base[strings.Index(base, "://")+3:]
+			req, err := mk(base)
+			if err != nil {
+				return nil, "", err
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				if p.NodeID != "" {
+					s.peers.MarkAddr(p.NodeID, addr, false)
+				}
+				terr = err
+				continue
+			}
+			if p.NodeID != "" {
+				s.peers.MarkAddr(p.NodeID, addr, true)
+			}
+			s.transports.record(p, t.Name(), nil)
+			return resp, addr, nil
+		}
+		if terr != nil {
+			s.transports.record(p, t.Name(), terr)
+			lastErr = terr
+		}
+	}
+	if lastErr == nil {
+		lastErr = errors.New("peer has no address")
+	}
+	return nil, "", lastErr
+}
+
+// getFromPeer GETs path (already versioned, with query) from p.
+func (s *Server) getFromPeer(p PeerInfo, method, path string, timeout time.Duration) (*http.Response, string, error) {
+	return s.peerDo(p, timeout, func(base string) (*http.Request, error) {
+		return http.NewRequest(method, base+path, nil)
+	})
+}
+
+// readPeerBody reads at most limit bytes of a peer response and closes it.
+func readPeerBody(resp *http.Response, limit int64) ([]byte, error) {
+	defer resp.Body.Close()
+	return io.ReadAll(io.LimitReader(resp.Body, limit))
+}
+
+type transportView struct {
+	Transport string  `json:"transport"`
+	Score     float64 `json:"score"`
+	transportStat
+}
+
+// GET /peers/transports (control): per-peer transport records.
+func (s *Server) handlePeerTransports(w http.ResponseWriter, r *http.Request) {
+	sel := s.transports
+	sel.mu.Lock()
+	out := make(map[string]any, len(sel.peers))
+	now := time.Now()
+	for id, e := range sel.peers {
+		views := make([]transportView, 0, len(e.stats))
+		for name, st := range e.stats {
+			st.decay(now)
+			views = append(views, transportView{Transport: name, Score: st.score(), transportStat: *st})
+		}
+		sort.Slice(views, func(i, j int) bool { return views[i].Score > views[j].Score })
+		out[id] = map[string]any{"caps": e.caps, "transports": views}
+	}
+	sel.mu.Unlock()
+	names := make([]string, len(sel.transports))
+	for i, t := range sel.transports {
+		names[i] = t.Name()
+	}
+	writeJSON(w, map[string]any{"available": names, "peers": out})
+}
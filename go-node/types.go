@@ -6,11 +6,15 @@ import (
 	"encoding/json"
 )
 
+// Chat and file-transfer messages on libp2p streams. Signatures cover
+// body(), which doesn't depend on the JSON names; legacy names are accepted
+// on decode (wire.go).
+
 type ChatMsg struct {
 	Text      string `json:"text"`
-	PeerID    string `json:"peerId"`
-	PubB64    string `json:"pubKey"`
-	SigB64    string `json:"sig"`
+	PeerID    string `json:"peer_id"`
+	PubB64    string `json:"pubkey"`
+	SigB64    string `json:"sig_b64"`
 	Timestamp int64  `json:"ts"`
 }
 
@@ -25,18 +29,19 @@ func (m *ChatMsg) body() []byte {
 
 type FileManifest struct {
 	ID            string `json:"id"`
-	FileName      string `json:"fileName"`
+	FileName      string `json:"file_name"`
 	Size          int64  `json:"size"`
-	ChunkSize     int    `json:"chunkSize"`
+	ChunkSize     int    `json:"chunk_size"`
 	Chunks        int    `json:"chunks"`
-	PlainSHA256   string `json:"plainSha256"`
-	CipherSHA256  string `json:"cipherSha256"`
-	WrappedKeyB64 string `json:"wrappedKey"`
-	WrapNonceB64  string `json:"wrapNonce"`
-	PeerID        string `json:"peerId"`
-	PubB64        string `json:"pubKey"`
-	SigB64        string `json:"sig"`
+	PlainSHA256   string `json:"plain_sha256"`
+	CipherSHA256  string `json:"cipher_sha256"`
+	WrappedKeyB64 string `json:"wrapped_key_b64"`
+	WrapNonceB64  string `json:"wrap_nonce_b64"`
+	PeerID        string `json:"peer_id"`
+	PubB64        string `json:"pubkey"`
+	SigB64        string `json:"sig_b64"`
 	Timestamp     int64  `json:"ts"`
+	OrgMAC        string `json:"org_mac,omitempty"` // the sender's network (p2p_org.go)
 }
 
 func (m *FileManifest) body() []byte {
@@ -59,12 +64,12 @@ func (m *FileManifest) computeID() string {
 }
 
 type FileChunk struct {
-	ManifestID string `json:"mid"`
-	Index      int    `json:"idx"`
-	NonceB64   string `json:"nonce"`
-	DataB64    string `json:"data"` // ciphertext
-	PeerID     string `json:"peerId"`
-	SigB64     string `json:"sig"`
+	ManifestID string `json:"manifest_id"`
+	Index      int    `json:"index"`
+	NonceB64   string `json:"nonce_b64"`
+	DataB64    string `json:"data_b64"` // ciphertext
+	PeerID     string `json:"peer_id"`
+	SigB64     string `json:"sig_b64"`
 }
 
 func (c *FileChunk) body() []byte {
@@ -0,0 +1,31 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+func init() { registerFeature(featureDashboard) }
+
+// GET /ui: a single-page dashboard built into the binary. The page itself
+// carries no node data; it asks for the control token, keeps it in
+// sessionStorage and sends it as a Bearer token on every call it makes to
+// the existing JSON endpoints and the /events stream.
+
+//go:embed ui/index.html
+var uiIndex []byte
+
+func (s *Server) handleUI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "GET only", http.StatusMethodNotAllowed)
+		return
+	}
+	h := w.Header()
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	h.Set("Cache-Control", "no-store")
+	h.Set("Content-Security-Policy", "default-src 'none'; script-src 'unsafe-inline'; style-src 'unsafe-inline'; connect-src 'self'; form-action 'none'; frame-ancestors 'none'; base-uri 'none'")
+	h.Set("X-Frame-Options", "DENY")
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Referrer-Policy", "no-referrer")
+	w.Write(uiIndex)
+}
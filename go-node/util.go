@@ -1,28 +1,194 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
 	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
+// execTimeout bounds runExec: a hung WMI or ioreg call is killed rather
+// than holding up whoever asked.
+const execTimeout = 5 * time.Second
+
+// runExec runs name and returns its stdout.
+func runExec(name string, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), execTimeout)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			err = fmt.Errorf("%s: timed out after %v", name, execTimeout)
+		}
+		return "", fmt.Errorf("%v: %s", err, stderr.String())
+	}
+	return stdout.String(), nil
+}
+
 func mustDecodeB64(s string) []byte {
 	b, _ := base64.StdEncoding.DecodeString(s)
 	return b
 }
 
+// slashLike maps backslashes and the characters that render as a slash to
+// '/', so "..∕..∕x" or "..\x" can't slip past a ".." check.
+var slashLike = strings.NewReplacer(
+	`\`, "/",
+	"⁄", "/", // fraction slash
+	"∕", "/", // division slash
+	"∖", "/", // set minus
+	"⧸", "/", // big solidus
+	"⧹", "/", // big reverse solidus
+	"／", "/", // fullwidth solidus
+	"＼", "/", // fullwidth reverse solidus
+)
+
+// sanitize flattens s into a single file name element: separators (and
+// look-alikes) and ':' become '-'. Pass the result through safeJoin.
 func sanitize(s string) string {
 	return strings.Map(func(r rune) rune {
-		if r == '/' || r == '\\' {
+		if r == '/' || r == ':' {
 			return '-'
 		}
 		return r
-	}, s)
+	}, slashLike.Replace(s))
 }
 
 func trim(s string) string { return strings.TrimSpace(s) }
 
-func tempUploadPath(name string) string {
-	return filepath.Join(os.TempDir(), "up__"+sanitize(name))
+// jitter shortens a retry delay by a random amount of up to a quarter, so
+// nodes that failed together (a shared outage) don't retry in lockstep. It
+// never lengthens d, so the callers' caps still hold.
+func jitter(d time.Duration) time.Duration {
+	span := int64(d / 4)
+	if span <= 0 {
+		return d
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(span+1))
+	if err != nil {
+		return d
+	}
+	return d - time.Duration(n.Int64())
+}
+
+func tempUploadPath(dir, name string) (string, error) {
+	return safeJoin(dir, "up__"+sanitize(name))
+}
+
+const (
+	maxNameBytes = 255  // per element, what most filesystems allow
+	maxPathBytes = 1024 // whole relative path
+)
+
+var errUnsafePath = errors.New("unsafe path")
+
+// cleanRelPath checks a relative path that came from a caller, a peer or a
+// chain block and returns it cleaned and slash-separated. It rejects
+// absolute paths, drive letters and stream names (any ':'), ".." elements,
+// control characters and over-long names; elements Windows would read as a
+// device (CON, NUL, COM1, ...) get a '_' prefix and trailing dots and
+// spaces, which Windows drops, are trimmed.
+func cleanRelPath(p string) (string, error) {
+	if len(p) > maxPathBytes {
+		return "", fmt.Errorf("%w: longer than %d bytes", errUnsafePath, maxPathBytes)
+	}
+	p = slashLike.Replace(p)
+	switch {
+	case strings.HasPrefix(p, "/"):
+		return "", fmt.Errorf("%w: absolute path", errUnsafePath)
+	case strings.Contains(p, ":"):
+		return "", fmt.Errorf("%w: drive letter or stream name", errUnsafePath)
+	}
+	var parts []string
+	for _, el := range strings.Split(p, "/") {
+		t := strings.TrimRight(el, ". ")
+		if t == "" {
+			if strings.Contains(el, "..") {
+				return "", fmt.Errorf("%w: %q leaves the directory", errUnsafePath, el)
+			}
+			continue // "", "." and blanks
+		}
+		if strings.IndexFunc(t, func(r rune) bool { return r < 0x20 || r == 0x7f }) >= 0 {
+			return "", fmt.Errorf("%w: control character", errUnsafePath)
+		}
+		if len(t) > maxNameBytes {
+			return "", fmt.Errorf("%w: name longer than %d bytes", errUnsafePath, maxNameBytes)
+		}
+		if windowsReserved(t) {
+			t = "_" + t
+		}
+		parts = append(parts, t)
+	}
+	if len(parts) == 0 {
+		return "", fmt.Errorf("%w: empty name", errUnsafePath)
+	}
+	return strings.Join(parts, "/"), nil
+}
+
+// windowsReserved reports whether name is a DOS device name, with or
+// without an extension ("nul", "COM1.txt").
+func windowsReserved(name string) bool {
+	stem, _, _ := strings.Cut(name, ".")
+	stem = strings.ToUpper(strings.TrimRight(stem, " "))
+	switch stem {
+	case "CON", "PRN", "AUX", "NUL", "CONIN$", "CONOUT$":
+		return true
+	}
+	if len(stem) == 4 && (strings.HasPrefix(stem, "COM") || strings.HasPrefix(stem, "LPT")) {
+		return stem[3] >= '1' && stem[3] <= '9'
+	}
+	return false
+}
+
+// safeJoin joins userPath under baseDir after cleanRelPath; the result is
+// always inside baseDir, also once symlinks already under baseDir are
+// followed. Every file name that doesn't come from this node goes through
+// it before anything is written.
+func safeJoin(baseDir, userPath string) (string, error) {
+	rel, err := cleanRelPath(userPath)
+	if err != nil {
+		return "", err
+	}
+	out := filepath.Join(baseDir, filepath.FromSlash(rel))
+	if !within(baseDir, out) || !resolvesInside(baseDir, out) {
+		return "", fmt.Errorf("%w: outside %s", errUnsafePath, baseDir)
+	}
+	return out, nil
+}
+
+func within(dir, p string) bool {
+	r, err := filepath.Rel(dir, p)
+	return err == nil && r != ".." && !strings.HasPrefix(r, ".."+string(filepath.Separator))
+}
+
+// resolvesInside follows the longest existing prefix of out, which is
+// lexically under baseDir, and reports whether it still lands there. A
+// dangling symlink on the way counts as leaving.
+func resolvesInside(baseDir, out string) bool {
+	base, err := filepath.EvalSymlinks(baseDir)
+	if err != nil {
+		return true // baseDir doesn't exist yet, so holds no links
+	}
+	for p := out; ; {
+		if _, err := os.Lstat(p); err == nil {
+			r, err := filepath.EvalSymlinks(p)
+			return err == nil && within(base, r)
+		}
+		parent := filepath.Dir(p)
+		if parent == p {
+			return true
+		}
+		p = parent
+	}
 }
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSafeJoinRejects(t *testing.T) {
+	base := t.TempDir()
+	for _, p := range []string{
+		"..", "../x", "a/../../x", "a/../..", "..\\x", "a/..\\..\\x", ".. /x",
+		"/etc/passwd", "\\server\\share", "//x", "C:\\x", "c:x", "a:stream",
+		"", ".", "./", "a\x00b", "a\nb",
+		"..∕..∕x", "..⁄x", "..∖x", "..⧸x", "..⧹x", "..／x", "..＼x", "／etc／passwd",
+	} {
+		if out, err := safeJoin(base, p); !errors.Is(err, errUnsafePath) {
+			t.Errorf("%q: got %q, %v", p, out, err)
+		}
+	}
+}
+
+func TestSafeJoinAccepts(t *testing.T) {
+	base := t.TempDir()
+	for p, want := range map[string]string{
+		"a.txt":       "a.txt",
+		"d/e/f.txt":   "d/e/f.txt",
+		"./a//b":      "a/b",
+		"a\\b":        "a/b",
+		"nul.txt":     "_nul.txt",
+		"dir/COM1":    "dir/_COM1",
+		"trailing. .": "trailing",
+		"a/./b/":      "a/b",
+		"x..y":        "x..y",
+	} {
+		out, err := safeJoin(base, p)
+		if err != nil || out != filepath.Join(base, filepath.FromSlash(want)) {
+			t.Errorf("%q: got %q, %v; want %q", p, out, err, want)
+		}
+	}
+}
+
+// jitter stays within the last quarter below d and actually varies.
+func TestJitterBounded(t *testing.T) {
+	const d = 10 * time.Second
+	seen := map[time.Duration]bool{}
+	for range 1000 {
+		j := jitter(d)
+		if j < d*3/4 || j > d {
+			t.Fatalf("jitter(%v) = %v", d, j)
+		}
+		seen[j] = true
+	}
+	if len(seen) < 100 {
+		t.Fatalf("only %d distinct delays", len(seen))
+	}
+	if j := jitter(3 * time.Nanosecond); j != 3*time.Nanosecond {
+		t.Fatalf("jitter(3ns) = %v", j)
+	}
+}
+
+// Every call site that turns a name from a peer, a chain block or a caller
+// into a path keeps it under its directory, also when the name is spelled
+// with characters that only look like slashes. Sites that flatten the name
+// put it directly in the directory.
+func TestSafeJoinCallSites(t *testing.T) {
+	hostile := []string{
+		"../x", "..\\x", "a/../../x", "/etc/passwd", "C:\\x", "..", "d/x", "d\\x",
+		"..∕..∕x", "..⁄x", "..∖x", "..⧸x", "..⧹x", "..／x", "..＼x", "／etc／passwd", "d∕x",
+	}
+	base := t.TempDir()
+	s := newTestServer(t, "a", nil)
+	k := make([]byte, 32)
+	ct, err := aeadSealWithKey(k, []byte("plain"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := strings.Repeat("ab", 32)
+	if err := os.MkdirAll(s.paths.ChunksDir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(s.paths.ChunksDir, hash+".bin"), ct, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, site := range []struct {
+		name string
+		dir  string
+		flat bool
+		path func(name string) (string, error)
+	}{
+		{"upload", base, true, func(n string) (string, error) { return tempUploadPath(base, n) }},
+		{"libp2p parts", base, true, func(n string) (string, error) { return partsDir(base, n) }},
+		{"libp2p file", base, true, func(n string) (string, error) {
+			return assembledPath(base, FileManifest{ID: n, FileName: n})
+		}},
+		{"quarantine release", base, true, func(n string) (string, error) {
+			return releasedPath(base, QuarantineItem{ID: quarantineID(n), Name: storedName(n)})
+		}},
+		{"recover", base, true, func(n string) (string, error) { return recoverTarget(base, n, false) }},
+		{"recover batch", base, false, func(n string) (string, error) { return recoverTarget(base, n, true) }},
+		{"key import", base, true, func(n string) (string, error) {
+			_, err := s.importFileKey(base, keyArchiveRecord{File: n, KeyB64: base64.RawURLEncoding.EncodeToString(k)})
+			return "", err
+		}},
+		{"decrypt out", s.paths.ChunksDir, false, func(n string) (string, error) {
+			q := url.Values{"hash": {hash}, "keyB64": {base64.RawURLEncoding.EncodeToString(k)}, "out": {n}}
+			rr := callControl(s, http.MethodPost, "/chunks/decrypt?"+q.Encode(), s.ctlToken, nil)
+			if rr.Code != http.StatusOK {
+				return "", fmt.Errorf("HTTP %d %s", rr.Code, rr.Body)
+			}
+			var res DecryptSavedResponse
+			err := json.Unmarshal(rr.Body.Bytes(), &res)
+			return res.Path, err
+		}},
+	} {
+		for _, n := range hostile {
+			out, err := site.path(n)
+			if err != nil {
+				continue
+			}
+			if !within(site.dir, out) || out == site.dir || (site.flat && filepath.Dir(out) != site.dir) {
+				t.Errorf("%s: %q lands at %q", site.name, n, out)
+			}
+		}
+	}
+}
+
+// A symlink already inside the base directory must not carry a name out of
+// it, whether it points at a directory or is a dangling file link.
+func TestSafeJoinSymlinkEscape(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks need privileges on Windows")
+	}
+	base, outside := t.TempDir(), t.TempDir()
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	must(os.Symlink(outside, filepath.Join(base, "out")))
+	must(os.Symlink(filepath.Join(outside, "new.txt"), filepath.Join(base, "dangling")))
+	must(os.Mkdir(filepath.Join(base, "in"), 0o700))
+	must(os.Symlink(filepath.Join(base, "in"), filepath.Join(base, "inlink")))
+
+	for _, p := range []string{"out", "out/x.txt", "out/deep/x.txt", "dangling"} {
+		if out, err := safeJoin(base, p); !errors.Is(err, errUnsafePath) {
+			t.Errorf("%q escapes through a symlink: %q, %v", p, out, err)
+		}
+	}
+	for _, p := range []string{"inlink/x.txt", "in/new/x.txt", "fresh/x.txt"} {
+		if _, err := safeJoin(base, p); err != nil {
+			t.Errorf("%q stays inside: %v", p, err)
+		}
+	}
+
+	// the base itself may be reached through a link
+	link := filepath.Join(t.TempDir(), "base")
+	must(os.Symlink(base, link))
+	if _, err := safeJoin(link, "in/x.txt"); err != nil {
+		t.Errorf("linked base: %v", err)
+	}
+	if _, err := safeJoin(link, "out/x.txt"); !errors.Is(err, errUnsafePath) {
+		t.Errorf("linked base, escaping link: %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+func init() { registerFeature(featureVault) }
+
+// Node modes. A vault replicates and stores everything but never originates
+// sends or executes sync commands; the mode is fixed at startup.
+const (
+	modeNormal = "normal"
+	modeVault  = "vault"
+
+	capVault = "vault" // beacon capability advertised by vault nodes
+
+	vaultQuotaFactor = 4 // vaults hold this many times the default inbox quotas
+)
+
+func validateMode(mode string) error {
+	switch mode {
+	case modeNormal, modeVault:
+		return nil
+	}
+	return fmt.Errorf("unknown mode %q (want %s or %s)", mode, modeNormal, modeVault)
+}
+
+// applyModeDefaults raises the inbox quotas of a vault unless the operator
+// set them explicitly (i.e. they still hold the normal defaults).
+func applyModeDefaults(cfg *Config) {
+	if cfg.Mode != modeVault {
+		return
+	}
+	if cfg.InboxMaxMsgs == defaultInboxMaxMsgs {
+		cfg.InboxMaxMsgs *= vaultQuotaFactor
+	}
+	if cfg.InboxMaxBytes == defaultInboxMaxBytes {
+		cfg.InboxMaxBytes *= vaultQuotaFactor
+	}
+	if cfg.InboxSenderMaxMsgs == defaultInboxSenderMaxMsgs {
+		cfg.InboxSenderMaxMsgs *= vaultQuotaFactor
+	}
+	if cfg.InboxSenderMaxBytes == defaultInboxSenderMaxBytes {
+		cfg.InboxSenderMaxBytes *= vaultQuotaFactor
+	}
+}
+
+// nodeCaps lists the capabilities a node with cfg advertises in beacons.
+func nodeCaps(cfg *Config) []string {
+	caps := []string{capPaddedChunks, capSealedNames, capOnionV2, capOnionBin, capOnionCell, capTextAck}
+	if cfg.Mode == modeVault {
+		caps = append(caps, capVault)
+	}
+	return caps
+}
+
+func (s *Server) isVault() bool {
+	return s.cfg.Mode == modeVault
+}
+
+func (p PeerInfo) hasCap(c string) bool {
+	for _, v := range p.Caps {
+		if v == c {
+			return true
+		}
+	}
+	return false
+}
+
+// originOnly hides a control endpoint on vault nodes.
+func (s *Server) originOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.isVault() {
+			http.NotFound(w, r)
+			return
+		}
+		h(w, r)
+	}
+}
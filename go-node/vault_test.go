@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// A vault hides every route that originates traffic, whatever the token.
+func TestVaultHidesOriginRoutes(t *testing.T) {
+	for _, mode := range []string{modeNormal, modeVault} {
+		cfg := defaultConfig()
+		cfg.Mode = mode
+		cfg.LoadGen = true
+		s := newTestServer(t, mode, cfg)
+		for _, path := range []string{"/mix/send-text", "/mix/send-file", "/command/broadcast", "/loadgen/start", "/loadgen/stop", "/loadgen"} {
+			method := http.MethodPost
+			if path == "/loadgen" {
+				method = http.MethodGet
+			}
+			rr := callControl(s, method, path, s.ctlToken, strings.NewReader("{}"))
+			// the handlers have 404s of their own (no run yet); originOnly's is the mux's
+			if hidden := rr.Code == http.StatusNotFound && rr.Body.String() == "404 page not found\n"; hidden != (mode == modeVault) {
+				t.Errorf("%s %s: HTTP %d %s", mode, path, rr.Code, rr.Body)
+			}
+		}
+	}
+}
@@ -0,0 +1,526 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() { registerFeature(featureWebhooks) }
+
+// Outbound webhooks: inbox arrivals, executed or rejected commands and
+// replication anomalies are POSTed as JSON to registered URLs, signed with
+// HMAC-SHA256 over the body. Deliveries go through a queue that survives
+// restarts and retries with jittered exponential backoff; after
+// WebhookMaxAttempts a delivery is dead-lettered. Hooks (with their secrets)
+// and the queue are kept in webhooks.enc, sealed with the env FileKey. A
+// secret is shown once, when the hook is created.
+
+const (
+	webhooksFile = "webhooks.enc"
+
+	webhookSigHeader      = "X-Webhook-Signature" // "sha256=<hex>"
+	webhookEventHeader    = "X-Webhook-Event"
+	webhookDeliveryHeader = "X-Webhook-Delivery"
+
+	defaultWebhookMaxAttempts = 8
+	webhookTimeout            = 10 * time.Second
+	webhookBackoffMin         = 5 * time.Second
+	webhookBackoffMax         = time.Hour
+	webhookQueueMax           = 1000 // pending deliveries; the oldest are dead-lettered beyond it
+	webhookDeadKeep           = 100
+	webhookLogKeep            = 200
+	webhookMinSecret          = 16
+)
+
+// Event types a hook can subscribe to; a filter is an exact type, a
+// "prefix.*" or "*".
+const (
+	eventInboxMessage      = "inbox.message"
+	eventCommandExecuted   = "command.executed"
+	eventCommandRejected   = "command.rejected"
+	eventReplicateHash     = "replicate.hash_mismatch"
+	eventReplicateChain    = "replicate.chain_mismatch"
+	eventReplicateForeign  = "replicate.foreign_org"
+	eventChunkCorrupt      = "chunk.corrupt"
+	eventIdentityDuplicate = "identity.duplicate"
+	eventBlockExpired      = "block.expired"
+	eventBlockDeleted      = "block.deleted"
+	eventQuarantineHeld    = "quarantine.held"
+	eventOutboxSent        = "outbox.sent"
+	eventOutboxExpired     = "outbox.expired"
+	eventSnapshotWritten   = "snapshot.written"
+	eventSnapshotFailed    = "snapshot.failed"
+	eventInboxExpired      = "inbox.expired_unread"
+	eventFileKeyMismatch   = "filekey.mismatch"
+	eventCallbackDropped   = "command.callback_dropped"
+	eventPeerKeyChanged    = "peer.key_changed"
+	eventPeerAppeared      = "peer." + peerAppeared
+	eventPeerUpdated       = "peer." + peerUpdated
+	eventPeerStale         = "peer." + peerGoneStale
+	eventPeerReturned      = "peer." + peerReturned
+	eventPeerBanned        = "peer." + peerBan
+	eventPeerUnbanned      = "peer." + peerUnban
+	eventPeerRemoved       = "peer." + peerRemoved
+)
+
+var webhookEventTypes = []string{
+	eventInboxMessage, eventCommandExecuted, eventCommandRejected,
+	eventReplicateHash, eventReplicateChain, eventReplicateForeign, eventChunkCorrupt,
+	eventIdentityDuplicate, eventBlockExpired, eventBlockDeleted, eventQuarantineHeld,
+	eventOutboxSent, eventOutboxExpired, eventSnapshotWritten, eventSnapshotFailed,
+	eventInboxExpired, eventFileKeyMismatch, eventCallbackDropped, eventPeerKeyChanged,
+	eventPeerAppeared, eventPeerUpdated, eventPeerStale, eventPeerReturned,
+	eventPeerBanned, eventPeerUnbanned, eventPeerRemoved,
+}
+
+type webhook struct {
+	ID      string    `json:"id"`
+	URL     string    `json:"url"`
+	Secret  string    `json:"secret"`
+	Events  []string  `json:"events,omitempty"` // empty = all
+	Created time.Time `json:"created"`
+}
+
+func (h *webhook) wants(typ string) bool {
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, f := range h.Events {
+		if f == "*" || f == typ || (strings.HasSuffix(f, ".*") && strings.HasPrefix(typ, f[:len(f)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookEvent is the delivered body.
+type WebhookEvent struct {
+	ID     string    `json:"id"`
+	Type   string    `json:"type"`
+	Time   time.Time `json:"time"`
+	NodeID string    `json:"node_id"`
+	Data   any       `json:"data"`
+}
+
+// webhookJob is one pending (or dead-lettered) delivery.
+type webhookJob struct {
+	Delivery string          `json:"delivery"`
+	Hook     string          `json:"hook"`
+	Event    string          `json:"event"`
+	Body     json.RawMessage `json:"body,omitempty"`
+	Attempts int             `json:"attempts"`
+	Next     time.Time       `json:"next"`
+	LastErr  string          `json:"last_error,omitempty"`
+}
+
+// webhookAttempt is one row of GET /webhooks/deliveries.
+type webhookAttempt struct {
+	Delivery string    `json:"delivery"`
+	Hook     string    `json:"hook"`
+	Event    string    `json:"event"`
+	Attempt  int       `json:"attempt"`
+	Time     time.Time `json:"time"`
+	Status   int       `json:"status,omitempty"` // HTTP status, 0 if none
+	Error    string    `json:"error,omitempty"`
+	Outcome  string    `json:"outcome"` // delivered | retry | dead
+}
+
+type webhookState struct {
+	Hooks []*webhook    `json:"hooks"`
+	Queue []*webhookJob `json:"queue"`
+	Dead  []*webhookJob `json:"dead,omitempty"` // newest last
+}
+
+type webhookStore struct {
+	path string
+	key  []byte
+
+	mu   sync.Mutex
+	st   webhookState
+	log  []webhookAttempt // newest last
+	wake chan struct{}
+}
+
+func newWebhookStore(paths *EnvPaths, key []byte) *webhookStore {
+	ws := &webhookStore{path: filepath.Join(paths.BaseDir, webhooksFile), key: key, wake: make(chan struct{}, 1)}
+	blob, err := os.ReadFile(ws.path)
+	if err != nil {
+		return ws
+	}
+	plain, err := aeadOpenWithKey(key, blob)
+	if err == nil {
+		err = json.Unmarshal(plain, &ws.st)
+	}
+	if err != nil {
+		log.Printf("[webhook] ignoring unreadable %s: %v", ws.path, err)
+		ws.st = webhookState{}
+	}
+	return ws
+}
+
+// saveLocked seals and writes the state; callers hold ws.mu.
+func (ws *webhookStore) saveLocked() {
+	b, _ := json.Marshal(ws.st)
+	blob, err := aeadSealWithKey(ws.key, b)
+	if err == nil {
+		err = writeFileAtomic(ws.path, blob)
+	}
+	if err != nil {
+		log.Printf("[webhook] save: %v", err)
+	}
+}
+
+func (ws *webhookStore) kick() {
+	select {
+	case ws.wake <- struct{}{}:
+	default:
+	}
+}
+
+func randID(n int) (string, error) {
+	b, err := secureRandom(n)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// emit queues an event for every hook that subscribes to typ and passes it
+// to /events subscribers. data should carry identifiers and sizes, never
+// message contents or keys.
+func (s *Server) emit(typ string, data any) {
+	id, err := randID(8)
+	if err != nil {
+		log.Printf("[webhook] %s: event id: %v", typ, err)
+		return
+	}
+	ev := WebhookEvent{ID: id, Type: typ, Time: time.Now().UTC(), NodeID: s.id.NodeID, Data: data}
+	s.events.publish(ev)
+	ws := s.webhooks
+	ws.mu.Lock()
+	var hooks []*webhook
+	for _, h := range ws.st.Hooks {
+		if h.wants(typ) {
+			hooks = append(hooks, h)
+		}
+	}
+	if len(hooks) == 0 {
+		ws.mu.Unlock()
+		return
+	}
+	body, err := json.Marshal(ev)
+	if err != nil {
+		ws.mu.Unlock()
+		log.Printf("[webhook] %s: marshal: %v", typ, err)
+		return
+	}
+	now := time.Now()
+	for _, h := range hooks {
+		id, err := randID(8)
+		if err != nil {
+			log.Printf("[webhook] %s for %s: delivery id: %v", typ, h.ID, err)
+			continue
+		}
+		ws.st.Queue = append(ws.st.Queue, &webhookJob{Delivery: id, Hook: h.ID, Event: typ, Body: body, Next: now})
+	}
+	if over := len(ws.st.Queue) - webhookQueueMax; over > 0 {
+		for _, j := range ws.st.Queue[:over] {
+			j.LastErr = "queue full"
+			ws.deadLocked(j)
+		}
+		ws.st.Queue = append([]*webhookJob(nil), ws.st.Queue[over:]...)
+		log.Printf("[webhook] queue full: dead-lettered %d oldest deliveries", over)
+	}
+	ws.saveLocked()
+	ws.mu.Unlock()
+	ws.kick()
+}
+
+func (ws *webhookStore) deadLocked(j *webhookJob) {
+	ws.st.Dead = append(ws.st.Dead, j)
+	if over := len(ws.st.Dead) - webhookDeadKeep; over > 0 {
+		ws.st.Dead = append([]*webhookJob(nil), ws.st.Dead[over:]...)
+	}
+}
+
+func (ws *webhookStore) logLocked(a webhookAttempt) {
+	ws.log = append(ws.log, a)
+	if over := len(ws.log) - webhookLogKeep; over > 0 {
+		ws.log = append([]webhookAttempt(nil), ws.log[over:]...)
+	}
+}
+
+func webhookBackoff(attempts int) time.Duration {
+	if attempts > 20 {
+		return webhookBackoffMax
+	}
+	d := webhookBackoffMin << (attempts - 1)
+	if d > webhookBackoffMax {
+		d = webhookBackoffMax
+	}
+	return d
+}
+
+func signWebhook(secret string, body []byte) string {
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write(body)
+	return "sha256=" + hex.EncodeToString(m.Sum(nil))
+}
+
+func (s *Server) startWebhookLoop(ctx context.Context) {
+	ws := s.webhooks
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	client := s.wanClient("webhook", webhookTimeout)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		case <-ws.wake:
+		}
+		func() {
+			defer recoverOnce("webhook")
+			s.deliverDue(client)
+		}()
+	}
+}
+
+// deliverDue attempts every queued delivery whose time has come, one at a
+// time so a slow endpoint delays but doesn't multiply load.
+func (s *Server) deliverDue(client *http.Client) {
+	ws := s.webhooks
+	for {
+		ws.mu.Lock()
+		var job *webhookJob
+		var hook webhook
+		now := time.Now()
+		for _, j := range ws.st.Queue {
+			if j.Next.After(now) {
+				continue
+			}
+			for _, h := range ws.st.Hooks {
+				if h.ID == j.Hook {
+					job, hook = j, *h
+				}
+			}
+			if job != nil {
+				break
+			}
+		}
+		ws.mu.Unlock()
+		if job == nil {
+			return
+		}
+
+		status, err := postWebhook(client, hook, job)
+		ws.mu.Lock()
+		job.Attempts++
+		a := webhookAttempt{Delivery: job.Delivery, Hook: job.Hook, Event: job.Event, Attempt: job.Attempts, Time: time.Now().UTC(), Status: status}
+		switch {
+		case err == nil:
+			a.Outcome = "delivered"
+			ws.removeLocked(job)
+		case job.Attempts >= s.cfg.WebhookMaxAttempts:
+			a.Outcome, a.Error, job.LastErr = "dead", err.Error(), err.Error()
+			ws.removeLocked(job)
+			ws.deadLocked(job)
+			log.Printf("[webhook] %s to %s dead after %d attempts: %v", job.Event, hook.URL, job.Attempts, err)
+		default:
+			a.Outcome, a.Error, job.LastErr = "retry", err.Error(), err.Error()
+			job.Next = time.Now().Add(jitter(webhookBackoff(job.Attempts)))
+		}
+		ws.logLocked(a)
+		ws.saveLocked()
+		ws.mu.Unlock()
+	}
+}
+
+func (ws *webhookStore) removeLocked(job *webhookJob) {
+	for i, j := range ws.st.Queue {
+		if j == job {
+			ws.st.Queue = append(ws.st.Queue[:i:i], ws.st.Queue[i+1:]...)
+			return
+		}
+	}
+}
+
+// postWebhook delivers one job; any 2xx is success.
+func postWebhook(client *http.Client, h webhook, j *webhookJob) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, h.URL, bytes.NewReader(j.Body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookSigHeader, signWebhook(h.Secret, j.Body))
+	req.Header.Set(webhookEventHeader, j.Event)
+	req.Header.Set(webhookDeliveryHeader, j.Delivery)
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return resp.StatusCode, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// webhookView is a hook as listed: the secret is reduced to a hint.
+type webhookView struct {
+	ID         string    `json:"id"`
+	URL        string    `json:"url"`
+	Events     []string  `json:"events"`
+	Created    time.Time `json:"created"`
+	SecretHint string    `json:"secret_hint"`
+	Pending    int       `json:"pending"`
+}
+
+type webhookCreate struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret,omitempty"` // generated if empty
+	Events []string `json:"events,omitempty"`
+}
+
+func validWebhookFilter(f string) bool {
+	if f == "*" {
+		return true
+	}
+	for _, t := range webhookEventTypes {
+		if f == t || (strings.HasSuffix(f, ".*") && strings.HasPrefix(t, f[:len(f)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+// /webhooks (control): GET lists hooks, POST {url, secret?, events?}
+// creates one (the response is the only time the secret is returned),
+// DELETE ?id= removes one with its pending deliveries.
+func (s *Server) handleWebhooks(w http.ResponseWriter, r *http.Request) {
+	ws := s.webhooks
+	switch r.Method {
+	case http.MethodGet:
+		ws.mu.Lock()
+		out := make([]webhookView, 0, len(ws.st.Hooks))
+		for _, h := range ws.st.Hooks {
+			v := webhookView{ID: h.ID, URL: h.URL, Events: h.Events, Created: h.Created, SecretHint: h.Secret[:4] + "…"}
+			for _, j := range ws.st.Queue {
+				if j.Hook == h.ID {
+					v.Pending++
+				}
+			}
+			out = append(out, v)
+		}
+		ws.mu.Unlock()
+		writeJSON(w, map[string]any{"hooks": out, "event_types": webhookEventTypes})
+	case http.MethodPost:
+		var req webhookCreate
+		if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil {
+			http.Error(w, "bad json", http.StatusBadRequest)
+			return
+		}
+		u, err := url.Parse(req.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			http.Error(w, "url must be an absolute http(s) URL", http.StatusBadRequest)
+			return
+		}
+		for _, f := range req.Events {
+			if !validWebhookFilter(f) {
+				http.Error(w, "unknown event type "+f, http.StatusBadRequest)
+				return
+			}
+		}
+		if req.Secret == "" {
+			b, err := secureRandom(32)
+			if err != nil {
+				http.Error(w, "secret: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			req.Secret = base64.RawURLEncoding.EncodeToString(b)
+		} else if len(req.Secret) < webhookMinSecret {
+			http.Error(w, fmt.Sprintf("secret must be at least %d characters", webhookMinSecret), http.StatusBadRequest)
+			return
+		}
+		id, err := randID(6)
+		if err != nil {
+			http.Error(w, "hook id: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		h := &webhook{ID: id, URL: req.URL, Secret: req.Secret, Events: req.Events, Created: time.Now().UTC()}
+		ws.mu.Lock()
+		ws.st.Hooks = append(ws.st.Hooks, h)
+		ws.saveLocked()
+		ws.mu.Unlock()
+		log.Printf("[audit] webhook %s created for %s (events %v)", h.ID, u.Host, h.Events)
+		writeJSON(w, h)
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+		ws.mu.Lock()
+		found := false
+		for i, h := range ws.st.Hooks {
+			if h.ID == id {
+				ws.st.Hooks = append(ws.st.Hooks[:i:i], ws.st.Hooks[i+1:]...)
+				found = true
+				break
+			}
+		}
+		if found {
+			q := ws.st.Queue[:0]
+			for _, j := range ws.st.Queue {
+				if j.Hook != id {
+					q = append(q, j)
+				}
+			}
+			ws.st.Queue = q
+			ws.saveLocked()
+		}
+		ws.mu.Unlock()
+		if !found {
+			http.Error(w, "no such webhook", http.StatusNotFound)
+			return
+		}
+		log.Printf("[audit] webhook %s deleted", id)
+		writeJSON(w, map[string]any{"status": "deleted", "id": id})
+	default:
+		http.Error(w, "use GET, POST or DELETE", http.StatusMethodNotAllowed)
+	}
+}
+
+// GET /webhooks/deliveries (control): recent attempts, pending and
+// dead-lettered deliveries (bodies omitted).
+func (s *Server) handleWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	ws := s.webhooks
+	strip := func(js []*webhookJob) []webhookJob {
+		out := make([]webhookJob, len(js))
+		for i, j := range js {
+			out[i] = *j
+			out[i].Body = nil
+		}
+		return out
+	}
+	ws.mu.Lock()
+	attempts := make([]webhookAttempt, len(ws.log))
+	for i := range ws.log {
+		attempts[len(ws.log)-1-i] = ws.log[i] // newest first
+	}
+	resp := map[string]any{"attempts": attempts, "pending": strip(ws.st.Queue), "dead": strip(ws.st.Dead)}
+	ws.mu.Unlock()
+	writeJSON(w, resp)
+}
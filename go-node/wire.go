@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+)
+
+// Wire-format compatibility. Structs that cross the network use snake_case
+// JSON names, *_b64 for base64 payloads and "pubkey" for mix public keys.
+// The names they had before that audit are still accepted on decode for one
+// release, never written: each type lists them in a legacy map and decodes
+// through decodeLegacy.
+
+// decodeLegacy decodes the JSON object data into v after renaming legacy
+// keys (legacy name -> canonical name). A canonical key present in data
+// wins over its legacy twin.
+func decodeLegacy(data []byte, v any, legacy map[string]string) error {
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(data, &m); err != nil || m == nil {
+		return json.Unmarshal(data, v) // let v report the error (or take null)
+	}
+	renamed := false
+	for old, canon := range legacy {
+		raw, ok := m[old]
+		if !ok {
+			continue
+		}
+		if _, ok := m[canon]; !ok {
+			m[canon] = raw
+		}
+		delete(m, old)
+		renamed = true
+	}
+	if renamed {
+		data, _ = json.Marshal(m)
+	}
+	return json.Unmarshal(data, v)
+}
+
+// decodePubKey accepts the canonical raw base64url form and the padded
+// standard form encoding/json writes for []byte.
+func decodePubKey(s string) []byte {
+	if s == "" {
+		return nil
+	}
+	for _, enc := range []*base64.Encoding{base64.RawURLEncoding, base64.StdEncoding} {
+		if b, err := enc.DecodeString(s); err == nil && len(b) == 32 {
+			return b
+		}
+	}
+	return nil
+}
+
+// ---- chat / file transfer (libp2p streams) ----
+
+var (
+	chatMsgLegacy = map[string]string{"peerId": "peer_id", "pubKey": "pubkey", "sig": "sig_b64"}
+
+	fileManifestLegacy = map[string]string{
+		"fileName":     "file_name",
+		"chunkSize":    "chunk_size",
+		"plainSha256":  "plain_sha256",
+		"cipherSha256": "cipher_sha256",
+		"wrappedKey":   "wrapped_key_b64",
+		"wrapNonce":    "wrap_nonce_b64",
+		"peerId":       "peer_id",
+		"pubKey":       "pubkey",
+		"sig":          "sig_b64",
+	}
+
+	fileChunkLegacy = map[string]string{
+		"mid":    "manifest_id",
+		"idx":    "index",
+		"nonce":  "nonce_b64",
+		"data":   "data_b64",
+		"peerId": "peer_id",
+		"sig":    "sig_b64",
+	}
+)
+
+func (m *ChatMsg) UnmarshalJSON(b []byte) error {
+	type plain ChatMsg
+	return decodeLegacy(b, (*plain)(m), chatMsgLegacy)
+}
+
+func (m *FileManifest) UnmarshalJSON(b []byte) error {
+	type plain FileManifest
+	return decodeLegacy(b, (*plain)(m), fileManifestLegacy)
+}
+
+func (c *FileChunk) UnmarshalJSON(b []byte) error {
+	type plain FileChunk
+	return decodeLegacy(b, (*plain)(c), fileChunkLegacy)
+}
+
+// isManifest tells a manifest from a chunk on the mixed file stream.
+func isManifest(probe map[string]any) bool {
+	_, ok := probe["file_name"]
+	_, legacy := probe["fileName"]
+	return ok || legacy
+}
+
+// ---- peers ----
+
+var peerBriefLegacy = map[string]string{"pubkey_b64": "pubkey"}
+
+func (b *PeerBrief) UnmarshalJSON(data []byte) error {
+	type plain PeerBrief
+	return decodeLegacy(data, (*plain)(b), peerBriefLegacy)
+}
+
+// PeerInfo keeps PubKey as raw bytes; on the wire (and in peers.enc) it is
+// "pubkey" in base64url like everywhere else. Before this it was dropped,
+// so peers restored from peers.enc had no key until their next beacon. The
+// continuity keys (key_continuity.go) are handled the same way.
+func (p PeerInfo) MarshalJSON() ([]byte, error) {
+	type plain PeerInfo
+	b64 := base64.RawURLEncoding.EncodeToString
+	out := struct {
+		plain
+		PubKey         string `json:"pubkey,omitempty"`
+		SignKey        string `json:"sign_key,omitempty"`
+		PendingKey     string `json:"pending_key,omitempty"`
+		PendingSignKey string `json:"pending_sign_key,omitempty"`
+		RejectedKey    string `json:"rejected_key,omitempty"`
+	}{plain: plain(p), PubKey: b64(p.PubKey), SignKey: b64(p.SignKey), PendingKey: b64(p.PendingKey),
+		PendingSignKey: b64(p.PendingSignKey), RejectedKey: b64(p.RejectedKey)}
+	return json.Marshal(out)
+}
+
+func (p *PeerInfo) UnmarshalJSON(data []byte) error {
+	type plain PeerInfo
+	in := struct {
+		*plain
+		PubKey         string `json:"pubkey,omitempty"`
+		SignKey        string `json:"sign_key,omitempty"`
+		PendingKey     string `json:"pending_key,omitempty"`
+		PendingSignKey string `json:"pending_sign_key,omitempty"`
+		RejectedKey    string `json:"rejected_key,omitempty"`
+	}{plain: (*plain)(p)}
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+	p.PubKey = decodePubKey(in.PubKey)
+	p.SignKey = decodePubKey(in.SignKey)
+	p.PendingKey = decodePubKey(in.PendingKey)
+	p.PendingSignKey = decodePubKey(in.PendingSignKey)
+	p.RejectedKey = decodePubKey(in.RejectedKey)
+	return nil
+}
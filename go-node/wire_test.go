@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+)
+
+var snakeCase = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// jsonKeys collects every object key in the JSON document data.
+func jsonKeys(t *testing.T, data []byte) []string {
+	var v any
+	if err := json.Unmarshal(data, &v); err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	var walk func(any)
+	walk = func(v any) {
+		switch v := v.(type) {
+		case map[string]any:
+			for k, e := range v {
+				keys = append(keys, k)
+				walk(e)
+			}
+		case []any:
+			for _, e := range v {
+				walk(e)
+			}
+		}
+	}
+	walk(v)
+	return keys
+}
+
+// roundTrip encodes v, checks every key is snake_case and decodes it back
+// into a fresh value of the same type, which must equal v.
+func roundTrip[T any](t *testing.T, v T) {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range jsonKeys(t, data) {
+		if !snakeCase.MatchString(k) {
+			t.Errorf("%T: key %q is not snake_case", v, k)
+		}
+	}
+	var got T
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("%T: %v", v, err)
+	}
+	if !reflect.DeepEqual(got, v) {
+		t.Fatalf("%T round trip:\n got %+v\nwant %+v\nwire %s", v, got, v, data)
+	}
+}
+
+func key32(b byte) []byte {
+	k := make([]byte, 32)
+	k[0] = b
+	return k
+}
+
+func TestWireRoundTrip(t *testing.T) {
+	now := time.Unix(1700000000, 0).UTC()
+	roundTrip(t, Beacon{Type: "beacon", NodeID: "n", APIPort: 8080, Hostname: "h", TS: 1, PubKey: "pk", Org: "o", API: 1,
+		Caps: []string{"vault"}, Gen: 2, Tip: "t", Posture: "strict", SignKey: "sk", KeySig: "ks", KeyIssued: 3})
+	roundTrip(t, PeerInfo{NodeID: "n", Addr: "1.2.3.4:8080", APIPort: 8080, Hostname: "h", LastSeen: now,
+		PubKey: key32(1), SignKey: key32(2), PendingKey: key32(3), PendingSignKey: key32(4), RejectedKey: key32(5),
+		APIVersion: 1, Caps: []string{"vault"}, KeyChangedAt: now})
+	roundTrip(t, PeerBrief{NodeID: "n", Addr: "a", Hostname: "h", LastSeen: now, PubKeyB64: "pk", APIVersion: 1, Caps: []string{"c"}})
+	roundTrip(t, PeerSnapshot{Version: 1, NodeID: "n", Created: now, Peers: []PeerBrief{{NodeID: "p", LastSeen: now}}})
+	roundTrip(t, ReplicateEnvelope{MsgID: "m", OriginID: "o", Name: "n", HashHex: "h", PrevHash: "p", OrgID: "org", CipherB64: "c",
+		EncKeyB64: "k", Created: 1, Hops: 2, Comp: "gzip", RawSize: 3, Logical: 4, Batch: "b", Kind: "k", PlainHash: "ph", Pad: 5, NameSealed: true})
+	roundTrip(t, Block{Hash: "h", PrevHash: "p", Name: "n", Size: 1, Created: 2, OriginID: "o", Comp: "gzip", RawSize: 3, Logical: 4,
+		Batch: "b", Kind: "k", PlainHash: "ph", Pad: 5, NameSealed: true})
+	roundTrip(t, FinalEnvelope{Type: "text", SenderID: "s", ReceiverID: "r", Name: "n", MsgID: "m", DataB64: "d", TextEph: "e",
+		Logical: 1, SentUnix: 2, Expires: 3, Ack: true, Group: "g", GroupOwner: "go", GroupGen: 4})
+	var layer onionLayerPlain
+	layer.Next, layer.Payload, layer.Len = "n:1", "p", 9
+	layer.Meta.Final, layer.Meta.MsgID, layer.Meta.TTL, layer.Meta.Trace, layer.Meta.Class, layer.Meta.Bin = true, "m", 3, "tr", "bulk", true
+	roundTrip(t, layer)
+	roundTrip(t, onionPacket{V: 2, EphemeralPub: "e", Ciphertext: "c"})
+	roundTrip(t, SyncCommand{Type: "encrypt", FolderPath: "/f", Recursive: true, OriginNode: "o", MsgID: "m", Timestamp: 1, OrgID: "org", DryRun: true})
+	roundTrip(t, ChatMsg{Text: "t", PeerID: "p", PubB64: "pk", SigB64: "s", Timestamp: 1})
+	roundTrip(t, FileManifest{ID: "i", FileName: "f", Size: 1, ChunkSize: 2, Chunks: 3, PlainSHA256: "p", CipherSHA256: "c",
+		WrappedKeyB64: "w", WrapNonceB64: "n", PeerID: "p", PubB64: "pk", SigB64: "s", Timestamp: 4})
+	roundTrip(t, FileChunk{ManifestID: "m", Index: 1, NonceB64: "n", DataB64: "d", PeerID: "p", SigB64: "s"})
+}
+
+// Zero optional fields stay off the wire.
+func TestWireOmitsZero(t *testing.T) {
+	for _, v := range []any{
+		Beacon{Type: "beacon", NodeID: "n"},
+		PeerInfo{NodeID: "n"},
+		FinalEnvelope{Type: "text", MsgID: "m"},
+		ReplicateEnvelope{MsgID: "m"},
+		onionPacket{EphemeralPub: "e", Ciphertext: "c"},
+	} {
+		data, _ := json.Marshal(v)
+		for _, k := range jsonKeys(t, data) {
+			switch k {
+			case "pubkey", "sign_key", "pending_key", "pending_sign_key", "rejected_key", "text_eph", "caps", "v", "receipt", "tombstone", "access", "key_changed_at":
+				t.Errorf("%T: zero %q on the wire: %s", v, k, data)
+			}
+		}
+	}
+}
+
+// The names from before the audit still decode, and lose to the canonical
+// one when both are present.
+func TestWireLegacyNames(t *testing.T) {
+	decode := func(in string, v any) {
+		t.Helper()
+		if err := json.Unmarshal([]byte(in), v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var c ChatMsg
+	decode(`{"text":"t","peerId":"p","pubKey":"pk","sig":"s"}`, &c)
+	if c != (ChatMsg{Text: "t", PeerID: "p", PubB64: "pk", SigB64: "s"}) {
+		t.Fatalf("chat: %+v", c)
+	}
+	var m FileManifest
+	decode(`{"fileName":"f","chunkSize":2,"plainSha256":"p","cipherSha256":"c","wrappedKey":"w","wrapNonce":"n","peerId":"id","pubKey":"pk","sig":"s"}`, &m)
+	if m != (FileManifest{FileName: "f", ChunkSize: 2, PlainSHA256: "p", CipherSHA256: "c", WrappedKeyB64: "w", WrapNonceB64: "n", PeerID: "id", PubB64: "pk", SigB64: "s"}) {
+		t.Fatalf("manifest: %+v", m)
+	}
+	var ch FileChunk
+	decode(`{"mid":"m","idx":3,"nonce":"n","data":"d","peerId":"p","sig":"s"}`, &ch)
+	if ch != (FileChunk{ManifestID: "m", Index: 3, NonceB64: "n", DataB64: "d", PeerID: "p", SigB64: "s"}) {
+		t.Fatalf("chunk: %+v", ch)
+	}
+	var b PeerBrief
+	decode(`{"node_id":"n","pubkey_b64":"old","pubkey":"new"}`, &b)
+	if b.PubKeyB64 != "new" {
+		t.Fatalf("canonical must win: %+v", b)
+	}
+	decode(`{"node_id":"n","pubkey_b64":"old"}`, &b)
+	if b.PubKeyB64 != "old" {
+		t.Fatalf("brief: %+v", b)
+	}
+
+	// PeerInfo as encoding/json wrote []byte (padded std base64)
+	var p PeerInfo
+	decode(`{"node_id":"n","pubkey":"`+base64.StdEncoding.EncodeToString(key32(7))+`"}`, &p)
+	if !reflect.DeepEqual(p.PubKey, key32(7)) {
+		t.Fatalf("padded pubkey: %x", p.PubKey)
+	}
+}
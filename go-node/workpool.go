@@ -0,0 +1,213 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// Bounded work pools. An inbound /p2p/command used to start a goroutine per
+// registered callback plus one to forward it, and every relay hop one or two
+// to report trace events, so a command storm grew goroutines without limit.
+// That work now goes through two pools of at most N workers each, started on
+// demand and gone when idle, in front of a bounded queue:
+//
+//   - callbacks (--callback-workers, --callback-queue): command callbacks.
+//     A full queue drops the call and fires command.callback_dropped.
+//   - forward (--forward-workers, --forward-queue): command forwards,
+//     dry-run results to the origin and relay trace reports. A command whose
+//     forward doesn't fit is refused with 503 and not marked seen, so the
+//     sender can retry; results and trace reports are dropped.
+//
+// Past --goroutine-budget goroutines in the process both pools refuse new
+// work as if full. GET /debug/goroutines has the count, the budget and the
+// pools; /metrics has workpool_queue_depth, workpool_busy and
+// workpool_rejected_total by pool.
+
+const (
+	defaultCallbackWorkers = 4
+	defaultCallbackQueue   = 1024
+	defaultForwardWorkers  = 16
+	defaultForwardQueue    = 1024
+	defaultGoroutineBudget = 10000
+
+	poolCallbacks = "callbacks"
+	poolForward   = "forward"
+)
+
+var (
+	poolQueueDepth = metricDef{"workpool_queue_depth", "jobs waiting in a work pool", "pool"}
+	poolBusy       = metricDef{"workpool_busy", "work pool workers running a job", "pool"}
+	poolRejected   = metricDef{"workpool_rejected_total", "jobs refused because the pool was full or over the goroutine budget", "pool"}
+	goroutineGauge = newGaugeVec("goroutines", "goroutines in the process at the last budget check", "scope")
+)
+
+type workPool struct {
+	name    string
+	workers int
+	budget  int // process goroutines past which submit refuses (0 = no check)
+	queue   chan func()
+
+	mu      sync.Mutex
+	running int // workers alive
+
+	busy     atomic.Int64
+	done     atomic.Int64
+	rejected atomic.Int64
+
+	depthGauge, busyGauge *gaugeVec
+	rejectedCount         *counterVec
+}
+
+func newWorkPool(name string, workers, queue, budget int, m *metricsRegistry) *workPool {
+	return &workPool{name: name, workers: max(workers, 1), budget: budget, queue: make(chan func(), max(queue, 0)),
+		depthGauge: m.gauge(poolQueueDepth), busyGauge: m.gauge(poolBusy), rejectedCount: m.counter(poolRejected)}
+}
+
+// submit queues job and reports whether it was taken.
+func (p *workPool) submit(job func()) bool {
+	if p.overBudget() {
+		p.reject()
+		return false
+	}
+	select {
+	case p.queue <- job:
+	default:
+		if !p.startWorker(job) {
+			p.reject()
+			return false
+		}
+		return true
+	}
+	p.startWorker(nil)
+	p.depthGauge.set(p.name, float64(len(p.queue)))
+	return true
+}
+
+// startWorker starts a worker if the pool has room for one, handing it
+// first to run before the queue.
+func (p *workPool) startWorker(first func()) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.running >= p.workers {
+		return false
+	}
+	p.running++
+	go p.work(first)
+	return true
+}
+
+// work runs jobs until the queue is empty. The emptiness check and the exit
+// are under mu, so a job queued meanwhile is seen here or starts a worker.
+func (p *workPool) work(first func()) {
+	if first != nil {
+		p.run(first)
+	}
+	for {
+		select {
+		case job := <-p.queue:
+			p.depthGauge.set(p.name, float64(len(p.queue)))
+			p.run(job)
+		default:
+			p.mu.Lock()
+			if len(p.queue) == 0 {
+				p.running--
+				p.mu.Unlock()
+				return
+			}
+			p.mu.Unlock()
+		}
+	}
+}
+
+func (p *workPool) run(job func()) {
+	p.busyGauge.set(p.name, float64(p.busy.Add(1)))
+	defer func() {
+		p.busyGauge.set(p.name, float64(p.busy.Add(-1)))
+		p.done.Add(1)
+	}()
+	defer recoverOnce("workpool-" + p.name)
+	job()
+}
+
+func (p *workPool) reject() {
+	p.rejected.Add(1)
+	p.rejectedCount.inc(p.name)
+}
+
+func (p *workPool) overBudget() bool {
+	if p.budget <= 0 {
+		return false
+	}
+	n := runtime.NumGoroutine()
+	goroutineGauge.set("process", float64(n))
+	return n > p.budget
+}
+
+type workPoolStats struct {
+	Workers  int   `json:"workers"`
+	Running  int   `json:"running"`
+	Busy     int64 `json:"busy"`
+	Queued   int   `json:"queued"`
+	QueueCap int   `json:"queue_cap"`
+	Done     int64 `json:"done"`
+	Rejected int64 `json:"rejected"`
+}
+
+func (p *workPool) stats() workPoolStats {
+	p.mu.Lock()
+	running := p.running
+	p.mu.Unlock()
+	return workPoolStats{
+		Workers:  p.workers,
+		Running:  running,
+		Busy:     p.busy.Load(),
+		Queued:   len(p.queue),
+		QueueCap: cap(p.queue),
+		Done:     p.done.Load(),
+		Rejected: p.rejected.Load(),
+	}
+}
+
+// goroutineBound is the most goroutines the pools can hold at once.
+func (s *Server) goroutineBound() int {
+	return s.cbPool.workers + s.fwdPool.workers
+}
+
+// GET /debug/goroutines (control): goroutine count against the budget, and
+// the work pools.
+func (s *Server) handleDebugGoroutines(w http.ResponseWriter, r *http.Request) {
+	n := runtime.NumGoroutine()
+	goroutineGauge.set("process", float64(n))
+	budget := s.cfg.GoroutineBudget
+	writeJSON(w, map[string]any{
+		"goroutines":  n,
+		"budget":      budget,
+		"over_budget": budget > 0 && n > budget,
+		"pool_bound":  s.goroutineBound(),
+		"pools": map[string]workPoolStats{
+			poolCallbacks: s.cbPool.stats(),
+			poolForward:   s.fwdPool.stats(),
+		},
+	})
+}
+
+// dispatchCallbacks hands cmd to every registered callback through the
+// callbacks pool.
+func (s *Server) dispatchCallbacks(cmd SyncCommand) {
+	s.cmdCbMu.RLock()
+	cbs := s.cmdCallbacks
+	s.cmdCbMu.RUnlock()
+	dropped := 0
+	for _, cb := range cbs {
+		if !s.cbPool.submit(func() { cb(cmd) }) {
+			dropped++
+		}
+	}
+	if dropped > 0 {
+		log.Printf("[p2p-cmd] %s: %d of %d callbacks dropped, pool full", cmd.MsgID, dropped, len(cbs))
+		s.emit(eventCallbackDropped, map[string]any{"msgid": cmd.MsgID, "origin": cmd.OriginNode, "dropped": dropped})
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 10k commands from 32 clients against slow callbacks and a live forward
+// peer: every command gets 200, or 503 with Retry-After when the forward
+// pool is full, the pools never run more than their workers, the process
+// stays within the pool bound plus the connections, and the node keeps
+// answering.
+func TestCommandStorm(t *testing.T) {
+	const (
+		commands = 10000
+		clients  = 32
+	)
+	cfg := defaultConfig()
+	cfg.CallbackWorkers, cfg.CallbackQueue = 4, 64
+	cfg.ForwardWorkers, cfg.ForwardQueue = 8, 64
+	s, peer := newTestServer(t, "storm", cfg), newTestServer(t, "peer", nil)
+	meet(t, s, peer)
+	var called atomic.Int64
+	for range 2 {
+		s.RegisterCommandCallback(func(SyncCommand) {
+			time.Sleep(time.Millisecond)
+			called.Add(1)
+		})
+	}
+	folder := t.TempDir()
+
+	tr := &http.Transport{MaxIdleConnsPerHost: clients}
+	t.Cleanup(tr.CloseIdleConnections)
+	client := &http.Client{Transport: tr, Timeout: 30 * time.Second}
+	runtime.GC()
+	base := runtime.NumGoroutine()
+
+	stop := make(chan struct{})
+	var peak, cbPeak, fwdPeak atomic.Int64
+	var slowest atomic.Int64
+	var watchers sync.WaitGroup
+	watchers.Add(2)
+	go func() {
+		defer watchers.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(2 * time.Millisecond):
+			}
+			for v, n := range map[*atomic.Int64]int64{
+				&peak:    int64(runtime.NumGoroutine()),
+				&cbPeak:  int64(s.cbPool.stats().Running),
+				&fwdPeak: int64(s.fwdPool.stats().Running),
+			} {
+				if n > v.Load() {
+					v.Store(n)
+				}
+			}
+		}
+	}()
+	go func() {
+		defer watchers.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(20 * time.Millisecond):
+			}
+			start := time.Now()
+			resp, err := client.Get("http://" + s.selfAddr + "/versions")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+			if d := int64(time.Since(start)); d > slowest.Load() {
+				slowest.Store(d)
+			}
+		}
+	}()
+
+	var ok, busy atomic.Int64
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				body, _ := json.Marshal(SyncCommand{Type: "encrypt", FolderPath: folder, OriginNode: "storm-origin",
+					MsgID: fmt.Sprintf("storm-%d", i), Timestamp: time.Now().Unix(), OrgID: "test"})
+				resp, err := client.Post("http://"+s.selfAddr+"/v1/p2p/command", "application/json", bytes.NewReader(body))
+				if err != nil {
+					t.Error(err)
+					continue
+				}
+				resp.Body.Close()
+				switch {
+				case resp.StatusCode == http.StatusOK:
+					ok.Add(1)
+				case resp.StatusCode == http.StatusServiceUnavailable && resp.Header.Get("Retry-After") != "":
+					busy.Add(1)
+				default:
+					t.Errorf("command %d: HTTP %d", i, resp.StatusCode)
+				}
+			}
+		}()
+	}
+	for i := range commands {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	close(stop)
+	watchers.Wait()
+
+	if ok.Load()+busy.Load() != commands {
+		t.Fatalf("%d ok + %d busy of %d", ok.Load(), busy.Load(), commands)
+	}
+	if cbPeak.Load() > int64(cfg.CallbackWorkers) || fwdPeak.Load() > int64(cfg.ForwardWorkers) {
+		t.Fatalf("workers peaked at %d callbacks, %d forward", cbPeak.Load(), fwdPeak.Load())
+	}
+	// per connection: the server's conn goroutine, the client's read and
+	// write loops, and the forward connections to the peer alike
+	bound := base + s.goroutineBound() + 4*(clients+cfg.ForwardWorkers) + 64
+	if peak.Load() > int64(bound) {
+		t.Fatalf("%d goroutines at peak, bound %d (base %d)", peak.Load(), bound, base)
+	}
+	if d := time.Duration(slowest.Load()); d > 2*time.Second {
+		t.Fatalf("/versions took %v during the storm", d)
+	}
+	eventually(t, "pools idle", func() bool {
+		cb, fwd := s.cbPool.stats(), s.fwdPool.stats()
+		return cb.Running == 0 && fwd.Running == 0
+	})
+	cb := s.cbPool.stats()
+	if called.Load()+cb.Rejected != 2*ok.Load() {
+		t.Fatalf("%d callbacks ran + %d dropped, want %d", called.Load(), cb.Rejected, 2*ok.Load())
+	}
+	t.Logf("%d ok, %d busy, %d callbacks dropped; peak %d goroutines (base %d), workers %d/%d, slowest /versions %v",
+		ok.Load(), busy.Load(), cb.Rejected, peak.Load(), base, cbPeak.Load(), fwdPeak.Load(), time.Duration(slowest.Load()))
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Retrieval alerts. A node asking for keys nobody touched in months is the
+// clearest ransomware signal the keysaver sees, so every key /keys/get
+// releases is checked against a few rules: first retrieval of a key older
+// than --alert-dormant-days (never fetched, or not in that long), more
+// than --alert-per-hour releases to one requester (its node_id, else its
+// token) in an hour, and a requester whose node_id differs from the node
+// that saved the key. Rules read the row /keys/get already loaded and
+// in-memory counts; the only query added per request is stamping the
+// row's last_retrieved_at by primary key. Alerts are stored, and POSTed to
+// --alert-webhook signed like go-node webhooks, off the request path.
+
+const (
+	ruleDormantKey    = "dormant_key"
+	ruleRetrievalRate = "retrieval_rate"
+	ruleForeignNode   = "foreign_node"
+
+	alertSigHeader      = "X-Keysaver-Signature" // "sha256=<hex>"
+	alertWebhookTries   = 3
+	alertWebhookWait    = 10 * time.Second
+	alertWebhookBackoff = 5 * time.Second
+	alertListMax        = 1000
+)
+
+// AlertRules configures the rules; zero turns a rule off.
+type AlertRules struct {
+	DormantDays   int    // first retrieval of a key untouched this many days
+	PerHour       int    // releases to one requester per hour
+	ForeignNode   bool   // requester node_id differs from the saving node
+	Webhook       string // POST each alert here ("" = store only)
+	WebhookSecret string // HMAC-SHA256 key for alertSigHeader
+}
+
+// alertGate holds each requester's releases in the last hour and when it
+// last raised a rate alert, so a burst raises one alert an hour.
+type alertGate struct {
+	mu        sync.Mutex
+	hits      map[string][]time.Time
+	rateAlert map[string]time.Time
+	client    *http.Client
+}
+
+// evaluateAlerts applies the rules to a key about to be released to requester
+// (node ID, or "token:<fingerprint>") and returns the alerts it raises.
+func (s *Server) evaluateAlerts(rec *FileKeyRecord, org, nodeID, tok string, now time.Time) []Alert {
+	rules := s.cfg.Alerts
+	var out []Alert
+	raise := func(rule, detail string) {
+		out = append(out, Alert{
+			At: now.UTC(), Rule: rule, OrgID: org, FileHash: rec.FileHash, FileName: rec.FileName,
+			NodeID: nodeID, OriginNodeID: rec.OriginNodeID, Token: tok, Detail: detail,
+		})
+	}
+	if d := time.Duration(rules.DormantDays) * 24 * time.Hour; d > 0 && now.Sub(rec.CreatedAt) >= d {
+		switch {
+		case rec.LastRetrievedAt == nil:
+			raise(ruleDormantKey, fmt.Sprintf("first retrieval; saved %s", rec.CreatedAt.UTC().Format(time.RFC3339)))
+		case now.Sub(*rec.LastRetrievedAt) >= d:
+			raise(ruleDormantKey, fmt.Sprintf("last retrieved %s", rec.LastRetrievedAt.UTC().Format(time.RFC3339)))
+		}
+	}
+	if rules.ForeignNode && nodeID != "" && nodeID != rec.OriginNodeID {
+		raise(ruleForeignNode, "saved by "+rec.OriginNodeID)
+	}
+	if rules.PerHour > 0 {
+		who := nodeID
+		if who == "" {
+			who = "token:" + tok
+		}
+		g := &s.alerts
+		g.mu.Lock()
+		if g.hits == nil {
+			g.hits, g.rateAlert = make(map[string][]time.Time), make(map[string]time.Time)
+		}
+		h := g.hits[who]
+		i := 0
+		for i < len(h) && now.Sub(h[i]) >= time.Hour {
+			i++
+		}
+		h = append(h[i:], now)
+		g.hits[who] = h
+		fire := len(h) > rules.PerHour && now.Sub(g.rateAlert[who]) >= time.Hour
+		if fire {
+			g.rateAlert[who] = now
+		}
+		g.mu.Unlock()
+		if fire {
+			raise(ruleRetrievalRate, fmt.Sprintf("%d keys in the last hour to %s (limit %d)", len(h), who, rules.PerHour))
+		}
+	}
+	return out
+}
+
+// raiseAlerts stores alerts and posts them to the webhook. It runs after
+// the response, so a slow database or receiver never delays a release.
+func (s *Server) raiseAlerts(alerts []Alert) {
+	for _, a := range alerts {
+		id, err := s.storage.AddAlert(a)
+		if err != nil {
+			log.Printf("[alert] store %s for %s: %v", a.Rule, a.FileHash, err)
+		}
+		a.ID = id
+		log.Printf("[alert] %s: hash=%s node=%q origin=%s token=%s %s", a.Rule, a.FileHash, a.NodeID, a.OriginNodeID, a.Token, a.Detail)
+		if s.cfg.Alerts.Webhook != "" {
+			s.postAlert(a)
+		}
+	}
+}
+
+func signAlert(secret string, body []byte) string {
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write(body)
+	return "sha256=" + hex.EncodeToString(m.Sum(nil))
+}
+
+// postAlert delivers one alert, retrying a few times with backoff.
+func (s *Server) postAlert(a Alert) {
+	g := &s.alerts
+	g.mu.Lock()
+	if g.client == nil {
+		g.client = &http.Client{Timeout: alertWebhookWait}
+	}
+	client := g.client
+	g.mu.Unlock()
+	body, _ := json.Marshal(a)
+	var lastErr error
+	for try := 0; try < alertWebhookTries; try++ {
+		if try > 0 {
+			time.Sleep(alertWebhookBackoff << (try - 1))
+		}
+		req, err := http.NewRequest(http.MethodPost, s.cfg.Alerts.Webhook, bytes.NewReader(body))
+		if err != nil {
+			lastErr = err
+			break
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if s.cfg.Alerts.WebhookSecret != "" {
+			req.Header.Set(alertSigHeader, signAlert(s.cfg.Alerts.WebhookSecret, body))
+		}
+		resp, err := client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode/100 == 2 {
+				return
+			}
+			err = fmt.Errorf("HTTP %d", resp.StatusCode)
+		}
+		lastErr = err
+	}
+	log.Printf("[alert] webhook for alert %d failed: %v", a.ID, lastErr)
+}
+
+// ---- storage ----
+
+const alertSchema = `
+CREATE TABLE IF NOT EXISTS alerts (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	at INTEGER NOT NULL,
+	rule TEXT NOT NULL,
+	org_id TEXT NOT NULL,
+	file_hash TEXT NOT NULL,
+	file_name TEXT NOT NULL,
+	node_id TEXT NOT NULL,
+	origin_node_id TEXT NOT NULL,
+	token TEXT NOT NULL,
+	detail TEXT NOT NULL,
+	acked_at INTEGER NOT NULL DEFAULT 0,
+	acked_by TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS idx_alerts_at ON alerts(at);
+`
+
+const alertCols = `id, at, rule, org_id, file_hash, file_name, node_id, origin_node_id, token, detail, acked_at, acked_by`
+
+func (s *Storage) AddAlert(a Alert) (int64, error) {
+	res, err := s.db.Exec(`INSERT INTO alerts (at, rule, org_id, file_hash, file_name, node_id, origin_node_id, token, detail)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		a.At.UnixMilli(), a.Rule, a.OrgID, a.FileHash, a.FileName, a.NodeID, a.OriginNodeID, a.Token, a.Detail)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func scanAlert(row rowScanner) (Alert, error) {
+	var a Alert
+	var at, acked int64
+	if err := row.Scan(&a.ID, &at, &a.Rule, &a.OrgID, &a.FileHash, &a.FileName, &a.NodeID, &a.OriginNodeID, &a.Token, &a.Detail, &acked, &a.AckedBy); err != nil {
+		return a, err
+	}
+	a.At = time.UnixMilli(at).UTC()
+	if acked != 0 {
+		t := time.UnixMilli(acked).UTC()
+		a.AckedAt = &t
+	}
+	return a, nil
+}
+
+// Alerts returns alerts raised after since, newest first; acked nil means
+// either state.
+func (s *Storage) Alerts(since time.Time, acked *bool, limit int) ([]Alert, error) {
+	q := `SELECT ` + alertCols + ` FROM alerts WHERE at > ?`
+	if acked != nil {
+		if *acked {
+			q += ` AND acked_at != 0`
+		} else {
+			q += ` AND acked_at = 0`
+		}
+	}
+	rows, err := s.db.Query(q+` ORDER BY at DESC, id DESC LIMIT ?`, since.UnixMilli(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []Alert{}
+	for rows.Next() {
+		a, err := scanAlert(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, a)
+	}
+	return out, rows.Err()
+}
+
+// AckAlert marks an alert acknowledged (the first ack is kept) and returns
+// it, or nil if it doesn't exist.
+func (s *Storage) AckAlert(id int64, by string) (*Alert, error) {
+	if _, err := s.db.Exec(`UPDATE alerts SET acked_at = ?, acked_by = ? WHERE id = ? AND acked_at = 0`,
+		time.Now().UnixMilli(), by, id); err != nil {
+		return nil, err
+	}
+	a, err := scanAlert(s.db.QueryRow(`SELECT `+alertCols+` FROM alerts WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// MarkRetrieved stamps a released key; by primary key, so it is the one
+// indexed write the alert rules add to /keys/get.
+func (s *Storage) MarkRetrieved(id int64, now time.Time) error {
+	_, err := s.db.Exec(`UPDATE file_keys SET last_retrieved_at = ? WHERE id = ?`, now.Unix(), id)
+	return err
+}
+
+// ---- handlers ----
+
+// GET /admin/alerts[?since=<RFC 3339>][&acknowledged=true|false]
+func (s *Server) handleAlerts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, `{"error":"method not allowed"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	var since time.Time
+	if v := r.URL.Query().Get("since"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Status: "error", Error: "since must be RFC 3339"})
+			return
+		}
+		since = t
+	}
+	var acked *bool
+	if v := r.URL.Query().Get("acknowledged"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Status: "error", Error: "acknowledged must be true or false"})
+			return
+		}
+		acked = &b
+	}
+	list, err := s.storage.Alerts(since, acked, alertListMax)
+	if err != nil {
+		log.Printf("[alert] list: %v", err)
+		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Status: "error", Error: "failed to list alerts"})
+		return
+	}
+	writeJSON(w, http.StatusOK, AlertsResponse{Status: "ok", Count: len(list), Alerts: list})
+}
+
+// POST /admin/alerts/{id}/ack
+func (s *Server) handleAckAlert(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, `{"error":"method not allowed"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, ErrorResponse{Status: "not_found", Error: "no such alert"})
+		return
+	}
+	admin := tokenFingerprint(bearerToken(r))
+	a, err := s.storage.AckAlert(id, admin)
+	if err != nil {
+		log.Printf("[alert] ack %d: %v", id, err)
+		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Status: "error", Error: "failed to acknowledge alert"})
+		return
+	}
+	if a == nil {
+		writeJSON(w, http.StatusNotFound, ErrorResponse{Status: "not_found", Error: "no such alert"})
+		return
+	}
+	log.Printf("[audit] alert %d (%s) acknowledged by %s", id, a.Rule, admin)
+	writeJSON(w, http.StatusOK, AlertResponse{Status: "ok", Alert: *a})
+}
@@ -0,0 +1,765 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Dual control for bulk retrieval. One key for one file is routine; a token
+// fetching hundreds an hour is a mass recovery or a stolen token. Each
+// token's releases from /keys/get are counted over the last hour. Past the
+// policy threshold a request gets 202 with an approval ID instead of the
+// key, and the hashes it asks for collect in that approval until admins
+// other than the requester approve it (POST /admin/approvals/{id}/approve)
+// or deny it. Approved hashes can then be fetched for the grant window.
+// While a declared incident lasts, over-threshold releases go out at once
+// and are audited. Policy, approvals, incidents and the audit log live in
+// the database; the hourly counts are in memory only.
+
+const (
+	approvalPending  = "pending"
+	approvalApproved = "approved"
+	approvalDenied   = "denied"
+	approvalExpired  = "expired"
+
+	statusPendingApproval = "pending_approval"
+
+	maxApprovalHashes = 10000
+	maxIncident       = 72 * time.Hour
+	approvalPollAfter = "30" // Retry-After on a 202, seconds
+)
+
+var errNotApprover = errors.New("the requesting token can't approve its own request")
+
+// approvalPolicy is ApprovalPolicy with parsed durations.
+type approvalPolicy struct {
+	threshold  int
+	approvers  int
+	pendingTTL time.Duration
+	grantTTL   time.Duration
+}
+
+func (p approvalPolicy) wire() ApprovalPolicy {
+	return ApprovalPolicy{
+		ThresholdPerHour: p.threshold,
+		Approvers:        p.approvers,
+		PendingTTL:       p.pendingTTL.String(),
+		GrantTTL:         p.grantTTL.String(),
+	}
+}
+
+func parsePolicy(w ApprovalPolicy) (approvalPolicy, error) {
+	p := approvalPolicy{threshold: w.ThresholdPerHour, approvers: w.Approvers}
+	var err error
+	if p.pendingTTL, err = time.ParseDuration(w.PendingTTL); err != nil || p.pendingTTL <= 0 {
+		return p, errors.New("bad pending_ttl")
+	}
+	if p.grantTTL, err = time.ParseDuration(w.GrantTTL); err != nil || p.grantTTL <= 0 {
+		return p, errors.New("bad grant_ttl")
+	}
+	if p.threshold < 0 {
+		return p, errors.New("threshold_per_hour must be >= 0")
+	}
+	if p.approvers < 1 {
+		return p, errors.New("approvers must be >= 1")
+	}
+	return p, nil
+}
+
+// approvalGate holds the policy and each token's releases in the last hour.
+// mu also serialises the over-threshold path, so one token never gets two
+// pending approvals.
+type approvalGate struct {
+	mu     sync.Mutex
+	policy approvalPolicy
+	hits   map[string][]time.Time // token fingerprint -> release times
+}
+
+// count drops releases older than an hour and returns how many are left.
+func (g *approvalGate) count(tok string, now time.Time) int {
+	h := g.hits[tok]
+	i := 0
+	for i < len(h) && now.Sub(h[i]) >= time.Hour {
+		i++
+	}
+	h = h[i:]
+	if len(h) == 0 {
+		delete(g.hits, tok)
+	} else {
+		g.hits[tok] = h
+	}
+	return len(h)
+}
+
+func (g *approvalGate) hit(tok string, now time.Time) {
+	if g.hits == nil {
+		g.hits = make(map[string][]time.Time)
+	}
+	g.hits[tok] = append(g.hits[tok], now)
+}
+
+// gateOutcome is what handleGetKey does with a live key.
+type gateOutcome struct {
+	release  bool
+	approval *Approval // pending or denied, when not released
+}
+
+// gateRelease decides whether the caller's token may have hash now.
+func (s *Server) gateRelease(r *http.Request, org, hash string) (gateOutcome, error) {
+	g := &s.approvals
+	tok := tokenFingerprint(bearerToken(r))
+	now := time.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.policy.threshold == 0 || g.count(tok, now) < g.policy.threshold {
+		g.hit(tok, now)
+		return gateOutcome{release: true}, nil
+	}
+
+	approvals, err := s.storage.TokenApprovals(tok, org, now)
+	if err != nil {
+		return gateOutcome{}, err
+	}
+	var pending *Approval
+	for i := range approvals {
+		a := &approvals[i]
+		if !slices.Contains(a.Hashes, hash) {
+			if a.State == approvalPending {
+				pending = a
+			}
+			continue
+		}
+		switch a.State {
+		case approvalApproved:
+			g.hit(tok, now)
+			s.audit(a.ID, "release", tok, hash)
+			return gateOutcome{release: true}, nil
+		case approvalDenied:
+			return gateOutcome{approval: a}, nil
+		case approvalPending:
+			return gateOutcome{approval: a}, nil
+		}
+	}
+
+	inc, err := s.storage.ActiveIncident(now)
+	if err != nil {
+		return gateOutcome{}, err
+	}
+	if inc != nil {
+		g.hit(tok, now)
+		s.audit("", "auto-release", tok, fmt.Sprintf("%s (incident %d)", hash, inc.ID))
+		return gateOutcome{release: true}, nil
+	}
+
+	if pending == nil {
+		id, err := newApprovalID()
+		if err != nil {
+			return gateOutcome{}, err
+		}
+		a := Approval{
+			ID:        id,
+			Token:     tok,
+			OrgID:     org,
+			State:     approvalPending,
+			Hashes:    []string{hash},
+			CreatedAt: now.UTC(),
+			ExpiresAt: now.Add(g.policy.pendingTTL).UTC(),
+		}
+		if err := s.storage.SaveApproval(a); err != nil {
+			return gateOutcome{}, err
+		}
+		log.Printf("[audit] approval %s opened: token=%s org=%q over %d keys/hour", a.ID, tok, org, g.policy.threshold)
+		s.audit(a.ID, "request", tok, hash)
+		return gateOutcome{approval: &a}, nil
+	}
+	if len(pending.Hashes) >= maxApprovalHashes {
+		return gateOutcome{approval: pending}, errApprovalFull
+	}
+	pending.Hashes = append(pending.Hashes, hash)
+	if err := s.storage.SaveApproval(*pending); err != nil {
+		return gateOutcome{}, err
+	}
+	s.audit(pending.ID, "request", tok, hash)
+	return gateOutcome{approval: pending}, nil
+}
+
+var errApprovalFull = errors.New("approval request is full")
+
+func newApprovalID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// audit writes one approval audit record; a failure is logged, not returned.
+func (s *Server) audit(approvalID, action, actor, detail string) {
+	rec := ApprovalAuditRecord{At: time.Now().UTC(), ApprovalID: approvalID, Action: action, Actor: actor, Detail: detail}
+	if err := s.storage.AddApprovalAudit(rec); err != nil {
+		log.Printf("[audit] approval audit write failed (%s %s %s %s): %v", approvalID, action, actor, detail, err)
+	}
+}
+
+// loadApprovalPolicy reads the persisted policy. Flags given on the command
+// line (override) replace it; defaults only seed an empty database.
+func (s *Server) loadApprovalPolicy(flags ApprovalPolicy, override bool) error {
+	stored, err := s.storage.ApprovalPolicy()
+	if err != nil {
+		return err
+	}
+	w := flags
+	if stored != nil && !override {
+		w = *stored
+	}
+	p, err := parsePolicy(w)
+	if err != nil {
+		return err
+	}
+	if stored == nil || override {
+		if err := s.storage.SaveApprovalPolicy(p.wire()); err != nil {
+			return err
+		}
+	}
+	s.approvals.mu.Lock()
+	s.approvals.policy = p
+	s.approvals.mu.Unlock()
+	return nil
+}
+
+// decide applies one admin's approve or deny to a pending approval.
+func (s *Server) decide(id, admin string, approve bool, reason string) (*Approval, int, error) {
+	g := &s.approvals
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	a, err := s.storage.GetApproval(id, time.Now())
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if a == nil {
+		return nil, http.StatusNotFound, errors.New("no such approval")
+	}
+	if a.State != approvalPending {
+		return a, http.StatusConflict, fmt.Errorf("approval is %s", a.State)
+	}
+	if admin == a.Token {
+		return a, http.StatusForbidden, errNotApprover
+	}
+	now := time.Now().UTC()
+	a.Reason = reason
+	if !approve {
+		a.State, a.DeniedBy, a.DecidedAt = approvalDenied, admin, &now
+		// denied hashes stay refused until the request would have lapsed
+	} else {
+		if !slices.Contains(a.Approvers, admin) {
+			a.Approvers = append(a.Approvers, admin)
+		}
+		if len(a.Approvers) >= g.policy.approvers {
+			a.State, a.DecidedAt = approvalApproved, &now
+			a.ExpiresAt = now.Add(g.policy.grantTTL)
+		}
+	}
+	if err := s.storage.SaveApproval(*a); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	action := "approve"
+	if !approve {
+		action = "deny"
+	}
+	s.audit(a.ID, action, admin, reason)
+	log.Printf("[audit] approval %s %s by %s: now %s (%d hashes, token=%s)", a.ID, action, admin, a.State, len(a.Hashes), a.Token)
+	return a, http.StatusOK, nil
+}
+
+// ---- storage ----
+
+const approvalSchema = `
+CREATE TABLE IF NOT EXISTS approvals (
+	id TEXT PRIMARY KEY,
+	token TEXT NOT NULL,
+	org_id TEXT NOT NULL,
+	state TEXT NOT NULL,
+	hashes TEXT NOT NULL,
+	approvers TEXT NOT NULL,
+	denied_by TEXT NOT NULL,
+	reason TEXT NOT NULL,
+	created_at INTEGER NOT NULL,
+	expires_at INTEGER NOT NULL,
+	decided_at INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_approvals_token ON approvals(token, state);
+CREATE TABLE IF NOT EXISTS approval_audit (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	at INTEGER NOT NULL,
+	approval_id TEXT NOT NULL,
+	action TEXT NOT NULL,
+	actor TEXT NOT NULL,
+	detail TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS approval_policy (
+	id INTEGER PRIMARY KEY CHECK (id = 1),
+	policy TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS incidents (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	reason TEXT NOT NULL,
+	declared_by TEXT NOT NULL,
+	starts_at INTEGER NOT NULL,
+	ends_at INTEGER NOT NULL
+);
+`
+
+const approvalCols = `id, token, org_id, state, hashes, approvers, denied_by, reason, created_at, expires_at, decided_at`
+
+// SaveApproval inserts or replaces an approval.
+func (s *Storage) SaveApproval(a Approval) error {
+	hashes, _ := json.Marshal(a.Hashes)
+	approvers, _ := json.Marshal(a.Approvers)
+	var decided int64
+	if a.DecidedAt != nil {
+		decided = a.DecidedAt.Unix()
+	}
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO approvals (`+approvalCols+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		a.ID, a.Token, a.OrgID, a.State, string(hashes), string(approvers), a.DeniedBy, a.Reason,
+		a.CreatedAt.Unix(), a.ExpiresAt.Unix(), decided)
+	return err
+}
+
+type rowScanner interface{ Scan(dest ...any) error }
+
+func scanApproval(row rowScanner) (Approval, error) {
+	var a Approval
+	var hashes, approvers string
+	var created, expires, decided int64
+	if err := row.Scan(&a.ID, &a.Token, &a.OrgID, &a.State, &hashes, &approvers, &a.DeniedBy, &a.Reason, &created, &expires, &decided); err != nil {
+		return a, err
+	}
+	if err := json.Unmarshal([]byte(hashes), &a.Hashes); err != nil {
+		return a, fmt.Errorf("approval %s hashes: %w", a.ID, err)
+	}
+	json.Unmarshal([]byte(approvers), &a.Approvers)
+	if a.Hashes == nil {
+		a.Hashes = []string{}
+	}
+	a.CreatedAt, a.ExpiresAt = time.Unix(created, 0).UTC(), time.Unix(expires, 0).UTC()
+	if decided != 0 {
+		t := time.Unix(decided, 0).UTC()
+		a.DecidedAt = &t
+	}
+	return a, nil
+}
+
+// expireApprovals marks pending approvals past their deadline expired and
+// audits each one.
+func (s *Storage) expireApprovals(now time.Time) error {
+	rows, err := s.db.Query(`SELECT id, token FROM approvals WHERE state = ? AND expires_at <= ?`, approvalPending, now.Unix())
+	if err != nil {
+		return err
+	}
+	var expired []ApprovalAuditRecord
+	for rows.Next() {
+		rec := ApprovalAuditRecord{At: now.UTC(), Action: "expire"}
+		if err := rows.Scan(&rec.ApprovalID, &rec.Actor); err != nil {
+			rows.Close()
+			return err
+		}
+		expired = append(expired, rec)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(expired) == 0 {
+		return err
+	}
+	for _, rec := range expired {
+		if _, err := s.db.Exec(`UPDATE approvals SET state = ? WHERE id = ? AND state = ?`, approvalExpired, rec.ApprovalID, approvalPending); err != nil {
+			return err
+		}
+		if err := s.AddApprovalAudit(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetApproval returns one approval (nil if unknown), expiring it first if
+// its time is up.
+func (s *Storage) GetApproval(id string, now time.Time) (*Approval, error) {
+	if err := s.expireApprovals(now); err != nil {
+		return nil, err
+	}
+	a, err := scanApproval(s.db.QueryRow(`SELECT `+approvalCols+` FROM approvals WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// TokenApprovals returns the approvals that still matter for a token in an
+// org: pending ones, and approved or denied ones inside their window.
+func (s *Storage) TokenApprovals(token, org string, now time.Time) ([]Approval, error) {
+	if err := s.expireApprovals(now); err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query(`SELECT `+approvalCols+` FROM approvals
+		WHERE token = ? AND org_id = ? AND state IN (?, ?, ?) AND expires_at > ? ORDER BY created_at DESC`,
+		token, org, approvalPending, approvalApproved, approvalDenied, now.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Approval
+	for rows.Next() {
+		a, err := scanApproval(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, a)
+	}
+	return out, rows.Err()
+}
+
+// ListApprovals returns approvals in state (all if ""), newest first.
+func (s *Storage) ListApprovals(state string, now time.Time) ([]Approval, error) {
+	if err := s.expireApprovals(now); err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query(`SELECT `+approvalCols+` FROM approvals WHERE (? = '' OR state = ?) ORDER BY created_at DESC LIMIT 1000`, state, state)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []Approval{}
+	for rows.Next() {
+		a, err := scanApproval(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, a)
+	}
+	return out, rows.Err()
+}
+
+func (s *Storage) AddApprovalAudit(rec ApprovalAuditRecord) error {
+	_, err := s.db.Exec(`INSERT INTO approval_audit (at, approval_id, action, actor, detail) VALUES (?, ?, ?, ?, ?)`,
+		rec.At.UnixMilli(), rec.ApprovalID, rec.Action, rec.Actor, rec.Detail)
+	return err
+}
+
+// ApprovalAudit returns the newest limit audit records.
+func (s *Storage) ApprovalAudit(limit int) ([]ApprovalAuditRecord, error) {
+	rows, err := s.db.Query(`SELECT at, approval_id, action, actor, detail FROM approval_audit ORDER BY id DESC LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []ApprovalAuditRecord{}
+	for rows.Next() {
+		var rec ApprovalAuditRecord
+		var at int64
+		if err := rows.Scan(&at, &rec.ApprovalID, &rec.Action, &rec.Actor, &rec.Detail); err != nil {
+			return nil, err
+		}
+		rec.At = time.UnixMilli(at).UTC()
+		out = append(out, rec)
+	}
+	return out, rows.Err()
+}
+
+// ApprovalPolicy returns the stored policy, or nil if none was saved yet.
+func (s *Storage) ApprovalPolicy() (*ApprovalPolicy, error) {
+	var raw string
+	err := s.db.QueryRow(`SELECT policy FROM approval_policy WHERE id = 1`).Scan(&raw)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var p ApprovalPolicy
+	if err := json.Unmarshal([]byte(raw), &p); err != nil {
+		return nil, fmt.Errorf("stored approval policy: %w", err)
+	}
+	return &p, nil
+}
+
+func (s *Storage) SaveApprovalPolicy(p ApprovalPolicy) error {
+	b, _ := json.Marshal(p)
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO approval_policy (id, policy) VALUES (1, ?)`, string(b))
+	return err
+}
+
+// DeclareIncident records an incident starting now.
+func (s *Storage) DeclareIncident(reason, by string, d time.Duration) (Incident, error) {
+	now := time.Now().UTC().Truncate(time.Second)
+	inc := Incident{Reason: reason, DeclaredBy: by, StartsAt: now, EndsAt: now.Add(d)}
+	res, err := s.db.Exec(`INSERT INTO incidents (reason, declared_by, starts_at, ends_at) VALUES (?, ?, ?, ?)`,
+		reason, by, inc.StartsAt.Unix(), inc.EndsAt.Unix())
+	if err != nil {
+		return inc, err
+	}
+	inc.ID, err = res.LastInsertId()
+	return inc, err
+}
+
+// EndIncident moves an incident's end to now if it is later; false if the
+// incident doesn't exist.
+func (s *Storage) EndIncident(id int64) (bool, error) {
+	now := time.Now().Unix()
+	if _, err := s.db.Exec(`UPDATE incidents SET ends_at = ? WHERE id = ? AND ends_at > ?`, now, id, now); err != nil {
+		return false, err
+	}
+	var n int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM incidents WHERE id = ?`, id).Scan(&n)
+	return n > 0, err
+}
+
+// Incidents returns the newest limit incidents.
+func (s *Storage) Incidents(limit int) ([]Incident, error) {
+	rows, err := s.db.Query(`SELECT id, reason, declared_by, starts_at, ends_at FROM incidents ORDER BY id DESC LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []Incident{}
+	for rows.Next() {
+		var inc Incident
+		var starts, ends int64
+		if err := rows.Scan(&inc.ID, &inc.Reason, &inc.DeclaredBy, &starts, &ends); err != nil {
+			return nil, err
+		}
+		inc.StartsAt, inc.EndsAt = time.Unix(starts, 0).UTC(), time.Unix(ends, 0).UTC()
+		out = append(out, inc)
+	}
+	return out, rows.Err()
+}
+
+// ActiveIncident returns the incident covering now with the latest end, or
+// nil.
+func (s *Storage) ActiveIncident(now time.Time) (*Incident, error) {
+	var inc Incident
+	var starts, ends int64
+	err := s.db.QueryRow(`SELECT id, reason, declared_by, starts_at, ends_at FROM incidents
+		WHERE starts_at <= ? AND ends_at > ? ORDER BY ends_at DESC LIMIT 1`, now.Unix(), now.Unix()).
+		Scan(&inc.ID, &inc.Reason, &inc.DeclaredBy, &starts, &ends)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	inc.StartsAt, inc.EndsAt = time.Unix(starts, 0).UTC(), time.Unix(ends, 0).UTC()
+	return &inc, nil
+}
+
+// ---- handlers ----
+
+// GET /keys/approvals/{id} (requesting token)
+func (s *Server) handleApprovalStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, `{"error":"method not allowed"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	a, err := s.storage.GetApproval(r.PathValue("id"), time.Now())
+	if err != nil {
+		log.Printf("[approvals] get: %v", err)
+		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Status: "error", Error: "failed to read approval"})
+		return
+	}
+	// other tokens can't tell an unknown ID from someone else's
+	if a == nil || a.Token != tokenFingerprint(bearerToken(r)) {
+		writeJSON(w, http.StatusNotFound, ErrorResponse{Status: "not_found", Error: "no such approval"})
+		return
+	}
+	writeJSON(w, http.StatusOK, ApprovalResponse{Status: "ok", Approval: *a})
+}
+
+// GET /admin/approvals[?state=pending]
+func (s *Server) handleListApprovals(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, `{"error":"method not allowed"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	list, err := s.storage.ListApprovals(r.URL.Query().Get("state"), time.Now())
+	if err != nil {
+		log.Printf("[approvals] list: %v", err)
+		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Status: "error", Error: "failed to list approvals"})
+		return
+	}
+	writeJSON(w, http.StatusOK, ListApprovalsResponse{Status: "ok", Count: len(list), Approvals: list})
+}
+
+// POST /admin/approvals/{id}/approve and /deny
+func (s *Server) handleDecideApproval(approve bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, `{"error":"method not allowed"}`, http.StatusMethodNotAllowed)
+			return
+		}
+		var req DecideApprovalRequest
+		// the body is optional
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4<<10)).Decode(&req); err != nil && err != io.EOF {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Status: "error", Error: "invalid JSON: " + err.Error()})
+			return
+		}
+		a, code, err := s.decide(r.PathValue("id"), tokenFingerprint(bearerToken(r)), approve, req.Reason)
+		if err != nil {
+			if code == http.StatusInternalServerError {
+				log.Printf("[approvals] decide %s: %v", r.PathValue("id"), err)
+				err = errors.New("failed to update approval")
+			}
+			writeJSON(w, code, ErrorResponse{Status: "error", Error: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, ApprovalResponse{Status: "ok", Approval: *a})
+	}
+}
+
+// GET /admin/approvals/audit[?limit=100]
+func (s *Server) handleApprovalAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, `{"error":"method not allowed"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > 1000 {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Status: "error", Error: "limit must be 1..1000"})
+			return
+		}
+		limit = n
+	}
+	recs, err := s.storage.ApprovalAudit(limit)
+	if err != nil {
+		log.Printf("[approvals] audit: %v", err)
+		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Status: "error", Error: "failed to read audit log"})
+		return
+	}
+	writeJSON(w, http.StatusOK, ApprovalAuditResponse{Status: "ok", Records: recs})
+}
+
+// GET, PUT /admin/approval-policy
+func (s *Server) handleApprovalPolicy(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.approvals.mu.Lock()
+		p := s.approvals.policy.wire()
+		s.approvals.mu.Unlock()
+		writeJSON(w, http.StatusOK, p)
+	case http.MethodPut:
+		var req ApprovalPolicy
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4<<10)).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Status: "error", Error: "invalid JSON: " + err.Error()})
+			return
+		}
+		p, err := parsePolicy(req)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Status: "error", Error: err.Error()})
+			return
+		}
+		if err := s.storage.SaveApprovalPolicy(p.wire()); err != nil {
+			log.Printf("[approvals] save policy: %v", err)
+			writeJSON(w, http.StatusInternalServerError, ErrorResponse{Status: "error", Error: "failed to save policy"})
+			return
+		}
+		s.approvals.mu.Lock()
+		s.approvals.policy = p
+		s.approvals.mu.Unlock()
+		admin := tokenFingerprint(bearerToken(r))
+		b, _ := json.Marshal(p.wire())
+		s.audit("", "policy", admin, string(b))
+		log.Printf("[audit] approval policy set by %s: %s", admin, b)
+		writeJSON(w, http.StatusOK, p.wire())
+	default:
+		http.Error(w, `{"error":"method not allowed"}`, http.StatusMethodNotAllowed)
+	}
+}
+
+// GET, POST /admin/incidents
+func (s *Server) handleIncidents(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req DeclareIncidentRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4<<10)).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Status: "error", Error: "invalid JSON: " + err.Error()})
+			return
+		}
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil || d <= 0 || d > maxIncident {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Status: "error", Error: "duration must be between 0 and " + maxIncident.String()})
+			return
+		}
+		if req.Reason == "" {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Status: "error", Error: "missing reason"})
+			return
+		}
+		admin := tokenFingerprint(bearerToken(r))
+		inc, err := s.storage.DeclareIncident(req.Reason, admin, d)
+		if err != nil {
+			log.Printf("[approvals] declare incident: %v", err)
+			writeJSON(w, http.StatusInternalServerError, ErrorResponse{Status: "error", Error: "failed to declare incident"})
+			return
+		}
+		s.audit("", "incident", admin, fmt.Sprintf("%d until %s: %s", inc.ID, inc.EndsAt.Format(time.RFC3339), req.Reason))
+		log.Printf("[audit] incident %d declared by %s until %s: %s", inc.ID, admin, inc.EndsAt.Format(time.RFC3339), req.Reason)
+	default:
+		http.Error(w, `{"error":"method not allowed"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	s.writeIncidents(w)
+}
+
+// POST /admin/incidents/{id}/end
+func (s *Server) handleEndIncident(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, `{"error":"method not allowed"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, ErrorResponse{Status: "not_found", Error: "no such incident"})
+		return
+	}
+	ok, err := s.storage.EndIncident(id)
+	if err != nil {
+		log.Printf("[approvals] end incident: %v", err)
+		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Status: "error", Error: "failed to end incident"})
+		return
+	}
+	if !ok {
+		writeJSON(w, http.StatusNotFound, ErrorResponse{Status: "not_found", Error: "no such incident"})
+		return
+	}
+	admin := tokenFingerprint(bearerToken(r))
+	s.audit("", "incident-end", admin, strconv.FormatInt(id, 10))
+	log.Printf("[audit] incident %d ended by %s", id, admin)
+	s.writeIncidents(w)
+}
+
+func (s *Server) writeIncidents(w http.ResponseWriter) {
+	list, err := s.storage.Incidents(100)
+	var active *Incident
+	if err == nil {
+		active, err = s.storage.ActiveIncident(time.Now())
+	}
+	if err != nil {
+		log.Printf("[approvals] incidents: %v", err)
+		writeJSON(w, http.StatusInternalServerError, ErrorResponse{Status: "error", Error: "failed to read incidents"})
+		return
+	}
+	writeJSON(w, http.StatusOK, IncidentsResponse{Status: "ok", Active: active, Incidents: list})
+}
@@ -1,20 +1,70 @@
 package main
 
 import (
+	"context"
 	"net/http"
 	"strings"
 )
 
+type ctxKey int
+
+const orgCtxKey ctxKey = iota
+
+// parseToken splits a configured "token@org" entry. Tokens without "@" are
+// not bound to an org and may act on any org.
+func parseToken(entry string) (token, org string) {
+	if i := strings.LastIndex(entry, "@"); i > 0 {
+		return entry[:i], entry[i+1:]
+	}
+	return entry, ""
+}
+
+// orgFromRequest returns the org the caller's token is bound to ("" = any).
+func orgFromRequest(r *http.Request) string {
+	org, _ := r.Context().Value(orgCtxKey).(string)
+	return org
+}
+
+// bearerToken returns the token of "Authorization: Bearer <token>", or "".
+func bearerToken(r *http.Request) string {
+	parts := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+	if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" || parts[1] == "" {
+		return ""
+	}
+	return parts[1]
+}
+
+// publicPaths are served without a token (keysaverclient.Routes marks the
+// same set Public).
+var publicPaths = map[string]bool{"/health": true, "/openapi.json": true, "/docs": true}
+
+// adminPrefix paths need an admin token, even when no API tokens are set.
+const adminPrefix = "/admin/"
+
 // AuthMiddleware validates API tokens
-func AuthMiddleware(tokens []string, next http.Handler) http.Handler {
-	tokenSet := make(map[string]struct{}, len(tokens))
+func AuthMiddleware(tokens, adminTokens []string, next http.Handler) http.Handler {
+	tokenSet := make(map[string]string, len(tokens))
 	for _, t := range tokens {
-		tokenSet[t] = struct{}{}
+		tok, org := parseToken(t)
+		tokenSet[tok] = org
+	}
+	adminSet := make(map[string]bool, len(adminTokens))
+	for _, t := range adminTokens {
+		adminSet[t] = true
 	}
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Skip auth for health check
-		if r.URL.Path == "/health" {
+		// Skip auth for health check and API docs
+		if publicPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if strings.HasPrefix(r.URL.Path, adminPrefix) {
+			if !adminSet[bearerToken(r)] {
+				http.Error(w, `{"error":"admin token required"}`, http.StatusForbidden)
+				return
+			}
 			next.ServeHTTP(w, r)
 			return
 		}
@@ -40,11 +90,12 @@ func AuthMiddleware(tokens []string, next http.Handler) http.Handler {
 		}
 
 		token := parts[1]
-		if _, ok := tokenSet[token]; !ok {
+		org, ok := tokenSet[token]
+		if !ok {
 			http.Error(w, `{"error":"invalid token"}`, http.StatusForbidden)
 			return
 		}
 
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), orgCtxKey, org)))
 	})
 }
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"keysaver-server/keysaverclient"
+)
+
+const testToken = "tok"
+
+// newTestKeysaver runs a keysaver on a temp database; edit, if not nil,
+// adjusts the config first. The primary listener takes testToken.
+func newTestKeysaver(t *testing.T, edit func(*Config)) (*Server, *httptest.Server) {
+	t.Helper()
+	cfg := defaultConfig()
+	cfg.DBPath = filepath.Join(t.TempDir(), "keys.db")
+	cfg.MasterKey = "test-master-key"
+	cfg.AuthTokens = []string{testToken}
+	cfg.HealthMinFree = 0
+	if edit != nil {
+		edit(cfg)
+	}
+	st, err := NewStorage(cfg.DBPath, cfg.MasterKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { st.Close() })
+	srv := NewServer(st, cfg)
+	if err := srv.loadApprovalPolicy(cfg.Approval, cfg.ApprovalFlags); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(srv.Handler())
+	t.Cleanup(ts.Close)
+	return srv, ts
+}
+
+func TestClientRoundTrip(t *testing.T) {
+	_, ts := newTestKeysaver(t, nil)
+	c := keysaverclient.New(ts.URL, testToken)
+	c.NodeID = "node-a"
+	ctx := context.Background()
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{5}, 32))
+
+	if h, err := c.DeepHealth(ctx); err != nil || h.Status != "ok" {
+		t.Fatalf("deep health: %+v %v", h, err)
+	}
+	saved, err := c.SaveKey(ctx, keysaverclient.SaveKeyRequest{FileHash: "h1", KeyB64: key, NodeID: "node-a", FileName: "a.txt", Verified: true})
+	if err != nil || saved.Status != "ok" || saved.Confirmation == "" {
+		t.Fatalf("save: %+v %v", saved, err)
+	}
+	got, err := c.GetKey(ctx, "h1")
+	if err != nil || got.KeyB64 != key || got.FileName != "a.txt" {
+		t.Fatalf("get: %+v %v", got, err)
+	}
+	list, err := c.ListKeys(ctx, "node-a")
+	if err != nil || list.Count != 1 || list.Keys[0].Confirmation != saved.Confirmation || list.Keys[0].VerifiedAt == nil {
+		t.Fatalf("list: %+v %v", list, err)
+	}
+	if _, err := c.GetKey(ctx, "nope"); !errors.Is(err, keysaverclient.ErrNotFound) {
+		t.Fatalf("get unknown: %v", err)
+	}
+	if _, err := c.RevokeKey(ctx, "h1", "node-a"); err != nil {
+		t.Fatalf("revoke: %v", err)
+	}
+	if _, err := c.GetKey(ctx, "h1"); !errors.Is(err, keysaverclient.ErrRevoked) {
+		t.Fatalf("get revoked: %v", err)
+	}
+	if err := c.DeleteKey(ctx, "h1", "node-a"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	var apiErr *keysaverclient.APIError
+	if _, err := keysaverclient.New(ts.URL, "wrong").GetKey(ctx, "h1"); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusForbidden {
+		t.Fatalf("bad token: %v", err)
+	}
+}
+
+// Nodes from before keysaverclient hand-built their requests. What they
+// sent must still work, and keys saved either way read back either way.
+func TestClientLegacyCompatible(t *testing.T) {
+	_, ts := newTestKeysaver(t, nil)
+	ctx := context.Background()
+	c := keysaverclient.New(ts.URL, testToken)
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{9}, 32))
+
+	// an old node's save, exactly as escrow.go built it
+	body, _ := json.Marshal(map[string]any{"hash": "old", "key_b64": key, "node_id": "node-old", "name": "o.txt", "org_id": "", "verified": false})
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/keys/save", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved keysaverclient.SaveKeyResponse
+	json.NewDecoder(resp.Body).Decode(&saved)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || saved.Status != "ok" {
+		t.Fatalf("legacy save: HTTP %d %+v", resp.StatusCode, saved)
+	}
+	if got, err := c.GetKey(ctx, "old"); err != nil || got.KeyB64 != key {
+		t.Fatalf("client reading a legacy save: %+v %v", got, err)
+	}
+
+	// a key the client saved, fetched the old way
+	if _, err := c.SaveKey(ctx, keysaverclient.SaveKeyRequest{FileHash: "new", KeyB64: key, NodeID: "node-new"}); err != nil {
+		t.Fatal(err)
+	}
+	req, _ = http.NewRequest(http.MethodGet, ts.URL+"/keys/get?hash=new&node_id=node-old", nil)
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		Status string `json:"status"`
+		KeyB64 string `json:"key_b64"`
+	}
+	json.NewDecoder(resp.Body).Decode(&got)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || got.Status != "ok" || got.KeyB64 != key {
+		t.Fatalf("legacy get: HTTP %d %+v", resp.StatusCode, got)
+	}
+}
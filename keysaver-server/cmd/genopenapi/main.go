@@ -0,0 +1,213 @@
+// Command genopenapi writes keysaver-server's OpenAPI 3 document from the
+// route table and wire structs in keysaverclient. Run via `go generate` in
+// keysaver-server; -check exits non-zero if the committed file is stale.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"keysaver-server/keysaverclient"
+)
+
+func main() {
+	out := flag.String("o", "openapi.json", "output file")
+	check := flag.Bool("check", false, "compare with the existing output instead of writing it")
+	flag.Parse()
+
+	doc, err := json.MarshalIndent(buildSpec(), "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	doc = append(doc, '\n')
+
+	if *check {
+		cur, err := os.ReadFile(*out)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !bytes.Equal(cur, doc) {
+			log.Fatalf("%s is out of date; run go generate", *out)
+		}
+		return
+	}
+	if err := os.WriteFile(*out, doc, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+type object = map[string]any
+
+func buildSpec() object {
+	schemas := object{}
+	paths := object{}
+	for _, rt := range keysaverclient.Routes {
+		op := object{
+			"summary":   rt.Summary,
+			"responses": responses(rt, schemas),
+		}
+		if rt.Public {
+			op["security"] = []any{}
+		}
+		if rt.ReadOnly {
+			op["x-readonly-listener"] = true
+		}
+		if len(rt.Params) > 0 {
+			var params []any
+			for _, p := range rt.Params {
+				in := "query"
+				if p.Path {
+					in = "path"
+				}
+				params = append(params, object{
+					"name":        p.Name,
+					"in":          in,
+					"description": p.Doc,
+					"required":    p.Required,
+					"schema":      object{"type": "string"},
+				})
+			}
+			op["parameters"] = params
+		}
+		if rt.Request != nil {
+			op["requestBody"] = object{
+				"required": true,
+				"content":  object{"application/json": object{"schema": schemaFor(reflect.TypeOf(rt.Request), schemas)}},
+			}
+		}
+		item, _ := paths[rt.Path].(object)
+		if item == nil {
+			item = object{}
+			paths[rt.Path] = item
+		}
+		item[strings.ToLower(rt.Method)] = op
+	}
+	return object{
+		"openapi": "3.0.3",
+		"info": object{
+			"title":       "keysaver-server",
+			"description": "Centralized, encrypted file-key storage for Hoshizora-RSW nodes.",
+			"version":     "1",
+		},
+		"paths": paths,
+		"components": object{
+			"schemas": schemas,
+			"securitySchemes": object{
+				"bearer": object{"type": "http", "scheme": "bearer", "description": "API token, optionally bound to an org (token@org)"},
+			},
+		},
+		"security": []any{object{"bearer": []any{}}},
+	}
+}
+
+func responses(rt keysaverclient.Route, schemas object) object {
+	codes := make([]int, 0, len(rt.Responses))
+	for c := range rt.Responses {
+		codes = append(codes, c)
+	}
+	sort.Ints(codes)
+	out := object{}
+	for _, c := range codes {
+		r := object{"description": statusText(c)}
+		if v := rt.Responses[c]; v != nil {
+			r["content"] = object{"application/json": object{"schema": schemaFor(reflect.TypeOf(v), schemas)}}
+		}
+		out[strconv.Itoa(c)] = r
+	}
+	return out
+}
+
+func statusText(code int) string {
+	switch code {
+	case 200:
+		return "OK"
+	case 202:
+		return "Accepted, waiting for approval"
+	case 400:
+		return "Bad request"
+	case 403:
+		return "Forbidden"
+	case 404:
+		return "Not found"
+	case 409:
+		return "Conflict"
+	case 429:
+		return "Too many requests"
+	case 500:
+		return "Internal error"
+	}
+	return fmt.Sprintf("HTTP %d", code)
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaFor returns an inline schema for t, registering named structs under
+// components/schemas and referencing them.
+func schemaFor(t reflect.Type, schemas object) object {
+	switch {
+	case t == timeType:
+		return object{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Pointer:
+		return schemaFor(t.Elem(), schemas)
+	case t.Kind() == reflect.Slice:
+		return object{"type": "array", "items": schemaFor(t.Elem(), schemas)}
+	case t.Kind() == reflect.String:
+		return object{"type": "string"}
+	case t.Kind() == reflect.Bool:
+		return object{"type": "boolean"}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		s := object{"type": "integer"}
+		if t.Kind() == reflect.Int64 || t.Kind() == reflect.Uint64 {
+			s["format"] = "int64"
+		}
+		return s
+	case t.Kind() == reflect.Struct:
+		if _, ok := schemas[t.Name()]; !ok {
+			schemas[t.Name()] = object{} // placeholder for recursive types
+			schemas[t.Name()] = structSchema(t, schemas)
+		}
+		return object{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return object{}
+}
+
+func structSchema(t reflect.Type, schemas object) object {
+	props := object{}
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" || !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		s := schemaFor(f.Type, schemas)
+		if d := f.Tag.Get("doc"); d != "" {
+			if _, isRef := s["$ref"]; isRef {
+				s = object{"allOf": []any{s}, "description": d}
+			} else {
+				s["description"] = d
+			}
+		}
+		props[name] = s
+		if f.Tag.Get("required") == "true" {
+			required = append(required, name)
+		}
+	}
+	out := object{"type": "object", "properties": props}
+	if len(required) > 0 {
+		out["required"] = required
+	}
+	return out
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+// TestSpecUpToDate regenerates the document and diffs it against the
+// committed openapi.json, which the server embeds.
+func TestSpecUpToDate(t *testing.T) {
+	doc, err := json.MarshalIndent(buildSpec(), "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc = append(doc, '\n')
+	cur, err := os.ReadFile("../../openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(cur, doc) {
+		t.Fatal("openapi.json is out of date; run go generate in keysaver-server")
+	}
+}
@@ -1,6 +1,10 @@
 package main
 
-import "time"
+import (
+	"time"
+
+	"keysaver-server/keysaverclient"
+)
 
 // Config holds server configuration
 type Config struct {
@@ -9,53 +13,64 @@ type Config struct {
 	MasterKey  string   // Master key for encrypting stored keys (32 bytes)
 	CertFile   string   // TLS certificate file
 	KeyFile    string   // TLS private key file
-	AuthTokens []string // Allowed API tokens
-}
+	AuthTokens []string // Allowed API tokens ("token" or "token@org")
 
-// FileKeyRecord represents a stored encryption key
-type FileKeyRecord struct {
-	ID           int64     `json:"id"`
-	FileHash     string    `json:"file_hash"`
-	OriginNodeID string    `json:"origin_node_id"`
-	KeyEncrypted []byte    `json:"-"`                 // Stored encrypted, never exposed
-	KeyB64       string    `json:"key_b64,omitempty"` // Decrypted key (only in responses)
-	FileName     string    `json:"file_name"`
-	CreatedAt    time.Time `json:"created_at"`
-}
+	// /admin/* endpoints: separate tokens, never open
+	AdminTokens []string
+	// Offline recovery public key (PEM) used by /admin/export-wrapped when
+	// the request brings none, and the minimum gap between two exports
+	RecoveryPubKey string
+	ExportInterval time.Duration
 
-// SaveKeyRequest is the request body for /keys/save
-type SaveKeyRequest struct {
-	FileHash string `json:"hash"`
-	KeyB64   string `json:"key_b64"` // Base64-encoded raw key
-	NodeID   string `json:"node_id"`
-	FileName string `json:"name"`
-}
+	// Optional second listener serving only /health, /keys/get and
+	// /keys/list, with its own tokens; DisableReads makes the primary port
+	// refuse get and list
+	ReadOnlyPort int // 0 = off
+	ReadTokens   []string
+	DisableReads bool
 
-// SaveKeyResponse is the response for /keys/save
-type SaveKeyResponse struct {
-	Status   string `json:"status"`
-	FileHash string `json:"hash"`
-	Message  string `json:"message,omitempty"`
-}
+	// Bulk-retrieval policy; seeds the one stored in the database, and
+	// replaces it when given as flags (ApprovalFlags)
+	Approval      ApprovalPolicy
+	ApprovalFlags bool
 
-// GetKeyResponse is the response for /keys/get
-type GetKeyResponse struct {
-	Status   string `json:"status"`
-	FileHash string `json:"hash"`
-	KeyB64   string `json:"key_b64,omitempty"`
-	FileName string `json:"name,omitempty"`
-	NodeID   string `json:"node_id,omitempty"`
-	Error    string `json:"error,omitempty"`
-}
+	// Retrieval alert rules and where to send alerts
+	Alerts AlertRules
 
-// ListKeysResponse is the response for /keys/list
-type ListKeysResponse struct {
-	Status string          `json:"status"`
-	NodeID string          `json:"node_id"`
-	Count  int             `json:"count"`
-	Keys   []FileKeyRecord `json:"keys"`
+	// Free bytes below which /health?deep=true fails its disk check
+	HealthMinFree int64
 }
 
+// Wire types live in keysaverclient so the OpenAPI document (openapi.json)
+// and the Go client are generated from the same definitions.
+type (
+	FileKeyRecord     = keysaverclient.FileKeyRecord
+	SaveKeyRequest    = keysaverclient.SaveKeyRequest
+	SaveKeyResponse   = keysaverclient.SaveKeyResponse
+	GetKeyResponse    = keysaverclient.GetKeyResponse
+	ListKeysResponse  = keysaverclient.ListKeysResponse
+	DeleteKeyResponse = keysaverclient.DeleteKeyResponse
+	RevokeKeyResponse = keysaverclient.RevokeKeyResponse
+	HealthResponse    = keysaverclient.HealthResponse
+	HealthCheck       = keysaverclient.HealthCheck
+	ErrorResponse     = keysaverclient.ErrorResponse
+	WrappedKeyRecord  = keysaverclient.WrappedKeyRecord
+
+	Approval               = keysaverclient.Approval
+	ApprovalResponse       = keysaverclient.ApprovalResponse
+	ListApprovalsResponse  = keysaverclient.ListApprovalsResponse
+	DecideApprovalRequest  = keysaverclient.DecideApprovalRequest
+	ApprovalPolicy         = keysaverclient.ApprovalPolicy
+	Incident               = keysaverclient.Incident
+	DeclareIncidentRequest = keysaverclient.DeclareIncidentRequest
+	IncidentsResponse      = keysaverclient.IncidentsResponse
+	ApprovalAuditRecord    = keysaverclient.ApprovalAuditRecord
+	ApprovalAuditResponse  = keysaverclient.ApprovalAuditResponse
+	Alert                  = keysaverclient.Alert
+	AlertsResponse         = keysaverclient.AlertsResponse
+	AlertResponse          = keysaverclient.AlertResponse
+)
+
 func defaultConfig() *Config {
 	return &Config{
 		Port:       80,
@@ -64,5 +79,13 @@ func defaultConfig() *Config {
 		CertFile:   "server.crt",
 		KeyFile:    "server.key",
 		AuthTokens: []string{"hoshizora-api-token-changeme"}, // Default token - CHANGE IN PRODUCTION
+
+		ExportInterval: time.Hour,
+
+		Approval: ApprovalPolicy{ThresholdPerHour: 0, Approvers: 1, PendingTTL: "24h", GrantTTL: "1h"},
+
+		Alerts: AlertRules{DormantDays: 90, PerHour: 0, ForeignNode: true},
+
+		HealthMinFree: defaultHealthMinFree,
 	}
 }
@@ -4,9 +4,12 @@ go 1.24.0
 
 require (
 	golang.org/x/crypto v0.43.0
+	keysaver-server/keysaverclient v0.0.0
 	modernc.org/sqlite v1.28.0
 )
 
+replace keysaver-server/keysaverclient => ./keysaverclient
+
 require (
 	github.com/dustin/go-humanize v1.0.1 // indirect
 	github.com/google/uuid v1.3.0 // indirect
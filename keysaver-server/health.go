@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Deep health. /health answers ok while the process runs, which says nothing
+// about a database that went read-only or a master key that can't open the
+// rows already stored (a restart with the wrong --master-key against an old
+// database). /health?deep=true checks those:
+//
+//   - write: in one transaction, insert a canary row with a freshly
+//     encrypted key, read it back, decrypt it and delete it;
+//   - decrypt: decrypt the oldest stored key (it is never returned);
+//   - disk: free space on the database's filesystem against
+//     --health-min-free;
+//   - wal: the size of the write-ahead log, if there is one (report only).
+//
+// Any failing check makes the answer 503. Results are cached for
+// deepHealthCache, since /health needs no token. At startup the same checks
+// run once, and a failing decrypt check stops the server.
+
+const (
+	healthOK   = "ok"
+	healthFail = "fail"
+	healthSkip = "skipped"
+
+	healthCanaryPrefix   = "health-canary-"
+	healthCanaryNode     = "keysaver-health"
+	defaultHealthMinFree = 100 << 20
+	deepHealthCache      = 10 * time.Second
+)
+
+type healthCache struct {
+	mu  sync.Mutex
+	at  time.Time
+	rep HealthResponse
+}
+
+// checkWrite round-trips a canary row through the database and the master
+// key. The row is deleted in the same transaction.
+func (s *Storage) checkWrite() HealthCheck {
+	c := HealthCheck{Name: "write", Status: healthFail}
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		c.Detail = "random: " + err.Error()
+		return c
+	}
+	enc, err := s.encryptKey(raw)
+	if err != nil {
+		c.Detail = "encrypt: " + err.Error()
+		return c
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		c.Detail = "begin: " + err.Error()
+		return c
+	}
+	defer tx.Rollback()
+	hash := healthCanaryPrefix + hex.EncodeToString(raw[:8])
+	if _, err := tx.Exec(`INSERT INTO file_keys (file_hash, origin_node_id, key_encrypted, file_name, created_at) VALUES (?, ?, ?, '', ?)`,
+		hash, healthCanaryNode, enc, time.Now().Unix()); err != nil {
+		c.Detail = "insert: " + err.Error()
+		return c
+	}
+	var back []byte
+	if err := tx.QueryRow(`SELECT key_encrypted FROM file_keys WHERE file_hash = ?`, hash).Scan(&back); err != nil {
+		c.Detail = "read back: " + err.Error()
+		return c
+	}
+	got, err := s.decryptKey(back)
+	if err != nil || !bytes.Equal(got, raw) {
+		c.Detail = "canary key didn't survive the round trip"
+		return c
+	}
+	if _, err := tx.Exec(`DELETE FROM file_keys WHERE file_hash = ?`, hash); err != nil {
+		c.Detail = "delete: " + err.Error()
+		return c
+	}
+	if err := tx.Commit(); err != nil {
+		c.Detail = "commit: " + err.Error()
+		return c
+	}
+	c.Status, c.Detail = healthOK, "canary row written, read, decrypted and deleted"
+	return c
+}
+
+// checkDecrypt opens the oldest stored key with the master key.
+func (s *Storage) checkDecrypt() HealthCheck {
+	c := HealthCheck{Name: "decrypt"}
+	var hash string
+	var enc []byte
+	err := s.db.QueryRow(`SELECT file_hash, key_encrypted FROM file_keys ORDER BY created_at, id LIMIT 1`).Scan(&hash, &enc)
+	switch {
+	case err == sql.ErrNoRows:
+		c.Status, c.Detail = healthSkip, "no stored keys"
+		return c
+	case err != nil:
+		c.Status, c.Detail = healthFail, "read: "+err.Error()
+		return c
+	}
+	raw, err := s.decryptKey(enc)
+	if err != nil {
+		c.Status, c.Detail = healthFail, fmt.Sprintf("master key can't decrypt the oldest stored key (%s); wrong --master-key for this database?", hash)
+		return c
+	}
+	clear(raw)
+	c.Status, c.Detail = healthOK, "oldest stored key decrypts"
+	return c
+}
+
+// checkDisk compares the free space next to the database with minFree.
+func checkDisk(dbPath string, minFree int64) HealthCheck {
+	c := HealthCheck{Name: "disk"}
+	free, err := diskFree(filepath.Dir(dbPath))
+	if err != nil {
+		c.Status, c.Detail = healthFail, err.Error()
+		return c
+	}
+	c.Bytes = int64(free)
+	if minFree > 0 && free < uint64(minFree) {
+		c.Status, c.Detail = healthFail, fmt.Sprintf("%d bytes free, below --health-min-free %d", free, minFree)
+		return c
+	}
+	c.Status, c.Detail = healthOK, fmt.Sprintf("%d bytes free", free)
+	return c
+}
+
+// checkWAL reports the write-ahead log's size.
+func checkWAL(dbPath string) HealthCheck {
+	c := HealthCheck{Name: "wal", Status: healthOK}
+	st, err := os.Stat(dbPath + "-wal")
+	if err != nil {
+		c.Detail = "no write-ahead log"
+		return c
+	}
+	c.Bytes = st.Size()
+	c.Detail = fmt.Sprintf("%d bytes", st.Size())
+	return c
+}
+
+// deepHealth runs every check; a cached result younger than
+// deepHealthCache is returned as is.
+func (s *Server) deepHealth() HealthResponse {
+	s.health.mu.Lock()
+	defer s.health.mu.Unlock()
+	if !s.health.at.IsZero() && time.Since(s.health.at) < deepHealthCache {
+		return s.health.rep
+	}
+	rep := HealthResponse{Status: healthOK, Service: "keysaver-server", Checks: []HealthCheck{
+		s.storage.checkWrite(),
+		s.storage.checkDecrypt(),
+		checkDisk(s.cfg.DBPath, s.cfg.HealthMinFree),
+		checkWAL(s.cfg.DBPath),
+	}}
+	for _, c := range rep.Checks {
+		if c.Status == healthFail {
+			rep.Status = healthFail
+		}
+	}
+	s.health.at, s.health.rep = time.Now(), rep
+	return rep
+}
+
+// GET /health[?deep=true]
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("deep") != "true" {
+		writeJSON(w, http.StatusOK, HealthResponse{
+			Status:  "ok",
+			Service: "keysaver-server",
+		})
+		return
+	}
+	rep := s.deepHealth()
+	status := http.StatusOK
+	if rep.Status != healthOK {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, rep)
+}
@@ -56,6 +56,13 @@ MASTER_KEY=CHANGE_THIS_TO_A_SECURE_RANDOM_STRING
 
 # API tokens (comma-separated, optional for authentication)
 # KEYSAVER_TOKENS=token1,token2,token3
+
+# Admin tokens for /admin/* (recovery export); unset = admin endpoints disabled
+# KEYSAVER_ADMIN_TOKENS=admintoken1
+
+# Tokens for the read-only listener (--readonly-port); pair with
+# --disable-reads so workstations can only write
+# KEYSAVER_READ_TOKENS=readtoken1
 EOF
     chmod 600 "$INSTALL_DIR/.env"
 fi
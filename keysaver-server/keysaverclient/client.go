@@ -0,0 +1,212 @@
+package keysaverclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned when the server has no key for the request.
+var ErrNotFound = errors.New("keysaver: not found")
+
+// ErrRevoked is returned by GetKey when the key was revoked.
+var ErrRevoked = errors.New("keysaver: key revoked")
+
+// ErrPendingApproval is returned by GetKey, with the response, when the
+// token is over the bulk-retrieval threshold: poll Approval with the
+// response's ApprovalID and call GetKey again once it is approved.
+var ErrPendingApproval = errors.New("keysaver: waiting for bulk-retrieval approval")
+
+// Client talks to one keysaver-server.
+type Client struct {
+	BaseURL string       // e.g. https://keys.example.com
+	Token   string       // bearer token ("" for open-mode servers)
+	HTTP    *http.Client // defaults to a client with a 15s timeout
+	NodeID  string       // sent as node_id with GetKey, for the server's alert rules
+}
+
+// New returns a Client for baseURL authenticating with token.
+func New(baseURL, token string) *Client {
+	return &Client{
+		BaseURL: strings.TrimRight(baseURL, "/"),
+		Token:   token,
+		HTTP:    &http.Client{Timeout: 15 * time.Second},
+	}
+}
+
+// Health calls GET /health.
+func (c *Client) Health(ctx context.Context) (*HealthResponse, error) {
+	var out HealthResponse
+	if err := c.do(ctx, http.MethodGet, "/health", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// DeepHealth calls GET /health?deep=true. A failed check is not an error:
+// the response comes back with Status "fail" and the checks.
+func (c *Client) DeepHealth(ctx context.Context) (*HealthResponse, error) {
+	status, raw, err := c.send(ctx, http.MethodGet, "/health", url.Values{"deep": {"true"}}, nil)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK && status != http.StatusServiceUnavailable {
+		return nil, &APIError{StatusCode: status, Message: errorMessage(raw)}
+	}
+	var out HealthResponse
+	if err := json.Unmarshal(raw, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// SaveKey calls POST /keys/save.
+func (c *Client) SaveKey(ctx context.Context, req SaveKeyRequest) (*SaveKeyResponse, error) {
+	var out SaveKeyResponse
+	if err := c.do(ctx, http.MethodPost, "/keys/save", nil, req, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// GetKey calls GET /keys/get. Returns ErrNotFound if the hash is unknown,
+// ErrRevoked if its key was revoked and ErrPendingApproval if it waits for
+// an admin.
+func (c *Client) GetKey(ctx context.Context, hash string) (*GetKeyResponse, error) {
+	var out GetKeyResponse
+	q := url.Values{"hash": {hash}}
+	if c.NodeID != "" {
+		q.Set("node_id", c.NodeID)
+	}
+	if err := c.do(ctx, http.MethodGet, "/keys/get", q, nil, &out); err != nil {
+		return nil, err
+	}
+	if out.Status == "pending_approval" {
+		return &out, ErrPendingApproval
+	}
+	return &out, nil
+}
+
+// Approval calls GET /keys/approvals/{id}. Returns ErrNotFound if the ID is
+// unknown or belongs to another token.
+func (c *Client) Approval(ctx context.Context, id string) (*Approval, error) {
+	var out ApprovalResponse
+	if err := c.do(ctx, http.MethodGet, "/keys/approvals/"+url.PathEscape(id), nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out.Approval, nil
+}
+
+// ListKeys calls GET /keys/list.
+func (c *Client) ListKeys(ctx context.Context, nodeID string) (*ListKeysResponse, error) {
+	var out ListKeysResponse
+	if err := c.do(ctx, http.MethodGet, "/keys/list", url.Values{"node_id": {nodeID}}, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// DeleteKey calls DELETE /keys/delete. Returns ErrNotFound if nothing matched.
+func (c *Client) DeleteKey(ctx context.Context, hash, nodeID string) error {
+	var out DeleteKeyResponse
+	return c.do(ctx, http.MethodDelete, "/keys/delete", url.Values{"hash": {hash}, "node_id": {nodeID}}, nil, &out)
+}
+
+// RevokeKey calls POST /keys/revoke. Returns ErrNotFound if nothing matched.
+func (c *Client) RevokeKey(ctx context.Context, hash, nodeID string) (*RevokeKeyResponse, error) {
+	var out RevokeKeyResponse
+	if err := c.do(ctx, http.MethodPost, "/keys/revoke", url.Values{"hash": {hash}, "node_id": {nodeID}}, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// APIError is a non-2xx response other than 404.
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("keysaver: HTTP %d: %s", e.StatusCode, e.Message)
+}
+
+func (c *Client) do(ctx context.Context, method, path string, q url.Values, in, out any) error {
+	status, raw, err := c.send(ctx, method, path, q, in)
+	if err != nil {
+		return err
+	}
+	if status == http.StatusNotFound {
+		return ErrNotFound
+	}
+	if status == http.StatusGone {
+		return ErrRevoked
+	}
+	if status/100 != 2 {
+		return &APIError{StatusCode: status, Message: errorMessage(raw)}
+	}
+	return json.Unmarshal(raw, out)
+}
+
+// send makes the request and returns the status and body.
+func (c *Client) send(ctx context.Context, method, path string, q url.Values, in any) (int, []byte, error) {
+	u := c.BaseURL + path
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return 0, nil, err
+		}
+		defer clear(b) // a SaveKey body carries the key
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return 0, nil, err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	hc := c.HTTP
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, 8<<20))
+	return resp.StatusCode, raw, err
+}
+
+// errorMessage pulls a reason out of an error body, which is ErrorResponse,
+// SaveKeyResponse or plain JSON text depending on the endpoint.
+func errorMessage(raw []byte) string {
+	var e struct {
+		Error   string `json:"error"`
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(raw, &e) == nil {
+		if e.Error != "" {
+			return e.Error
+		}
+		if e.Message != "" {
+			return e.Message
+		}
+	}
+	return strings.TrimSpace(string(raw))
+}
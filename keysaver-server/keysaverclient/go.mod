@@ -0,0 +1,3 @@
+module keysaver-server/keysaverclient
+
+go 1.24.0
@@ -0,0 +1,252 @@
+package keysaverclient
+
+import "net/http"
+
+// Param is one query (or, with Path set, path) parameter of a Route.
+type Param struct {
+	Name     string
+	Doc      string
+	Required bool
+	Path     bool // a {name} segment of Route.Path
+}
+
+// Route describes one endpoint for the OpenAPI generator. Request and the
+// Responses values are zero values of the wire types (nil = no body).
+type Route struct {
+	Method    string
+	Path      string
+	Summary   string
+	Public    bool // served without a bearer token
+	ReadOnly  bool // also served on the read-only listener (--readonly-port)
+	Params    []Param
+	Request   any
+	Responses map[int]any
+}
+
+// Routes lists every keysaver-server endpoint.
+var Routes = []Route{
+	{
+		Method: http.MethodGet, Path: "/health", Summary: "Liveness check; deep=true also checks the database, master key and disk", Public: true, ReadOnly: true,
+		Params: []Param{
+			{Name: "deep", Doc: "true: write, read and delete a canary row, decrypt the oldest stored key, check free disk and report the WAL size (cached for 10s)"},
+		},
+		Responses: map[int]any{200: HealthResponse{}, 503: HealthResponse{}},
+	},
+	{
+		Method: http.MethodGet, Path: "/openapi.json", Summary: "This OpenAPI document", Public: true,
+		Responses: map[int]any{200: nil},
+	},
+	{
+		Method: http.MethodGet, Path: "/docs", Summary: "Human-readable API reference (HTML)", Public: true,
+		Responses: map[int]any{200: nil},
+	},
+	{
+		Method: http.MethodPost, Path: "/keys/save", Summary: "Upload a file key (encrypted at rest with the master key)",
+		Request: SaveKeyRequest{},
+		Responses: map[int]any{
+			200: SaveKeyResponse{},
+			400: SaveKeyResponse{},
+			403: SaveKeyResponse{},
+			409: SaveKeyResponse{},
+			500: SaveKeyResponse{},
+		},
+	},
+	{
+		Method: http.MethodGet, Path: "/keys/get", Summary: "Retrieve a key by file hash (403 on a primary port started with --disable-reads)",
+		ReadOnly: true,
+		Params: []Param{
+			{Name: "hash", Doc: "SHA-256 of the file ciphertext (hex)", Required: true},
+			{Name: "node_id", Doc: "Requesting node's NodeID, checked by the foreign-node and retrieval-rate alert rules"},
+		},
+		Responses: map[int]any{
+			200: GetKeyResponse{},
+			202: GetKeyResponse{},
+			400: GetKeyResponse{},
+			403: GetKeyResponse{},
+			404: GetKeyResponse{},
+			410: GetKeyResponse{},
+			429: GetKeyResponse{},
+			500: GetKeyResponse{},
+		},
+	},
+	{
+		Method: http.MethodGet, Path: "/keys/approvals/{id}",
+		Summary: "Poll a bulk-retrieval approval that /keys/get answered 202 with (requesting token only). " +
+			"Once approved, repeat the /keys/get calls for its hashes",
+		ReadOnly: true,
+		Params:   []Param{{Name: "id", Doc: "Approval ID from the 202 response", Required: true, Path: true}},
+		Responses: map[int]any{
+			200: ApprovalResponse{},
+			404: ErrorResponse{},
+			500: ErrorResponse{},
+		},
+	},
+	{
+		Method: http.MethodGet, Path: "/keys/list", Summary: "List keys saved by a node (403 on a primary port started with --disable-reads)",
+		ReadOnly: true,
+		Params:   []Param{{Name: "node_id", Doc: "Saving node's NodeID", Required: true}},
+		Responses: map[int]any{
+			200: ListKeysResponse{},
+			400: ErrorResponse{},
+			403: ErrorResponse{},
+			500: ErrorResponse{},
+		},
+	},
+	{
+		Method: http.MethodDelete, Path: "/keys/delete", Summary: "Delete a key (only by the node that saved it)",
+		Params: []Param{
+			{Name: "hash", Doc: "SHA-256 of the file ciphertext (hex)", Required: true},
+			{Name: "node_id", Doc: "Saving node's NodeID", Required: true},
+		},
+		Responses: map[int]any{
+			200: DeleteKeyResponse{},
+			400: ErrorResponse{},
+			404: ErrorResponse{},
+			500: ErrorResponse{},
+		},
+	},
+	{
+		Method: http.MethodPost, Path: "/keys/revoke", Summary: "Soft-delete a key (only by the node that saved it): /keys/get answers 410, the row is kept for admin export",
+		Params: []Param{
+			{Name: "hash", Doc: "SHA-256 of the file ciphertext (hex)", Required: true},
+			{Name: "node_id", Doc: "Saving node's NodeID", Required: true},
+		},
+		Responses: map[int]any{
+			200: RevokeKeyResponse{},
+			400: ErrorResponse{},
+			404: ErrorResponse{},
+			500: ErrorResponse{},
+		},
+	},
+	{
+		Method: http.MethodGet, Path: "/admin/approvals", Summary: "List bulk-retrieval approvals. Admin token only",
+		Params: []Param{{Name: "state", Doc: "pending | approved | denied | expired (default: all)"}},
+		Responses: map[int]any{
+			200: ListApprovalsResponse{},
+			403: ErrorResponse{},
+			500: ErrorResponse{},
+		},
+	},
+	{
+		Method: http.MethodPost, Path: "/admin/approvals/{id}/approve",
+		Summary: "Approve a pending bulk retrieval. The requesting token can't approve its own request; " +
+			"the keys are released once the policy's number of distinct admin tokens approved. Admin token only",
+		Params:  []Param{{Name: "id", Doc: "Approval ID", Required: true, Path: true}},
+		Request: DecideApprovalRequest{},
+		Responses: map[int]any{
+			200: ApprovalResponse{},
+			403: ErrorResponse{},
+			404: ErrorResponse{},
+			409: ErrorResponse{},
+			500: ErrorResponse{},
+		},
+	},
+	{
+		Method: http.MethodPost, Path: "/admin/approvals/{id}/deny",
+		Summary: "Deny a pending bulk retrieval; its hashes answer 403 to the requester until the request would have lapsed. Admin token only",
+		Params:  []Param{{Name: "id", Doc: "Approval ID", Required: true, Path: true}},
+		Request: DecideApprovalRequest{},
+		Responses: map[int]any{
+			200: ApprovalResponse{},
+			403: ErrorResponse{},
+			404: ErrorResponse{},
+			409: ErrorResponse{},
+			500: ErrorResponse{},
+		},
+	},
+	{
+		Method: http.MethodGet, Path: "/admin/approvals/audit", Summary: "Approval audit log, newest first. Admin token only",
+		Params: []Param{{Name: "limit", Doc: "Records to return (default 100, at most 1000)"}},
+		Responses: map[int]any{
+			200: ApprovalAuditResponse{},
+			400: ErrorResponse{},
+			403: ErrorResponse{},
+			500: ErrorResponse{},
+		},
+	},
+	{
+		Method: http.MethodGet, Path: "/admin/approval-policy", Summary: "Current bulk-retrieval policy. Admin token only",
+		Responses: map[int]any{
+			200: ApprovalPolicy{},
+			403: ErrorResponse{},
+		},
+	},
+	{
+		Method: http.MethodPut, Path: "/admin/approval-policy", Summary: "Replace the bulk-retrieval policy (persisted, audited). Admin token only",
+		Request: ApprovalPolicy{},
+		Responses: map[int]any{
+			200: ApprovalPolicy{},
+			400: ErrorResponse{},
+			403: ErrorResponse{},
+			500: ErrorResponse{},
+		},
+	},
+	{
+		Method: http.MethodGet, Path: "/admin/incidents", Summary: "Declared incidents and the one auto-approving now. Admin token only",
+		Responses: map[int]any{
+			200: IncidentsResponse{},
+			403: ErrorResponse{},
+			500: ErrorResponse{},
+		},
+	},
+	{
+		Method: http.MethodPost, Path: "/admin/incidents",
+		Summary: "Declare an incident: until it ends, retrievals over the threshold are released at once and audited. Admin token only",
+		Request: DeclareIncidentRequest{},
+		Responses: map[int]any{
+			200: IncidentsResponse{},
+			400: ErrorResponse{},
+			403: ErrorResponse{},
+			500: ErrorResponse{},
+		},
+	},
+	{
+		Method: http.MethodPost, Path: "/admin/incidents/{id}/end", Summary: "End an incident's auto-approval window now. Admin token only",
+		Params: []Param{{Name: "id", Doc: "Incident ID", Required: true, Path: true}},
+		Responses: map[int]any{
+			200: IncidentsResponse{},
+			403: ErrorResponse{},
+			404: ErrorResponse{},
+			500: ErrorResponse{},
+		},
+	},
+	{
+		Method: http.MethodGet, Path: "/admin/alerts", Summary: "Retrieval alerts (dormant key, retrieval rate, foreign node), newest first. Admin token only",
+		Params: []Param{
+			{Name: "since", Doc: "Only alerts after this time (RFC 3339)"},
+			{Name: "acknowledged", Doc: "true or false (default: both)"},
+		},
+		Responses: map[int]any{
+			200: AlertsResponse{},
+			400: ErrorResponse{},
+			403: ErrorResponse{},
+			500: ErrorResponse{},
+		},
+	},
+	{
+		Method: http.MethodPost, Path: "/admin/alerts/{id}/ack", Summary: "Acknowledge an alert (audited; the first acknowledgement is kept). Admin token only",
+		Params: []Param{{Name: "id", Doc: "Alert ID", Required: true, Path: true}},
+		Responses: map[int]any{
+			200: AlertResponse{},
+			403: ErrorResponse{},
+			404: ErrorResponse{},
+			500: ErrorResponse{},
+		},
+	},
+	{
+		Method: http.MethodPost, Path: "/admin/export-wrapped",
+		Summary: "Stream every stored key wrapped to an offline recovery public key, as NDJSON (one record per line). " +
+			"Body: PEM public key (RSA or X25519), or empty to use the server's --recovery-pubkey. Admin token only; audited and rate-limited",
+		Params: []Param{
+			{Name: "confirm", Doc: "First 16 hex chars of SHA-256 over the recovery key's DER (PKIX) encoding", Required: true},
+			{Name: "org", Doc: "Only export this org (default: all)"},
+		},
+		Responses: map[int]any{
+			200: WrappedKeyRecord{},
+			400: ErrorResponse{},
+			403: ErrorResponse{},
+			429: ErrorResponse{},
+			500: ErrorResponse{},
+		},
+	},
+}
@@ -0,0 +1,219 @@
+// Package keysaverclient holds the keysaver-server wire types and a small Go
+// client for them. The server's OpenAPI document is generated from these
+// structs (see cmd/genopenapi), so the `json` and `doc` tags are the API
+// contract.
+package keysaverclient
+
+import "time"
+
+// FileKeyRecord is one stored key as returned by /keys/list.
+type FileKeyRecord struct {
+	ID           int64      `json:"id" doc:"Row ID"`
+	FileHash     string     `json:"file_hash" doc:"SHA-256 of the file ciphertext (hex)"`
+	OriginNodeID string     `json:"origin_node_id" doc:"Node that saved the key"`
+	OrgID        string     `json:"org_id,omitempty" doc:"Organization the key belongs to"`
+	KeyB64       string     `json:"key_b64,omitempty" doc:"Decrypted key (only in single-key responses)"`
+	FileName     string     `json:"file_name" doc:"Original file name"`
+	CreatedAt    time.Time  `json:"created_at" doc:"When the key was first saved"`
+	RevokedAt    *time.Time `json:"revoked_at,omitempty" doc:"When the key was revoked (soft-deleted); absent while live"`
+	// LastRetrievedAt feeds the dormant-key alert rule
+	LastRetrievedAt *time.Time `json:"last_retrieved_at,omitempty" doc:"When /keys/get last released the key; absent if never"`
+	Confirmation    string     `json:"confirmation,omitempty" doc:"Escrow confirmation of the stored key, as /keys/save returned it (live keys in /keys/list only)"`
+	VerifiedAt      *time.Time `json:"verified_at,omitempty" doc:"When the stored key was saved with verified:true; absent if the node didn't prove it"`
+}
+
+// SaveKeyRequest is the request body for /keys/save
+type SaveKeyRequest struct {
+	FileHash string `json:"hash" doc:"SHA-256 of the file ciphertext (hex)" required:"true"`
+	KeyB64   string `json:"key_b64" doc:"Base64-encoded raw key" required:"true"`
+	NodeID   string `json:"node_id" doc:"Saving node's NodeID" required:"true"`
+	FileName string `json:"name" doc:"Original file name"`
+	OrgID    string `json:"org_id,omitempty" doc:"Must match the token's org if it is bound"`
+	Verified bool   `json:"verified,omitempty" doc:"The node decrypted its local chunk with this key before saving it"`
+}
+
+// SaveKeyResponse is the response for /keys/save
+type SaveKeyResponse struct {
+	Status       string `json:"status" doc:"ok | error"`
+	FileHash     string `json:"hash" doc:"Echo of the saved hash"`
+	Message      string `json:"message,omitempty" doc:"Error detail"`
+	Confirmation string `json:"confirmation,omitempty" doc:"HMAC over org, hash, origin node and key; /keys/list repeats it while the stored key is unchanged"`
+}
+
+// GetKeyResponse is the response for /keys/get
+type GetKeyResponse struct {
+	Status    string     `json:"status" doc:"ok | not_found | revoked | error"`
+	FileHash  string     `json:"hash" doc:"Requested hash"`
+	KeyB64    string     `json:"key_b64,omitempty" doc:"Base64-encoded raw key"`
+	FileName  string     `json:"name,omitempty" doc:"Original file name"`
+	NodeID    string     `json:"node_id,omitempty" doc:"Node that saved the key"`
+	Error     string     `json:"error,omitempty" doc:"Error detail"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty" doc:"When the key was revoked (status revoked)"`
+	// bulk retrieval over the policy threshold waits for an admin
+	ApprovalID string `json:"approval_id,omitempty" doc:"Approval to poll at /keys/approvals/{id} (status pending_approval or denied)"`
+}
+
+// ListKeysResponse is the response for /keys/list
+type ListKeysResponse struct {
+	Status string          `json:"status" doc:"ok"`
+	NodeID string          `json:"node_id" doc:"Requested NodeID"`
+	Count  int             `json:"count" doc:"Number of keys"`
+	Keys   []FileKeyRecord `json:"keys" doc:"Keys saved by the node, newest first (without key material)"`
+}
+
+// DeleteKeyResponse is the response for /keys/delete
+type DeleteKeyResponse struct {
+	Status string `json:"status" doc:"ok"`
+	Hash   string `json:"hash" doc:"Deleted hash"`
+}
+
+// RevokeKeyResponse is the response for /keys/revoke
+type RevokeKeyResponse struct {
+	Status    string    `json:"status" doc:"ok"`
+	Hash      string    `json:"hash" doc:"Revoked hash"`
+	RevokedAt time.Time `json:"revoked_at" doc:"When the key was revoked (the first revocation if repeated)"`
+}
+
+// WrappedKeyRecord is one NDJSON line of /admin/export-wrapped: a stored key
+// re-encrypted to the offline recovery public key.
+type WrappedKeyRecord struct {
+	FileHash      string    `json:"file_hash" doc:"SHA-256 of the file ciphertext (hex)"`
+	NodeID        string    `json:"node_id" doc:"Node that saved the key"`
+	FileName      string    `json:"file_name" doc:"Original file name"`
+	OrgID         string    `json:"org_id,omitempty" doc:"Organization the key belongs to"`
+	Alg           string    `json:"alg" doc:"rsa-oaep-sha256 | x25519-xchacha20poly1305"`
+	WrappedKeyB64 string    `json:"wrapped_key_b64" doc:"Key wrapped to the recovery public key (std base64); file_hash is bound as label/AAD"`
+	WrappedAt     time.Time `json:"wrapped_at" doc:"When this record was produced"`
+}
+
+// HealthResponse is the response for /health
+type HealthResponse struct {
+	Status  string        `json:"status" doc:"ok, or fail when a deep check failed (HTTP 503)"`
+	Service string        `json:"service" doc:"Always keysaver-server"`
+	Checks  []HealthCheck `json:"checks,omitempty" doc:"Per-check results (deep=true only)"`
+}
+
+// HealthCheck is one check of /health?deep=true.
+type HealthCheck struct {
+	Name   string `json:"name" doc:"write | decrypt | disk | wal"`
+	Status string `json:"status" doc:"ok | fail | skipped"`
+	Detail string `json:"detail,omitempty" doc:"What was checked, or why it failed"`
+	Bytes  int64  `json:"bytes,omitempty" doc:"Free bytes (disk) or log size (wal)"`
+}
+
+// ErrorResponse is the body of most non-2xx responses.
+type ErrorResponse struct {
+	Status string `json:"status,omitempty" doc:"error | not_found"`
+	Error  string `json:"error" doc:"Human-readable reason"`
+}
+
+// Approval is a bulk-retrieval request held for dual control: a token that
+// fetches more keys per hour than the policy allows gets its further keys
+// only after admins other than the requester approve.
+type Approval struct {
+	ID        string     `json:"id" doc:"Approval ID"`
+	Token     string     `json:"token" doc:"Fingerprint of the requesting token (first 8 hex of its SHA-256)"`
+	OrgID     string     `json:"org_id,omitempty" doc:"Org the requesting token is bound to"`
+	State     string     `json:"state" doc:"pending | approved | denied | expired"`
+	Hashes    []string   `json:"hashes" doc:"Hashes asked for while pending; approval releases exactly these"`
+	Approvers []string   `json:"approvers,omitempty" doc:"Fingerprints of the admin tokens that approved"`
+	DeniedBy  string     `json:"denied_by,omitempty" doc:"Fingerprint of the admin token that denied"`
+	Reason    string     `json:"reason,omitempty" doc:"Note given with the decision"`
+	CreatedAt time.Time  `json:"created_at" doc:"When the threshold was crossed"`
+	ExpiresAt time.Time  `json:"expires_at" doc:"Pending: when the request lapses. Approved: end of the release window"`
+	DecidedAt *time.Time `json:"decided_at,omitempty" doc:"When it was approved or denied"`
+}
+
+// ApprovalResponse is the response for /keys/approvals/{id} and the
+// approve / deny endpoints.
+type ApprovalResponse struct {
+	Status   string   `json:"status" doc:"ok"`
+	Approval Approval `json:"approval" doc:"The approval after the call"`
+}
+
+// ListApprovalsResponse is the response for /admin/approvals
+type ListApprovalsResponse struct {
+	Status    string     `json:"status" doc:"ok"`
+	Count     int        `json:"count" doc:"Number of approvals"`
+	Approvals []Approval `json:"approvals" doc:"Newest first"`
+}
+
+// DecideApprovalRequest is the optional body of the approve / deny endpoints.
+type DecideApprovalRequest struct {
+	Reason string `json:"reason,omitempty" doc:"Note kept in the approval and the audit log"`
+}
+
+// ApprovalPolicy is the bulk-retrieval policy, persisted in the database.
+type ApprovalPolicy struct {
+	ThresholdPerHour int    `json:"threshold_per_hour" doc:"Keys one token may fetch per hour before approval is needed (0 = off)"`
+	Approvers        int    `json:"approvers" doc:"Distinct admin tokens that must approve"`
+	PendingTTL       string `json:"pending_ttl" doc:"How long a request waits for approval, e.g. 24h"`
+	GrantTTL         string `json:"grant_ttl" doc:"How long approved keys can be fetched, e.g. 1h"`
+}
+
+// Incident is a declared incident: while it lasts, retrievals over the
+// threshold are released at once and audited instead of waiting.
+type Incident struct {
+	ID         int64     `json:"id" doc:"Incident ID"`
+	Reason     string    `json:"reason" doc:"Why it was declared"`
+	DeclaredBy string    `json:"declared_by" doc:"Fingerprint of the declaring admin token"`
+	StartsAt   time.Time `json:"starts_at" doc:"Declared at"`
+	EndsAt     time.Time `json:"ends_at" doc:"Auto-approval stops at"`
+}
+
+// DeclareIncidentRequest is the request body for POST /admin/incidents
+type DeclareIncidentRequest struct {
+	Reason   string `json:"reason" doc:"Why bulk retrieval is expected" required:"true"`
+	Duration string `json:"duration" doc:"Auto-approval window, e.g. 4h (at most 72h)" required:"true"`
+}
+
+// IncidentsResponse is the response for /admin/incidents
+type IncidentsResponse struct {
+	Status    string     `json:"status" doc:"ok"`
+	Active    *Incident  `json:"active,omitempty" doc:"The incident auto-approving now, if any"`
+	Incidents []Incident `json:"incidents" doc:"Recent incidents, newest first"`
+}
+
+// ApprovalAuditRecord is one line of the approval audit log.
+type ApprovalAuditRecord struct {
+	At         time.Time `json:"at" doc:"When"`
+	ApprovalID string    `json:"approval_id,omitempty" doc:"Approval concerned"`
+	Action     string    `json:"action" doc:"request | approve | deny | release | expire | auto-release | incident | incident-end | policy"`
+	Actor      string    `json:"actor" doc:"Token fingerprint of whoever acted (requester or admin)"`
+	Detail     string    `json:"detail,omitempty" doc:"Hash, reason or new policy"`
+}
+
+// ApprovalAuditResponse is the response for /admin/approvals/audit
+type ApprovalAuditResponse struct {
+	Status  string                `json:"status" doc:"ok"`
+	Records []ApprovalAuditRecord `json:"records" doc:"Newest first"`
+}
+
+// Alert is one retrieval that tripped an alert rule.
+type Alert struct {
+	ID           int64      `json:"id" doc:"Alert ID"`
+	At           time.Time  `json:"at" doc:"When the key was released"`
+	Rule         string     `json:"rule" doc:"dormant_key | retrieval_rate | foreign_node"`
+	OrgID        string     `json:"org_id,omitempty" doc:"Org of the requesting token"`
+	FileHash     string     `json:"file_hash" doc:"Key released"`
+	FileName     string     `json:"file_name,omitempty" doc:"Original file name"`
+	NodeID       string     `json:"node_id,omitempty" doc:"Requesting node, as sent in node_id"`
+	OriginNodeID string     `json:"origin_node_id" doc:"Node that saved the key"`
+	Token        string     `json:"token" doc:"Fingerprint of the requesting token"`
+	Detail       string     `json:"detail" doc:"Why the rule fired"`
+	AckedAt      *time.Time `json:"acked_at,omitempty" doc:"When an admin acknowledged it"`
+	AckedBy      string     `json:"acked_by,omitempty" doc:"Fingerprint of the acknowledging admin token"`
+}
+
+// AlertsResponse is the response for /admin/alerts
+type AlertsResponse struct {
+	Status string  `json:"status" doc:"ok"`
+	Count  int     `json:"count" doc:"Number of alerts"`
+	Alerts []Alert `json:"alerts" doc:"Newest first (at most 1000)"`
+}
+
+// AlertResponse is the response for /admin/alerts/{id}/ack
+type AlertResponse struct {
+	Status string `json:"status" doc:"ok"`
+	Alert  Alert  `json:"alert" doc:"The alert after the call"`
+}
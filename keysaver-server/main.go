@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
 	"time"
@@ -22,12 +23,66 @@ func main() {
 	flag.StringVar(&cfg.KeyFile, "key", cfg.KeyFile, "TLS private key file")
 
 	var authTokensFlag string
-	flag.StringVar(&authTokensFlag, "tokens", "", "Comma-separated API tokens (empty = no auth)")
+	flag.StringVar(&authTokensFlag, "tokens", "", "Comma-separated API tokens, optionally bound to an org as token@org (empty = no auth)")
+
+	// Read/write split: a second listener for recovery reads
+	var readTokensFlag string
+	flag.IntVar(&cfg.ReadOnlyPort, "readonly-port", 0, "Second port serving only /keys/get, /keys/list and /health (0 = off)")
+	flag.StringVar(&readTokensFlag, "read-tokens", "", "Comma-separated tokens for the read-only port, optionally token@org (empty = no auth)")
+	flag.BoolVar(&cfg.DisableReads, "disable-reads", false, "Refuse /keys/get and /keys/list on the primary port")
 
 	var httpMode bool
 	flag.BoolVar(&httpMode, "http", false, "Use HTTP instead of HTTPS (dev only)")
 
+	// Disaster recovery export
+	var adminTokensFlag, recoveryPubFlag string
+	flag.StringVar(&adminTokensFlag, "admin-tokens", "", "Comma-separated tokens for /admin/* endpoints (empty = admin endpoints disabled)")
+	flag.StringVar(&recoveryPubFlag, "recovery-pubkey", "", "PEM file with the offline recovery public key (RSA >= 3072 or X25519)")
+	flag.DurationVar(&cfg.ExportInterval, "export-interval", cfg.ExportInterval, "Minimum time between two wrapped-key exports")
+
+	// Dual control for bulk key retrieval
+	flag.IntVar(&cfg.Approval.ThresholdPerHour, "bulk-threshold", cfg.Approval.ThresholdPerHour, "Keys one token may fetch per hour before further ones need admin approval (0 = off)")
+	flag.IntVar(&cfg.Approval.Approvers, "bulk-approvers", cfg.Approval.Approvers, "Distinct admin tokens that must approve a bulk retrieval")
+	flag.StringVar(&cfg.Approval.PendingTTL, "bulk-pending-ttl", cfg.Approval.PendingTTL, "How long a bulk retrieval waits for approval")
+	flag.StringVar(&cfg.Approval.GrantTTL, "bulk-grant-ttl", cfg.Approval.GrantTTL, "How long approved keys can be fetched")
+
+	// Retrieval alerts
+	flag.IntVar(&cfg.Alerts.DormantDays, "alert-dormant-days", cfg.Alerts.DormantDays, "Alert on the first retrieval of a key not fetched for this many days (0 = off)")
+	flag.IntVar(&cfg.Alerts.PerHour, "alert-per-hour", cfg.Alerts.PerHour, "Alert when one node (or token) fetches more keys than this per hour (0 = off)")
+	flag.BoolVar(&cfg.Alerts.ForeignNode, "alert-foreign-node", cfg.Alerts.ForeignNode, "Alert when a node fetches a key another node saved")
+	flag.StringVar(&cfg.Alerts.Webhook, "alert-webhook", "", "URL to POST each alert to (empty = store only)")
+	flag.StringVar(&cfg.Alerts.WebhookSecret, "alert-webhook-secret", "", "HMAC-SHA256 secret signing alert webhooks (X-Keysaver-Signature)")
+
+	flag.Int64Var(&cfg.HealthMinFree, "health-min-free", cfg.HealthMinFree, "Free bytes next to the database below which /health?deep=true fails (0 = don't check)")
+
+	// Offline mode: unwrap an export with the recovery private key, then exit
+	var unwrapExport, recoveryKey, unwrapHashes string
+	flag.StringVar(&unwrapExport, "unwrap-export", "", "Offline: NDJSON export file to unwrap (needs --recovery-key)")
+	flag.StringVar(&recoveryKey, "recovery-key", "", "Offline: PEM recovery private key")
+	flag.StringVar(&unwrapHashes, "hashes", "", "Offline: comma-separated file hashes to unwrap (empty = all)")
+
 	flag.Parse()
+	flag.Visit(func(f *flag.Flag) {
+		if strings.HasPrefix(f.Name, "bulk-") {
+			cfg.ApprovalFlags = true
+		}
+	})
+
+	if unwrapExport != "" {
+		if recoveryKey == "" {
+			log.Fatal("--unwrap-export needs --recovery-key")
+		}
+		wanted := map[string]bool{}
+		for _, h := range strings.Split(unwrapHashes, ",") {
+			if h = strings.TrimSpace(h); h != "" {
+				wanted[h] = true
+			}
+		}
+		if err := runUnwrapExport(unwrapExport, recoveryKey, wanted, os.Stdout); err != nil {
+			log.Fatalf("unwrap: %v", err)
+		}
+		return
+	}
 
 	// Environment variable overrides
 	if envMaster := os.Getenv("KEYSAVER_MASTER_KEY"); envMaster != "" {
@@ -36,6 +91,15 @@ func main() {
 	if envTokens := os.Getenv("KEYSAVER_TOKENS"); envTokens != "" {
 		authTokensFlag = envTokens
 	}
+	if envAdmin := os.Getenv("KEYSAVER_ADMIN_TOKENS"); envAdmin != "" {
+		adminTokensFlag = envAdmin
+	}
+	if envRead := os.Getenv("KEYSAVER_READ_TOKENS"); envRead != "" {
+		readTokensFlag = envRead
+	}
+	if envAlert := os.Getenv("KEYSAVER_ALERT_SECRET"); envAlert != "" {
+		cfg.Alerts.WebhookSecret = envAlert
+	}
 
 	// Validate master key
 	if cfg.MasterKey == "" {
@@ -52,6 +116,44 @@ func main() {
 	} else {
 		log.Printf("[auth] WARNING: No API tokens configured, running in open mode")
 	}
+	for _, t := range strings.Split(adminTokensFlag, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			cfg.AdminTokens = append(cfg.AdminTokens, t)
+		}
+	}
+	if len(cfg.AdminTokens) > 0 {
+		log.Printf("[auth] %d admin tokens configured", len(cfg.AdminTokens))
+	}
+	for _, t := range strings.Split(readTokensFlag, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			cfg.ReadTokens = append(cfg.ReadTokens, t)
+		}
+	}
+	if cfg.ReadOnlyPort != 0 {
+		if cfg.ReadOnlyPort == cfg.Port {
+			log.Fatal("--readonly-port must differ from --port")
+		}
+		if len(cfg.ReadTokens) > 0 {
+			log.Printf("[auth] %d read tokens configured for :%d", len(cfg.ReadTokens), cfg.ReadOnlyPort)
+		} else {
+			log.Printf("[auth] WARNING: No read tokens configured, read-only port :%d is open", cfg.ReadOnlyPort)
+		}
+	}
+	if cfg.DisableReads {
+		log.Printf("[auth] reads disabled on the primary port")
+	}
+	if recoveryPubFlag != "" {
+		b, err := os.ReadFile(recoveryPubFlag)
+		if err != nil {
+			log.Fatalf("Failed to read recovery public key: %v", err)
+		}
+		rk, err := parseRecoveryPubKey(b)
+		if err != nil {
+			log.Fatalf("Invalid recovery public key: %v", err)
+		}
+		cfg.RecoveryPubKey = string(b)
+		log.Printf("[recovery] export key fingerprint %s", rk.fp)
+	}
 
 	// Initialize storage
 	storage, err := NewStorage(cfg.DBPath, cfg.MasterKey)
@@ -63,53 +165,91 @@ func main() {
 
 	// Create server
 	srv := NewServer(storage, cfg)
-	handler := srv.Handler()
+	// a master key that can't open what's stored would hand out garbage
+	for _, c := range srv.deepHealth().Checks {
+		switch {
+		case c.Name == "decrypt" && c.Status == healthFail:
+			log.Fatalf("[health] %s; refusing to serve", c.Detail)
+		case c.Status == healthFail:
+			log.Printf("[health] WARNING: %s check failed: %s", c.Name, c.Detail)
+		}
+	}
+	if err := srv.loadApprovalPolicy(cfg.Approval, cfg.ApprovalFlags); err != nil {
+		log.Fatalf("Bulk retrieval policy: %v", err)
+	}
+	if p := srv.approvals.policy; p.threshold > 0 {
+		log.Printf("[approvals] bulk retrieval over %d keys/hour per token needs %d admin approval(s)", p.threshold, p.approvers)
+		if len(cfg.AdminTokens) == 0 {
+			log.Printf("[approvals] WARNING: no admin tokens configured, so nobody can approve bulk retrievals")
+		}
+	}
+
+	if cfg.Alerts.DormantDays < 0 || cfg.Alerts.PerHour < 0 {
+		log.Fatal("--alert-dormant-days and --alert-per-hour must not be negative")
+	}
+	if cfg.Alerts.Webhook != "" {
+		if u, err := url.Parse(cfg.Alerts.Webhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			log.Fatalf("--alert-webhook must be an http(s) URL, got %q", cfg.Alerts.Webhook)
+		}
+		if cfg.Alerts.WebhookSecret == "" {
+			log.Printf("[alert] WARNING: --alert-webhook without --alert-webhook-secret sends unsigned alerts")
+		}
+	}
+
+	if cfg.ReadOnlyPort != 0 {
+		go serve(newHTTPServer(cfg.ReadOnlyPort, srv.ReadOnlyHandler()), "read-only", httpMode, cfg)
+	}
+	serve(newHTTPServer(cfg.Port, srv.Handler()), "primary", httpMode, cfg)
+}
 
-	// HTTP server configuration
-	httpSrv := &http.Server{
-		Addr:              fmt.Sprintf(":%d", cfg.Port),
+func newHTTPServer(port int, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              fmt.Sprintf(":%d", port),
 		Handler:           handler,
 		ReadHeaderTimeout: 10 * time.Second,
 		ReadTimeout:       30 * time.Second,
 		WriteTimeout:      30 * time.Second,
 		IdleTimeout:       60 * time.Second,
 	}
+}
 
+// serve runs one listener until it fails, which ends the process.
+func serve(httpSrv *http.Server, name string, httpMode bool, cfg *Config) {
 	if httpMode {
 		// Development mode: plain HTTP
-		log.Printf("[server] starting HTTP server on :%d (DEV MODE)", cfg.Port)
+		log.Printf("[server] starting %s HTTP server on %s (DEV MODE)", name, httpSrv.Addr)
 		if err := httpSrv.ListenAndServe(); err != nil {
-			log.Fatalf("HTTP server error: %v", err)
-		}
-	} else {
-		// Production mode: HTTPS with TLS
-		// Check if cert files exist
-		if _, err := os.Stat(cfg.CertFile); os.IsNotExist(err) {
-			log.Printf("[tls] Certificate file not found: %s", cfg.CertFile)
-			log.Printf("[tls] To generate a self-signed cert for testing:")
-			log.Printf("      openssl req -x509 -newkey rsa:4096 -keyout server.key -out server.crt -days 365 -nodes -subj '/CN=localhost'")
-			log.Fatal("[tls] Cannot start HTTPS server without certificates")
-		}
-
-		// TLS configuration with modern security settings
-		// Include AES_128_GCM ciphers required for HTTP/2
-		tlsConfig := &tls.Config{
-			MinVersion:               tls.VersionTLS12,
-			PreferServerCipherSuites: true,
-			CipherSuites: []uint16{
-				tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
-				tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
-				tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
-				tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
-				tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
-				tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
-			},
-		}
-		httpSrv.TLSConfig = tlsConfig
-
-		log.Printf("[server] starting HTTPS server on :%d", cfg.Port)
-		if err := httpSrv.ListenAndServeTLS(cfg.CertFile, cfg.KeyFile); err != nil {
-			log.Fatalf("HTTPS server error: %v", err)
+			log.Fatalf("HTTP server error (%s): %v", name, err)
 		}
+		return
+	}
+	// Production mode: HTTPS with TLS
+	// Check if cert files exist
+	if _, err := os.Stat(cfg.CertFile); os.IsNotExist(err) {
+		log.Printf("[tls] Certificate file not found: %s", cfg.CertFile)
+		log.Printf("[tls] To generate a self-signed cert for testing:")
+		log.Printf("      openssl req -x509 -newkey rsa:4096 -keyout server.key -out server.crt -days 365 -nodes -subj '/CN=localhost'")
+		log.Fatal("[tls] Cannot start HTTPS server without certificates")
+	}
+
+	// TLS configuration with modern security settings
+	// Include AES_128_GCM ciphers required for HTTP/2
+	tlsConfig := &tls.Config{
+		MinVersion:               tls.VersionTLS12,
+		PreferServerCipherSuites: true,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+		},
+	}
+	httpSrv.TLSConfig = tlsConfig
+
+	log.Printf("[server] starting %s HTTPS server on %s", name, httpSrv.Addr)
+	if err := httpSrv.ListenAndServeTLS(cfg.CertFile, cfg.KeyFile); err != nil {
+		log.Fatalf("HTTPS server error (%s): %v", name, err)
 	}
 }
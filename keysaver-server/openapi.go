@@ -0,0 +1,114 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+//go:generate go run ./cmd/genopenapi -o openapi.json
+
+// openapiSpec is generated from keysaverclient's structs; never edit it by hand.
+//
+//go:embed openapi.json
+var openapiSpec []byte
+
+// GET /openapi.json
+func (s *Server) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openapiSpec)
+}
+
+type docsOp struct {
+	Method, Path, Summary string
+	Public, ReadOnly      bool
+	Params                []map[string]any
+	Request               string
+	Responses             []string
+}
+
+var docsTmpl = template.Must(template.New("docs").Parse(`<!doctype html>
+<html><head><meta charset="utf-8"><title>keysaver-server API</title>
+<style>body{font-family:sans-serif;max-width:60em;margin:2em auto}code{background:#eee;padding:0 .3em}
+.op{border-top:1px solid #ccc;padding:.5em 0}.m{font-weight:bold;display:inline-block;width:5em}</style></head>
+<body><h1>keysaver-server API</h1>
+<p>Authenticate with <code>Authorization: Bearer &lt;token&gt;</code> unless marked public.
+Machine-readable spec: <a href="/openapi.json">/openapi.json</a>.</p>
+{{range .}}<div class="op"><span class="m">{{.Method}}</span><code>{{.Path}}</code>{{if .Public}} (public){{end}}{{if .ReadOnly}} (also on read-only port){{end}}
+<p>{{.Summary}}</p>
+{{if .Params}}<ul>{{range .Params}}<li><code>{{.name}}</code>{{if .required}} (required){{end}} — {{.description}}</li>{{end}}</ul>{{end}}
+{{if .Request}}<p>Body: <code>{{.Request}}</code></p>{{end}}
+<p>Responses: {{range .Responses}}<code>{{.}}</code> {{end}}</p></div>
+{{end}}</body></html>
+`))
+
+// GET /docs renders the embedded spec as a single HTML page.
+func (s *Server) handleDocs(w http.ResponseWriter, r *http.Request) {
+	var spec struct {
+		Paths map[string]map[string]struct {
+			Summary     string           `json:"summary"`
+			Security    []any            `json:"security"`
+			ReadOnly    bool             `json:"x-readonly-listener"`
+			Parameters  []map[string]any `json:"parameters"`
+			RequestBody struct {
+				Content map[string]struct {
+					Schema map[string]any `json:"schema"`
+				} `json:"content"`
+			} `json:"requestBody"`
+			Responses map[string]struct {
+				Content map[string]struct {
+					Schema map[string]any `json:"schema"`
+				} `json:"content"`
+			} `json:"responses"`
+		} `json:"paths"`
+	}
+	if err := json.Unmarshal(openapiSpec, &spec); err != nil {
+		log.Printf("[docs] bad embedded spec: %v", err)
+		http.Error(w, "spec unavailable", http.StatusInternalServerError)
+		return
+	}
+	var ops []docsOp
+	for path, item := range spec.Paths {
+		for method, op := range item {
+			d := docsOp{
+				Method:   strings.ToUpper(method),
+				Path:     path,
+				Summary:  op.Summary,
+				Public:   op.Security != nil && len(op.Security) == 0,
+				ReadOnly: op.ReadOnly,
+				Params:   op.Parameters,
+			}
+			if c, ok := op.RequestBody.Content["application/json"]; ok {
+				d.Request = schemaName(c.Schema)
+			}
+			for code, resp := range op.Responses {
+				label := code
+				if c, ok := resp.Content["application/json"]; ok {
+					label += " " + schemaName(c.Schema)
+				}
+				d.Responses = append(d.Responses, label)
+			}
+			sort.Strings(d.Responses)
+			ops = append(ops, d)
+		}
+	}
+	sort.Slice(ops, func(i, j int) bool {
+		if ops[i].Path != ops[j].Path {
+			return ops[i].Path < ops[j].Path
+		}
+		return ops[i].Method < ops[j].Method
+	})
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := docsTmpl.Execute(w, ops); err != nil {
+		log.Printf("[docs] render: %v", err)
+	}
+}
+
+func schemaName(schema map[string]any) string {
+	ref, _ := schema["$ref"].(string)
+	return ref[strings.LastIndex(ref, "/")+1:]
+}
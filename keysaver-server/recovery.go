@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Disaster recovery export: every stored key wrapped to an offline recovery
+// public key, streamed as NDJSON. Plaintext keys exist only in memory for
+// the duration of one wrap. The matching private key never touches this
+// server; `keysaver-server --unwrap-export` uses it offline.
+
+const (
+	algRSAOAEP = "rsa-oaep-sha256"
+	algX25519  = "x25519-xchacha20poly1305"
+
+	exportBatch    = 200
+	x25519WrapInfo = "keysaver-recovery-v1"
+)
+
+// exportGate allows one export at a time and at most one per interval.
+type exportGate struct {
+	mu      sync.Mutex
+	running bool
+	last    time.Time
+}
+
+// begin reserves an export slot, or returns how long to wait.
+func (g *exportGate) begin(interval time.Duration) (time.Duration, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.running {
+		return interval, false
+	}
+	if wait := interval - time.Since(g.last); !g.last.IsZero() && wait > 0 {
+		return wait, false
+	}
+	g.running, g.last = true, time.Now()
+	return 0, true
+}
+
+func (g *exportGate) end() {
+	g.mu.Lock()
+	g.running = false
+	g.mu.Unlock()
+}
+
+// recoveryKey is a parsed recovery public key and its fingerprint.
+type recoveryKey struct {
+	rsa *rsa.PublicKey
+	x   *ecdh.PublicKey
+	fp  string // first 16 hex of sha256(PKIX DER)
+}
+
+func parseRecoveryPubKey(pemBytes []byte) (*recoveryKey, error) {
+	blk, _ := pem.Decode(pemBytes)
+	if blk == nil {
+		return nil, errors.New("no PEM block")
+	}
+	pub, err := x509.ParsePKIXPublicKey(blk.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parse public key: %w", err)
+	}
+	sum := sha256.Sum256(blk.Bytes)
+	k := &recoveryKey{fp: hex.EncodeToString(sum[:8])}
+	switch p := pub.(type) {
+	case *rsa.PublicKey:
+		if p.N.BitLen() < 3072 {
+			return nil, errors.New("RSA recovery key must be at least 3072 bits")
+		}
+		k.rsa = p
+	case *ecdh.PublicKey:
+		if p.Curve() != ecdh.X25519() {
+			return nil, errors.New("only X25519 ECDH keys are supported")
+		}
+		k.x = p
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", pub)
+	}
+	return k, nil
+}
+
+// wrap encrypts rawKey to the recovery key; fileHash is bound as the OAEP
+// label / AEAD additional data so records can't be swapped.
+func (k *recoveryKey) wrap(rawKey []byte, fileHash string) (string, []byte, error) {
+	if k.rsa != nil {
+		ct, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, k.rsa, rawKey, []byte(fileHash))
+		return algRSAOAEP, ct, err
+	}
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", nil, err
+	}
+	shared, err := eph.ECDH(k.x)
+	if err != nil {
+		return "", nil, err
+	}
+	aead, err := chacha20poly1305.NewX(x25519WrapKey(shared, eph.PublicKey().Bytes(), k.x.Bytes()))
+	if err != nil {
+		return "", nil, err
+	}
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", nil, err
+	}
+	out := append(eph.PublicKey().Bytes(), nonce...)
+	return algX25519, aead.Seal(out, nonce, rawKey, []byte(fileHash)), nil
+}
+
+func x25519WrapKey(shared, ephPub, recipPub []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte(x25519WrapInfo))
+	h.Write(shared)
+	h.Write(ephPub)
+	h.Write(recipPub)
+	return h.Sum(nil)
+}
+
+// tokenFingerprint identifies a token in audit logs without logging it.
+func tokenFingerprint(tok string) string {
+	sum := sha256.Sum256([]byte(tok))
+	return hex.EncodeToString(sum[:4])
+}
+
+// POST /admin/export-wrapped?confirm=<key fingerprint>[&org=<org>]
+func (s *Server) handleExportWrapped(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, `{"error":"method not allowed"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	pemBytes, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Status: "error", Error: err.Error()})
+		return
+	}
+	if len(pemBytes) == 0 {
+		pemBytes = []byte(s.cfg.RecoveryPubKey)
+	}
+	if len(pemBytes) == 0 {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Status: "error", Error: "no recovery public key in body and none configured"})
+		return
+	}
+	rk, err := parseRecoveryPubKey(pemBytes)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Status: "error", Error: err.Error()})
+		return
+	}
+
+	who := fmt.Sprintf("token=%s from=%s", tokenFingerprint(bearerToken(r)), r.RemoteAddr)
+	org := r.URL.Query().Get("org")
+	if r.URL.Query().Get("confirm") != rk.fp {
+		log.Printf("[audit] export-wrapped refused (bad confirm) %s key=%s", who, rk.fp)
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Status: "error", Error: "confirm must be the recovery key fingerprint (first 16 hex of sha256 over its DER)"})
+		return
+	}
+	if wait, ok := s.export.begin(s.cfg.ExportInterval); !ok {
+		log.Printf("[audit] export-wrapped refused (rate limit) %s key=%s", who, rk.fp)
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		writeJSON(w, http.StatusTooManyRequests, ErrorResponse{Status: "error", Error: "an export ran recently or is running"})
+		return
+	}
+	defer s.export.end()
+
+	log.Printf("[audit] export-wrapped START %s key=%s org=%q", who, rk.fp, org)
+	// the stream can outlast the server's WriteTimeout
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	flusher, _ := w.(http.Flusher)
+
+	n, err := s.storage.EachKey(org, exportBatch, func(rec FileKeyRecord, rawKey []byte) error {
+		alg, wrapped, err := rk.wrap(rawKey, rec.FileHash)
+		if err != nil {
+			return err
+		}
+		if err := enc.Encode(WrappedKeyRecord{
+			FileHash:      rec.FileHash,
+			NodeID:        rec.OriginNodeID,
+			FileName:      rec.FileName,
+			OrgID:         rec.OrgID,
+			Alg:           alg,
+			WrappedKeyB64: base64.StdEncoding.EncodeToString(wrapped),
+			WrappedAt:     time.Now().UTC(),
+		}); err != nil {
+			return err
+		}
+		if bw.Buffered() > 64<<10 {
+			if err := bw.Flush(); err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		return nil
+	})
+	bw.Flush()
+	if err != nil {
+		// headers are gone; a truncated stream is the signal
+		log.Printf("[audit] export-wrapped FAILED after %d keys %s: %v", n, who, err)
+		return
+	}
+	log.Printf("[audit] export-wrapped DONE %d keys %s key=%s", n, who, rk.fp)
+}
+
+// ---- offline unwrap ----
+
+func loadRecoveryPrivKey(path string) (any, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	blk, _ := pem.Decode(b)
+	if blk == nil {
+		return nil, errors.New("no PEM block in " + path)
+	}
+	if k, err := x509.ParsePKCS8PrivateKey(blk.Bytes); err == nil {
+		return k, nil
+	}
+	return x509.ParsePKCS1PrivateKey(blk.Bytes)
+}
+
+func unwrapRecord(priv any, rec WrappedKeyRecord) ([]byte, error) {
+	wrapped, err := base64.StdEncoding.DecodeString(rec.WrappedKeyB64)
+	if err != nil {
+		return nil, err
+	}
+	switch rec.Alg {
+	case algRSAOAEP:
+		k, ok := priv.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("record is RSA-wrapped, key is not RSA")
+		}
+		return rsa.DecryptOAEP(sha256.New(), nil, k, wrapped, []byte(rec.FileHash))
+	case algX25519:
+		k, ok := priv.(*ecdh.PrivateKey)
+		if !ok {
+			return nil, errors.New("record is X25519-wrapped, key is not X25519")
+		}
+		if len(wrapped) < 32+chacha20poly1305.NonceSizeX {
+			return nil, errors.New("wrapped key too short")
+		}
+		ephPub, err := ecdh.X25519().NewPublicKey(wrapped[:32])
+		if err != nil {
+			return nil, err
+		}
+		shared, err := k.ECDH(ephPub)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := chacha20poly1305.NewX(x25519WrapKey(shared, wrapped[:32], k.PublicKey().Bytes()))
+		if err != nil {
+			return nil, err
+		}
+		nonce := wrapped[32 : 32+chacha20poly1305.NonceSizeX]
+		return aead.Open(nil, nonce, wrapped[32+chacha20poly1305.NonceSizeX:], []byte(rec.FileHash))
+	default:
+		return nil, fmt.Errorf("unknown alg %q", rec.Alg)
+	}
+}
+
+// runUnwrapExport reads an export file and prints {file_hash, key_b64} for
+// the wanted hashes (all if wanted is empty). Runs offline, no server.
+func runUnwrapExport(exportPath, privPath string, wanted map[string]bool, out io.Writer) error {
+	priv, err := loadRecoveryPrivKey(privPath)
+	if err != nil {
+		return fmt.Errorf("recovery key: %w", err)
+	}
+	f, err := os.Open(exportPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(out)
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64<<10), 1<<20)
+	found := 0
+	for line := 1; sc.Scan(); line++ {
+		var rec WrappedKeyRecord
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		if len(wanted) > 0 && !wanted[rec.FileHash] {
+			continue
+		}
+		raw, err := unwrapRecord(priv, rec)
+		if err != nil {
+			return fmt.Errorf("line %d (%s): %w", line, rec.FileHash, err)
+		}
+		found++
+		if err := enc.Encode(map[string]string{
+			"file_hash": rec.FileHash,
+			"file_name": rec.FileName,
+			"node_id":   rec.NodeID,
+			"key_b64":   base64.StdEncoding.EncodeToString(raw),
+		}); err != nil {
+			return err
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	if len(wanted) > 0 && found < len(wanted) {
+		return fmt.Errorf("%d of %d requested hashes not in the export", len(wanted)-found, len(wanted))
+	}
+	return nil
+}
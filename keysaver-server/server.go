@@ -2,14 +2,20 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
+	"time"
 )
 
 // Server handles HTTP requests
 type Server struct {
-	storage *Storage
-	cfg     *Config
+	storage   *Storage
+	cfg       *Config
+	export    exportGate
+	approvals approvalGate
+	alerts    alertGate
+	health    healthCache
 }
 
 // NewServer creates a new server instance
@@ -26,28 +32,75 @@ func writeJSON(w http.ResponseWriter, status int, v any) {
 	_ = json.NewEncoder(w).Encode(v)
 }
 
-// Handler returns the HTTP handler with all routes
-func (s *Server) Handler() http.Handler {
-	mux := http.NewServeMux()
+// route is one path a listener may serve.
+type route struct {
+	path string
+	h    http.HandlerFunc
+	read bool // hands out stored keys; served by the read-only listener
+}
+
+func (s *Server) routes() []route {
+	return []route{
+		// Health check
+		{path: "/health", h: s.handleHealth, read: true},
+
+		// API description (generated from keysaverclient)
+		{path: "/openapi.json", h: s.handleOpenAPI},
+		{path: "/docs", h: s.handleDocs},
 
-	// Health check
-	mux.HandleFunc("/health", s.handleHealth)
+		// Key operations
+		{path: "/keys/save", h: s.handleSaveKey},
+		{path: "/keys/get", h: s.handleGetKey, read: true},
+		{path: "/keys/list", h: s.handleListKeys, read: true},
+		{path: "/keys/delete", h: s.handleDeleteKey},
+		{path: "/keys/revoke", h: s.handleRevokeKey},
+		{path: "/keys/approvals/{id}", h: s.handleApprovalStatus, read: true},
 
-	// Key operations
-	mux.HandleFunc("/keys/save", s.handleSaveKey)
-	mux.HandleFunc("/keys/get", s.handleGetKey)
-	mux.HandleFunc("/keys/list", s.handleListKeys)
-	mux.HandleFunc("/keys/delete", s.handleDeleteKey)
+		// Admin (admin tokens only)
+		{path: "/admin/export-wrapped", h: s.handleExportWrapped},
+		{path: "/admin/approvals", h: s.handleListApprovals},
+		{path: "/admin/approvals/{id}/approve", h: s.handleDecideApproval(true)},
+		{path: "/admin/approvals/{id}/deny", h: s.handleDecideApproval(false)},
+		{path: "/admin/approvals/audit", h: s.handleApprovalAudit},
+		{path: "/admin/approval-policy", h: s.handleApprovalPolicy},
+		{path: "/admin/incidents", h: s.handleIncidents},
+		{path: "/admin/incidents/{id}/end", h: s.handleEndIncident},
+		{path: "/admin/alerts", h: s.handleAlerts},
+		{path: "/admin/alerts/{id}/ack", h: s.handleAckAlert},
+	}
+}
+
+// Handler returns the primary listener's handler: every route, with reads
+// refused when DisableReads is set (/health stays).
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	for _, rt := range s.routes() {
+		h := rt.h
+		if rt.read && rt.path != "/health" && s.cfg.DisableReads {
+			h = readsDisabled
+		}
+		mux.HandleFunc(rt.path, h)
+	}
+	return AuthMiddleware(s.cfg.AuthTokens, s.cfg.AdminTokens, mux)
+}
 
-	// Wrap with auth middleware
-	return AuthMiddleware(s.cfg.AuthTokens, mux)
+// ReadOnlyHandler returns the --readonly-port handler: /health, /keys/get
+// and /keys/list only, checked against the read token set. Admin endpoints
+// don't exist here.
+func (s *Server) ReadOnlyHandler() http.Handler {
+	mux := http.NewServeMux()
+	for _, rt := range s.routes() {
+		if rt.read {
+			mux.HandleFunc(rt.path, rt.h)
+		}
+	}
+	return AuthMiddleware(s.cfg.ReadTokens, nil, mux)
 }
 
-// GET /health
-func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
-	writeJSON(w, http.StatusOK, map[string]string{
-		"status":  "ok",
-		"service": "keysaver-server",
+func readsDisabled(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusForbidden, ErrorResponse{
+		Status: "error",
+		Error:  "reads are disabled on this port; use the read-only listener",
 	})
 }
 
@@ -76,8 +129,29 @@ func (s *Server) handleSaveKey(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Org: a bound token pins the org; an unbound token may name one
+	org := orgFromRequest(r)
+	if org != "" && req.OrgID != "" && req.OrgID != org {
+		writeJSON(w, http.StatusForbidden, SaveKeyResponse{
+			Status:  "error",
+			Message: "token not valid for org " + req.OrgID,
+		})
+		return
+	}
+	if org == "" {
+		org = req.OrgID
+	}
+
 	// Save
-	if err := s.storage.SaveKey(req.FileHash, req.NodeID, req.KeyB64, req.FileName); err != nil {
+	confirmation, err := s.storage.SaveKey(org, req.FileHash, req.NodeID, req.KeyB64, req.FileName, req.Verified)
+	if err != nil {
+		if errors.Is(err, ErrOrgConflict) {
+			writeJSON(w, http.StatusConflict, SaveKeyResponse{
+				Status:  "error",
+				Message: "hash already stored for another org",
+			})
+			return
+		}
 		log.Printf("[save] error: %v", err)
 		writeJSON(w, http.StatusInternalServerError, SaveKeyResponse{
 			Status:  "error",
@@ -86,10 +160,11 @@ func (s *Server) handleSaveKey(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Printf("[save] hash=%s node=%s name=%s", req.FileHash, req.NodeID, req.FileName)
+	log.Printf("[save] hash=%s node=%s name=%s org=%s verified=%t", req.FileHash, req.NodeID, req.FileName, org, req.Verified)
 	writeJSON(w, http.StatusOK, SaveKeyResponse{
-		Status:   "ok",
-		FileHash: req.FileHash,
+		Status:       "ok",
+		FileHash:     req.FileHash,
+		Confirmation: confirmation,
 	})
 }
 
@@ -109,7 +184,8 @@ func (s *Server) handleGetKey(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rec, err := s.storage.GetKey(hash)
+	org := orgFromRequest(r)
+	rec, err := s.storage.GetKey(org, hash)
 	if err != nil {
 		log.Printf("[get] error: %v", err)
 		writeJSON(w, http.StatusInternalServerError, GetKeyResponse{
@@ -127,6 +203,52 @@ func (s *Server) handleGetKey(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if rec.RevokedAt != nil {
+		writeJSON(w, http.StatusGone, GetKeyResponse{
+			Status:    "revoked",
+			FileHash:  rec.FileHash,
+			FileName:  rec.FileName,
+			NodeID:    rec.OriginNodeID,
+			RevokedAt: rec.RevokedAt,
+		})
+		return
+	}
+
+	// bulk retrieval past the policy threshold waits for dual control
+	gate, err := s.gateRelease(r, org, hash)
+	if err != nil && !errors.Is(err, errApprovalFull) {
+		log.Printf("[get] approval gate: %v", err)
+		writeJSON(w, http.StatusInternalServerError, GetKeyResponse{
+			Status: "error",
+			Error:  "failed to retrieve key",
+		})
+		return
+	}
+	if !gate.release {
+		resp := GetKeyResponse{FileHash: hash, ApprovalID: gate.approval.ID}
+		switch {
+		case err != nil:
+			resp.Status, resp.Error = "error", err.Error()
+			writeJSON(w, http.StatusTooManyRequests, resp)
+		case gate.approval.State == approvalDenied:
+			resp.Status, resp.Error = approvalDenied, "bulk retrieval denied by an admin"
+			writeJSON(w, http.StatusForbidden, resp)
+		default:
+			resp.Status = statusPendingApproval
+			w.Header().Set("Retry-After", approvalPollAfter)
+			writeJSON(w, http.StatusAccepted, resp)
+		}
+		return
+	}
+
+	now := time.Now()
+	if err := s.storage.MarkRetrieved(rec.ID, now); err != nil {
+		log.Printf("[get] mark retrieved: %v", err)
+	}
+	if alerts := s.evaluateAlerts(rec, org, r.URL.Query().Get("node_id"), tokenFingerprint(bearerToken(r)), now); len(alerts) > 0 {
+		go s.raiseAlerts(alerts)
+	}
+
 	log.Printf("[get] hash=%s node=%s", hash, rec.OriginNodeID)
 	writeJSON(w, http.StatusOK, GetKeyResponse{
 		Status:   "ok",
@@ -146,19 +268,19 @@ func (s *Server) handleListKeys(w http.ResponseWriter, r *http.Request) {
 
 	nodeID := r.URL.Query().Get("node_id")
 	if nodeID == "" {
-		writeJSON(w, http.StatusBadRequest, map[string]string{
-			"status": "error",
-			"error":  "missing ?node_id parameter",
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{
+			Status: "error",
+			Error:  "missing ?node_id parameter",
 		})
 		return
 	}
 
-	records, err := s.storage.ListKeys(nodeID)
+	records, err := s.storage.ListKeys(orgFromRequest(r), nodeID)
 	if err != nil {
 		log.Printf("[list] error: %v", err)
-		writeJSON(w, http.StatusInternalServerError, map[string]string{
-			"status": "error",
-			"error":  "failed to list keys",
+		writeJSON(w, http.StatusInternalServerError, ErrorResponse{
+			Status: "error",
+			Error:  "failed to list keys",
 		})
 		return
 	}
@@ -187,34 +309,78 @@ func (s *Server) handleDeleteKey(w http.ResponseWriter, r *http.Request) {
 	nodeID := r.URL.Query().Get("node_id")
 
 	if hash == "" || nodeID == "" {
-		writeJSON(w, http.StatusBadRequest, map[string]string{
-			"status": "error",
-			"error":  "missing ?hash and ?node_id parameters",
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{
+			Status: "error",
+			Error:  "missing ?hash and ?node_id parameters",
 		})
 		return
 	}
 
-	deleted, err := s.storage.DeleteKey(hash, nodeID)
+	deleted, err := s.storage.DeleteKey(orgFromRequest(r), hash, nodeID)
 	if err != nil {
 		log.Printf("[delete] error: %v", err)
-		writeJSON(w, http.StatusInternalServerError, map[string]string{
-			"status": "error",
-			"error":  "failed to delete key",
+		writeJSON(w, http.StatusInternalServerError, ErrorResponse{
+			Status: "error",
+			Error:  "failed to delete key",
 		})
 		return
 	}
 
 	if !deleted {
-		writeJSON(w, http.StatusNotFound, map[string]string{
-			"status": "not_found",
-			"error":  "key not found or not owned by this node",
+		writeJSON(w, http.StatusNotFound, ErrorResponse{
+			Status: "not_found",
+			Error:  "key not found or not owned by this node",
 		})
 		return
 	}
 
 	log.Printf("[delete] hash=%s node=%s", hash, nodeID)
-	writeJSON(w, http.StatusOK, map[string]string{
-		"status": "ok",
-		"hash":   hash,
+	writeJSON(w, http.StatusOK, DeleteKeyResponse{
+		Status: "ok",
+		Hash:   hash,
+	})
+}
+
+// POST /keys/revoke?hash=<hash>&node_id=<id>
+func (s *Server) handleRevokeKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, `{"error":"method not allowed"}`, http.StatusMethodNotAllowed)
+		return
+	}
+
+	hash := r.URL.Query().Get("hash")
+	nodeID := r.URL.Query().Get("node_id")
+
+	if hash == "" || nodeID == "" {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{
+			Status: "error",
+			Error:  "missing ?hash and ?node_id parameters",
+		})
+		return
+	}
+
+	at, err := s.storage.RevokeKey(orgFromRequest(r), hash, nodeID)
+	if err != nil {
+		log.Printf("[revoke] error: %v", err)
+		writeJSON(w, http.StatusInternalServerError, ErrorResponse{
+			Status: "error",
+			Error:  "failed to revoke key",
+		})
+		return
+	}
+
+	if at == nil {
+		writeJSON(w, http.StatusNotFound, ErrorResponse{
+			Status: "not_found",
+			Error:  "key not found or not owned by this node",
+		})
+		return
+	}
+
+	log.Printf("[revoke] hash=%s node=%s", hash, nodeID)
+	writeJSON(w, http.StatusOK, RevokeKeyResponse{
+		Status:    "ok",
+		Hash:      hash,
+		RevokedAt: *at,
 	})
 }
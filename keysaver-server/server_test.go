@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"keysaver-server/keysaverclient"
+)
+
+// With --disable-reads the primary listener takes saves but refuses gets
+// and lists; the read-only listener serves those with its own tokens and
+// nothing else.
+func TestReadWriteListeners(t *testing.T) {
+	srv, ts := newTestKeysaver(t, func(cfg *Config) {
+		cfg.DisableReads = true
+		cfg.ReadOnlyPort = 1
+		cfg.ReadTokens = []string{"read-tok"}
+	})
+	ro := httptest.NewServer(srv.ReadOnlyHandler())
+	t.Cleanup(ro.Close)
+	ctx := context.Background()
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{3}, 32))
+
+	w := keysaverclient.New(ts.URL, testToken)
+	if _, err := w.SaveKey(ctx, keysaverclient.SaveKeyRequest{FileHash: "h", KeyB64: key, NodeID: "n"}); err != nil {
+		t.Fatalf("save on the write listener: %v", err)
+	}
+	var apiErr *keysaverclient.APIError
+	if _, err := w.GetKey(ctx, "h"); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusForbidden || !strings.Contains(apiErr.Message, "read-only listener") {
+		t.Fatalf("get on the write listener: %v", err)
+	}
+	if _, err := w.ListKeys(ctx, "n"); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusForbidden {
+		t.Fatalf("list on the write listener: %v", err)
+	}
+	if _, err := w.Health(ctx); err != nil {
+		t.Fatalf("health on the write listener: %v", err)
+	}
+
+	r := keysaverclient.New(ro.URL, "read-tok")
+	if got, err := r.GetKey(ctx, "h"); err != nil || got.KeyB64 != key {
+		t.Fatalf("get on the read listener: %+v %v", got, err)
+	}
+	if _, err := keysaverclient.New(ro.URL, testToken).GetKey(ctx, "h"); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusForbidden {
+		t.Fatalf("write token on the read listener: %v", err)
+	}
+	if _, err := r.SaveKey(ctx, keysaverclient.SaveKeyRequest{FileHash: "h2", KeyB64: key, NodeID: "n"}); !errors.Is(err, keysaverclient.ErrNotFound) {
+		t.Fatalf("save on the read listener: %v", err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, ro.URL+"/admin/approvals", nil)
+	req.Header.Set("Authorization", "Bearer read-tok")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		t.Fatal("admin route served on the read listener")
+	}
+}
+
+func TestReadsEnabledByDefault(t *testing.T) {
+	_, ts := newTestKeysaver(t, nil)
+	c := keysaverclient.New(ts.URL, testToken)
+	ctx := context.Background()
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{4}, 32))
+	if _, err := c.SaveKey(ctx, keysaverclient.SaveKeyRequest{FileHash: "h", KeyB64: key, NodeID: "n"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := c.GetKey(ctx, "h"); err != nil || got.KeyB64 != key {
+		t.Fatalf("get: %+v %v", got, err)
+	}
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"time"
@@ -15,8 +17,9 @@ import (
 
 // Storage handles encrypted key persistence
 type Storage struct {
-	db        *sql.DB
-	masterKey [32]byte
+	db         *sql.DB
+	masterKey  [32]byte
+	confirmKey [32]byte // HMAC key for escrow confirmations
 }
 
 // NewStorage creates a new storage with the given master key
@@ -30,8 +33,9 @@ func NewStorage(dbPath string, masterKeyStr string) (*Storage, error) {
 	}
 
 	s := &Storage{
-		db:        db,
-		masterKey: masterKey,
+		db:         db,
+		masterKey:  masterKey,
+		confirmKey: sha256.Sum256(append([]byte("keysaver-escrow-confirmation"), masterKey[:]...)),
 	}
 
 	if err := s.initSchema(); err != nil {
@@ -55,10 +59,81 @@ func (s *Storage) initSchema() error {
 	CREATE INDEX IF NOT EXISTS idx_file_keys_node ON file_keys(origin_node_id);
 	CREATE INDEX IF NOT EXISTS idx_file_keys_hash ON file_keys(file_hash);
 	`
-	_, err := s.db.Exec(schema)
-	return err
+	if _, err := s.db.Exec(schema); err != nil {
+		return err
+	}
+	if _, err := s.db.Exec(approvalSchema); err != nil {
+		return err
+	}
+	if _, err := s.db.Exec(alertSchema); err != nil {
+		return err
+	}
+	return s.migrateColumns()
+}
+
+// migrateColumns adds file_keys.org_id to databases created before orgs,
+// file_keys.revoked_at to ones created before revocation,
+// file_keys.last_retrieved_at to ones created before retrieval alerts, and
+// file_keys.verified_at to ones created before key usage proofs.
+func (s *Storage) migrateColumns() error {
+	cols, err := s.columns()
+	if err != nil {
+		return err
+	}
+	if !cols["org_id"] {
+		if _, err := s.db.Exec(`ALTER TABLE file_keys ADD COLUMN org_id TEXT NOT NULL DEFAULT ''`); err != nil {
+			return err
+		}
+		if _, err := s.db.Exec(`CREATE INDEX IF NOT EXISTS idx_file_keys_org ON file_keys(org_id)`); err != nil {
+			return err
+		}
+	}
+	if !cols["revoked_at"] {
+		if _, err := s.db.Exec(`ALTER TABLE file_keys ADD COLUMN revoked_at INTEGER NOT NULL DEFAULT 0`); err != nil {
+			return err
+		}
+	}
+	if !cols["last_retrieved_at"] {
+		if _, err := s.db.Exec(`ALTER TABLE file_keys ADD COLUMN last_retrieved_at INTEGER NOT NULL DEFAULT 0`); err != nil {
+			return err
+		}
+	}
+	if !cols["verified_at"] {
+		if _, err := s.db.Exec(`ALTER TABLE file_keys ADD COLUMN verified_at INTEGER NOT NULL DEFAULT 0`); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
+// columns lists the columns of file_keys.
+func (s *Storage) columns() (map[string]bool, error) {
+	rows, err := s.db.Query(`PRAGMA table_info(file_keys)`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cols := make(map[string]bool)
+	for rows.Next() {
+		var (
+			cid     int
+			name    string
+			ctype   string
+			notnull int
+			dflt    sql.NullString
+			pk      int
+		)
+		if err := rows.Scan(&cid, &name, &ctype, &notnull, &dflt, &pk); err != nil {
+			return nil, err
+		}
+		cols[name] = true
+	}
+	return cols, rows.Err()
+}
+
+// ErrOrgConflict is returned when a hash is already stored under another org.
+var ErrOrgConflict = errors.New("hash belongs to another org")
+
 // Close closes the database connection
 func (s *Storage) Close() error {
 	return s.db.Close()
@@ -97,48 +172,81 @@ func (s *Storage) decryptKey(encryptedKey []byte) ([]byte, error) {
 	return aead.Open(nil, nonce, ciphertext, nil)
 }
 
-// SaveKey stores an encrypted key
-func (s *Storage) SaveKey(fileHash, nodeID, keyB64, fileName string) error {
+// confirmation binds org, hash, node and key into the token /keys/save
+// hands out. Nodes put it in their escrow receipts; /keys/list repeats it
+// while the stored key is unchanged, so an audit can match the two.
+func (s *Storage) confirmation(org, fileHash, nodeID string, rawKey []byte) string {
+	kh := sha256.Sum256(rawKey)
+	m := hmac.New(sha256.New, s.confirmKey[:])
+	m.Write([]byte(org + "\x00" + fileHash + "\x00" + nodeID + "\x00"))
+	m.Write(kh[:])
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// SaveKey stores an encrypted key under org and returns its confirmation.
+// verified is the node's word that the key opened its chunk; a save without
+// it clears an earlier one, since the key may have changed.
+func (s *Storage) SaveKey(org, fileHash, nodeID, keyB64, fileName string, verified bool) (string, error) {
 	// Decode the key
 	rawKey, err := base64.RawURLEncoding.DecodeString(keyB64)
 	if err != nil {
 		// Try standard base64
 		rawKey, err = base64.StdEncoding.DecodeString(keyB64)
 		if err != nil {
-			return fmt.Errorf("decode key: %w", err)
+			return "", fmt.Errorf("decode key: %w", err)
 		}
 	}
 
 	// Encrypt with master key
 	encryptedKey, err := s.encryptKey(rawKey)
 	if err != nil {
-		return fmt.Errorf("encrypt key: %w", err)
+		return "", fmt.Errorf("encrypt key: %w", err)
 	}
 
-	// Insert or update
+	// Insert or update (never across orgs)
 	query := `
-	INSERT INTO file_keys (file_hash, origin_node_id, key_encrypted, file_name, created_at)
-	VALUES (?, ?, ?, ?, ?)
+	INSERT INTO file_keys (file_hash, origin_node_id, key_encrypted, file_name, created_at, org_id, verified_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?)
 	ON CONFLICT(file_hash) DO UPDATE SET
 		key_encrypted = excluded.key_encrypted,
-		file_name = excluded.file_name
+		file_name = excluded.file_name,
+		revoked_at = 0,
+		verified_at = excluded.verified_at
+	WHERE file_keys.org_id = excluded.org_id
 	`
-	_, err = s.db.Exec(query, fileHash, nodeID, encryptedKey, fileName, time.Now().Unix())
-	return err
+	now := time.Now().Unix()
+	var verifiedUnix int64
+	if verified {
+		verifiedUnix = now
+	}
+	res, err := s.db.Exec(query, fileHash, nodeID, encryptedKey, fileName, now, org, verifiedUnix)
+	if err != nil {
+		return "", err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return "", ErrOrgConflict
+	}
+	// the row keeps its first origin node on update
+	var origin string
+	if err := s.db.QueryRow(`SELECT origin_node_id FROM file_keys WHERE file_hash = ?`, fileHash).Scan(&origin); err != nil {
+		return "", err
+	}
+	return s.confirmation(org, fileHash, origin, rawKey), nil
 }
 
-// GetKey retrieves and decrypts a key by file hash
-func (s *Storage) GetKey(fileHash string) (*FileKeyRecord, error) {
-	query := `SELECT id, file_hash, origin_node_id, key_encrypted, file_name, created_at 
-	          FROM file_keys WHERE file_hash = ?`
+// GetKey retrieves and decrypts a key by file hash. org "" matches any org.
+// A revoked key comes back with RevokedAt set and no key material.
+func (s *Storage) GetKey(org, fileHash string) (*FileKeyRecord, error) {
+	query := `SELECT id, file_hash, origin_node_id, key_encrypted, file_name, created_at, org_id, revoked_at, last_retrieved_at, verified_at
+	          FROM file_keys WHERE file_hash = ? AND (? = '' OR org_id = ?)`
 
 	var rec FileKeyRecord
 	var encryptedKey []byte
-	var createdUnix int64
+	var createdUnix, revokedUnix, retrievedUnix, verifiedUnix int64
 
-	err := s.db.QueryRow(query, fileHash).Scan(
+	err := s.db.QueryRow(query, fileHash, org, org).Scan(
 		&rec.ID, &rec.FileHash, &rec.OriginNodeID,
-		&encryptedKey, &rec.FileName, &createdUnix,
+		&encryptedKey, &rec.FileName, &createdUnix, &rec.OrgID, &revokedUnix, &retrievedUnix, &verifiedUnix,
 	)
 	if err == sql.ErrNoRows {
 		return nil, nil
@@ -146,6 +254,13 @@ func (s *Storage) GetKey(fileHash string) (*FileKeyRecord, error) {
 	if err != nil {
 		return nil, err
 	}
+	rec.CreatedAt = time.Unix(createdUnix, 0)
+	rec.LastRetrievedAt = unixTime(retrievedUnix)
+	rec.VerifiedAt = unixTime(verifiedUnix)
+	if revokedUnix != 0 {
+		rec.RevokedAt = unixTime(revokedUnix)
+		return &rec, nil
+	}
 
 	// Decrypt the key
 	rawKey, err := s.decryptKey(encryptedKey)
@@ -154,16 +269,16 @@ func (s *Storage) GetKey(fileHash string) (*FileKeyRecord, error) {
 	}
 
 	rec.KeyB64 = base64.StdEncoding.EncodeToString(rawKey)
-	rec.CreatedAt = time.Unix(createdUnix, 0)
 	return &rec, nil
 }
 
-// ListKeys returns all keys for a given node
-func (s *Storage) ListKeys(nodeID string) ([]FileKeyRecord, error) {
-	query := `SELECT id, file_hash, origin_node_id, file_name, created_at 
-	          FROM file_keys WHERE origin_node_id = ? ORDER BY created_at DESC`
+// ListKeys returns all keys for a given node, each live one with its
+// confirmation. org "" matches any org.
+func (s *Storage) ListKeys(org, nodeID string) ([]FileKeyRecord, error) {
+	query := `SELECT id, file_hash, origin_node_id, key_encrypted, file_name, created_at, org_id, revoked_at, last_retrieved_at, verified_at
+	          FROM file_keys WHERE origin_node_id = ? AND (? = '' OR org_id = ?) ORDER BY created_at DESC`
 
-	rows, err := s.db.Query(query, nodeID)
+	rows, err := s.db.Query(query, nodeID, org, org)
 	if err != nil {
 		return nil, err
 	}
@@ -172,22 +287,31 @@ func (s *Storage) ListKeys(nodeID string) ([]FileKeyRecord, error) {
 	var records []FileKeyRecord
 	for rows.Next() {
 		var rec FileKeyRecord
-		var createdUnix int64
-		if err := rows.Scan(&rec.ID, &rec.FileHash, &rec.OriginNodeID, &rec.FileName, &createdUnix); err != nil {
+		var encryptedKey []byte
+		var createdUnix, revokedUnix, retrievedUnix, verifiedUnix int64
+		if err := rows.Scan(&rec.ID, &rec.FileHash, &rec.OriginNodeID, &encryptedKey, &rec.FileName, &createdUnix, &rec.OrgID, &revokedUnix, &retrievedUnix, &verifiedUnix); err != nil {
 			return nil, err
 		}
 		rec.CreatedAt = time.Unix(createdUnix, 0)
+		rec.RevokedAt = unixTime(revokedUnix)
+		rec.LastRetrievedAt = unixTime(retrievedUnix)
+		rec.VerifiedAt = unixTime(verifiedUnix)
+		if rec.RevokedAt == nil {
+			if rawKey, err := s.decryptKey(encryptedKey); err == nil {
+				rec.Confirmation = s.confirmation(rec.OrgID, rec.FileHash, rec.OriginNodeID, rawKey)
+			}
+		}
 		records = append(records, rec)
 	}
 
 	return records, rows.Err()
 }
 
-// DeleteKey removes a key by file hash (only if caller is owner)
-func (s *Storage) DeleteKey(fileHash, nodeID string) (bool, error) {
+// DeleteKey removes a key by file hash (only if caller is owner). org "" matches any org.
+func (s *Storage) DeleteKey(org, fileHash, nodeID string) (bool, error) {
 	result, err := s.db.Exec(
-		"DELETE FROM file_keys WHERE file_hash = ? AND origin_node_id = ?",
-		fileHash, nodeID,
+		"DELETE FROM file_keys WHERE file_hash = ? AND origin_node_id = ? AND (? = '' OR org_id = ?)",
+		fileHash, nodeID, org, org,
 	)
 	if err != nil {
 		return false, err
@@ -196,3 +320,89 @@ func (s *Storage) DeleteKey(fileHash, nodeID string) (bool, error) {
 	affected, _ := result.RowsAffected()
 	return affected > 0, nil
 }
+
+// RevokeKey soft-deletes a key (only if caller is owner): the row stays, so
+// an admin export still covers it, but /keys/get answers 410. Revoking
+// twice keeps the first time. org "" matches any org.
+func (s *Storage) RevokeKey(org, fileHash, nodeID string) (*time.Time, error) {
+	_, err := s.db.Exec(
+		`UPDATE file_keys SET revoked_at = ? WHERE file_hash = ? AND origin_node_id = ? AND (? = '' OR org_id = ?) AND revoked_at = 0`,
+		time.Now().Unix(), fileHash, nodeID, org, org,
+	)
+	if err != nil {
+		return nil, err
+	}
+	var revokedUnix int64
+	err = s.db.QueryRow(
+		`SELECT revoked_at FROM file_keys WHERE file_hash = ? AND origin_node_id = ? AND (? = '' OR org_id = ?)`,
+		fileHash, nodeID, org, org,
+	).Scan(&revokedUnix)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return unixTime(revokedUnix), nil
+}
+
+// unixTime is a nullable seconds column: 0 means never.
+func unixTime(unix int64) *time.Time {
+	if unix == 0 {
+		return nil
+	}
+	t := time.Unix(unix, 0)
+	return &t
+}
+
+// EachKey decrypts every key (of org, or all orgs if "") in id order,
+// fetching batch rows at a time so the whole table is never in memory.
+// Plaintext keys only ever live in fn's arguments.
+func (s *Storage) EachKey(org string, batch int, fn func(rec FileKeyRecord, rawKey []byte) error) (int, error) {
+	query := `SELECT id, file_hash, origin_node_id, key_encrypted, file_name, created_at, org_id
+	          FROM file_keys WHERE id > ? AND (? = '' OR org_id = ?) ORDER BY id LIMIT ?`
+	var lastID int64
+	n := 0
+	for {
+		rows, err := s.db.Query(query, lastID, org, org, batch)
+		if err != nil {
+			return n, err
+		}
+		type row struct {
+			rec FileKeyRecord
+			enc []byte
+		}
+		var page []row
+		for rows.Next() {
+			var r row
+			var createdUnix int64
+			if err := rows.Scan(&r.rec.ID, &r.rec.FileHash, &r.rec.OriginNodeID, &r.enc, &r.rec.FileName, &createdUnix, &r.rec.OrgID); err != nil {
+				rows.Close()
+				return n, err
+			}
+			r.rec.CreatedAt = time.Unix(createdUnix, 0)
+			page = append(page, r)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return n, err
+		}
+		for _, r := range page {
+			rawKey, err := s.decryptKey(r.enc)
+			if err != nil {
+				return n, fmt.Errorf("decrypt key %s: %w", r.rec.FileHash, err)
+			}
+			err = fn(r.rec, rawKey)
+			clear(rawKey)
+			if err != nil {
+				return n, err
+			}
+			n++
+			lastID = r.rec.ID
+		}
+		if len(page) < batch {
+			return n, nil
+		}
+	}
+}